@@ -80,6 +80,12 @@ func TestElements(t *testing.T) {
 			So(err, ShouldBeNil)
 		})
 
+		Convey("Given that I list the keys of the cache, I should get the keys of all the elements", func() {
+			So(c.KeyList(), ShouldHaveLength, 2)
+			So(c.KeyList(), ShouldContain, id)
+			So(c.KeyList(), ShouldContain, newid)
+		})
+
 		Convey("Given that I have an element in the cache, I should be able to delete it", func() {
 			err := c.Remove(id)
 			So(err, ShouldBeNil)
@@ -7,25 +7,24 @@ import (
 )
 
 // CollectorImpl : This is a local implementation for the collector interface
-// It has a flow entries cache which contains unique flows that are reported back to the
-// controller/launcher process
+// It has a list of the flow entries that are reported back to the controller/launcher
+// process. The entries are not merged, so that the controller gets the detail of every
+// flow, as it does from a local enforcer.
 type CollectorImpl struct {
-	Flows map[string]*collector.FlowRecord
+	Flows []*collector.FlowRecord
 	sync.Mutex
 }
 
 // NewCollector creates a new remote collector for statistics
 func NewCollector() *CollectorImpl {
 	return &CollectorImpl{
-		Flows: map[string]*collector.FlowRecord{},
+		Flows: []*collector.FlowRecord{},
 	}
 }
 
 // CollectFlowEvent collects a new flow event and adds it to a local list it shares with SendStats
 func (c *CollectorImpl) CollectFlowEvent(record *collector.FlowRecord) {
 
-	hash := collector.StatsFlowHash(record)
-
 	// If flow event doesn't have a count make it equal to 1. At least one flow is collected
 	if record.Count == 0 {
 		record.Count = 1
@@ -34,14 +33,7 @@ func (c *CollectorImpl) CollectFlowEvent(record *collector.FlowRecord) {
 	c.Lock()
 	defer c.Unlock()
 
-	if r, ok := c.Flows[hash]; ok {
-		r.Count = r.Count + record.Count
-		return
-	}
-
-	c.Flows[hash] = record
-
-	c.Flows[hash].Tags = record.Tags
+	c.Flows = append(c.Flows, record)
 }
 
 //CollectContainerEvent exported
@@ -21,7 +21,7 @@ func TestNewCollector(t *testing.T) {
 func TestCollectFlowEvent(t *testing.T) {
 	Convey("Given a stats collector", t, func() {
 		c := &CollectorImpl{
-			Flows: map[string]*collector.FlowRecord{},
+			Flows: []*collector.FlowRecord{},
 		}
 
 		Convey("When I add a flow event", func() {
@@ -43,19 +43,20 @@ func TestCollectFlowEvent(t *testing.T) {
 			}
 			c.CollectFlowEvent(r)
 
-			Convey("The flow should be in the cache", func() {
+			Convey("The flow should be in the list", func() {
 				So(len(c.Flows), ShouldEqual, 1)
-				So(c.Flows[collector.StatsFlowHash(r)], ShouldNotBeNil)
-				So(c.Flows[collector.StatsFlowHash(r)].Count, ShouldEqual, 1)
+				So(c.Flows[0], ShouldEqual, r)
+				So(c.Flows[0].Count, ShouldEqual, 1)
 			})
 
 			Convey("When I add a second flow that matches", func() {
-				r := &collector.FlowRecord{
+				second := &collector.FlowRecord{
 					ContextID: "1",
 					Source: &collector.EndPoint{
 						ID:   "A",
 						IP:   "1.1.1.1",
 						Type: collector.PU,
+						Port: 3000,
 					},
 					Destination: &collector.EndPoint{
 						ID:   "B",
@@ -66,36 +67,40 @@ func TestCollectFlowEvent(t *testing.T) {
 					Count: 10,
 					Tags:  policy.NewTagStore(),
 				}
-				c.CollectFlowEvent(r)
-				Convey("The flow should be in the cache", func() {
-					So(len(c.Flows), ShouldEqual, 1)
-					So(c.Flows[collector.StatsFlowHash(r)], ShouldNotBeNil)
-					So(c.Flows[collector.StatsFlowHash(r)].Count, ShouldEqual, 11)
+				c.CollectFlowEvent(second)
+
+				Convey("Both flows should be kept with their own detail", func() {
+					So(len(c.Flows), ShouldEqual, 2)
+					So(c.Flows[0].Count, ShouldEqual, 1)
+					So(c.Flows[1].Count, ShouldEqual, 10)
+					So(c.Flows[1].Source.Port, ShouldEqual, 3000)
 				})
 			})
 
-			Convey("When I add a third flow that doesn't  matche the previous flows ", func() {
-				r := &collector.FlowRecord{
+			Convey("When I add the final record of the flow", func() {
+				final := &collector.FlowRecord{
 					ContextID: "1",
 					Source: &collector.EndPoint{
-						ID:   "C",
-						IP:   "3.3.3.3",
+						ID:   "A",
+						IP:   "1.1.1.1",
 						Type: collector.PU,
 					},
 					Destination: &collector.EndPoint{
-						ID:   "D",
-						IP:   "4.4.4.4",
+						ID:   "B",
+						IP:   "2.2.2.2",
 						Type: collector.PU,
 						Port: 80,
 					},
-					Count: 33,
-					Tags:  policy.NewTagStore(),
+					Tags:     policy.NewTagStore(),
+					Counters: &collector.FlowCounters{SourceBytes: 100, SourcePackets: 1},
+					Final:    true,
 				}
-				c.CollectFlowEvent(r)
-				Convey("The flow should be in the cache", func() {
+				c.CollectFlowEvent(final)
+
+				Convey("It should be kept with its counters", func() {
 					So(len(c.Flows), ShouldEqual, 2)
-					So(c.Flows[collector.StatsFlowHash(r)], ShouldNotBeNil)
-					So(c.Flows[collector.StatsFlowHash(r)].Count, ShouldEqual, 33)
+					So(c.Flows[1].Final, ShouldBeTrue)
+					So(c.Flows[1].Counters, ShouldResemble, &collector.FlowCounters{SourceBytes: 100, SourcePackets: 1})
 				})
 			})
 		})
@@ -49,6 +49,24 @@ func (s *Server) InitEnforcer(req rpcwrapper.Request, resp *rpcwrapper.Response)
 	return nil
 }
 
+// UpdateSecrets is a function called from the controller over RPC. It replaces the secrets
+// of the enforcer created during initenforcer
+func (s *Server) UpdateSecrets(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+	return nil
+}
+
+// Status is a function called from the controller over RPC. It returns the health
+// of the enforcer created during initenforcer
+func (s *Server) Status(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+	return nil
+}
+
+// Ping is a function called from the controller over RPC to check that the remote
+// enforcer is responsive
+func (s *Server) Ping(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+	return nil
+}
+
 // InitSupervisor is a function called from the controller over RPC. It initializes data structure required by the supervisor
 func (s *Server) InitSupervisor(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
 	return nil
@@ -75,6 +93,11 @@ func (s *Server) Enforce(req rpcwrapper.Request, resp *rpcwrapper.Response) erro
 	return nil
 }
 
+// Batch enforces and supervises the policies of the payload
+func (s *Server) Batch(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+	return nil
+}
+
 // EnforcerExit this method is called when  we received a killrpocess message from the controller
 // This allows a graceful exit of the enforcer
 func (s *Server) EnforcerExit(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
@@ -9,7 +9,6 @@ package remoteenforcer
 import "C"
 
 import (
-	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"os"
@@ -19,6 +18,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 
@@ -28,6 +28,7 @@ import (
 	"github.com/aporeto-inc/trireme/constants"
 	"github.com/aporeto-inc/trireme/enforcer"
 	_ "github.com/aporeto-inc/trireme/enforcer/utils/nsenter" // nolint
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
 	"github.com/aporeto-inc/trireme/enforcer/utils/rpcwrapper"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
 	"github.com/aporeto-inc/trireme/policy"
@@ -55,6 +56,7 @@ type Server struct {
 	Supervisor     supervisor.Supervisor
 	Service        enforcer.PacketProcessor
 	secrets        secrets.Secrets
+	revocation     *revocation.Checker
 }
 
 var cmdLock sync.Mutex
@@ -157,74 +159,40 @@ func (s *Server) InitEnforcer(req rpcwrapper.Request, resp *rpcwrapper.Response)
 
 	if s.Enforcer == nil {
 		payload := req.Payload.(rpcwrapper.InitRequestPayload)
-		switch payload.SecretType {
-		case secrets.PKIType:
-			// PKI params
-			s.secrets, err = secrets.NewPKISecrets(payload.PrivatePEM, payload.PublicPEM, payload.CAPEM, map[string]*ecdsa.PublicKey{})
-			if err != nil {
-				return fmt.Errorf("Failed to initialize secrets")
-			}
-			s.Enforcer = enforcer.New(
-				payload.MutualAuth,
-				payload.FqConfig,
-				s.statsclient.(*StatsClient).collector,
-				s.Service,
-				s.secrets,
-				payload.ServerID,
-				payload.Validity,
-				constants.RemoteContainer,
-				s.procMountPoint,
-			)
-		case secrets.PSKType:
-			// PSK params
-			s.secrets = secrets.NewPSKSecrets(payload.PrivatePEM)
-			s.Enforcer = enforcer.New(
-				payload.MutualAuth,
-				payload.FqConfig,
-				s.statsclient.(*StatsClient).collector,
-				s.Service,
-				s.secrets,
-				payload.ServerID,
-				payload.Validity,
-				constants.RemoteContainer,
-				s.procMountPoint,
-			)
-		case secrets.PKICompactType:
-			// Compact PKI Parameters
-			s.secrets, err = secrets.NewCompactPKI(payload.PrivatePEM, payload.PublicPEM, payload.CAPEM, payload.Token)
-			if err != nil {
-				return fmt.Errorf("Failed to initialize secrets")
+		initSecrets, err := secretsFromPEM(payload.SecretType, payload.PrivatePEM, payload.PublicPEM, payload.CAPEM, payload.Token, payload.SPIFFE)
+		if err != nil {
+			return fmt.Errorf("Failed to initialize secrets")
+		}
+		checker, err := enableRevocation(initSecrets, payload.Revocation, payload.CAPEM)
+		if err != nil {
+			return fmt.Errorf("Failed to initialize revocation checks: %s", err)
+		}
+		s.revocation = checker
+		// The secrets are shared with the service so that it sees the updates
+		s.secrets = secrets.NewRotatingSecrets(initSecrets)
+		e := enforcer.New(
+			payload.MutualAuth,
+			payload.FqConfig,
+			s.statsclient.(*StatsClient).collector,
+			s.Service,
+			s.secrets,
+			payload.ServerID,
+			payload.Validity,
+			constants.RemoteContainer,
+			s.procMountPoint,
+			payload.TokenType,
+		)
+		// Replayed Syn tokens are rejected if the controller configured it
+		if payload.Replay != nil {
+			protector, ok := e.(enforcer.ReplayProtector)
+			if !ok {
+				return fmt.Errorf("Enforcer does not support replay protection")
 			}
-			s.Enforcer = enforcer.New(
-				payload.MutualAuth,
-				payload.FqConfig,
-				s.statsclient.(*StatsClient).collector,
-				s.Service,
-				s.secrets,
-				payload.ServerID,
-				payload.Validity,
-				constants.RemoteContainer,
-				s.procMountPoint,
-			)
-		case secrets.PKINull:
-			// Null Encryption
-			zap.L().Info("Using Null Secrets")
-			s.secrets, err = secrets.NewNullPKI(payload.PrivatePEM, payload.PublicPEM, payload.CAPEM)
-			if err != nil {
-				return fmt.Errorf("Failed to initialize secrets")
+			if err := protector.EnableReplayProtection(payload.Replay); err != nil {
+				return err
 			}
-			s.Enforcer = enforcer.New(
-				payload.MutualAuth,
-				payload.FqConfig,
-				s.statsclient.(*StatsClient).collector,
-				s.Service,
-				s.secrets,
-				payload.ServerID,
-				payload.Validity,
-				constants.RemoteContainer,
-				s.procMountPoint,
-			)
 		}
+		s.Enforcer = e
 	}
 	s.Enforcer.Start()
 
@@ -235,6 +203,170 @@ func (s *Server) InitEnforcer(req rpcwrapper.Request, resp *rpcwrapper.Response)
 	return nil
 }
 
+// secretsFromPEM creates the secrets of the given type from the key material
+// sent by the controller. The SPIFFE secrets are fetched from the workload API
+// instead, so that they are rotated with the SVID.
+func secretsFromPEM(secretType secrets.PrivateSecretsType, privatePEM, publicPEM, caPEM, token []byte, spiffeSocket string) (secrets.Secrets, error) {
+
+	switch secretType {
+	case secrets.PKIType:
+		// PKI params
+		return secrets.NewPKISecrets(privatePEM, publicPEM, caPEM, map[string]interface{}{})
+	case secrets.PSKType:
+		// PSK params
+		return secrets.NewPSKSecrets(privatePEM), nil
+	case secrets.PKICompactType:
+		// Compact PKI Parameters
+		return secrets.NewCompactPKI(privatePEM, publicPEM, caPEM, token)
+	case secrets.PKINull:
+		// Null Encryption
+		zap.L().Info("Using Null Secrets")
+		return secrets.NewNullPKI(privatePEM, publicPEM, caPEM)
+	case secrets.PKISPIFFEType:
+		// SPIFFE workload API
+		return secrets.NewSPIFFESecrets(spiffeSocket)
+	default:
+		return nil, fmt.Errorf("Unknown secrets type %d", secretType)
+	}
+}
+
+// enableRevocation starts the revocation checks of the secrets if the controller
+// configured them
+func enableRevocation(s secrets.Secrets, config *revocation.Config, caPEM []byte) (*revocation.Checker, error) {
+
+	if config == nil {
+		return nil, nil
+	}
+
+	r, ok := s.(secrets.RevocationChecking)
+	if !ok {
+		return nil, fmt.Errorf("Secrets type %d does not support revocation checks", s.Type())
+	}
+
+	checker, err := revocation.NewChecker(config, caPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	checker.Start()
+	r.SetRevocation(checker)
+
+	return checker, nil
+}
+
+// stopSecrets stops the secrets that watch the SPIFFE workload API
+func stopSecrets(s secrets.Secrets) {
+
+	if spiffe, ok := s.(*secrets.SPIFFESecrets); ok {
+		spiffe.Stop()
+	}
+}
+
+// UpdateSecrets is a function called from the controller over RPC. It replaces the secrets
+// of the enforcer created during initenforcer
+func (s *Server) UpdateSecrets(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+
+	if !s.rpchdl.CheckValidity(&req, s.rpcSecret) {
+		resp.Status = ("UpdateSecrets message authentication failed")
+		return errors.New(resp.Status)
+	}
+
+	cmdLock.Lock()
+	defer cmdLock.Unlock()
+
+	updater, ok := s.Enforcer.(enforcer.SecretsUpdater)
+	if !ok {
+		resp.Status = ("Enforcer does not support secrets updates")
+		return errors.New(resp.Status)
+	}
+
+	payload := req.Payload.(rpcwrapper.UpdateSecretsPayload)
+	newSecrets, err := secretsFromPEM(payload.SecretType, payload.PrivatePEM, payload.PublicPEM, payload.CAPEM, payload.Token, payload.SPIFFE)
+	if err != nil {
+		resp.Status = err.Error()
+		return fmt.Errorf("Failed to load secrets: %s", err)
+	}
+
+	checker, err := enableRevocation(newSecrets, payload.Revocation, payload.CAPEM)
+	if err != nil {
+		resp.Status = err.Error()
+		return fmt.Errorf("Failed to load revocation checks: %s", err)
+	}
+
+	var previousSecrets secrets.Secrets
+	if rotating, ok := s.secrets.(*secrets.RotatingSecrets); ok {
+		previousSecrets = rotating.Current()
+	}
+
+	if err := updater.UpdateSecrets(newSecrets, payload.Overlap); err != nil {
+		if checker != nil {
+			checker.Stop()
+		}
+		stopSecrets(newSecrets)
+		resp.Status = err.Error()
+		return err
+	}
+
+	// The previous SVID is still used during the overlap window, but it is
+	// not rotated anymore
+	stopSecrets(previousSecrets)
+
+	// The previous checker is still used by the previous secrets until
+	// the end of the overlap window
+	if previous := s.revocation; previous != nil {
+		time.AfterFunc(payload.Overlap, previous.Stop)
+	}
+	s.revocation = checker
+
+	resp.Status = ""
+
+	return nil
+}
+
+// Status is a function called from the controller over RPC. It returns the health
+// of the enforcer created during initenforcer
+func (s *Server) Status(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+
+	if !s.rpchdl.CheckValidity(&req, s.rpcSecret) {
+		resp.Status = ("Status message authentication failed")
+		return errors.New(resp.Status)
+	}
+
+	cmdLock.Lock()
+	defer cmdLock.Unlock()
+
+	reporter, ok := s.Enforcer.(enforcer.StatusReporter)
+	if !ok {
+		resp.Status = ("Enforcer is not initialized or does not report its status")
+		return errors.New(resp.Status)
+	}
+
+	status, err := reporter.Status()
+	if err != nil {
+		resp.Status = err.Error()
+		return err
+	}
+
+	resp.Payload = rpcwrapper.StatusResponsePayload{Status: status}
+	resp.Status = ""
+
+	return nil
+}
+
+// Ping is a function called from the controller over RPC to check that the remote
+// enforcer is responsive. It does not wait for the other calls to complete.
+func (s *Server) Ping(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+
+	if !s.rpchdl.CheckValidity(&req, s.rpcSecret) {
+		resp.Status = ("Ping message authentication failed")
+		return errors.New(resp.Status)
+	}
+
+	resp.Status = ""
+
+	return nil
+}
+
 // InitSupervisor is a function called from the controller over RPC. It initializes data structure required by the supervisor
 func (s *Server) InitSupervisor(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
 
@@ -253,15 +385,20 @@ func (s *Server) InitSupervisor(req rpcwrapper.Request, resp *rpcwrapper.Respons
 			//TO DO
 			return fmt.Errorf("IPSets not supported yet")
 		default:
+			implementation := constants.IPTables
+			if payload.CaptureMethod == rpcwrapper.NFTables {
+				implementation = constants.NFTables
+			}
+
 			supervisorHandle, err := supervisor.NewSupervisor(
 				s.statsclient.(*StatsClient).collector,
 				s.Enforcer,
 				constants.RemoteContainer,
-				constants.IPTables,
+				implementation,
 				payload.TriremeNetworks,
 			)
 			if err != nil {
-				zap.L().Error("Failed to instantiate the iptables supervisor", zap.Error(err))
+				zap.L().Error("Failed to instantiate the supervisor", zap.Error(err))
 				return err
 			}
 			s.Supervisor = supervisorHandle
@@ -293,6 +430,18 @@ func (s *Server) Supervise(req rpcwrapper.Request, resp *rpcwrapper.Response) er
 	defer cmdLock.Unlock()
 
 	payload := req.Payload.(rpcwrapper.SuperviseRequestPayload)
+	if err := s.supervise(payload); err != nil {
+		resp.Status = err.Error()
+		return err
+	}
+
+	return nil
+
+}
+
+// supervise supervises a PU with the policy of the payload
+func (s *Server) supervise(payload rpcwrapper.SuperviseRequestPayload) error {
+
 	pupolicy := policy.NewPUPolicy(payload.ManagementID,
 		payload.TriremeAction,
 		payload.ApplicationACLs,
@@ -304,6 +453,7 @@ func (s *Server) Supervise(req rpcwrapper.Request, resp *rpcwrapper.Response) er
 		payload.PolicyIPs,
 		payload.TriremeNetworks,
 		payload.ExcludedNetworks)
+	pupolicy.SetFailurePolicy(payload.FailurePolicy)
 
 	runtime := policy.NewPURuntimeWithDefaults()
 
@@ -320,12 +470,10 @@ func (s *Server) Supervise(req rpcwrapper.Request, resp *rpcwrapper.Response) er
 			zap.String("ContextID", payload.ContextID),
 			zap.Error(err),
 		)
-		resp.Status = err.Error()
 		return err
 	}
 
 	return nil
-
 }
 
 //Unenforce this method calls the unenforce method on the enforcer created from initenforcer
@@ -370,6 +518,18 @@ func (s *Server) Enforce(req rpcwrapper.Request, resp *rpcwrapper.Response) erro
 	defer cmdLock.Unlock()
 
 	payload := req.Payload.(rpcwrapper.EnforcePayload)
+	if err := s.enforce(payload); err != nil {
+		resp.Status = err.Error()
+		return err
+	}
+
+	resp.Status = ""
+
+	return nil
+}
+
+// enforce enforces the policy of the payload
+func (s *Server) enforce(payload rpcwrapper.EnforcePayload) error {
 
 	pupolicy := policy.NewPUPolicy(payload.ManagementID,
 		payload.TriremeAction,
@@ -382,6 +542,7 @@ func (s *Server) Enforce(req rpcwrapper.Request, resp *rpcwrapper.Response) erro
 		payload.PolicyIPs,
 		payload.TriremeNetworks,
 		payload.ExcludedNetworks)
+	pupolicy.SetFailurePolicy(payload.FailurePolicy)
 
 	runtime := policy.NewPURuntimeWithDefaults()
 	puInfo := policy.PUInfoFromPolicyAndRuntime(payload.ContextID, pupolicy, runtime)
@@ -392,13 +553,60 @@ func (s *Server) Enforce(req rpcwrapper.Request, resp *rpcwrapper.Response) erro
 		zap.L().Fatal("Enforcer not inited")
 	}
 	if err := s.Enforcer.Enforce(payload.ContextID, puInfo); err != nil {
-		resp.Status = err.Error()
 		return err
 	}
 
 	zap.L().Debug("Enforcer enabled", zap.String("contextID", payload.ContextID))
 
+	return nil
+}
+
+// Batch is a function called from the controller over RPC. It enforces and then
+// supervises the policies of the payload, and reports the errors by context ID.
+// A PU whose policy fails to be enforced is not supervised. The call only fails
+// when the batch can not be processed at all.
+func (s *Server) Batch(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+
+	if !s.rpchdl.CheckValidity(&req, s.rpcSecret) {
+		resp.Status = ("Batch Message Auth Failed")
+		return errors.New(resp.Status)
+	}
+
+	cmdLock.Lock()
+	defer cmdLock.Unlock()
+
+	payload := req.Payload.(rpcwrapper.BatchPayload)
+
+	if s.Enforcer == nil || (len(payload.Supervise) > 0 && s.Supervisor == nil) {
+		resp.Status = ("Enforcer or supervisor is not initialized")
+		return errors.New(resp.Status)
+	}
+
+	report := rpcwrapper.BatchResponsePayload{Errors: map[string]string{}}
+
+	for _, p := range payload.Enforce {
+		if err := s.enforce(p); err != nil {
+			report.Errors[p.ContextID] = err.Error()
+		}
+	}
+
+	for _, p := range payload.Supervise {
+		if _, failed := report.Errors[p.ContextID]; failed {
+			continue
+		}
+		if err := s.supervise(p); err != nil {
+			report.Errors[p.ContextID] = err.Error()
+		}
+	}
+
+	resp.Payload = report
+
+	// The response is not sent back when the call fails, so the PUs that
+	// failed are only reported in the payload
 	resp.Status = ""
+	if len(report.Errors) > 0 {
+		resp.Status = fmt.Sprintf("Batch failed for %d PUs", len(report.Errors))
+	}
 
 	return nil
 }
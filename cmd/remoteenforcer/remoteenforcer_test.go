@@ -735,6 +735,96 @@ func TestEnforce(t *testing.T) {
 	})
 }
 
+func TestBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("When I create a new server", t, func() {
+		rpcHdl := mockrpcwrapper.NewMockRPCServer(ctrl)
+		mockEnf := mockenforcer.NewMockPolicyEnforcer(ctrl)
+		mockSup := mockinterfaces.NewMockSupervisor(ctrl)
+		mockStats := mockstats.NewMockStats(ctrl)
+
+		var service enforcer.PacketProcessor
+		server, err := NewServer(service, rpcHdl, "/tmp/test.sock", "T6UYZGcKW-aum_vi-XakafF3vHV7F6x8wdofZs7akGU=", mockStats)
+		So(err, ShouldBeNil)
+		server.Enforcer = mockEnf
+
+		other := initTestEnfPayload()
+		other.ContextID = "other"
+
+		var rpcwrperreq rpcwrapper.Request
+		var rpcwrperres rpcwrapper.Response
+		rpcwrperreq.Payload = rpcwrapper.BatchPayload{
+			Enforce:   []rpcwrapper.EnforcePayload{initTestEnfPayload(), other},
+			Supervise: []rpcwrapper.SuperviseRequestPayload{initTestSupPayload()},
+		}
+
+		Convey("When I send a batch with an invalid secret", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(false)
+
+			err := server.Batch(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get error", func() {
+				So(err, ShouldResemble, fmt.Errorf("Batch Message Auth Failed"))
+			})
+		})
+
+		Convey("When I send a batch before the supervisor is initialized", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(true)
+
+			err := server.Batch(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I send a batch", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(true)
+			server.Supervisor = mockSup
+
+			calls := []string{}
+			record := func(contextID string, puInfo *policy.PUInfo) {
+				calls = append(calls, contextID)
+			}
+			mockEnf.EXPECT().Enforce("b06f47830f64", gomock.Any()).Times(1).Do(record).Return(nil)
+			mockEnf.EXPECT().Enforce("other", gomock.Any()).Times(1).Do(record).Return(nil)
+			mockSup.EXPECT().Supervise("ac0d3577e808", gomock.Any()).Times(1).Do(record).Return(nil)
+
+			err := server.Batch(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then the policies should be enforced and then supervised", func() {
+				So(err, ShouldBeNil)
+				So(calls, ShouldResemble, []string{"b06f47830f64", "other", "ac0d3577e808"})
+				So(rpcwrperres.Payload.(rpcwrapper.BatchResponsePayload).Errors, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a policy of a batch fails to be enforced", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(true)
+			server.Supervisor = mockSup
+
+			failed := initTestSupPayload()
+			failed.ContextID = "other"
+			rpcwrperreq.Payload = rpcwrapper.BatchPayload{
+				Enforce:   []rpcwrapper.EnforcePayload{initTestEnfPayload(), other},
+				Supervise: []rpcwrapper.SuperviseRequestPayload{failed},
+			}
+
+			mockEnf.EXPECT().Enforce("b06f47830f64", gomock.Any()).Times(1).Return(nil)
+			mockEnf.EXPECT().Enforce("other", gomock.Any()).Times(1).Return(fmt.Errorf("Failed to enforce"))
+
+			err := server.Batch(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then its PU should not be supervised and its error reported", func() {
+				So(err, ShouldBeNil)
+				So(rpcwrperres.Payload.(rpcwrapper.BatchResponsePayload).Errors, ShouldResemble, map[string]string{"other": "Failed to enforce"})
+			})
+		})
+	})
+}
+
 func TestUnEnforce(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -916,3 +1006,151 @@ func TestUnSupervise(t *testing.T) {
 		})
 	})
 }
+
+func TestUpdateSecrets(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("When I create a new server", t, func() {
+		rpcHdl := mockrpcwrapper.NewMockRPCServer(ctrl)
+		mockEnf := mockenforcer.NewMockPolicyEnforcer(ctrl)
+		mockStats := mockstats.NewMockStats(ctrl)
+
+		var service enforcer.PacketProcessor
+		server, err := NewServer(service, rpcHdl, "/tmp/test.sock", "T6UYZGcKW-aum_vi-XakafF3vHV7F6x8wdofZs7akGU=", mockStats)
+		So(err, ShouldBeNil)
+
+		var rpcwrperreq rpcwrapper.Request
+		var rpcwrperres rpcwrapper.Response
+		rpcwrperreq.Payload = rpcwrapper.UpdateSecretsPayload{
+			SecretType: secrets.PSKType,
+			PrivatePEM: []byte("New Test Password"),
+			Overlap:    time.Minute,
+		}
+
+		Convey("When I try to update the secrets with an invalid secret", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(false)
+			server.Enforcer = mockEnf
+
+			err := server.UpdateSecrets(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get error", func() {
+				So(err, ShouldResemble, fmt.Errorf("UpdateSecrets message authentication failed"))
+			})
+		})
+
+		Convey("When I try to update the secrets of an enforcer that does not support it", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(true)
+			server.Enforcer = mockEnf
+
+			err := server.UpdateSecrets(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I try to update the secrets of the enforcer", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(true)
+			secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+			server.Enforcer = enforcer.NewWithDefaults("someServerID", &collector.DefaultCollector{}, nil, secret, constants.LocalContainer, "/proc")
+
+			err := server.UpdateSecrets(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get no error", func() {
+				So(err, ShouldBeNil)
+				So(rpcwrperres.Status, ShouldEqual, "")
+			})
+		})
+
+		Convey("When I try to update the secrets with another type", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(true)
+			secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+			server.Enforcer = enforcer.NewWithDefaults("someServerID", &collector.DefaultCollector{}, nil, secret, constants.LocalContainer, "/proc")
+			rpcwrperreq.Payload = rpcwrapper.UpdateSecretsPayload{SecretType: secrets.PKINull}
+
+			err := server.UpdateSecrets(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestStatus(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("When I create a new server", t, func() {
+		rpcHdl := mockrpcwrapper.NewMockRPCServer(ctrl)
+		mockEnf := mockenforcer.NewMockPolicyEnforcer(ctrl)
+		mockStats := mockstats.NewMockStats(ctrl)
+
+		var service enforcer.PacketProcessor
+		server, err := NewServer(service, rpcHdl, "/tmp/test.sock", "T6UYZGcKW-aum_vi-XakafF3vHV7F6x8wdofZs7akGU=", mockStats)
+		So(err, ShouldBeNil)
+
+		var rpcwrperreq rpcwrapper.Request
+		var rpcwrperres rpcwrapper.Response
+		rpcwrperreq.Payload = rpcwrapper.StatusPayload{ContextID: "pu"}
+
+		Convey("When I try to get the status with an invalid secret", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(false)
+			server.Enforcer = mockEnf
+
+			err := server.Status(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get error", func() {
+				So(err, ShouldResemble, fmt.Errorf("Status message authentication failed"))
+			})
+		})
+
+		Convey("When I try to get the status of an enforcer that does not report it", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(true)
+			server.Enforcer = mockEnf
+
+			err := server.Status(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get error", func() {
+				So(err, ShouldNotBeNil)
+				So(rpcwrperres.Payload, ShouldBeNil)
+			})
+		})
+
+		Convey("When I try to get the status of an enforcer that is not started", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(true)
+			secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+			server.Enforcer = enforcer.NewWithDefaults("someServerID", &collector.DefaultCollector{}, nil, secret, constants.LocalContainer, "/proc")
+
+			err := server.Status(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get error", func() {
+				So(err, ShouldNotBeNil)
+				So(rpcwrperres.Status, ShouldNotBeEmpty)
+			})
+		})
+
+		Convey("When I ping the server", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(true)
+
+			err := server.Ping(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get no error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When I ping the server with an invalid secret", func() {
+			rpcHdl.EXPECT().CheckValidity(gomock.Any(), gomock.Any()).Times(1).Return(false)
+
+			err := server.Ping(rpcwrperreq, &rpcwrperres)
+
+			Convey("Then I should get error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -75,7 +75,7 @@ func (s *StatsClient) SendStats() {
 				break
 			}
 			collected := s.collector.Flows
-			s.collector.Flows = map[string]*collector.FlowRecord{}
+			s.collector.Flows = []*collector.FlowRecord{}
 			s.collector.Unlock()
 
 			if len(collected) == 0 {
@@ -0,0 +1,319 @@
+package flowlogcollector
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+const (
+	// DefaultMaxSize is the default size in bytes after which the log is rotated
+	DefaultMaxSize = 100 * 1024 * 1024
+	// DefaultMaxFiles is the default number of rotated logs that are kept
+	DefaultMaxFiles = 5
+	// DefaultQueueSize is the default number of records that can be waiting to be written
+	DefaultQueueSize = 1000
+
+	// FlowRecordType is the type of the log entries of flow records
+	FlowRecordType = "flow"
+	// PURecordType is the type of the log entries of container records
+	PURecordType = "pu"
+)
+
+// Config is the configuration of a FlowLogCollector
+type Config struct {
+	// Path is the path of the log file. The rotated files are written in
+	// the same directory with a numeric suffix.
+	Path string
+	// MaxSize is the size in bytes after which the log is rotated
+	MaxSize int64
+	// MaxFiles is the number of rotated logs that are kept
+	MaxFiles int
+	// QueueSize is the number of records that can be waiting to be written.
+	// Records are dropped when the queue is full.
+	QueueSize int
+	// IPFIXAddress is the UDP address of an IPFIX collector. If it is
+	// empty, flow records are not exported.
+	IPFIXAddress string
+	// ObservationDomainID is the observation domain of the IPFIX messages
+	ObservationDomainID uint32
+}
+
+// EndPoint is an endpoint of a flow in the log
+type EndPoint struct {
+	ID   string `json:"id,omitempty"`
+	IP   string `json:"ip,omitempty"`
+	Port uint16 `json:"port,omitempty"`
+	Type string `json:"type"`
+}
+
+// Counters are the counters of a flow in the log
+type Counters struct {
+	SourceBytes        uint64 `json:"sourceBytes"`
+	SourcePackets      uint64 `json:"sourcePackets"`
+	DestinationBytes   uint64 `json:"destinationBytes"`
+	DestinationPackets uint64 `json:"destinationPackets"`
+}
+
+// Record is an entry of the log
+type Record struct {
+	Timestamp   time.Time  `json:"timestamp"`
+	Type        string     `json:"type"`
+	ContextID   string     `json:"contextID"`
+	Tags        []string   `json:"tags,omitempty"`
+	Count       int        `json:"count,omitempty"`
+	Source      *EndPoint  `json:"source,omitempty"`
+	Destination *EndPoint  `json:"destination,omitempty"`
+	Protocol    uint8      `json:"protocol,omitempty"`
+	FirstSeen   *time.Time `json:"firstSeen,omitempty"`
+	LastSeen    *time.Time `json:"lastSeen,omitempty"`
+	Counters    *Counters  `json:"counters,omitempty"`
+	Final       bool       `json:"final,omitempty"`
+	Action      string     `json:"action,omitempty"`
+	DropReason  string     `json:"dropReason,omitempty"`
+	PolicyID    string     `json:"policyID,omitempty"`
+	IPAddress   string     `json:"ipAddress,omitempty"`
+	Event       string     `json:"event,omitempty"`
+}
+
+// FlowLogCollector is an EventCollector that writes all the flow and PU events
+// to a rotating file as JSON lines, and optionally exports the flows to an
+// IPFIX collector. Events are timestamped when they are collected and written
+// in the background, so that the datapath is never blocked on the disk or the
+// network. Events are forwarded to the next collector.
+type FlowLogCollector struct {
+	next     collector.EventCollector
+	file     *rotatingFile
+	exporter *ipfixExporter
+	queue    chan *Record
+	done     chan struct{}
+	closed   bool
+
+	sync.RWMutex
+}
+
+// NewFlowLogCollector creates a new FlowLogCollector. If next is not nil,
+// all the events are also forwarded to it.
+func NewFlowLogCollector(config *Config, next collector.EventCollector) (*FlowLogCollector, error) {
+
+	if config == nil || config.Path == "" {
+		return nil, fmt.Errorf("A path is required for the flow log")
+	}
+
+	maxSize := config.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	maxFiles := config.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = DefaultMaxFiles
+	}
+
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	file, err := newRotatingFile(config.Path, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FlowLogCollector{
+		next:  next,
+		file:  file,
+		queue: make(chan *Record, queueSize),
+		done:  make(chan struct{}),
+	}
+
+	if config.IPFIXAddress != "" {
+		f.exporter, err = newIPFIXExporter(config.IPFIXAddress, config.ObservationDomainID)
+		if err != nil {
+			file.Close() // nolint
+			return nil, err
+		}
+	}
+
+	go f.run()
+
+	return f, nil
+}
+
+// CollectFlowEvent is part of the EventCollector interface.
+func (f *FlowLogCollector) CollectFlowEvent(record *collector.FlowRecord) {
+
+	f.enqueue(flowRecord(time.Now(), record))
+
+	if f.next != nil {
+		f.next.CollectFlowEvent(record)
+	}
+}
+
+// CollectContainerEvent is part of the EventCollector interface.
+func (f *FlowLogCollector) CollectContainerEvent(record *collector.ContainerRecord) {
+
+	f.enqueue(puRecord(time.Now(), record))
+
+	if f.next != nil {
+		f.next.CollectContainerEvent(record)
+	}
+}
+
+// Close writes the pending records and closes the log and the IPFIX exporter
+func (f *FlowLogCollector) Close() error {
+
+	f.Lock()
+	if f.closed {
+		f.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.queue)
+	f.Unlock()
+
+	<-f.done
+
+	if f.exporter != nil {
+		f.exporter.Close() // nolint
+	}
+
+	return f.file.Close()
+}
+
+// enqueue queues the record for the writer, dropping it if the queue is full
+func (f *FlowLogCollector) enqueue(record *Record) {
+
+	f.RLock()
+	defer f.RUnlock()
+
+	if f.closed {
+		return
+	}
+
+	select {
+	case f.queue <- record:
+	default:
+		zap.L().Warn("Flow log queue is full, dropping record")
+	}
+}
+
+// run writes the queued records until the queue is closed
+func (f *FlowLogCollector) run() {
+
+	defer close(f.done)
+
+	for record := range f.queue {
+		f.write(record)
+	}
+}
+
+// write writes a single record to the log and the IPFIX exporter
+func (f *FlowLogCollector) write(record *Record) {
+
+	if f.exporter != nil && record.Type == FlowRecordType {
+		if err := f.exporter.export(record); err != nil {
+			zap.L().Warn("Failed to export flow record", zap.Error(err))
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		zap.L().Warn("Failed to encode flow log record", zap.Error(err))
+		return
+	}
+
+	// Each record is written at once, so that the file is only rotated
+	// between records and a record is never split across files
+	if _, err := f.file.Write(append(data, '\n')); err != nil {
+		zap.L().Warn("Failed to write flow log record", zap.Error(err))
+	}
+}
+
+// flowRecord converts a flow record to a log record. The record is converted
+// when it is collected since the tags are shared with the datapath.
+func flowRecord(timestamp time.Time, r *collector.FlowRecord) *Record {
+
+	action := collector.FlowReject
+	if r.Action.Accepted() {
+		action = collector.FlowAccept
+	}
+
+	record := &Record{
+		Timestamp:   timestamp,
+		Type:        FlowRecordType,
+		ContextID:   r.ContextID,
+		Tags:        tags(r.Tags),
+		Count:       r.Count,
+		Source:      endPoint(r.Source),
+		Destination: endPoint(r.Destination),
+		Protocol:    r.Protocol,
+		Final:       r.Final,
+		Action:      action,
+		DropReason:  r.DropReason,
+		PolicyID:    r.PolicyID,
+	}
+
+	if !r.FirstSeen.IsZero() {
+		firstSeen := r.FirstSeen
+		record.FirstSeen = &firstSeen
+	}
+
+	if !r.LastSeen.IsZero() {
+		lastSeen := r.LastSeen
+		record.LastSeen = &lastSeen
+	}
+
+	if r.Counters != nil {
+		record.Counters = &Counters{
+			SourceBytes:        r.Counters.SourceBytes,
+			SourcePackets:      r.Counters.SourcePackets,
+			DestinationBytes:   r.Counters.DestinationBytes,
+			DestinationPackets: r.Counters.DestinationPackets,
+		}
+	}
+
+	return record
+}
+
+// puRecord converts a container record to a log record
+func puRecord(timestamp time.Time, r *collector.ContainerRecord) *Record {
+
+	return &Record{
+		Timestamp: timestamp,
+		Type:      PURecordType,
+		ContextID: r.ContextID,
+		Tags:      tags(r.Tags),
+		IPAddress: r.IPAddress,
+		Event:     r.Event,
+	}
+}
+
+func endPoint(e *collector.EndPoint) *EndPoint {
+
+	if e == nil {
+		return nil
+	}
+
+	return &EndPoint{
+		ID:   e.ID,
+		IP:   e.IP,
+		Port: e.Port,
+		Type: e.Type.String(),
+	}
+}
+
+func tags(t *policy.TagStore) []string {
+
+	if t == nil {
+		return nil
+	}
+
+	return t.Copy().GetSlice()
+}
@@ -0,0 +1,355 @@
+package flowlogcollector
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type countingCollector struct {
+	flows  int
+	events int
+}
+
+func (c *countingCollector) CollectFlowEvent(record *collector.FlowRecord) { c.flows++ }
+
+func (c *countingCollector) CollectContainerEvent(record *collector.ContainerRecord) { c.events++ }
+
+func readRecords(path string) []*Record {
+
+	file, err := os.Open(path)
+	So(err, ShouldBeNil)
+	defer file.Close() // nolint
+
+	records := []*Record{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		r := &Record{}
+		So(json.Unmarshal(scanner.Bytes(), r), ShouldBeNil)
+		records = append(records, r)
+	}
+
+	return records
+}
+
+func testFlow(srcIP, dstIP string) *collector.FlowRecord {
+
+	return &collector.FlowRecord{
+		ContextID: "pu1",
+		Count:     2,
+		Source: &collector.EndPoint{
+			ID:   "src",
+			IP:   srcIP,
+			Port: 3000,
+			Type: collector.PU,
+		},
+		Destination: &collector.EndPoint{
+			ID:   "pu1",
+			IP:   dstIP,
+			Port: 80,
+			Type: collector.PU,
+		},
+		Tags:       policy.NewTagStoreFromMap(map[string]string{"app": "web"}),
+		Action:     policy.Accept,
+		DropReason: "NA",
+		PolicyID:   "policy1",
+		Protocol:   6,
+		FirstSeen:  time.Unix(1500000000, 0),
+		LastSeen:   time.Unix(1500000002, 0),
+	}
+}
+
+func TestFlowLogCollector(t *testing.T) {
+
+	Convey("Given a flow log collector that forwards events", t, func() {
+
+		dir, err := ioutil.TempDir("", "flowlog")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		path := filepath.Join(dir, "flows.log")
+		next := &countingCollector{}
+
+		f, err := NewFlowLogCollector(&Config{Path: path}, next)
+		So(err, ShouldBeNil)
+
+		Convey("When I collect flow and PU events and close the collector", func() {
+
+			before := time.Now()
+			f.CollectFlowEvent(testFlow("10.1.1.1", "10.1.1.2"))
+			f.CollectContainerEvent(&collector.ContainerRecord{
+				ContextID: "pu1",
+				IPAddress: "10.1.1.2",
+				Event:     collector.ContainerStart,
+			})
+			So(f.Close(), ShouldBeNil)
+
+			records := readRecords(path)
+
+			Convey("Every event should be written as a JSON line with a timestamp", func() {
+				So(len(records), ShouldEqual, 2)
+
+				So(records[0].Type, ShouldEqual, FlowRecordType)
+				So(records[0].Timestamp.Before(before), ShouldBeFalse)
+				So(records[0].ContextID, ShouldEqual, "pu1")
+				So(records[0].Count, ShouldEqual, 2)
+				So(records[0].Tags, ShouldResemble, []string{"app=web"})
+				So(records[0].Source, ShouldResemble, &EndPoint{ID: "src", IP: "10.1.1.1", Port: 3000, Type: "pu"})
+				So(records[0].Destination.Port, ShouldEqual, 80)
+				So(records[0].Action, ShouldEqual, collector.FlowAccept)
+				So(records[0].PolicyID, ShouldEqual, "policy1")
+				So(records[0].Protocol, ShouldEqual, 6)
+				So(records[0].FirstSeen.Unix(), ShouldEqual, 1500000000)
+				So(records[0].LastSeen.Unix(), ShouldEqual, 1500000002)
+				So(records[0].Counters, ShouldBeNil)
+				So(records[0].Final, ShouldBeFalse)
+
+				So(records[1].Type, ShouldEqual, PURecordType)
+				So(records[1].IPAddress, ShouldEqual, "10.1.1.2")
+				So(records[1].Event, ShouldEqual, collector.ContainerStart)
+			})
+
+			Convey("The events should be forwarded to the next collector", func() {
+				So(next.flows, ShouldEqual, 1)
+				So(next.events, ShouldEqual, 1)
+			})
+
+			Convey("Final records should be written with their counters", func() {
+				f, err := NewFlowLogCollector(&Config{Path: path}, nil)
+				So(err, ShouldBeNil)
+
+				flow := testFlow("10.1.1.1", "10.1.1.2")
+				flow.Final = true
+				flow.Counters = &collector.FlowCounters{SourceBytes: 100, SourcePackets: 2, DestinationBytes: 300, DestinationPackets: 3}
+				f.CollectFlowEvent(flow)
+				So(f.Close(), ShouldBeNil)
+
+				records := readRecords(path)
+				So(len(records), ShouldEqual, 3)
+				So(records[2].Final, ShouldBeTrue)
+				So(records[2].Counters, ShouldResemble, &Counters{SourceBytes: 100, SourcePackets: 2, DestinationBytes: 300, DestinationPackets: 3})
+			})
+
+			Convey("Events collected after closing should be ignored", func() {
+				f.CollectFlowEvent(testFlow("10.1.1.1", "10.1.1.2"))
+				So(f.Close(), ShouldBeNil)
+				So(next.flows, ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Given a flow log collector whose file is smaller than two records", t, func() {
+
+		dir, err := ioutil.TempDir("", "flowlog")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		path := filepath.Join(dir, "flows.log")
+		f, err := NewFlowLogCollector(&Config{Path: path, MaxSize: 600, MaxFiles: 10}, nil)
+		So(err, ShouldBeNil)
+
+		Convey("When I collect several flows", func() {
+			for i := 0; i < 5; i++ {
+				f.CollectFlowEvent(testFlow("10.1.1.1", "10.1.1.2"))
+			}
+			So(f.Close(), ShouldBeNil)
+
+			Convey("Each file should only hold whole records", func() {
+				total := len(readRecords(path))
+				for i := 1; i <= 10; i++ {
+					if _, err := os.Stat(path + "." + strconv.Itoa(i)); err != nil {
+						break
+					}
+					total += len(readRecords(path + "." + strconv.Itoa(i)))
+				}
+
+				So(total, ShouldEqual, 5)
+				_, err := os.Stat(path + ".1")
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given a flow log collector without a path", t, func() {
+		_, err := NewFlowLogCollector(&Config{}, nil)
+
+		Convey("I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestRotatingFile(t *testing.T) {
+
+	Convey("Given a rotating file that keeps two rotated files", t, func() {
+
+		dir, err := ioutil.TempDir("", "flowlog")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		path := filepath.Join(dir, "flows.log")
+		r, err := newRotatingFile(path, 10, 2)
+		So(err, ShouldBeNil)
+
+		Convey("When I write more than the maximum size several times", func() {
+			for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+				_, err := r.Write([]byte(line))
+				So(err, ShouldBeNil)
+			}
+			So(r.Close(), ShouldBeNil)
+
+			Convey("The files should be rotated and the oldest one removed", func() {
+				data, err := ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "fourth\n")
+
+				data, err = ioutil.ReadFile(path + ".1")
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "third\n")
+
+				data, err = ioutil.ReadFile(path + ".2")
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "second\n")
+
+				_, err = os.Stat(path + ".3")
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("When I reopen the file, the size should include the existing data", func() {
+			_, err := r.Write([]byte("12345678"))
+			So(err, ShouldBeNil)
+			So(r.Close(), ShouldBeNil)
+
+			r, err = newRotatingFile(path, 10, 2)
+			So(err, ShouldBeNil)
+			_, err = r.Write([]byte("abc"))
+			So(err, ShouldBeNil)
+			So(r.Close(), ShouldBeNil)
+
+			data, err := ioutil.ReadFile(path + ".1")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "12345678")
+		})
+
+		Convey("When the file can not be renamed", func() {
+			So(r.Close(), ShouldBeNil)
+			r, err = newRotatingFile(path, 10, 1)
+			So(err, ShouldBeNil)
+			So(os.MkdirAll(filepath.Join(path+".1", "busy"), 0700), ShouldBeNil)
+
+			for _, line := range []string{"first\n", "second\n"} {
+				_, err := r.Write([]byte(line))
+				So(err, ShouldBeNil)
+			}
+
+			Convey("The data should still be written to the current file", func() {
+				So(r.Close(), ShouldBeNil)
+
+				data, err := ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "first\nsecond\n")
+			})
+
+			Convey("The file should be rotated once the rename succeeds", func() {
+				So(os.RemoveAll(path+".1"), ShouldBeNil)
+
+				_, err := r.Write([]byte("third\n"))
+				So(err, ShouldBeNil)
+				So(r.Close(), ShouldBeNil)
+
+				data, err := ioutil.ReadFile(path + ".1")
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "first\nsecond\n")
+
+				data, err = ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "third\n")
+			})
+		})
+	})
+}
+
+func TestIPFIXExport(t *testing.T) {
+
+	Convey("Given a flow log collector that exports to an IPFIX collector", t, func() {
+
+		dir, err := ioutil.TempDir("", "flowlog")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close() // nolint
+
+		f, err := NewFlowLogCollector(&Config{
+			Path:                filepath.Join(dir, "flows.log"),
+			IPFIXAddress:        listener.LocalAddr().String(),
+			ObservationDomainID: 42,
+		}, nil)
+		So(err, ShouldBeNil)
+
+		receive := func() []byte {
+			buf := make([]byte, 1500)
+			listener.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint
+			n, _, err := listener.ReadFrom(buf)
+			So(err, ShouldBeNil)
+			return buf[:n]
+		}
+
+		Convey("When I collect an IPv4 and an IPv6 flow", func() {
+			f.CollectFlowEvent(testFlow("10.1.1.1", "10.1.1.2"))
+			first := receive()
+
+			flow := testFlow("fd00::1", "fd00::2")
+			flow.Action = policy.Reject
+			f.CollectFlowEvent(flow)
+			second := receive()
+
+			So(f.Close(), ShouldBeNil)
+
+			Convey("The first message should have a header, the templates and an IPv4 data record", func() {
+				So(binary.BigEndian.Uint16(first[0:2]), ShouldEqual, ipfixVersion)
+				So(int(binary.BigEndian.Uint16(first[2:4])), ShouldEqual, len(first))
+				So(binary.BigEndian.Uint32(first[8:12]), ShouldEqual, 0)
+				So(binary.BigEndian.Uint32(first[12:16]), ShouldEqual, 42)
+
+				set := first[ipfixHeaderLen:]
+				So(binary.BigEndian.Uint16(set[0:2]), ShouldEqual, ipfixTemplateSetID)
+				So(binary.BigEndian.Uint16(set[4:6]), ShouldEqual, ipfixTemplateIPv4ID)
+				So(binary.BigEndian.Uint16(set[6:8]), ShouldEqual, len(ipfixTemplateIPv4.fields))
+
+				data := set[binary.BigEndian.Uint16(set[2:4]):]
+				So(binary.BigEndian.Uint16(data[0:2]), ShouldEqual, ipfixTemplateIPv4ID)
+				So(int(binary.BigEndian.Uint16(data[2:4])), ShouldEqual, len(data))
+				So(net.IP(data[12:16]).String(), ShouldEqual, "10.1.1.1")
+				So(net.IP(data[16:20]).String(), ShouldEqual, "10.1.1.2")
+				So(binary.BigEndian.Uint16(data[20:22]), ShouldEqual, 3000)
+				So(binary.BigEndian.Uint16(data[22:24]), ShouldEqual, 80)
+				So(binary.BigEndian.Uint64(data[24:32]), ShouldEqual, 2)
+				So(data[32], ShouldEqual, ipfixFlowCreated)
+			})
+
+			Convey("The second message should only have an IPv6 data record", func() {
+				So(binary.BigEndian.Uint32(second[8:12]), ShouldEqual, 1)
+
+				data := second[ipfixHeaderLen:]
+				So(binary.BigEndian.Uint16(data[0:2]), ShouldEqual, ipfixTemplateIPv6ID)
+				So(net.IP(data[12:28]).String(), ShouldEqual, "fd00::1")
+				So(net.IP(data[28:44]).String(), ShouldEqual, "fd00::2")
+				So(data[len(data)-1], ShouldEqual, ipfixFlowDenied)
+			})
+		})
+	})
+}
@@ -0,0 +1,201 @@
+package flowlogcollector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+)
+
+// IPFIX constants as defined in RFC 7011 and the IANA IPFIX registry
+const (
+	ipfixVersion         = 10
+	ipfixHeaderLen       = 16
+	ipfixSetHeaderLen    = 4
+	ipfixTemplateSetID   = 2
+	ipfixTemplateIPv4ID  = 256
+	ipfixTemplateIPv6ID  = 257
+	ipfixFlowCreated     = 1
+	ipfixFlowDenied      = 3
+	ieSourceTransport    = 7
+	ieSourceIPv4         = 8
+	ieDestTransport      = 11
+	ieDestIPv4           = 12
+	ieSourceIPv6         = 27
+	ieDestIPv6           = 28
+	ieDeltaFlowCount     = 3
+	ieFirewallEvent      = 233
+	ieObservationTimeMs  = 323
+	ipfixTemplateRefresh = 30 * time.Second
+)
+
+// ipfixField is a field of an IPFIX template
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// ipfixTemplate describes the data records of a template
+type ipfixTemplate struct {
+	id     uint16
+	fields []ipfixField
+}
+
+var (
+	ipfixTemplateIPv4 = ipfixTemplate{
+		id: ipfixTemplateIPv4ID,
+		fields: []ipfixField{
+			{ieObservationTimeMs, 8},
+			{ieSourceIPv4, 4},
+			{ieDestIPv4, 4},
+			{ieSourceTransport, 2},
+			{ieDestTransport, 2},
+			{ieDeltaFlowCount, 8},
+			{ieFirewallEvent, 1},
+		},
+	}
+
+	ipfixTemplateIPv6 = ipfixTemplate{
+		id: ipfixTemplateIPv6ID,
+		fields: []ipfixField{
+			{ieObservationTimeMs, 8},
+			{ieSourceIPv6, 16},
+			{ieDestIPv6, 16},
+			{ieSourceTransport, 2},
+			{ieDestTransport, 2},
+			{ieDeltaFlowCount, 8},
+			{ieFirewallEvent, 1},
+		},
+	}
+)
+
+// ipfixExporter exports flow records as IPFIX messages over UDP. Since UDP
+// collectors can start at any time, the templates are sent with the first
+// message and then periodically.
+type ipfixExporter struct {
+	conn          net.Conn
+	domainID      uint32
+	sequence      uint32
+	templatesSent time.Time
+}
+
+// newIPFIXExporter creates an exporter sending messages to the given address
+func newIPFIXExporter(address string, domainID uint32) (*ipfixExporter, error) {
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to IPFIX collector %s: %s", address, err)
+	}
+
+	return &ipfixExporter{
+		conn:     conn,
+		domainID: domainID,
+	}, nil
+}
+
+// export sends the flow record as an IPFIX message. Records with endpoints
+// that are not IP addresses of the same family are ignored.
+func (e *ipfixExporter) export(record *Record) error {
+
+	if record.Source == nil || record.Destination == nil {
+		return nil
+	}
+
+	src := net.ParseIP(record.Source.IP)
+	dst := net.ParseIP(record.Destination.IP)
+	if src == nil || dst == nil {
+		return nil
+	}
+
+	template := ipfixTemplateIPv6
+	if src.To4() != nil && dst.To4() != nil {
+		template = ipfixTemplateIPv4
+		src, dst = src.To4(), dst.To4()
+	} else if src.To4() != nil || dst.To4() != nil {
+		return nil
+	} else {
+		src, dst = src.To16(), dst.To16()
+	}
+
+	message := make([]byte, ipfixHeaderLen, 512)
+
+	timestamp := record.Timestamp
+	if timestamp.Sub(e.templatesSent) > ipfixTemplateRefresh {
+		message = appendTemplateSet(message, ipfixTemplateIPv4, ipfixTemplateIPv6)
+		e.templatesSent = timestamp
+	}
+
+	count := uint64(record.Count)
+	if count == 0 {
+		count = 1
+	}
+
+	event := byte(ipfixFlowDenied)
+	if record.Action == collector.FlowAccept {
+		event = ipfixFlowCreated
+	}
+
+	data := make([]byte, 0, 64)
+	data = appendUint64(data, uint64(timestamp.UnixNano()/int64(time.Millisecond)))
+	data = append(data, src...)
+	data = append(data, dst...)
+	data = appendUint16(data, record.Source.Port)
+	data = appendUint16(data, record.Destination.Port)
+	data = appendUint64(data, count)
+	data = append(data, event)
+
+	message = appendUint16(message, template.id)
+	message = appendUint16(message, uint16(ipfixSetHeaderLen+len(data)))
+	message = append(message, data...)
+
+	binary.BigEndian.PutUint16(message[0:2], ipfixVersion)
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(message)))
+	binary.BigEndian.PutUint32(message[4:8], uint32(timestamp.Unix()))
+	binary.BigEndian.PutUint32(message[8:12], e.sequence)
+	binary.BigEndian.PutUint32(message[12:16], e.domainID)
+
+	// The sequence number counts the data records sent before this message
+	e.sequence++
+
+	_, err := e.conn.Write(message)
+
+	return err
+}
+
+// Close closes the connection to the IPFIX collector
+func (e *ipfixExporter) Close() error {
+	return e.conn.Close()
+}
+
+// appendTemplateSet appends a template set with the given templates
+func appendTemplateSet(message []byte, templates ...ipfixTemplate) []byte {
+
+	start := len(message)
+	message = appendUint16(message, ipfixTemplateSetID)
+	message = appendUint16(message, 0)
+
+	for _, t := range templates {
+		message = appendUint16(message, t.id)
+		message = appendUint16(message, uint16(len(t.fields)))
+		for _, f := range t.fields {
+			message = appendUint16(message, f.id)
+			message = appendUint16(message, f.length)
+		}
+	}
+
+	binary.BigEndian.PutUint16(message[start+2:start+4], uint16(len(message)-start))
+
+	return message
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,115 @@
+package flowlogcollector
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// rotatingFile is a file that is rotated when it reaches a maximum size. The
+// rotated files are renamed with a numeric suffix, the most recent being .1
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// newRotatingFile opens or creates the file at the given path
+func newRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+
+	r := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// open opens the file in append mode and records its current size
+func (r *rotatingFile) open() error {
+
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open flow log %s: %s", r.path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close() // nolint
+		return fmt.Errorf("Unable to stat flow log %s: %s", r.path, err)
+	}
+
+	r.file = file
+	r.size = info.Size()
+
+	return nil
+}
+
+// Write writes the data to the file, rotating it first if the data does not
+// fit. The data is never split across files. If the rotation fails, the data is still written to the current file,
+// as the buffered writer of the collector would fail all the later writes. The
+// rotation is then attempted again once the maximum size is written again.
+func (r *rotatingFile) Write(data []byte) (int, error) {
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(data)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			zap.L().Warn("Failed to rotate flow log", zap.Error(err))
+			r.size = 0
+		}
+	}
+
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+
+	return n, err
+}
+
+// rotate shifts the rotated files and opens a new file. The current file is
+// renamed while it is still open, so that it is kept if the rotation fails.
+func (r *rotatingFile) rotate() error {
+
+	if r.maxFiles > 0 {
+		// The oldest file is overwritten by the rename if it exists
+		for i := r.maxFiles - 1; i > 0; i-- {
+			if err := os.Rename(r.rotatedPath(i), r.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Unable to rotate flow log %s: %s", r.path, err)
+			}
+		}
+
+		if err := os.Rename(r.path, r.rotatedPath(1)); err != nil {
+			return fmt.Errorf("Unable to rotate flow log %s: %s", r.path, err)
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return fmt.Errorf("Unable to remove flow log %s: %s", r.path, err)
+	}
+
+	previous := r.file
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	if err := previous.Close(); err != nil {
+		zap.L().Warn("Unable to close rotated flow log", zap.String("path", r.path), zap.Error(err))
+	}
+
+	return nil
+}
+
+// rotatedPath returns the path of the i-th rotated file
+func (r *rotatingFile) rotatedPath(i int) string {
+	return r.path + "." + strconv.Itoa(i)
+}
+
+// Close closes the file
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
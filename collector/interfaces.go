@@ -2,6 +2,7 @@ package collector
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/aporeto-inc/trireme/policy"
 )
@@ -27,6 +28,12 @@ const (
 	InvalidNonse = "nonse"
 	// PolicyDrop indicates that the flow is rejected because of the policy decision
 	PolicyDrop = "policy"
+	// EncryptionMismatch indicates that the policy requires encryption, but the remote did not negotiate it
+	EncryptionMismatch = "encryption"
+	// RevokedCertificate indicates that the certificate of the remote is revoked
+	RevokedCertificate = "revoked"
+	// ReplayedToken indicates that the token was already seen, or is too old to be checked
+	ReplayedToken = "replay"
 	// ContainerStart indicates a container start event
 	ContainerStart = "start"
 	// ContainerStop indicates a container stop event
@@ -41,6 +48,16 @@ const (
 	ContainerFailed = "forcestop"
 	// ContainerIgnored indicates that the container will be ignored by Trireme
 	ContainerIgnored = "ignore"
+	// ContainerRepaired indicates that missing rules of a container were reinstalled
+	ContainerRepaired = "repair"
+	// ContainerRepairFailed indicates that missing rules of a container could not be reinstalled. The repair is retried.
+	ContainerRepairFailed = "repairfailed"
+	// ContainerEnforcerRestarted indicates that the remote enforcer of a container exited and was launched again
+	ContainerEnforcerRestarted = "enforcerrestart"
+	// ContainerFailOpen indicates that a queue of the enforcer stalled and the packets of a container are accepted without being processed
+	ContainerFailOpen = "failopen"
+	// ContainerFailClosed indicates that a queue of the enforcer stalled and the packets of a container are dropped
+	ContainerFailClosed = "failclosed"
 	// UnknownContainerDelete indicates that policy for an unknown  container was deleted
 	UnknownContainerDelete = "unknowncontainer"
 	// PolicyValid Normal flow accept
@@ -59,6 +76,26 @@ type EventCollector interface {
 	CollectContainerEvent(record *ContainerRecord)
 }
 
+// MetricType is the type of a metric registered with a MetricsRegistry
+type MetricType string
+
+const (
+	// CounterMetric is a metric that only increases
+	CounterMetric MetricType = "counter"
+	// GaugeMetric is a metric that can increase and decrease
+	GaugeMetric MetricType = "gauge"
+)
+
+// MetricsRegistry is implemented by collectors that can also export the internal
+// metrics of the components reporting events to them.
+type MetricsRegistry interface {
+
+	// RegisterMetric registers a metric with a single label. The values function
+	// is called every time the metric is exported and returns the current value
+	// of the metric for every value of the label.
+	RegisterMetric(name string, help string, kind MetricType, label string, values func() map[string]float64)
+}
+
 // EndPointType is the type of an endpoint (PU or an external IP address )
 type EndPointType byte
 
@@ -84,6 +121,16 @@ type EndPoint struct {
 	Type EndPointType
 }
 
+// FlowCounters holds the accounting counters of a flow in both directions
+type FlowCounters struct {
+	// SourceBytes and SourcePackets count the traffic sent by the source
+	SourceBytes   uint64
+	SourcePackets uint64
+	// DestinationBytes and DestinationPackets count the traffic sent by the destination
+	DestinationBytes   uint64
+	DestinationPackets uint64
+}
+
 // FlowRecord describes a flow record for statistis
 type FlowRecord struct {
 	ContextID   string
@@ -94,6 +141,21 @@ type FlowRecord struct {
 	Action      policy.ActionType
 	DropReason  string
 	PolicyID    string
+	// PolicyTrace contains the clauses of the matched policy that were
+	// satisfied by the tags of the remote endpoint
+	PolicyTrace []string
+	Protocol    uint8
+	// FirstSeen and LastSeen are the times of the first and last packets of
+	// the flow processed by the enforcer. In a final record, LastSeen is the
+	// time conntrack destroyed the entry of the flow.
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Counters are only reported in the final record of a flow, and only if
+	// conntrack accounting is enabled (net.netfilter.nf_conntrack_acct)
+	Counters *FlowCounters
+	// Final indicates that conntrack destroyed the entry of the accepted
+	// flow and that the enforcer will not report it anymore
+	Final bool
 }
 
 func (f *FlowRecord) String() string {
@@ -0,0 +1,222 @@
+package metricscollector
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/collector"
+)
+
+const (
+	// DefaultMetricsPath is the HTTP path where the metrics are exposed
+	DefaultMetricsPath = "/metrics"
+
+	// contentType is the content type of the Prometheus text format
+	contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	flowsMetric    = "trireme_flows_total"
+	puEventsMetric = "trireme_pu_events_total"
+)
+
+// flowKey is the set of labels of the flow counters
+type flowKey struct {
+	action     string
+	dropReason string
+	policyID   string
+}
+
+// registeredMetric is a metric registered by another component
+type registeredMetric struct {
+	name   string
+	help   string
+	kind   collector.MetricType
+	label  string
+	values func() map[string]float64
+}
+
+// MetricsCollector is an EventCollector that counts the flow and PU events and
+// exposes them, along with the metrics registered by the other components, in
+// the Prometheus text format. Events are forwarded to the next collector.
+type MetricsCollector struct {
+	next       collector.EventCollector
+	flows      map[flowKey]uint64
+	puEvents   map[string]uint64
+	registered []*registeredMetric
+
+	sync.Mutex
+}
+
+// NewMetricsCollector creates a new MetricsCollector. If next is not nil,
+// all the events are also forwarded to it.
+func NewMetricsCollector(next collector.EventCollector) *MetricsCollector {
+
+	return &MetricsCollector{
+		next:       next,
+		flows:      map[flowKey]uint64{},
+		puEvents:   map[string]uint64{},
+		registered: []*registeredMetric{},
+	}
+}
+
+// CollectFlowEvent is part of the EventCollector interface.
+func (m *MetricsCollector) CollectFlowEvent(record *collector.FlowRecord) {
+
+	key := flowKey{
+		action:     collector.FlowReject,
+		dropReason: record.DropReason,
+		policyID:   record.PolicyID,
+	}
+
+	if record.Action.Accepted() {
+		key.action = collector.FlowAccept
+	}
+
+	count := uint64(1)
+	if record.Count > 1 {
+		count = uint64(record.Count)
+	}
+
+	m.Lock()
+	m.flows[key] += count
+	m.Unlock()
+
+	if m.next != nil {
+		m.next.CollectFlowEvent(record)
+	}
+}
+
+// CollectContainerEvent is part of the EventCollector interface.
+func (m *MetricsCollector) CollectContainerEvent(record *collector.ContainerRecord) {
+
+	m.Lock()
+	m.puEvents[record.Event]++
+	m.Unlock()
+
+	if m.next != nil {
+		m.next.CollectContainerEvent(record)
+	}
+}
+
+// RegisterMetric is part of the MetricsRegistry interface.
+func (m *MetricsCollector) RegisterMetric(name string, help string, kind collector.MetricType, label string, values func() map[string]float64) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.registered = append(m.registered, &registeredMetric{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		label:  label,
+		values: values,
+	})
+}
+
+// Write writes all the metrics in the Prometheus text format
+func (m *MetricsCollector) Write(w io.Writer) error {
+
+	var buf bytes.Buffer
+
+	m.Lock()
+
+	writeHeader(&buf, flowsMetric, "Number of flows reported by the enforcers", collector.CounterMetric)
+	flows := make([]flowKey, 0, len(m.flows))
+	for key := range m.flows {
+		flows = append(flows, key)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].action != flows[j].action {
+			return flows[i].action < flows[j].action
+		}
+		if flows[i].dropReason != flows[j].dropReason {
+			return flows[i].dropReason < flows[j].dropReason
+		}
+		return flows[i].policyID < flows[j].policyID
+	})
+	for _, key := range flows {
+		fmt.Fprintf(&buf, "%s{action=\"%s\",drop_reason=\"%s\",policy_id=\"%s\"} %d\n",
+			flowsMetric,
+			escapeLabel(key.action),
+			escapeLabel(key.dropReason),
+			escapeLabel(key.policyID),
+			m.flows[key],
+		)
+	}
+
+	writeHeader(&buf, puEventsMetric, "Number of processing unit lifecycle events", collector.CounterMetric)
+	events := make([]string, 0, len(m.puEvents))
+	for event := range m.puEvents {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		fmt.Fprintf(&buf, "%s{event=\"%s\"} %d\n", puEventsMetric, escapeLabel(event), m.puEvents[event])
+	}
+
+	registered := make([]*registeredMetric, len(m.registered))
+	copy(registered, m.registered)
+
+	m.Unlock()
+
+	// The registered metrics are sampled without holding the lock since they
+	// call into the other components
+	for _, metric := range registered {
+		writeHeader(&buf, metric.name, metric.help, metric.kind)
+
+		values := metric.values()
+		labels := make([]string, 0, len(values))
+		for label := range values {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+
+		for _, label := range labels {
+			fmt.Fprintf(&buf, "%s{%s=\"%s\"} %s\n", metric.name, metric.label, escapeLabel(label), strconv.FormatFloat(values[label], 'g', -1, 64))
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+// ServeHTTP implements the http.Handler interface and serves the metrics
+func (m *MetricsCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", contentType)
+
+	if err := m.Write(w); err != nil {
+		zap.L().Warn("Failed to write metrics", zap.Error(err))
+	}
+}
+
+// ListenAndServe exposes the metrics on the DefaultMetricsPath of the given address.
+// It blocks until the server fails.
+func (m *MetricsCollector) ListenAndServe(address string) error {
+
+	mux := http.NewServeMux()
+	mux.Handle(DefaultMetricsPath, m)
+
+	return http.ListenAndServe(address, mux)
+}
+
+// writeHeader writes the help and type lines of a metric
+func writeHeader(buf *bytes.Buffer, name string, help string, kind collector.MetricType) {
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+}
+
+// escapeLabel escapes a label value as required by the Prometheus text format
+func escapeLabel(value string) string {
+
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
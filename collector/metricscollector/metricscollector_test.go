@@ -0,0 +1,99 @@
+package metricscollector
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type countingCollector struct {
+	flows  int
+	events int
+}
+
+func (c *countingCollector) CollectFlowEvent(record *collector.FlowRecord) { c.flows++ }
+
+func (c *countingCollector) CollectContainerEvent(record *collector.ContainerRecord) { c.events++ }
+
+func TestMetricsCollector(t *testing.T) {
+
+	Convey("Given a metrics collector that forwards events", t, func() {
+
+		next := &countingCollector{}
+		m := NewMetricsCollector(next)
+
+		Convey("When I collect flow events", func() {
+			m.CollectFlowEvent(&collector.FlowRecord{Action: policy.Accept, DropReason: "NA", PolicyID: "p1"})
+			m.CollectFlowEvent(&collector.FlowRecord{Action: policy.Accept, DropReason: "NA", PolicyID: "p1", Count: 3})
+			m.CollectFlowEvent(&collector.FlowRecord{Action: policy.Reject, DropReason: collector.PolicyDrop, PolicyID: "p\"2"})
+
+			var buf bytes.Buffer
+			So(m.Write(&buf), ShouldBeNil)
+			output := buf.String()
+
+			Convey("The flows should be counted by action, drop reason and policy", func() {
+				So(output, ShouldContainSubstring, "# TYPE trireme_flows_total counter\n")
+				So(output, ShouldContainSubstring, "trireme_flows_total{action=\"accept\",drop_reason=\"NA\",policy_id=\"p1\"} 4\n")
+				So(output, ShouldContainSubstring, "trireme_flows_total{action=\"reject\",drop_reason=\"policy\",policy_id=\"p\\\"2\"} 1\n")
+			})
+
+			Convey("The events should be forwarded to the next collector", func() {
+				So(next.flows, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When I collect PU events", func() {
+			m.CollectContainerEvent(&collector.ContainerRecord{Event: collector.ContainerStart})
+			m.CollectContainerEvent(&collector.ContainerRecord{Event: collector.ContainerStart})
+			m.CollectContainerEvent(&collector.ContainerRecord{Event: collector.ContainerDelete})
+
+			var buf bytes.Buffer
+			So(m.Write(&buf), ShouldBeNil)
+
+			So(buf.String(), ShouldContainSubstring, "trireme_pu_events_total{event=\"delete\"} 1\ntrireme_pu_events_total{event=\"start\"} 2\n")
+			So(next.events, ShouldEqual, 3)
+		})
+
+		Convey("When I register a metric, it should be sampled when the metrics are written", func() {
+			value := 1.0
+			m.RegisterMetric("test_entries", "Test entries", collector.GaugeMetric, "cache", func() map[string]float64 {
+				return map[string]float64{"b": value, "a": 0.5}
+			})
+
+			var buf bytes.Buffer
+			So(m.Write(&buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "# HELP test_entries Test entries\n# TYPE test_entries gauge\ntest_entries{cache=\"a\"} 0.5\ntest_entries{cache=\"b\"} 1\n")
+
+			value = 42
+			buf.Reset()
+			So(m.Write(&buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "test_entries{cache=\"b\"} 42\n")
+		})
+
+		Convey("When I request the metrics over HTTP, I should get the text format", func() {
+			m.CollectContainerEvent(&collector.ContainerRecord{Event: collector.ContainerStart})
+
+			recorder := httptest.NewRecorder()
+			m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, DefaultMetricsPath, nil))
+
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"), ShouldBeTrue)
+			So(recorder.Body.String(), ShouldContainSubstring, "trireme_pu_events_total{event=\"start\"} 1\n")
+		})
+	})
+
+	Convey("Given a metrics collector without a next collector", t, func() {
+		m := NewMetricsCollector(nil)
+
+		Convey("Collecting events should not fail", func() {
+			m.CollectFlowEvent(&collector.FlowRecord{Action: policy.Accept})
+			m.CollectContainerEvent(&collector.ContainerRecord{Event: collector.ContainerStop})
+		})
+	})
+}
@@ -3,7 +3,7 @@
 package configurator
 
 import (
-	"crypto/ecdsa"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -17,7 +17,9 @@ import (
 	"github.com/aporeto-inc/trireme/monitor/linuxmonitor"
 	"github.com/aporeto-inc/trireme/monitor/rpcmonitor"
 
+	"github.com/aporeto-inc/trireme/enforcer/utils/fqconfig"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/enforcer/utils/tokens"
 
 	"github.com/aporeto-inc/trireme/enforcer/proxy"
 	"github.com/aporeto-inc/trireme/enforcer/utils/rpcwrapper"
@@ -32,13 +34,61 @@ const (
 	AporetoProcMountPoint = "/aporetoproc"
 )
 
+// newLocalEnforcer creates an enforcer with the default settings that
+// exchanges tokens of the given type
+func newLocalEnforcer(
+	serverID string,
+	eventCollector collector.EventCollector,
+	processor enforcer.PacketProcessor,
+	secrets secrets.Secrets,
+	mode constants.ModeType,
+	tokenType tokens.TokenType,
+) enforcer.PolicyEnforcer {
+
+	return enforcer.New(
+		false,
+		fqconfig.NewFilterQueueWithDefaults(),
+		eventCollector,
+		processor,
+		secrets,
+		serverID,
+		time.Hour*8760,
+		mode,
+		DefaultProcMountPoint,
+		tokenType,
+	)
+}
+
+// newProxyEnforcer creates a proxy enforcer with the default settings whose
+// remote enforcers exchange tokens of the given type
+func newProxyEnforcer(
+	serverID string,
+	eventCollector collector.EventCollector,
+	secrets secrets.Secrets,
+	rpchdl rpcwrapper.RPCClient,
+	tokenType tokens.TokenType,
+) enforcer.PolicyEnforcer {
+
+	e := enforcerproxy.NewDefaultProxyEnforcer(
+		serverID,
+		eventCollector,
+		secrets,
+		rpchdl,
+		DefaultProcMountPoint,
+	)
+	e.(*enforcerproxy.ProxyInfo).TokenType = tokenType
+
+	return e
+}
+
 // NewTriremeLinuxProcess instantiates Trireme for a Linux process implementation
 func NewTriremeLinuxProcess(
 	serverID string,
 	resolver trireme.PolicyResolver,
 	processor enforcer.PacketProcessor,
 	eventCollector collector.EventCollector,
-	secrets secrets.Secrets) trireme.Trireme {
+	secrets secrets.Secrets,
+	tokenType tokens.TokenType) trireme.Trireme {
 
 	if eventCollector == nil {
 		zap.L().Warn("Using a default collector for events")
@@ -46,12 +96,12 @@ func NewTriremeLinuxProcess(
 	}
 
 	enforcers := map[constants.PUType]enforcer.PolicyEnforcer{
-		constants.LinuxProcessPU: enforcer.NewWithDefaults(serverID,
+		constants.LinuxProcessPU: newLocalEnforcer(serverID,
 			eventCollector,
 			nil,
 			secrets,
 			constants.LocalServer,
-			DefaultProcMountPoint,
+			tokenType,
 		)}
 
 	s, err := supervisor.NewSupervisor(
@@ -78,7 +128,8 @@ func NewLocalTriremeDocker(
 	processor enforcer.PacketProcessor,
 	eventCollector collector.EventCollector,
 	secrets secrets.Secrets,
-	impl constants.ImplementationType) trireme.Trireme {
+	impl constants.ImplementationType,
+	tokenType tokens.TokenType) trireme.Trireme {
 
 	if eventCollector == nil {
 		zap.L().Warn("Using a default collector for events")
@@ -86,12 +137,12 @@ func NewLocalTriremeDocker(
 	}
 
 	enforcers := map[constants.PUType]enforcer.PolicyEnforcer{
-		constants.ContainerPU: enforcer.NewWithDefaults(serverID,
+		constants.ContainerPU: newLocalEnforcer(serverID,
 			eventCollector,
 			nil,
 			secrets,
 			constants.LocalContainer,
-			DefaultProcMountPoint,
+			tokenType,
 		)}
 
 	s, err := supervisor.NewSupervisor(
@@ -117,7 +168,8 @@ func NewDistributedTriremeDocker(serverID string,
 	processor enforcer.PacketProcessor,
 	eventCollector collector.EventCollector,
 	secrets secrets.Secrets,
-	impl constants.ImplementationType) trireme.Trireme {
+	impl constants.ImplementationType,
+	tokenType tokens.TokenType) trireme.Trireme {
 
 	if eventCollector == nil {
 		zap.L().Warn("Using a default collector for events")
@@ -127,12 +179,12 @@ func NewDistributedTriremeDocker(serverID string,
 	rpcwrapper := rpcwrapper.NewRPCWrapper()
 
 	enforcers := map[constants.PUType]enforcer.PolicyEnforcer{
-		constants.ContainerPU: enforcerproxy.NewDefaultProxyEnforcer(
+		constants.ContainerPU: newProxyEnforcer(
 			serverID,
 			eventCollector,
 			secrets,
 			rpcwrapper,
-			DefaultProcMountPoint,
+			tokenType,
 		),
 	}
 
@@ -155,6 +207,7 @@ func NewHybridTrireme(
 	eventCollector collector.EventCollector,
 	secrets secrets.Secrets,
 	networks []string,
+	tokenType tokens.TokenType,
 ) trireme.Trireme {
 
 	if eventCollector == nil {
@@ -163,12 +216,12 @@ func NewHybridTrireme(
 	}
 
 	rpcwrapper := rpcwrapper.NewRPCWrapper()
-	containerEnforcer := enforcerproxy.NewDefaultProxyEnforcer(
+	containerEnforcer := newProxyEnforcer(
 		serverID,
 		eventCollector,
 		secrets,
 		rpcwrapper,
-		DefaultProcMountPoint,
+		tokenType,
 	)
 
 	containerSupervisor, cerr := supervisorproxy.NewProxySupervisor(
@@ -180,12 +233,12 @@ func NewHybridTrireme(
 		zap.L().Fatal("Failed to load Supervisor", zap.Error(cerr))
 	}
 
-	processEnforcer := enforcer.NewWithDefaults(serverID,
+	processEnforcer := newLocalEnforcer(serverID,
 		eventCollector,
 		processor,
 		secrets,
 		constants.LocalServer,
-		DefaultProcMountPoint,
+		tokenType,
 	)
 
 	processSupervisor, perr := supervisor.NewSupervisor(
@@ -222,8 +275,20 @@ func NewSecretsFromPSK(key []byte) secrets.Secrets {
 
 // NewSecretsFromPKI creates secrets from a PKI
 func NewSecretsFromPKI(keyPEM, certPEM, caCertPEM []byte) secrets.Secrets {
-	secrets, err := secrets.NewPKISecrets(keyPEM, certPEM, caCertPEM, map[string]*ecdsa.PublicKey{})
+	secrets, err := secrets.NewPKISecrets(keyPEM, certPEM, caCertPEM, map[string]interface{}{})
+	if err != nil {
+		return nil
+	}
+	return secrets
+}
+
+// NewSecretsFromSPIFFE creates secrets from the X.509 SVIDs of the SPIFFE
+// workload API listening on the given Unix socket. The secrets are rotated
+// with the SVIDs.
+func NewSecretsFromSPIFFE(socketPath string) secrets.Secrets {
+	secrets, err := secrets.NewSPIFFESecrets(socketPath)
 	if err != nil {
+		zap.L().Error("Failed to create SPIFFE secrets", zap.Error(err))
 		return nil
 	}
 	return secrets
@@ -260,7 +325,8 @@ func NewPSKTriremeWithDockerMonitor(
 			processor,
 			eventCollector,
 			secrets,
-			constants.IPTables)
+			constants.IPTables,
+			tokens.JWTType)
 	} else {
 		triremeInstance = NewLocalTriremeDocker(
 			serverID,
@@ -268,7 +334,8 @@ func NewPSKTriremeWithDockerMonitor(
 			processor,
 			eventCollector,
 			secrets,
-			constants.IPTables)
+			constants.IPTables,
+			tokens.JWTType)
 	}
 
 	monitorInstance := dockermonitor.NewDockerMonitor(
@@ -308,7 +375,7 @@ func NewPKITriremeWithDockerMonitor(
 		eventCollector = &collector.DefaultCollector{}
 	}
 
-	publicKeyAdder, err := secrets.NewPKISecrets(keyPEM, certPEM, caCertPEM, map[string]*ecdsa.PublicKey{})
+	publicKeyAdder, err := secrets.NewPKISecrets(keyPEM, certPEM, caCertPEM, map[string]interface{}{})
 	if err != nil {
 		return nil, nil, nil
 	}
@@ -322,7 +389,8 @@ func NewPKITriremeWithDockerMonitor(
 			processor,
 			eventCollector,
 			publicKeyAdder,
-			constants.IPTables)
+			constants.IPTables,
+			tokens.JWTType)
 	} else {
 		triremeInstance = NewLocalTriremeDocker(
 			serverID,
@@ -330,7 +398,8 @@ func NewPKITriremeWithDockerMonitor(
 			processor,
 			eventCollector,
 			publicKeyAdder,
-			constants.IPTables)
+			constants.IPTables,
+			tokens.JWTType)
 	}
 
 	monitorInstance := dockermonitor.NewDockerMonitor(
@@ -376,6 +445,7 @@ func NewPSKHybridTriremeWithMonitor(
 		eventCollector,
 		secrets,
 		networks,
+		tokens.JWTType,
 	)
 
 	monitorDocker := dockermonitor.NewDockerMonitor(
@@ -447,6 +517,7 @@ func NewHybridCompactPKIWithDocker(
 		eventCollector,
 		secrets,
 		networks,
+		tokens.JWTType,
 	)
 
 	monitorDocker := dockermonitor.NewDockerMonitor(
@@ -519,6 +590,7 @@ func NewCompactPKIWithDocker(
 		eventCollector,
 		secrets,
 		constants.IPTables,
+		tokens.JWTType,
 	)
 
 	monitorDocker := dockermonitor.NewDockerMonitor(
@@ -563,7 +635,8 @@ func NewPSKTriremeWithCNIMonitor(
 			processor,
 			eventCollector,
 			secrets,
-			constants.IPTables)
+			constants.IPTables,
+			tokens.JWTType)
 	} else {
 		triremeInstance = NewLocalTriremeDocker(
 			serverID,
@@ -571,7 +644,8 @@ func NewPSKTriremeWithCNIMonitor(
 			processor,
 			eventCollector,
 			secrets,
-			constants.IPTables)
+			constants.IPTables,
+			tokens.JWTType)
 	}
 
 	rpcmon, err := rpcmonitor.NewRPCMonitor(
@@ -11,6 +11,7 @@ import (
 	"github.com/aporeto-inc/trireme/enforcer/proxy"
 	"github.com/aporeto-inc/trireme/enforcer/utils/rpcwrapper"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/enforcer/utils/tokens"
 	"github.com/aporeto-inc/trireme/monitor"
 	"github.com/aporeto-inc/trireme/monitor/dockermonitor"
 	"github.com/aporeto-inc/trireme/supervisor"
@@ -255,7 +256,7 @@ func testMonitorInstance(triremeInstance trireme.Trireme) monitor.Monitor {
 
 func TestNewTriremeLinuxProcess(t *testing.T) {
 	Convey("When I try to instantiate a new trireme linux process", t, func() {
-		_ = NewTriremeLinuxProcess("testServerID", policyResolver(), procPacket(), nil, secretGen(nil, nil, nil))
+		_ = NewTriremeLinuxProcess("testServerID", policyResolver(), procPacket(), nil, secretGen(nil, nil, nil), tokens.JWTType)
 
 		Convey("Then I should get correct instantiation of all data structures", func() {
 			// TODO: for some reasons the test fails, but the structs are strictly identical (at least in what the test ouputs).
@@ -266,7 +267,7 @@ func TestNewTriremeLinuxProcess(t *testing.T) {
 
 func TestNewLocalTriremeDocker(t *testing.T) {
 	Convey("When I try to instantiate a new local trireme docker", t, func() {
-		_ = NewLocalTriremeDocker("testServerID", policyResolver(), procPacket(), nil, secretGen(nil, nil, nil), constants.IPTables)
+		_ = NewLocalTriremeDocker("testServerID", policyResolver(), procPacket(), nil, secretGen(nil, nil, nil), constants.IPTables, tokens.JWTType)
 
 		Convey("Then I should get correct instantiation of all data structures", func() {
 			// TODO: for some reasons the test fails, but the structs are strictly identical (at least in what the test ouputs).
@@ -277,7 +278,7 @@ func TestNewLocalTriremeDocker(t *testing.T) {
 
 func TestNewDistributedTriremeDocker(t *testing.T) {
 	Convey("When I try to instantiate a new new distributed trireme docker", t, func() {
-		trirem := NewDistributedTriremeDocker("testServerID", policyResolver(), procPacket(), nil, secretGen(nil, nil, nil), constants.IPTables)
+		trirem := NewDistributedTriremeDocker("testServerID", policyResolver(), procPacket(), nil, secretGen(nil, nil, nil), constants.IPTables, tokens.JWTType)
 
 		Convey("Then trireme struct should not match because of random server secret don't match", func() {
 			So(trirem, ShouldNotResemble, testTriremeStruct("psk", "distributeddocker", constants.IPTables, constants.ContainerPU, constants.ContainerPU))
@@ -285,9 +286,19 @@ func TestNewDistributedTriremeDocker(t *testing.T) {
 	})
 }
 
+func TestNewProxyEnforcerTokenType(t *testing.T) {
+	Convey("When I create a proxy enforcer with binary tokens", t, func() {
+		e := newProxyEnforcer("testServerID", &collector.DefaultCollector{}, secretGen(nil, nil, nil), rpcwrapper.NewRPCWrapper(), tokens.BinaryType)
+
+		Convey("Then the remote enforcers should be initialized with binary tokens", func() {
+			So(e.(*enforcerproxy.ProxyInfo).TokenType, ShouldEqual, tokens.BinaryType)
+		})
+	})
+}
+
 func TestNewHybridTrireme(t *testing.T) {
 	Convey("When I try to instantiate a new hybrid trireme", t, func() {
-		trirem := NewHybridTrireme("testServerID", policyResolver(), procPacket(), nil, secretGen(nil, nil, nil), []string{"anyNetwork"})
+		trirem := NewHybridTrireme("testServerID", policyResolver(), procPacket(), nil, secretGen(nil, nil, nil), []string{"anyNetwork"}, tokens.JWTType)
 
 		Convey("Then trireme struct should not match because of random server secret don't match", func() {
 			So(trirem, ShouldNotResemble, testTriremeStruct("psk", "hybrid", constants.IPTables, constants.ContainerPU, constants.ContainerPU))
@@ -6,6 +6,12 @@ const (
 
 	// DefaultDockerSocketType is unix
 	DefaultDockerSocketType = "unix"
+
+	// DefaultContainerdSocket is the default socket to use to communicate with containerd
+	DefaultContainerdSocket = "/run/containerd/containerd.sock"
+
+	// DefaultContainerdNamespace is the containerd namespace of the containers created through CRI
+	DefaultContainerdNamespace = "k8s.io"
 )
 
 // ModeType defines the mode of the enforcement and supervisor.
@@ -30,6 +36,8 @@ const (
 	IPSets ImplementationType = iota
 	// IPTables mandates an IPTable supervisor implementation
 	IPTables
+	// NFTables mandates an nftables supervisor implementation
+	NFTables
 	// Remote indicates that this is a remote supervisor
 )
 
@@ -55,4 +63,7 @@ const (
 	DefaultRemoteArg = "enforce"
 	// DefaultConnMark is the default conn mark for all data packets
 	DefaultConnMark = uint32(0xEEEE)
+	// EncryptedConnMark is the conn mark for data packets of encrypted connections.
+	// These packets must still be processed by the datapath
+	EncryptedConnMark = uint32(0xEEEF)
 )
@@ -70,9 +70,10 @@ func GenerateRandomString(s int) (string, error) {
 	return base64.URLEncoding.EncodeToString(b), err
 }
 
-// CreateEphemeralKey creates an ephmeral private/public key based on the
-// provided public key and the corresponding elliptic curve
-func CreateEphemeralKey(curve func() elliptic.Curve, pub *ecdsa.PublicKey) (*ecdsa.PrivateKey, []byte) {
+// CreateEphemeralKey creates an ephmeral private/public key on the provided
+// elliptic curve. The public key is returned in its marshaled form so that it
+// can be transmitted in the tokens.
+func CreateEphemeralKey(curve func() elliptic.Curve) (*ecdsa.PrivateKey, []byte) {
 
 	ephemeral, err := ecdsa.GenerateKey(curve(), rand.Reader)
 
@@ -81,12 +82,35 @@ func CreateEphemeralKey(curve func() elliptic.Curve, pub *ecdsa.PublicKey) (*ecd
 		return nil, []byte{}
 	}
 
-	ephPub := elliptic.Marshal(pub.Curve, ephemeral.PublicKey.X, ephemeral.PublicKey.Y)
+	ephPub := elliptic.Marshal(ephemeral.Curve, ephemeral.PublicKey.X, ephemeral.PublicKey.Y)
 
 	return ephemeral, ephPub
 
 }
 
+// ComputeSharedKey computes the ECDH shared secret between a local ephemeral
+// private key and the marshaled ephemeral public key of the remote party
+func ComputeSharedKey(priv *ecdsa.PrivateKey, remotePub []byte) ([]byte, error) {
+
+	if priv == nil {
+		return nil, fmt.Errorf("No local ephemeral key")
+	}
+
+	x, y := elliptic.Unmarshal(priv.Curve, remotePub)
+	if x == nil {
+		return nil, fmt.Errorf("Invalid remote ephemeral key")
+	}
+
+	sx, _ := priv.Curve.ScalarMult(x, y, priv.D.Bytes())
+
+	size := (priv.Curve.Params().BitSize + 7) / 8
+	shared := make([]byte, size)
+	sxBytes := sx.Bytes()
+	copy(shared[size-len(sxBytes):], sxBytes)
+
+	return shared, nil
+}
+
 // LoadRootCertificates loads the certificates in the provide PEM buffer in a CertPool
 func LoadRootCertificates(rootPEM []byte) *x509.CertPool {
 
@@ -121,6 +145,37 @@ func LoadEllipticCurveKey(keyPEM []byte) (*ecdsa.PrivateKey, error) {
 	return key, nil
 }
 
+// LoadPrivateKey parses a signing key. The EC keys can be in SEC 1 or PKCS #8
+// form, and the Ed25519 keys in PKCS #8 form. Only the keys with a JWT
+// signing method are accepted.
+func LoadPrivateKey(keyPEM []byte) (interface{}, error) {
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to Parse PEM block")
+	}
+
+	var key interface{}
+	var err error
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := SigningMethod(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
 // LoadAndVerifyCertificate parses, validates, and creates a certificate structure from a PEM buffer
 // It must be provided with the a CertPool
 func LoadAndVerifyCertificate(certPEM []byte, roots *x509.CertPool) (*x509.Certificate, error) {
@@ -166,6 +221,33 @@ func LoadAndVerifyECSecrets(keyPEM, certPEM, caCertPEM []byte) (key *ecdsa.Priva
 
 }
 
+// LoadAndVerifySecrets loads the signing key, the certificate and the
+// authorities like LoadAndVerifyECSecrets, for all the supported key types.
+// The certificate must be the one of the key.
+func LoadAndVerifySecrets(keyPEM, certPEM, caCertPEM []byte) (key interface{}, cert *x509.Certificate, rootCertPool *x509.CertPool, err error) {
+
+	key, err = LoadPrivateKey(keyPEM)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	rootCertPool = LoadRootCertificates(caCertPEM)
+	if rootCertPool == nil {
+		return nil, nil, nil, fmt.Errorf("Failed to load root certificate pool")
+	}
+
+	cert, err = LoadAndVerifyCertificate(certPEM, rootCertPool)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !samePublicKey(key, cert.PublicKey) {
+		return nil, nil, nil, fmt.Errorf("Certificate does not match the key")
+	}
+
+	return key, cert, rootCertPool, nil
+}
+
 // LoadCertificate loads a certificate from a PEM file without verifying
 // Should only be used for loading a root CA certificate. It will only read
 // the first certificate
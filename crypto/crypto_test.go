@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"crypto/elliptic"
 	"fmt"
 	"testing"
 
@@ -70,6 +71,35 @@ func TestRandomString(t *testing.T) {
 	})
 }
 
+// TestComputeSharedKey tests the ephemeral key exchange
+func TestComputeSharedKey(t *testing.T) {
+	Convey("Given two ephemeral keys", t, func() {
+		privA, pubA := CreateEphemeralKey(elliptic.P256)
+		privB, pubB := CreateEphemeralKey(elliptic.P256)
+		So(privA, ShouldNotBeNil)
+		So(privB, ShouldNotBeNil)
+
+		Convey("Both sides should compute the same shared key", func() {
+			sharedA, errA := ComputeSharedKey(privA, pubB)
+			sharedB, errB := ComputeSharedKey(privB, pubA)
+			So(errA, ShouldBeNil)
+			So(errB, ShouldBeNil)
+			So(len(sharedA), ShouldEqual, 32)
+			So(sharedA, ShouldResemble, sharedB)
+		})
+
+		Convey("If the remote key is invalid, I should get an error", func() {
+			_, err := ComputeSharedKey(privA, []byte("invalid"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("If there is no local key, I should get an error", func() {
+			_, err := ComputeSharedKey(nil, pubB)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
 // TestFuncLoadEllipticCurve
 func TestFuncLoadEllipticCurve(t *testing.T) {
 	Convey("Given a valid EC key", t, func() {
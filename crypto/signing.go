@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"fmt"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA signs JWTs with Ed25519 keys
+var SigningMethodEdDSA jwt.SigningMethod = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+// signingMethodEdDSA implements the EdDSA signing method of RFC 8037
+type signingMethodEdDSA struct{}
+
+// Alg implements the interface jwt.SigningMethod
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Verify implements the interface jwt.SigningMethod
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok || len(publicKey) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+
+	return nil
+}
+
+// Sign implements the interface jwt.SigningMethod
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok || len(privateKey) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+// SigningMethod returns the JWT signing method of a key. The private and the
+// public keys of a pair have the same method: ES256 or ES384 for the EC keys
+// of these curves, EdDSA for the Ed25519 keys, HS256 for the pre-shared keys
+// and none for the null key.
+func SigningMethod(key interface{}) (jwt.SigningMethod, error) {
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return ecdsaSigningMethod(k.Curve)
+	case *ecdsa.PublicKey:
+		return ecdsaSigningMethod(k.Curve)
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return SigningMethodEdDSA, nil
+	case []byte:
+		return jwt.SigningMethodHS256, nil
+	}
+
+	if key == jwt.UnsafeAllowNoneSignatureType {
+		return jwt.SigningMethodNone, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported key type %T", key)
+}
+
+// CheckSigningMethod verifies that a token was signed with the method of the
+// key, so that a peer can not pick a method that the key is not meant for
+func CheckSigningMethod(method jwt.SigningMethod, key interface{}) error {
+
+	expected, err := SigningMethod(key)
+	if err != nil {
+		return err
+	}
+
+	if method == nil || method.Alg() != expected.Alg() {
+		return fmt.Errorf("Signing method does not match the key, expected %s", expected.Alg())
+	}
+
+	return nil
+}
+
+// ecdsaSigningMethod returns the JWT signing method of an EC curve
+func ecdsaSigningMethod(curve elliptic.Curve) (jwt.SigningMethod, error) {
+
+	switch curve {
+	case elliptic.P256():
+		return jwt.SigningMethodES256, nil
+	case elliptic.P384():
+		return jwt.SigningMethodES384, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported curve %s", curve.Params().Name)
+}
+
+// samePublicKey checks that a public key is the one of a private key
+func samePublicKey(privateKey interface{}, publicKey interface{}) bool {
+
+	switch k := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		return k.PublicKey.Equal(publicKey)
+	case ed25519.PrivateKey:
+		return k.Public().(ed25519.PublicKey).Equal(publicKey)
+	}
+
+	return false
+}
@@ -0,0 +1,186 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newSecrets returns the PEM of a PKCS #8 key, of a certificate of the public
+// key of certKey and of its self signed authority
+func newSecrets(key gocrypto.Signer, certKey gocrypto.Signer) (keyPEM, certPEM, caPEM []byte) {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	So(err, ShouldBeNil)
+	ca, err := x509.ParseCertificate(caDER)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, certKey.Public(), caKey)
+	So(err, ShouldBeNil)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	So(err, ShouldBeNil)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+}
+
+func TestSigningMethod(t *testing.T) {
+
+	Convey("Given keys of all the supported types", t, func() {
+		p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		So(err, ShouldBeNil)
+		edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+
+		Convey("The signing method should follow the key type", func() {
+			for key, expected := range map[interface{}]jwt.SigningMethod{
+				p256:                             jwt.SigningMethodES256,
+				&p256.PublicKey:                  jwt.SigningMethodES256,
+				p384:                             jwt.SigningMethodES384,
+				&p384.PublicKey:                  jwt.SigningMethodES384,
+				jwt.UnsafeAllowNoneSignatureType: jwt.SigningMethodNone,
+			} {
+				method, err := SigningMethod(key)
+				So(err, ShouldBeNil)
+				So(method, ShouldEqual, expected)
+			}
+
+			method, err := SigningMethod(edPrivate)
+			So(err, ShouldBeNil)
+			So(method, ShouldEqual, SigningMethodEdDSA)
+			method, err = SigningMethod(edPublic)
+			So(err, ShouldBeNil)
+			So(method, ShouldEqual, SigningMethodEdDSA)
+			method, err = SigningMethod([]byte("psk"))
+			So(err, ShouldBeNil)
+			So(method, ShouldEqual, jwt.SigningMethodHS256)
+		})
+
+		Convey("The keys of other curves should be rejected", func() {
+			p521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+			So(err, ShouldBeNil)
+			_, err = SigningMethod(p521)
+			So(err, ShouldNotBeNil)
+			_, err = SigningMethod("key")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When I sign a token with an Ed25519 key", func() {
+			token, err := jwt.NewWithClaims(SigningMethodEdDSA, jwt.StandardClaims{Issuer: "node"}).SignedString(edPrivate)
+			So(err, ShouldBeNil)
+
+			Convey("It should be verified with the public key", func() {
+				parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+					return edPublic, CheckSigningMethod(token.Method, edPublic)
+				})
+				So(err, ShouldBeNil)
+				So(parsed.Valid, ShouldBeTrue)
+			})
+
+			Convey("It should be rejected with another public key", func() {
+				other, _, err := ed25519.GenerateKey(rand.Reader)
+				So(err, ShouldBeNil)
+				_, err = jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+					return other, nil
+				})
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("It should be rejected for an EC key", func() {
+				So(CheckSigningMethod(SigningMethodEdDSA, &p256.PublicKey), ShouldNotBeNil)
+				So(CheckSigningMethod(jwt.SigningMethodES256, &p384.PublicKey), ShouldNotBeNil)
+				So(CheckSigningMethod(jwt.SigningMethodES384, &p384.PublicKey), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestLoadAndVerifySecrets(t *testing.T) {
+
+	Convey("Given secrets with an Ed25519 key", t, func() {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		keyPEM, certPEM, caPEM := newSecrets(key, key)
+
+		Convey("They should be loaded", func() {
+			loaded, cert, roots, err := LoadAndVerifySecrets(keyPEM, certPEM, caPEM)
+			So(err, ShouldBeNil)
+			So(loaded, ShouldResemble, key)
+			So(cert.PublicKey, ShouldResemble, key.Public())
+			So(roots, ShouldNotBeNil)
+		})
+
+		Convey("They should be rejected with the certificate of another key", func() {
+			_, other, err := ed25519.GenerateKey(rand.Reader)
+			So(err, ShouldBeNil)
+			keyPEM, certPEM, caPEM := newSecrets(key, other)
+
+			_, _, _, err = LoadAndVerifySecrets(keyPEM, certPEM, caPEM)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given secrets with a P-384 key", t, func() {
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		So(err, ShouldBeNil)
+		keyPEM, certPEM, caPEM := newSecrets(key, key)
+
+		Convey("They should be loaded from the PKCS #8 and the SEC 1 forms", func() {
+			loaded, _, _, err := LoadAndVerifySecrets(keyPEM, certPEM, caPEM)
+			So(err, ShouldBeNil)
+			So(loaded.(*ecdsa.PrivateKey).D, ShouldResemble, key.D)
+
+			ecDER, err := x509.MarshalECPrivateKey(key)
+			So(err, ShouldBeNil)
+			loaded, err = LoadPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}))
+			So(err, ShouldBeNil)
+			So(loaded.(*ecdsa.PrivateKey).D, ShouldResemble, key.D)
+		})
+	})
+
+	Convey("Given a key of an unsupported curve", t, func() {
+		key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		So(err, ShouldBeNil)
+		keyPEM, _, _ := newSecrets(key, key)
+
+		Convey("It should be rejected", func() {
+			_, err := LoadPrivateKey(keyPEM)
+			So(err, ShouldNotBeNil)
+			_, err = LoadPrivateKey([]byte("key"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,58 @@
+package enforcer
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/collector"
+)
+
+// acceptedFlowLifetime is the time an accepted flow waits for the destruction
+// of its conntrack entry. It is the default timeout of established TCP
+// connections in conntrack.
+const acceptedFlowLifetime = 5 * 24 * time.Hour
+
+// acceptedFlowTuple returns the conntrack tuple of an accepted flow. The
+// accepted records are reported for the packets of the original direction.
+func acceptedFlowTuple(record *collector.FlowRecord) flowTuple {
+
+	return flowTuple{
+		protocol: record.Protocol,
+		srcIP:    record.Source.IP,
+		dstIP:    record.Destination.IP,
+		srcPort:  record.Source.Port,
+		dstPort:  record.Destination.Port,
+	}
+}
+
+// listenFlowTerminations reports the final records of the accepted flows when
+// conntrack destroys their entries, until stop is closed
+func (d *Datapath) listenFlowTerminations(stop <-chan struct{}) {
+
+	if err := d.flowListener.listen(stop, d.reportFinalFlow); err != nil {
+		zap.L().Error("Unable to report the final records of the flows", zap.Error(err))
+	}
+}
+
+// reportFinalFlow reports the final record of an accepted flow with the
+// counters of its destroyed conntrack entry
+func (d *Datapath) reportFinalFlow(flow flowTuple, counters *collector.FlowCounters) {
+
+	item, err := d.acceptedFlows.Get(flow)
+	if err != nil {
+		return
+	}
+
+	// The flow may be destroyed again if it is recreated by a late packet
+	if err := d.acceptedFlows.Remove(flow); err != nil {
+		return
+	}
+
+	record := *item.(*collector.FlowRecord)
+	record.LastSeen = time.Now()
+	record.Counters = counters
+	record.Final = true
+
+	d.collector.CollectFlowEvent(&record)
+}
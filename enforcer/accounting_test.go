@@ -0,0 +1,191 @@
+package enforcer
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// channelCollector sends the flow records to a channel
+type channelCollector struct {
+	flows chan *collector.FlowRecord
+}
+
+func (c *channelCollector) CollectFlowEvent(record *collector.FlowRecord) { c.flows <- record }
+
+func (c *channelCollector) CollectContainerEvent(record *collector.ContainerRecord) {}
+
+// accountingEvents reports the destruction of a single flow
+type accountingEvents struct {
+	flow     flowTuple
+	counters *collector.FlowCounters
+}
+
+func (e *accountingEvents) listen(stop <-chan struct{}, terminated func(flow flowTuple, counters *collector.FlowCounters)) error {
+
+	terminated(e.flow, e.counters)
+	<-stop
+
+	return nil
+}
+
+// tcpTestPacket creates the bytes of a TCP packet without payload
+func tcpTestPacket(src string, dst string, srcPort uint16, dstPort uint16) *packet.Packet {
+	return tcpTestDataPacket(src, dst, srcPort, dstPort, nil)
+}
+
+func tcpTestDataPacket(src string, dst string, srcPort uint16, dstPort uint16, data []byte) *packet.Packet {
+
+	buffer := make([]byte, 40, 40+len(data))
+	buffer[0] = 0x45
+	binary.BigEndian.PutUint16(buffer[2:4], uint16(len(buffer)))
+	buffer[8] = 64
+	buffer[9] = packet.IPProtocolTCP
+	copy(buffer[12:16], net.ParseIP(src).To4())
+	copy(buffer[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(buffer[20:22], srcPort)
+	binary.BigEndian.PutUint16(buffer[22:24], dstPort)
+	buffer[32] = 0x50
+	buffer[33] = packet.TCPAckMask
+	buffer = append(buffer, data...)
+	binary.BigEndian.PutUint16(buffer[2:4], uint16(len(buffer)))
+
+	p, err := packet.New(packet.PacketTypeNetwork, buffer, "0")
+	So(err, ShouldBeNil)
+
+	return p
+}
+
+func TestFinalFlowRecord(t *testing.T) {
+
+	Convey("Given an enforcer with a connection that was accepted", t, func() {
+
+		records := &channelCollector{flows: make(chan *collector.FlowRecord, 10)}
+		secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+		enforcer := NewWithDefaults("SomeServerId", records, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+
+		flow := flowTuple{
+			protocol: packet.IPProtocolTCP,
+			srcIP:    "10.1.1.1",
+			dstIP:    "10.1.1.2",
+			srcPort:  2000,
+			dstPort:  80,
+		}
+		counters := &collector.FlowCounters{
+			SourceBytes:        1000,
+			SourcePackets:      10,
+			DestinationBytes:   5000,
+			DestinationPackets: 8,
+		}
+
+		context := &PUContext{ID: "pu1", ManagementID: "pu1", Annotations: policy.NewTagStore()}
+
+		p := tcpTestPacket("10.1.1.1", "10.1.1.2", 2000, 80)
+
+		conn := NewTCPConnection()
+		conn.SetLastSeen(conn.firstSeen.Add(time.Second))
+		enforcer.reportAcceptedFlow(p, conn, "remote", "pu1", context, &policy.FlowPolicy{Action: policy.Accept}, nil)
+
+		accepted := <-records.flows
+
+		Convey("The accepted record should have the times and the protocol of the connection", func() {
+			So(accepted.Final, ShouldBeFalse)
+			So(accepted.Counters, ShouldBeNil)
+			So(accepted.Protocol, ShouldEqual, packet.IPProtocolTCP)
+			So(accepted.Source.Port, ShouldEqual, 2000)
+			So(accepted.FirstSeen, ShouldResemble, conn.firstSeen)
+			So(accepted.LastSeen, ShouldResemble, conn.firstSeen.Add(time.Second))
+		})
+
+		Convey("When the connection expires from the trackers", func() {
+			TCPConnectionExpirationNotifier(enforcer.netOrigConnectionTracker, "key", conn)
+
+			Convey("No final record should be reported", func() {
+				So(len(records.flows), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When conntrack destroys the entry of the flow twice", func() {
+			before := time.Now()
+			enforcer.reportFinalFlow(flow, counters)
+			enforcer.reportFinalFlow(flow, counters)
+
+			final := <-records.flows
+
+			Convey("A single final record should be reported with the conntrack counters", func() {
+				So(final.Final, ShouldBeTrue)
+				So(final.Source.ID, ShouldEqual, "remote")
+				So(final.Destination.ID, ShouldEqual, "pu1")
+				So(final.FirstSeen, ShouldResemble, conn.firstSeen)
+				So(final.LastSeen.Before(before), ShouldBeFalse)
+				So(final.Counters, ShouldResemble, counters)
+				So(len(records.flows), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When conntrack destroys the entry of another flow", func() {
+			other := flow
+			other.srcPort = 2001
+			enforcer.reportFinalFlow(other, counters)
+
+			Convey("No final record should be reported", func() {
+				So(len(records.flows), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When conntrack destroys the entry without counters", func() {
+			enforcer.reportFinalFlow(flow, nil)
+
+			Convey("The final record should be reported without counters", func() {
+				final := <-records.flows
+				So(final.Final, ShouldBeTrue)
+				So(final.Counters, ShouldBeNil)
+			})
+		})
+
+		Convey("When the listener of the flow terminations reports the flow", func() {
+			enforcer.flowListener = &accountingEvents{flow: flow, counters: counters}
+			stop := make(chan struct{})
+			go enforcer.listenFlowTerminations(stop)
+			defer close(stop)
+
+			Convey("The final record should be reported", func() {
+				final := <-records.flows
+				So(final.Final, ShouldBeTrue)
+				So(final.Counters, ShouldResemble, counters)
+			})
+		})
+	})
+
+	Convey("Given a connection that was rejected", t, func() {
+
+		records := &channelCollector{flows: make(chan *collector.FlowRecord, 10)}
+		secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+		enforcer := NewWithDefaults("SomeServerId", records, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+
+		context := &PUContext{ID: "pu1", ManagementID: "pu1", Annotations: policy.NewTagStore()}
+		conn := NewTCPConnection()
+		enforcer.reportRejectedFlow(tcpTestPacket("10.1.1.1", "10.1.1.2", 2000, 80), conn, "remote", "pu1", context, collector.PolicyDrop, nil, nil)
+		<-records.flows
+
+		Convey("No final record should be reported when conntrack destroys its entry", func() {
+			enforcer.reportFinalFlow(flowTuple{
+				protocol: packet.IPProtocolTCP,
+				srcIP:    "10.1.1.1",
+				dstIP:    "10.1.1.2",
+				srcPort:  2000,
+				dstPort:  80,
+			}, nil)
+
+			So(len(records.flows), ShouldEqual, 0)
+		})
+	})
+}
@@ -22,14 +22,25 @@ type PortActionList []*PortAction
 
 // ACLCache holds all the ACLS in an internal DB
 // map[prefixes][subnets] -> list of ports with their actions
+// IPv6 ACLs are kept separately and indexed by the prefix length
+// A cache only holds the rules of one protocol
 type ACLCache struct {
-	prefixMap map[uint32]map[uint32]PortActionList
+	protocol   string
+	prefixMap  map[uint32]map[uint32]PortActionList
+	prefixMap6 map[int]map[[net.IPv6len]byte]PortActionList
 }
 
-// NewACLCache creates a new ACL cache
+// NewACLCache creates a new ACL cache for the TCP rules
 func NewACLCache() *ACLCache {
+	return NewProtocolACLCache("tcp")
+}
+
+// NewProtocolACLCache creates a new ACL cache for the rules of the given protocol
+func NewProtocolACLCache(protocol string) *ACLCache {
 	return &ACLCache{
-		prefixMap: make(map[uint32]map[uint32]PortActionList),
+		protocol:   strings.ToLower(protocol),
+		prefixMap:  make(map[uint32]map[uint32]PortActionList),
+		prefixMap6: make(map[int]map[[net.IPv6len]byte]PortActionList),
 	}
 }
 
@@ -79,7 +90,7 @@ func createPortAction(rule policy.IPRule) *PortAction {
 func (c *ACLCache) AddRule(rule policy.IPRule) (err error) {
 	var subnet, mask uint32
 
-	if strings.ToLower(rule.Protocol) != "tcp" {
+	if strings.ToLower(rule.Protocol) != c.protocol {
 		return nil
 	}
 
@@ -90,6 +101,10 @@ func (c *ACLCache) AddRule(rule policy.IPRule) (err error) {
 		return fmt.Errorf("Invalid address")
 	}
 
+	if subnetSlice.To4() == nil {
+		return c.addRule6(rule, subnetSlice, parts)
+	}
+
 	subnet = binary.BigEndian.Uint32(subnetSlice.To4())
 
 	switch len(parts) {
@@ -97,7 +112,7 @@ func (c *ACLCache) AddRule(rule policy.IPRule) (err error) {
 		mask = 0xFFFFFFFF
 	case 2:
 		maskvalue, err := strconv.Atoi(parts[1])
-		if err != nil || mask > 32 {
+		if err != nil || maskvalue < 0 || maskvalue > 32 {
 			return fmt.Errorf("Invalid address")
 		}
 		mask = binary.BigEndian.Uint32(net.CIDRMask(maskvalue, 32))
@@ -121,6 +136,48 @@ func (c *ACLCache) AddRule(rule policy.IPRule) (err error) {
 	return nil
 }
 
+// addRule6 adds a single IPv6 rule to the ACL Cache
+func (c *ACLCache) addRule6(rule policy.IPRule, subnetSlice net.IP, parts []string) error {
+
+	prefix := 8 * net.IPv6len
+
+	switch len(parts) {
+	case 1:
+	case 2:
+		maskvalue, err := strconv.Atoi(parts[1])
+		if err != nil || maskvalue < 0 || maskvalue > 8*net.IPv6len {
+			return fmt.Errorf("Invalid address")
+		}
+		prefix = maskvalue
+	default:
+		return fmt.Errorf("Invalid address")
+	}
+
+	a := createPortAction(rule)
+	if a == nil {
+		return fmt.Errorf("Invalid port")
+	}
+
+	if _, ok := c.prefixMap6[prefix]; !ok {
+		c.prefixMap6[prefix] = make(map[[net.IPv6len]byte]PortActionList)
+	}
+
+	subnet := maskIPv6(subnetSlice, prefix)
+
+	c.prefixMap6[prefix][subnet] = append(c.prefixMap6[prefix][subnet], a)
+
+	return nil
+}
+
+// maskIPv6 returns the subnet of an IPv6 address for the given prefix length
+func maskIPv6(ip net.IP, prefix int) [net.IPv6len]byte {
+
+	var subnet [net.IPv6len]byte
+	copy(subnet[:], ip.Mask(net.CIDRMask(prefix, 8*net.IPv6len)))
+
+	return subnet
+}
+
 // AddRuleList adds a list of rules to the cache
 func (c *ACLCache) AddRuleList(rules policy.IPRuleList) (err error) {
 
@@ -133,24 +190,65 @@ func (c *ACLCache) AddRuleList(rules policy.IPRuleList) (err error) {
 	return
 }
 
-// GetMatchingAction gets the matching action
+// GetMatchingAction gets the matching action. The ip can be an IPv4 or
+// an IPv6 address.
 func (c *ACLCache) GetMatchingAction(ip []byte, port uint16) (*policy.FlowPolicy, error) {
 
+	if ip4 := net.IP(ip).To4(); ip4 != nil {
+		return c.getMatchingAction4(ip4, port)
+	}
+
+	if len(ip) == net.IPv6len {
+		return c.getMatchingAction6(ip, port)
+	}
+
+	return &policy.FlowPolicy{Action: policy.Reject, PolicyID: "default", ServiceID: "default"}, fmt.Errorf("Invalid address")
+}
+
+// getMatchingAction4 gets the matching action of an IPv4 address
+func (c *ACLCache) getMatchingAction4(ip []byte, port uint16) (*policy.FlowPolicy, error) {
+
 	addr := binary.BigEndian.Uint32(ip)
 	// Iterate over all the bitmasks we have
 	for bitmask, pmap := range c.prefixMap {
 
 		// Do a lookup as a hash to see if we have a match
 		if actionList, ok := pmap[addr&bitmask]; ok {
+			if p := actionList.match(port); p != nil {
+				return p, nil
+			}
+		}
+	}
 
-			// Scan the ports - TODO: better algorithm needed hefe
-			for _, p := range actionList {
-				if port >= p.min && port <= p.max {
-					return p.policy, nil
-				}
+	return &policy.FlowPolicy{Action: policy.Reject, PolicyID: "default", ServiceID: "default"}, fmt.Errorf("No match")
+}
+
+// getMatchingAction6 gets the matching action of an IPv6 address
+func (c *ACLCache) getMatchingAction6(ip net.IP, port uint16) (*policy.FlowPolicy, error) {
+
+	// Iterate over all the prefix lengths we have
+	for prefix, pmap := range c.prefixMap6 {
+
+		// Do a lookup as a hash to see if we have a match
+		if actionList, ok := pmap[maskIPv6(ip, prefix)]; ok {
+			if p := actionList.match(port); p != nil {
+				return p, nil
 			}
 		}
 	}
 
 	return &policy.FlowPolicy{Action: policy.Reject, PolicyID: "default", ServiceID: "default"}, fmt.Errorf("No match")
 }
+
+// match returns the policy of the first action that includes the port
+func (l PortActionList) match(port uint16) *policy.FlowPolicy {
+
+	// Scan the ports - TODO: better algorithm needed hefe
+	for _, p := range l {
+		if port >= p.min && port <= p.max {
+			return p.policy
+		}
+	}
+
+	return nil
+}
@@ -48,6 +48,39 @@ var (
 				Action:   policy.Accept,
 				PolicyID: "5"}},
 	}
+
+	rules6 = policy.IPRuleList{
+		policy.IPRule{
+			Address:  "fd00:1::/32",
+			Port:     "400:500",
+			Protocol: "tcp",
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Accept,
+				PolicyID: "1"},
+		},
+		policy.IPRule{
+			Address:  "fd00:2:0:1::/64",
+			Protocol: "tcp",
+			Port:     "80",
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Accept,
+				PolicyID: "2"},
+		},
+		policy.IPRule{
+			Address:  "fd00:3::1",
+			Protocol: "tcp",
+			Port:     "80",
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Accept,
+				PolicyID: "3"}},
+		policy.IPRule{
+			Address:  "10.1.1.0/24",
+			Protocol: "tcp",
+			Port:     "80",
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Accept,
+				PolicyID: "4"}},
+	}
 )
 
 func TestLookup(t *testing.T) {
@@ -99,4 +132,86 @@ func TestLookup(t *testing.T) {
 		})
 
 	})
+
+	Convey("Given a DB of the UDP rules", t, func() {
+		c := NewProtocolACLCache("UDP")
+		err := c.AddRuleList(rules)
+		So(err, ShouldBeNil)
+		So(len(c.prefixMap), ShouldEqual, 1)
+
+		Convey("When I lookup for the address of the UDP rule, I should get the right action", func() {
+			ip := net.ParseIP("192.168.200.1")
+			a, err := c.GetMatchingAction(ip.To4(), 443)
+			So(err, ShouldBeNil)
+			So(a.PolicyID, ShouldEqual, "5")
+		})
+
+		Convey("When I lookup for the address of a TCP rule, I should get reject", func() {
+			ip := net.ParseIP("10.1.1.1")
+			a, err := c.GetMatchingAction(ip.To4(), 80)
+			So(err, ShouldNotBeNil)
+			So(a.Action, ShouldEqual, policy.Reject)
+		})
+	})
+}
+
+func TestLookupIPv6(t *testing.T) {
+
+	Convey("Given a good DB with IPv6 and IPv4 rules", t, func() {
+		c := NewACLCache()
+		err := c.AddRuleList(rules6)
+		So(err, ShouldBeNil)
+		So(len(c.prefixMap6), ShouldEqual, 3)
+		So(len(c.prefixMap), ShouldEqual, 1)
+
+		Convey("When I lookup for a matching address and a port range, I should get the right action", func() {
+			a, err := c.GetMatchingAction(net.ParseIP("fd00:1:ffff::1"), uint16(450))
+			So(err, ShouldBeNil)
+			So(a.PolicyID, ShouldEqual, "1")
+		})
+
+		Convey("When I lookup for a matching address exact port, I should get the right action", func() {
+			a, err := c.GetMatchingAction(net.ParseIP("fd00:2:0:1:abcd::1"), uint16(80))
+			So(err, ShouldBeNil)
+			So(a.PolicyID, ShouldEqual, "2")
+		})
+
+		Convey("When I lookup for a matching exact address exact port, I should get the right action", func() {
+			a, err := c.GetMatchingAction(net.ParseIP("fd00:3::1"), uint16(80))
+			So(err, ShouldBeNil)
+			So(a.PolicyID, ShouldEqual, "3")
+		})
+
+		Convey("When I lookup for a non matching address . I should get reject", func() {
+			a, err := c.GetMatchingAction(net.ParseIP("fd00:2:0:2::1"), uint16(80))
+			So(err, ShouldNotBeNil)
+			So(a.Action, ShouldEqual, policy.Reject)
+		})
+
+		Convey("When I lookup for an IPv4 address in its 16 byte form, I should get the IPv4 action", func() {
+			a, err := c.GetMatchingAction(net.ParseIP("10.1.1.10"), uint16(80))
+			So(err, ShouldBeNil)
+			So(a.PolicyID, ShouldEqual, "4")
+		})
+
+		Convey("When I lookup for an invalid address, I should get reject", func() {
+			a, err := c.GetMatchingAction([]byte{1, 2}, uint16(80))
+			So(err, ShouldNotBeNil)
+			So(a.Action, ShouldEqual, policy.Reject)
+		})
+	})
+
+	Convey("Given an IPv6 rule with an invalid prefix", t, func() {
+		c := NewACLCache()
+		err := c.AddRule(policy.IPRule{
+			Address:  "fd00::/129",
+			Protocol: "tcp",
+			Port:     "80",
+			Policy:   &policy.FlowPolicy{Action: policy.Accept},
+		})
+
+		Convey("I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
 }
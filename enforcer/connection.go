@@ -1,6 +1,7 @@
 package enforcer
 
 import (
+	"crypto/ecdsa"
 	"fmt"
 	"sync"
 	"time"
@@ -60,6 +61,11 @@ type AuthInfo struct {
 	RemotePublicKey interface{}
 	RemoteIP        string
 	RemotePort      string
+	// LocalEphemeralKey is the private key of the ephemeral key transmitted
+	// in our token when the connection is negotiating encryption
+	LocalEphemeralKey *ecdsa.PrivateKey
+	// RemoteEphemeralKey is the ephemeral key received from the remote
+	RemoteEphemeralKey []byte
 }
 
 // TCPConnection is information regarding TCP Connection
@@ -91,6 +97,22 @@ type TCPConnection struct {
 
 	// FlowPolicy holds the last matched policy
 	FlowPolicy *policy.FlowPolicy
+
+	// PolicyTrace holds the clauses of the last matched policy that were
+	// satisfied by the tags of the remote endpoint
+	PolicyTrace []string
+
+	// encryption holds the session keys if the connection is encrypted
+	encryption *flowCipher
+
+	// remoteMSS is the MSS announced by the remote, which leaves room for
+	// the encryption option if the connection is encrypted
+	remoteMSS uint16
+
+	// firstSeen and lastSeen are the times of the first and last packets
+	// of the connection processed by the datapath
+	firstSeen time.Time
+	lastSeen  time.Time
 }
 
 // TCPConnectionExpirationNotifier handles processing the expiration of an element
@@ -159,6 +181,12 @@ func (c *TCPConnection) SetReported(flowState bool) {
 	c.logs = append(c.logs, reported)
 }
 
+// SetLastSeen records the time of the last packet of the connection
+func (c *TCPConnection) SetLastSeen(t time.Time) {
+
+	c.lastSeen = t
+}
+
 // SetPacketInfo is used to setup the state for the TCP connection
 func (c *TCPConnection) SetPacketInfo(flowHash, tcpFlags string) {
 
@@ -192,10 +220,83 @@ func (c *TCPConnection) Cleanup(expiration bool) {
 // NewTCPConnection returns a TCPConnection information struct
 func NewTCPConnection() *TCPConnection {
 
+	now := time.Now()
+
 	c := &TCPConnection{
-		state: TCPSynSend,
-		logs:  []string{"Initialized"},
+		state:     TCPSynSend,
+		logs:      []string{"Initialized"},
+		firstSeen: now,
+		lastSeen:  now,
 	}
 
 	return c
 }
+
+// UDPFlowState identifies the constants of the state of a UDP flow
+type UDPFlowState int
+
+const (
+
+	// UDPStart is the state of a flow for which no packet has been processed
+	UDPStart UDPFlowState = iota
+
+	// UDPSynSend is the state where the packets carry the Syn token, but no reply has been received
+	UDPSynSend
+
+	// UDPSynReceived indicates that the Syn token has been accepted and replies carry the SynAck token
+	UDPSynReceived
+
+	// UDPData indicates that the flow has been authorized
+	UDPData
+)
+
+// UDPConnection is information regarding a UDP flow
+type UDPConnection struct {
+	sync.Mutex
+
+	state UDPFlowState
+	Auth  AuthInfo
+
+	// Context is the PUContext that is associated with this connection
+	Context *PUContext
+
+	// FlowPolicy holds the last matched policy
+	FlowPolicy *policy.FlowPolicy
+
+	// initiator indicates that the flow was started by the local PU
+	initiator bool
+
+	// token is attached to the packets until the remote responds
+	token []byte
+
+	// handshakeStart is the time at which the current token was first attached
+	handshakeStart time.Time
+}
+
+// NewUDPConnection returns a UDPConnection information struct
+func NewUDPConnection(context *PUContext, initiator bool) *UDPConnection {
+
+	return &UDPConnection{
+		state:     UDPStart,
+		Context:   context,
+		initiator: initiator,
+	}
+}
+
+// String returns a printable version of connection
+func (c *UDPConnection) String() string {
+
+	return fmt.Sprintf("state:%d auth: %+v", c.state, c.Auth)
+}
+
+// GetState is used to return the state
+func (c *UDPConnection) GetState() UDPFlowState {
+
+	return c.state
+}
+
+// SetState is used to setup the state for the UDP connection
+func (c *UDPConnection) SetState(state UDPFlowState) {
+
+	c.state = state
+}
@@ -1,14 +1,26 @@
 package enforcer
 
+import "time"
+
 const (
 	// TCPAuthenticationOptionBaseLen specifies the length of base TCP Authentication Option packet
 	TCPAuthenticationOptionBaseLen = 4
 	// TCPAuthenticationOptionAckLen specifies the length of TCP Authentication Option in the ack packet
 	TCPAuthenticationOptionAckLen = 20
+	// UDPAuthenticationHeaderLen specifies the length of the header in front of tokens in UDP payloads
+	UDPAuthenticationHeaderLen = 8
+	// UDPAuthenticationMagic identifies UDP payloads that start with a token
+	UDPAuthenticationMagic = uint32(0x54524d55)
 	// PortNumberLabelString is the label to use for port numbers
 	PortNumberLabelString = "$sys:port"
+	// SPIFFEIDLabelString is the label carrying the SPIFFE ID of the certificate of the transmitter
+	SPIFFEIDLabelString = "$sys:spiffeid"
 	// TransmitterLabel is the name of the label used to identify the Transmitter Context
 	TransmitterLabel = "AporetoContextID"
 	// DefaultNetwork to be used
 	DefaultNetwork = "0.0.0.0/0"
+	// EncryptedConnectionTimeout is the idle time after which the state of an
+	// encrypted connection is released. Data packets of encrypted connections
+	// always need the state to be processed.
+	EncryptedConnectionTimeout = time.Hour
 )
@@ -0,0 +1,22 @@
+package enforcer
+
+import (
+	"github.com/aporeto-inc/trireme/collector"
+)
+
+// flowTuple identifies a flow by the original direction of its conntrack entry
+type flowTuple struct {
+	protocol uint8
+	srcIP    string
+	dstIP    string
+	srcPort  uint16
+	dstPort  uint16
+}
+
+// flowTerminationListener reports the conntrack entries that are destroyed
+type flowTerminationListener interface {
+	// listen calls terminated with the tuple and the counters of every
+	// destroyed conntrack entry until stop is closed. The counters are nil
+	// if conntrack accounting is disabled.
+	listen(stop <-chan struct{}, terminated func(flow flowTuple, counters *collector.FlowCounters)) error
+}
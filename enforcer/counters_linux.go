@@ -0,0 +1,201 @@
+// +build linux
+
+package enforcer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+
+	"github.com/aporeto-inc/trireme/collector"
+)
+
+// conntrackEvents listens to the destroy events of conntrack. The events carry
+// the counters of the entries if nf_conntrack_acct is enabled.
+type conntrackEvents struct{}
+
+func newConntrackEvents() flowTerminationListener {
+	return &conntrackEvents{}
+}
+
+// listen subscribes to the destroy events of conntrack and reports them until
+// stop is closed
+func (c *conntrackEvents) listen(stop <-chan struct{}, terminated func(flow flowTuple, counters *collector.FlowCounters)) error {
+
+	s, err := nl.Subscribe(unix.NETLINK_NETFILTER, unix.NFNLGRP_CONNTRACK_DESTROY)
+	if err != nil {
+		return fmt.Errorf("Unable to subscribe to conntrack events: %s", err)
+	}
+	defer s.Close()
+
+	// Closing the socket interrupts the receive
+	go func() {
+		<-stop
+		s.Close()
+	}()
+
+	for {
+		msgs, _, err := s.Receive()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+
+			// The socket overran and some events are lost
+			if err == unix.ENOBUFS {
+				zap.L().Warn("Lost conntrack events")
+				continue
+			}
+
+			return fmt.Errorf("Unable to receive conntrack events: %s", err)
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Type&0xff != nl.IPCTNL_MSG_CT_DELETE {
+				continue
+			}
+
+			flow, counters, err := parseConntrackEvent(msg.Data)
+			if err != nil {
+				zap.L().Debug("Invalid conntrack event", zap.Error(err))
+				continue
+			}
+
+			terminated(flow, counters)
+		}
+	}
+}
+
+// parseConntrackEvent returns the original tuple and the counters of a
+// conntrack message. The counters are nil if the message has none.
+func parseConntrackEvent(msg []byte) (flowTuple, *collector.FlowCounters, error) {
+
+	flow := flowTuple{}
+
+	if len(msg) < nl.SizeofNfgenmsg {
+		return flow, nil, fmt.Errorf("Invalid conntrack message")
+	}
+
+	attrs, err := nl.ParseRouteAttr(msg[nl.SizeofNfgenmsg:])
+	if err != nil {
+		return flow, nil, fmt.Errorf("Invalid conntrack message: %s", err)
+	}
+
+	var counters *collector.FlowCounters
+	found := false
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type & nl.NLA_TYPE_MASK {
+		case nl.CTA_TUPLE_ORIG:
+			if flow, err = parseTupleAttrs(attr); err != nil {
+				return flow, nil, err
+			}
+			found = true
+		case nl.CTA_COUNTERS_ORIG:
+			if counters == nil {
+				counters = &collector.FlowCounters{}
+			}
+			if counters.SourceBytes, counters.SourcePackets, err = parseCounterAttrs(attr); err != nil {
+				return flow, nil, err
+			}
+		case nl.CTA_COUNTERS_REPLY:
+			if counters == nil {
+				counters = &collector.FlowCounters{}
+			}
+			if counters.DestinationBytes, counters.DestinationPackets, err = parseCounterAttrs(attr); err != nil {
+				return flow, nil, err
+			}
+		}
+	}
+
+	if !found {
+		return flow, nil, fmt.Errorf("No tuple in conntrack message")
+	}
+
+	return flow, counters, nil
+}
+
+// parseTupleAttrs returns the flow of a nested tuple attribute
+func parseTupleAttrs(attr syscall.NetlinkRouteAttr) (flowTuple, error) {
+
+	flow := flowTuple{}
+
+	nested, err := nl.ParseRouteAttr(attr.Value)
+	if err != nil {
+		return flow, fmt.Errorf("Invalid conntrack tuple: %s", err)
+	}
+
+	for _, tuple := range nested {
+		tupleType := tuple.Attr.Type & nl.NLA_TYPE_MASK
+		if tupleType != nl.CTA_TUPLE_IP && tupleType != nl.CTA_TUPLE_PROTO {
+			continue
+		}
+
+		values, err := nl.ParseRouteAttr(tuple.Value)
+		if err != nil {
+			return flow, fmt.Errorf("Invalid conntrack tuple: %s", err)
+		}
+
+		switch tupleType {
+		case nl.CTA_TUPLE_IP:
+			for _, value := range values {
+				switch value.Attr.Type & nl.NLA_TYPE_MASK {
+				case nl.CTA_IP_V4_SRC, nl.CTA_IP_V6_SRC:
+					flow.srcIP = net.IP(value.Value).String()
+				case nl.CTA_IP_V4_DST, nl.CTA_IP_V6_DST:
+					flow.dstIP = net.IP(value.Value).String()
+				}
+			}
+		case nl.CTA_TUPLE_PROTO:
+			for _, value := range values {
+				switch value.Attr.Type & nl.NLA_TYPE_MASK {
+				case nl.CTA_PROTO_NUM:
+					if len(value.Value) >= 1 {
+						flow.protocol = value.Value[0]
+					}
+				case nl.CTA_PROTO_SRC_PORT:
+					if len(value.Value) >= 2 {
+						flow.srcPort = binary.BigEndian.Uint16(value.Value)
+					}
+				case nl.CTA_PROTO_DST_PORT:
+					if len(value.Value) >= 2 {
+						flow.dstPort = binary.BigEndian.Uint16(value.Value)
+					}
+				}
+			}
+		}
+	}
+
+	return flow, nil
+}
+
+// parseCounterAttrs returns the bytes and packets of a nested counters attribute
+func parseCounterAttrs(attr syscall.NetlinkRouteAttr) (bytes uint64, packets uint64, err error) {
+
+	nested, err := nl.ParseRouteAttr(attr.Value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid conntrack counters: %s", err)
+	}
+
+	for _, counter := range nested {
+		if len(counter.Value) < 8 {
+			continue
+		}
+
+		switch counter.Attr.Type & nl.NLA_TYPE_MASK {
+		case nl.CTA_COUNTERS_BYTES:
+			bytes = binary.BigEndian.Uint64(counter.Value)
+		case nl.CTA_COUNTERS_PACKETS:
+			packets = binary.BigEndian.Uint64(counter.Value)
+		}
+	}
+
+	return bytes, packets, nil
+}
@@ -0,0 +1,106 @@
+// +build linux
+
+package enforcer
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/collector"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// conntrackCounterAttr creates a nested counters attribute
+func conntrackCounterAttr(attrType int, bytes, packets uint64) []byte {
+
+	be64 := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return b
+	}
+
+	attr := nl.NewRtAttr(unix.NLA_F_NESTED|attrType, nil)
+	attr.AddRtAttr(nl.CTA_COUNTERS_PACKETS, be64(packets))
+	attr.AddRtAttr(nl.CTA_COUNTERS_BYTES, be64(bytes))
+
+	return attr.Serialize()
+}
+
+// conntrackTupleAttr creates a nested original tuple attribute
+func conntrackTupleAttr(src, dst string, srcPort, dstPort uint16) []byte {
+
+	tuple := nl.NewRtAttr(unix.NLA_F_NESTED|nl.CTA_TUPLE_ORIG, nil)
+	ip := tuple.AddRtAttr(unix.NLA_F_NESTED|nl.CTA_TUPLE_IP, nil)
+	ip.AddRtAttr(nl.CTA_IP_V4_SRC, net.ParseIP(src).To4())
+	ip.AddRtAttr(nl.CTA_IP_V4_DST, net.ParseIP(dst).To4())
+	proto := tuple.AddRtAttr(unix.NLA_F_NESTED|nl.CTA_TUPLE_PROTO, nil)
+	proto.AddRtAttr(nl.CTA_PROTO_NUM, []byte{unix.IPPROTO_TCP})
+	proto.AddRtAttr(nl.CTA_PROTO_SRC_PORT, nl.BEUint16Attr(srcPort))
+	proto.AddRtAttr(nl.CTA_PROTO_DST_PORT, nl.BEUint16Attr(dstPort))
+
+	return tuple.Serialize()
+}
+
+func TestParseConntrackEvent(t *testing.T) {
+
+	flow := flowTuple{
+		protocol: unix.IPPROTO_TCP,
+		srcIP:    "10.1.1.1",
+		dstIP:    "10.1.1.2",
+		srcPort:  2000,
+		dstPort:  80,
+	}
+
+	Convey("Given a conntrack event with counters", t, func() {
+		msg := (&nl.Nfgenmsg{NfgenFamily: unix.AF_INET, Version: nl.NFNETLINK_V0}).Serialize()
+		msg = append(msg, conntrackTupleAttr("10.1.1.1", "10.1.1.2", 2000, 80)...)
+		msg = append(msg, nl.NewRtAttr(nl.CTA_MARK, nl.Uint32Attr(0)).Serialize()...)
+		msg = append(msg, conntrackCounterAttr(nl.CTA_COUNTERS_ORIG, 1000, 10)...)
+		msg = append(msg, conntrackCounterAttr(nl.CTA_COUNTERS_REPLY, 5000, 8)...)
+
+		Convey("I should get the flow and the counters of both directions", func() {
+			tuple, counters, err := parseConntrackEvent(msg)
+			So(err, ShouldBeNil)
+			So(tuple, ShouldResemble, flow)
+			So(counters, ShouldResemble, &collector.FlowCounters{
+				SourceBytes:        1000,
+				SourcePackets:      10,
+				DestinationBytes:   5000,
+				DestinationPackets: 8,
+			})
+		})
+	})
+
+	Convey("Given a conntrack event without counters", t, func() {
+		msg := (&nl.Nfgenmsg{NfgenFamily: unix.AF_INET, Version: nl.NFNETLINK_V0}).Serialize()
+		msg = append(msg, conntrackTupleAttr("10.1.1.1", "10.1.1.2", 2000, 80)...)
+		msg = append(msg, nl.NewRtAttr(nl.CTA_MARK, nl.Uint32Attr(0)).Serialize()...)
+
+		Convey("I should get the flow without counters", func() {
+			tuple, counters, err := parseConntrackEvent(msg)
+			So(err, ShouldBeNil)
+			So(tuple, ShouldResemble, flow)
+			So(counters, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a conntrack event without tuple", t, func() {
+		msg := (&nl.Nfgenmsg{NfgenFamily: unix.AF_INET, Version: nl.NFNETLINK_V0}).Serialize()
+		msg = append(msg, conntrackCounterAttr(nl.CTA_COUNTERS_ORIG, 1000, 10)...)
+
+		Convey("I should get an error", func() {
+			_, _, err := parseConntrackEvent(msg)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a truncated message", t, func() {
+		Convey("I should get an error", func() {
+			_, _, err := parseConntrackEvent([]byte{2})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,21 @@
+// +build darwin !linux
+
+package enforcer
+
+import (
+	"fmt"
+
+	"github.com/aporeto-inc/trireme/collector"
+)
+
+// conntrackEvents TODO
+type conntrackEvents struct {
+}
+
+func newConntrackEvents() flowTerminationListener {
+	return &conntrackEvents{}
+}
+
+func (c *conntrackEvents) listen(stop <-chan struct{}, terminated func(flow flowTuple, counters *collector.FlowCounters)) error {
+	return fmt.Errorf("Conntrack events are not supported")
+}
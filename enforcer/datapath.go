@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -14,7 +15,9 @@ import (
 	"github.com/aporeto-inc/trireme/collector"
 	"github.com/aporeto-inc/trireme/constants"
 	"github.com/aporeto-inc/trireme/enforcer/acls"
+	"github.com/aporeto-inc/trireme/enforcer/lookup"
 	"github.com/aporeto-inc/trireme/enforcer/utils/fqconfig"
+	"github.com/aporeto-inc/trireme/enforcer/utils/replay"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
 	"github.com/aporeto-inc/trireme/enforcer/utils/tokens"
 	"github.com/aporeto-inc/trireme/monitor/linuxmonitor/cgnetcls"
@@ -24,15 +27,28 @@ import (
 // Datapath is the structure holding all information about a connection filter
 type Datapath struct {
 
+	// Verdict counters of the queues. They are accessed atomically and must
+	// stay at the beginning of the structure to be 64-bit aligned.
+	netVerdicts verdictCounters
+	appVerdicts verdictCounters
+
+	// started is the start time of the datapath in nanoseconds since the
+	// epoch, or 0 when it is stopped. It is accessed atomically.
+	started int64
+
 	// Configuration parameters
 	filterQueue    *fqconfig.FilterQueue
 	tokenEngine    tokens.TokenEngine
 	collector      collector.EventCollector
 	service        PacketProcessor
-	secrets        secrets.Secrets
+	secrets        *secrets.RotatingSecrets
 	nflogger       nfLogger
 	procMountPoint string
 
+	// replay remembers the nonces of the Syn tokens. It is nil unless the
+	// replay protection is enabled
+	replay *replay.Window
+
 	// Internal structures and caches
 	// Key=ContextId Value=ContainerIP
 	contextTracker cache.DataStore
@@ -53,9 +69,21 @@ type Datapath struct {
 	netOrigConnectionTracker  cache.DataStore
 	netReplyConnectionTracker cache.DataStore
 
+	// Hash on full five-tuple and return the UDP flow
+	udpAppOrigConnectionTracker  cache.DataStore
+	udpAppReplyConnectionTracker cache.DataStore
+	udpNetOrigConnectionTracker  cache.DataStore
+	udpNetReplyConnectionTracker cache.DataStore
+
 	// connctrack handle
 	conntrackHdl conntrack.Conntrack
 
+	// accepted flows waiting for the destruction of their conntrack entry
+	// to report their final record, and the listener of the destructions
+	acceptedFlows    cache.DataStore
+	flowListener     flowTerminationListener
+	flowListenerStop chan struct{}
+
 	// mode captures the mode of the enforcer
 	mode constants.ModeType
 
@@ -63,15 +91,23 @@ type Datapath struct {
 	netStop []chan bool
 	appStop []chan bool
 
-	// ack size
-	ackSize uint32
+	// watches of the queues and stop signal of their watchdog
+	netWatch     *queueWatch
+	appWatch     *queueWatch
+	queueBacklog queueBacklog
+	watchdogStop chan struct{}
 
 	mutualAuthorization bool
+
+	// newPolicyDB creates the databases of the rules of the PUs
+	newPolicyDB func() lookup.PolicyDB
 }
 
 // New will create a new data path structure. It instantiates the data stores
 // needed to track sessions. The data path is started with a different call.
 // Only required parameters must be provided. Rest a pre-populated with defaults.
+// The token type selects the encoding of the tokens, and all the enforcers
+// must use the same one.
 func New(
 	mutualAuth bool,
 	filterQueue *fqconfig.FilterQueue,
@@ -82,6 +118,7 @@ func New(
 	validity time.Duration,
 	mode constants.ModeType,
 	procMountPoint string,
+	tokenType tokens.TokenType,
 ) PolicyEnforcer {
 
 	if mode == constants.RemoteContainer || mode == constants.LocalServer {
@@ -99,7 +136,13 @@ func New(
 
 	}
 
-	tokenEngine, err := tokens.NewJWT(validity, serverID, secrets)
+	if secrets == nil {
+		zap.L().Fatal("Secrets must be given to the enforcer")
+	}
+
+	rotatingSecrets := newRotatingSecrets(secrets)
+
+	tokenEngine, err := tokens.NewTokenEngine(tokenType, validity, serverID, rotatingSecrets)
 	if err != nil {
 		zap.L().Fatal("Unable to create TokenEngine in enforcer", zap.Error(err))
 	}
@@ -116,16 +159,28 @@ func New(
 		appReplyConnectionTracker: cache.NewCacheWithExpiration(time.Second * 24),
 		netOrigConnectionTracker:  cache.NewCacheWithExpiration(time.Second * 24),
 		netReplyConnectionTracker: cache.NewCacheWithExpiration(time.Second * 24),
-		filterQueue:               filterQueue,
-		mutualAuthorization:       mutualAuth,
-		service:                   service,
-		collector:                 collector,
-		tokenEngine:               tokenEngine,
-		secrets:                   secrets,
-		ackSize:                   secrets.AckSize(),
-		mode:                      mode,
-		procMountPoint:            procMountPoint,
-		conntrackHdl:              conntrack.NewHandle(),
+
+		udpAppOrigConnectionTracker:  cache.NewCacheWithExpiration(time.Second * 24),
+		udpAppReplyConnectionTracker: cache.NewCacheWithExpiration(time.Second * 24),
+		udpNetOrigConnectionTracker:  cache.NewCacheWithExpiration(time.Second * 24),
+		udpNetReplyConnectionTracker: cache.NewCacheWithExpiration(time.Second * 24),
+
+		filterQueue:         filterQueue,
+		mutualAuthorization: mutualAuth,
+		service:             service,
+		collector:           collector,
+		tokenEngine:         tokenEngine,
+		secrets:             rotatingSecrets,
+		mode:                mode,
+		procMountPoint:      procMountPoint,
+		conntrackHdl:        conntrack.NewHandle(),
+		acceptedFlows:       cache.NewCacheWithExpiration(acceptedFlowLifetime),
+		flowListener:        newConntrackEvents(),
+
+		netWatch:     newQueueWatch(filterQueue.GetNetworkQueueStart(), filterQueue.GetNumNetworkQueues()),
+		appWatch:     newQueueWatch(filterQueue.GetApplicationQueueStart(), filterQueue.GetNumApplicationQueues()),
+		queueBacklog: readQueueBacklog,
+		newPolicyDB:  lookup.NewPolicyDB,
 	}
 
 	if d.tokenEngine == nil {
@@ -134,6 +189,8 @@ func New(
 
 	d.nflogger = newNFLogger(11, 10, d.puInfoDelegate, collector)
 
+	d.registerMetrics(collector)
+
 	return d
 }
 
@@ -166,6 +223,7 @@ func NewWithDefaults(
 		validity,
 		mode,
 		procMountPoint,
+		tokens.JWTType,
 	)
 }
 
@@ -199,6 +257,15 @@ func (d *Datapath) Unenforce(contextID string) error {
 		)
 	}
 
+	if pu.IPv6 != "" {
+		if err := d.puFromIP.Remove(pu.IPv6); err != nil {
+			zap.L().Warn("Unable to remove cache entry during unenforcement",
+				zap.String("IP", pu.IPv6),
+				zap.Error(err),
+			)
+		}
+	}
+
 	if err := d.puFromIP.Remove(pu.Mark); err != nil {
 		zap.L().Warn("Unable to remove cache entry during unenforcement",
 			zap.String("Mark", pu.Mark),
@@ -225,12 +292,69 @@ func (d *Datapath) Unenforce(contextID string) error {
 	return nil
 }
 
+// MutualAuthorization returns true if the transmitters validate the policy of
+// the receivers
+func (d *Datapath) MutualAuthorization() bool {
+
+	return d.mutualAuthorization
+}
+
 // GetFilterQueue returns the filter queues used by the data path
 func (d *Datapath) GetFilterQueue() *fqconfig.FilterQueue {
 
 	return d.filterQueue
 }
 
+// UpdateSecrets replaces the secrets used to sign and verify the tokens. The
+// previous secrets are still accepted for verification for the overlap duration.
+func (d *Datapath) UpdateSecrets(s secrets.Secrets, overlap time.Duration) error {
+
+	if err := d.secrets.Rotate(s, overlap); err != nil {
+		return fmt.Errorf("Failed to update secrets: %s", err)
+	}
+
+	zap.L().Info("Updated enforcer secrets", zap.Duration("overlap", overlap))
+
+	return nil
+}
+
+// CurrentSecrets returns the secrets currently used to sign the tokens
+func (d *Datapath) CurrentSecrets() secrets.Secrets {
+
+	return d.secrets.Current()
+}
+
+// EnableReplayProtection rejects the Syn tokens whose nonce was already seen
+// within the window of the configuration, or that were issued before it. It
+// must be called before the enforcer is started. The Syn tokens are then
+// signed with their nonce and the tokens of the enforcers without replay
+// protection, whose nonce is not signed, are rejected.
+func (d *Datapath) EnableReplayProtection(config *replay.Config) error {
+
+	if d.replay != nil {
+		return fmt.Errorf("Replay protection is already enabled")
+	}
+
+	window, err := replay.NewWindow(config)
+	if err != nil {
+		return fmt.Errorf("Failed to enable replay protection: %s", err)
+	}
+
+	window.Start()
+	d.replay = window
+
+	zap.L().Info("Enabled replay protection", zap.Duration("window", window.Config().Window))
+
+	return nil
+}
+
+// SetPolicyDB replaces the database used to search the rules of the PUs,
+// lookup.NewPolicyDB by default. It must be called before the PUs are
+// enforced.
+func (d *Datapath) SetPolicyDB(newPolicyDB func() lookup.PolicyDB) {
+	d.newPolicyDB = newPolicyDB
+}
+
 // Start starts the application and network interceptors
 func (d *Datapath) Start() error {
 
@@ -244,6 +368,16 @@ func (d *Datapath) Start() error {
 
 	go d.nflogger.start()
 
+	d.flowListenerStop = make(chan struct{})
+	go d.listenFlowTerminations(d.flowListenerStop)
+
+	if timeout := d.filterQueue.WatchdogTimeout; timeout > 0 {
+		d.watchdogStop = make(chan struct{})
+		go d.startWatchdog(timeout, d.watchdogStop)
+	}
+
+	atomic.StoreInt64(&d.started, time.Now().UnixNano())
+
 	return nil
 }
 
@@ -252,6 +386,8 @@ func (d *Datapath) Stop() error {
 
 	zap.L().Debug("Stoping enforcer")
 
+	atomic.StoreInt64(&d.started, 0)
+
 	for i := uint16(0); i < d.filterQueue.GetNumApplicationQueues(); i++ {
 		d.appStop[i] <- true
 	}
@@ -262,9 +398,34 @@ func (d *Datapath) Stop() error {
 
 	d.nflogger.stop()
 
+	if d.flowListenerStop != nil {
+		close(d.flowListenerStop)
+		d.flowListenerStop = nil
+	}
+
+	if d.watchdogStop != nil {
+		close(d.watchdogStop)
+		d.watchdogStop = nil
+	}
+
+	if d.replay != nil {
+		d.replay.Stop()
+	}
+
 	return nil
 }
 
+// newRotatingSecrets wraps the given secrets so that they can be updated after
+// the token engine is created. Secrets that are already rotating are shared.
+func newRotatingSecrets(s secrets.Secrets) *secrets.RotatingSecrets {
+
+	if rotating, ok := s.(*secrets.RotatingSecrets); ok {
+		return rotating
+	}
+
+	return secrets.NewRotatingSecrets(s)
+}
+
 func (d *Datapath) getProcessKeys(puInfo *policy.PUInfo) (string, []string) {
 
 	mark, ok := puInfo.Runtime.Options().Get(cgnetcls.CgroupMarkTag)
@@ -312,6 +473,11 @@ func (d *Datapath) doCreatePU(contextID string, puInfo *policy.PUInfo) error {
 		} else {
 			d.puFromIP.AddOrUpdate(DefaultNetwork, pu)
 		}
+
+		if ip, ok := puInfo.Runtime.IPAddresses()[policy.DefaultNamespaceIPv6]; ok && ip != "" {
+			pu.IPv6 = ip
+			d.puFromIP.AddOrUpdate(ip, pu)
+		}
 	}
 
 	// Cache PU from contextID for management and policy updates
@@ -325,14 +491,34 @@ func (d *Datapath) doUpdatePU(puContext *PUContext, containerInfo *policy.PUInfo
 	puContext.Lock()
 	defer puContext.Unlock()
 
-	puContext.AcceptRcvRules, puContext.RejectRcvRules = createRuleDBs(containerInfo.Policy.ReceiverRules())
+	return updatePUContext(puContext, containerInfo, d.newPolicyDB)
+}
+
+// updatePUContext sets the rules and ACLs of the policy of a PU in its context.
+// The rules are stored in databases created by newPolicyDB. The lock of the
+// context must be held.
+func updatePUContext(puContext *PUContext, containerInfo *policy.PUInfo, newPolicyDB func() lookup.PolicyDB) error {
+
+	puContext.AcceptRcvRules, puContext.RejectRcvRules = createRuleDBs(containerInfo.Policy.ReceiverRules(), newPolicyDB)
+
+	puContext.AcceptTxtRules, puContext.RejectTxtRules = createRuleDBs(containerInfo.Policy.TransmitterRules(), newPolicyDB)
+
+	puContext.encryption = encryptionRequired(containerInfo.Policy.ReceiverRules()) || encryptionRequired(containerInfo.Policy.TransmitterRules())
 
-	puContext.AcceptTxtRules, puContext.RejectTxtRules = createRuleDBs(containerInfo.Policy.TransmitterRules())
+	puContext.monitored = containerInfo.Policy.TriremeAction() == policy.Monitor
+
+	puContext.failurePolicy = containerInfo.Policy.FailurePolicy()
+
+	// Invalidate any cached Syn token since it was created with the old policy
+	puContext.synToken = nil
+	puContext.synEphemeralKey = nil
 
 	puContext.Identity = containerInfo.Policy.Identity()
 
 	puContext.Annotations = containerInfo.Policy.Annotations()
 
+	puContext.policyHash = containerInfo.Policy.Hash()
+
 	puContext.externalIPCache = cache.NewCache()
 
 	puContext.ApplicationACLs = acls.NewACLCache()
@@ -341,7 +527,17 @@ func (d *Datapath) doUpdatePU(puContext *PUContext, containerInfo *policy.PUInfo
 	}
 
 	puContext.NetworkACLS = acls.NewACLCache()
-	return puContext.NetworkACLS.AddRuleList(containerInfo.Policy.NetworkACLs())
+	if err := puContext.NetworkACLS.AddRuleList(containerInfo.Policy.NetworkACLs()); err != nil {
+		return err
+	}
+
+	puContext.ApplicationUDPACLs = acls.NewProtocolACLCache("udp")
+	if err := puContext.ApplicationUDPACLs.AddRuleList(containerInfo.Policy.ApplicationACLs()); err != nil {
+		return err
+	}
+
+	puContext.NetworkUDPACLs = acls.NewProtocolACLCache("udp")
+	return puContext.NetworkUDPACLs.AddRuleList(containerInfo.Policy.NetworkACLs())
 }
 
 func (d *Datapath) puInfoDelegate(contextID string) (ID string, tags *policy.TagStore) {
@@ -3,6 +3,7 @@ package enforcer
 // Go libraries
 import (
 	"bytes"
+	"crypto/elliptic"
 	"fmt"
 	"strconv"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/aporeto-inc/trireme/cache"
 	"github.com/aporeto-inc/trireme/collector"
 	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/crypto"
 	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
 	"github.com/aporeto-inc/trireme/enforcer/utils/tokens"
 	"github.com/aporeto-inc/trireme/monitor/linuxmonitor/cgnetcls"
@@ -82,6 +84,8 @@ func (d *Datapath) processNetworkTCPPackets(p *packet.Packet) (err error) {
 	conn.Lock()
 	defer conn.Unlock()
 
+	conn.SetLastSeen(time.Now())
+
 	p.Print(packet.PacketStageIncoming)
 
 	if d.service != nil {
@@ -102,7 +106,17 @@ func (d *Datapath) processNetworkTCPPackets(p *packet.Packet) (err error) {
 			zap.String("Flags", packet.TCPFlagsToStr(p.TCPFlags)),
 			zap.Error(err),
 		)
-		return fmt.Errorf("Packet processing failed for network packet: %s", err.Error())
+
+		if !context.isMonitored() || isEncryptionError(err) {
+			return fmt.Errorf("Packet processing failed for network packet: %s", err.Error())
+		}
+
+		// Monitored PUs accept the flows that fail the handshake. The failure
+		// was reported already. The segments of encrypted connections that
+		// fail to decrypt are dropped above.
+		d.releaseMonitoredFlow(conn, p)
+		p.UpdateTCPChecksum()
+		return nil
 	}
 
 	p.Print(packet.PacketStageService)
@@ -187,6 +201,8 @@ func (d *Datapath) processApplicationTCPPackets(p *packet.Packet) (err error) {
 	conn.Lock()
 	defer conn.Unlock()
 
+	conn.SetLastSeen(time.Now())
+
 	p.Print(packet.PacketStageIncoming)
 
 	if d.service != nil {
@@ -208,7 +224,16 @@ func (d *Datapath) processApplicationTCPPackets(p *packet.Packet) (err error) {
 			zap.Error(err),
 		)
 		p.Print(packet.PacketFailureAuth)
-		return fmt.Errorf("Processing failed for application packet: %s", err.Error())
+
+		if !context.isMonitored() || isEncryptionError(err) {
+			return fmt.Errorf("Processing failed for application packet: %s", err.Error())
+		}
+
+		// Monitored PUs send the packets they fail to authorize without a
+		// token. The remote decides what to do with them. The segments of
+		// encrypted connections that fail to encrypt are dropped above.
+		p.UpdateTCPChecksum()
+		return nil
 	}
 
 	p.Print(packet.PacketStageService)
@@ -283,6 +308,11 @@ func (d *Datapath) processApplicationSynPacket(tcpPacket *packet.Packet, context
 	d.appOrigConnectionTracker.AddOrUpdate(hash, conn)
 	d.sourcePortConnectionCache.AddOrUpdate(tcpPacket.SourcePortHash(packet.PacketTypeApplication), conn)
 
+	// Leave room for the encryption option if encryption is offered
+	if conn.Auth.LocalEphemeralKey != nil {
+		reserveEncryptionOption(tcpPacket)
+	}
+
 	// Attach the tags to the packet.
 	return nil, tcpPacket.TCPDataAttach(tcpOptions, tcpData)
 
@@ -298,7 +328,7 @@ func (d *Datapath) processApplicationSynAckPacket(tcpPacket *packet.Packet, cont
 			tcpPacket.IPProto,
 			tcpPacket.DestinationPort,
 			tcpPacket.SourcePort,
-			constants.DefaultConnMark,
+			connectionMark(conn),
 		); err != nil {
 			zap.L().Error("Failed to update conntrack entry for flow",
 				zap.String("context", string(conn.Auth.LocalContext)),
@@ -334,6 +364,15 @@ func (d *Datapath) processApplicationSynAckPacket(tcpPacket *packet.Packet, cont
 			return nil, err
 		}
 
+		// If encryption was negotiated, we have now both nonces and can derive the keys
+		conn.encryption = nil
+		if conn.Auth.LocalEphemeralKey != nil {
+			if conn.encryption, err = newFlowCipher(conn.Auth.LocalEphemeralKey, conn.Auth.RemoteEphemeralKey, conn.Auth.RemoteContext, conn.Auth.LocalContext, false); err != nil {
+				return nil, &encryptionError{err: err}
+			}
+			reserveEncryptionOption(tcpPacket)
+		}
+
 		// Attach the tags to the packet
 		return nil, tcpPacket.TCPDataAttach(tcpOptions, tcpData)
 	}
@@ -351,7 +390,7 @@ func (d *Datapath) processApplicationSynAckPacket(tcpPacket *packet.Packet, cont
 func (d *Datapath) processApplicationAckPacket(tcpPacket *packet.Packet, context *PUContext, conn *TCPConnection) (interface{}, error) {
 
 	if conn.GetState() == TCPData {
-		return nil, nil
+		return nil, d.encryptPayload(tcpPacket, conn)
 	}
 
 	// Only process in SynAckReceived state
@@ -368,8 +407,9 @@ func (d *Datapath) processApplicationAckPacket(tcpPacket *packet.Packet, context
 
 		tcpOptions := d.createTCPAuthenticationOption([]byte{})
 
-		// Since we adjust sequence numbers let's make sure we haven't made a mistake
-		if len(token) != int(d.ackSize) {
+		// Since we adjust sequence numbers let's make sure we haven't made a mistake.
+		// The size depends on the token encoding and on the type of the current key.
+		if len(token) != int(d.tokenEngine.AckSize()) {
 			return nil, fmt.Errorf("Protocol Error %d", len(token))
 		}
 
@@ -387,7 +427,7 @@ func (d *Datapath) processApplicationAckPacket(tcpPacket *packet.Packet, context
 				tcpPacket.IPProto,
 				tcpPacket.SourcePort,
 				tcpPacket.DestinationPort,
-				constants.DefaultConnMark,
+				connectionMark(conn),
 			); err != nil {
 				zap.L().Error("Failed to update conntrack table for flow",
 					zap.String("context", string(conn.Auth.LocalContext)),
@@ -413,6 +453,10 @@ func (d *Datapath) processApplicationAckPacket(tcpPacket *packet.Packet, context
 			)
 		}
 
+		if err := d.encryptPayload(tcpPacket, conn); err != nil {
+			return nil, err
+		}
+
 		conn.SetState(TCPData)
 		return nil, nil
 	}
@@ -453,10 +497,13 @@ func (d *Datapath) processNetworkSynPacket(context *PUContext, conn *TCPConnecti
 	if err = tcpPacket.CheckTCPAuthenticationOption(TCPAuthenticationOptionBaseLen); err != nil {
 
 		// If there is no auth option, attempt the ACLs
-		plc, perr := context.NetworkACLS.GetMatchingAction(tcpPacket.SourceAddress.To4(), tcpPacket.DestinationPort)
+		plc, perr := context.NetworkACLS.GetMatchingAction(tcpPacket.SourceAddress, tcpPacket.DestinationPort)
 		d.reportExternalServiceFlow(context, plc, false, tcpPacket)
 		if perr != nil || plc.Action == policy.Reject {
-			return nil, nil, fmt.Errorf("Drop it")
+			if !context.monitored {
+				return nil, nil, fmt.Errorf("Drop it")
+			}
+			plc = auditPolicy
 		}
 
 		conn.SetState(TCPData)
@@ -468,25 +515,30 @@ func (d *Datapath) processNetworkSynPacket(context *PUContext, conn *TCPConnecti
 
 	// Decode the JWT token using the context key
 	claims, err = d.parsePacketToken(&conn.Auth, tcpPacket.ReadTCPData())
+	if err == nil {
+		err = d.checkReplay(claims, conn.Auth.RemoteContext)
+	}
 
 	// If the token signature is not valid or there are no claims
 	// we must drop the connection and we drop the Syn packet. The source will
 	// retry but we have no state to maintain here.
 	if err != nil || claims == nil {
-		d.reportRejectedFlow(tcpPacket, conn, collector.DefaultEndPoint, context.ManagementID, context, collector.InvalidToken, nil)
+		d.reportRejectedFlow(tcpPacket, conn, collector.DefaultEndPoint, context.ManagementID, context, tokenDropReason(err, collector.InvalidToken), nil, nil)
 		return nil, nil, fmt.Errorf("Syn packet dropped because of invalid token %v %+v", err, claims)
 	}
 
+	conn.remoteMSS = tcpPacket.TCPMSS()
+
 	txLabel, ok := claims.T.Get(TransmitterLabel)
 	if err := tcpPacket.CheckTCPAuthenticationOption(TCPAuthenticationOptionBaseLen); !ok || err != nil {
-		d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID, context, collector.InvalidFormat, nil)
+		d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID, context, collector.InvalidFormat, nil, nil)
 		return nil, nil, fmt.Errorf("TCP Authentication Option not found %v", err)
 	}
 
 	// Remove any of our data from the packet. No matter what we don't need the
 	// metadata any more.
 	if err := tcpPacket.TCPDataDetach(TCPAuthenticationOptionBaseLen); err != nil {
-		d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID, context, collector.InvalidFormat, nil)
+		d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID, context, collector.InvalidFormat, nil, nil)
 		return nil, nil, fmt.Errorf("Syn packet dropped because of invalid format %v", err)
 	}
 
@@ -497,33 +549,64 @@ func (d *Datapath) processNetworkSynPacket(context *PUContext, conn *TCPConnecti
 	claims.T.AppendKeyValue(PortNumberLabelString, strconv.Itoa(int(tcpPacket.DestinationPort)))
 
 	// Validate against reject rules first - We always process reject with higher priority
-	if index, plc := context.RejectRcvRules.Search(claims.T); index >= 0 {
+	if index, plc, trace := context.RejectRcvRules.SearchWithTrace(claims.T); index >= 0 {
 		// Reject the connection
-		d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID, context, collector.PolicyDrop, plc.(*policy.FlowPolicy))
-		return nil, nil, fmt.Errorf("Connection rejected because of policy %+v", claims.T)
+		d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID, context, collector.PolicyDrop, plc.(*policy.FlowPolicy), trace)
+		if !context.monitored {
+			return nil, nil, fmt.Errorf("Connection rejected because of policy %+v", claims.T)
+		}
+		return d.acceptNetworkSynPacket(conn, tcpPacket, claims, auditPolicy, trace)
 	}
 
 	// Search the policy rules for a matching rule.
-	if index, action := context.AcceptRcvRules.Search(claims.T); index >= 0 {
+	if index, action, trace := context.AcceptRcvRules.SearchWithTrace(claims.T); index >= 0 {
 
-		hash := tcpPacket.L4FlowHash()
-		// Update the connection state and store the Nonse send to us by the host.
-		// We use the nonse in the subsequent packets to achieve randomization.
-		conn.SetState(TCPSynReceived)
-
-		// conntrack
-		d.netOrigConnectionTracker.AddOrUpdate(hash, conn)
-		d.appReplyConnectionTracker.AddOrUpdate(tcpPacket.L4ReverseFlowHash(), conn)
+		flowPolicy := action.(*policy.FlowPolicy)
 
-		// Cache the action
-		conn.FlowPolicy = action.(*policy.FlowPolicy)
+		// If the policy requires encryption the remote must have sent an ephemeral key
+		if flowPolicy.Action.Encrypted() && len(claims.EK) == 0 {
+			d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID, context, collector.EncryptionMismatch, flowPolicy, trace)
+			if !context.monitored {
+				return nil, nil, fmt.Errorf("Connection rejected because encryption was not negotiated %+v", claims.T)
+			}
+			flowPolicy = auditPolicy
+		}
 
 		// Accept the connection
-		return action, claims, nil
+		return d.acceptNetworkSynPacket(conn, tcpPacket, claims, flowPolicy, trace)
 	}
 
-	d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID, context, collector.PolicyDrop, nil)
-	return nil, nil, fmt.Errorf("No matched tags - reject %+v", claims.T)
+	d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID, context, collector.PolicyDrop, nil, nil)
+	if !context.monitored {
+		return nil, nil, fmt.Errorf("No matched tags - reject %+v", claims.T)
+	}
+
+	return d.acceptNetworkSynPacket(conn, tcpPacket, claims, auditPolicy, nil)
+}
+
+// acceptNetworkSynPacket records the connection of a Syn packet accepted with
+// the flow policy, and the trace of the matched rule that is reported with it
+func (d *Datapath) acceptNetworkSynPacket(conn *TCPConnection, tcpPacket *packet.Packet, claims *tokens.ConnectionClaims, flowPolicy *policy.FlowPolicy, trace []string) (interface{}, *tokens.ConnectionClaims, error) {
+
+	conn.Auth.RemoteEphemeralKey = nil
+	if flowPolicy.Action.Encrypted() {
+		conn.Auth.RemoteEphemeralKey = claims.EK
+	}
+
+	hash := tcpPacket.L4FlowHash()
+	// Update the connection state and store the Nonse send to us by the host.
+	// We use the nonse in the subsequent packets to achieve randomization.
+	conn.SetState(TCPSynReceived)
+
+	// conntrack
+	d.netOrigConnectionTracker.AddOrUpdate(hash, conn)
+	d.appReplyConnectionTracker.AddOrUpdate(tcpPacket.L4ReverseFlowHash(), conn)
+
+	// Cache the action
+	conn.FlowPolicy = flowPolicy
+	conn.PolicyTrace = trace
+
+	return flowPolicy, claims, nil
 }
 
 // processNetworkSynAckPacket processes a SynAck packet arriving from the network
@@ -542,10 +625,18 @@ func (d *Datapath) processNetworkSynAckPacket(context *PUContext, conn *TCPConne
 		}
 
 		// Never seen this IP before, let's parse them.
-		plc, err = context.ApplicationACLs.GetMatchingAction(tcpPacket.SourceAddress.To4(), tcpPacket.SourcePort)
+		plc, err = context.ApplicationACLs.GetMatchingAction(tcpPacket.SourceAddress, tcpPacket.SourcePort)
 		if err != nil || plc.Action&policy.Reject > 0 {
 			d.reportExternalServiceFlow(context, plc, true, tcpPacket)
-			return nil, nil, fmt.Errorf("Drop it")
+			if !context.monitored {
+				return nil, nil, fmt.Errorf("Drop it")
+			}
+
+			// The flow is not cached, so that the next ones are reported too
+			conn.SetState(TCPData)
+			d.releaseFlow(context, auditPolicy, tcpPacket)
+
+			return auditPolicy, nil, nil
 		}
 
 		// Added to the cache if we can accept it
@@ -564,7 +655,7 @@ func (d *Datapath) processNetworkSynAckPacket(context *PUContext, conn *TCPConne
 
 	tcpData := tcpPacket.ReadTCPData()
 	if len(tcpData) == 0 {
-		d.reportRejectedFlow(tcpPacket, nil, collector.DefaultEndPoint, context.ManagementID, context, collector.MissingToken, nil)
+		d.reportRejectedFlow(tcpPacket, nil, collector.DefaultEndPoint, context.ManagementID, context, collector.MissingToken, nil, nil)
 		return nil, nil, fmt.Errorf("SynAck packet dropped because of missing token")
 	}
 
@@ -572,20 +663,21 @@ func (d *Datapath) processNetworkSynAckPacket(context *PUContext, conn *TCPConne
 	// // Validate the certificate and parse the token
 	// claims, nonce, cert, err := d.tokenEngine.Decode(false, tcpData, nil)
 	if err != nil || claims == nil {
-		d.reportRejectedFlow(tcpPacket, nil, collector.DefaultEndPoint, context.ManagementID, context, collector.MissingToken, nil)
+		d.reportRejectedFlow(tcpPacket, nil, collector.DefaultEndPoint, context.ManagementID, context, tokenDropReason(err, collector.MissingToken), nil, nil)
 		return nil, nil, fmt.Errorf("Synack packet dropped because of bad claims %v", claims)
 	}
 
 	tcpPacket.ConnectionMetadata = &conn.Auth
+	conn.remoteMSS = tcpPacket.TCPMSS()
 
 	if err := tcpPacket.CheckTCPAuthenticationOption(TCPAuthenticationOptionBaseLen); err != nil {
-		d.reportRejectedFlow(tcpPacket, conn, context.ManagementID, conn.Auth.RemoteContextID, context, collector.InvalidFormat, nil)
+		d.reportRejectedFlow(tcpPacket, conn, context.ManagementID, conn.Auth.RemoteContextID, context, collector.InvalidFormat, nil, nil)
 		return nil, nil, fmt.Errorf("TCP Authentication Option not found")
 	}
 
 	// Remove any of our data
 	if err := tcpPacket.TCPDataDetach(TCPAuthenticationOptionBaseLen); err != nil {
-		d.reportRejectedFlow(tcpPacket, conn, context.ManagementID, conn.Auth.RemoteContextID, context, collector.InvalidFormat, nil)
+		d.reportRejectedFlow(tcpPacket, conn, context.ManagementID, conn.Auth.RemoteContextID, context, collector.InvalidFormat, nil, nil)
 		return nil, nil, fmt.Errorf("SynAck packet dropped because of invalid format")
 	}
 
@@ -595,28 +687,55 @@ func (d *Datapath) processNetworkSynAckPacket(context *PUContext, conn *TCPConne
 	// is matched in both directions. We have to make this optional as it can
 	// become a very strong condition
 
-	if index, _ := context.RejectTxtRules.Search(claims.T); d.mutualAuthorization && index >= 0 {
-		d.reportRejectedFlow(tcpPacket, conn, context.ManagementID, conn.Auth.RemoteContextID, context, collector.PolicyDrop, nil)
-		return nil, nil, fmt.Errorf("Dropping because of reject rule on transmitter")
+	if index, plc, trace := context.RejectTxtRules.SearchWithTrace(claims.T); d.mutualAuthorization && index >= 0 {
+		d.reportRejectedFlow(tcpPacket, conn, context.ManagementID, conn.Auth.RemoteContextID, context, collector.PolicyDrop, plc.(*policy.FlowPolicy), trace)
+		if !context.monitored {
+			return nil, nil, fmt.Errorf("Dropping because of reject rule on transmitter")
+		}
+		return d.acceptNetworkSynAckPacket(context, conn, tcpPacket, claims, -1, auditPolicy)
 	}
 
 	if index, action := context.AcceptTxtRules.Search(claims.T); !d.mutualAuthorization || index >= 0 {
-		conn.SetState(TCPSynAckReceived)
+		return d.acceptNetworkSynAckPacket(context, conn, tcpPacket, claims, index, action)
+	}
 
-		// conntrack
-		d.netReplyConnectionTracker.AddOrUpdate(tcpPacket.L4FlowHash(), conn)
-		return action, claims, nil
+	d.reportRejectedFlow(tcpPacket, conn, context.ManagementID, conn.Auth.RemoteContextID, context, collector.PolicyDrop, nil, nil)
+	if !context.monitored {
+		return nil, nil, fmt.Errorf("Dropping packet SYNACK at the network ")
 	}
 
-	d.reportRejectedFlow(tcpPacket, conn, context.ManagementID, conn.Auth.RemoteContextID, context, collector.PolicyDrop, nil)
-	return nil, nil, fmt.Errorf("Dropping packet SYNACK at the network ")
+	return d.acceptNetworkSynAckPacket(context, conn, tcpPacket, claims, -1, auditPolicy)
+}
+
+// acceptNetworkSynAckPacket negotiates the encryption of the connection of a
+// SynAck packet accepted with the action of the matching rule, and records it
+func (d *Datapath) acceptNetworkSynAckPacket(context *PUContext, conn *TCPConnection, tcpPacket *packet.Packet, claims *tokens.ConnectionClaims, index int, action interface{}) (interface{}, *tokens.ConnectionClaims, error) {
+
+	if err := d.negotiateEncryption(conn, claims, index, action); err != nil {
+		d.reportRejectedFlow(tcpPacket, conn, context.ManagementID, conn.Auth.RemoteContextID, context, collector.EncryptionMismatch, nil, nil)
+		if !context.monitored {
+			return nil, nil, err
+		}
+
+		// Monitored PUs still encrypt if the remote requires it
+		if err := d.negotiateEncryption(conn, claims, -1, nil); err != nil {
+			return nil, nil, &encryptionError{err: err}
+		}
+		action = auditPolicy
+	}
+
+	conn.SetState(TCPSynAckReceived)
+
+	// conntrack
+	d.netReplyConnectionTracker.AddOrUpdate(tcpPacket.L4FlowHash(), conn)
+	return action, claims, nil
 }
 
 // processNetworkAckPacket processes an Ack packet arriving from the network
 func (d *Datapath) processNetworkAckPacket(context *PUContext, conn *TCPConnection, tcpPacket *packet.Packet) (action interface{}, claims *tokens.ConnectionClaims, err error) {
 
 	if conn.GetState() == TCPData || conn.GetState() == TCPAckSend {
-		return nil, nil, nil
+		return nil, nil, d.decryptPayload(tcpPacket, conn)
 	}
 
 	context.Lock()
@@ -628,25 +747,25 @@ func (d *Datapath) processNetworkAckPacket(context *PUContext, conn *TCPConnecti
 	if conn.GetState() == TCPSynAckSend || conn.GetState() == TCPSynReceived {
 
 		if err := tcpPacket.CheckTCPAuthenticationOption(TCPAuthenticationOptionBaseLen); err != nil {
-			d.reportRejectedFlow(tcpPacket, conn, collector.DefaultEndPoint, context.ManagementID, context, collector.InvalidFormat, nil)
+			d.reportRejectedFlow(tcpPacket, conn, collector.DefaultEndPoint, context.ManagementID, context, collector.InvalidFormat, nil, nil)
 			return nil, nil, fmt.Errorf("TCP Authentication Option not found")
 		}
 
 		if _, err := d.parseAckToken(&conn.Auth, tcpPacket.ReadTCPData()); err != nil {
-			d.reportRejectedFlow(tcpPacket, conn, collector.DefaultEndPoint, context.ManagementID, context, collector.InvalidFormat, nil)
+			d.reportRejectedFlow(tcpPacket, conn, collector.DefaultEndPoint, context.ManagementID, context, collector.InvalidFormat, nil, nil)
 			return nil, nil, fmt.Errorf("Ack packet dropped because signature validation failed %v", err)
 		}
 
 		// Remove any of our data - adjust the sequence numbers
 		if err := tcpPacket.TCPDataDetach(TCPAuthenticationOptionBaseLen); err != nil {
-			d.reportRejectedFlow(tcpPacket, conn, collector.DefaultEndPoint, context.ManagementID, context, collector.InvalidFormat, nil)
+			d.reportRejectedFlow(tcpPacket, conn, collector.DefaultEndPoint, context.ManagementID, context, collector.InvalidFormat, nil, nil)
 			return nil, nil, fmt.Errorf("Ack packet dropped because of invalid format %v", err)
 		}
 
 		tcpPacket.DropDetachedBytes()
 
 		// We accept the packet as a new flow
-		d.reportAcceptedFlow(tcpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID, context, conn.FlowPolicy)
+		d.reportAcceptedFlow(tcpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID, context, conn.FlowPolicy, conn.PolicyTrace)
 
 		conn.SetState(TCPData)
 
@@ -657,7 +776,7 @@ func (d *Datapath) processNetworkAckPacket(context *PUContext, conn *TCPConnecti
 				tcpPacket.IPProto,
 				tcpPacket.SourcePort,
 				tcpPacket.DestinationPort,
-				constants.DefaultConnMark,
+				connectionMark(conn),
 			); err != nil {
 				zap.L().Error("Failed to update conntrack table after ack packet")
 			}
@@ -672,7 +791,7 @@ func (d *Datapath) processNetworkAckPacket(context *PUContext, conn *TCPConnecti
 	}
 
 	// Everything else is dropped - ACK received in the Syn state without a SynAck
-	d.reportRejectedFlow(tcpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID, context, collector.InvalidState, nil)
+	d.reportRejectedFlow(tcpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID, context, collector.InvalidState, nil, nil)
 	zap.L().Error("Invalid state reached",
 		zap.String("state", fmt.Sprintf("%v", conn.GetState())),
 		zap.String("context", context.ManagementID),
@@ -698,13 +817,15 @@ func (d *Datapath) createAckPacketToken(context *PUContext, auth *AuthInfo) ([]b
 	return token, nil
 }
 
-// createSynPacketToken creates the authentication token
+// createSynPacketToken creates the authentication token. With replay
+// protection, every token carries its own signed nonce and is not cached.
 func (d *Datapath) createSynPacketToken(context *PUContext, auth *AuthInfo) (token []byte, err error) {
 
-	if context.synExpiration.After(time.Now()) && len(context.synToken) > 0 {
+	if d.replay == nil && context.synExpiration.After(time.Now()) && len(context.synToken) > 0 {
 		// Randomize the nonce and send it
 		auth.LocalContext, err = d.tokenEngine.Randomize(context.synToken)
 		if err == nil {
+			auth.LocalEphemeralKey = context.synEphemeralKey
 			return context.synToken, nil
 		}
 		// If there is an error, let's try to create a new one
@@ -714,10 +835,25 @@ func (d *Datapath) createSynPacketToken(context *PUContext, auth *AuthInfo) (tok
 		T: context.Identity,
 	}
 
+	// The receivers remember the nonces, which must be signed so that they
+	// can not be changed to replay the token
+	if d.replay != nil {
+		if claims.LCL, err = crypto.GenerateRandomBytes(tokens.NonceLength); err != nil {
+			return []byte{}, err
+		}
+	}
+
+	// Offer an ephemeral key if any of the policies of the PU requires encryption
+	context.synEphemeralKey = nil
+	if context.encryption {
+		context.synEphemeralKey, claims.EK = crypto.CreateEphemeralKey(elliptic.P256)
+	}
+
 	if context.synToken, auth.LocalContext, err = d.tokenEngine.CreateAndSign(false, claims); err != nil {
 		return []byte{}, nil
 	}
 
+	auth.LocalEphemeralKey = context.synEphemeralKey
 	context.synExpiration = time.Now().Add(time.Millisecond * 500)
 
 	return context.synToken, nil
@@ -733,11 +869,17 @@ func (d *Datapath) createSynAckPacketToken(context *PUContext, auth *AuthInfo) (
 		RMT: auth.RemoteContext,
 	}
 
-	if context.synToken, auth.LocalContext, err = d.tokenEngine.CreateAndSign(false, claims); err != nil {
+	// Answer with our own ephemeral key if the policy requires encryption
+	auth.LocalEphemeralKey = nil
+	if len(auth.RemoteEphemeralKey) > 0 {
+		auth.LocalEphemeralKey, claims.EK = crypto.CreateEphemeralKey(elliptic.P256)
+	}
+
+	if token, auth.LocalContext, err = d.tokenEngine.CreateAndSign(false, claims); err != nil {
 		return []byte{}, nil
 	}
 
-	return context.synToken, nil
+	return token, nil
 
 }
 
@@ -746,22 +888,56 @@ func (d *Datapath) createSynAckPacketToken(context *PUContext, auth *AuthInfo) (
 func (d *Datapath) parsePacketToken(auth *AuthInfo, data []byte) (*tokens.ConnectionClaims, error) {
 
 	// Validate the certificate and parse the token
-	claims, nonce, cert, err := d.tokenEngine.Decode(false, data, auth.RemotePublicKey)
+	cached, nonce, cert, err := d.tokenEngine.Decode(false, data, auth.RemotePublicKey)
 	if err != nil {
 		return nil, err
 	}
 
+	if cached.T == nil {
+		return nil, fmt.Errorf("No tags in token")
+	}
+
+	// The claims are cached with their tokens, so the labels of this
+	// connection are appended to a copy
+	claims := *cached
+	claims.T = cached.T.Copy()
+
 	// We always a need a valid remote context ID
 	remoteContextID, ok := claims.T.Get(TransmitterLabel)
 	if !ok {
 		return nil, fmt.Errorf("No Transmitter Label ")
 	}
 
+	// The rules can match the SPIFFE ID of the verified certificate, but a
+	// transmitter can not set it.
+	if spiffeID, ok := claims.T.Get(SPIFFEIDLabelString); ok {
+		return nil, fmt.Errorf("SPIFFE ID label %s can not be set by the transmitter", spiffeID)
+	}
+	if claims.SID != "" {
+		claims.T.AppendKeyValue(SPIFFEIDLabelString, claims.SID)
+	}
+
 	auth.RemotePublicKey = cert
 	auth.RemoteContext = nonce
 	auth.RemoteContextID = remoteContextID
 
-	return claims, nil
+	return &claims, nil
+}
+
+// checkReplay rejects a Syn token if its nonce was already seen in the replay
+// window. The nonce must be signed with the claims of the token, so that it can
+// not be changed to replay a captured token.
+func (d *Datapath) checkReplay(claims *tokens.ConnectionClaims, nonce []byte) error {
+
+	if d.replay == nil || claims == nil {
+		return nil
+	}
+
+	if !bytes.Equal(claims.LCL, nonce) {
+		return fmt.Errorf("Token nonce is not signed")
+	}
+
+	return d.replay.Check(claims.ISS, nonce, claims.IAT)
 }
 
 // parseAckToken parses the tokens in Ack packets. They don't carry all the state context
@@ -784,6 +960,122 @@ func (d *Datapath) parseAckToken(auth *AuthInfo, data []byte) (*tokens.Connectio
 	return claims, nil
 }
 
+// negotiateEncryption derives the session keys of the connection from the SynAck
+// claims at the initiator. It fails if the two sides disagree about encryption.
+func (d *Datapath) negotiateEncryption(conn *TCPConnection, claims *tokens.ConnectionClaims, index int, action interface{}) (err error) {
+
+	conn.encryption = nil
+
+	if len(claims.EK) == 0 {
+		if index >= 0 && action.(*policy.FlowPolicy).Action.Encrypted() {
+			return fmt.Errorf("Dropping SynAck because encryption was not negotiated")
+		}
+		return nil
+	}
+
+	if conn.Auth.LocalEphemeralKey == nil {
+		return fmt.Errorf("Dropping SynAck because encryption was not offered")
+	}
+
+	conn.encryption, err = newFlowCipher(conn.Auth.LocalEphemeralKey, claims.EK, conn.Auth.LocalContext, conn.Auth.RemoteContext, true)
+
+	return err
+}
+
+// encryptPayload replaces the payload of application packets of encrypted
+// connections with its cipher text, and adds the encryption option with its
+// record. The payload keeps its size, so that the sequence numbers are not
+// changed. The segments that do not fit in the MSS announced by the remote,
+// or have no room for the option, are dropped.
+func (d *Datapath) encryptPayload(tcpPacket *packet.Packet, conn *TCPConnection) error {
+
+	data := tcpPacket.ReadTCPData()
+	if conn.encryption == nil || len(data) == 0 {
+		return nil
+	}
+
+	if conn.remoteMSS != 0 && len(data) > int(conn.remoteMSS) {
+		return &encryptionError{err: fmt.Errorf("Segment of %d bytes exceeds the MSS %d", len(data), conn.remoteMSS)}
+	}
+
+	if tcpPacket.TCPHeaderOptionLength()+encryptionOverhead > packet.TCPMaxOptionsLength {
+		return &encryptionError{err: fmt.Errorf("No room for the encryption option")}
+	}
+
+	cipherText, record, err := conn.encryption.seal(tcpPacket.TCPSeq, data)
+	if err != nil {
+		return &encryptionError{err: err}
+	}
+
+	if err := tcpPacket.TCPDataDetach(0); err != nil {
+		return &encryptionError{err: err}
+	}
+
+	tcpPacket.DropDetachedDataBytes()
+
+	if err := tcpPacket.TCPDataAttach(encryptionOption(record), cipherText); err != nil {
+		return &encryptionError{err: err}
+	}
+
+	return nil
+}
+
+// decryptPayload removes the encryption option of network packets of
+// encrypted connections and replaces their cipher text with the payload. The
+// packets that fail to decrypt are dropped.
+func (d *Datapath) decryptPayload(tcpPacket *packet.Packet, conn *TCPConnection) error {
+
+	if conn.encryption == nil || len(tcpPacket.ReadTCPData()) == 0 {
+		return nil
+	}
+
+	if tcpPacket.TCPHeaderOptionLength() < encryptionOverhead {
+		return &encryptionError{err: fmt.Errorf("Encryption option not found")}
+	}
+
+	if err := tcpPacket.TCPDataDetach(encryptionOverhead); err != nil {
+		return &encryptionError{err: err}
+	}
+
+	record, err := encryptionRecord(tcpPacket.GetTCPOptions())
+	if err != nil {
+		return &encryptionError{err: err}
+	}
+
+	data, err := conn.encryption.open(tcpPacket.TCPSeq, record, tcpPacket.GetTCPData())
+	if err != nil {
+		return &encryptionError{err: err}
+	}
+
+	tcpPacket.DropDetachedBytes()
+
+	if err := tcpPacket.TCPDataAttach([]byte{}, data); err != nil {
+		return &encryptionError{err: err}
+	}
+
+	return nil
+}
+
+// reserveEncryptionOption decreases the MSS announced in a Syn or SynAck
+// packet to leave room for the encryption option in the segments. SACK is
+// disabled, since its blocks would not leave room for the option.
+func reserveEncryptionOption(tcpPacket *packet.Packet) {
+
+	tcpPacket.DecreaseTCPMSS(encryptionOverhead)
+	tcpPacket.ClearTCPOption(packet.TCPSackPermittedOption, packet.TCPSackPermittedOptionLen)
+}
+
+// connectionMark returns the conntrack mark for the data packets of a connection.
+// Encrypted connections are marked so that their packets are still processed.
+func connectionMark(conn *TCPConnection) uint32 {
+
+	if conn.encryption != nil {
+		return constants.EncryptedConnMark
+	}
+
+	return constants.DefaultConnMark
+}
+
 // createTCPAuthenticationOption creates the TCP authentication option -
 func (d *Datapath) createTCPAuthenticationOption(token []byte) []byte {
 
@@ -950,6 +1242,10 @@ func updateTimer(c cache.DataStore, hash string, conn *TCPConnection) error {
 	if conn.ServiceConnection && conn.TimeOut > 0 {
 		return c.SetTimeOut(hash, conn.TimeOut)
 	}
+
+	if conn.encryption != nil {
+		return c.SetTimeOut(hash, EncryptedConnectionTimeout)
+	}
 	return nil
 }
 
@@ -990,6 +1286,40 @@ func (d *Datapath) contextFromIP(app bool, packetIP string, mark string, port st
 	return pu.(*PUContext), nil
 }
 
+// releaseMonitoredFlow stops the processing of a flow of a monitored PU that
+// failed the handshake of a network packet. Once it is marked in conntrack,
+// which happens when the application replies to a Syn packet, its packets are
+// not sent to the queues anymore.
+func (d *Datapath) releaseMonitoredFlow(conn *TCPConnection, tcpPacket *packet.Packet) {
+
+	conn.SetState(TCPData)
+
+	src, dst := tcpPacket.SourceAddress.String(), tcpPacket.DestinationAddress.String()
+	srcPort, dstPort := tcpPacket.SourcePort, tcpPacket.DestinationPort
+
+	switch tcpPacket.TCPFlags & packet.TCPSynAckMask {
+	case packet.TCPSynMask:
+		d.netOrigConnectionTracker.AddOrUpdate(tcpPacket.L4FlowHash(), conn)
+		d.appReplyConnectionTracker.AddOrUpdate(tcpPacket.L4ReverseFlowHash(), conn)
+		return
+
+	case packet.TCPSynAckMask:
+		lerr1 := d.appOrigConnectionTracker.Remove(tcpPacket.L4ReverseFlowHash())
+		lerr2 := d.sourcePortConnectionCache.Remove(tcpPacket.SourcePortHash(packet.PacketTypeNetwork))
+		if lerr1 != nil || lerr2 != nil {
+			zap.L().Debug("Failed to clean cache")
+		}
+
+		// The flow was initiated by the application
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	if err := d.conntrackHdl.ConntrackTableUpdateMark(src, dst, tcpPacket.IPProto, srcPort, dstPort, constants.DefaultConnMark); err != nil {
+		zap.L().Debug("Failed to release flow of monitored PU", zap.String("flow", tcpPacket.L4FlowHash()), zap.Error(err))
+	}
+}
+
 // releaseFlow releases the flow and updates the conntrack table
 func (d *Datapath) releaseFlow(context *PUContext, plc *policy.FlowPolicy, tcpPacket *packet.Packet) {
 
@@ -14,6 +14,7 @@ import (
 	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
 	"github.com/aporeto-inc/trireme/enforcer/utils/packetgen"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/enforcer/utils/tokens"
 	"github.com/aporeto-inc/trireme/mock"
 	"github.com/aporeto-inc/trireme/monitor/linuxmonitor/cgnetcls"
 	"github.com/aporeto-inc/trireme/policy"
@@ -51,6 +52,51 @@ func TestInvalidContext(t *testing.T) {
 	})
 }
 
+func TestSPIFFEIDLabel(t *testing.T) {
+
+	Convey("Given I create a new enforcer instance", t, func() {
+
+		secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+		collector := &collector.DefaultCollector{}
+		enforcer := NewWithDefaults("SomeServerId", collector, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+
+		Convey("When a transmitter sets the SPIFFE ID label itself", func() {
+
+			tags := policy.NewTagStoreFromMap(map[string]string{
+				TransmitterLabel:    "client",
+				SPIFFEIDLabelString: "spiffe://example.org/admin",
+			})
+			token, _, err := enforcer.tokenEngine.CreateAndSign(false, &tokens.ConnectionClaims{T: tags, EK: []byte{}})
+			So(err, ShouldBeNil)
+
+			_, err = enforcer.parsePacketToken(&AuthInfo{}, token)
+
+			Convey("Then the token should be rejected", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the same token is parsed twice", func() {
+
+			tags := policy.NewTagStoreFromMap(map[string]string{TransmitterLabel: "client"})
+			token, _, err := enforcer.tokenEngine.CreateAndSign(false, &tokens.ConnectionClaims{T: tags, EK: []byte{}})
+			So(err, ShouldBeNil)
+
+			first, err := enforcer.parsePacketToken(&AuthInfo{}, token)
+			So(err, ShouldBeNil)
+			first.T.AppendKeyValue(PortNumberLabelString, "80")
+
+			second, err := enforcer.parsePacketToken(&AuthInfo{}, token)
+
+			Convey("Then the labels appended to the first claims should not be in the cached claims", func() {
+				So(err, ShouldBeNil)
+				_, ok := second.T.Get(PortNumberLabelString)
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
+
 func TestInvalidIPContext(t *testing.T) {
 
 	Convey("Given I create a new enforcer instance", t, func() {
@@ -123,7 +169,7 @@ func (m *myMatcher) Matches(x interface{}) bool {
 	f1 := m.x.(*collector.FlowRecord)
 	f2 := x.(*collector.FlowRecord)
 
-	if f1.Destination.IP == f2.Destination.IP && f1.Source.IP == f2.Source.IP && f1.Destination.Port == f2.Destination.Port && f1.Action == f2.Action && f1.Count == f2.Count {
+	if f1.Destination.IP == f2.Destination.IP && f1.Source.IP == f2.Source.IP && f1.Destination.Port == f2.Destination.Port && f1.Action == f2.Action && f1.Count == f2.Count && f1.Final == f2.Final {
 
 		return true
 	}
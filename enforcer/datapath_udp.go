@@ -0,0 +1,518 @@
+package enforcer
+
+// Go libraries
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// UDP flows are authorized with the same tokens as TCP connections. Since UDP
+// has no handshake, the tokens are carried in front of the payload of the
+// first packets of a flow:
+//   - The initiator attaches a Syn token to every packet until it receives a reply.
+//     Destinations that match an application ACL are external services and
+//     their packets never carry a token.
+//   - The responder validates the Syn token against its receiver rules and
+//     attaches a SynAck token to every reply until it receives a packet without a token.
+//   - The initiator validates the SynAck token and stops attaching tokens.
+// Each side stops attaching tokens udpHandshakeTimeout after it attached its
+// first token, so that a flow towards a remote that never answers, or that
+// only receives, does not carry tokens for ever. The responder only starts its
+// timer with its first reply, so that a slow reply still authorizes the flow
+// at the initiator.
+// Once a flow is authorized, the conntrack entry is marked and the rest of the
+// packets bypass the datapath. Tokens increase the size of the first packets
+// of a flow and applications that send datagrams close to the MTU may see
+// them fragmented.
+
+const (
+	// udpSynPacket identifies a UDP payload carrying a Syn token
+	udpSynPacket = uint8(1)
+
+	// udpSynAckPacket identifies a UDP payload carrying a SynAck token
+	udpSynAckPacket = uint8(2)
+
+	// udpHandshakeTimeout is the time after which a side stops attaching tokens
+	// to the packets of a flow
+	udpHandshakeTimeout = 2 * time.Second
+)
+
+// processNetworkUDPPackets processes UDP packets arriving from the network
+func (d *Datapath) processNetworkUDPPackets(p *packet.Packet) (err error) {
+
+	zap.L().Debug("Processing network UDP packet ",
+		zap.String("flow", p.L4FlowHash()),
+	)
+
+	defer zap.L().Debug("Finished Processing network UDP packet ",
+		zap.String("flow", p.L4FlowHash()),
+		zap.Error(err),
+	)
+
+	context, conn, err := d.netUDPRetrieveState(p)
+	if err != nil {
+		zap.L().Debug("UDP packet rejected",
+			zap.String("flow", p.L4FlowHash()),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	if err = d.processNetworkUDPPacket(p, context, conn); err != nil {
+		zap.L().Debug("Rejecting UDP packet ",
+			zap.String("flow", p.L4FlowHash()),
+			zap.Error(err),
+		)
+
+		if !context.isMonitored() {
+			return fmt.Errorf("Packet processing failed for network UDP packet: %s", err.Error())
+		}
+
+		// Monitored PUs accept the packets that fail the handshake, without
+		// the token. The failure was reported already
+		if packetType, token := parseUDPAuthenticationHeader(p.ReadUDPData()); packetType != 0 {
+			if err := p.UDPDataDetach(uint16(UDPAuthenticationHeaderLen + len(token))); err != nil {
+				return fmt.Errorf("Packet processing failed for network UDP packet: %s", err.Error())
+			}
+		}
+	}
+
+	// Accept the packet
+	p.UpdateUDPChecksum()
+
+	return nil
+}
+
+// processApplicationUDPPackets processes UDP packets arriving from an application and are destined to the network
+func (d *Datapath) processApplicationUDPPackets(p *packet.Packet) (err error) {
+
+	zap.L().Debug("Processing application UDP packet ",
+		zap.String("flow", p.L4FlowHash()),
+	)
+
+	defer zap.L().Debug("Finished Processing application UDP packet ",
+		zap.String("flow", p.L4FlowHash()),
+		zap.Error(err),
+	)
+
+	context, conn, err := d.appUDPRetrieveState(p)
+	if err != nil {
+		zap.L().Debug("UDP packet rejected",
+			zap.String("flow", p.L4FlowHash()),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	if err = d.processApplicationUDPPacket(p, context, conn); err != nil {
+		zap.L().Debug("Dropping UDP packet ",
+			zap.String("flow", p.L4FlowHash()),
+			zap.Error(err),
+		)
+
+		// Monitored PUs send the packets they fail to authorize without a token
+		if !context.isMonitored() {
+			return fmt.Errorf("Packet processing failed for application UDP packet: %s", err.Error())
+		}
+	}
+
+	// Accept the packet
+	p.UpdateUDPChecksum()
+
+	return nil
+}
+
+// processApplicationUDPPacket attaches the tokens to the application packets of flows
+// that are not authorized yet
+func (d *Datapath) processApplicationUDPPacket(p *packet.Packet, context *PUContext, conn *UDPConnection) error {
+
+	context.Lock()
+	defer context.Unlock()
+
+	switch conn.GetState() {
+
+	case UDPStart:
+		hash := p.L4FlowHash()
+
+		// If the destination is a known external service there is nobody to authorize with
+		if _, err := context.externalIPCache.Get(p.DestinationAddress.String() + ":" + strconv.Itoa(int(p.DestinationPort))); err == nil {
+			conn.SetState(UDPData)
+			d.udpAppOrigConnectionTracker.AddOrUpdate(hash, conn)
+			d.udpNetReplyConnectionTracker.AddOrUpdate(p.L4ReverseFlowHash(), conn)
+			return nil
+		}
+
+		// Destinations covered by the ACLs are not PUs. A token would corrupt
+		// the payload that they receive, so the ACLs decide alone
+		if plc, err := context.ApplicationUDPACLs.GetMatchingAction(p.DestinationAddress, p.DestinationPort); err == nil {
+			d.reportExternalServiceFlow(context, plc, true, p)
+			if plc.Action&policy.Reject > 0 {
+				if !context.monitored {
+					return fmt.Errorf("Drop it")
+				}
+				plc = auditPolicy
+			} else {
+				context.externalIPCache.AddOrUpdate(p.DestinationAddress.String()+":"+strconv.Itoa(int(p.DestinationPort)), plc)
+			}
+
+			conn.FlowPolicy = plc
+			conn.SetState(UDPData)
+			d.udpAppOrigConnectionTracker.AddOrUpdate(hash, conn)
+			d.udpNetReplyConnectionTracker.AddOrUpdate(p.L4ReverseFlowHash(), conn)
+			return nil
+		}
+
+		token, err := d.createSynPacketToken(context, &conn.Auth)
+		if err != nil {
+			return err
+		}
+
+		conn.token = createUDPAuthenticationHeader(udpSynPacket, token)
+		conn.handshakeStart = time.Now()
+		conn.SetState(UDPSynSend)
+
+		d.udpAppOrigConnectionTracker.AddOrUpdate(hash, conn)
+		d.udpNetReplyConnectionTracker.AddOrUpdate(p.L4ReverseFlowHash(), conn)
+
+		p.UDPDataAttach(conn.token)
+		return nil
+
+	case UDPSynSend:
+		// No reply yet. Keep sending the same token so that the nonce does not
+		// change, until the remote is not expected to answer any more. A reply
+		// is still validated against the token or the ACLs.
+		if time.Since(conn.handshakeStart) > udpHandshakeTimeout {
+			return nil
+		}
+
+		p.UDPDataAttach(conn.token)
+		return nil
+
+	case UDPSynReceived:
+		// The initiator did not send anything since the first reply. It has
+		// got one of the SynAck tokens or it will fall back to the ACLs.
+		if conn.token != nil && time.Since(conn.handshakeStart) > udpHandshakeTimeout {
+			conn.token = nil
+			conn.SetState(UDPData)
+			d.releaseUDPFlow(p, conn.initiator)
+			return nil
+		}
+
+		// The timeout starts with the first reply
+		if conn.token == nil {
+			token, err := d.createSynAckPacketToken(context, &conn.Auth)
+			if err != nil {
+				return err
+			}
+			conn.token = createUDPAuthenticationHeader(udpSynAckPacket, token)
+			conn.handshakeStart = time.Now()
+		}
+
+		p.UDPDataAttach(conn.token)
+		return nil
+
+	default:
+		d.releaseUDPFlow(p, conn.initiator)
+		return nil
+	}
+}
+
+// processNetworkUDPPacket validates the tokens of network packets and strips them
+// before they are delivered to the application
+func (d *Datapath) processNetworkUDPPacket(p *packet.Packet, context *PUContext, conn *UDPConnection) error {
+
+	context.Lock()
+	defer context.Unlock()
+
+	packetType, token := parseUDPAuthenticationHeader(p.ReadUDPData())
+
+	switch packetType {
+	case udpSynPacket:
+		return d.processNetworkUDPSynPacket(p, context, conn, token)
+	case udpSynAckPacket:
+		return d.processNetworkUDPSynAckPacket(p, context, conn, token)
+	}
+
+	switch conn.GetState() {
+
+	case UDPStart:
+		// A flow from a remote that is not a PU. Attempt the ACLs
+		plc, err := context.NetworkUDPACLs.GetMatchingAction(p.SourceAddress, p.DestinationPort)
+		d.reportExternalServiceFlow(context, plc, false, p)
+		if err != nil || plc.Action&policy.Reject > 0 {
+			if !context.monitored {
+				return fmt.Errorf("Drop it")
+			}
+			plc = auditPolicy
+		}
+
+		conn.FlowPolicy = plc
+		conn.SetState(UDPData)
+		d.udpNetOrigConnectionTracker.AddOrUpdate(p.L4FlowHash(), conn)
+		d.udpAppReplyConnectionTracker.AddOrUpdate(p.L4ReverseFlowHash(), conn)
+		return nil
+
+	case UDPSynSend:
+		// A reply without a token from a remote that is not a PU. Attempt the ACLs
+		plc, err := context.ApplicationUDPACLs.GetMatchingAction(p.SourceAddress, p.SourcePort)
+		d.reportReverseExternalServiceFlow(context, plc, true, p)
+		if err != nil || plc.Action&policy.Reject > 0 {
+			if !context.monitored {
+				return fmt.Errorf("Drop it")
+			}
+			// The flow is not cached, so that the next ones are reported too
+			plc = auditPolicy
+		} else {
+			context.externalIPCache.AddOrUpdate(p.SourceAddress.String()+":"+strconv.Itoa(int(p.SourcePort)), plc)
+		}
+
+		conn.FlowPolicy = plc
+		conn.token = nil
+		conn.SetState(UDPData)
+		d.releaseUDPFlow(p, !conn.initiator)
+		return nil
+
+	case UDPSynReceived:
+		// The initiator has received our SynAck since it stopped sending tokens
+		conn.token = nil
+		conn.SetState(UDPData)
+		d.releaseUDPFlow(p, !conn.initiator)
+		return nil
+
+	default:
+		d.releaseUDPFlow(p, !conn.initiator)
+		return nil
+	}
+}
+
+// processNetworkUDPSynPacket validates the Syn token of a UDP flow against the receiver rules
+func (d *Datapath) processNetworkUDPSynPacket(p *packet.Packet, context *PUContext, conn *UDPConnection, token []byte) error {
+
+	remoteContext := conn.Auth.RemoteContext
+
+	claims, err := d.parsePacketToken(&conn.Auth, token)
+
+	// The initiator attaches the same token to the packets until it gets a
+	// reply, so only the new nonces are checked for replays
+	if err == nil && !bytes.Equal(remoteContext, conn.Auth.RemoteContext) {
+		if err = d.checkReplay(claims, conn.Auth.RemoteContext); err != nil {
+			conn.Auth.RemoteContext = remoteContext
+		}
+	}
+
+	if err != nil || claims == nil {
+		d.reportRejectedFlow(p, nil, collector.DefaultEndPoint, context.ManagementID, context, tokenDropReason(err, collector.InvalidToken), nil, nil)
+		return fmt.Errorf("UDP packet dropped because of invalid token %v", err)
+	}
+
+	txLabel, _ := claims.T.Get(TransmitterLabel)
+
+	if err := p.UDPDataDetach(uint16(UDPAuthenticationHeaderLen + len(token))); err != nil {
+		d.reportRejectedFlow(p, nil, txLabel, context.ManagementID, context, collector.InvalidFormat, nil, nil)
+		return fmt.Errorf("UDP packet dropped because of invalid format %v", err)
+	}
+
+	claims.T.AppendKeyValue(PortNumberLabelString, strconv.Itoa(int(p.DestinationPort)))
+
+	// Validate against reject rules first - We always process reject with higher priority
+	var flowPolicy *policy.FlowPolicy
+	var trace []string
+	if index, plc, rejectTrace := context.RejectRcvRules.SearchWithTrace(claims.T); index >= 0 {
+		d.reportRejectedFlow(p, nil, txLabel, context.ManagementID, context, collector.PolicyDrop, plc.(*policy.FlowPolicy), rejectTrace)
+		if !context.monitored {
+			return fmt.Errorf("UDP flow rejected because of policy %+v", claims.T)
+		}
+		flowPolicy = auditPolicy
+		trace = rejectTrace
+	} else if index, action, acceptTrace := context.AcceptRcvRules.SearchWithTrace(claims.T); index >= 0 {
+		flowPolicy = action.(*policy.FlowPolicy)
+		trace = acceptTrace
+	} else {
+		d.reportRejectedFlow(p, nil, txLabel, context.ManagementID, context, collector.PolicyDrop, nil, nil)
+		if !context.monitored {
+			return fmt.Errorf("No matched tags - reject %+v", claims.T)
+		}
+		flowPolicy = auditPolicy
+	}
+
+	// A new nonce means that the initiator started over and needs a new SynAck token
+	if !bytes.Equal(remoteContext, conn.Auth.RemoteContext) {
+		conn.token = nil
+	}
+
+	if conn.GetState() == UDPStart {
+		d.reportAcceptedFlow(p, nil, txLabel, context.ManagementID, context, flowPolicy, trace)
+	}
+
+	conn.FlowPolicy = flowPolicy
+	conn.SetState(UDPSynReceived)
+
+	d.udpNetOrigConnectionTracker.AddOrUpdate(p.L4FlowHash(), conn)
+	d.udpAppReplyConnectionTracker.AddOrUpdate(p.L4ReverseFlowHash(), conn)
+
+	return nil
+}
+
+// processNetworkUDPSynAckPacket validates the SynAck token of a reply to a UDP flow
+// that we initiated
+func (d *Datapath) processNetworkUDPSynAckPacket(p *packet.Packet, context *PUContext, conn *UDPConnection, token []byte) error {
+
+	if conn.GetState() != UDPSynSend && conn.GetState() != UDPData {
+		d.reportRejectedFlow(p, nil, collector.DefaultEndPoint, context.ManagementID, context, collector.InvalidState, nil, nil)
+		return fmt.Errorf("UDP SynAck received in wrong state %v", conn.GetState())
+	}
+
+	claims, err := d.parsePacketToken(&conn.Auth, token)
+	if err != nil || claims == nil {
+		d.reportRejectedFlow(p, nil, collector.DefaultEndPoint, context.ManagementID, context, tokenDropReason(err, collector.InvalidToken), nil, nil)
+		return fmt.Errorf("UDP SynAck dropped because of invalid token %v", err)
+	}
+
+	// The remote must have signed our nonce
+	if !bytes.Equal(claims.RMT, conn.Auth.LocalContext) {
+		d.reportRejectedFlow(p, nil, context.ManagementID, conn.Auth.RemoteContextID, context, collector.InvalidNonse, nil, nil)
+		return fmt.Errorf("UDP SynAck dropped because of invalid nonce")
+	}
+
+	if err := p.UDPDataDetach(uint16(UDPAuthenticationHeaderLen + len(token))); err != nil {
+		d.reportRejectedFlow(p, nil, context.ManagementID, conn.Auth.RemoteContextID, context, collector.InvalidFormat, nil, nil)
+		return fmt.Errorf("UDP SynAck dropped because of invalid format %v", err)
+	}
+
+	if conn.GetState() == UDPData {
+		return nil
+	}
+
+	if index, plc, trace := context.RejectTxtRules.SearchWithTrace(claims.T); d.mutualAuthorization && index >= 0 {
+		d.reportRejectedFlow(p, nil, context.ManagementID, conn.Auth.RemoteContextID, context, collector.PolicyDrop, plc.(*policy.FlowPolicy), trace)
+		if !context.monitored {
+			return fmt.Errorf("Dropping because of reject rule on transmitter")
+		}
+	} else if index, _ := context.AcceptTxtRules.Search(claims.T); d.mutualAuthorization && index < 0 {
+		d.reportRejectedFlow(p, nil, context.ManagementID, conn.Auth.RemoteContextID, context, collector.PolicyDrop, nil, nil)
+		if !context.monitored {
+			return fmt.Errorf("Dropping UDP SynAck at the network")
+		}
+	}
+
+	conn.token = nil
+	conn.SetState(UDPData)
+	d.releaseUDPFlow(p, !conn.initiator)
+
+	return nil
+}
+
+// appUDPRetrieveState retrieves the state of an application UDP packet. A new
+// flow is created if there is no state.
+func (d *Datapath) appUDPRetrieveState(p *packet.Packet) (*PUContext, *UDPConnection, error) {
+
+	hash := p.L4FlowHash()
+
+	if conn, err := d.udpAppReplyConnectionTracker.GetReset(hash, 0); err == nil {
+		return conn.(*UDPConnection).Context, conn.(*UDPConnection), nil
+	}
+
+	if conn, err := d.udpAppOrigConnectionTracker.GetReset(hash, 0); err == nil {
+		return conn.(*UDPConnection).Context, conn.(*UDPConnection), nil
+	}
+
+	context, err := d.contextFromIP(true, p.SourceAddress.String(), p.Mark, strconv.Itoa(int(p.SourcePort)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("No context in app UDP processing")
+	}
+
+	return context, NewUDPConnection(context, true), nil
+}
+
+// netUDPRetrieveState retrieves the state of a network UDP packet. A new
+// flow is created if there is no state.
+func (d *Datapath) netUDPRetrieveState(p *packet.Packet) (*PUContext, *UDPConnection, error) {
+
+	hash := p.L4FlowHash()
+
+	if conn, err := d.udpNetReplyConnectionTracker.GetReset(hash, 0); err == nil {
+		return conn.(*UDPConnection).Context, conn.(*UDPConnection), nil
+	}
+
+	if conn, err := d.udpNetOrigConnectionTracker.GetReset(hash, 0); err == nil {
+		return conn.(*UDPConnection).Context, conn.(*UDPConnection), nil
+	}
+
+	context, err := d.contextFromIP(false, p.DestinationAddress.String(), p.Mark, strconv.Itoa(int(p.DestinationPort)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("No context in net UDP processing")
+	}
+
+	return context, NewUDPConnection(context, false), nil
+}
+
+// releaseUDPFlow marks the conntrack entry of an authorized UDP flow so that the
+// rest of its packets bypass the datapath. The entry might not be confirmed yet
+// for the first packet of a flow, in which case the next packet will retry.
+func (d *Datapath) releaseUDPFlow(p *packet.Packet, original bool) {
+
+	src, dst := p.SourceAddress.String(), p.DestinationAddress.String()
+	srcPort, dstPort := p.SourcePort, p.DestinationPort
+
+	if !original {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	if err := d.conntrackHdl.ConntrackTableUpdateMark(
+		src,
+		dst,
+		p.IPProto,
+		srcPort,
+		dstPort,
+		constants.DefaultConnMark,
+	); err != nil {
+		zap.L().Debug("Failed to update conntrack table for UDP flow",
+			zap.String("flow", p.L4FlowHash()),
+			zap.Error(err),
+		)
+	}
+}
+
+// createUDPAuthenticationHeader prepends the authentication header to a token
+func createUDPAuthenticationHeader(packetType uint8, token []byte) []byte {
+
+	data := make([]byte, UDPAuthenticationHeaderLen, UDPAuthenticationHeaderLen+len(token))
+	binary.BigEndian.PutUint32(data[0:4], UDPAuthenticationMagic)
+	data[4] = packetType
+	binary.BigEndian.PutUint16(data[6:8], uint16(len(token)))
+
+	return append(data, token...)
+}
+
+// parseUDPAuthenticationHeader returns the packet type and the token of a UDP payload.
+// The packet type is zero if the payload does not carry a token.
+func parseUDPAuthenticationHeader(data []byte) (uint8, []byte) {
+
+	if len(data) < UDPAuthenticationHeaderLen || binary.BigEndian.Uint32(data[0:4]) != UDPAuthenticationMagic {
+		return 0, nil
+	}
+
+	tokenLen := int(binary.BigEndian.Uint16(data[6:8]))
+	if len(data) < UDPAuthenticationHeaderLen+tokenLen {
+		return 0, nil
+	}
+
+	return data[4], data[UDPAuthenticationHeaderLen : UDPAuthenticationHeaderLen+tokenLen]
+}
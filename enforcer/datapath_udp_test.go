@@ -0,0 +1,352 @@
+package enforcer
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/lookup"
+	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
+	"github.com/aporeto-inc/trireme/enforcer/utils/replay"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// udpTestPacket creates the bytes of a UDP packet
+func udpTestPacket(context uint64, src string, dst string, srcPort uint16, dstPort uint16, payload []byte) *packet.Packet {
+
+	buffer := make([]byte, 28+len(payload))
+	buffer[0] = 0x45
+	binary.BigEndian.PutUint16(buffer[2:4], uint16(len(buffer)))
+	buffer[8] = 64
+	buffer[9] = packet.IPProtocolUDP
+	copy(buffer[12:16], net.ParseIP(src).To4())
+	copy(buffer[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(buffer[20:22], srcPort)
+	binary.BigEndian.PutUint16(buffer[22:24], dstPort)
+	binary.BigEndian.PutUint16(buffer[24:26], uint16(8+len(payload)))
+	copy(buffer[28:], payload)
+
+	p, err := packet.New(context, buffer, "0")
+	So(err, ShouldBeNil)
+	p.UpdateIPChecksum()
+	p.UpdateUDPChecksum()
+
+	return p
+}
+
+// transmit moves a packet processed by the application side to the network side
+func transmit(p *packet.Packet) *packet.Packet {
+
+	n, err := packet.New(packet.PacketTypeNetwork, p.GetBytes(), "0")
+	So(err, ShouldBeNil)
+	So(n.VerifyIPChecksum(), ShouldBeTrue)
+	So(n.VerifyUDPChecksum(), ShouldBeTrue)
+
+	return n
+}
+
+func setupUDPProcessingUnits(receiverValue string) *Datapath {
+
+	tagSelector := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{
+				Key:      TransmitterLabel,
+				Value:    []string{receiverValue},
+				Operator: policy.Equal,
+			},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept},
+	}
+
+	puInfo1 := policy.NewPUInfo("udp-pu-1", constants.ContainerPU)
+	puInfo1.Runtime.SetIPAddresses(policy.ExtendedMap{"bridge": "10.1.1.1"})
+	puInfo1.Policy.AddIdentityTag(TransmitterLabel, "value")
+	puInfo1.Policy.AddReceiverRules(tagSelector)
+
+	puInfo2 := policy.NewPUInfo("udp-pu-2", constants.ContainerPU)
+	puInfo2.Runtime.SetIPAddresses(policy.ExtendedMap{"bridge": "10.1.1.2"})
+	puInfo2.Policy.AddIdentityTag(TransmitterLabel, "value")
+	puInfo2.Policy.AddReceiverRules(tagSelector)
+
+	secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+	enforcer := NewWithDefaults("SomeServerId", &collector.DefaultCollector{}, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+	So(enforcer.Enforce("udp-pu-1", puInfo1), ShouldBeNil)
+	So(enforcer.Enforce("udp-pu-2", puInfo2), ShouldBeNil)
+
+	return enforcer
+}
+
+func TestUDPFlowAuthorization(t *testing.T) {
+
+	Convey("Given two PUs with a policy that accepts each other", t, func() {
+
+		enforcer := setupUDPProcessingUnits("value")
+
+		Convey("The first request should carry a token that is removed by the receiver", func() {
+
+			request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 53, []byte("request"))
+			So(enforcer.processApplicationUDPPackets(request), ShouldBeNil)
+			So(len(request.ReadUDPData()), ShouldBeGreaterThan, len("request"))
+
+			received := transmit(request)
+			So(enforcer.processNetworkUDPPackets(received), ShouldBeNil)
+			So(string(received.ReadUDPData()), ShouldEqual, "request")
+
+			Convey("The reply should carry a token that authorizes the flow at the initiator", func() {
+
+				reply := udpTestPacket(packet.PacketTypeApplication, "10.1.1.2", "10.1.1.1", 53, 40000, []byte("reply"))
+				So(enforcer.processApplicationUDPPackets(reply), ShouldBeNil)
+				So(len(reply.ReadUDPData()), ShouldBeGreaterThan, len("reply"))
+
+				received := transmit(reply)
+				So(enforcer.processNetworkUDPPackets(received), ShouldBeNil)
+				So(string(received.ReadUDPData()), ShouldEqual, "reply")
+
+				Convey("Subsequent packets should not carry tokens", func() {
+
+					next := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 53, []byte("next"))
+					So(enforcer.processApplicationUDPPackets(next), ShouldBeNil)
+					So(string(next.ReadUDPData()), ShouldEqual, "next")
+
+					received := transmit(next)
+					So(enforcer.processNetworkUDPPackets(received), ShouldBeNil)
+					So(string(received.ReadUDPData()), ShouldEqual, "next")
+
+					conn, err := enforcer.udpNetOrigConnectionTracker.Get(received.L4FlowHash())
+					So(err, ShouldBeNil)
+					So(conn.(*UDPConnection).GetState(), ShouldEqual, UDPData)
+				})
+			})
+		})
+
+		Convey("A request that gets no reply should stop carrying tokens after the handshake timeout", func() {
+
+			request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 53, []byte("request"))
+			So(enforcer.processApplicationUDPPackets(request), ShouldBeNil)
+
+			conn, err := enforcer.udpAppOrigConnectionTracker.Get(request.L4FlowHash())
+			So(err, ShouldBeNil)
+			conn.(*UDPConnection).handshakeStart = time.Now().Add(-2 * udpHandshakeTimeout)
+
+			next := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 53, []byte("next"))
+			So(enforcer.processApplicationUDPPackets(next), ShouldBeNil)
+			So(string(next.ReadUDPData()), ShouldEqual, "next")
+		})
+
+		Convey("Replies to a request that is not acknowledged should stop carrying tokens after the handshake timeout", func() {
+
+			request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 53, []byte("request"))
+			So(enforcer.processApplicationUDPPackets(request), ShouldBeNil)
+
+			received := transmit(request)
+			So(enforcer.processNetworkUDPPackets(received), ShouldBeNil)
+
+			reply := udpTestPacket(packet.PacketTypeApplication, "10.1.1.2", "10.1.1.1", 53, 40000, []byte("reply"))
+			So(enforcer.processApplicationUDPPackets(reply), ShouldBeNil)
+			So(len(reply.ReadUDPData()), ShouldBeGreaterThan, len("reply"))
+
+			conn, err := enforcer.udpNetOrigConnectionTracker.Get(received.L4FlowHash())
+			So(err, ShouldBeNil)
+			conn.(*UDPConnection).handshakeStart = time.Now().Add(-2 * udpHandshakeTimeout)
+
+			next := udpTestPacket(packet.PacketTypeApplication, "10.1.1.2", "10.1.1.1", 53, 40000, []byte("next"))
+			So(enforcer.processApplicationUDPPackets(next), ShouldBeNil)
+			So(string(next.ReadUDPData()), ShouldEqual, "next")
+			So(conn.(*UDPConnection).GetState(), ShouldEqual, UDPData)
+		})
+
+		Convey("A reply sent after the handshake timeout of the request should still authorize the flow", func() {
+
+			request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 53, []byte("request"))
+			So(enforcer.processApplicationUDPPackets(request), ShouldBeNil)
+
+			received := transmit(request)
+			So(enforcer.processNetworkUDPPackets(received), ShouldBeNil)
+
+			initiator, err := enforcer.udpAppOrigConnectionTracker.Get(request.L4FlowHash())
+			So(err, ShouldBeNil)
+			initiator.(*UDPConnection).handshakeStart = time.Now().Add(-2 * udpHandshakeTimeout)
+
+			responder, err := enforcer.udpNetOrigConnectionTracker.Get(received.L4FlowHash())
+			So(err, ShouldBeNil)
+			responder.(*UDPConnection).handshakeStart = time.Now().Add(-2 * udpHandshakeTimeout)
+
+			reply := udpTestPacket(packet.PacketTypeApplication, "10.1.1.2", "10.1.1.1", 53, 40000, []byte("reply"))
+			So(enforcer.processApplicationUDPPackets(reply), ShouldBeNil)
+			So(len(reply.ReadUDPData()), ShouldBeGreaterThan, len("reply"))
+
+			received = transmit(reply)
+			So(enforcer.processNetworkUDPPackets(received), ShouldBeNil)
+			So(string(received.ReadUDPData()), ShouldEqual, "reply")
+			So(initiator.(*UDPConnection).GetState(), ShouldEqual, UDPData)
+		})
+
+		Convey("A request to a destination of the application ACLs should not carry a token", func() {
+
+			context, err := enforcer.contextTracker.Get("udp-pu-1")
+			So(err, ShouldBeNil)
+			So(context.(*PUContext).ApplicationUDPACLs.AddRule(policy.IPRule{
+				Address:  "8.8.8.8/32",
+				Port:     "53",
+				Protocol: "udp",
+				Policy:   &policy.FlowPolicy{Action: policy.Accept},
+			}), ShouldBeNil)
+
+			request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "8.8.8.8", 40000, 53, []byte("request"))
+			So(enforcer.processApplicationUDPPackets(request), ShouldBeNil)
+			So(string(request.ReadUDPData()), ShouldEqual, "request")
+
+			conn, err := enforcer.udpAppOrigConnectionTracker.Get(request.L4FlowHash())
+			So(err, ShouldBeNil)
+			So(conn.(*UDPConnection).GetState(), ShouldEqual, UDPData)
+		})
+
+		Convey("A request to a destination rejected by the application ACLs should be dropped", func() {
+
+			context, err := enforcer.contextTracker.Get("udp-pu-1")
+			So(err, ShouldBeNil)
+			So(context.(*PUContext).ApplicationUDPACLs.AddRule(policy.IPRule{
+				Address:  "8.8.4.4/32",
+				Port:     "53",
+				Protocol: "udp",
+				Policy:   &policy.FlowPolicy{Action: policy.Reject},
+			}), ShouldBeNil)
+
+			request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "8.8.4.4", 40000, 53, []byte("request"))
+			So(enforcer.processApplicationUDPPackets(request), ShouldNotBeNil)
+		})
+
+		Convey("A packet without a token from a remote that is not a PU should be dropped", func() {
+
+			request := udpTestPacket(packet.PacketTypeNetwork, "10.1.1.3", "10.1.1.2", 40000, 53, []byte("request"))
+			So(enforcer.processNetworkUDPPackets(request), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given two PUs with a policy that rejects each other", t, func() {
+
+		enforcer := setupUDPProcessingUnits("other")
+
+		Convey("The first request should be dropped by the receiver", func() {
+
+			request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 53, []byte("request"))
+			So(enforcer.processApplicationUDPPackets(request), ShouldBeNil)
+
+			So(enforcer.processNetworkUDPPackets(transmit(request)), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestUDPReplayProtection(t *testing.T) {
+
+	Convey("Given two PUs with replay protection", t, func() {
+
+		enforcer := setupUDPProcessingUnits("value")
+		So(enforcer.EnableReplayProtection(&replay.Config{}), ShouldBeNil)
+		So(enforcer.EnableReplayProtection(&replay.Config{}), ShouldNotBeNil)
+
+		request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 53, []byte("request"))
+		So(enforcer.processApplicationUDPPackets(request), ShouldBeNil)
+		token := request.ReadUDPData()[:len(request.ReadUDPData())-len("request")]
+
+		So(enforcer.processNetworkUDPPackets(transmit(request)), ShouldBeNil)
+
+		Convey("A retransmission of the first request should be accepted", func() {
+
+			retransmitted := udpTestPacket(packet.PacketTypeNetwork, "10.1.1.1", "10.1.1.2", 40000, 53, append(append([]byte{}, token...), []byte("again")...))
+			So(enforcer.processNetworkUDPPackets(retransmitted), ShouldBeNil)
+			So(string(retransmitted.ReadUDPData()), ShouldEqual, "again")
+		})
+
+		Convey("The token replayed on another flow should be dropped", func() {
+
+			replayed := udpTestPacket(packet.PacketTypeNetwork, "10.1.1.1", "10.1.1.2", 40001, 53, append(append([]byte{}, token...), []byte("replay")...))
+			So(enforcer.processNetworkUDPPackets(replayed), ShouldNotBeNil)
+		})
+
+		Convey("The token replayed on another flow with one byte of its nonce changed should be dropped", func() {
+
+			changed := append([]byte{}, token...)
+			changed[UDPAuthenticationHeaderLen+2] ^= 0x01
+
+			replayed := udpTestPacket(packet.PacketTypeNetwork, "10.1.1.1", "10.1.1.2", 40002, 53, append(changed, []byte("replay")...))
+			So(enforcer.processNetworkUDPPackets(replayed), ShouldNotBeNil)
+		})
+	})
+}
+
+// countingPolicyDB counts the searches of the default PolicyDB
+type countingPolicyDB struct {
+	lookup.PolicyDB
+	searches *int
+}
+
+func (c *countingPolicyDB) SearchWithTrace(tags *policy.TagStore) (int, interface{}, []string) {
+	*c.searches++
+	return c.PolicyDB.SearchWithTrace(tags)
+}
+
+func TestUDPFlowRecordTrace(t *testing.T) {
+
+	Convey("Given a receiver with an accept and a reject rule", t, func() {
+
+		records := &channelCollector{flows: make(chan *collector.FlowRecord, 10)}
+		secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+		enforcer := NewWithDefaults("SomeServerId", records, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+
+		searches := 0
+		enforcer.SetPolicyDB(func() lookup.PolicyDB {
+			return &countingPolicyDB{PolicyDB: lookup.NewPolicyDB(), searches: &searches}
+		})
+
+		puInfo1 := policy.NewPUInfo("udp-pu-1", constants.ContainerPU)
+		puInfo1.Runtime.SetIPAddresses(policy.ExtendedMap{"bridge": "10.1.1.1"})
+		puInfo1.Policy.AddIdentityTag(TransmitterLabel, "value")
+		So(enforcer.Enforce("udp-pu-1", puInfo1), ShouldBeNil)
+
+		puInfo2 := policy.NewPUInfo("udp-pu-2", constants.ContainerPU)
+		puInfo2.Runtime.SetIPAddresses(policy.ExtendedMap{"bridge": "10.1.1.2"})
+		puInfo2.Policy.AddReceiverRules(policy.TagSelector{
+			Clause: []policy.KeyValueOperator{
+				{Key: TransmitterLabel, Value: []string{"value"}, Operator: policy.Equal},
+			},
+			Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "accept-value"},
+		})
+		puInfo2.Policy.AddReceiverRules(policy.TagSelector{
+			Clause: []policy.KeyValueOperator{
+				{Key: PortNumberLabelString, Value: []string{"22"}, Operator: policy.Equal},
+			},
+			Policy: &policy.FlowPolicy{Action: policy.Reject, PolicyID: "reject-ssh"},
+		})
+		So(enforcer.Enforce("udp-pu-2", puInfo2), ShouldBeNil)
+
+		Convey("The accepted flow should be reported with the matched rule and its trace", func() {
+			request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 53, []byte("request"))
+			So(enforcer.processApplicationUDPPackets(request), ShouldBeNil)
+			So(enforcer.processNetworkUDPPackets(transmit(request)), ShouldBeNil)
+
+			record := <-records.flows
+			So(record.Action, ShouldEqual, policy.Accept)
+			So(record.PolicyID, ShouldEqual, "accept-value")
+			So(record.PolicyTrace, ShouldResemble, []string{TransmitterLabel + "=value"})
+			So(searches, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("The rejected flow should be reported with the matched rule and its trace", func() {
+			request := udpTestPacket(packet.PacketTypeApplication, "10.1.1.1", "10.1.1.2", 40000, 22, []byte("request"))
+			So(enforcer.processApplicationUDPPackets(request), ShouldBeNil)
+			So(enforcer.processNetworkUDPPackets(transmit(request)), ShouldNotBeNil)
+
+			record := <-records.flows
+			So(record.Action, ShouldEqual, policy.Reject)
+			So(record.DropReason, ShouldEqual, collector.PolicyDrop)
+			So(record.PolicyID, ShouldEqual, "reject-ssh")
+			So(record.PolicyTrace, ShouldResemble, []string{PortNumberLabelString + "=22"})
+		})
+	})
+}
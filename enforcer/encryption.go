@@ -0,0 +1,276 @@
+package enforcer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
+)
+
+const (
+	// encryptionIVLength is the part of the nonce that is fixed per direction
+	encryptionIVLength = 4
+
+	// encryptionCounterLength is the length of the record counter sent in
+	// front of every encrypted payload
+	encryptionCounterLength = 8
+
+	// encryptionTagLength is the length of the authentication tag sent after
+	// every encrypted payload
+	encryptionTagLength = 16
+
+	// encryptionRecordLength is the length of the record counter and the
+	// authentication tag of every encrypted payload
+	encryptionRecordLength = encryptionCounterLength + encryptionTagLength
+
+	// encryptionOptionLength is the length of the TCP option that carries the
+	// record counter and the authentication tag
+	encryptionOptionLength = 2 + encryptionRecordLength
+
+	// encryptionOverhead is the number of bytes added to the TCP header of
+	// every encrypted segment: the encryption option after two no-operation
+	// options that align it. The payload keeps its size, so that the sequence
+	// numbers of the endpoints stay valid. The MSS announced by the encrypted
+	// connections is decreased by this size so that the segments still fit in
+	// the path MTU.
+	encryptionOverhead = 2 + encryptionOptionLength
+
+	// encryptionEpochShift gives the epoch of a record counter. The key of a
+	// direction changes every 2^32 records, so that a key never encrypts more
+	// than 2^32 records.
+	encryptionEpochShift = 32
+
+	// initiatorLabel and responderLabel separate the keys of the two directions
+	initiatorLabel = "trireme-initiator"
+	responderLabel = "trireme-responder"
+)
+
+// encryptionError is the error of a segment of an encrypted connection that
+// can not be sealed or opened. Such a segment is always dropped, even for the
+// monitored PUs, so that a connection never falls back to plain text.
+type encryptionError struct {
+	err error
+}
+
+// Error implements the error interface
+func (e *encryptionError) Error() string {
+	return fmt.Sprintf("Encryption failed: %s", e.err)
+}
+
+// isEncryptionError returns true if the error is an encryption error
+func isEncryptionError(err error) bool {
+
+	_, ok := err.(*encryptionError)
+	return ok
+}
+
+// flowCipher holds the session keys of an encrypted connection. The key
+// material is derived from the ECDH shared secret of the ephemeral keys
+// exchanged in the Syn/SynAck tokens and the nonces of both sides, so that
+// every connection gets its own keys even when a Syn token is re-used.
+//
+// Payloads are sealed with AES-GCM, which keeps their size. Every segment sent
+// in a direction is a record with its own counter, which makes the nonce of
+// the record with the fixed IV of the direction. The counter and the
+// authentication tag are sent in a TCP option. A retransmitted segment is a
+// new record, so a nonce is never used twice with the same key. The TCP
+// sequence number of the segment is authenticated with the payload, so that a
+// record can not be moved in the stream.
+type flowCipher struct {
+	local  *flowKeys
+	remote *flowKeys
+
+	// counter is the counter of the next record sent
+	counter uint64
+}
+
+// flowKeys are the keys of one direction. They are derived again from the
+// base key at every epoch of the record counter.
+type flowKeys struct {
+	base  []byte
+	iv    []byte
+	epoch uint32
+	aead  cipher.AEAD
+}
+
+// newFlowCipher derives the session keys of a connection. The initiator is
+// the side that transmitted the Syn packet.
+func newFlowCipher(ephemeral *ecdsa.PrivateKey, remoteEK []byte, initiatorNonce []byte, responderNonce []byte, initiator bool) (*flowCipher, error) {
+
+	shared, err := crypto.ComputeSharedKey(ephemeral, remoteEK)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := append(append([]byte{}, initiatorNonce...), responderNonce...)
+
+	initiatorKeys, err := deriveKeys(shared, initiatorLabel, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	responderKeys, err := deriveKeys(shared, responderLabel, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if initiator {
+		return &flowCipher{
+			local:  initiatorKeys,
+			remote: responderKeys,
+		}, nil
+	}
+
+	return &flowCipher{
+		local:  responderKeys,
+		remote: initiatorKeys,
+	}, nil
+}
+
+// deriveKeys derives the base key and IV of one direction from the shared secret
+func deriveKeys(shared []byte, label string, salt []byte) (*flowKeys, error) {
+
+	base, err := crypto.ComputeHmac256(append([]byte(label+":key:"), salt...), shared)
+	if err != nil {
+		return nil, err
+	}
+
+	iv, err := crypto.ComputeHmac256(append([]byte(label+":iv:"), salt...), shared)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &flowKeys{
+		base: base,
+		iv:   iv[:encryptionIVLength],
+	}
+
+	if err := k.rekey(0); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// rekey derives the key of an epoch from the base key
+func (k *flowKeys) rekey(epoch uint32) error {
+
+	var label [4]byte
+	binary.BigEndian.PutUint32(label[:], epoch)
+
+	key, err := crypto.ComputeHmac256(append([]byte("epoch:"), label[:]...), k.base)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("Failed to create session cipher: %s", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("Failed to create session cipher: %s", err)
+	}
+
+	k.epoch = epoch
+	k.aead = aead
+
+	return nil
+}
+
+// keys returns the cipher and the nonce of a record
+func (k *flowKeys) keys(counter uint64) (cipher.AEAD, []byte, error) {
+
+	if epoch := uint32(counter >> encryptionEpochShift); epoch != k.epoch {
+		if err := k.rekey(epoch); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	nonce := make([]byte, encryptionIVLength+encryptionCounterLength)
+	copy(nonce, k.iv)
+	binary.BigEndian.PutUint64(nonce[encryptionIVLength:], counter)
+
+	return k.aead, nonce, nil
+}
+
+// seal encrypts the payload of a segment transmitted by this side starting at
+// seq. It returns the cipher text, which has the size of the payload, and the
+// record with the counter and the tag.
+func (f *flowCipher) seal(seq uint32, data []byte) ([]byte, []byte, error) {
+
+	if f.counter == math.MaxUint64 {
+		return nil, nil, fmt.Errorf("Session keys exhausted")
+	}
+
+	aead, nonce, err := f.local.keys(f.counter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	record := make([]byte, encryptionCounterLength, encryptionRecordLength)
+	binary.BigEndian.PutUint64(record, f.counter)
+	f.counter++
+
+	sealed := aead.Seal(nil, nonce, data, sequenceData(seq))
+
+	return sealed[:len(data)], append(record, sealed[len(data):]...), nil
+}
+
+// open decrypts the cipher text received from the remote in a segment
+// starting at seq with its record. It fails if the cipher text was modified
+// or moved in the stream.
+func (f *flowCipher) open(seq uint32, record []byte, cipherText []byte) ([]byte, error) {
+
+	if len(record) != encryptionRecordLength {
+		return nil, fmt.Errorf("Invalid encryption record length: %d", len(record))
+	}
+
+	aead, nonce, err := f.remote.keys(binary.BigEndian.Uint64(record))
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := append(append([]byte{}, cipherText...), record[encryptionCounterLength:]...)
+
+	data, err := aead.Open(nil, nonce, sealed, sequenceData(seq))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt payload: %s", err)
+	}
+
+	return data, nil
+}
+
+// encryptionOption returns the TCP options that carry a record
+func encryptionOption(record []byte) []byte {
+
+	option := []byte{packet.TCPNoOperationOption, packet.TCPNoOperationOption, packet.TCPEncryptionOption, encryptionOptionLength}
+
+	return append(option, record...)
+}
+
+// encryptionRecord returns the record carried by the TCP options of an
+// encrypted segment
+func encryptionRecord(option []byte) ([]byte, error) {
+
+	if len(option) != encryptionOverhead || option[2] != packet.TCPEncryptionOption || option[3] != encryptionOptionLength {
+		return nil, fmt.Errorf("Encryption option not found")
+	}
+
+	return option[4:], nil
+}
+
+// sequenceData returns the sequence number authenticated with a record
+func sequenceData(seq uint32) []byte {
+
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, seq)
+
+	return data
+}
@@ -0,0 +1,266 @@
+package enforcer
+
+import (
+	"crypto/elliptic"
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFlowCipher(t *testing.T) {
+
+	Convey("Given an initiator and a responder that exchanged ephemeral keys", t, func() {
+
+		initiatorKey, initiatorEK := crypto.CreateEphemeralKey(elliptic.P256)
+		responderKey, responderEK := crypto.CreateEphemeralKey(elliptic.P256)
+		initiatorNonce := []byte("0123456789abcdef")
+		responderNonce := []byte("fedcba9876543210")
+
+		initiator, err := newFlowCipher(initiatorKey, responderEK, initiatorNonce, responderNonce, true)
+		So(err, ShouldBeNil)
+		responder, err := newFlowCipher(responderKey, initiatorEK, initiatorNonce, responderNonce, false)
+		So(err, ShouldBeNil)
+
+		data := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+		Convey("Data sealed by the initiator should be opened by the responder", func() {
+			cipherText, record, err := initiator.seal(1000, data)
+			So(err, ShouldBeNil)
+			So(len(cipherText), ShouldEqual, len(data))
+			So(len(record), ShouldEqual, encryptionRecordLength)
+
+			payload, err := responder.open(1000, record, cipherText)
+			So(err, ShouldBeNil)
+			So(payload, ShouldResemble, data)
+		})
+
+		Convey("The two directions should use different keys", func() {
+			forward, record, err := initiator.seal(5, data)
+			So(err, ShouldBeNil)
+			reverse, _, err := responder.seal(5, data)
+			So(err, ShouldBeNil)
+			So(forward, ShouldNotResemble, reverse)
+
+			_, err = initiator.open(5, record, forward)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A retransmitted segment should be sealed with a new nonce", func() {
+			first, _, err := initiator.seal(5, data)
+			So(err, ShouldBeNil)
+			second, record, err := initiator.seal(5, data)
+			So(err, ShouldBeNil)
+			So(first, ShouldNotResemble, second)
+
+			payload, err := responder.open(5, record, second)
+			So(err, ShouldBeNil)
+			So(payload, ShouldResemble, data)
+		})
+
+		Convey("A modified cipher text should be rejected", func() {
+			cipherText, record, err := initiator.seal(5, data)
+			So(err, ShouldBeNil)
+			cipherText[1] ^= 0x01
+
+			_, err = responder.open(5, record, cipherText)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A record moved to another sequence number should be rejected", func() {
+			cipherText, record, err := initiator.seal(5, data)
+			So(err, ShouldBeNil)
+
+			_, err = responder.open(6, record, cipherText)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A truncated record should be rejected", func() {
+			_, err := responder.open(5, make([]byte, encryptionRecordLength-1), data)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Records sealed across an epoch should be opened with the keys of their epoch", func() {
+			initiator.counter = 1<<encryptionEpochShift - 1
+
+			last, lastRecord, err := initiator.seal(5, data)
+			So(err, ShouldBeNil)
+			next, nextRecord, err := initiator.seal(6, data)
+			So(err, ShouldBeNil)
+			So(initiator.local.epoch, ShouldEqual, 1)
+
+			payload, err := responder.open(6, nextRecord, next)
+			So(err, ShouldBeNil)
+			So(payload, ShouldResemble, data)
+
+			payload, err = responder.open(5, lastRecord, last)
+			So(err, ShouldBeNil)
+			So(payload, ShouldResemble, data)
+		})
+
+		Convey("The initiator should stop sealing when the record counter is exhausted", func() {
+			initiator.counter = math.MaxUint64
+
+			_, _, err := initiator.seal(5, data)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A responder with different nonces should not be able to open the records", func() {
+			other, err := newFlowCipher(responderKey, initiatorEK, responderNonce, initiatorNonce, false)
+			So(err, ShouldBeNil)
+
+			cipherText, record, err := initiator.seal(0, data)
+			So(err, ShouldBeNil)
+
+			_, err = other.open(0, record, cipherText)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given an invalid remote ephemeral key", t, func() {
+		key, _ := crypto.CreateEphemeralKey(elliptic.P256)
+
+		Convey("I should fail to create the session keys", func() {
+			_, err := newFlowCipher(key, []byte("invalid"), []byte("a"), []byte("b"), true)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// encryptionTestSegment creates a TCP segment with options and payload
+func encryptionTestSegment(seq uint32, options []byte, data []byte) *packet.Packet {
+
+	buffer := make([]byte, 40, 40+len(options)+len(data))
+	buffer[0] = 0x45
+	buffer[8] = 64
+	buffer[9] = packet.IPProtocolTCP
+	copy(buffer[12:16], net.ParseIP("10.1.1.1").To4())
+	copy(buffer[16:20], net.ParseIP("10.1.1.2").To4())
+	binary.BigEndian.PutUint16(buffer[20:22], 2000)
+	binary.BigEndian.PutUint16(buffer[22:24], 80)
+	binary.BigEndian.PutUint32(buffer[24:28], seq)
+	buffer[32] = byte(5+len(options)/4) << 4
+	buffer[33] = packet.TCPAckMask
+	buffer = append(buffer, options...)
+	buffer = append(buffer, data...)
+	binary.BigEndian.PutUint16(buffer[2:4], uint16(len(buffer)))
+
+	p, err := packet.New(packet.PacketTypeApplication, buffer, "0")
+	So(err, ShouldBeNil)
+
+	return p
+}
+
+func TestEncryptedSegments(t *testing.T) {
+
+	Convey("Given the two sides of an encrypted connection", t, func() {
+
+		initiatorKey, initiatorEK := crypto.CreateEphemeralKey(elliptic.P256)
+		responderKey, responderEK := crypto.CreateEphemeralKey(elliptic.P256)
+		initiatorNonce := []byte("0123456789abcdef")
+		responderNonce := []byte("fedcba9876543210")
+
+		initiator, err := newFlowCipher(initiatorKey, responderEK, initiatorNonce, responderNonce, true)
+		So(err, ShouldBeNil)
+		responder, err := newFlowCipher(responderKey, initiatorEK, initiatorNonce, responderNonce, false)
+		So(err, ShouldBeNil)
+
+		d := &Datapath{}
+		sender := &TCPConnection{encryption: initiator, remoteMSS: 1000}
+		receiver := &TCPConnection{encryption: responder}
+
+		timestamps := []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2}
+
+		// transmit encrypts a segment and returns the segment received by the remote
+		transmit := func(seq uint32, options []byte, data []byte) *packet.Packet {
+
+			segment := encryptionTestSegment(seq, options, data)
+			So(d.encryptPayload(segment, sender), ShouldBeNil)
+			segment.UpdateTCPChecksum()
+
+			received, err := packet.New(packet.PacketTypeNetwork, segment.GetBytes(), "0")
+			So(err, ShouldBeNil)
+			So(received.VerifyTCPChecksum(), ShouldBeTrue)
+
+			return received
+		}
+
+		// deliver decrypts a received segment and returns the segment delivered to the PU
+		deliver := func(received *packet.Packet) *packet.Packet {
+
+			So(d.decryptPayload(received, receiver), ShouldBeNil)
+			received.UpdateTCPChecksum()
+
+			delivered, err := packet.New(packet.PacketTypeNetwork, received.GetBytes(), "0")
+			So(err, ShouldBeNil)
+			So(delivered.VerifyTCPChecksum(), ShouldBeTrue)
+
+			return delivered
+		}
+
+		stream := make([]byte, 3000)
+		for i := range stream {
+			stream[i] = byte(i)
+		}
+
+		Convey("When a stream is sent in several full-sized segments, every segment should keep its sequence number and size", func() {
+
+			for offset := 0; offset < len(stream); offset += 1000 {
+				data := stream[offset : offset+1000]
+				received := transmit(uint32(1000+offset), timestamps, data)
+
+				So(received.TCPSeq, ShouldEqual, 1000+offset)
+				So(received.IPTotalLength, ShouldEqual, 40+len(timestamps)+encryptionOverhead+len(data))
+				So(received.TCPHeaderOptionLength(), ShouldEqual, packet.TCPMaxOptionsLength)
+				So(len(received.ReadTCPData()), ShouldEqual, len(data))
+				So(received.ReadTCPData(), ShouldNotResemble, data)
+
+				delivered := deliver(received)
+				So(delivered.TCPSeq, ShouldEqual, 1000+offset)
+				So(delivered.IPTotalLength, ShouldEqual, 40+len(timestamps)+len(data))
+				So(delivered.ReadTCPData(), ShouldResemble, data)
+			}
+		})
+
+		Convey("When data is retransmitted in segments with other boundaries, it should be decrypted", func() {
+
+			for _, offset := range []int{0, 1000} {
+				deliver(transmit(uint32(1000+offset), nil, stream[offset:offset+1000]))
+			}
+
+			delivered := deliver(transmit(1500, nil, stream[500:1500]))
+			So(delivered.TCPSeq, ShouldEqual, 1500)
+			So(delivered.ReadTCPData(), ShouldResemble, stream[500:1500])
+		})
+
+		Convey("A segment larger than the MSS of the remote should be dropped", func() {
+			segment := encryptionTestSegment(1000, nil, stream[:1001])
+			err := d.encryptPayload(segment, sender)
+			So(isEncryptionError(err), ShouldBeTrue)
+		})
+
+		Convey("A segment without room for the encryption option should be dropped", func() {
+			sack := []byte{1, 1, 5, 10, 0, 0, 0, 1, 0, 0, 0, 2}
+			segment := encryptionTestSegment(1000, append(sack, timestamps...), stream[:100])
+			err := d.encryptPayload(segment, sender)
+			So(isEncryptionError(err), ShouldBeTrue)
+		})
+
+		Convey("A segment without the encryption option should be dropped by the remote", func() {
+			segment := encryptionTestSegment(1000, timestamps, stream[:100])
+			err := d.decryptPayload(segment, receiver)
+			So(isEncryptionError(err), ShouldBeTrue)
+		})
+
+		Convey("Segments without payload should not be changed", func() {
+			segment := encryptionTestSegment(1000, timestamps, nil)
+			So(d.encryptPayload(segment, sender), ShouldBeNil)
+			So(segment.TCPHeaderOptionLength(), ShouldEqual, len(timestamps))
+			So(d.decryptPayload(segment, receiver), ShouldBeNil)
+		})
+	})
+}
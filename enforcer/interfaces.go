@@ -1,6 +1,7 @@
 package enforcer
 
 import (
+	"crypto/ecdsa"
 	"sync"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/aporeto-inc/trireme/enforcer/lookup"
 	"github.com/aporeto-inc/trireme/enforcer/utils/fqconfig"
 	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
+	"github.com/aporeto-inc/trireme/enforcer/utils/replay"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
 	"github.com/aporeto-inc/trireme/enforcer/utils/tokens"
 	"github.com/aporeto-inc/trireme/policy"
@@ -34,6 +36,50 @@ type PolicyEnforcer interface {
 	Stop() error
 }
 
+// FlowSimulator evaluates the policy of a flow without processing any packets.
+type FlowSimulator interface {
+
+	// SimulateFlow evaluates a flow from source to destination on the given port.
+	// The source and destination are either contextIDs or IP addresses.
+	SimulateFlow(source, destination string, port uint16) (*FlowSimulation, error)
+}
+
+// MutualAuthorizer is implemented by the enforcers whose transmitters can also
+// validate the policy of the receivers.
+type MutualAuthorizer interface {
+
+	// MutualAuthorization returns true if the transmitters validate the policy
+	// of the receivers.
+	MutualAuthorization() bool
+}
+
+// SecretsUpdater replaces the key material of an enforcer at runtime.
+type SecretsUpdater interface {
+
+	// UpdateSecrets replaces the secrets used to sign and verify the tokens.
+	// The previous secrets are still accepted for the overlap duration.
+	UpdateSecrets(s secrets.Secrets, overlap time.Duration) error
+
+	// CurrentSecrets returns the secrets currently used to sign the tokens.
+	CurrentSecrets() secrets.Secrets
+}
+
+// ReplayProtector rejects the Syn tokens that are replayed by a third party.
+type ReplayProtector interface {
+
+	// EnableReplayProtection remembers the nonces of the Syn tokens for the
+	// window of the configuration and rejects the ones that are seen twice.
+	EnableReplayProtection(config *replay.Config) error
+}
+
+// StatusReporter reports the health of an enforcer.
+type StatusReporter interface {
+
+	// Status returns the health of the queues, the size of the caches and the
+	// hashes of the policies of the enforcer.
+	Status() (*Status, error)
+}
+
 // PublicKeyAdder register a publicKey for a Node.
 type PublicKeyAdder interface {
 
@@ -65,19 +111,30 @@ type PUContext struct {
 	ManagementID    string
 	Identity        *policy.TagStore
 	Annotations     *policy.TagStore
-	AcceptTxtRules  *lookup.PolicyDB
-	RejectTxtRules  *lookup.PolicyDB
-	AcceptRcvRules  *lookup.PolicyDB
-	RejectRcvRules  *lookup.PolicyDB
+	AcceptTxtRules  lookup.PolicyDB
+	RejectTxtRules  lookup.PolicyDB
+	AcceptRcvRules  lookup.PolicyDB
+	RejectRcvRules  lookup.PolicyDB
 	ApplicationACLs *acls.ACLCache
 	NetworkACLS     *acls.ACLCache
 	externalIPCache cache.DataStore
 	Extension       interface{}
 	IP              string
+	IPv6            string
 	Mark            string
 	Ports           []string
 	PUType          constants.PUType
 	synToken        []byte
+	synEphemeralKey *ecdsa.PrivateKey
 	synExpiration   time.Time
+	encryption      bool
+	monitored       bool
+	failurePolicy   policy.FailurePolicy
+	policyHash      string
+
+	// ApplicationUDPACLs and NetworkUDPACLs hold the ACLs of the UDP flows
+	ApplicationUDPACLs *acls.ACLCache
+	NetworkUDPACLs     *acls.ACLCache
+
 	sync.Mutex
 }
@@ -12,76 +12,86 @@ import (
 
 // ForwardingPolicy is an instance of the forwarding policy
 type ForwardingPolicy struct {
-	tags    []policy.KeyValueOperator
-	count   int
-	index   int
-	actions interface{}
+	tags     []policy.KeyValueOperator
+	count    int
+	index    int
+	priority int
+	actions  interface{}
 }
 
 // intList is a list of integeres
 type intList []int
 
-//PolicyDB is the structure of a policy
-type PolicyDB struct {
+// PolicyDB is a database of policies that finds the policy matching a set of tags
+type PolicyDB interface {
+	// AddPolicy adds a policy to the database and returns its index
+	AddPolicy(selector policy.TagSelector) (policyID int)
+
+	// Search returns the index and the actions of the policy matching the
+	// tags, or -1 if no policy matches
+	Search(tags *policy.TagStore) (int, interface{})
+
+	// SearchWithTrace is the same as Search but it also returns the clauses
+	// of the matching policy that were satisfied by the tags
+	SearchWithTrace(tags *policy.TagStore) (int, interface{}, []string)
+
+	// PrintPolicyDB dumps the database for debugging
+	PrintPolicyDB()
+}
+
+// tagPolicyDB is the default PolicyDB. It indexes the policies by the keys and
+// values of their clauses.
+type tagPolicyDB struct {
 	// rules    []policy
-	numberOfPolicies       int
-	equalPrefixes          map[string]intList
-	equalMapTable          map[string]map[string][]*ForwardingPolicy
-	notEqualMapTable       map[string]map[string][]*ForwardingPolicy
-	notStarTable           map[string][]*ForwardingPolicy
-	defaultNotExistsPolicy *ForwardingPolicy
+	numberOfPolicies         int
+	equalPrefixes            map[string]intList
+	equalMapTable            map[string]map[string][]*ForwardingPolicy
+	notEqualMapTable         map[string]map[string][]*ForwardingPolicy
+	notStarTable             map[string][]*ForwardingPolicy
+	defaultNotExistsPolicies []*ForwardingPolicy
 }
 
 //NewPolicyDB creates a new PolicyDB for efficient search of policies
-func NewPolicyDB() (m *PolicyDB) {
-
-	m = &PolicyDB{
-		numberOfPolicies:       0,
-		equalMapTable:          map[string]map[string][]*ForwardingPolicy{},
-		equalPrefixes:          map[string]intList{},
-		notEqualMapTable:       map[string]map[string][]*ForwardingPolicy{},
-		notStarTable:           map[string][]*ForwardingPolicy{},
-		defaultNotExistsPolicy: nil,
+func NewPolicyDB() PolicyDB {
+
+	return &tagPolicyDB{
+		numberOfPolicies:         0,
+		equalMapTable:            map[string]map[string][]*ForwardingPolicy{},
+		equalPrefixes:            map[string]intList{},
+		notEqualMapTable:         map[string]map[string][]*ForwardingPolicy{},
+		notStarTable:             map[string][]*ForwardingPolicy{},
+		defaultNotExistsPolicies: []*ForwardingPolicy{},
 	}
-
-	return m
 }
 
+// sortedInsert inserts a value in a list sorted in descending order.
+// Values that are already in the list are not inserted again.
 func (array intList) sortedInsert(value int) intList {
-	l := len(array)
-	if l == 0 {
-		array = append(array, value)
-		return array
-	}
 
-	i := sort.Search(l, func(i int) bool {
+	i := sort.Search(len(array), func(i int) bool {
 		return array[i] <= value
 	})
 
-	if i == 0 { // new value is the largest
-		array = append([]int{value}, array...)
-		return array
-	}
-
-	if i == l-1 { // new value is the smallest
-		array = append(array, value)
+	if i < len(array) && array[i] == value {
 		return array
 	}
 
-	inserted := append(array[0:i], value)
-
-	return append(inserted, array[i:]...)
+	array = append(array, 0)
+	copy(array[i+1:], array[i:])
+	array[i] = value
 
+	return array
 }
 
 //AddPolicy adds a policy to the database
-func (m *PolicyDB) AddPolicy(selector policy.TagSelector) (policyID int) {
+func (m *tagPolicyDB) AddPolicy(selector policy.TagSelector) (policyID int) {
 
 	// Create a new policy object
 	e := ForwardingPolicy{
-		count:   0,
-		tags:    selector.Clause,
-		actions: selector.Policy,
+		count:    0,
+		tags:     selector.Clause,
+		priority: selector.Priority,
+		actions:  selector.Policy,
 	}
 
 	// For each tag of the incoming policy add a mapping between the map tables
@@ -101,7 +111,7 @@ func (m *PolicyDB) AddPolicy(selector policy.TagSelector) (policyID int) {
 		case policy.KeyNotExists:
 			m.notStarTable[keyValueOp.Key] = append(m.notStarTable[keyValueOp.Key], &e)
 			if len(selector.Clause) == 1 {
-				m.defaultNotExistsPolicy = &e
+				m.defaultNotExistsPolicies = append(m.defaultNotExistsPolicies, &e)
 			}
 
 		case policy.Equal:
@@ -140,7 +150,7 @@ func (m *PolicyDB) AddPolicy(selector policy.TagSelector) (policyID int) {
 
 }
 
-func (m *PolicyDB) keyValueFromString(tag string) (key, value string) {
+func (m *tagPolicyDB) keyValueFromString(tag string) (key, value string) {
 
 	parts := strings.SplitN(tag, "=", 2)
 
@@ -151,18 +161,49 @@ func (m *PolicyDB) keyValueFromString(tag string) (key, value string) {
 	return parts[0], parts[1]
 }
 
-//Search searches for a set of tags in the database to find a policy match
-func (m *PolicyDB) Search(tags *policy.TagStore) (int, interface{}) {
+// searchState holds the state of a single search in the database
+type searchState struct {
+	count []int
+	skip  []bool
+	match *ForwardingPolicy
+	trace map[int][]string
+}
+
+// Search searches for a set of tags in the database to find a policy match.
+// All policies are evaluated and the matching policy with the highest priority
+// is returned. Policies of equal priority are returned in the order they
+// were added to the database.
+func (m *tagPolicyDB) Search(tags *policy.TagStore) (int, interface{}) {
+
+	index, action, _ := m.search(tags, false)
+
+	return index, action
+}
+
+// SearchWithTrace is the same as Search but it also returns the clauses of the
+// matching policy that were satisfied by the tags, explaining why the policy
+// was selected.
+func (m *tagPolicyDB) SearchWithTrace(tags *policy.TagStore) (int, interface{}, []string) {
+
+	return m.search(tags, true)
+}
+
+func (m *tagPolicyDB) search(tags *policy.TagStore, trace bool) (int, interface{}, []string) {
 
-	count := make([]int, m.numberOfPolicies+1)
+	s := &searchState{
+		count: make([]int, m.numberOfPolicies+1),
+		skip:  make([]bool, m.numberOfPolicies+1),
+	}
 
-	skip := make([]bool, m.numberOfPolicies+1)
+	if trace {
+		s.trace = map[int][]string{}
+	}
 
 	// Disable all policies that fail the not key exists
 	for _, t := range tags.GetSlice() {
 		k, _ := m.keyValueFromString(t)
 		for _, policy := range m.notStarTable[k] {
-			skip[policy.index] = true
+			s.skip[policy.index] = true
 		}
 	}
 
@@ -170,16 +211,12 @@ func (m *PolicyDB) Search(tags *policy.TagStore) (int, interface{}) {
 	for _, t := range tags.GetSlice() {
 		k, v := m.keyValueFromString(t)
 		// Search for matches of k=v
-		if index, action := searchInMapTabe(m.equalMapTable[k][v], count, skip); index >= 0 {
-			return index, action
-		}
+		s.searchInMapTable(m.equalMapTable[k][v], k, policy.Equal, v)
 
 		// Search for matches in prefixes
 		for _, i := range m.equalPrefixes[k] {
 			if i <= len(v) {
-				if index, action := searchInMapTabe(m.equalMapTable[k][v[:i]], count, skip); index >= 0 {
-					return index, action
-				}
+				s.searchInMapTable(m.equalMapTable[k][v[:i]], k, policy.Equal, v[:i]+"*")
 			}
 		}
 
@@ -190,42 +227,78 @@ func (m *PolicyDB) Search(tags *policy.TagStore) (int, interface{}) {
 				continue
 			}
 
-			if index, action := searchInMapTabe(policies, count, skip); index >= 0 {
-				return index, action
-			}
+			s.searchInMapTable(policies, k, policy.NotEqual, value)
 		}
 	}
 
-	if m.defaultNotExistsPolicy != nil && !skip[m.defaultNotExistsPolicy.index] {
-		return m.defaultNotExistsPolicy.index, m.defaultNotExistsPolicy.actions
+	for _, p := range m.defaultNotExistsPolicies {
+		if !s.skip[p.index] {
+			s.selectPolicy(p)
+		}
 	}
 
-	return -1, nil
+	if s.match == nil {
+		return -1, nil, nil
+	}
+
+	return s.match.index, s.match.actions, s.matchTrace()
 }
 
-func searchInMapTabe(table []*ForwardingPolicy, count []int, skip []bool) (int, interface{}) {
+// searchInMapTable accounts for a hit of the given clause on all the policies of the table
+func (s *searchState) searchInMapTable(table []*ForwardingPolicy, key string, operator policy.Operator, value string) {
+
 	for _, policy := range table {
 
 		// Skip the policy if we have marked it
-		if skip[policy.index] {
+		if s.skip[policy.index] {
 			continue
 		}
 
 		// Since a policy is hit, the count of remaining tags is reduced by one
-		count[policy.index]++
+		s.count[policy.index]++
+
+		if s.trace != nil {
+			s.trace[policy.index] = append(s.trace[policy.index], key+string(operator)+value)
+		}
 
 		// If all tags of the policy have been hit, there is a match
-		if count[policy.index] == policy.count {
-			return policy.index, policy.actions
+		if s.count[policy.index] == policy.count {
+			s.selectPolicy(policy)
 		}
+	}
+}
+
+// selectPolicy keeps the policy if it has precedence over the current match
+func (s *searchState) selectPolicy(p *ForwardingPolicy) {
 
+	if s.match == nil ||
+		p.priority > s.match.priority ||
+		(p.priority == s.match.priority && p.index < s.match.index) {
+		s.match = p
 	}
+}
+
+// matchTrace returns the clauses that were hit by the matching policy
+func (s *searchState) matchTrace() []string {
+
+	if s.trace == nil {
+		return nil
+	}
+
+	clauses := s.trace[s.match.index]
+	for _, kv := range s.match.tags {
+		if kv.Operator == policy.KeyNotExists {
+			clauses = append(clauses, kv.Key+string(kv.Operator))
+		}
+	}
+
+	sort.Strings(clauses)
 
-	return -1, nil
+	return clauses
 }
 
 // PrintPolicyDB is a debugging function to dump the map
-func (m *PolicyDB) PrintPolicyDB() {
+func (m *tagPolicyDB) PrintPolicyDB() {
 
 	zap.L().Debug("Print Policy DB: equal table")
 
@@ -109,7 +109,7 @@ var (
 func TestConstructorNewPolicyDB(t *testing.T) {
 	Convey("Given that I instantiate a new policy DB, I should not get nil", t, func() {
 
-		p := &PolicyDB{}
+		p := &tagPolicyDB{}
 
 		policyDB := NewPolicyDB()
 
@@ -121,7 +121,7 @@ func TestConstructorNewPolicyDB(t *testing.T) {
 func TestFuncAddPolicy(t *testing.T) {
 
 	Convey("Given an empty policy DB", t, func() {
-		policyDB := NewPolicyDB()
+		policyDB := NewPolicyDB().(*tagPolicyDB)
 
 		Convey("When I add a single policy it should be associated with all the tags", func() {
 			index := policyDB.AddPolicy(appEqWebAndenvEqDemo)
@@ -307,12 +307,13 @@ func TestFuncSearch(t *testing.T) {
 				So(action.(*policy.FlowPolicy).Action, ShouldEqual, policy.Accept)
 			})
 
-			Convey("Given that I search for a value that matches a complete value ", func() {
+			Convey("Given that I search for a value that matches a complete value and a prefix, it should return the policy added first ", func() {
 				tags := policy.NewTagStore()
 				tags.AppendKeyValue("domain", "com.example.web")
 
 				index, action := policyDB.Search(tags)
-				So(index, ShouldEqual, index8)
+				So(index, ShouldEqual, index7)
+				So(index8, ShouldBeGreaterThan, index7)
 				So(action.(*policy.FlowPolicy).Action, ShouldEqual, policy.Accept)
 			})
 
@@ -340,6 +341,131 @@ func TestFuncSearch(t *testing.T) {
 	})
 }
 
+// TestFuncSearchPriority tests that the search selects policies by priority
+func TestFuncSearchPriority(t *testing.T) {
+
+	Convey("Given a policyDB with policies of different priorities", t, func() {
+		policyDB := NewPolicyDB()
+
+		low := appEqWebAndenvEqDemo
+		low.Policy = &policy.FlowPolicy{Action: policy.Accept, PolicyID: "low"}
+
+		high := appEqWebAndEnvEqDemoOrQa
+		high.Policy = &policy.FlowPolicy{Action: policy.Accept, PolicyID: "high"}
+		high.Priority = 10
+
+		notJava := policylangNotJava
+		notJava.Policy = &policy.FlowPolicy{Action: policy.Accept, PolicyID: "notjava"}
+		notJava.Priority = 10
+
+		envNotExists := policyEnvDoesNotExist
+		envNotExists.Policy = &policy.FlowPolicy{Action: policy.Accept, PolicyID: "noenv"}
+		envNotExists.Priority = 5
+
+		indexLow := policyDB.AddPolicy(low)
+		indexHigh := policyDB.AddPolicy(high)
+		indexNotJava := policyDB.AddPolicy(notJava)
+		indexNotExists := policyDB.AddPolicy(envNotExists)
+
+		Convey("When more than one policy matches, the highest priority should be returned", func() {
+			tags := policy.NewTagStore()
+			tags.AppendKeyValue("app", "web")
+			tags.AppendKeyValue("env", "demo")
+
+			index, action := policyDB.Search(tags)
+			So(index, ShouldEqual, indexHigh)
+			So(action.(*policy.FlowPolicy).PolicyID, ShouldEqual, "high")
+		})
+
+		Convey("When policies of equal priority match, the policy added first should be returned regardless of the tag order", func() {
+			tags := policy.NewTagStore()
+			tags.AppendKeyValue("lang", "go")
+			tags.AppendKeyValue("env", "qa")
+			tags.AppendKeyValue("app", "web")
+
+			index, _ := policyDB.Search(tags)
+			So(index, ShouldEqual, indexHigh)
+
+			reversed := policy.NewTagStore()
+			reversed.AppendKeyValue("app", "web")
+			reversed.AppendKeyValue("env", "qa")
+			reversed.AppendKeyValue("lang", "go")
+
+			index, _ = policyDB.Search(reversed)
+			So(index, ShouldEqual, indexHigh)
+			So(indexNotJava, ShouldBeGreaterThan, indexHigh)
+		})
+
+		Convey("When a higher priority policy matches, the key not exists policy should not be returned", func() {
+			tags := policy.NewTagStore()
+			tags.AppendKeyValue("lang", "go")
+
+			index, _ := policyDB.Search(tags)
+			So(index, ShouldEqual, indexNotJava)
+
+			tags = policy.NewTagStore()
+			tags.AppendKeyValue("app", "web")
+
+			index, _ = policyDB.Search(tags)
+			So(index, ShouldEqual, indexNotExists)
+			So(indexLow, ShouldNotEqual, indexNotExists)
+		})
+
+		Convey("When I search with a trace, I should get the clauses that matched", func() {
+			tags := policy.NewTagStore()
+			tags.AppendKeyValue("env", "qa")
+			tags.AppendKeyValue("app", "web")
+
+			index, action, trace := policyDB.SearchWithTrace(tags)
+			So(index, ShouldEqual, indexHigh)
+			So(action.(*policy.FlowPolicy).PolicyID, ShouldEqual, "high")
+			So(trace, ShouldResemble, []string{"app=web", "env=qa"})
+		})
+
+		Convey("When I search with a trace and nothing matches, I should get no trace", func() {
+			tags := policy.NewTagStore()
+			tags.AppendKeyValue("env", "prod")
+
+			index, action, trace := policyDB.SearchWithTrace(tags)
+			So(index, ShouldEqual, -1)
+			So(action, ShouldBeNil)
+			So(trace, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a policyDB with prefix, not equal and not exists policies", t, func() {
+		policyDB := NewPolicyDB()
+		policyDB.AddPolicy(policyDomainParent)
+		policyDB.AddPolicy(appEqWebAndenvNotDemoOrQA)
+		policyDB.AddPolicy(envKeyNotExistsAndAppEqWeb)
+
+		Convey("The trace should describe the prefixes that matched", func() {
+			tags := policy.NewTagStore()
+			tags.AppendKeyValue("domain", "com.example.db")
+
+			_, _, trace := policyDB.SearchWithTrace(tags)
+			So(trace, ShouldResemble, []string{"domain=com.*", "domain=com.example.*"})
+		})
+
+		Convey("The trace should describe the values that were not equal", func() {
+			tags := policy.NewTagStore()
+			tags.AppendKeyValue("app", "web")
+			tags.AppendKeyValue("env", "prod")
+
+			_, _, trace := policyDB.SearchWithTrace(tags)
+			So(trace, ShouldResemble, []string{"app=web", "env=!demo", "env=!qa"})
+		})
+
+		Convey("The trace should describe the keys that did not exist", func() {
+			tags := policy.NewTagStore()
+			tags.AppendKeyValue("app", "web")
+
+			_, _, trace := policyDB.SearchWithTrace(tags)
+			So(trace, ShouldResemble, []string{"app=web", "env!*"})
+		})
+	})
+}
+
 // TestFuncDumbDB is a mock test for the print function
 func TestFuncDumpDB(t *testing.T) {
 	Convey("Given an empty policy DB", t, func() {
@@ -0,0 +1,122 @@
+package enforcer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/aporeto-inc/trireme/cache"
+	"github.com/aporeto-inc/trireme/collector"
+)
+
+// verdictCounters counts the verdicts given to the packets of a queue and
+// the errors of the queue. The times are in nanoseconds since the epoch.
+type verdictCounters struct {
+	accepted   uint64
+	dropped    uint64
+	errors     uint64
+	lastPacket int64
+	lastError  int64
+}
+
+// accept counts an accepted packet
+func (v *verdictCounters) accept() {
+	atomic.AddUint64(&v.accepted, 1)
+	atomic.StoreInt64(&v.lastPacket, time.Now().UnixNano())
+}
+
+// drop counts a dropped packet
+func (v *verdictCounters) drop() {
+	atomic.AddUint64(&v.dropped, 1)
+	atomic.StoreInt64(&v.lastPacket, time.Now().UnixNano())
+}
+
+// fail counts an error of the queue
+func (v *verdictCounters) fail() {
+	atomic.AddUint64(&v.errors, 1)
+	atomic.StoreInt64(&v.lastError, time.Now().UnixNano())
+}
+
+// values returns the counters indexed by verdict
+func (v *verdictCounters) values() map[string]float64 {
+	return map[string]float64{
+		"accept": float64(atomic.LoadUint64(&v.accepted)),
+		"drop":   float64(atomic.LoadUint64(&v.dropped)),
+	}
+}
+
+// registerMetrics registers the internal counters and gauges of the datapath
+// if the collector is able to export them
+func (d *Datapath) registerMetrics(c collector.EventCollector) {
+
+	registry, ok := c.(collector.MetricsRegistry)
+	if !ok {
+		return
+	}
+
+	registry.RegisterMetric(
+		"trireme_datapath_network_verdicts_total",
+		"Number of verdicts given to packets received from the network",
+		collector.CounterMetric,
+		"verdict",
+		d.netVerdicts.values,
+	)
+
+	registry.RegisterMetric(
+		"trireme_datapath_application_verdicts_total",
+		"Number of verdicts given to packets sent by the applications",
+		collector.CounterMetric,
+		"verdict",
+		d.appVerdicts.values,
+	)
+
+	registry.RegisterMetric(
+		"trireme_datapath_queue_stalls_total",
+		"Number of times the watchdog found a queue stalled",
+		collector.CounterMetric,
+		"direction",
+		d.queueStalls,
+	)
+
+	registry.RegisterMetric(
+		"trireme_datapath_cache_entries",
+		"Number of entries in the caches of the datapath",
+		collector.GaugeMetric,
+		"cache",
+		d.cacheSizes,
+	)
+}
+
+// queueStalls returns the number of stalls of the queues indexed by direction
+func (d *Datapath) queueStalls() map[string]float64 {
+	return map[string]float64{
+		"network":     float64(atomic.LoadUint64(&d.netWatch.stalls)),
+		"application": float64(atomic.LoadUint64(&d.appWatch.stalls)),
+	}
+}
+
+// cacheSizes returns the number of entries of the datapath caches
+func (d *Datapath) cacheSizes() map[string]float64 {
+
+	caches := map[string]cache.DataStore{
+		"context":       d.contextTracker,
+		"pu_from_ip":    d.puFromIP,
+		"pu_from_mark":  d.puFromMark,
+		"pu_from_port":  d.puFromPort,
+		"source_port":   d.sourcePortConnectionCache,
+		"tcp_app_orig":  d.appOrigConnectionTracker,
+		"tcp_app_reply": d.appReplyConnectionTracker,
+		"tcp_net_orig":  d.netOrigConnectionTracker,
+		"tcp_net_reply": d.netReplyConnectionTracker,
+		"udp_app_orig":  d.udpAppOrigConnectionTracker,
+		"udp_app_reply": d.udpAppReplyConnectionTracker,
+		"udp_net_orig":  d.udpNetOrigConnectionTracker,
+		"udp_net_reply": d.udpNetReplyConnectionTracker,
+	}
+
+	sizes := make(map[string]float64, len(caches))
+	for name, c := range caches {
+		sizes[name] = float64(c.SizeOf())
+	}
+
+	return sizes
+}
@@ -0,0 +1,47 @@
+package enforcer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/collector/metricscollector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDatapathMetrics(t *testing.T) {
+
+	Convey("Given an enforcer that reports to a metrics collector", t, func() {
+
+		metrics := metricscollector.NewMetricsCollector(nil)
+		secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+		enforcer := NewWithDefaults("SomeServerId", metrics, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+
+		puInfo := policy.NewPUInfo("metrics-pu", constants.ContainerPU)
+		puInfo.Runtime.SetIPAddresses(policy.ExtendedMap{policy.DefaultNamespace: "10.1.1.1"})
+		So(enforcer.Enforce("metrics-pu", puInfo), ShouldBeNil)
+
+		enforcer.netVerdicts.accept()
+		enforcer.netVerdicts.drop()
+		enforcer.netVerdicts.drop()
+		enforcer.appVerdicts.accept()
+
+		var buf bytes.Buffer
+		So(metrics.Write(&buf), ShouldBeNil)
+		output := buf.String()
+
+		Convey("The verdict counters should be exported", func() {
+			So(output, ShouldContainSubstring, "trireme_datapath_network_verdicts_total{verdict=\"accept\"} 1\n")
+			So(output, ShouldContainSubstring, "trireme_datapath_network_verdicts_total{verdict=\"drop\"} 2\n")
+			So(output, ShouldContainSubstring, "trireme_datapath_application_verdicts_total{verdict=\"accept\"} 1\n")
+		})
+
+		Convey("The cache sizes should be exported", func() {
+			So(output, ShouldContainSubstring, "# TYPE trireme_datapath_cache_entries gauge\n")
+			So(output, ShouldContainSubstring, "trireme_datapath_cache_entries{cache=\"context\"} 1\n")
+			So(output, ShouldContainSubstring, "trireme_datapath_cache_entries{cache=\"pu_from_ip\"} 1\n")
+		})
+	})
+}
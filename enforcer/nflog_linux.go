@@ -5,6 +5,7 @@ package enforcer
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aporeto-inc/netlink-go/nflog"
 	"github.com/aporeto-inc/trireme/collector"
@@ -88,24 +89,33 @@ func (a *nfLog) recordFromNFLogBuffer(buf *nflog.NfPacket, puIsSource bool) (*co
 	}
 
 	var action policy.ActionType
-	if shortAction == "a" {
+	switch shortAction {
+	case "a":
 		action = policy.Accept
-	} else {
+	case "u":
+		action = policy.Reject | policy.Audit
+	default:
 		action = policy.Reject
 	}
 
+	now := time.Now()
+
 	record := &collector.FlowRecord{
 		ContextID: contextID,
 		Source: &collector.EndPoint{
-			IP: buf.SrcIP.String(),
+			IP:   buf.SrcIP.String(),
+			Port: uint16(buf.SrcPort),
 		},
 		Destination: &collector.EndPoint{
 			IP:   buf.DstIP.String(),
 			Port: uint16(buf.DstPort),
 		},
-		PolicyID: policyID,
-		Tags:     tags,
-		Action:   action,
+		PolicyID:  policyID,
+		Tags:      tags,
+		Action:    action,
+		Protocol:  uint8(buf.Protocol),
+		FirstSeen: now,
+		LastSeen:  now,
 	}
 
 	if puIsSource {
@@ -12,9 +12,20 @@ import (
 	"go.uber.org/zap"
 )
 
-func errorCallback(err error, data interface{}) {
-	zap.L().Error("Error while processing packets on queue", zap.Error(err))
+func networkErrorCallback(err error, data interface{}) {
+	zap.L().Error("Error while processing packets on network queue", zap.Error(err))
+	if d, ok := data.(*Datapath); ok {
+		d.netVerdicts.fail()
+	}
+}
+
+func appErrorCallback(err error, data interface{}) {
+	zap.L().Error("Error while processing packets on application queue", zap.Error(err))
+	if d, ok := data.(*Datapath); ok {
+		d.appVerdicts.fail()
+	}
 }
+
 func networkCallback(packet *nfqueue.NFPacket, d interface{}) {
 	d.(*Datapath).processNetworkPacketsFromNFQ(packet)
 }
@@ -34,13 +45,24 @@ func (d *Datapath) startNetworkInterceptor() {
 
 	nfq := make([]nfqueue.Verdict, d.filterQueue.GetNumNetworkQueues())
 
+	d.netWatch.setStarter(func(queue uint16) (queueStopper, error) {
+		verdict, err := nfqueue.CreateAndStartNfQueue(queue, d.filterQueue.GetNetworkQueueSize(), nfqueue.NfDefaultPacketSize, networkCallback, networkErrorCallback, d)
+		if err != nil {
+			return nil, err
+		}
+		return verdict, nil
+	})
+
 	for i := uint16(0); i < d.filterQueue.GetNumNetworkQueues(); i++ {
 
 		// Initialize all the queues
-		nfq[i], err = nfqueue.CreateAndStartNfQueue(d.filterQueue.GetNetworkQueueStart()+i, d.filterQueue.GetNetworkQueueSize(), nfqueue.NfDefaultPacketSize, networkCallback, errorCallback, d)
+		nfq[i], err = nfqueue.CreateAndStartNfQueue(d.filterQueue.GetNetworkQueueStart()+i, d.filterQueue.GetNetworkQueueSize(), nfqueue.NfDefaultPacketSize, networkCallback, networkErrorCallback, d)
 		if err != nil {
 			zap.L().Fatal("Unable to initialize netfilter queue", zap.Error(err))
 		}
+		if nfq[i] != nil {
+			d.netWatch.setHandle(d.filterQueue.GetNetworkQueueStart()+i, nfq[i])
+		}
 		go func(j uint16) {
 			for range d.netStop[j] {
 				return
@@ -62,12 +84,23 @@ func (d *Datapath) startApplicationInterceptor() {
 
 	nfq := make([]nfqueue.Verdict, d.filterQueue.GetNumApplicationQueues())
 
+	d.appWatch.setStarter(func(queue uint16) (queueStopper, error) {
+		verdict, err := nfqueue.CreateAndStartNfQueue(queue, d.filterQueue.GetApplicationQueueSize(), nfqueue.NfDefaultPacketSize, appCallBack, appErrorCallback, d)
+		if err != nil {
+			return nil, err
+		}
+		return verdict, nil
+	})
+
 	for i := uint16(0); i < d.filterQueue.GetNumApplicationQueues(); i++ {
-		nfq[i], err = nfqueue.CreateAndStartNfQueue(d.filterQueue.GetApplicationQueueStart()+i, d.filterQueue.GetApplicationQueueSize(), nfqueue.NfDefaultPacketSize, appCallBack, errorCallback, d)
+		nfq[i], err = nfqueue.CreateAndStartNfQueue(d.filterQueue.GetApplicationQueueStart()+i, d.filterQueue.GetApplicationQueueSize(), nfqueue.NfDefaultPacketSize, appCallBack, appErrorCallback, d)
 
 		if err != nil {
 			zap.L().Fatal("Unable to initialize netfilter queue", zap.Error(err))
 		}
+		if nfq[i] != nil {
+			d.appWatch.setHandle(d.filterQueue.GetApplicationQueueStart()+i, nfq[i])
+		}
 		go func(j uint16) {
 			for range d.appStop[j] {
 				return
@@ -81,6 +114,9 @@ func (d *Datapath) startApplicationInterceptor() {
 // processNetworkPacketsFromNFQ processes packets arriving from the network in an NF queue
 func (d *Datapath) processNetworkPacketsFromNFQ(p *nfqueue.NFPacket) {
 
+	d.netWatch.begin(p.QueueHandle.QueueNum)
+	defer d.netWatch.end(p.QueueHandle.QueueNum)
+
 	// Parse the packet - drop if parsing fails
 	netPacket, err := packet.New(packet.PacketTypeNetwork, p.Buffer, strconv.Itoa(int(p.Mark)))
 
@@ -88,12 +124,15 @@ func (d *Datapath) processNetworkPacketsFromNFQ(p *nfqueue.NFPacket) {
 		netPacket.Print(packet.PacketFailureCreate)
 	} else if netPacket.IPProto == packet.IPProtocolTCP {
 		err = d.processNetworkTCPPackets(netPacket)
+	} else if netPacket.IPProto == packet.IPProtocolUDP {
+		err = d.processNetworkUDPPackets(netPacket)
 	} else {
 		err = fmt.Errorf("Invalid IP Protocol %d", netPacket.IPProto)
 	}
 	if err != nil {
 		length := uint32(len(p.Buffer))
 		buffer := p.Buffer
+		d.netVerdicts.drop()
 		p.QueueHandle.SetVerdict2(uint32(p.QueueHandle.QueueNum), 0, uint32(p.Mark), length, uint32(p.ID), buffer)
 		return
 	}
@@ -106,6 +145,7 @@ func (d *Datapath) processNetworkPacketsFromNFQ(p *nfqueue.NFPacket) {
 	// buffer = append(buffer, netPacket.GetTCPOptions()...)
 	// buffer = append(buffer, netPacket.GetTCPData()...)
 	// length = uint32(len(buffer))
+	d.netVerdicts.accept()
 	p.QueueHandle.SetVerdict2(uint32(p.QueueHandle.QueueNum), 1, uint32(p.Mark), uint32(copyIndex), uint32(p.ID), buffer)
 
 }
@@ -113,6 +153,9 @@ func (d *Datapath) processNetworkPacketsFromNFQ(p *nfqueue.NFPacket) {
 // processApplicationPackets processes packets arriving from an application and are destined to the network
 func (d *Datapath) processApplicationPacketsFromNFQ(p *nfqueue.NFPacket) {
 
+	d.appWatch.begin(p.QueueHandle.QueueNum)
+	defer d.appWatch.end(p.QueueHandle.QueueNum)
+
 	// Being liberal on what we transmit - malformed TCP packets are let go
 	// We are strict on what we accept on the other side, but we don't block
 	// lots of things at the ingress to the network
@@ -122,6 +165,8 @@ func (d *Datapath) processApplicationPacketsFromNFQ(p *nfqueue.NFPacket) {
 		appPacket.Print(packet.PacketFailureCreate)
 	} else if appPacket.IPProto == packet.IPProtocolTCP {
 		err = d.processApplicationTCPPackets(appPacket)
+	} else if appPacket.IPProto == packet.IPProtocolUDP {
+		err = d.processApplicationUDPPackets(appPacket)
 	} else {
 		err = fmt.Errorf("Invalid IP Protocol %d", appPacket.IPProto)
 	}
@@ -129,6 +174,7 @@ func (d *Datapath) processApplicationPacketsFromNFQ(p *nfqueue.NFPacket) {
 	if err != nil {
 		length := uint32(len(p.Buffer))
 		buffer := p.Buffer
+		d.appVerdicts.drop()
 		p.QueueHandle.SetVerdict2(uint32(p.QueueHandle.QueueNum), 0, uint32(p.Mark), length, uint32(p.ID), buffer)
 		return
 	}
@@ -143,6 +189,7 @@ func (d *Datapath) processApplicationPacketsFromNFQ(p *nfqueue.NFPacket) {
 	// buffer = append(buffer, appPacket.GetTCPData()...)
 	// length = uint32(len(buffer))
 
+	d.appVerdicts.accept()
 	p.QueueHandle.SetVerdict2(uint32(p.QueueHandle.QueueNum), 1, uint32(p.Mark), uint32(copyIndex), uint32(p.ID), buffer)
 
 }
@@ -6,6 +6,7 @@ package enforcerproxy
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,8 +17,11 @@ import (
 	"github.com/aporeto-inc/trireme/crypto"
 	"github.com/aporeto-inc/trireme/enforcer"
 	"github.com/aporeto-inc/trireme/enforcer/utils/fqconfig"
+	"github.com/aporeto-inc/trireme/enforcer/utils/replay"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
 	"github.com/aporeto-inc/trireme/enforcer/utils/rpcwrapper"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/enforcer/utils/tokens"
 	"github.com/aporeto-inc/trireme/policy"
 	"github.com/aporeto-inc/trireme/processmon"
 )
@@ -42,10 +46,15 @@ var ErrEnforceFailed = errors.New("Failed to enforce rules")
 // ErrInitFailed exported
 var ErrInitFailed = errors.New("Failed remote Init")
 
+// DefaultStatusInterval is the default interval between two checks of the
+// health of the remote enforcers
+const DefaultStatusInterval = 30 * time.Second
+
 //ProxyInfo is the struct used to hold state about active enforcers in the system
 type ProxyInfo struct {
 	MutualAuth        bool
 	Secrets           secrets.Secrets
+	TokenType         tokens.TokenType
 	serverID          string
 	validity          time.Duration
 	prochdl           processmon.ProcessManager
@@ -55,6 +64,12 @@ type ProxyInfo struct {
 	commandArg        string
 	statsServerSecret string
 	procMountPoint    string
+	replay            *replay.Config
+	statusInterval    time.Duration
+	policyHashes      map[string]string
+	failurePolicies   map[string]policy.FailurePolicy
+	unhealthy         map[string]string
+	stop              chan struct{}
 
 	sync.Mutex
 }
@@ -62,22 +77,32 @@ type ProxyInfo struct {
 //InitRemoteEnforcer method makes a RPC call to the remote enforcer
 func (s *ProxyInfo) InitRemoteEnforcer(contextID string) error {
 
+	s.Lock()
+	currentSecrets := s.Secrets
+	replayConfig := replayConfigOf(s.replay, contextID)
+	filterQueue := filterQueueOf(s.filterQueue, s.failurePolicies[contextID])
+	s.Unlock()
+
 	resp := &rpcwrapper.Response{}
 	request := &rpcwrapper.Request{
 		Payload: &rpcwrapper.InitRequestPayload{
-			FqConfig:   s.filterQueue,
+			FqConfig:   filterQueue,
 			MutualAuth: s.MutualAuth,
 			Validity:   s.validity,
-			SecretType: s.Secrets.Type(),
+			SecretType: currentSecrets.Type(),
 			ServerID:   s.serverID,
-			CAPEM:      s.Secrets.(keyPEM).AuthPEM(),
-			PublicPEM:  s.Secrets.(keyPEM).TransmittedPEM(),
-			PrivatePEM: s.Secrets.(keyPEM).EncodingPEM(),
+			CAPEM:      currentSecrets.(keyPEM).AuthPEM(),
+			PublicPEM:  currentSecrets.(keyPEM).TransmittedPEM(),
+			PrivatePEM: currentSecrets.(keyPEM).EncodingPEM(),
+			Revocation: revocationConfig(currentSecrets),
+			SPIFFE:     spiffeSocket(currentSecrets),
+			TokenType:  s.TokenType,
+			Replay:     replayConfig,
 		},
 	}
 
-	if s.Secrets.Type() == secrets.PKICompactType {
-		request.Payload.(*rpcwrapper.InitRequestPayload).Token = s.Secrets.TransmittedKey()
+	if currentSecrets.Type() == secrets.PKICompactType {
+		request.Payload.(*rpcwrapper.InitRequestPayload).Token = currentSecrets.TransmittedKey()
 	}
 
 	if err := s.rpchdl.RemoteCall(contextID, "Server.InitEnforcer", request, resp); err != nil {
@@ -91,6 +116,74 @@ func (s *ProxyInfo) InitRemoteEnforcer(contextID string) error {
 	return nil
 }
 
+// EnableReplayProtection configures the replay protection of the remote
+// enforcers. It applies to the remote enforcers initialized afterwards.
+func (s *ProxyInfo) EnableReplayProtection(config *replay.Config) error {
+
+	if config == nil {
+		return fmt.Errorf("Replay configuration can not be nil")
+	}
+
+	s.Lock()
+	s.replay = config
+	s.Unlock()
+
+	return nil
+}
+
+// replayConfigOf returns the replay configuration of the remote enforcer of a
+// context. Each of them saves its window in its own file.
+func replayConfigOf(config *replay.Config, contextID string) *replay.Config {
+
+	if config == nil {
+		return nil
+	}
+
+	c := *config
+	if c.File != "" {
+		c.File = c.File + "." + strings.Replace(contextID, "/", "_", -1)
+	}
+
+	return &c
+}
+
+// filterQueueOf returns the queue configuration of the remote enforcer of a
+// context. Its queues only serve the PU, so they fail open or closed as its
+// failure policy says.
+func filterQueueOf(fqc *fqconfig.FilterQueue, failurePolicy policy.FailurePolicy) *fqconfig.FilterQueue {
+
+	if fqc == nil {
+		return nil
+	}
+
+	c := *fqc
+	c.FailOpen = failurePolicy.FailsOpen(fqc.FailOpen)
+
+	return &c
+}
+
+// revocationConfig returns the revocation configuration that the remote
+// enforcers must use with the secrets, if any
+func revocationConfig(s secrets.Secrets) *revocation.Config {
+
+	if r, ok := s.(secrets.RevocationChecking); ok && r.Revocation() != nil {
+		return r.Revocation().Config()
+	}
+
+	return nil
+}
+
+// spiffeSocket returns the socket of the workload API that the remote enforcers
+// must fetch their SVIDs from, if any
+func spiffeSocket(s secrets.Secrets) string {
+
+	if spiffe, ok := s.(*secrets.SPIFFESecrets); ok {
+		return spiffe.SocketPath()
+	}
+
+	return ""
+}
+
 //Enforce method makes a RPC call for the remote enforcer enforce method
 func (s *ProxyInfo) Enforce(contextID string, puInfo *policy.PUInfo) error {
 
@@ -106,6 +199,7 @@ func (s *ProxyInfo) Enforce(contextID string, puInfo *policy.PUInfo) error {
 
 	s.Lock()
 	_, ok := s.initDone[contextID]
+	s.failurePolicies[contextID] = puInfo.Policy.FailurePolicy()
 	s.Unlock()
 	if !ok {
 		if err = s.InitRemoteEnforcer(contextID); err != nil {
@@ -114,20 +208,7 @@ func (s *ProxyInfo) Enforce(contextID string, puInfo *policy.PUInfo) error {
 	}
 
 	request := &rpcwrapper.Request{
-		Payload: &rpcwrapper.EnforcePayload{
-			ContextID:        contextID,
-			ManagementID:     puInfo.Policy.ManagementID(),
-			TriremeAction:    puInfo.Policy.TriremeAction(),
-			ApplicationACLs:  puInfo.Policy.ApplicationACLs(),
-			NetworkACLs:      puInfo.Policy.NetworkACLs(),
-			PolicyIPs:        puInfo.Policy.IPAddresses(),
-			Annotations:      puInfo.Policy.Annotations(),
-			Identity:         puInfo.Policy.Identity(),
-			ReceiverRules:    puInfo.Policy.ReceiverRules(),
-			TransmitterRules: puInfo.Policy.TransmitterRules(),
-			TriremeNetworks:  puInfo.Policy.TriremeNetworks(),
-			ExcludedNetworks: puInfo.Policy.ExcludedNetworks(),
-		},
+		Payload: rpcwrapper.NewEnforcePayload(contextID, puInfo),
 	}
 
 	err = s.rpchdl.RemoteCall(contextID, "Server.Enforce", request, &rpcwrapper.Response{})
@@ -135,12 +216,44 @@ func (s *ProxyInfo) Enforce(contextID string, puInfo *policy.PUInfo) error {
 		// We can't talk to the enforcer. Kill it and restart it
 		s.Lock()
 		delete(s.initDone, contextID)
+		delete(s.policyHashes, contextID)
 		s.Unlock()
 		s.prochdl.KillProcess(contextID)
 		zap.L().Error("Failed to Enforce remote enforcer", zap.Error(err))
 		return ErrEnforceFailed
 	}
 
+	s.Lock()
+	s.policyHashes[contextID] = puInfo.Policy.Hash()
+	s.Unlock()
+
+	return nil
+}
+
+// EnforceAndSupervise enforces and supervises the policy of a PU with a single
+// call to its remote enforcer, which must already be initialized.
+func (s *ProxyInfo) EnforceAndSupervise(contextID string, puInfo *policy.PUInfo) error {
+
+	s.Lock()
+	_, ok := s.initDone[contextID]
+	s.Unlock()
+	if !ok {
+		return fmt.Errorf("Remote enforcer is not initialized: context=%s", contextID)
+	}
+
+	batch := rpcwrapper.NewBatch()
+	batch.Enforce(contextID, puInfo)
+	batch.Supervise(contextID, puInfo)
+
+	if err := batch.Send(s.rpchdl)[contextID]; err != nil {
+		return fmt.Errorf("Failed to send batch: context=%s error=%s", contextID, err)
+	}
+
+	s.Lock()
+	s.failurePolicies[contextID] = puInfo.Policy.FailurePolicy()
+	s.policyHashes[contextID] = puInfo.Policy.Hash()
+	s.Unlock()
+
 	return nil
 }
 
@@ -149,23 +262,251 @@ func (s *ProxyInfo) Unenforce(contextID string) error {
 
 	s.Lock()
 	delete(s.initDone, contextID)
+	delete(s.policyHashes, contextID)
+	delete(s.failurePolicies, contextID)
+	delete(s.unhealthy, contextID)
 	s.Unlock()
 
 	return nil
 }
 
+// Ping checks that the remote enforcer of a context responds to the calls.
+func (s *ProxyInfo) Ping(contextID string) error {
+
+	resp := &rpcwrapper.Response{}
+	request := &rpcwrapper.Request{
+		Payload: &rpcwrapper.StatusPayload{
+			ContextID: contextID,
+		},
+	}
+
+	if err := s.rpchdl.RemoteCall(contextID, "Server.Ping", request, resp); err != nil {
+		return fmt.Errorf("Failed to ping remote enforcer: status %s, error: %s", resp.Status, err)
+	}
+
+	return nil
+}
+
+// Status returns the health of the queues, the size of the caches and the
+// hashes of the policies of the remote enforcer of a context.
+func (s *ProxyInfo) Status(contextID string) (*enforcer.Status, error) {
+
+	resp := &rpcwrapper.Response{}
+	request := &rpcwrapper.Request{
+		Payload: &rpcwrapper.StatusPayload{
+			ContextID: contextID,
+		},
+	}
+
+	if err := s.rpchdl.RemoteCall(contextID, "Server.Status", request, resp); err != nil {
+		return nil, fmt.Errorf("Failed to get status of remote enforcer: status %s, error: %s", resp.Status, err)
+	}
+
+	payload, ok := resp.Payload.(rpcwrapper.StatusResponsePayload)
+	if !ok || payload.Status == nil {
+		return nil, fmt.Errorf("Invalid status of remote enforcer")
+	}
+
+	return payload.Status, nil
+}
+
+// Unhealthy returns the remote enforcers that failed their last health check,
+// with the reason of the failure, by context ID.
+func (s *ProxyInfo) Unhealthy() map[string]string {
+
+	s.Lock()
+	defer s.Unlock()
+
+	unhealthy := make(map[string]string, len(s.unhealthy))
+	for contextID, reason := range s.unhealthy {
+		unhealthy[contextID] = reason
+	}
+
+	return unhealthy
+}
+
+// SetStatusInterval sets the interval between two health checks of the remote
+// enforcers. They are not checked if 0. It must be called before Start.
+func (s *ProxyInfo) SetStatusInterval(interval time.Duration) {
+
+	s.Lock()
+	s.statusInterval = interval
+	s.Unlock()
+}
+
+// checkStatus checks the health of the initialized remote enforcers, and
+// flags the ones that do not respond, report a failure, or do not enforce
+// the last policy that was sent to them.
+func (s *ProxyInfo) checkStatus() {
+
+	s.Lock()
+	expected := make(map[string]string, len(s.initDone))
+	for contextID := range s.initDone {
+		expected[contextID] = s.policyHashes[contextID]
+	}
+	s.Unlock()
+
+	for contextID, hash := range expected {
+
+		reason := ""
+		status, err := s.Status(contextID)
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case !status.Healthy:
+			reason = "Queues are failing"
+		case hash != "" && status.Policies[contextID] != hash:
+			reason = "Policy is out of date"
+		}
+
+		s.Lock()
+		if _, ok := s.initDone[contextID]; !ok {
+			// The enforcer was stopped during the check
+			s.Unlock()
+			continue
+		}
+		previous, wasUnhealthy := s.unhealthy[contextID]
+		if reason != "" {
+			s.unhealthy[contextID] = reason
+		} else {
+			delete(s.unhealthy, contextID)
+		}
+		s.Unlock()
+
+		if reason != "" && reason != previous {
+			zap.L().Warn("Remote enforcer is unhealthy",
+				zap.String("contextID", contextID),
+				zap.String("reason", reason),
+			)
+		} else if reason == "" && wasUnhealthy {
+			zap.L().Info("Remote enforcer is healthy again", zap.String("contextID", contextID))
+		}
+	}
+}
+
+// pollStatus checks the health of the remote enforcers periodically
+func (s *ProxyInfo) pollStatus(interval time.Duration, stop chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkStatus()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// UpdateSecrets replaces the secrets given to new remote enforcers and pushes
+// them to the remote enforcers that are already initialized. The remote
+// enforcers still accept the previous secrets for the overlap duration.
+func (s *ProxyInfo) UpdateSecrets(newSecrets secrets.Secrets, overlap time.Duration) error {
+
+	if newSecrets == nil {
+		return fmt.Errorf("Secrets can not be nil")
+	}
+
+	pem, ok := newSecrets.(keyPEM)
+	if !ok {
+		return fmt.Errorf("Secrets can not be sent to remote enforcers")
+	}
+
+	s.Lock()
+	if newSecrets.Type() != s.Secrets.Type() {
+		s.Unlock()
+		return fmt.Errorf("Secrets type can not change from %d to %d", s.Secrets.Type(), newSecrets.Type())
+	}
+	s.Secrets = newSecrets
+	contextIDs := make([]string, 0, len(s.initDone))
+	for contextID := range s.initDone {
+		contextIDs = append(contextIDs, contextID)
+	}
+	s.Unlock()
+
+	failed := []string{}
+	for _, contextID := range contextIDs {
+
+		payload := &rpcwrapper.UpdateSecretsPayload{
+			SecretType: newSecrets.Type(),
+			CAPEM:      pem.AuthPEM(),
+			PublicPEM:  pem.TransmittedPEM(),
+			PrivatePEM: pem.EncodingPEM(),
+			Overlap:    overlap,
+			Revocation: revocationConfig(newSecrets),
+			SPIFFE:     spiffeSocket(newSecrets),
+		}
+
+		if newSecrets.Type() == secrets.PKICompactType {
+			payload.Token = newSecrets.TransmittedKey()
+		}
+
+		resp := &rpcwrapper.Response{}
+		if err := s.rpchdl.RemoteCall(contextID, "Server.UpdateSecrets", &rpcwrapper.Request{Payload: payload}, resp); err != nil {
+			zap.L().Error("Failed to update secrets of remote enforcer",
+				zap.String("contextID", contextID),
+				zap.String("status", resp.Status),
+				zap.Error(err),
+			)
+			failed = append(failed, contextID)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to update secrets of remote enforcers: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// CurrentSecrets returns the secrets given to new remote enforcers
+func (s *ProxyInfo) CurrentSecrets() secrets.Secrets {
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.Secrets
+}
+
+// MutualAuthorization returns true if the remote enforcers validate the policy
+// of the receivers
+func (s *ProxyInfo) MutualAuthorization() bool {
+	return s.MutualAuth
+}
+
 // GetFilterQueue returns the current FilterQueueConfig.
 func (s *ProxyInfo) GetFilterQueue() *fqconfig.FilterQueue {
 	return s.filterQueue
 }
 
-// Start starts the the remote enforcer proxy.
+// Start starts the the remote enforcer proxy. It checks the health of the
+// remote enforcers periodically.
 func (s *ProxyInfo) Start() error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.statusInterval > 0 && s.stop == nil {
+		s.stop = make(chan struct{})
+		go s.pollStatus(s.statusInterval, s.stop)
+	}
+
 	return nil
 }
 
 // Stop stops the remote enforcer.
 func (s *ProxyInfo) Stop() error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+
 	return nil
 }
 
@@ -202,6 +543,10 @@ func NewProxyEnforcer(mutualAuth bool,
 		commandArg:        cmdArg,
 		statsServerSecret: statsServersecret,
 		procMountPoint:    procMountPoint,
+		statusInterval:    DefaultStatusInterval,
+		policyHashes:      make(map[string]string),
+		failurePolicies:   make(map[string]policy.FailurePolicy),
+		unhealthy:         make(map[string]string),
 	}
 
 	zap.L().Debug("Called NewDataPathEnforcer")
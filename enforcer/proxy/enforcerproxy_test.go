@@ -1,12 +1,15 @@
 package enforcerproxy
 
 import (
-	"crypto/ecdsa"
+	"errors"
 	"testing"
+	"time"
 
 	gomock "github.com/aporeto-inc/mock/gomock"
 	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/enforcer"
 	"github.com/aporeto-inc/trireme/enforcer/utils/fqconfig"
+	"github.com/aporeto-inc/trireme/enforcer/utils/rpcwrapper"
 	mockrpcwrapper "github.com/aporeto-inc/trireme/enforcer/utils/rpcwrapper/mock"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
 	"github.com/aporeto-inc/trireme/policy"
@@ -78,7 +81,7 @@ func secretGen(keyPEM, certPEM, caPool []byte) secrets.Secrets {
 		newSecret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
 		return newSecret
 	}
-	newSecret, _ := secrets.NewPKISecrets([]byte(keyPEM), []byte(certPEM), []byte(caPool), map[string]*ecdsa.PublicKey{})
+	newSecret, _ := secrets.NewPKISecrets([]byte(keyPEM), []byte(certPEM), []byte(caPool), map[string]interface{}{})
 	return newSecret
 }
 
@@ -231,6 +234,75 @@ func TestEnforce(t *testing.T) {
 	})
 }
 
+func TestEnforceAndSupervise(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("When I try to start a proxy enforcer with defaults", t, func() {
+		rpchdl := mockrpcwrapper.NewMockRPCClient(ctrl)
+		policyEnf := NewDefaultProxyEnforcer("testServerID", eventCollector(), secretGen(nil, nil, nil), rpchdl, procMountPoint).(*ProxyInfo)
+
+		Convey("When I enforce and supervise a PU whose remote enforcer is not initialized", func() {
+			err := policyEnf.EnforceAndSupervise("testServerID", createPUInfo())
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the remote enforcer is initialized", func() {
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.InitEnforcer", gomock.Any(), gomock.Any()).Times(1).Return(nil)
+			So(policyEnf.InitRemoteEnforcer("testServerID"), ShouldBeNil)
+
+			puInfo := createPUInfo()
+
+			Convey("When I enforce and supervise a PU", func() {
+				var payload *rpcwrapper.BatchPayload
+				rpchdl.EXPECT().RemoteCall("testServerID", "Server.Batch", gomock.Any(), gomock.Any()).Times(1).Do(func(contextID string, methodName string, req *rpcwrapper.Request, resp *rpcwrapper.Response) {
+					payload = req.Payload.(*rpcwrapper.BatchPayload)
+				}).Return(nil)
+
+				err := policyEnf.EnforceAndSupervise("testServerID", puInfo)
+
+				Convey("Then both requests should be sent in a single call", func() {
+					So(err, ShouldBeNil)
+					So(len(payload.Enforce), ShouldEqual, 1)
+					So(len(payload.Supervise), ShouldEqual, 1)
+					So(payload.Enforce[0].ContextID, ShouldEqual, "testServerID")
+					So(payload.Supervise[0].ManagementID, ShouldEqual, puInfo.Policy.ManagementID())
+					So(policyEnf.policyHashes["testServerID"], ShouldEqual, puInfo.Policy.Hash())
+				})
+			})
+
+			Convey("When the remote enforcer fails to supervise the PU", func() {
+				rpchdl.EXPECT().RemoteCall("testServerID", "Server.Batch", gomock.Any(), gomock.Any()).Times(1).Do(func(contextID string, methodName string, req *rpcwrapper.Request, resp *rpcwrapper.Response) {
+					resp.Payload = rpcwrapper.BatchResponsePayload{Errors: map[string]string{"testServerID": "Failed to supervise"}}
+				}).Return(nil)
+
+				err := policyEnf.EnforceAndSupervise("testServerID", puInfo)
+
+				Convey("Then I should get the error of the PU", func() {
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldContainSubstring, "Failed to supervise")
+					So(policyEnf.policyHashes, ShouldNotContainKey, "testServerID")
+				})
+			})
+
+			Convey("When the batch call fails", func() {
+				rpchdl.EXPECT().RemoteCall("testServerID", "Server.Batch", gomock.Any(), gomock.Any()).Times(1).Return(errors.New("connection refused"))
+
+				err := policyEnf.EnforceAndSupervise("testServerID", puInfo)
+
+				Convey("Then I should get the error of the call", func() {
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldContainSubstring, "connection refused")
+					So(policyEnf.policyHashes, ShouldNotContainKey, "testServerID")
+				})
+			})
+		})
+	})
+}
+
 func TestUnenforce(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -262,3 +334,149 @@ func TestUnenforce(t *testing.T) {
 		})
 	})
 }
+
+func TestUpdateSecrets(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("When I try to start a proxy enforcer with defaults", t, func() {
+		rpchdl := mockrpcwrapper.NewMockRPCClient(ctrl)
+		policyEnf := NewDefaultProxyEnforcer("testServerID", eventCollector(), secretGen(nil, nil, nil), rpchdl, procMountPoint)
+		psk := secrets.NewPSKSecrets([]byte("New Test Password"))
+
+		Convey("When I update the secrets before any remote enforcer is initiated", func() {
+			err := policyEnf.(*ProxyInfo).UpdateSecrets(psk, time.Minute)
+
+			Convey("Then I should not get any error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When I update the secrets of an initiated remote enforcer", func() {
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.InitEnforcer", gomock.Any(), gomock.Any()).Times(1).Return(nil)
+			err := policyEnf.(*ProxyInfo).InitRemoteEnforcer("testServerID")
+			So(err, ShouldBeNil)
+
+			var payload *rpcwrapper.UpdateSecretsPayload
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.UpdateSecrets", gomock.Any(), gomock.Any()).Times(1).Do(func(contextID string, methodName string, req *rpcwrapper.Request, resp *rpcwrapper.Response) {
+				payload = req.Payload.(*rpcwrapper.UpdateSecretsPayload)
+			}).Return(nil)
+			err = policyEnf.(*ProxyInfo).UpdateSecrets(psk, time.Minute)
+
+			Convey("Then the new key material should be sent to the remote enforcer", func() {
+				So(err, ShouldBeNil)
+				So(payload, ShouldNotBeNil)
+				So(payload.SecretType, ShouldEqual, secrets.PSKType)
+				So(payload.PrivatePEM, ShouldResemble, []byte("New Test Password"))
+				So(payload.Overlap, ShouldEqual, time.Minute)
+			})
+		})
+
+		Convey("When I update the secrets and the remote enforcer fails", func() {
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.InitEnforcer", gomock.Any(), gomock.Any()).Times(1).Return(nil)
+			err := policyEnf.(*ProxyInfo).InitRemoteEnforcer("testServerID")
+			So(err, ShouldBeNil)
+
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.UpdateSecrets", gomock.Any(), gomock.Any()).Times(1).Return(errors.New("error"))
+			err = policyEnf.(*ProxyInfo).UpdateSecrets(psk, time.Minute)
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I update the secrets with another type", func() {
+			null, _ := secrets.NewNullPKI(nil, nil, nil)
+			err := policyEnf.(*ProxyInfo).UpdateSecrets(null, time.Minute)
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a proxy enforcer with an enforced remote enforcer", t, func() {
+		rpchdl := mockrpcwrapper.NewMockRPCClient(ctrl)
+		policyEnf := NewDefaultProxyEnforcer("testServerID", eventCollector(), secretGen(nil, nil, nil), rpchdl, procMountPoint).(*ProxyInfo)
+
+		puInfo := createPUInfo()
+		rpchdl.EXPECT().NewRPCClient("testServerID", "/var/run/testServerID.sock", gomock.Any()).AnyTimes()
+		rpchdl.EXPECT().RemoteCall("testServerID", "Server.InitEnforcer", gomock.Any(), gomock.Any()).Times(1).Return(nil)
+		rpchdl.EXPECT().RemoteCall("testServerID", "Server.Enforce", gomock.Any(), gomock.Any()).Times(1).Return(nil)
+		So(policyEnf.Enforce("testServerID", puInfo), ShouldBeNil)
+
+		status := &enforcer.Status{
+			Healthy:  true,
+			Policies: map[string]string{"testServerID": puInfo.Policy.Hash()},
+		}
+		reportStatus := func(contextID string, methodName string, req *rpcwrapper.Request, resp *rpcwrapper.Response) {
+			resp.Payload = rpcwrapper.StatusResponsePayload{Status: status}
+		}
+
+		Convey("When I ping the remote enforcer", func() {
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.Ping", gomock.Any(), gomock.Any()).Times(1).Return(nil)
+
+			Convey("Then I should not get any error", func() {
+				So(policyEnf.Ping("testServerID"), ShouldBeNil)
+			})
+		})
+
+		Convey("When I get the status of the remote enforcer", func() {
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.Status", gomock.Any(), gomock.Any()).Times(1).Do(reportStatus).Return(nil)
+			reported, err := policyEnf.Status("testServerID")
+
+			Convey("Then I should get its status", func() {
+				So(err, ShouldBeNil)
+				So(reported, ShouldResemble, status)
+			})
+		})
+
+		Convey("When the remote enforcer is healthy and has the last policy", func() {
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.Status", gomock.Any(), gomock.Any()).Times(1).Do(reportStatus).Return(nil)
+			policyEnf.checkStatus()
+
+			Convey("Then it should not be flagged", func() {
+				So(policyEnf.Unhealthy(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the remote enforcer has another policy", func() {
+			status.Policies["testServerID"] = "other"
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.Status", gomock.Any(), gomock.Any()).Times(1).Do(reportStatus).Return(nil)
+			policyEnf.checkStatus()
+
+			Convey("Then it should be flagged", func() {
+				So(policyEnf.Unhealthy(), ShouldContainKey, "testServerID")
+			})
+		})
+
+		Convey("When the remote enforcer does not respond", func() {
+			rpchdl.EXPECT().RemoteCall("testServerID", "Server.Status", gomock.Any(), gomock.Any()).Times(1).Return(errors.New("error"))
+			policyEnf.checkStatus()
+
+			Convey("Then it should be flagged until it recovers", func() {
+				So(policyEnf.Unhealthy(), ShouldContainKey, "testServerID")
+
+				status.Healthy = false
+				rpchdl.EXPECT().RemoteCall("testServerID", "Server.Status", gomock.Any(), gomock.Any()).Times(1).Do(reportStatus).Return(nil)
+				policyEnf.checkStatus()
+				So(policyEnf.Unhealthy()["testServerID"], ShouldEqual, "Queues are failing")
+
+				status.Healthy = true
+				rpchdl.EXPECT().RemoteCall("testServerID", "Server.Status", gomock.Any(), gomock.Any()).Times(1).Do(reportStatus).Return(nil)
+				policyEnf.checkStatus()
+				So(policyEnf.Unhealthy(), ShouldBeEmpty)
+			})
+
+			Convey("Then it should not be flagged anymore once unenforced", func() {
+				So(policyEnf.Unenforce("testServerID"), ShouldBeNil)
+				So(policyEnf.Unhealthy(), ShouldBeEmpty)
+			})
+		})
+	})
+}
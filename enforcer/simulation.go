@@ -0,0 +1,220 @@
+package enforcer
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/enforcer/acls"
+	"github.com/aporeto-inc/trireme/enforcer/lookup"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// FlowSimulation is the result of the evaluation of a simulated flow
+type FlowSimulation struct {
+	// Action is collector.FlowAccept or collector.FlowReject
+	Action string
+	// Policy is the policy that matched the flow, if any
+	Policy *policy.FlowPolicy
+	// DropReason is the reason the flow was rejected as reported by the collector
+	DropReason string
+	// Trace contains the clauses of the matched policy that were satisfied by the claims
+	Trace []string
+}
+
+// SimulationEndpoint is the source or the destination of a simulated flow. It
+// is either a PU with its policy or an external service with its IP address.
+type SimulationEndpoint struct {
+	PU *policy.PUInfo
+	IP net.IP
+}
+
+// SimulateFlow evaluates the policy of a connection from source to destination
+// on the given port without processing any packets. The source and destination
+// are either contextIDs of PUs enforced by this datapath or IP addresses of
+// external services. The flow goes through the same rules and ACLs as a TCP
+// connection going through the datapath.
+func (d *Datapath) SimulateFlow(source, destination string, port uint16) (*FlowSimulation, error) {
+
+	srcContext, srcIP, err := d.simulationEndpoint(source)
+	if err != nil {
+		return nil, err
+	}
+
+	dstContext, dstIP, err := d.simulationEndpoint(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	return simulateFlow(srcContext, srcIP, dstContext, dstIP, port, d.mutualAuthorization)
+}
+
+// SimulatePolicyFlow evaluates the policy of a connection from source to
+// destination on the given port with the policies of the PUs, without any
+// enforcer. The PUs can be enforced by different enforcers. The transmitter
+// validates the policy of the receiver if mutualAuthorization is set, as the
+// enforcer of the source does.
+func SimulatePolicyFlow(source, destination *SimulationEndpoint, port uint16, mutualAuthorization bool) (*FlowSimulation, error) {
+
+	srcContext, err := simulationContext(source)
+	if err != nil {
+		return nil, err
+	}
+
+	dstContext, err := simulationContext(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	return simulateFlow(srcContext, source.IP, dstContext, destination.IP, port, mutualAuthorization)
+}
+
+// simulationContext returns a context with the policy of the PU of an
+// endpoint, or nil for an external service
+func simulationContext(endpoint *SimulationEndpoint) (*PUContext, error) {
+
+	if endpoint.PU == nil {
+		return nil, nil
+	}
+
+	context := &PUContext{
+		ID:           endpoint.PU.ContextID,
+		ManagementID: endpoint.PU.Policy.ManagementID(),
+		PUType:       endpoint.PU.Runtime.PUType(),
+	}
+
+	if err := updatePUContext(context, endpoint.PU, lookup.NewPolicyDB); err != nil {
+		return nil, fmt.Errorf("Invalid policy for PU %s: %s", endpoint.PU.ContextID, err)
+	}
+
+	return context, nil
+}
+
+// simulateFlow evaluates a flow between PU contexts or external services
+func simulateFlow(srcContext *PUContext, srcIP net.IP, dstContext *PUContext, dstIP net.IP, port uint16, mutualAuthorization bool) (*FlowSimulation, error) {
+
+	switch {
+	case srcContext != nil && dstContext != nil:
+		return simulatePUFlow(srcContext, dstContext, port, mutualAuthorization), nil
+	case srcContext != nil:
+		return simulateACLFlow(srcContext, srcContext.ApplicationACLs, dstIP, port), nil
+	case dstContext != nil:
+		return simulateACLFlow(dstContext, dstContext.NetworkACLS, srcIP, port), nil
+	default:
+		return nil, fmt.Errorf("Source %s or destination %s must be a PU", srcIP, dstIP)
+	}
+}
+
+// simulationEndpoint returns the context of a PU or the IP address of an external service
+func (d *Datapath) simulationEndpoint(endpoint string) (*PUContext, net.IP, error) {
+
+	if context, err := d.contextTracker.Get(endpoint); err == nil {
+		return context.(*PUContext), nil, nil
+	}
+
+	if ip := net.ParseIP(endpoint); ip != nil {
+		return nil, ip, nil
+	}
+
+	return nil, nil, fmt.Errorf("Endpoint %s is neither a PU nor an IP address", endpoint)
+}
+
+// simulatePUFlow evaluates the policies of both PUs for the claims they exchange
+// in the Syn and SynAck packets
+func simulatePUFlow(src, dst *PUContext, port uint16, mutualAuthorization bool) *FlowSimulation {
+
+	// The claims of the Syn packet as they are seen by the receiver
+	src.Lock()
+	synClaims := src.Identity.Copy()
+	offersEncryption := src.encryption
+	src.Unlock()
+
+	synClaims.AppendKeyValue(PortNumberLabelString, strconv.Itoa(int(port)))
+
+	dst.Lock()
+	synAckClaims := dst.Identity.Copy()
+	rejectIndex, rejectAction, rejectTrace := dst.RejectRcvRules.SearchWithTrace(synClaims)
+	acceptIndex, acceptAction, acceptTrace := dst.AcceptRcvRules.SearchWithTrace(synClaims)
+	dst.Unlock()
+
+	// Reject rules are always processed with higher priority
+	if rejectIndex >= 0 {
+		return rejectedSimulation(collector.PolicyDrop, rejectAction.(*policy.FlowPolicy), rejectTrace)
+	}
+
+	if acceptIndex < 0 {
+		return rejectedSimulation(collector.PolicyDrop, nil, nil)
+	}
+
+	flowPolicy := acceptAction.(*policy.FlowPolicy)
+
+	if flowPolicy.Action.Encrypted() && !offersEncryption {
+		return rejectedSimulation(collector.EncryptionMismatch, flowPolicy, acceptTrace)
+	}
+
+	// The transmitter validates the claims of the SynAck packet
+	src.Lock()
+	txRejectIndex, _, txRejectTrace := src.RejectTxtRules.SearchWithTrace(synAckClaims)
+	txAcceptIndex, txAcceptAction, txAcceptTrace := src.AcceptTxtRules.SearchWithTrace(synAckClaims)
+	src.Unlock()
+
+	if mutualAuthorization {
+		if txRejectIndex >= 0 {
+			return rejectedSimulation(collector.PolicyDrop, nil, txRejectTrace)
+		}
+
+		if txAcceptIndex < 0 {
+			return rejectedSimulation(collector.PolicyDrop, nil, nil)
+		}
+	}
+
+	// The receiver answers with an ephemeral key only if its policy requires encryption
+	if !flowPolicy.Action.Encrypted() && txAcceptIndex >= 0 && txAcceptAction.(*policy.FlowPolicy).Action.Encrypted() {
+		return rejectedSimulation(collector.EncryptionMismatch, nil, txAcceptTrace)
+	}
+
+	return &FlowSimulation{
+		Action: collector.FlowAccept,
+		Policy: flowPolicy,
+		Trace:  acceptTrace,
+	}
+}
+
+// simulateACLFlow evaluates the ACLs of a PU for a flow with an external service
+func simulateACLFlow(context *PUContext, aclCache *acls.ACLCache, ip net.IP, port uint16) *FlowSimulation {
+
+	context.Lock()
+	plc, err := aclCache.GetMatchingAction(ip, port)
+	context.Unlock()
+
+	if err != nil {
+		return rejectedSimulation(collector.PolicyDrop, nil, nil)
+	}
+
+	if plc.Action&policy.Reject > 0 {
+		return rejectedSimulation(collector.PolicyDrop, plc, nil)
+	}
+
+	return &FlowSimulation{
+		Action: collector.FlowAccept,
+		Policy: plc,
+	}
+}
+
+// rejectedSimulation returns the result of a simulated flow that was rejected
+func rejectedSimulation(reason string, plc *policy.FlowPolicy, trace []string) *FlowSimulation {
+
+	if plc == nil {
+		plc = &policy.FlowPolicy{
+			Action: policy.Reject,
+		}
+	}
+
+	return &FlowSimulation{
+		Action:     collector.FlowReject,
+		Policy:     plc,
+		DropReason: reason,
+		Trace:      trace,
+	}
+}
@@ -0,0 +1,193 @@
+package enforcer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func acceptTransmitter(value string, action policy.ActionType, policyID string) policy.TagSelector {
+
+	return policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{
+				Key:      TransmitterLabel,
+				Value:    []string{value},
+				Operator: policy.Equal,
+			},
+		},
+		Policy: &policy.FlowPolicy{Action: action, PolicyID: policyID},
+	}
+}
+
+func simulationPU(contextID string, ip string, rxRules, txRules policy.TagSelectorList, appACLs, netACLs policy.IPRuleList) *policy.PUInfo {
+
+	identity := policy.NewTagStore()
+	identity.AppendKeyValue(TransmitterLabel, contextID)
+
+	puPolicy := policy.NewPUPolicy(contextID, policy.Police, appACLs, netACLs, txRules, rxRules, identity, nil, nil, []string{}, []string{})
+	puInfo := policy.PUInfoFromPolicyAndRuntime(contextID, puPolicy, policy.NewPURuntimeWithDefaults())
+	puInfo.Runtime.SetIPAddresses(policy.ExtendedMap{policy.DefaultNamespace: ip})
+
+	return puInfo
+}
+
+func TestSimulateFlow(t *testing.T) {
+
+	Convey("Given an enforcer with a client and a server PU", t, func() {
+
+		secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+		enforcer := NewWithDefaults("SomeServerId", &collector.DefaultCollector{}, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+
+		portRule := policy.TagSelector{
+			Clause: []policy.KeyValueOperator{
+				{
+					Key:      PortNumberLabelString,
+					Value:    []string{"443"},
+					Operator: policy.Equal,
+				},
+			},
+			Policy: &policy.FlowPolicy{Action: policy.Reject, PolicyID: "reject-https"},
+		}
+
+		client := simulationPU("client", "10.1.1.1",
+			nil,
+			policy.TagSelectorList{acceptTransmitter("server", policy.Accept, "tx-server")},
+			policy.IPRuleList{
+				{Address: "192.168.0.0/16", Port: "80", Protocol: "TCP", Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "app-acl"}},
+			},
+			nil,
+		)
+
+		server := simulationPU("server", "10.1.1.2",
+			policy.TagSelectorList{
+				acceptTransmitter("client", policy.Accept, "rx-client"),
+				acceptTransmitter("secure", policy.Accept|policy.Encrypt, "rx-secure"),
+				portRule,
+			},
+			nil,
+			nil,
+			policy.IPRuleList{
+				{Address: "172.16.0.0/12", Port: "80", Protocol: "TCP", Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "net-acl"}},
+			},
+		)
+
+		secure := simulationPU("secure", "10.1.1.3", nil, nil, nil, nil)
+
+		So(enforcer.Enforce("client", client), ShouldBeNil)
+		So(enforcer.Enforce("server", server), ShouldBeNil)
+		So(enforcer.Enforce("secure", secure), ShouldBeNil)
+
+		Convey("A flow that matches an accept rule of the receiver should be accepted", func() {
+			result, err := enforcer.SimulateFlow("client", "server", 80)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowAccept)
+			So(result.Policy.PolicyID, ShouldEqual, "rx-client")
+			So(result.DropReason, ShouldBeEmpty)
+			So(result.Trace, ShouldResemble, []string{TransmitterLabel + "=client"})
+		})
+
+		Convey("A flow evaluated from the policies of the PUs should get the same result", func() {
+			result, err := SimulatePolicyFlow(&SimulationEndpoint{PU: client}, &SimulationEndpoint{PU: server}, 80, false)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowAccept)
+			So(result.Policy.PolicyID, ShouldEqual, "rx-client")
+
+			result, err = SimulatePolicyFlow(&SimulationEndpoint{PU: client}, &SimulationEndpoint{IP: net.ParseIP("192.168.1.1")}, 80, false)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowAccept)
+			So(result.Policy.PolicyID, ShouldEqual, "app-acl")
+
+			_, err = SimulatePolicyFlow(&SimulationEndpoint{IP: net.ParseIP("192.168.1.1")}, &SimulationEndpoint{IP: net.ParseIP("192.168.1.2")}, 80, false)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A flow that matches a reject rule on the port should be rejected", func() {
+			result, err := enforcer.SimulateFlow("client", "server", 443)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowReject)
+			So(result.Policy.PolicyID, ShouldEqual, "reject-https")
+			So(result.DropReason, ShouldEqual, collector.PolicyDrop)
+			So(result.Trace, ShouldResemble, []string{PortNumberLabelString + "=443"})
+		})
+
+		Convey("A flow that matches no rule of the receiver should be rejected", func() {
+			result, err := enforcer.SimulateFlow("server", "client", 80)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowReject)
+			So(result.Policy.Action, ShouldEqual, policy.Reject)
+			So(result.DropReason, ShouldEqual, collector.PolicyDrop)
+		})
+
+		Convey("A flow that requires encryption from a PU that does not offer it should be rejected", func() {
+			result, err := enforcer.SimulateFlow("secure", "server", 80)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowReject)
+			So(result.Policy.PolicyID, ShouldEqual, "rx-secure")
+			So(result.DropReason, ShouldEqual, collector.EncryptionMismatch)
+		})
+
+		Convey("With mutual authorization, the transmitter rules should be validated", func() {
+			enforcer.mutualAuthorization = true
+
+			result, err := enforcer.SimulateFlow("client", "server", 80)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowAccept)
+
+			server.Policy.AddTransmitterRules(policy.TagSelector{
+				Clause: []policy.KeyValueOperator{
+					{
+						Key:      TransmitterLabel,
+						Operator: policy.KeyExists,
+					},
+				},
+				Policy: &policy.FlowPolicy{Action: policy.Accept},
+			})
+			So(enforcer.Enforce("server", server), ShouldBeNil)
+
+			client.Policy = policy.NewPUPolicy("client", policy.Police, nil, nil, nil, nil, client.Policy.Identity(), nil, nil, []string{}, []string{})
+			So(enforcer.Enforce("client", client), ShouldBeNil)
+
+			result, err = enforcer.SimulateFlow("client", "server", 80)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowReject)
+			So(result.DropReason, ShouldEqual, collector.PolicyDrop)
+		})
+
+		Convey("A flow to an external service should be evaluated against the application ACLs", func() {
+			result, err := enforcer.SimulateFlow("client", "192.168.1.1", 80)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowAccept)
+			So(result.Policy.PolicyID, ShouldEqual, "app-acl")
+
+			result, err = enforcer.SimulateFlow("client", "8.8.8.8", 80)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowReject)
+			So(result.DropReason, ShouldEqual, collector.PolicyDrop)
+		})
+
+		Convey("A flow from an external service should be evaluated against the network ACLs", func() {
+			result, err := enforcer.SimulateFlow("172.16.1.1", "server", 80)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowAccept)
+			So(result.Policy.PolicyID, ShouldEqual, "net-acl")
+
+			result, err = enforcer.SimulateFlow("172.16.1.1", "server", 22)
+			So(err, ShouldBeNil)
+			So(result.Action, ShouldEqual, collector.FlowReject)
+		})
+
+		Convey("A flow between unknown endpoints should fail", func() {
+			_, err := enforcer.SimulateFlow("unknown", "server", 80)
+			So(err, ShouldNotBeNil)
+
+			_, err = enforcer.SimulateFlow("10.0.0.1", "10.0.0.2", 80)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
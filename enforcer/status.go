@@ -0,0 +1,109 @@
+package enforcer
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// QueueStatus is the health of the queues of one direction of the datapath
+type QueueStatus struct {
+	Queues     uint16    `json:",omitempty"`
+	Accepted   uint64    `json:",omitempty"`
+	Dropped    uint64    `json:",omitempty"`
+	Errors     uint64    `json:",omitempty"`
+	LastPacket time.Time `json:",omitempty"`
+	LastError  time.Time `json:",omitempty"`
+	// Stalls is the number of times the watchdog found a queue stalled
+	Stalls uint64 `json:",omitempty"`
+	// Stalled and Stopped are the number of queues that are stalled, and
+	// that were stopped by the watchdog to accept their packets
+	Stalled uint16 `json:",omitempty"`
+	Stopped uint16 `json:",omitempty"`
+}
+
+// healthy returns false if some queues are stalled or stopped, or if the
+// queues reported an error and did not process any packet since
+func (q *QueueStatus) healthy() bool {
+
+	if q.Stalled > 0 || q.Stopped > 0 {
+		return false
+	}
+
+	return q.LastError.IsZero() || q.LastError.Before(q.LastPacket)
+}
+
+// Status is the health of an enforcer
+type Status struct {
+	Healthy     bool          `json:",omitempty"`
+	Started     time.Time     `json:",omitempty"`
+	Uptime      time.Duration `json:",omitempty"`
+	Network     QueueStatus   `json:",omitempty"`
+	Application QueueStatus   `json:",omitempty"`
+	// Caches are the number of entries of the caches of the datapath
+	Caches map[string]int `json:",omitempty"`
+	// Policies are the hashes of the policies enforced, by context ID
+	Policies map[string]string `json:",omitempty"`
+}
+
+// Status returns the health of the datapath. It is healthy once started, as
+// long as its queues are not stalled and keep processing packets after errors.
+func (d *Datapath) Status() (*Status, error) {
+
+	started := atomic.LoadInt64(&d.started)
+	if started == 0 {
+		return nil, fmt.Errorf("Enforcer is not started")
+	}
+
+	status := &Status{
+		Started:     time.Unix(0, started),
+		Network:     d.netVerdicts.status(d.filterQueue.GetNumNetworkQueues(), d.netWatch),
+		Application: d.appVerdicts.status(d.filterQueue.GetNumApplicationQueues(), d.appWatch),
+		Caches:      map[string]int{},
+		Policies:    map[string]string{},
+	}
+
+	status.Uptime = time.Since(status.Started)
+	status.Healthy = status.Network.healthy() && status.Application.healthy()
+
+	for name, size := range d.cacheSizes() {
+		status.Caches[name] = int(size)
+	}
+
+	for _, contextID := range d.contextTracker.KeyList() {
+		item, err := d.contextTracker.Get(contextID)
+		if err != nil {
+			continue
+		}
+		pu := item.(*PUContext)
+		pu.Lock()
+		status.Policies[pu.ID] = pu.policyHash
+		pu.Unlock()
+	}
+
+	return status, nil
+}
+
+// status returns the counters of the queues and their state in the watch
+func (v *verdictCounters) status(queues uint16, watch *queueWatch) QueueStatus {
+
+	status := QueueStatus{
+		Queues:   queues,
+		Accepted: atomic.LoadUint64(&v.accepted),
+		Dropped:  atomic.LoadUint64(&v.dropped),
+		Errors:   atomic.LoadUint64(&v.errors),
+	}
+
+	if last := atomic.LoadInt64(&v.lastPacket); last != 0 {
+		status.LastPacket = time.Unix(0, last)
+	}
+
+	if last := atomic.LoadInt64(&v.lastError); last != 0 {
+		status.LastError = time.Unix(0, last)
+	}
+
+	status.Stalls = atomic.LoadUint64(&watch.stalls)
+	status.Stalled, status.Stopped = watch.counts()
+
+	return status
+}
@@ -0,0 +1,66 @@
+package enforcer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDatapathStatus(t *testing.T) {
+
+	Convey("Given an enforcer with a PU", t, func() {
+
+		secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+		enforcer := NewWithDefaults("SomeServerId", &collector.DefaultCollector{}, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+
+		puInfo := policy.NewPUInfo("status-pu", constants.ContainerPU)
+		puInfo.Runtime.SetIPAddresses(policy.ExtendedMap{policy.DefaultNamespace: "10.1.1.1"})
+		So(enforcer.Enforce("status-pu", puInfo), ShouldBeNil)
+
+		Convey("When the enforcer is not started, I should get an error", func() {
+			_, err := enforcer.Status()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When the enforcer is started", func() {
+			atomic.StoreInt64(&enforcer.started, time.Now().Add(-time.Minute).UnixNano())
+			enforcer.netVerdicts.accept()
+			enforcer.netVerdicts.drop()
+
+			status, err := enforcer.Status()
+
+			Convey("I should get the queues, the caches and the policies", func() {
+				So(err, ShouldBeNil)
+				So(status.Healthy, ShouldBeTrue)
+				So(status.Uptime, ShouldBeGreaterThanOrEqualTo, time.Minute)
+				So(status.Network.Queues, ShouldEqual, enforcer.filterQueue.GetNumNetworkQueues())
+				So(status.Network.Accepted, ShouldEqual, 1)
+				So(status.Network.Dropped, ShouldEqual, 1)
+				So(status.Caches["context"], ShouldEqual, 1)
+				So(status.Policies["status-pu"], ShouldEqual, puInfo.Policy.Hash())
+			})
+
+			Convey("When a queue fails and does not process packets anymore, it should be unhealthy", func() {
+				enforcer.appVerdicts.fail()
+
+				status, err := enforcer.Status()
+				So(err, ShouldBeNil)
+				So(status.Healthy, ShouldBeFalse)
+				So(status.Application.Errors, ShouldEqual, 1)
+
+				time.Sleep(time.Millisecond)
+				enforcer.appVerdicts.accept()
+
+				status, err = enforcer.Status()
+				So(err, ShouldBeNil)
+				So(status.Healthy, ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -1,13 +1,17 @@
 package enforcer
 
 import (
+	"time"
+
 	"github.com/aporeto-inc/trireme/collector"
 	"github.com/aporeto-inc/trireme/enforcer/lookup"
 	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
+	"github.com/aporeto-inc/trireme/enforcer/utils/replay"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
 	"github.com/aporeto-inc/trireme/policy"
 )
 
-func (d *Datapath) reportFlow(p *packet.Packet, connection *TCPConnection, sourceID string, destID string, context *PUContext, mode string, plc *policy.FlowPolicy) {
+func (d *Datapath) reportFlow(p *packet.Packet, connection *TCPConnection, sourceID string, destID string, context *PUContext, mode string, plc *policy.FlowPolicy, trace []string) {
 
 	c := &collector.FlowRecord{
 		ContextID: context.ID,
@@ -23,23 +27,41 @@ func (d *Datapath) reportFlow(p *packet.Packet, connection *TCPConnection, sourc
 			Port: p.DestinationPort,
 			Type: collector.PU,
 		},
-		Tags:       context.Annotations,
-		Action:     plc.Action,
-		DropReason: mode,
+		Tags:        context.Annotations,
+		Action:      plc.Action,
+		DropReason:  mode,
+		PolicyID:    plc.PolicyID,
+		PolicyTrace: trace,
+		Protocol:    p.IPProto,
+	}
+
+	if connection != nil {
+		c.FirstSeen = connection.firstSeen
+		c.LastSeen = connection.lastSeen
+
+		// Keep a copy of the record, since collectors may modify it, to
+		// report the final record when the conntrack entry is destroyed
+		if plc.Action.Accepted() {
+			accepted := *c
+			d.acceptedFlows.AddOrUpdate(acceptedFlowTuple(&accepted), &accepted)
+		}
+	} else {
+		c.FirstSeen = time.Now()
+		c.LastSeen = c.FirstSeen
 	}
 
 	d.collector.CollectFlowEvent(c)
 
 }
 
-func (d *Datapath) reportAcceptedFlow(p *packet.Packet, conn *TCPConnection, sourceID string, destID string, context *PUContext, plc *policy.FlowPolicy) {
+func (d *Datapath) reportAcceptedFlow(p *packet.Packet, conn *TCPConnection, sourceID string, destID string, context *PUContext, plc *policy.FlowPolicy, trace []string) {
 	if conn != nil {
 		conn.SetReported(RejectReported)
 	}
-	d.reportFlow(p, conn, sourceID, destID, context, "NA", plc)
+	d.reportFlow(p, conn, sourceID, destID, context, "NA", plc, trace)
 }
 
-func (d *Datapath) reportRejectedFlow(p *packet.Packet, conn *TCPConnection, sourceID string, destID string, context *PUContext, mode string, plc *policy.FlowPolicy) {
+func (d *Datapath) reportRejectedFlow(p *packet.Packet, conn *TCPConnection, sourceID string, destID string, context *PUContext, mode string, plc *policy.FlowPolicy, trace []string) {
 	if conn != nil {
 		conn.SetReported(AcceptReported)
 	}
@@ -50,7 +72,36 @@ func (d *Datapath) reportRejectedFlow(p *packet.Packet, conn *TCPConnection, sou
 		}
 	}
 
-	d.reportFlow(p, conn, sourceID, destID, context, mode, plc)
+	if context.monitored {
+		plc = auditedPolicy(plc)
+	}
+
+	d.reportFlow(p, conn, sourceID, destID, context, mode, plc, trace)
+}
+
+// isMonitored returns true if the PU only reports the flows its policy rejects
+func (p *PUContext) isMonitored() bool {
+
+	p.Lock()
+	defer p.Unlock()
+
+	return p.monitored
+}
+
+// auditPolicy is the policy of the flows that a monitored PU accepts, although
+// its policy would reject them
+var auditPolicy = &policy.FlowPolicy{
+	Action: policy.Accept | policy.Audit,
+}
+
+// auditedPolicy returns the policy reported for a flow that the policy rejects,
+// but that a monitored PU accepts
+func auditedPolicy(plc *policy.FlowPolicy) *policy.FlowPolicy {
+
+	audited := *plc
+	audited.Action = plc.Action&^policy.Accept | policy.Reject | policy.Audit
+
+	return &audited
 }
 
 func (d *Datapath) reportExternalServiceFlow(context *PUContext, flowpolicy *policy.FlowPolicy, app bool, p *packet.Packet) {
@@ -71,6 +122,10 @@ func (d *Datapath) reportExternalServiceFlow(context *PUContext, flowpolicy *pol
 		}
 	}
 
+	if context.monitored && flowpolicy.Action.Rejected() {
+		flowpolicy = auditedPolicy(flowpolicy)
+	}
+
 	if app {
 		src.ID = context.ManagementID
 		src.Type = collector.PU
@@ -91,8 +146,12 @@ func (d *Datapath) reportExternalServiceFlow(context *PUContext, flowpolicy *pol
 		Action:      flowpolicy.Action,
 		Tags:        context.Annotations,
 		PolicyID:    flowpolicy.PolicyID,
+		Protocol:    p.IPProto,
 	}
 
+	record.FirstSeen = time.Now()
+	record.LastSeen = record.FirstSeen
+
 	d.collector.CollectFlowEvent(record)
 }
 
@@ -114,6 +173,10 @@ func (d *Datapath) reportReverseExternalServiceFlow(context *PUContext, flowpoli
 		}
 	}
 
+	if context.monitored && flowpolicy.Action.Rejected() {
+		flowpolicy = auditedPolicy(flowpolicy)
+	}
+
 	if app {
 		src.ID = context.ManagementID
 		src.Type = collector.PU
@@ -134,16 +197,34 @@ func (d *Datapath) reportReverseExternalServiceFlow(context *PUContext, flowpoli
 		Action:      flowpolicy.Action,
 		Tags:        context.Annotations,
 		PolicyID:    flowpolicy.PolicyID,
+		Protocol:    p.IPProto,
 	}
 
+	record.FirstSeen = time.Now()
+	record.LastSeen = record.FirstSeen
+
 	d.collector.CollectFlowEvent(record)
 }
 
-// createRuleDBs creates the database of rules from the policy
-func createRuleDBs(policyRules policy.TagSelectorList) (*lookup.PolicyDB, *lookup.PolicyDB) {
+// tokenDropReason returns the drop reason of a flow whose token was rejected
+func tokenDropReason(err error, reason string) string {
+
+	switch err {
+	case revocation.ErrRevoked:
+		return collector.RevokedCertificate
+	case replay.ErrReplayed, replay.ErrOutsideWindow:
+		return collector.ReplayedToken
+	}
+
+	return reason
+}
+
+// createRuleDBs creates the database of rules from the policy with the given
+// PolicyDB constructor
+func createRuleDBs(policyRules policy.TagSelectorList, newPolicyDB func() lookup.PolicyDB) (lookup.PolicyDB, lookup.PolicyDB) {
 
-	acceptRules := lookup.NewPolicyDB()
-	rejectRules := lookup.NewPolicyDB()
+	acceptRules := newPolicyDB()
+	rejectRules := newPolicyDB()
 
 	for _, rule := range policyRules {
 		if rule.Policy.Action&policy.Accept != 0 {
@@ -156,3 +237,15 @@ func createRuleDBs(policyRules policy.TagSelectorList) (*lookup.PolicyDB, *looku
 	}
 	return acceptRules, rejectRules
 }
+
+// encryptionRequired returns true if any of the accept rules requires encryption
+func encryptionRequired(policyRules policy.TagSelectorList) bool {
+
+	for _, rule := range policyRules {
+		if rule.Policy.Action&policy.Accept != 0 && rule.Policy.Action.Encrypted() {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,6 +1,9 @@
 package fqconfig
 
-import "strconv"
+import (
+	"strconv"
+	"time"
+)
 
 // FilterQueue captures all the configuration parameters of the NFQUEUEs
 type FilterQueue struct {
@@ -36,6 +39,12 @@ type FilterQueue struct {
 	ApplicationQueuesSvcStr string
 	// ApplicationQueuesSynAckStr is the queue string for application synack packets
 	ApplicationQueuesSynAckStr string
+	// FailOpen specifies if the packets are accepted when the queues can not
+	// process them. It is the default of the PUs without a failure policy
+	FailOpen bool
+	// WatchdogTimeout is how long a queue may process a packet before it is
+	// considered stalled. The queues are not watched if 0
+	WatchdogTimeout time.Duration
 }
 
 // NewFilterQueueWithDefaults return a default filter queue config
@@ -59,6 +68,7 @@ func NewFilterQueue(queueSeparation bool, MarkValue int, QueueStart, NumberOfNet
 		MarkValue:            MarkValue,
 		NetworkQueueSize:     NetworkQueueSize,
 		ApplicationQueueSize: ApplicationQueueSize,
+		WatchdogTimeout:      DefaultWatchdogTimeout,
 	}
 
 	if queueSeparation {
@@ -187,4 +197,7 @@ const (
 	DefaultQueueSize = 500
 	// DefaultMarkValue is the default Mark for packets in the raw chain
 	DefaultMarkValue = 0x1111
+	// DefaultWatchdogTimeout is the default time after which a queue that is
+	// processing a packet is considered stalled
+	DefaultWatchdogTimeout = 10 * time.Second
 )
@@ -13,6 +13,8 @@ func TestFqDefaultConfig(t *testing.T) {
 		Convey("Then I should see a config", func() {
 
 			So(fqc, ShouldNotBeNil)
+			So(fqc.FailOpen, ShouldBeFalse)
+			So(fqc.WatchdogTimeout, ShouldEqual, DefaultWatchdogTimeout)
 
 			So(fqc.GetMarkValue(), ShouldEqual, DefaultMarkValue)
 
@@ -4,10 +4,31 @@ const (
 	// minIPPacketLen is the min ip packet size
 	minIPPacketLen = 40
 
+	// minUDPPacketLen is the min ip packet size for UDP packets
+	minUDPPacketLen = 28
+
 	// minIPHdrSize
 	minIPHdrSize = 20
 
 	minIPHdrWords = (minIPHdrSize / 4)
+
+	// minIPv6PacketLen is the min ipv6 packet size
+	minIPv6PacketLen = 60
+
+	// minUDPv6PacketLen is the min ipv6 packet size for UDP packets
+	minUDPv6PacketLen = 48
+
+	// ipv6HdrSize is the size of the fixed IPv6 header
+	ipv6HdrSize = 40
+)
+
+// IP versions
+const (
+	// IPVersion4 is the version of IPv4 packets
+	IPVersion4 = 4
+
+	// IPVersion6 is the version of IPv6 packets
+	IPVersion6 = 6
 )
 
 // IP Header field position constants
@@ -15,6 +36,9 @@ const (
 	// ipHdrLenPos is location of IP (entire packet) length
 	ipHdrLenPos = 0
 
+	// ipVersionPos is the location of the IP version
+	ipVersionPos = 0
+
 	// ipLengthPos is location of IP (entire packet) length
 	ipLengthPos = 2
 
@@ -34,6 +58,21 @@ const (
 	ipDestAddrPos = 16
 )
 
+// IPv6 Header field position constants
+const (
+	// ipv6PayloadLengthPos is the location of the IPv6 payload length
+	ipv6PayloadLengthPos = 4
+
+	// ipv6NextHeaderPos is the location of the IPv6 next header
+	ipv6NextHeaderPos = 6
+
+	// ipv6SourceAddrPos is location of source IPv6 address
+	ipv6SourceAddrPos = 8
+
+	// ipv6DestAddrPos is location of destination IPv6 address
+	ipv6DestAddrPos = 24
+)
+
 // IP Protocol numbers
 const (
 	// IPProtocolTCP defines the constant for UDP protocol number
@@ -46,30 +85,49 @@ const (
 // IP Header masks
 const (
 	ipHdrLenMask = 0xF
+
+	ipVersionShift = 4
 )
 
-// TCP Header field position constants
+// TCP Header field position constants. They are relative to the
+// beginning of the TCP header.
 const (
 	// tcpSourcePortPos is the location of source port
-	tcpSourcePortPos = 20
+	tcpSourcePortPos = 0
 
 	// tcpDestPortPos is the location of destination port
-	tcpDestPortPos = 22
+	tcpDestPortPos = 2
 
 	// tcpSeqPos is the location of seq
-	tcpSeqPos = 24
+	tcpSeqPos = 4
 
 	// tcpAckPos is the location of seq
-	tcpAckPos = 28
+	tcpAckPos = 8
 
 	// tcpDataOffsetPos is the location of the TCP data offset
-	tcpDataOffsetPos = 32
+	tcpDataOffsetPos = 12
 
 	//tcpFlagsOfsetPos is the location of the TCP flags
-	tcpFlagsOffsetPos = 33
+	tcpFlagsOffsetPos = 13
 
 	// TCPChecksumPos is the location of TCP checksum
-	TCPChecksumPos = 36
+	TCPChecksumPos = 16
+
+	// tcpOptionsPos is the location of the TCP options
+	tcpOptionsPos = 20
+)
+
+// UDP Header field position constants. They are relative to the
+// beginning of the UDP header.
+const (
+	// udpLengthPos is the location of the UDP length
+	udpLengthPos = 4
+
+	// UDPChecksumPos is the location of UDP checksum
+	UDPChecksumPos = 6
+
+	// udpDataPos is the location of the UDP payload
+	udpDataPos = 8
 )
 
 // TCP Header masks
@@ -103,4 +161,23 @@ const (
 
 	// TCPMssOptionLen is the type for MSS option
 	TCPMssOptionLen = uint8(4)
+
+	// TCPSackPermittedOption is the type for the SACK permitted option
+	TCPSackPermittedOption = uint8(4)
+
+	// TCPSackPermittedOptionLen is the length of the SACK permitted option
+	TCPSackPermittedOptionLen = uint8(2)
+
+	// TCPEncryptionOption is the type for the option that carries the
+	// record of the segments of encrypted connections
+	TCPEncryptionOption = uint8(253)
+
+	// TCPNoOperationOption is the option used to pad the TCP options
+	TCPNoOperationOption = uint8(1)
+
+	// TCPMaxOptionsLength is the maximum length of the options of a TCP header
+	TCPMaxOptionsLength = 40
+
+	// tcpEndOfOptionList is the option that ends the TCP options
+	tcpEndOfOptionList = uint8(0)
 )
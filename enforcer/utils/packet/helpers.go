@@ -8,6 +8,7 @@ import (
 	"strconv"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 // Helpher functions for the package, mainly for debugging and validation
@@ -15,9 +16,13 @@ import (
 
 // VerifyIPChecksum returns true if the IP header checksum is correct
 // for this packet, false otherwise. Note that the checksum is not
-// modified.
+// modified. IPv6 headers have no checksum.
 func (p *Packet) VerifyIPChecksum() bool {
 
+	if p.ipVersion == IPVersion6 {
+		return true
+	}
+
 	sum := p.computeIPChecksum()
 
 	return sum == p.ipChecksum
@@ -27,6 +32,10 @@ func (p *Packet) VerifyIPChecksum() bool {
 // packet with the value.
 func (p *Packet) UpdateIPChecksum() {
 
+	if p.ipVersion == IPVersion6 {
+		return
+	}
+
 	p.ipChecksum = p.computeIPChecksum()
 
 	binary.BigEndian.PutUint16(p.Buffer[ipChecksumPos:ipChecksumPos+2], p.ipChecksum)
@@ -48,7 +57,30 @@ func (p *Packet) UpdateTCPChecksum() {
 
 	p.TCPChecksum = p.computeTCPChecksum()
 
-	binary.BigEndian.PutUint16(p.Buffer[TCPChecksumPos:TCPChecksumPos+2], p.TCPChecksum)
+	binary.BigEndian.PutUint16(p.l4Header()[TCPChecksumPos:TCPChecksumPos+2], p.TCPChecksum)
+}
+
+// VerifyUDPChecksum returns true if the UDP header checksum is correct
+// for this packet, false otherwise. A zero checksum means that the
+// sender did not compute it, which is only allowed over IPv4.
+func (p *Packet) VerifyUDPChecksum() bool {
+
+	if p.UDPChecksum == 0 {
+		return p.ipVersion != IPVersion6
+	}
+
+	sum := p.computeUDPChecksum()
+
+	return sum == p.UDPChecksum
+}
+
+// UpdateUDPChecksum computes the UDP header checksum and updates the
+// packet with the value.
+func (p *Packet) UpdateUDPChecksum() {
+
+	p.UDPChecksum = p.computeUDPChecksum()
+
+	binary.BigEndian.PutUint16(p.l4Header()[UDPChecksumPos:UDPChecksumPos+2], p.UDPChecksum)
 }
 
 // String returns a string representation of fields contained in this packet.
@@ -57,7 +89,14 @@ func (p *Packet) String() string {
 	var buf bytes.Buffer
 	buf.WriteString("(error)")
 
-	header, err := ipv4.ParseHeader(p.Buffer)
+	var header fmt.Stringer
+	var err error
+
+	if p.ipVersion == IPVersion6 {
+		header, err = ipv6.ParseHeader(p.Buffer)
+	} else {
+		header, err = ipv4.ParseHeader(p.Buffer)
+	}
 
 	if err == nil {
 		buf.Reset()
@@ -92,12 +131,72 @@ func (p *Packet) computeIPChecksum() uint16 {
 // Computes the TCP header checksum. The packet is not modified.
 func (p *Packet) computeTCPChecksum() uint16 {
 
-	var pseudoHeaderLen uint16 = 12
 	tcpSize := uint16(len(p.Buffer)) - p.l4BeginPos
-	bufLen := pseudoHeaderLen + tcpSize
-	buf := make([]byte, bufLen)
 
-	// Construct the pseudo-header for TCP checksum computation:
+	// The pseudo-header covers the TCP buffer size (real header + payload)
+	buf := p.pseudoHeader(IPProtocolTCP, tcpSize+uint16(len(p.tcpData)+len(p.tcpOptions)))
+	pseudoHeaderLen := len(buf)
+
+	// The TCP buffer (real header + payload)
+	buf = append(buf, p.l4Header()...)
+
+	// Set current checksum to zero (in buf, not changing packet)
+	buf[pseudoHeaderLen+TCPChecksumPos] = 0
+	buf[pseudoHeaderLen+TCPChecksumPos+1] = 0
+
+	buf = append(buf, p.tcpOptions...)
+	buf = append(buf, p.tcpData...)
+
+	return checksum(buf)
+}
+
+// Computes the UDP header checksum. The packet is not modified.
+func (p *Packet) computeUDPChecksum() uint16 {
+
+	udpSize := uint16(len(p.Buffer)) - p.l4BeginPos
+
+	// The pseudo-header covers the UDP buffer size (real header + payload)
+	buf := p.pseudoHeader(IPProtocolUDP, udpSize)
+	pseudoHeaderLen := len(buf)
+
+	// The UDP buffer (real header + payload)
+	buf = append(buf, p.l4Header()...)
+
+	// Set current checksum to zero (in buf, not changing packet)
+	buf[pseudoHeaderLen+UDPChecksumPos] = 0
+	buf[pseudoHeaderLen+UDPChecksumPos+1] = 0
+
+	// A computed checksum of zero is transmitted as all ones
+	if sum := checksum(buf); sum != 0 {
+		return sum
+	}
+
+	return 0xffff
+}
+
+// pseudoHeader constructs the pseudo-header for the TCP and UDP checksum
+// computation of the upper layer buffer with the given protocol and size.
+func (p *Packet) pseudoHeader(proto uint8, size uint16) []byte {
+
+	if p.ipVersion == IPVersion6 {
+		buf := make([]byte, 40)
+
+		// bytes 0-15: Source IP address
+		copy(buf[0:16], p.Buffer[ipv6SourceAddrPos:ipv6SourceAddrPos+16])
+
+		// bytes 16-31: Destination IP address
+		copy(buf[16:32], p.Buffer[ipv6DestAddrPos:ipv6DestAddrPos+16])
+
+		// bytes 32-35: Upper layer buffer size
+		binary.BigEndian.PutUint32(buf[32:36], uint32(size))
+
+		// bytes 36-38: Constant zero, byte 39: Next header
+		buf[39] = proto
+
+		return buf
+	}
+
+	buf := make([]byte, 12)
 
 	// bytes 0-3: Source IP address
 	copy(buf[0:4], p.Buffer[ipSourceAddrPos:ipSourceAddrPos+4])
@@ -108,23 +207,13 @@ func (p *Packet) computeTCPChecksum() uint16 {
 	// byte 8: Constant zero
 	buf[8] = 0
 
-	// byte 9: Protocol (6==TCP)
-	buf[9] = 6
-
-	// bytes 10,11: TCP buffer size (real header + payload)
-	binary.BigEndian.PutUint16(buf[10:12], tcpSize+uint16(len(p.tcpData)+len(p.tcpOptions)))
+	// byte 9: Protocol
+	buf[9] = proto
 
-	// bytes 12+: The TCP buffer (real header + payload)
-	copy(buf[12:], p.Buffer[p.l4BeginPos:])
+	// bytes 10,11: Upper layer buffer size
+	binary.BigEndian.PutUint16(buf[10:12], size)
 
-	// Set current checksum to zero (in buf, not changing packet)
-	buf[pseudoHeaderLen+16] = 0
-	buf[pseudoHeaderLen+17] = 0
-
-	buf = append(buf, p.tcpOptions...)
-	buf = append(buf, p.tcpData...)
-
-	return checksum(buf)
+	return buf
 }
 
 // incCsum16 implements rfc1624, equation 3.
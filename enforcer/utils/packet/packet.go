@@ -49,7 +49,7 @@ func init() {
 
 // New returns a pointer to Packet structure built from the
 // provided bytes buffer which is expected to contain valid TCP/IP
-// packet bytes.
+// packet bytes. Both IPv4 and IPv6 packets are supported.
 func New(context uint64, bytes []byte, mark string) (packet *Packet, err error) {
 
 	var p Packet
@@ -64,22 +64,24 @@ func New(context uint64, bytes []byte, mark string) (packet *Packet, err error)
 	p.tcpOptions = []byte{}
 	p.tcpData = []byte{}
 
-	// IP Header Processing
-	p.ipHeaderLen = bytes[ipHdrLenPos] & ipHdrLenMask
-	p.IPProto = bytes[ipProtoPos]
-	p.IPTotalLength = binary.BigEndian.Uint16(bytes[ipLengthPos : ipLengthPos+2])
-	p.ipID = binary.BigEndian.Uint16(bytes[IPIDPos : IPIDPos+2])
-	p.ipChecksum = binary.BigEndian.Uint16(bytes[ipChecksumPos : ipChecksumPos+2])
-	p.SourceAddress = net.IP(bytes[ipSourceAddrPos : ipSourceAddrPos+4])
-	p.DestinationAddress = net.IP(bytes[ipDestAddrPos : ipDestAddrPos+4])
+	if len(bytes) < minIPHdrSize {
+		return nil, fmt.Errorf("IP Packet too small (len=%d)", len(bytes))
+	}
 
-	// Some sanity checking...
-	if p.IPTotalLength < minIPPacketLen {
-		return nil, fmt.Errorf("IP Packet too small (hdrlen=%d)", p.ipHeaderLen)
+	// IP Header Processing
+	p.ipVersion = bytes[ipVersionPos] >> ipVersionShift
+
+	switch p.ipVersion {
+	case IPVersion4:
+		err = p.parseIPv4Header()
+	case IPVersion6:
+		err = p.parseIPv6Header()
+	default:
+		err = fmt.Errorf("IP version not supported (version=%d)", p.ipVersion)
 	}
 
-	if p.ipHeaderLen != minIPHdrWords {
-		return nil, fmt.Errorf("Packets with IP options not supported (hdrlen=%d)", p.ipHeaderLen)
+	if err != nil {
+		return nil, err
 	}
 
 	if p.IPTotalLength != uint16(len(p.Buffer)) {
@@ -90,21 +92,109 @@ func New(context uint64, bytes []byte, mark string) (packet *Packet, err error)
 		}
 	}
 
+	l4Header := p.l4Header()
+
+	// UDP Header Processing
+	if p.IPProto == IPProtocolUDP {
+		p.SourcePort = binary.BigEndian.Uint16(l4Header[tcpSourcePortPos : tcpSourcePortPos+2])
+		p.DestinationPort = binary.BigEndian.Uint16(l4Header[tcpDestPortPos : tcpDestPortPos+2])
+		p.UDPChecksum = binary.BigEndian.Uint16(l4Header[UDPChecksumPos : UDPChecksumPos+2])
+		p.context = context
+
+		return &p, nil
+	}
+
 	// TCP Header Processing
-	p.l4BeginPos = minIPHdrSize
-	p.TCPChecksum = binary.BigEndian.Uint16(bytes[TCPChecksumPos : TCPChecksumPos+2])
-	p.SourcePort = binary.BigEndian.Uint16(bytes[tcpSourcePortPos : tcpSourcePortPos+2])
-	p.DestinationPort = binary.BigEndian.Uint16(bytes[tcpDestPortPos : tcpDestPortPos+2])
-	p.TCPAck = binary.BigEndian.Uint32(bytes[tcpAckPos : tcpAckPos+4])
-	p.TCPSeq = binary.BigEndian.Uint32(bytes[tcpSeqPos : tcpSeqPos+4])
-	p.tcpDataOffset = (bytes[tcpDataOffsetPos] & tcpDataOffsetMask) >> 4
-	p.TCPFlags = bytes[tcpFlagsOffsetPos]
+	p.TCPChecksum = binary.BigEndian.Uint16(l4Header[TCPChecksumPos : TCPChecksumPos+2])
+	p.SourcePort = binary.BigEndian.Uint16(l4Header[tcpSourcePortPos : tcpSourcePortPos+2])
+	p.DestinationPort = binary.BigEndian.Uint16(l4Header[tcpDestPortPos : tcpDestPortPos+2])
+	p.TCPAck = binary.BigEndian.Uint32(l4Header[tcpAckPos : tcpAckPos+4])
+	p.TCPSeq = binary.BigEndian.Uint32(l4Header[tcpSeqPos : tcpSeqPos+4])
+	p.tcpDataOffset = (l4Header[tcpDataOffsetPos] & tcpDataOffsetMask) >> 4
+	p.TCPFlags = l4Header[tcpFlagsOffsetPos]
 
 	p.context = context
 
 	return &p, nil
 }
 
+// parseIPv4Header parses the fields of an IPv4 header
+func (p *Packet) parseIPv4Header() error {
+
+	p.ipHeaderLen = p.Buffer[ipHdrLenPos] & ipHdrLenMask
+	p.IPProto = p.Buffer[ipProtoPos]
+	p.IPTotalLength = binary.BigEndian.Uint16(p.Buffer[ipLengthPos : ipLengthPos+2])
+	p.ipID = binary.BigEndian.Uint16(p.Buffer[IPIDPos : IPIDPos+2])
+	p.ipChecksum = binary.BigEndian.Uint16(p.Buffer[ipChecksumPos : ipChecksumPos+2])
+	p.SourceAddress = net.IP(p.Buffer[ipSourceAddrPos : ipSourceAddrPos+net.IPv4len])
+	p.DestinationAddress = net.IP(p.Buffer[ipDestAddrPos : ipDestAddrPos+net.IPv4len])
+
+	// Some sanity checking...
+	minPacketLen := uint16(minIPPacketLen)
+	if p.IPProto == IPProtocolUDP {
+		minPacketLen = minUDPPacketLen
+	}
+
+	if p.IPTotalLength < minPacketLen {
+		return fmt.Errorf("IP Packet too small (hdrlen=%d)", p.ipHeaderLen)
+	}
+
+	if p.ipHeaderLen != minIPHdrWords {
+		return fmt.Errorf("Packets with IP options not supported (hdrlen=%d)", p.ipHeaderLen)
+	}
+
+	p.l4BeginPos = minIPHdrSize
+
+	return nil
+}
+
+// parseIPv6Header parses the fields of an IPv6 header. Extension headers
+// are not supported and the next header must be TCP or UDP.
+func (p *Packet) parseIPv6Header() error {
+
+	if len(p.Buffer) < ipv6HdrSize {
+		return fmt.Errorf("IPv6 Packet too small (len=%d)", len(p.Buffer))
+	}
+
+	payloadLength := int(binary.BigEndian.Uint16(p.Buffer[ipv6PayloadLengthPos : ipv6PayloadLengthPos+2]))
+	if ipv6HdrSize+payloadLength > 0xFFFF {
+		return fmt.Errorf("IPv6 Packet too large (payloadlen=%d)", payloadLength)
+	}
+
+	p.IPProto = p.Buffer[ipv6NextHeaderPos]
+	p.IPTotalLength = uint16(ipv6HdrSize + payloadLength)
+	p.SourceAddress = net.IP(p.Buffer[ipv6SourceAddrPos : ipv6SourceAddrPos+net.IPv6len])
+	p.DestinationAddress = net.IP(p.Buffer[ipv6DestAddrPos : ipv6DestAddrPos+net.IPv6len])
+
+	if p.IPProto != IPProtocolTCP && p.IPProto != IPProtocolUDP {
+		return fmt.Errorf("IPv6 extension headers not supported (nexthdr=%d)", p.IPProto)
+	}
+
+	// Some sanity checking...
+	minPacketLen := uint16(minIPv6PacketLen)
+	if p.IPProto == IPProtocolUDP {
+		minPacketLen = minUDPv6PacketLen
+	}
+
+	if p.IPTotalLength < minPacketLen {
+		return fmt.Errorf("IPv6 Packet too small (payloadlen=%d)", payloadLength)
+	}
+
+	p.l4BeginPos = ipv6HdrSize
+
+	return nil
+}
+
+// l4Header returns the buffer starting at the transport header
+func (p *Packet) l4Header() []byte {
+	return p.Buffer[p.l4BeginPos:]
+}
+
+// IPVersion returns the IP version of the packet
+func (p *Packet) IPVersion() uint8 {
+	return p.ipVersion
+}
+
 // GetTCPData returns any additional data in the packet
 func (p *Packet) GetTCPData() []byte {
 	return p.tcpData
@@ -183,8 +273,8 @@ func (p *Packet) Print(context uint64) {
 			p.ipID,
 			flagsToDir(p.context|context),
 			flagsToStr(p.context|context),
-			p.SourceAddress.To4().String(), p.SourcePort,
-			p.DestinationAddress.To4().String(), p.DestinationPort,
+			p.SourceAddress.String(), p.SourcePort,
+			p.DestinationAddress.String(), p.DestinationPort,
 			tcpFlagsToStr(p.TCPFlags),
 			p.TCPSeq, p.TCPAck, p.IPTotalLength-p.TCPDataStartBytes(),
 			expAck, expAck, p.tcpDataOffset,
@@ -252,6 +342,13 @@ func (p *Packet) CheckTCPAuthenticationOption(iOptionLength int) (err error) {
 // FixupIPHdrOnDataModify modifies the IP header fields and checksum
 func (p *Packet) FixupIPHdrOnDataModify(old, new uint16) {
 
+	// IPv6 has no header checksum and only carries the payload length
+	if p.ipVersion == IPVersion6 {
+		p.IPTotalLength = p.IPTotalLength + new - old
+		binary.BigEndian.PutUint16(p.Buffer[ipv6PayloadLengthPos:ipv6PayloadLengthPos+2], p.IPTotalLength-ipv6HdrSize)
+		return
+	}
+
 	// IP Header Processing
 	// IP chekcsum fixup.
 	p.ipChecksum = incCsum16(p.ipChecksum, old, new)
@@ -266,28 +363,109 @@ func (p *Packet) FixupIPHdrOnDataModify(old, new uint16) {
 func (p *Packet) IncreaseTCPSeq(incr uint32) {
 
 	p.TCPSeq = p.TCPSeq + incr
-	binary.BigEndian.PutUint32(p.Buffer[tcpSeqPos:tcpSeqPos+4], p.TCPSeq)
+	binary.BigEndian.PutUint32(p.l4Header()[tcpSeqPos:tcpSeqPos+4], p.TCPSeq)
 }
 
 // DecreaseTCPSeq decreases TCP seq number by decr
 func (p *Packet) DecreaseTCPSeq(decr uint32) {
 
 	p.TCPSeq = p.TCPSeq - decr
-	binary.BigEndian.PutUint32(p.Buffer[tcpSeqPos:tcpSeqPos+4], p.TCPSeq)
+	binary.BigEndian.PutUint32(p.l4Header()[tcpSeqPos:tcpSeqPos+4], p.TCPSeq)
 }
 
 // IncreaseTCPAck increases TCP ack number by incr
 func (p *Packet) IncreaseTCPAck(incr uint32) {
 
 	p.TCPAck = p.TCPAck + incr
-	binary.BigEndian.PutUint32(p.Buffer[tcpAckPos:tcpAckPos+4], p.TCPAck)
+	binary.BigEndian.PutUint32(p.l4Header()[tcpAckPos:tcpAckPos+4], p.TCPAck)
 }
 
 // DecreaseTCPAck decreases TCP ack number by decr
 func (p *Packet) DecreaseTCPAck(decr uint32) {
 
 	p.TCPAck = p.TCPAck - decr
-	binary.BigEndian.PutUint32(p.Buffer[tcpAckPos:tcpAckPos+4], p.TCPAck)
+	binary.BigEndian.PutUint32(p.l4Header()[tcpAckPos:tcpAckPos+4], p.TCPAck)
+}
+
+// findTCPOption returns the options of the TCP header and the position of
+// the option of the given kind and length in them, or -1 if there is none
+func (p *Packet) findTCPOption(kind uint8, length uint8) ([]byte, int) {
+
+	options := p.Buffer[p.l4BeginPos+tcpOptionsPos : p.TCPDataStartBytes()]
+
+	for i := 0; i < len(options); {
+
+		switch options[i] {
+		case tcpEndOfOptionList:
+			return options, -1
+		case TCPNoOperationOption:
+			i++
+			continue
+		}
+
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return options, -1
+		}
+
+		if options[i] == kind && options[i+1] == length {
+			return options, i
+		}
+
+		i += int(options[i+1])
+	}
+
+	return options, -1
+}
+
+// DecreaseTCPMSS decreases the MSS option of the packet by decr. It returns
+// false if the packet has no MSS option.
+func (p *Packet) DecreaseTCPMSS(decr uint16) bool {
+
+	options, i := p.findTCPOption(TCPMssOption, TCPMssOptionLen)
+	if i < 0 {
+		return false
+	}
+
+	mss := binary.BigEndian.Uint16(options[i+2 : i+4])
+	if mss <= decr {
+		return false
+	}
+	binary.BigEndian.PutUint16(options[i+2:i+4], mss-decr)
+
+	return true
+}
+
+// TCPMSS returns the MSS option of the packet, or 0 if it has none
+func (p *Packet) TCPMSS() uint16 {
+
+	options, i := p.findTCPOption(TCPMssOption, TCPMssOptionLen)
+	if i < 0 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(options[i+2 : i+4])
+}
+
+// ClearTCPOption replaces an option of the given kind and length with
+// no-operation options, so that the length of the header does not change.
+// It returns false if the packet does not have the option.
+func (p *Packet) ClearTCPOption(kind uint8, length uint8) bool {
+
+	options, i := p.findTCPOption(kind, length)
+	if i < 0 {
+		return false
+	}
+
+	for j := i; j < i+int(length); j++ {
+		options[j] = TCPNoOperationOption
+	}
+
+	return true
+}
+
+// TCPHeaderOptionLength returns the length of the options in the TCP header
+func (p *Packet) TCPHeaderOptionLength() int {
+	return int(p.TCPDataStartBytes()-p.l4BeginPos) - tcpOptionsPos
 }
 
 // FixupTCPHdrOnTCPDataDetach modifies the TCP header fields and checksum
@@ -295,7 +473,7 @@ func (p *Packet) FixupTCPHdrOnTCPDataDetach(dataLength uint16, optionLength uint
 
 	// Update DataOffset
 	p.tcpDataOffset = p.tcpDataOffset - uint8(optionLength/4)
-	p.Buffer[tcpDataOffsetPos] = p.tcpDataOffset << 4
+	p.l4Header()[tcpDataOffsetPos] = p.tcpDataOffset << 4
 }
 
 // tcpDataDetach splits the p.Buffer into p.Buffer (header + some options), p.tcpOptions (optionLength) and p.TCPData (dataLength)
@@ -355,8 +533,8 @@ func (p *Packet) FixupTCPHdrOnTCPDataAttach(tcpOptions []byte, tcpData []byte) {
 
 	// Modify the fields
 	p.tcpDataOffset = p.tcpDataOffset + uint8(numberOfOptions)
-	binary.BigEndian.PutUint16(p.Buffer[TCPChecksumPos:TCPChecksumPos+2], p.TCPChecksum)
-	p.Buffer[tcpDataOffsetPos] = p.tcpDataOffset << 4
+	binary.BigEndian.PutUint16(p.l4Header()[TCPChecksumPos:TCPChecksumPos+2], p.TCPChecksum)
+	p.l4Header()[tcpDataOffsetPos] = p.tcpDataOffset << 4
 }
 
 // tcpDataAttach splits the p.Buffer into p.Buffer (header + some options), p.tcpOptions (optionLength) and p.TCPData (dataLength)
@@ -392,6 +570,57 @@ func (p *Packet) TCPDataAttach(tcpOptions []byte, tcpData []byte) (err error) {
 	return
 }
 
+// ReadUDPData returns the payload of a UDP packet
+// It does not remove the payload from the packet
+func (p *Packet) ReadUDPData() []byte {
+
+	if uint16(len(p.Buffer)) >= p.IPTotalLength {
+		return p.Buffer[p.l4BeginPos+udpDataPos : p.IPTotalLength]
+	}
+
+	return []byte{}
+}
+
+// UDPDataAttach inserts the provided data in front of the UDP payload and
+// updates the IP and UDP headers
+func (p *Packet) UDPDataAttach(data []byte) {
+
+	dataPos := p.l4BeginPos + udpDataPos
+
+	buffer := make([]byte, 0, len(p.Buffer)+len(data))
+	buffer = append(buffer, p.Buffer[:dataPos]...)
+	buffer = append(buffer, data...)
+	buffer = append(buffer, p.Buffer[dataPos:]...)
+	p.Buffer = buffer
+
+	p.fixupUDPHdrOnDataModify(p.IPTotalLength, p.IPTotalLength+uint16(len(data)))
+}
+
+// UDPDataDetach removes length bytes from the beginning of the UDP payload
+// and updates the IP and UDP headers
+func (p *Packet) UDPDataDetach(length uint16) (err error) {
+
+	dataPos := p.l4BeginPos + udpDataPos
+
+	if uint16(len(p.Buffer)) < p.IPTotalLength || p.IPTotalLength < dataPos+length {
+		return fmt.Errorf("UDP Data Detach failed: length=%d IPTotalLength=%d", length, p.IPTotalLength)
+	}
+
+	p.Buffer = append(p.Buffer[:dataPos], p.Buffer[dataPos+length:p.IPTotalLength]...)
+
+	p.fixupUDPHdrOnDataModify(p.IPTotalLength, p.IPTotalLength-length)
+
+	return nil
+}
+
+// fixupUDPHdrOnDataModify modifies the IP and UDP lengths when the payload changes
+func (p *Packet) fixupUDPHdrOnDataModify(old, new uint16) {
+
+	p.FixupIPHdrOnDataModify(old, new)
+
+	binary.BigEndian.PutUint16(p.l4Header()[udpLengthPos:udpLengthPos+2], p.IPTotalLength-p.l4BeginPos)
+}
+
 // L4FlowHash calculate a hash string based on the 4-tuple
 func (p *Packet) L4FlowHash() string {
 	return p.SourceAddress.String() + ":" + p.DestinationAddress.String() + ":" + strconv.Itoa(int(p.SourcePort)) + ":" + strconv.Itoa(int(p.DestinationPort))
@@ -1,6 +1,9 @@
 package packet
 
-import "testing"
+import (
+	"encoding/binary"
+	"testing"
+)
 
 type SamplePacketName int
 
@@ -11,6 +14,9 @@ const (
 	synIPLenTooSmall
 	synMissingBytes
 	synBadIPChecksum
+	udpGoodChecksum
+	synIPv6GoodTCPChecksum
+	udpIPv6GoodChecksum
 )
 
 var testPackets = [][]byte{
@@ -57,7 +63,28 @@ var testPackets = [][]byte{
 		0x00, 0x7f, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0xb2, 0x64, 0x00, 0x63, 0x58, 0xd1,
 		0x24, 0xd9, 0x00, 0x00, 0x00, 0x00, 0xa0, 0x02, 0xaa, 0xaa, 0xfe, 0x30, 0x00, 0x00, 0x02,
 		0x04, 0xff, 0xd7, 0x04, 0x02, 0x08, 0x0a, 0x00, 0xc5, 0x8e, 0xf7, 0x00, 0x00, 0x00, 0x00,
-		0x01, 0x03, 0x03, 0x07}}
+		0x01, 0x03, 0x03, 0x07},
+
+	// UDP packet from port 53000 to port 53 with payload "abcd".
+	// Everything is correct.
+	[]byte{0x45, 0x00, 0x00, 0x20, 0x12, 0x34, 0x40, 0x00, 0x40, 0x11, 0x2a,
+		0x97, 0x7f, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0xcf, 0x08, 0x00, 0x35, 0x00, 0x0c,
+		0x6d, 0xcf, 0x61, 0x62, 0x63, 0x64},
+
+	// IPv6 SYN packet from fd00::1 port 35968 to fd00::2 port 99.
+	// Everything is correct.
+	[]byte{0x60, 0x00, 0x00, 0x00, 0x00, 0x18, 0x06, 0x40, 0xfd, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xfd, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x8c,
+		0x80, 0x00, 0x63, 0x2c, 0x32, 0xa8, 0xd6, 0x00, 0x00, 0x00, 0x00, 0x60, 0x02, 0xaa,
+		0xaa, 0x97, 0x7a, 0x00, 0x00, 0x02, 0x04, 0xff, 0xc4},
+
+	// IPv6 UDP packet from port 53000 to port 53 with payload "abcd".
+	// Everything is correct.
+	[]byte{0x60, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x11, 0x40, 0xfd, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xfd, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xcf,
+		0x08, 0x00, 0x35, 0x00, 0x0c, 0x71, 0xcd, 0x61, 0x62, 0x63, 0x64}}
 
 func TestGoodPacket(t *testing.T) {
 
@@ -355,6 +382,223 @@ func TestRawChecksums(t *testing.T) {
 	}
 }
 
+func TestGoodUDPPacket(t *testing.T) {
+
+	t.Parallel()
+	pkt := getTestPacket(t, udpGoodChecksum)
+
+	if !pkt.VerifyIPChecksum() {
+		t.Error("Test packet IP checksum failed")
+	}
+
+	if !pkt.VerifyUDPChecksum() {
+		t.Error("UDP checksum failed")
+	}
+
+	if pkt.SourcePort != 53000 || pkt.DestinationPort != 53 {
+		t.Error("Unexpected ports")
+	}
+
+	if string(pkt.ReadUDPData()) != "abcd" {
+		t.Error("Unexpected UDP payload")
+	}
+}
+
+func TestUDPDataAttachDetach(t *testing.T) {
+
+	t.Parallel()
+	pkt := getTestPacket(t, udpGoodChecksum)
+
+	pkt.UDPDataAttach([]byte("token"))
+	pkt.UpdateUDPChecksum()
+
+	if pkt.IPTotalLength != 37 || len(pkt.GetBytes()) != 37 {
+		t.Errorf("Unexpected length after attach %d", pkt.IPTotalLength)
+	}
+
+	if string(pkt.ReadUDPData()) != "tokenabcd" {
+		t.Error("Unexpected UDP payload after attach")
+	}
+
+	if !pkt.VerifyIPChecksum() || !pkt.VerifyUDPChecksum() {
+		t.Error("Checksums are wrong after attach")
+	}
+
+	if err := pkt.UDPDataDetach(5); err != nil {
+		t.Fatal(err)
+	}
+	pkt.UpdateUDPChecksum()
+
+	if string(pkt.GetBytes()) != string(testPackets[udpGoodChecksum]) {
+		t.Error("Packet differs from the original after detach")
+	}
+
+	if err := pkt.UDPDataDetach(10); err == nil {
+		t.Error("Expected failure when detaching more than the payload")
+	}
+}
+
+func TestGoodIPv6Packet(t *testing.T) {
+
+	t.Parallel()
+	pkt := getTestPacket(t, synIPv6GoodTCPChecksum)
+	t.Log(pkt.String())
+
+	if pkt.IPVersion() != IPVersion6 {
+		t.Errorf("Unexpected IP version %d", pkt.IPVersion())
+	}
+
+	if !pkt.VerifyTCPChecksum() {
+		t.Error("TCP checksum failed")
+	}
+
+	if pkt.SourceAddress.String() != "fd00::1" || pkt.DestinationAddress.String() != "fd00::2" {
+		t.Errorf("Unexpected addresses %s %s", pkt.SourceAddress, pkt.DestinationAddress)
+	}
+
+	if pkt.SourcePort != 35968 || pkt.DestinationPort != 99 {
+		t.Error("Unexpected ports")
+	}
+
+	if pkt.TCPFlags&TCPSynMask == 0 || pkt.TCPSeq != 0x2c32a8d6 {
+		t.Error("Unexpected TCP header fields")
+	}
+}
+
+func TestIPv6TCPDataAttachDetach(t *testing.T) {
+
+	t.Parallel()
+	pkt := getTestPacket(t, synIPv6GoodTCPChecksum)
+
+	options := []byte{TCPAuthenticationOption, 4, 0, 0}
+	if err := pkt.TCPDataAttach(options, []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+	pkt.UpdateTCPChecksum()
+
+	attached, err := New(0, pkt.GetBytes(), "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attached.IPTotalLength != 73 || !attached.VerifyTCPChecksum() {
+		t.Errorf("Unexpected packet after attach %d", attached.IPTotalLength)
+	}
+
+	if err := attached.CheckTCPAuthenticationOption(4); err != nil {
+		t.Error(err)
+	}
+
+	if attached.ReadTCPDataString() != "token" {
+		t.Error("Unexpected TCP payload after attach")
+	}
+
+	if err := attached.TCPDataDetach(4); err != nil {
+		t.Fatal(err)
+	}
+	attached.DropDetachedBytes()
+	attached.UpdateTCPChecksum()
+
+	if string(attached.GetBytes()) != string(testPackets[synIPv6GoodTCPChecksum]) {
+		t.Error("Packet differs from the original after detach")
+	}
+}
+
+func TestDecreaseTCPMSS(t *testing.T) {
+
+	t.Parallel()
+
+	for _, name := range []SamplePacketName{synGoodTCPChecksum, synIPv6GoodTCPChecksum} {
+		pkt := getTestPacket(t, name)
+		original := binary.BigEndian.Uint16(pkt.Buffer[pkt.l4BeginPos+tcpOptionsPos+2:])
+
+		if !pkt.DecreaseTCPMSS(24) {
+			t.Fatalf("MSS option not found in packet %d", name)
+		}
+
+		if mss := binary.BigEndian.Uint16(pkt.Buffer[pkt.l4BeginPos+tcpOptionsPos+2:]); mss != original-24 {
+			t.Errorf("Unexpected MSS %d in packet %d", mss, name)
+		}
+	}
+
+	pkt := getTestPacket(t, synGoodTCPChecksum)
+	pkt.Buffer[pkt.l4BeginPos+tcpOptionsPos] = tcpEndOfOptionList
+	if pkt.DecreaseTCPMSS(24) {
+		t.Error("MSS option found after the end of the options")
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+
+	t.Parallel()
+
+	pkt := getTestPacket(t, synGoodTCPChecksum)
+
+	if pkt.TCPMSS() != 0xffd7 {
+		t.Errorf("Unexpected MSS %d", pkt.TCPMSS())
+	}
+
+	if pkt.TCPHeaderOptionLength() != 20 {
+		t.Errorf("Unexpected length of the options %d", pkt.TCPHeaderOptionLength())
+	}
+
+	if !pkt.ClearTCPOption(TCPSackPermittedOption, TCPSackPermittedOptionLen) {
+		t.Fatal("SACK permitted option not found")
+	}
+
+	if pkt.ClearTCPOption(TCPSackPermittedOption, TCPSackPermittedOptionLen) {
+		t.Error("SACK permitted option found after it was cleared")
+	}
+
+	if pkt.TCPHeaderOptionLength() != 20 || pkt.TCPMSS() != 0xffd7 {
+		t.Error("Options changed by the clear of the SACK permitted option")
+	}
+}
+
+func TestIPv6UDPDataAttachDetach(t *testing.T) {
+
+	t.Parallel()
+	pkt := getTestPacket(t, udpIPv6GoodChecksum)
+
+	if !pkt.VerifyUDPChecksum() || string(pkt.ReadUDPData()) != "abcd" {
+		t.Error("Unexpected UDP packet")
+	}
+
+	pkt.UDPDataAttach([]byte("token"))
+	pkt.UpdateUDPChecksum()
+
+	attached, err := New(0, pkt.GetBytes(), "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !attached.VerifyUDPChecksum() || string(attached.ReadUDPData()) != "tokenabcd" {
+		t.Error("Unexpected UDP packet after attach")
+	}
+
+	if err := attached.UDPDataDetach(5); err != nil {
+		t.Fatal(err)
+	}
+	attached.UpdateUDPChecksum()
+
+	if string(attached.GetBytes()) != string(testPackets[udpIPv6GoodChecksum]) {
+		t.Error("Packet differs from the original after detach")
+	}
+}
+
+func TestIPv6ExtensionHeader(t *testing.T) {
+
+	t.Parallel()
+	tmp := make([]byte, len(testPackets[synIPv6GoodTCPChecksum]))
+	copy(tmp, testPackets[synIPv6GoodTCPChecksum])
+
+	// Hop-by-hop options header
+	tmp[6] = 0
+	if _, err := New(0, tmp, "0"); err == nil {
+		t.Error("Expected failure for IPv6 extension headers")
+	}
+}
+
 func getTestPacket(t *testing.T, id SamplePacketName) *Packet {
 
 	tmp := make([]byte, len(testPackets[id]))
@@ -2,6 +2,7 @@ package pkiverifier
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/x509"
 	"fmt"
@@ -12,6 +13,8 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/aporeto-inc/trireme/cache"
+	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
 )
 
 const (
@@ -21,22 +24,41 @@ const (
 
 // VerifierClaims captures all the clains of the verifier that is basically the public key
 type VerifierClaims struct {
-	X *big.Int
-	Y *big.Int
+	X *big.Int `json:",omitempty"`
+	Y *big.Int `json:",omitempty"`
+	// C is the curve of an EC public key. It is empty for the P-256 curve.
+	C string `json:",omitempty"`
+	// K is an Ed25519 public key
+	K []byte `json:",omitempty"`
+	// S is the serial number of the certificate, used to check its revocation
+	S *big.Int `json:",omitempty"`
+	// I is the raw issuer name of the certificate, since the serial number is
+	// only unique for an issuer
+	I []byte `json:",omitempty"`
 	jwt.StandardClaims
 }
 
+// verifiedKey is a key verified from a token and the issuer and serial number
+// of its certificate
+type verifiedKey struct {
+	publicKey interface{}
+	serial    *big.Int
+	issuer    []byte
+}
+
 // PKIConfiguration is the configuration of the verifier
 type PKIConfiguration struct {
-	publicKey  *ecdsa.PublicKey
-	privateKey *ecdsa.PrivateKey
-	signMethod jwt.SigningMethod
+	publicKey  interface{}
+	privateKey interface{}
 	keycache   cache.DataStore
 	validity   time.Duration
+	revocation *revocation.Checker
 }
 
-// NewConfig initializes a new signer structure
-func NewConfig(publicKey *ecdsa.PublicKey, privateKey *ecdsa.PrivateKey, cacheValiditiy time.Duration) *PKIConfiguration {
+// NewConfig initializes a new signer structure. The keys can be EC keys of the
+// P-256 or P-384 curves or Ed25519 keys, and the tokens are signed with the
+// method of the private key.
+func NewConfig(publicKey interface{}, privateKey interface{}, cacheValiditiy time.Duration) *PKIConfiguration {
 
 	validity := defaultValidity * time.Second
 	if cacheValiditiy > 0 {
@@ -46,54 +68,111 @@ func NewConfig(publicKey *ecdsa.PublicKey, privateKey *ecdsa.PrivateKey, cacheVa
 	return &PKIConfiguration{
 		publicKey:  publicKey,
 		privateKey: privateKey,
-		signMethod: jwt.SigningMethodES256,
 		keycache:   cache.NewCacheWithExpiration(validity),
 		validity:   validity,
 	}
 }
 
+// SetRevocation sets the checker of the revoked certificates. The keys of the
+// revoked certificates are rejected even if they are cached.
+func (p *PKIConfiguration) SetRevocation(c *revocation.Checker) {
+	p.revocation = c
+}
+
 // Verify verifies a token and returns the public key
-func (p *PKIConfiguration) Verify(token []byte) (*ecdsa.PublicKey, error) {
+func (p *PKIConfiguration) Verify(token []byte) (interface{}, error) {
 
 	tokenString := string(token)
 
 	claims := &VerifierClaims{}
 
-	if pk, err := p.keycache.Get(tokenString); err == nil {
-		return pk.(*ecdsa.PublicKey), nil
+	if cached, err := p.keycache.Get(tokenString); err == nil {
+		return p.checkRevocation(cached.(*verifiedKey))
 	}
 
 	// Parse the JWT token with the public key recovered
 	jwttoken, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if err := crypto.CheckSigningMethod(token.Method, p.publicKey); err != nil {
+			return nil, err
+		}
 		return p.publicKey, nil
 	})
 
 	if err != nil || !jwttoken.Valid {
 		zap.L().Error("Failed to parse public key structure", zap.Error(err))
-		return nil, fmt.Errorf("error in token %v ", err.Error())
+		return nil, fmt.Errorf("error in token %v ", err)
 	}
 
-	pk := KeyFromClaims(claims)
+	publicKey, err := PublicKeyFromClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &verifiedKey{
+		publicKey: publicKey,
+		serial:    claims.S,
+		issuer:    claims.I,
+	}
 
 	if time.Now().Add(p.validity).Unix() <= claims.ExpiresAt {
-		p.keycache.AddOrUpdate(tokenString, pk)
+		p.keycache.AddOrUpdate(tokenString, key)
 	}
 
-	return pk, nil
+	return p.checkRevocation(key)
+}
+
+// checkRevocation returns the public key unless its certificate is revoked.
+// The tokens without a serial number are rejected when the revocation is
+// checked, since they can not be checked. The tokens without an issuer, created
+// by older enforcers, are rejected if the serial number is revoked by any
+// authority.
+func (p *PKIConfiguration) checkRevocation(key *verifiedKey) (interface{}, error) {
+
+	if p.revocation != nil {
+		if key.serial == nil {
+			return nil, fmt.Errorf("Missing certificate serial number in token")
+		}
+		if err := p.revocation.CheckSerial(key.issuer, key.serial); err != nil {
+			return nil, err
+		}
+	}
+
+	return key.publicKey, nil
 }
 
 // CreateTokenFromCertificate creates and signs a token
 func (p *PKIConfiguration) CreateTokenFromCertificate(cert *x509.Certificate) ([]byte, error) {
 
+	signMethod, err := crypto.SigningMethod(p.privateKey)
+	if err != nil {
+		return []byte{}, err
+	}
+
 	// Combine the application claims with the standard claims
 	claims := &VerifierClaims{
-		X: cert.PublicKey.(*ecdsa.PublicKey).X,
-		Y: cert.PublicKey.(*ecdsa.PublicKey).Y,
+		S: cert.SerialNumber,
+		I: cert.RawIssuer,
 	}
 	claims.ExpiresAt = cert.NotAfter.Unix()
 
+	switch key := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if _, err := crypto.SigningMethod(key); err != nil {
+			return []byte{}, err
+		}
+		claims.X = key.X
+		claims.Y = key.Y
+		if key.Curve != elliptic.P256() {
+			claims.C = key.Curve.Params().Name
+		}
+	case ed25519.PublicKey:
+		claims.K = key
+	default:
+		return []byte{}, fmt.Errorf("Unsupported public key type %T", cert.PublicKey)
+	}
+
 	// Create the token and sign with our key
-	strtoken, err := jwt.NewWithClaims(p.signMethod, claims).SignedString(p.privateKey)
+	strtoken, err := jwt.NewWithClaims(signMethod, claims).SignedString(p.privateKey)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -101,11 +180,44 @@ func (p *PKIConfiguration) CreateTokenFromCertificate(cert *x509.Certificate) ([
 	return []byte(strtoken), nil
 }
 
-// KeyFromClaims creates the public key structure from the claims
+// KeyFromClaims creates the EC public key structure from the claims
 func KeyFromClaims(claims *VerifierClaims) *ecdsa.PublicKey {
+
+	curve := elliptic.P256()
+	if claims.C == elliptic.P384().Params().Name {
+		curve = elliptic.P384()
+	}
+
 	return &ecdsa.PublicKey{
-		Curve: elliptic.P256(),
+		Curve: curve,
 		X:     claims.X,
 		Y:     claims.Y,
 	}
 }
+
+// PublicKeyFromClaims creates the public key from the claims. It is either an
+// EC public key or an Ed25519 public key.
+func PublicKeyFromClaims(claims *VerifierClaims) (interface{}, error) {
+
+	if len(claims.K) > 0 {
+		if len(claims.K) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 public key size %d", len(claims.K))
+		}
+		return ed25519.PublicKey(claims.K), nil
+	}
+
+	if claims.X == nil || claims.Y == nil {
+		return nil, fmt.Errorf("Missing public key in claims")
+	}
+
+	if claims.C != "" && claims.C != elliptic.P384().Params().Name {
+		return nil, fmt.Errorf("Unsupported curve %s", claims.C)
+	}
+
+	key := KeyFromClaims(claims)
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("Public key is not on curve %s", key.Curve.Params().Name)
+	}
+
+	return key, nil
+}
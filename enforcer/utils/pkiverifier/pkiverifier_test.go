@@ -1,11 +1,23 @@
 package pkiverifier
 
 import (
+	gocrypto "crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -84,8 +96,9 @@ func TestCreateAndVerify(t *testing.T) {
 		Convey("When I create a token", func() {
 			token, err1 := p.CreateTokenFromCertificate(cert)
 			So(err1, ShouldBeNil)
-			rxtoken, err2 := p.Verify(token)
+			rxkey, err2 := p.Verify(token)
 			So(err2, ShouldBeNil)
+			rxtoken := rxkey.(*ecdsa.PublicKey)
 			So(*rxtoken.X, ShouldResemble, *cert.PublicKey.(*ecdsa.PublicKey).X)
 			So(*rxtoken.Y, ShouldResemble, *cert.PublicKey.(*ecdsa.PublicKey).Y)
 			So(rxtoken.Curve, ShouldResemble, cert.PublicKey.(*ecdsa.PublicKey).Curve)
@@ -135,3 +148,189 @@ func TestCaching(t *testing.T) {
 		})
 	})
 }
+
+func TestRevocation(t *testing.T) {
+	Convey("Given a verifier with a revocation checker", t, func() {
+		dir, err := ioutil.TempDir("", "pkiverifier")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		caTemplate := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "ca"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+		So(err, ShouldBeNil)
+		ca, err := x509.ParseCertificate(caDER)
+		So(err, ShouldBeNil)
+
+		issue := func(serial int64) *x509.Certificate {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			So(err, ShouldBeNil)
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(serial),
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+			So(err, ShouldBeNil)
+			cert, err := x509.ParseCertificate(der)
+			So(err, ShouldBeNil)
+			return cert
+		}
+
+		file := filepath.Join(dir, "ca.crl")
+		revoke := func(serial int64) {
+			der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+				Number:     big.NewInt(time.Now().UnixNano()),
+				ThisUpdate: time.Now(),
+				NextUpdate: time.Now().Add(time.Hour),
+				RevokedCertificateEntries: []x509.RevocationListEntry{
+					{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()},
+				},
+			}, ca, caKey)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(file, der, 0600), ShouldBeNil)
+		}
+		revoke(2)
+
+		checker, err := revocation.NewChecker(&revocation.Config{CRLFiles: []string{file}}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+		So(err, ShouldBeNil)
+
+		p := NewConfig(&caKey.PublicKey, caKey, time.Minute)
+		p.SetRevocation(checker)
+
+		Convey("When I receive the token of a revoked certificate", func() {
+			token, err := p.CreateTokenFromCertificate(issue(2))
+			So(err, ShouldBeNil)
+			_, err = p.Verify(token)
+
+			Convey("I should get a revocation error", func() {
+				So(err, ShouldEqual, revocation.ErrRevoked)
+			})
+		})
+
+		Convey("When I receive the token of a valid certificate", func() {
+			cert := issue(3)
+			token, err := p.CreateTokenFromCertificate(cert)
+			So(err, ShouldBeNil)
+			key, err := p.Verify(token)
+			So(err, ShouldBeNil)
+			So(key, ShouldResemble, cert.PublicKey)
+
+			Convey("When the certificate is revoked after its key is cached", func() {
+				revoke(3)
+				So(checker.Reload(), ShouldBeNil)
+				_, err := p.keycache.Get(string(token))
+				So(err, ShouldBeNil)
+
+				_, err = p.Verify(token)
+
+				Convey("I should get a revocation error", func() {
+					So(err, ShouldEqual, revocation.ErrRevoked)
+				})
+			})
+		})
+
+		Convey("When I receive a token without the serial number of its certificate", func() {
+			cert := issue(3)
+			token, err := p.CreateTokenFromCertificate(&x509.Certificate{PublicKey: cert.PublicKey, NotAfter: cert.NotAfter})
+			So(err, ShouldBeNil)
+			_, err = p.Verify(token)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestKeyTypes(t *testing.T) {
+
+	newCertificate := func(key gocrypto.Signer, caKey gocrypto.Signer) *x509.Certificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), caKey)
+		So(err, ShouldBeNil)
+		cert, err := x509.ParseCertificate(der)
+		So(err, ShouldBeNil)
+		return cert
+	}
+
+	Convey("Given an Ed25519 authority and a P-384 certificate", t, func() {
+		_, caKey, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		So(err, ShouldBeNil)
+		cert := newCertificate(key, caKey)
+
+		p := NewConfig(caKey.Public(), caKey, -1)
+
+		Convey("When I create and verify a token", func() {
+			token, err := p.CreateTokenFromCertificate(cert)
+			So(err, ShouldBeNil)
+			rxkey, err := p.Verify(token)
+
+			Convey("I should get the P-384 key", func() {
+				So(err, ShouldBeNil)
+				So(rxkey, ShouldResemble, &key.PublicKey)
+			})
+		})
+	})
+
+	Convey("Given a P-384 authority and an Ed25519 certificate", t, func() {
+		caKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		So(err, ShouldBeNil)
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		cert := newCertificate(key, caKey)
+
+		p := NewConfig(&caKey.PublicKey, caKey, -1)
+
+		Convey("When I create and verify a token", func() {
+			token, err := p.CreateTokenFromCertificate(cert)
+			So(err, ShouldBeNil)
+			rxkey, err := p.Verify(token)
+
+			Convey("I should get the Ed25519 key", func() {
+				So(err, ShouldBeNil)
+				So(rxkey, ShouldResemble, key.Public())
+			})
+		})
+
+		Convey("When the token is verified with the key of another type", func() {
+			token, err := p.CreateTokenFromCertificate(cert)
+			So(err, ShouldBeNil)
+			other, _, err := ed25519.GenerateKey(rand.Reader)
+			So(err, ShouldBeNil)
+			_, err = NewConfig(other, nil, -1).Verify(token)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given a certificate of an unsupported curve", t, func() {
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		So(err, ShouldBeNil)
+
+		_, err = NewConfig(&caKey.PublicKey, caKey, -1).CreateTokenFromCertificate(newCertificate(key, caKey))
+
+		Convey("I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
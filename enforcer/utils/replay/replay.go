@@ -0,0 +1,338 @@
+package replay
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultWindow is the default age of the oldest token that is accepted
+	DefaultWindow = 5 * time.Minute
+	// DefaultBuckets is the default number of buckets of the window
+	DefaultBuckets = 60
+	// DefaultMaxEntries is the default number of tokens remembered in the window
+	DefaultMaxEntries = 500000
+)
+
+var (
+	// ErrReplayed is returned when a token was already seen in the window
+	ErrReplayed = errors.New("Token replayed")
+	// ErrOutsideWindow is returned when a token was issued before the start of
+	// the window, or too far in the future. It can not be checked for replays.
+	ErrOutsideWindow = errors.New("Token issued outside of the replay window")
+)
+
+// Config is the configuration of the replay window
+type Config struct {
+	// Window is how long the tokens are remembered. The tokens issued before
+	// are rejected, so it must be larger than the clock skew of the nodes
+	Window time.Duration `json:",omitempty"`
+	// Buckets is the number of buckets the window is split in. The tokens of
+	// a bucket are forgotten together, once it is out of the window
+	Buckets int `json:",omitempty"`
+	// MaxEntries bounds the number of tokens in the window. The oldest buckets
+	// are dropped when it is exceeded, and their tokens are then rejected
+	MaxEntries int `json:",omitempty"`
+	// File is where the window is saved, so that the tokens are remembered
+	// when the enforcer restarts. The window is only kept in memory if empty
+	File string `json:",omitempty"`
+	// SaveInterval is the interval between two saves of the window. It is
+	// only saved when stopped if 0. The tokens seen after the last save are
+	// forgotten if the enforcer does not stop cleanly
+	SaveInterval time.Duration `json:",omitempty"`
+}
+
+// state is the content of the file of the window
+type state struct {
+	Floor   int64
+	Buckets map[int64][]string
+}
+
+// Window remembers the issuers and the nonces of the tokens issued within a
+// time window, and rejects the tokens that are seen twice. The tokens are
+// stored in buckets of their issue time, which are dropped as the window moves.
+type Window struct {
+	config  *Config
+	width   int64
+	buckets map[int64]map[string]struct{}
+	entries int
+	// floor is the issue time, in seconds, of the oldest token that is accepted
+	floor int64
+	now   func() time.Time
+	stop  chan struct{}
+
+	sync.Mutex
+}
+
+// NewWindow creates a replay window and loads the tokens of its file
+func NewWindow(config *Config) (*Window, error) {
+
+	if config == nil {
+		return nil, fmt.Errorf("Replay configuration can not be nil")
+	}
+
+	// The defaults are set on a copy, since the configuration may be shared
+	c := *config
+	config = &c
+
+	if config.Window <= 0 {
+		config.Window = DefaultWindow
+	}
+
+	if config.Buckets <= 0 {
+		config.Buckets = DefaultBuckets
+	}
+
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultMaxEntries
+	}
+
+	width := int64(config.Window/time.Second) / int64(config.Buckets)
+	if width < 1 {
+		width = 1
+	}
+
+	w := &Window{
+		config:  config,
+		width:   width,
+		buckets: map[int64]map[string]struct{}{},
+		now:     time.Now,
+	}
+
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Config returns the configuration of the window
+func (w *Window) Config() *Config {
+	return w.config
+}
+
+// Check records the nonce of a token of the issuer. It returns ErrReplayed if
+// it was already recorded, or ErrOutsideWindow if the token is too old. The
+// nonce and the issue time must be covered by the signature of the token.
+func (w *Window) Check(issuer string, nonce []byte, issuedAt int64) error {
+
+	w.Lock()
+	defer w.Unlock()
+
+	now := w.now().Unix()
+	w.expire(now)
+
+	if issuedAt < w.floor || issuedAt > now+int64(w.config.Window/time.Second) {
+		return ErrOutsideWindow
+	}
+
+	key := issuer + ":" + hex.EncodeToString(nonce)
+	index := issuedAt / w.width
+
+	bucket, ok := w.buckets[index]
+	if !ok {
+		bucket = map[string]struct{}{}
+		w.buckets[index] = bucket
+	}
+
+	if _, ok := bucket[key]; ok {
+		zap.L().Warn("Rejected replayed token", zap.String("issuer", issuer))
+		return ErrReplayed
+	}
+
+	bucket[key] = struct{}{}
+	w.entries++
+
+	if w.entries > w.config.MaxEntries {
+		zap.L().Warn("Replay window is full, dropping the oldest tokens", zap.Int("entries", w.entries))
+		for w.entries > w.config.MaxEntries {
+			w.dropOldest()
+		}
+		if issuedAt < w.floor {
+			return ErrOutsideWindow
+		}
+	}
+
+	return nil
+}
+
+// expire drops the buckets that are out of the window. It must be called with
+// the lock held.
+func (w *Window) expire(now int64) {
+
+	start := now - int64(w.config.Window/time.Second)
+	if start > w.floor {
+		w.floor = start
+	}
+
+	for index, bucket := range w.buckets {
+		if (index+1)*w.width <= w.floor {
+			w.entries -= len(bucket)
+			delete(w.buckets, index)
+		}
+	}
+}
+
+// dropOldest drops the oldest bucket and rejects the tokens issued until its
+// end. It must be called with the lock held.
+func (w *Window) dropOldest() {
+
+	oldest := int64(-1)
+	for index := range w.buckets {
+		if oldest < 0 || index < oldest {
+			oldest = index
+		}
+	}
+
+	if oldest < 0 {
+		return
+	}
+
+	w.entries -= len(w.buckets[oldest])
+	delete(w.buckets, oldest)
+
+	if end := (oldest + 1) * w.width; end > w.floor {
+		w.floor = end
+	}
+}
+
+// Start saves the window periodically
+func (w *Window) Start() {
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.config.File == "" || w.config.SaveInterval <= 0 || w.stop != nil {
+		return
+	}
+
+	w.stop = make(chan struct{})
+	go w.save(w.config.SaveInterval, w.stop)
+}
+
+// Stop stops the periodic saves and saves the window a last time
+func (w *Window) Stop() {
+
+	w.Lock()
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+	w.Unlock()
+
+	if err := w.Save(); err != nil {
+		zap.L().Error("Failed to save the replay window", zap.Error(err))
+	}
+}
+
+func (w *Window) save(interval time.Duration, stop chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Save(); err != nil {
+				zap.L().Error("Failed to save the replay window", zap.Error(err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Save writes the window to its file. The file is replaced at once, so that
+// the previous window is kept if the enforcer stops while saving.
+func (w *Window) Save() error {
+
+	if w.config.File == "" {
+		return nil
+	}
+
+	w.Lock()
+	w.expire(w.now().Unix())
+	s := &state{
+		Floor:   w.floor,
+		Buckets: make(map[int64][]string, len(w.buckets)),
+	}
+	for index, bucket := range w.buckets {
+		keys := make([]string, 0, len(bucket))
+		for key := range bucket {
+			keys = append(keys, key)
+		}
+		s.Buckets[index] = keys
+	}
+	w.Unlock()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp := w.config.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write replay window %s: %s", tmp, err)
+	}
+
+	if err := os.Rename(tmp, w.config.File); err != nil {
+		return fmt.Errorf("Failed to replace replay window %s: %s", w.config.File, err)
+	}
+
+	return nil
+}
+
+// load reads the window from its file. Without a file, the tokens seen before
+// the start are unknown and the ones issued before are rejected.
+func (w *Window) load() error {
+
+	now := w.now().Unix()
+	w.floor = now
+
+	if w.config.File == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(w.config.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read replay window %s: %s", w.config.File, err)
+	}
+
+	s := &state{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return fmt.Errorf("Failed to parse replay window %s: %s", w.config.File, err)
+	}
+
+	if s.Floor < w.floor {
+		w.floor = s.Floor
+	}
+
+	for index, keys := range s.Buckets {
+		bucket := make(map[string]struct{}, len(keys))
+		for _, key := range keys {
+			bucket[key] = struct{}{}
+		}
+		w.buckets[index] = bucket
+		w.entries += len(bucket)
+	}
+
+	w.expire(now)
+	for w.entries > w.config.MaxEntries {
+		w.dropOldest()
+	}
+
+	zap.L().Debug("Loaded replay window", zap.String("file", w.config.File), zap.Int("entries", w.entries))
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package replay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// clock is a settable clock of the tests
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func TestNewWindow(t *testing.T) {
+
+	Convey("When I create a window without configuration, I should get an error", t, func() {
+		_, err := NewWindow(nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When I create a window with an empty configuration, I should get the defaults", t, func() {
+		config := &Config{}
+		w, err := NewWindow(config)
+		So(err, ShouldBeNil)
+		So(w.Config().Window, ShouldEqual, DefaultWindow)
+		So(w.Config().Buckets, ShouldEqual, DefaultBuckets)
+		So(w.Config().MaxEntries, ShouldEqual, DefaultMaxEntries)
+		So(config.Window, ShouldEqual, 0)
+	})
+
+	Convey("When I create a window with a file that can not be parsed, I should get an error", t, func() {
+		dir, err := ioutil.TempDir("", "replay")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		file := filepath.Join(dir, "window")
+		So(ioutil.WriteFile(file, []byte("window"), 0600), ShouldBeNil)
+
+		_, err = NewWindow(&Config{File: file})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCheck(t *testing.T) {
+
+	Convey("Given a window of 60 seconds in 6 buckets", t, func() {
+		w, err := NewWindow(&Config{Window: time.Minute, Buckets: 6, MaxEntries: 4})
+		So(err, ShouldBeNil)
+
+		c := &clock{now: time.Unix(w.floor, 0)}
+		w.now = c.Now
+		now := c.now.Unix()
+
+		Convey("A new nonce should be accepted once", func() {
+			So(w.Check("a", []byte("nonce"), now), ShouldBeNil)
+			So(w.Check("a", []byte("nonce"), now), ShouldEqual, ErrReplayed)
+
+			Convey("The same nonce of another issuer should be accepted", func() {
+				So(w.Check("b", []byte("nonce"), now), ShouldBeNil)
+			})
+		})
+
+		Convey("A token issued before the window was created should be rejected", func() {
+			So(w.Check("a", []byte("nonce"), now-1), ShouldEqual, ErrOutsideWindow)
+		})
+
+		Convey("A token issued far in the future should be rejected", func() {
+			So(w.Check("a", []byte("nonce"), now+120), ShouldEqual, ErrOutsideWindow)
+		})
+
+		Convey("When the window moves past the issue time of a token", func() {
+			So(w.Check("a", []byte("nonce"), now), ShouldBeNil)
+			c.now = c.now.Add(2 * time.Minute)
+
+			Convey("The token should be rejected as too old and forgotten", func() {
+				So(w.Check("a", []byte("nonce"), now), ShouldEqual, ErrOutsideWindow)
+				So(w.entries, ShouldEqual, 0)
+				So(w.buckets, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the window is full", func() {
+			c.now = c.now.Add(2 * time.Minute)
+			now = c.now.Unix()
+
+			So(w.Check("a", []byte("1"), now-50), ShouldBeNil)
+			So(w.Check("a", []byte("2"), now-30), ShouldBeNil)
+			So(w.Check("a", []byte("3"), now), ShouldBeNil)
+			So(w.Check("a", []byte("4"), now), ShouldBeNil)
+			So(w.Check("a", []byte("5"), now), ShouldBeNil)
+
+			Convey("The oldest bucket should be dropped and its tokens rejected", func() {
+				So(w.entries, ShouldEqual, 4)
+				So(w.Check("a", []byte("1"), now-50), ShouldEqual, ErrOutsideWindow)
+				So(w.Check("a", []byte("2"), now-30), ShouldEqual, ErrReplayed)
+			})
+		})
+	})
+}
+
+func TestSave(t *testing.T) {
+
+	Convey("Given a window with a file", t, func() {
+		dir, err := ioutil.TempDir("", "replay")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		config := &Config{File: filepath.Join(dir, "window"), SaveInterval: 10 * time.Millisecond}
+
+		w, err := NewWindow(config)
+		So(err, ShouldBeNil)
+		w.Start()
+
+		now := time.Now().Unix()
+		So(w.Check("a", []byte("nonce"), now), ShouldBeNil)
+
+		Convey("The window should be saved periodically", func() {
+			So(func() bool {
+				for i := 0; i < 100; i++ {
+					if _, err := os.Stat(config.File); err == nil {
+						return true
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return false
+			}(), ShouldBeTrue)
+			w.Stop()
+		})
+
+		Convey("When the window is stopped and created again", func() {
+			w.Stop()
+
+			restarted, err := NewWindow(config)
+			So(err, ShouldBeNil)
+
+			Convey("The tokens seen before should be rejected", func() {
+				So(restarted.Check("a", []byte("nonce"), now), ShouldEqual, ErrReplayed)
+				So(restarted.Check("a", []byte("other"), now), ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,486 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/aporeto-inc/trireme/cache"
+)
+
+const (
+	// ocspRefreshInterval is the interval between two queries of the OCSP
+	// responder for a known certificate
+	ocspRefreshInterval = time.Minute
+	// ocspCacheValidity is how long the answers of the OCSP responder are used
+	// when they can not be refreshed
+	ocspCacheValidity = 5 * time.Minute
+	// ocspFailureValidity is how long a failure to get an answer is cached
+	// before the OCSP responder is asked again
+	ocspFailureValidity = 10 * time.Second
+	// ocspTimeout is the timeout of the requests to the OCSP responder
+	ocspTimeout = 2 * time.Second
+)
+
+// ErrRevoked is returned when a certificate is revoked
+var ErrRevoked = errors.New("Certificate revoked")
+
+// Config is the configuration of the revocation checks
+type Config struct {
+	// CRLFiles are the certificate revocation lists, in PEM or DER
+	CRLFiles []string `json:",omitempty"`
+	// ReloadInterval is the interval between two loads of the CRL files. The
+	// files are only loaded once if it is 0
+	ReloadInterval time.Duration `json:",omitempty"`
+	// OCSPServer is the URL of an OCSP responder that is asked about the
+	// certificates that are not in the CRLs. It is not used if empty
+	OCSPServer string `json:",omitempty"`
+	// OCSPFailClosed rejects the certificates when the OCSP responder does
+	// not give an answer. They are accepted otherwise
+	OCSPFailClosed bool `json:",omitempty"`
+}
+
+// certificateKey identifies a certificate by its issuer and serial number,
+// since the serial numbers are only unique for an issuer
+type certificateKey struct {
+	issuer string
+	serial string
+}
+
+// ocspAnswer is the status of a certificate given by the OCSP responder
+type ocspAnswer struct {
+	cert   *x509.Certificate
+	status int
+}
+
+// Checker checks if certificates are revoked. The revoked serial numbers are
+// loaded from CRL files that must be signed by one of the authorities, and
+// only revoke the certificates issued by the authority that signed the CRL.
+//
+// The OCSP responder is never asked on the datapath. The certificates are
+// queried in the background the first time they are checked and refreshed
+// while they are used. Until an answer is known, they are accepted unless the
+// checker fails closed.
+type Checker struct {
+	config       *Config
+	authorities  []*x509.Certificate
+	revoked      map[certificateKey]bool
+	serials      map[string]bool
+	ocspCache    cache.DataStore
+	ocspFailures cache.DataStore
+	ocspPending  map[certificateKey]bool
+	ocspQueries  sync.WaitGroup
+	client       *http.Client
+	stop         chan struct{}
+
+	sync.RWMutex
+}
+
+// NewChecker creates a checker for the certificates issued by the given
+// authorities and loads the CRL files
+func NewChecker(config *Config, caPEM []byte) (*Checker, error) {
+
+	if config == nil {
+		return nil, fmt.Errorf("Revocation configuration can not be nil")
+	}
+
+	authorities, err := loadAuthorities(caPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Checker{
+		config:       config,
+		authorities:  authorities,
+		revoked:      map[certificateKey]bool{},
+		serials:      map[string]bool{},
+		ocspCache:    cache.NewCacheWithExpiration(ocspCacheValidity),
+		ocspFailures: cache.NewCacheWithExpiration(ocspFailureValidity),
+		ocspPending:  map[certificateKey]bool{},
+		client:       &http.Client{Timeout: ocspTimeout},
+	}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Config returns the configuration of the checker
+func (c *Checker) Config() *Config {
+	return c.config
+}
+
+// Start reloads the CRL files and refreshes the answers of the OCSP
+// responder periodically
+func (c *Checker) Start() {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.stop != nil {
+		return
+	}
+
+	c.stop = make(chan struct{})
+
+	if c.config.ReloadInterval > 0 {
+		go c.reload(c.config.ReloadInterval, c.stop)
+	}
+
+	if c.config.OCSPServer != "" {
+		go c.refresh(ocspRefreshInterval, c.stop)
+	}
+}
+
+// Stop stops the reloads of the CRL files and the OCSP refreshes
+func (c *Checker) Stop() {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+func (c *Checker) reload(interval time.Duration, stop chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Reload(); err != nil {
+				zap.L().Error("Failed to reload the revocation lists, keeping the previous ones", zap.Error(err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reload loads the CRL files again. The revoked serial numbers are only
+// replaced if every file is loaded.
+func (c *Checker) Reload() error {
+
+	revoked := map[certificateKey]bool{}
+	serials := map[string]bool{}
+
+	for _, file := range c.config.CRLFiles {
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("Failed to read CRL %s: %s", file, err)
+		}
+
+		crl, err := x509.ParseCRL(data)
+		if err != nil {
+			return fmt.Errorf("Failed to parse CRL %s: %s", file, err)
+		}
+
+		authority := c.crlIssuer(crl)
+		if authority == nil {
+			return fmt.Errorf("CRL %s is not signed by a known authority", file)
+		}
+
+		if crl.HasExpired(time.Now()) {
+			zap.L().Warn("CRL is past its next update", zap.String("file", file))
+		}
+
+		for _, entry := range crl.TBSCertList.RevokedCertificates {
+			revoked[certificateKey{issuer: string(authority.RawSubject), serial: entry.SerialNumber.String()}] = true
+			serials[entry.SerialNumber.String()] = true
+		}
+	}
+
+	c.Lock()
+	c.revoked = revoked
+	c.serials = serials
+	c.Unlock()
+
+	zap.L().Debug("Loaded revocation lists", zap.Int("revoked", len(revoked)))
+
+	return nil
+}
+
+// Check returns ErrRevoked if the certificate is revoked. A certificate
+// without issuer is revoked if its serial number is in any CRL.
+func (c *Checker) Check(cert *x509.Certificate) error {
+
+	if cert == nil || cert.SerialNumber == nil {
+		return nil
+	}
+
+	c.RLock()
+	var revoked bool
+	if len(cert.RawIssuer) == 0 {
+		revoked = c.serials[cert.SerialNumber.String()]
+	} else {
+		revoked = c.revoked[keyOf(cert)]
+	}
+	c.RUnlock()
+
+	if revoked {
+		zap.L().Warn("Rejected revoked certificate", zap.String("serial", cert.SerialNumber.String()))
+		return ErrRevoked
+	}
+
+	if c.config.OCSPServer == "" {
+		return nil
+	}
+
+	return c.checkOCSP(cert)
+}
+
+// CheckSerial returns ErrRevoked if the certificate with the given issuer
+// and serial number is revoked. It is used when only the raw issuer name and
+// the serial number are known. The issuer can be nil if it is not known.
+func (c *Checker) CheckSerial(issuer []byte, serial *big.Int) error {
+	return c.Check(&x509.Certificate{SerialNumber: serial, RawIssuer: issuer})
+}
+
+// Prefetch queries the OCSP responder about a certificate in the background,
+// unless its status is already known or being queried
+func (c *Checker) Prefetch(cert *x509.Certificate) {
+
+	if c.config.OCSPServer == "" || cert == nil || cert.SerialNumber == nil {
+		return
+	}
+
+	key := keyOf(cert)
+
+	if _, err := c.ocspCache.Get(key); err == nil {
+		return
+	}
+
+	if _, err := c.ocspFailures.Get(key); err == nil {
+		return
+	}
+
+	c.query(cert)
+}
+
+// checkOCSP returns the status of the certificate given by the OCSP responder.
+// If it is not known yet, the responder is queried in the background.
+func (c *Checker) checkOCSP(cert *x509.Certificate) error {
+
+	key := keyOf(cert)
+	serial := key.serial
+
+	if answer, err := c.ocspCache.Get(key); err == nil {
+		if answer.(*ocspAnswer).status == ocsp.Revoked {
+			zap.L().Warn("Rejected certificate revoked by the OCSP responder", zap.String("serial", serial))
+			return ErrRevoked
+		}
+		return nil
+	}
+
+	if failure, err := c.ocspFailures.Get(key); err == nil {
+		return c.ocspFailure(serial, failure.(error))
+	}
+
+	c.query(cert)
+
+	return c.ocspFailure(serial, fmt.Errorf("Status not known yet"))
+}
+
+// query starts a query of the OCSP responder about a certificate, unless one
+// is already running
+func (c *Checker) query(cert *x509.Certificate) {
+
+	key := keyOf(cert)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.ocspPending[key] {
+		return
+	}
+
+	c.ocspPending[key] = true
+	c.ocspQueries.Add(1)
+
+	go func() {
+		defer c.ocspQueries.Done()
+
+		c.fetch(cert)
+
+		c.Lock()
+		delete(c.ocspPending, key)
+		c.Unlock()
+	}()
+}
+
+// refresh queries the OCSP responder again about the certificates of the
+// cached answers, so that the answers of the certificates in use stay valid
+func (c *Checker) refresh(interval time.Duration, stop chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, key := range c.ocspCache.KeyList() {
+				if answer, err := c.ocspCache.Get(key); err == nil {
+					c.query(answer.(*ocspAnswer).cert)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// fetch asks the OCSP responder about the certificate and caches the answer.
+// A failure is cached for a short time so that the responder is not asked
+// about the same certificate at every packet. A failure to refresh an answer
+// keeps the previous one until it expires.
+func (c *Checker) fetch(cert *x509.Certificate) {
+
+	key := keyOf(cert)
+
+	status, err := c.ask(cert)
+	if err != nil {
+		zap.L().Warn("Failed to check the certificate with the OCSP responder",
+			zap.String("serial", key.serial),
+			zap.String("server", c.config.OCSPServer),
+			zap.Error(err),
+		)
+		if _, cerr := c.ocspCache.Get(key); cerr != nil {
+			c.ocspFailures.AddOrUpdate(key, err)
+		}
+		return
+	}
+
+	c.ocspFailures.Remove(key) // nolint
+	c.ocspCache.AddOrUpdate(key, &ocspAnswer{cert: cert, status: status})
+}
+
+// ask sends the OCSP request of the certificate and returns its status
+func (c *Checker) ask(cert *x509.Certificate) (int, error) {
+
+	issuer := c.issuer(cert)
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.client.Post(c.config.OCSPServer, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Status %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := ocsp.ParseResponseForCert(data, cert, issuer)
+	if err != nil {
+		return 0, err
+	}
+
+	switch response.Status {
+	case ocsp.Good, ocsp.Revoked:
+		return response.Status, nil
+	default:
+		return 0, fmt.Errorf("Unknown certificate")
+	}
+}
+
+// ocspFailure decides about a certificate the OCSP responder did not answer for
+func (c *Checker) ocspFailure(serial string, err error) error {
+
+	if c.config.OCSPFailClosed {
+		return fmt.Errorf("Unable to check revocation of certificate %s: %s", serial, err)
+	}
+
+	return nil
+}
+
+// issuer returns the authority that signed the certificate. If the
+// certificate is only known by its issuer and serial number, it is the
+// authority with the issuer name, or the first authority if none matches.
+func (c *Checker) issuer(cert *x509.Certificate) *x509.Certificate {
+
+	for _, authority := range c.authorities {
+		if cert.CheckSignatureFrom(authority) == nil {
+			return authority
+		}
+	}
+
+	for _, authority := range c.authorities {
+		if len(cert.RawIssuer) > 0 && bytes.Equal(cert.RawIssuer, authority.RawSubject) {
+			return authority
+		}
+	}
+
+	return c.authorities[0]
+}
+
+// crlIssuer returns the authority that signed the CRL, or nil if it is not
+// signed by one of the authorities
+func (c *Checker) crlIssuer(crl *pkix.CertificateList) *x509.Certificate {
+
+	for _, authority := range c.authorities {
+		if authority.CheckCRLSignature(crl) == nil {
+			return authority
+		}
+	}
+
+	return nil
+}
+
+// keyOf returns the key of the certificate in the revoked certificates and
+// the OCSP answers
+func keyOf(cert *x509.Certificate) certificateKey {
+	return certificateKey{issuer: string(cert.RawIssuer), serial: cert.SerialNumber.String()}
+}
+
+// loadAuthorities parses all the certificates of the PEM buffer
+func loadAuthorities(caPEM []byte) ([]*x509.Certificate, error) {
+
+	authorities := []*x509.Certificate{}
+
+	for block, rest := pem.Decode(caPEM); block != nil; block, rest = pem.Decode(rest) {
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse authority: %s", err)
+		}
+
+		authorities = append(authorities, cert)
+	}
+
+	if len(authorities) == 0 {
+		return nil, fmt.Errorf("No authority found")
+	}
+
+	return authorities, nil
+}
@@ -0,0 +1,380 @@
+package revocation
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type authority struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	pem  []byte
+}
+
+func newAuthority(name string) *authority {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	So(err, ShouldBeNil)
+
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+
+	return &authority{
+		key:  key,
+		cert: cert,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (a *authority) issue(serial int64) *x509.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, key.Public(), a.key)
+	So(err, ShouldBeNil)
+
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+
+	return cert
+}
+
+func (a *authority) writeCRL(file string, serials ...int64) {
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, a.cert, a.key)
+	So(err, ShouldBeNil)
+
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600)
+	So(err, ShouldBeNil)
+}
+
+// ocspResponder answers with the status of the given serial numbers
+func (a *authority) ocspResponder(statuses map[int64]int) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		request, err := ocsp.ParseRequest(data)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		status, ok := statuses[request.SerialNumber.Int64()]
+		if !ok {
+			status = ocsp.Unknown
+		}
+
+		response, err := ocsp.CreateResponse(a.cert, a.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now(),
+		}, crypto.Signer(a.key))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(response) // nolint
+	}))
+}
+
+func TestCRL(t *testing.T) {
+
+	Convey("Given an authority and a CRL file", t, func() {
+		dir, err := ioutil.TempDir("", "revocation")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		ca := newAuthority("ca")
+		file := filepath.Join(dir, "ca.crl")
+		ca.writeCRL(file, 2)
+
+		config := &Config{CRLFiles: []string{file}}
+
+		Convey("When I create a checker", func() {
+			c, err := NewChecker(config, ca.pem)
+			So(err, ShouldBeNil)
+
+			Convey("The revoked certificates should be rejected", func() {
+				So(c.Check(ca.issue(2)), ShouldEqual, ErrRevoked)
+				So(c.CheckSerial(ca.cert.RawSubject, big.NewInt(2)), ShouldEqual, ErrRevoked)
+			})
+
+			Convey("The other certificates should be accepted", func() {
+				So(c.Check(ca.issue(3)), ShouldBeNil)
+				So(c.CheckSerial(ca.cert.RawSubject, big.NewInt(3)), ShouldBeNil)
+			})
+
+			Convey("The revoked serial numbers should be rejected when the issuer is not known", func() {
+				So(c.CheckSerial(nil, big.NewInt(2)), ShouldEqual, ErrRevoked)
+				So(c.CheckSerial(nil, big.NewInt(3)), ShouldBeNil)
+			})
+
+			Convey("When the CRL changes and I reload it", func() {
+				ca.writeCRL(file, 3)
+				So(c.Reload(), ShouldBeNil)
+
+				Convey("The new list should be used", func() {
+					So(c.CheckSerial(ca.cert.RawSubject, big.NewInt(2)), ShouldBeNil)
+					So(c.CheckSerial(ca.cert.RawSubject, big.NewInt(3)), ShouldEqual, ErrRevoked)
+				})
+			})
+
+			Convey("When the CRL is broken and I reload it", func() {
+				So(ioutil.WriteFile(file, []byte("garbage"), 0600), ShouldBeNil)
+
+				Convey("I should get an error and the previous list should be kept", func() {
+					So(c.Reload(), ShouldNotBeNil)
+					So(c.CheckSerial(ca.cert.RawSubject, big.NewInt(2)), ShouldEqual, ErrRevoked)
+				})
+			})
+		})
+
+		Convey("When I create a checker with a reload interval", func() {
+			config.ReloadInterval = 10 * time.Millisecond
+			c, err := NewChecker(config, ca.pem)
+			So(err, ShouldBeNil)
+
+			c.Start()
+			defer c.Stop()
+
+			ca.writeCRL(file, 3)
+
+			Convey("The new list should be loaded", func() {
+				So(func() bool {
+					for i := 0; i < 100; i++ {
+						if c.CheckSerial(ca.cert.RawSubject, big.NewInt(3)) == ErrRevoked {
+							return true
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+					return false
+				}(), ShouldBeTrue)
+			})
+		})
+
+		Convey("When I create a checker for another authority", func() {
+			_, err := NewChecker(config, newAuthority("other").pem)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I create a checker for two authorities", func() {
+			other := newAuthority("other")
+			otherFile := filepath.Join(dir, "other.crl")
+			other.writeCRL(otherFile, 3)
+
+			c, err := NewChecker(&Config{CRLFiles: []string{file, otherFile}}, append(append([]byte{}, ca.pem...), other.pem...))
+			So(err, ShouldBeNil)
+
+			Convey("A serial number should only be revoked for the authority of the CRL", func() {
+				So(c.Check(ca.issue(2)), ShouldEqual, ErrRevoked)
+				So(c.Check(other.issue(2)), ShouldBeNil)
+				So(c.Check(ca.issue(3)), ShouldBeNil)
+				So(c.Check(other.issue(3)), ShouldEqual, ErrRevoked)
+
+				So(c.CheckSerial(ca.cert.RawSubject, big.NewInt(2)), ShouldEqual, ErrRevoked)
+				So(c.CheckSerial(other.cert.RawSubject, big.NewInt(2)), ShouldBeNil)
+			})
+		})
+
+		Convey("When I create a checker with a missing CRL", func() {
+			_, err := NewChecker(&Config{CRLFiles: []string{filepath.Join(dir, "missing.crl")}}, ca.pem)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I create a checker without authority", func() {
+			_, err := NewChecker(config, []byte("garbage"))
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestOCSP(t *testing.T) {
+
+	Convey("Given an authority and an OCSP responder", t, func() {
+		ca := newAuthority("ca")
+		server := ca.ocspResponder(map[int64]int{2: ocsp.Revoked, 3: ocsp.Good})
+		defer server.Close()
+
+		c, err := NewChecker(&Config{OCSPServer: server.URL}, ca.pem)
+		So(err, ShouldBeNil)
+
+		// check returns the status of a certificate once the responder answered
+		check := func(cert *x509.Certificate) error {
+			c.Prefetch(cert)
+			c.ocspQueries.Wait()
+			return c.Check(cert)
+		}
+
+		Convey("The revoked certificates should be accepted until the responder answers", func() {
+			So(c.Check(ca.issue(2)), ShouldBeNil)
+			c.ocspQueries.Wait()
+
+			So(c.Check(ca.issue(2)), ShouldEqual, ErrRevoked)
+			So(c.CheckSerial(ca.cert.RawSubject, big.NewInt(2)), ShouldEqual, ErrRevoked)
+		})
+
+		Convey("The good certificates should be accepted", func() {
+			So(check(ca.issue(3)), ShouldBeNil)
+		})
+
+		Convey("The unknown certificates should be accepted", func() {
+			So(check(ca.issue(4)), ShouldBeNil)
+		})
+
+		Convey("When the checker fails closed", func() {
+			c.config.OCSPFailClosed = true
+
+			Convey("The certificates should be rejected until the responder answers", func() {
+				err := c.Check(ca.issue(3))
+				So(err, ShouldNotBeNil)
+				So(err, ShouldNotEqual, ErrRevoked)
+
+				c.ocspQueries.Wait()
+				So(c.Check(ca.issue(3)), ShouldBeNil)
+			})
+
+			Convey("The unknown certificates should be rejected", func() {
+				err := check(ca.issue(4))
+				So(err, ShouldNotBeNil)
+				So(err, ShouldNotEqual, ErrRevoked)
+			})
+		})
+
+		Convey("When the responder goes away", func() {
+			So(check(ca.issue(2)), ShouldEqual, ErrRevoked)
+			So(check(ca.issue(3)), ShouldBeNil)
+			server.Close()
+
+			Convey("The cached answers should be used", func() {
+				So(c.Check(ca.issue(2)), ShouldEqual, ErrRevoked)
+			})
+
+			Convey("A failed refresh should keep the cached answers", func() {
+				c.query(ca.issue(2))
+				c.ocspQueries.Wait()
+
+				So(c.Check(ca.issue(2)), ShouldEqual, ErrRevoked)
+			})
+
+			Convey("The other certificates should be accepted unless the checker fails closed", func() {
+				So(check(ca.issue(5)), ShouldBeNil)
+
+				c.config.OCSPFailClosed = true
+				So(check(ca.issue(6)), ShouldNotBeNil)
+			})
+
+			Convey("The failures should be cached", func() {
+				So(check(ca.issue(5)), ShouldBeNil)
+				key := certificateKey{issuer: string(ca.cert.RawSubject), serial: "5"}
+				_, err := c.ocspFailures.Get(key)
+				So(err, ShouldBeNil)
+
+				c.Prefetch(ca.issue(5))
+				c.RLock()
+				pending := c.ocspPending[key]
+				c.RUnlock()
+				So(pending, ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given a checker with the answer of an OCSP responder", t, func() {
+		ca := newAuthority("ca")
+		server := ca.ocspResponder(map[int64]int{2: ocsp.Good})
+		defer server.Close()
+
+		c, err := NewChecker(&Config{OCSPServer: server.URL}, ca.pem)
+		So(err, ShouldBeNil)
+
+		cert := ca.issue(2)
+		c.Prefetch(cert)
+		c.ocspQueries.Wait()
+		So(c.Check(cert), ShouldBeNil)
+
+		Convey("When the certificate is revoked, the refresh should reject it", func() {
+			revoked := ca.ocspResponder(map[int64]int{2: ocsp.Revoked})
+			defer revoked.Close()
+			c.config.OCSPServer = revoked.URL
+
+			stop := make(chan struct{})
+			go c.refresh(10*time.Millisecond, stop)
+			defer close(stop)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for c.Check(cert) == nil && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			So(c.Check(cert), ShouldEqual, ErrRevoked)
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package rpcwrapper
+
+import (
+	"errors"
+
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// NewEnforcePayload returns the payload enforcing the policy of a PU
+func NewEnforcePayload(contextID string, puInfo *policy.PUInfo) *EnforcePayload {
+
+	return &EnforcePayload{
+		ContextID:        contextID,
+		ManagementID:     puInfo.Policy.ManagementID(),
+		TriremeAction:    puInfo.Policy.TriremeAction(),
+		ApplicationACLs:  puInfo.Policy.ApplicationACLs(),
+		NetworkACLs:      puInfo.Policy.NetworkACLs(),
+		PolicyIPs:        puInfo.Policy.IPAddresses(),
+		Annotations:      puInfo.Policy.Annotations(),
+		Identity:         puInfo.Policy.Identity(),
+		ReceiverRules:    puInfo.Policy.ReceiverRules(),
+		TransmitterRules: puInfo.Policy.TransmitterRules(),
+		TriremeNetworks:  puInfo.Policy.TriremeNetworks(),
+		ExcludedNetworks: puInfo.Policy.ExcludedNetworks(),
+		FailurePolicy:    puInfo.Policy.FailurePolicy(),
+	}
+}
+
+// NewSupervisePayload returns the payload supervising a PU with its policy
+func NewSupervisePayload(contextID string, puInfo *policy.PUInfo) *SuperviseRequestPayload {
+
+	return &SuperviseRequestPayload{
+		ContextID:        contextID,
+		ManagementID:     puInfo.Policy.ManagementID(),
+		TriremeAction:    puInfo.Policy.TriremeAction(),
+		ApplicationACLs:  puInfo.Policy.ApplicationACLs(),
+		NetworkACLs:      puInfo.Policy.NetworkACLs(),
+		PolicyIPs:        puInfo.Policy.IPAddresses(),
+		Annotations:      puInfo.Policy.Annotations(),
+		Identity:         puInfo.Policy.Identity(),
+		ReceiverRules:    puInfo.Policy.ReceiverRules(),
+		TransmitterRules: puInfo.Policy.TransmitterRules(),
+		ExcludedNetworks: puInfo.Policy.ExcludedNetworks(),
+		TriremeNetworks:  puInfo.Policy.TriremeNetworks(),
+		FailurePolicy:    puInfo.Policy.FailurePolicy(),
+	}
+}
+
+// Batch collects the enforce and supervise requests of PUs by remote
+// enforcer, so that each remote enforcer gets them in a single call. A remote
+// enforcer serves a single PU and is reached with its context ID, so each
+// payload of a batch only holds the requests of that context ID.
+type Batch struct {
+	payloads map[string]*BatchPayload
+}
+
+// NewBatch creates an empty batch
+func NewBatch() *Batch {
+
+	return &Batch{
+		payloads: map[string]*BatchPayload{},
+	}
+}
+
+// payload returns the payload of a remote enforcer
+func (b *Batch) payload(contextID string) *BatchPayload {
+
+	p, ok := b.payloads[contextID]
+	if !ok {
+		p = &BatchPayload{}
+		b.payloads[contextID] = p
+	}
+
+	return p
+}
+
+// Enforce adds the request enforcing the policy of a PU to the payload of its
+// remote enforcer
+func (b *Batch) Enforce(contextID string, puInfo *policy.PUInfo) {
+
+	p := b.payload(contextID)
+	p.Enforce = append(p.Enforce, *NewEnforcePayload(contextID, puInfo))
+}
+
+// Supervise adds the request supervising a PU to the payload of its remote
+// enforcer
+func (b *Batch) Supervise(contextID string, puInfo *policy.PUInfo) {
+
+	p := b.payload(contextID)
+	p.Supervise = append(p.Supervise, *NewSupervisePayload(contextID, puInfo))
+}
+
+// Send makes one call per remote enforcer and returns the errors by context
+// ID. A remote enforcer reports the PUs that failed in the response of a
+// successful call. When the call itself fails, the response is lost and all
+// the PUs of the remote enforcer get the error of the call.
+func (b *Batch) Send(client RPCClient) map[string]error {
+
+	errs := map[string]error{}
+
+	for contextID, payload := range b.payloads {
+
+		resp := &Response{}
+		if err := client.RemoteCall(contextID, "Server.Batch", &Request{Payload: payload}, resp); err != nil {
+			for _, p := range payload.Enforce {
+				errs[p.ContextID] = err
+			}
+			for _, p := range payload.Supervise {
+				errs[p.ContextID] = err
+			}
+			continue
+		}
+
+		report, _ := resp.Payload.(BatchResponsePayload) // nolint
+		for id, reason := range report.Errors {
+			errs[id] = errors.New(reason)
+		}
+	}
+
+	return errs
+}
@@ -230,6 +230,7 @@ func RegisterTypes() {
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Init_Request_Payload", *(&InitRequestPayload{}))
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Init_Response_Payload", *(&InitResponsePayload{}))
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Init_Supervisor_Payload", *(&InitSupervisorPayload{}))
+	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Update_Secrets_Payload", *(&UpdateSecretsPayload{}))
 
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Enforce_Payload", *(&EnforcePayload{}))
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.UnEnforce_Payload", *(&UnEnforcePayload{}))
@@ -237,4 +238,10 @@ func RegisterTypes() {
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Supervise_Request_Payload", *(&SuperviseRequestPayload{}))
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.UnSupervise_Payload", *(&UnSupervisePayload{}))
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Stats_Payload", *(&StatsPayload{}))
+
+	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Status_Payload", *(&StatusPayload{}))
+	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Status_Response_Payload", *(&StatusResponsePayload{}))
+
+	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Batch_Payload", *(&BatchPayload{}))
+	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Batch_Response_Payload", *(&BatchResponsePayload{}))
 }
@@ -4,8 +4,12 @@ import (
 	"time"
 
 	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/enforcer"
 	"github.com/aporeto-inc/trireme/enforcer/utils/fqconfig"
+	"github.com/aporeto-inc/trireme/enforcer/utils/replay"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/enforcer/utils/tokens"
 	"github.com/aporeto-inc/trireme/policy"
 )
 
@@ -17,6 +21,8 @@ const (
 	IPTables CaptureType = iota
 	// IPSets forces an IPSet implementation
 	IPSets
+	// NFTables forces an nftables implementation
+	NFTables
 )
 
 //Request exported
@@ -34,7 +40,8 @@ const (
 //Response is the response for every RPC call. This is used to carry the status of the actual function call
 //made on the remote end
 type Response struct {
-	Status string
+	Status  string
+	Payload interface{}
 }
 
 //InitRequestPayload Payload for enforcer init request
@@ -48,6 +55,22 @@ type InitRequestPayload struct {
 	PublicPEM  []byte                     `json:",omitempty"`
 	PrivatePEM []byte                     `json:",omitempty"`
 	Token      []byte                     `json:",omitempty"`
+	Revocation *revocation.Config         `json:",omitempty"`
+	SPIFFE     string                     `json:",omitempty"`
+	TokenType  tokens.TokenType           `json:",omitempty"`
+	Replay     *replay.Config             `json:",omitempty"`
+}
+
+//UpdateSecretsPayload carries the new key material of the remote enforcer
+type UpdateSecretsPayload struct {
+	SecretType secrets.PrivateSecretsType `json:",omitempty"`
+	CAPEM      []byte                     `json:",omitempty"`
+	PublicPEM  []byte                     `json:",omitempty"`
+	PrivatePEM []byte                     `json:",omitempty"`
+	Token      []byte                     `json:",omitempty"`
+	Overlap    time.Duration              `json:",omitempty"`
+	Revocation *revocation.Config         `json:",omitempty"`
+	SPIFFE     string                     `json:",omitempty"`
 }
 
 //InitSupervisorPayload for supervisor init request
@@ -70,6 +93,7 @@ type EnforcePayload struct {
 	TransmitterRules policy.TagSelectorList `json:",omitempty"`
 	TriremeNetworks  []string               `json:",omitempty"`
 	ExcludedNetworks []string               `json:",omitempty"`
+	FailurePolicy    policy.FailurePolicy   `json:",omitempty"`
 }
 
 //SuperviseRequestPayload for Supervise request
@@ -86,6 +110,21 @@ type SuperviseRequestPayload struct {
 	TransmitterRules policy.TagSelectorList `json:",omitempty"`
 	ExcludedNetworks []string               `json:",omitempty"`
 	TriremeNetworks  []string               `json:",omitempty"`
+	FailurePolicy    policy.FailurePolicy   `json:",omitempty"`
+}
+
+//BatchPayload carries the enforce and supervise requests of a remote enforcer in
+//a single call. The policies are enforced and then supervised, in order. As a
+//remote enforcer serves a single PU, all the requests are for its context ID.
+type BatchPayload struct {
+	Enforce   []EnforcePayload          `json:",omitempty"`
+	Supervise []SuperviseRequestPayload `json:",omitempty"`
+}
+
+//BatchResponsePayload carries the errors of a batch by context ID. It is only
+//received when the call succeeds, so a batch that partially fails still succeeds.
+type BatchResponsePayload struct {
+	Errors map[string]string `json:",omitempty"`
 }
 
 //UnEnforcePayload payload for unenforce request
@@ -118,9 +157,20 @@ type UnEnforceResponsePayload struct {
 	Status int `json:",omitempty"`
 }
 
-//StatsPayload is the payload carries by the stats reporting form the remote enforcer
+//StatusPayload payload for status and ping requests
+type StatusPayload struct {
+	ContextID string `json:",omitempty"`
+}
+
+//StatusResponsePayload carries the health of the remote enforcer
+type StatusResponsePayload struct {
+	Status *enforcer.Status `json:",omitempty"`
+}
+
+//StatsPayload is the payload carries by the stats reporting form the remote enforcer.
+//It holds every flow record collected since the last report.
 type StatsPayload struct {
-	Flows map[string]*collector.FlowRecord `json:",omitempty"`
+	Flows []*collector.FlowRecord `json:",omitempty"`
 }
 
 //ExcludeIPRequestPayload carries the list of excluded ips
@@ -1,12 +1,12 @@
 package secrets
 
 import (
-	"crypto/ecdsa"
 	"crypto/x509"
 	"fmt"
 
 	"github.com/aporeto-inc/trireme/crypto"
 	"github.com/aporeto-inc/trireme/enforcer/utils/pkiverifier"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
 	"go.uber.org/zap"
 )
 
@@ -15,19 +15,22 @@ type CompactPKI struct {
 	PrivateKeyPEM []byte
 	PublicKeyPEM  []byte
 	AuthorityPEM  []byte
-	privateKey    *ecdsa.PrivateKey
+	privateKey    interface{}
 	publicKey     *x509.Certificate
 	certPool      *x509.CertPool
 	txKey         []byte
 	verifier      *pkiverifier.PKIConfiguration
+	revocation    *revocation.Checker
 }
 
-// NewCompactPKI creates new secrets for PKI implementation based on compact encoding
+// NewCompactPKI creates new secrets for PKI implementation based on compact encoding.
+// The keys of the node and of the authority can be EC keys of the P-256 or
+// P-384 curves, or Ed25519 keys.
 func NewCompactPKI(keyPEM, certPEM, caPEM, txKey []byte) (*CompactPKI, error) {
 
 	zap.L().Debug("Initializing with Compact PKI")
 
-	key, cert, caCertPool, err := crypto.LoadAndVerifyECSecrets(keyPEM, certPEM, caPEM)
+	key, cert, caCertPool, err := crypto.LoadAndVerifySecrets(keyPEM, certPEM, caPEM)
 	if err != nil {
 		return nil, err
 	}
@@ -49,7 +52,7 @@ func NewCompactPKI(keyPEM, certPEM, caPEM, txKey []byte) (*CompactPKI, error) {
 		publicKey:     cert,
 		certPool:      caCertPool,
 		txKey:         txKey,
-		verifier:      pkiverifier.NewConfig(caKey.PublicKey.(*ecdsa.PublicKey), nil, -1),
+		verifier:      pkiverifier.NewConfig(caKey.PublicKey, nil, -1),
 	}
 
 	return p, nil
@@ -75,7 +78,7 @@ func (p *CompactPKI) DecodingKey(server string, ackKey interface{}, prevKey inte
 
 	// If we have an inband certificate, return this one
 	if ackKey != nil {
-		return ackKey.(*ecdsa.PublicKey), nil
+		return ackKey, nil
 	}
 
 	// Otherwise, return the prevCert
@@ -101,7 +104,7 @@ func (p *CompactPKI) TransmittedKey() []byte {
 
 // AckSize returns the default size of an ACK packet
 func (p *CompactPKI) AckSize() uint32 {
-	return uint32(322)
+	return ackSize(322, p.privateKey)
 }
 
 // AuthPEM returns the Certificate Authority PEM
@@ -118,3 +121,14 @@ func (p *CompactPKI) TransmittedPEM() []byte {
 func (p *CompactPKI) EncodingPEM() []byte {
 	return p.PrivateKeyPEM
 }
+
+// SetRevocation sets the checker that rejects the tokens of revoked certificates
+func (p *CompactPKI) SetRevocation(c *revocation.Checker) {
+	p.revocation = c
+	p.verifier.SetRevocation(c)
+}
+
+// Revocation returns the checker that rejects the tokens of revoked certificates
+func (p *CompactPKI) Revocation() *revocation.Checker {
+	return p.revocation
+}
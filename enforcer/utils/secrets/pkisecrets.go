@@ -1,13 +1,13 @@
 package secrets
 
 import (
-	"crypto/ecdsa"
 	"crypto/x509"
 	"fmt"
 
 	"go.uber.org/zap"
 
 	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
 )
 
 // PKISecrets holds all PKI information
@@ -15,15 +15,18 @@ type PKISecrets struct {
 	PrivateKeyPEM    []byte
 	PublicKeyPEM     []byte
 	AuthorityPEM     []byte
-	CertificateCache map[string]*ecdsa.PublicKey
-	privateKey       *ecdsa.PrivateKey
+	CertificateCache map[string]interface{}
+	certificates     map[string]*x509.Certificate
+	privateKey       interface{}
 	publicKey        *x509.Certificate
 	certPool         *x509.CertPool
+	revocation       *revocation.Checker
 }
 
-// NewPKISecrets creates new secrets for PKI implementations
-func NewPKISecrets(keyPEM, certPEM, caPEM []byte, certCache map[string]*ecdsa.PublicKey) (*PKISecrets, error) {
-	key, cert, caCertPool, err := crypto.LoadAndVerifyECSecrets(keyPEM, certPEM, caPEM)
+// NewPKISecrets creates new secrets for PKI implementations. The key can be
+// an EC key of the P-256 or P-384 curves, or an Ed25519 key.
+func NewPKISecrets(keyPEM, certPEM, caPEM []byte, certCache map[string]interface{}) (*PKISecrets, error) {
+	key, cert, caCertPool, err := crypto.LoadAndVerifySecrets(keyPEM, certPEM, caPEM)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid certificates")
 	}
@@ -33,6 +36,7 @@ func NewPKISecrets(keyPEM, certPEM, caPEM []byte, certCache map[string]*ecdsa.Pu
 		PublicKeyPEM:     certPEM,
 		AuthorityPEM:     caPEM,
 		CertificateCache: certCache,
+		certificates:     map[string]*x509.Certificate{},
 		privateKey:       key,
 		publicKey:        cert,
 		certPool:         caCertPool,
@@ -67,15 +71,28 @@ func (p *PKISecrets) DecodingKey(server string, ackCert interface{}, prevCert in
 			return nil, fmt.Errorf("No certificate in cache for server %s", server)
 		}
 
+		// The certificate is checked at every use so that the reloads of the
+		// revocation lists apply to the cached certificates
+		if p.revocation != nil {
+			if err := p.checkCachedCertificate(server); err != nil {
+				return nil, err
+			}
+		}
+
 		return cert, nil
 	}
 
 	// If we have an inband certificate, return this one
 	if ackCert != nil {
-		return ackCert.(*x509.Certificate).PublicKey.(*ecdsa.PublicKey), nil
+		return ackCert.(*x509.Certificate).PublicKey, nil
+	}
+
+	// Otherwise, return the prevCert. It is the certificate of the peer
+	// returned when its SYN or SYN/ACK was verified.
+	if cert, ok := prevCert.(*x509.Certificate); ok {
+		return cert.PublicKey, nil
 	}
 
-	// Otherwise, return the prevCert
 	if prevCert != nil {
 		return prevCert, nil
 	}
@@ -91,6 +108,12 @@ func (p *PKISecrets) VerifyPublicKey(pkey []byte) (interface{}, error) {
 		return nil, err
 	}
 
+	if p.revocation != nil {
+		if err := p.revocation.Check(decodedCert); err != nil {
+			return nil, err
+		}
+	}
+
 	return decodedCert, nil
 }
 
@@ -102,7 +125,7 @@ func (p *PKISecrets) TransmittedKey() []byte {
 
 // AckSize returns the default size of an ACK packet
 func (p *PKISecrets) AckSize() uint32 {
-	return uint32(336)
+	return ackSize(336, p.privateKey)
 }
 
 // PublicKeyAdd validates the parameter certificate.
@@ -115,12 +138,36 @@ func (p *PKISecrets) PublicKeyAdd(host string, newCert []byte) error {
 		return fmt.Errorf("Error loading new Cert: %s", err)
 	}
 
+	if p.revocation != nil {
+		if err := p.revocation.Check(cert); err != nil {
+			return fmt.Errorf("Error loading new Cert: %s", err)
+		}
+	}
+
 	zap.L().Debug("Adding Cert for host", zap.String("host", host))
 
-	p.CertificateCache[host] = cert.PublicKey.(*ecdsa.PublicKey)
+	if _, err := crypto.SigningMethod(cert.PublicKey); err != nil {
+		return fmt.Errorf("Error loading new Cert: %s", err)
+	}
+
+	p.CertificateCache[host] = cert.PublicKey
+	p.certificates[host] = cert
 	return nil
 }
 
+// checkCachedCertificate checks the revocation of the certificate of a server of
+// the cache. The keys added to the cache without their certificate are rejected
+// since their revocation can not be checked.
+func (p *PKISecrets) checkCachedCertificate(server string) error {
+
+	cert, ok := p.certificates[server]
+	if !ok {
+		return fmt.Errorf("No certificate to check the revocation of server %s", server)
+	}
+
+	return p.revocation.Check(cert)
+}
+
 // AuthPEM returns the Certificate Authority PEM
 func (p *PKISecrets) AuthPEM() []byte {
 	return p.AuthorityPEM
@@ -135,3 +182,13 @@ func (p *PKISecrets) TransmittedPEM() []byte {
 func (p *PKISecrets) EncodingPEM() []byte {
 	return p.PrivateKeyPEM
 }
+
+// SetRevocation sets the checker that rejects revoked certificates
+func (p *PKISecrets) SetRevocation(c *revocation.Checker) {
+	p.revocation = c
+}
+
+// Revocation returns the checker that rejects revoked certificates
+func (p *PKISecrets) Revocation() *revocation.Checker {
+	return p.revocation
+}
@@ -1,11 +1,24 @@
 package secrets
 
 import (
+	gocrypto "crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
+	"github.com/aporeto-inc/trireme/enforcer/utils/spiffe"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -105,10 +118,84 @@ func TestPKIBasicInterfaceFunctions(t *testing.T) {
 	})
 }
 
+func TestPKIKeyTypes(t *testing.T) {
+
+	// newSecrets creates PKI secrets with the key and a certificate of the
+	// key. The key of the secrets can be another one.
+	newSecrets := func(key gocrypto.Signer, certKey gocrypto.Signer) (*PKISecrets, *spiffe.X509SVID, error) {
+		domain := newTrustDomain()
+		svid := domain.issue("spiffe://example.org/node", certKey)
+
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		So(err, ShouldBeNil)
+
+		p, err := NewPKISecrets(
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+			certificatePEM(svid),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: domain.bundle[0].Raw}),
+			nil,
+		)
+
+		return p, svid, err
+	}
+
+	Convey("Given PKI secrets with an Ed25519 key", t, func() {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		p, svid, err := newSecrets(key, key)
+		So(err, ShouldBeNil)
+
+		Convey("The key should be used", func() {
+			So(p.EncodingKey(), ShouldResemble, key)
+			So(p.AckSize(), ShouldEqual, 336)
+		})
+
+		Convey("The public key of the peer should be returned as is", func() {
+			cert, err := p.VerifyPublicKey(certificatePEM(svid))
+			So(err, ShouldBeNil)
+			pk, err := p.DecodingKey("server", cert, nil)
+			So(err, ShouldBeNil)
+			So(pk, ShouldResemble, key.Public())
+		})
+
+		Convey("Its certificate should be added to the cache", func() {
+			p.CertificateCache = map[string]interface{}{}
+			So(p.PublicKeyAdd("server1", certificatePEM(svid)), ShouldBeNil)
+			pk, err := p.DecodingKey("server1", nil, nil)
+			So(err, ShouldBeNil)
+			So(pk, ShouldResemble, key.Public())
+		})
+	})
+
+	Convey("Given PKI secrets with a P-384 key", t, func() {
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		So(err, ShouldBeNil)
+		p, _, err := newSecrets(key, key)
+		So(err, ShouldBeNil)
+
+		Convey("The ACK packets should be longer", func() {
+			So(p.AckSize(), ShouldEqual, 336+42)
+		})
+	})
+
+	Convey("Given a key that does not match the certificate", t, func() {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		_, other, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+
+		_, _, err = newSecrets(key, other)
+
+		Convey("I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
 func TestPKICache(t *testing.T) {
 	Convey("Given PKI secrets with a cache", t, func() {
 		_, cert, _, _ := crypto.LoadAndVerifyECSecrets([]byte(privateKeyPEM), []byte(publicPEM), []byte(caPEM))
-		cache := map[string]*ecdsa.PublicKey{}
+		cache := map[string]interface{}{}
 		p, err := NewPKISecrets([]byte(privateKeyPEM), []byte(publicPEM), []byte(caPEM), cache)
 		So(err, ShouldBeNil)
 		So(p, ShouldNotBeNil)
@@ -135,3 +222,135 @@ func TestPKICache(t *testing.T) {
 
 	})
 }
+
+func TestPKIRevocation(t *testing.T) {
+
+	Convey("Given PKI secrets with a revocation checker", t, func() {
+		dir, err := ioutil.TempDir("", "secrets")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		caTemplate := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "ca"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+		So(err, ShouldBeNil)
+		ca, err := x509.ParseCertificate(caDER)
+		So(err, ShouldBeNil)
+
+		issue := func(serial int64) ([]byte, []byte) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			So(err, ShouldBeNil)
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(serial),
+				Subject:      pkix.Name{CommonName: "node"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+			So(err, ShouldBeNil)
+			keyDER, err := x509.MarshalECPrivateKey(key)
+			So(err, ShouldBeNil)
+			return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		}
+
+		crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now(),
+			NextUpdate: time.Now().Add(time.Hour),
+			RevokedCertificateEntries: []x509.RevocationListEntry{
+				{SerialNumber: big.NewInt(3), RevocationTime: time.Now()},
+			},
+		}, ca, caKey)
+		So(err, ShouldBeNil)
+		file := filepath.Join(dir, "ca.crl")
+		So(ioutil.WriteFile(file, crlDER, 0600), ShouldBeNil)
+
+		authPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+		checker, err := revocation.NewChecker(&revocation.Config{CRLFiles: []string{file}}, authPEM)
+		So(err, ShouldBeNil)
+
+		keyPEM, certPEM := issue(2)
+		p, err := NewPKISecrets(keyPEM, certPEM, authPEM, map[string]interface{}{})
+		So(err, ShouldBeNil)
+		p.SetRevocation(checker)
+		So(p.Revocation(), ShouldEqual, checker)
+
+		_, revokedPEM := issue(3)
+		_, validPEM := issue(4)
+
+		Convey("The revoked certificates should be rejected", func() {
+			_, err := p.VerifyPublicKey(revokedPEM)
+			So(err, ShouldEqual, revocation.ErrRevoked)
+
+			So(p.PublicKeyAdd("revoked", revokedPEM), ShouldNotBeNil)
+			So(p.CertificateCache, ShouldNotContainKey, "revoked")
+		})
+
+		Convey("The other certificates should be accepted", func() {
+			cert, err := p.VerifyPublicKey(validPEM)
+			So(err, ShouldBeNil)
+			So(cert.(*x509.Certificate).SerialNumber.Int64(), ShouldEqual, 4)
+
+			So(p.PublicKeyAdd("valid", validPEM), ShouldBeNil)
+			So(p.CertificateCache, ShouldContainKey, "valid")
+		})
+
+		Convey("When a cached certificate is revoked and the CRL is reloaded", func() {
+			So(p.PublicKeyAdd("valid", validPEM), ShouldBeNil)
+			_, err := p.DecodingKey("valid", nil, nil)
+			So(err, ShouldBeNil)
+
+			crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+				Number:     big.NewInt(2),
+				ThisUpdate: time.Now(),
+				NextUpdate: time.Now().Add(time.Hour),
+				RevokedCertificateEntries: []x509.RevocationListEntry{
+					{SerialNumber: big.NewInt(4), RevocationTime: time.Now()},
+				},
+			}, ca, caKey)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(file, crlDER, 0600), ShouldBeNil)
+			So(checker.Reload(), ShouldBeNil)
+
+			Convey("Its key should be rejected", func() {
+				_, err := p.DecodingKey("valid", nil, nil)
+				So(err, ShouldEqual, revocation.ErrRevoked)
+			})
+		})
+
+		Convey("A cached key without certificate should be rejected", func() {
+			p.CertificateCache["static"] = ca.PublicKey
+
+			_, err := p.DecodingKey("static", nil, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When they are rotating secrets", func() {
+			r := NewRotatingSecrets(p)
+			So(r.Revocation(), ShouldEqual, checker)
+
+			keyPEM, certPEM := issue(5)
+			next, err := NewPKISecrets(keyPEM, certPEM, authPEM, map[string]interface{}{})
+			So(err, ShouldBeNil)
+			So(r.Rotate(next, time.Minute), ShouldBeNil)
+			So(r.Revocation(), ShouldBeNil)
+			r.SetRevocation(checker)
+			So(next.Revocation(), ShouldEqual, checker)
+
+			Convey("The revoked certificates should be rejected", func() {
+				_, err := r.VerifyPublicKey(revokedPEM)
+				So(err, ShouldEqual, revocation.ErrRevoked)
+			})
+		})
+	})
+}
@@ -0,0 +1,211 @@
+package secrets
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
+)
+
+// pemSecrets is implemented by the secrets that can be sent to a remote enforcer
+type pemSecrets interface {
+	AuthPEM() []byte
+	TransmittedPEM() []byte
+	EncodingPEM() []byte
+}
+
+// OverlappingSecrets are secrets that still accept the keys of the secrets
+// they replaced for an overlap window. The tokens whose signature does not
+// verify with the current decoding key are verified again with the previous one.
+type OverlappingSecrets interface {
+
+	// PreviousDecodingKey returns the decoding key of the previous secrets. It
+	// fails when there are none or when the overlap window is over.
+	PreviousDecodingKey(server string, ackCert, prevCert interface{}) (interface{}, error)
+}
+
+// RotatingSecrets are secrets whose key material can be replaced at runtime.
+// New tokens are always signed with the current secrets. For an overlap window
+// after a rotation, received tokens are also verified with the previous
+// secrets, so that peers that did not rotate yet are still accepted. The
+// previous secrets are used when the current ones fail to verify a
+// certificate or find a key, and through OverlappingSecrets when a signature
+// does not verify, which is how a pre-shared key is rotated. A revoked
+// certificate is never retried with the previous secrets.
+type RotatingSecrets struct {
+	current  Secrets
+	previous Secrets
+	expiry   time.Time
+
+	sync.RWMutex
+}
+
+// NewRotatingSecrets creates rotating secrets starting with the given secrets
+func NewRotatingSecrets(s Secrets) *RotatingSecrets {
+
+	return &RotatingSecrets{
+		current: s,
+	}
+}
+
+// Rotate replaces the current secrets. The replaced secrets are still used for
+// verification for the overlap duration. Only the last replaced secrets are
+// kept, and the type of the secrets cannot change.
+func (r *RotatingSecrets) Rotate(s Secrets, overlap time.Duration) error {
+
+	if s == nil {
+		return fmt.Errorf("Secrets can not be nil")
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if s.Type() != r.current.Type() {
+		return fmt.Errorf("Secrets type can not change from %d to %d", r.current.Type(), s.Type())
+	}
+
+	r.previous = nil
+	if overlap > 0 {
+		r.previous = r.current
+		r.expiry = time.Now().Add(overlap)
+	}
+	r.current = s
+
+	return nil
+}
+
+// Current returns the secrets currently used for signing
+func (r *RotatingSecrets) Current() Secrets {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.current
+}
+
+// secrets returns the current secrets and the previous ones if the overlap
+// window is not over
+func (r *RotatingSecrets) secrets() (Secrets, Secrets) {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.previous != nil && time.Now().Before(r.expiry) {
+		return r.current, r.previous
+	}
+
+	return r.current, nil
+}
+
+// Type implements the interface Secrets
+func (r *RotatingSecrets) Type() PrivateSecretsType {
+	return r.Current().Type()
+}
+
+// EncodingKey returns the encoding key of the current secrets
+func (r *RotatingSecrets) EncodingKey() interface{} {
+	return r.Current().EncodingKey()
+}
+
+// PublicKey returns the public key of the current secrets
+func (r *RotatingSecrets) PublicKey() interface{} {
+	return r.Current().PublicKey()
+}
+
+// DecodingKey returns the decoding key of the current secrets, or of the
+// previous secrets during the overlap window
+func (r *RotatingSecrets) DecodingKey(server string, ackCert, prevCert interface{}) (interface{}, error) {
+
+	current, previous := r.secrets()
+
+	key, err := current.DecodingKey(server, ackCert, prevCert)
+	if err != nil && err != revocation.ErrRevoked && previous != nil {
+		return previous.DecodingKey(server, ackCert, prevCert)
+	}
+
+	return key, err
+}
+
+// PreviousDecodingKey implements the interface OverlappingSecrets
+func (r *RotatingSecrets) PreviousDecodingKey(server string, ackCert, prevCert interface{}) (interface{}, error) {
+
+	_, previous := r.secrets()
+	if previous == nil {
+		return nil, fmt.Errorf("No previous secrets")
+	}
+
+	return previous.DecodingKey(server, ackCert, prevCert)
+}
+
+// VerifyPublicKey verifies the inband public key with the current secrets, or
+// with the previous secrets during the overlap window
+func (r *RotatingSecrets) VerifyPublicKey(pkey []byte) (interface{}, error) {
+
+	current, previous := r.secrets()
+
+	key, err := current.VerifyPublicKey(pkey)
+	if err != nil && err != revocation.ErrRevoked && previous != nil {
+		return previous.VerifyPublicKey(pkey)
+	}
+
+	return key, err
+}
+
+// TransmittedKey returns the transmitted key of the current secrets
+func (r *RotatingSecrets) TransmittedKey() []byte {
+	return r.Current().TransmittedKey()
+}
+
+// AckSize returns the ack size of the current secrets
+func (r *RotatingSecrets) AckSize() uint32 {
+	return r.Current().AckSize()
+}
+
+// AuthPEM returns the Certificate Authority PEM of the current secrets
+func (r *RotatingSecrets) AuthPEM() []byte {
+
+	if s, ok := r.Current().(pemSecrets); ok {
+		return s.AuthPEM()
+	}
+
+	return nil
+}
+
+// TransmittedPEM returns the PEM certificate of the current secrets
+func (r *RotatingSecrets) TransmittedPEM() []byte {
+
+	if s, ok := r.Current().(pemSecrets); ok {
+		return s.TransmittedPEM()
+	}
+
+	return nil
+}
+
+// EncodingPEM returns the key PEM of the current secrets
+func (r *RotatingSecrets) EncodingPEM() []byte {
+
+	if s, ok := r.Current().(pemSecrets); ok {
+		return s.EncodingPEM()
+	}
+
+	return nil
+}
+
+// SetRevocation sets the revocation checker of the current secrets
+func (r *RotatingSecrets) SetRevocation(c *revocation.Checker) {
+
+	if s, ok := r.Current().(RevocationChecking); ok {
+		s.SetRevocation(c)
+	}
+}
+
+// Revocation returns the revocation checker of the current secrets
+func (r *RotatingSecrets) Revocation() *revocation.Checker {
+
+	if s, ok := r.Current().(RevocationChecking); ok {
+		return s.Revocation()
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package secrets
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// keySecrets accept a single public key
+type keySecrets struct {
+	*PSKSecrets
+	key string
+}
+
+func (k *keySecrets) VerifyPublicKey(pkey []byte) (interface{}, error) {
+
+	if string(pkey) != k.key {
+		return nil, fmt.Errorf("Unknown key %s", string(pkey))
+	}
+
+	return k.key, nil
+}
+
+func (k *keySecrets) DecodingKey(server string, ackCert, prevCert interface{}) (interface{}, error) {
+
+	if ackCert != k.key {
+		return nil, fmt.Errorf("Unknown key")
+	}
+
+	return k.key, nil
+}
+
+// revokedSecrets reject every key as revoked
+type revokedSecrets struct {
+	*keySecrets
+}
+
+func (r *revokedSecrets) VerifyPublicKey(pkey []byte) (interface{}, error) {
+	return nil, revocation.ErrRevoked
+}
+
+func (r *revokedSecrets) DecodingKey(server string, ackCert, prevCert interface{}) (interface{}, error) {
+	return nil, revocation.ErrRevoked
+}
+
+func newKeySecrets(key string) *keySecrets {
+	return &keySecrets{PSKSecrets: NewPSKSecrets([]byte(key)), key: key}
+}
+
+func TestRotatingSecrets(t *testing.T) {
+
+	Convey("Given rotating secrets", t, func() {
+		old := newKeySecrets("old")
+		r := NewRotatingSecrets(old)
+
+		Convey("The current secrets should be used", func() {
+			So(r.Type(), ShouldEqual, PSKType)
+			So(r.EncodingKey(), ShouldResemble, []byte("old"))
+			So(r.EncodingPEM(), ShouldResemble, []byte("old"))
+			So(r.AckSize(), ShouldEqual, old.AckSize())
+
+			key, err := r.VerifyPublicKey([]byte("old"))
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "old")
+		})
+
+		Convey("When I rotate the secrets with an overlap window", func() {
+			err := r.Rotate(newKeySecrets("new"), time.Minute)
+			So(err, ShouldBeNil)
+
+			Convey("The new secrets should be used for signing", func() {
+				So(r.EncodingKey(), ShouldResemble, []byte("new"))
+				So(r.EncodingPEM(), ShouldResemble, []byte("new"))
+			})
+
+			Convey("Both the new and the old keys should be verified", func() {
+				key, err := r.VerifyPublicKey([]byte("new"))
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "new")
+
+				key, err = r.VerifyPublicKey([]byte("old"))
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "old")
+
+				key, err = r.DecodingKey("server", "old", nil)
+				So(err, ShouldBeNil)
+				So(key, ShouldEqual, "old")
+
+				_, err = r.VerifyPublicKey([]byte("other"))
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("When I rotate them again", func() {
+				err := r.Rotate(newKeySecrets("newer"), time.Minute)
+				So(err, ShouldBeNil)
+
+				Convey("Only the last replaced key should still be verified", func() {
+					_, err := r.VerifyPublicKey([]byte("new"))
+					So(err, ShouldBeNil)
+
+					_, err = r.VerifyPublicKey([]byte("old"))
+					So(err, ShouldNotBeNil)
+				})
+			})
+		})
+
+		Convey("When the overlap window is over", func() {
+			err := r.Rotate(newKeySecrets("new"), time.Millisecond)
+			So(err, ShouldBeNil)
+			time.Sleep(5 * time.Millisecond)
+
+			Convey("The old key should be rejected", func() {
+				_, err := r.VerifyPublicKey([]byte("old"))
+				So(err, ShouldNotBeNil)
+
+				_, err = r.DecodingKey("server", "old", nil)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I rotate the secrets without an overlap window", func() {
+			err := r.Rotate(newKeySecrets("new"), 0)
+			So(err, ShouldBeNil)
+
+			Convey("The old key should be rejected", func() {
+				_, err := r.VerifyPublicKey([]byte("old"))
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I rotate to secrets of another type", func() {
+			null, _ := NewNullPKI(nil, nil, nil)
+			err := r.Rotate(null, time.Minute)
+
+			Convey("I should get an error and keep the current secrets", func() {
+				So(err, ShouldNotBeNil)
+				So(r.Current(), ShouldEqual, old)
+			})
+		})
+
+		Convey("When the current secrets find a revoked key", func() {
+			err := r.Rotate(&revokedSecrets{newKeySecrets("new")}, time.Minute)
+			So(err, ShouldBeNil)
+
+			Convey("The previous secrets should not be used", func() {
+				_, err := r.VerifyPublicKey([]byte("old"))
+				So(err, ShouldEqual, revocation.ErrRevoked)
+
+				_, err = r.DecodingKey("server", "old", nil)
+				So(err, ShouldEqual, revocation.ErrRevoked)
+			})
+		})
+
+		Convey("When I rotate to nil secrets", func() {
+			err := r.Rotate(nil, time.Minute)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestRotatingPSKSecrets(t *testing.T) {
+
+	Convey("Given rotating pre-shared key secrets", t, func() {
+		r := NewRotatingSecrets(NewPSKSecrets([]byte("old")))
+
+		Convey("There should be no previous decoding key", func() {
+			_, err := r.PreviousDecodingKey("server", nil, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When I rotate the key with an overlap window", func() {
+			err := r.Rotate(NewPSKSecrets([]byte("new")), time.Millisecond*50)
+			So(err, ShouldBeNil)
+
+			Convey("The new key should decode and the old one should be the previous decoding key", func() {
+				key, err := r.DecodingKey("server", nil, nil)
+				So(err, ShouldBeNil)
+				So(key, ShouldResemble, []byte("new"))
+
+				key, err = r.PreviousDecodingKey("server", nil, nil)
+				So(err, ShouldBeNil)
+				So(key, ShouldResemble, []byte("old"))
+			})
+
+			Convey("The old key should not be returned after the overlap window", func() {
+				time.Sleep(100 * time.Millisecond)
+
+				_, err := r.PreviousDecodingKey("server", nil, nil)
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -1,5 +1,12 @@
 package secrets
 
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
+)
+
 // Secrets is an interface implementing Secrets
 type Secrets interface {
 	Type() PrivateSecretsType
@@ -11,6 +18,13 @@ type Secrets interface {
 	AckSize() uint32
 }
 
+// RevocationChecking is implemented by the secrets that reject the revoked
+// certificates of their peers
+type RevocationChecking interface {
+	SetRevocation(c *revocation.Checker)
+	Revocation() *revocation.Checker
+}
+
 // PrivateSecretsType identifies the different secrets that are supported
 type PrivateSecretsType int
 
@@ -23,4 +37,19 @@ const (
 	PKICompactType
 	// PKINull is for debugging
 	PKINull
+	// PKISPIFFEType is for asymmetric signing with the X.509 SVIDs of the SPIFFE workload API
+	PKISPIFFEType
 )
+
+// ackSize returns the size of an ACK packet signed with the key, given its
+// size with an ES256 signature. The ES384 signatures are 32 bytes longer, so
+// 42 characters longer in base64. The Ed25519 signatures have the size of the
+// ES256 ones.
+func ackSize(es256Size uint32, key interface{}) uint32 {
+
+	if k, ok := key.(*ecdsa.PrivateKey); ok && k.Curve == elliptic.P384() {
+		return es256Size + 42
+	}
+
+	return es256Size
+}
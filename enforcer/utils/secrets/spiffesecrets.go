@@ -0,0 +1,288 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
+	"github.com/aporeto-inc/trireme/enforcer/utils/spiffe"
+)
+
+const (
+	// spiffeFetchTimeout is the time to wait for the first SVID of the workload API
+	spiffeFetchTimeout = 30 * time.Second
+	// spiffeOverlap is how long the previous SVID and bundles are still used
+	// to verify the peers after a rotation
+	spiffeOverlap = 10 * time.Minute
+)
+
+// SPIFFESecrets are PKI secrets using the X.509 SVID of the SPIFFE workload
+// API as key and certificate, and its trust bundles as authorities. They are
+// rotated whenever the workload API sends a new SVID. The SVIDs of the peers
+// are verified with the bundle of their own trust domain.
+type SPIFFESecrets struct {
+	client     *spiffe.Client
+	rotating   *RotatingSecrets
+	id         string
+	revocation *revocation.Checker
+	cancel     context.CancelFunc
+
+	sync.RWMutex
+}
+
+// NewSPIFFESecrets creates secrets from the SVIDs of the workload API listening
+// on the given Unix socket. It waits for the first SVID.
+func NewSPIFFESecrets(socketPath string) (*SPIFFESecrets, error) {
+
+	client, err := spiffe.NewClient(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spiffeFetchTimeout)
+	defer cancel()
+
+	x509Context, err := client.FetchX509Context(ctx)
+	if err != nil {
+		client.Close() // nolint
+		return nil, fmt.Errorf("Failed to fetch the SVID from the workload API: %s", err)
+	}
+
+	pki, id, err := svidFromX509Context(x509Context)
+	if err != nil {
+		client.Close() // nolint
+		return nil, err
+	}
+
+	zap.L().Info("Using SPIFFE SVID", zap.String("id", id))
+
+	s := &SPIFFESecrets{
+		client:   client,
+		rotating: NewRotatingSecrets(pki),
+		id:       id,
+	}
+
+	watchCtx, watchCancel := context.WithCancel(context.Background())
+	s.cancel = watchCancel
+	go client.WatchX509Context(watchCtx, s.update)
+
+	return s, nil
+}
+
+// update rotates the secrets to a new SVID of the workload API
+func (s *SPIFFESecrets) update(x509Context *spiffe.X509Context) {
+
+	pki, id, err := svidFromX509Context(x509Context)
+	if err != nil {
+		zap.L().Error("Ignoring SVID update", zap.Error(err))
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	current := s.rotating.Current().(*svidSecrets)
+	if bytes.Equal(current.PublicKeyPEM, pki.PublicKeyPEM) && bytes.Equal(current.AuthorityPEM, pki.AuthorityPEM) {
+		return
+	}
+
+	pki.SetRevocation(s.revocation)
+
+	if err := s.rotating.Rotate(pki, spiffeOverlap); err != nil {
+		zap.L().Error("Failed to rotate SVID", zap.Error(err))
+		return
+	}
+
+	s.id = id
+
+	zap.L().Info("Rotated SPIFFE SVID", zap.String("id", id))
+}
+
+// ID returns the SPIFFE ID of the current SVID
+func (s *SPIFFESecrets) ID() string {
+
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.id
+}
+
+// SocketPath returns the path of the socket of the workload API
+func (s *SPIFFESecrets) SocketPath() string {
+	return s.client.SocketPath()
+}
+
+// Stop stops watching the workload API. The current SVID is still used.
+func (s *SPIFFESecrets) Stop() {
+
+	s.cancel()
+	s.client.Close() // nolint
+}
+
+// Type implements the interface Secrets
+func (s *SPIFFESecrets) Type() PrivateSecretsType {
+	return PKISPIFFEType
+}
+
+// EncodingKey returns the private key of the SVID
+func (s *SPIFFESecrets) EncodingKey() interface{} {
+	return s.rotating.EncodingKey()
+}
+
+// PublicKey returns the certificate of the SVID
+func (s *SPIFFESecrets) PublicKey() interface{} {
+	return s.rotating.PublicKey()
+}
+
+// DecodingKey returns the public key of the peer
+func (s *SPIFFESecrets) DecodingKey(server string, ackCert, prevCert interface{}) (interface{}, error) {
+	return s.rotating.DecodingKey(server, ackCert, prevCert)
+}
+
+// VerifyPublicKey verifies the SVID certificate of a peer with the bundle of
+// its trust domain
+func (s *SPIFFESecrets) VerifyPublicKey(pkey []byte) (interface{}, error) {
+	return s.rotating.VerifyPublicKey(pkey)
+}
+
+// TransmittedKey returns the PEM of the SVID certificate and its intermediates
+func (s *SPIFFESecrets) TransmittedKey() []byte {
+	return s.rotating.TransmittedKey()
+}
+
+// AckSize returns the default size of an ACK packet
+func (s *SPIFFESecrets) AckSize() uint32 {
+	return s.rotating.AckSize()
+}
+
+// AuthPEM returns the PEM of the trust bundles
+func (s *SPIFFESecrets) AuthPEM() []byte {
+	return s.rotating.AuthPEM()
+}
+
+// TransmittedPEM returns the PEM of the SVID certificate and its intermediates
+func (s *SPIFFESecrets) TransmittedPEM() []byte {
+	return s.rotating.TransmittedPEM()
+}
+
+// EncodingPEM returns the PEM of the SVID key
+func (s *SPIFFESecrets) EncodingPEM() []byte {
+	return s.rotating.EncodingPEM()
+}
+
+// SetRevocation sets the checker that rejects revoked certificates. It is
+// kept when the SVID is rotated.
+func (s *SPIFFESecrets) SetRevocation(c *revocation.Checker) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.revocation = c
+	s.rotating.SetRevocation(c)
+}
+
+// Revocation returns the checker that rejects revoked certificates
+func (s *SPIFFESecrets) Revocation() *revocation.Checker {
+
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.revocation
+}
+
+// svidSecrets are the PKI secrets of an SVID. The SVID certificate is sent
+// with its intermediates, and the certificates of the peers are verified with
+// the bundle of the trust domain of their SPIFFE ID, so that the authorities
+// of a federated trust domain can not issue the SVIDs of another one.
+type svidSecrets struct {
+	*PKISecrets
+	bundles *x509bundle.Set
+}
+
+// VerifyPublicKey verifies the SVID certificate of a peer followed by its
+// intermediates with the bundle of the trust domain of the peer
+func (s *svidSecrets) VerifyPublicKey(pkey []byte) (interface{}, error) {
+
+	certificates := []*x509.Certificate{}
+	for block, rest := pem.Decode(pkey); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, cert)
+	}
+
+	if _, err := spiffe.Verify(certificates, s.bundles); err != nil {
+		return nil, err
+	}
+
+	if s.revocation != nil {
+		if err := s.revocation.Check(certificates[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return certificates[0], nil
+}
+
+// svidFromX509Context creates the secrets of the default SVID of the workload
+// API, trusting the bundles of its trust domain and of the federated ones.
+func svidFromX509Context(x509Context *spiffe.X509Context) (*svidSecrets, string, error) {
+
+	svid := x509Context.Default()
+	if svid == nil {
+		return nil, "", fmt.Errorf("No SVID received")
+	}
+
+	if _, err := crypto.SigningMethod(svid.PrivateKey); err != nil {
+		return nil, "", fmt.Errorf("Unsupported SVID key of %s: %s", svid.ID, err)
+	}
+
+	if _, err := spiffe.Verify(svid.Certificates, x509Context.Bundles); err != nil {
+		return nil, "", fmt.Errorf("Invalid SVID %s: %s", svid.ID, err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(svid.PrivateKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid SVID key of %s: %s", svid.ID, err)
+	}
+
+	certPEM := []byte{}
+	for _, cert := range svid.Certificates {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	// The bundles are sorted by trust domain, so the same bundles give the same PEM
+	caPEM := []byte{}
+	for _, bundle := range x509Context.Bundles.Bundles() {
+		for _, cert := range bundle.X509Authorities() {
+			caPEM = append(caPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+	}
+
+	certPool := x509.NewCertPool()
+	for _, cert := range svid.Bundle {
+		certPool.AddCert(cert)
+	}
+
+	return &svidSecrets{
+		PKISecrets: &PKISecrets{
+			PrivateKeyPEM: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+			PublicKeyPEM:  certPEM,
+			AuthorityPEM:  caPEM,
+			privateKey:    svid.PrivateKey,
+			publicKey:     svid.Certificates[0],
+			certPool:      certPool,
+		},
+		bundles: x509Context.Bundles,
+	}, svid.ID, nil
+}
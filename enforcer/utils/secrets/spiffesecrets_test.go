@@ -0,0 +1,214 @@
+package secrets
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/enforcer/utils/spiffe"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// trustDomain issues the SVIDs of a test trust domain
+type trustDomain struct {
+	key    *ecdsa.PrivateKey
+	bundle []*x509.Certificate
+	serial int64
+}
+
+func newTrustDomain() *trustDomain {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.org"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+
+	return &trustDomain{key: key, bundle: []*x509.Certificate{cert}, serial: 1}
+}
+
+func (t *trustDomain) issue(id string, key crypto.Signer) *spiffe.X509SVID {
+
+	uri, err := url.Parse(id)
+	So(err, ShouldBeNil)
+
+	t.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(t.serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, t.bundle[0], key.Public(), t.key)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+
+	return &spiffe.X509SVID{
+		ID:           id,
+		Certificates: []*x509.Certificate{cert},
+		PrivateKey:   key,
+		Bundle:       t.bundle,
+	}
+}
+
+func (t *trustDomain) issueEC(id string) *spiffe.X509SVID {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	return t.issue(id, key)
+}
+
+func certificatePEM(svid *spiffe.X509SVID) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svid.Certificates[0].Raw})
+}
+
+func TestSPIFFESecrets(t *testing.T) {
+
+	Convey("Given a workload API", t, func() {
+		dir, err := ioutil.TempDir("", "spiffe")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		socket := filepath.Join(dir, "agent.sock")
+		server, err := spiffe.NewServer(socket)
+		So(err, ShouldBeNil)
+		defer server.Stop()
+
+		domain := newTrustDomain()
+		svid := domain.issueEC("spiffe://example.org/web")
+		So(server.SetX509SVIDs([]*spiffe.X509SVID{svid}, nil), ShouldBeNil)
+
+		Convey("When I create SPIFFE secrets", func() {
+			s, err := NewSPIFFESecrets(socket)
+			So(err, ShouldBeNil)
+			defer s.Stop()
+
+			Convey("The SVID should be used", func() {
+				So(s.Type(), ShouldEqual, PKISPIFFEType)
+				So(s.ID(), ShouldEqual, "spiffe://example.org/web")
+				So(s.SocketPath(), ShouldEqual, socket)
+				So(s.TransmittedKey(), ShouldResemble, certificatePEM(svid))
+				So(s.EncodingKey().(*ecdsa.PrivateKey).D, ShouldResemble, svid.PrivateKey.(*ecdsa.PrivateKey).D)
+			})
+
+			Convey("The SVIDs of the trust domain should be verified", func() {
+				peer := domain.issueEC("spiffe://example.org/db")
+				cert, err := s.VerifyPublicKey(certificatePEM(peer))
+				So(err, ShouldBeNil)
+				So(cert.(*x509.Certificate).Equal(peer.Certificates[0]), ShouldBeTrue)
+
+				key, err := s.DecodingKey("server", cert, nil)
+				So(err, ShouldBeNil)
+				So(key, ShouldResemble, peer.PrivateKey.Public())
+			})
+
+			Convey("The SVIDs of another trust domain should be rejected", func() {
+				_, err := s.VerifyPublicKey(certificatePEM(newTrustDomain().issueEC("spiffe://other.org/db")))
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("When the workload API rotates the SVID", func() {
+				rotated := domain.issueEC("spiffe://example.org/web")
+				So(server.SetX509SVIDs([]*spiffe.X509SVID{rotated}, nil), ShouldBeNil)
+
+				Convey("The new SVID should be used", func() {
+					So(func() bool {
+						for i := 0; i < 100; i++ {
+							if string(s.TransmittedKey()) == string(certificatePEM(rotated)) {
+								return true
+							}
+							time.Sleep(10 * time.Millisecond)
+						}
+						return false
+					}(), ShouldBeTrue)
+				})
+			})
+
+			Convey("When the workload API adds a federated trust domain", func() {
+				other := newTrustDomain()
+				So(server.SetX509SVIDs([]*spiffe.X509SVID{svid}, map[string][]*x509.Certificate{"spiffe://other.org": other.bundle}), ShouldBeNil)
+
+				Convey("The SVIDs of the federated trust domain should be verified", func() {
+					peer := certificatePEM(other.issueEC("spiffe://other.org/db"))
+					So(func() bool {
+						for i := 0; i < 100; i++ {
+							if _, err := s.VerifyPublicKey(peer); err == nil {
+								return true
+							}
+							time.Sleep(10 * time.Millisecond)
+						}
+						return false
+					}(), ShouldBeTrue)
+				})
+
+				Convey("The SVIDs of our trust domain issued by the federated trust domain should be rejected", func() {
+					So(func() bool {
+						for i := 0; i < 100; i++ {
+							if _, err := s.VerifyPublicKey(certificatePEM(other.issueEC("spiffe://other.org/db"))); err == nil {
+								return true
+							}
+							time.Sleep(10 * time.Millisecond)
+						}
+						return false
+					}(), ShouldBeTrue)
+
+					_, err := s.VerifyPublicKey(certificatePEM(other.issueEC("spiffe://example.org/db")))
+					So(err, ShouldNotBeNil)
+				})
+			})
+		})
+
+		Convey("When the SVID key is an Ed25519 key", func() {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			So(err, ShouldBeNil)
+			So(server.SetX509SVIDs([]*spiffe.X509SVID{domain.issue("spiffe://example.org/web", key)}, nil), ShouldBeNil)
+
+			s, err := NewSPIFFESecrets(socket)
+			So(err, ShouldBeNil)
+			defer s.Stop()
+
+			Convey("The SVID key should be used", func() {
+				So(s.EncodingKey(), ShouldResemble, key)
+			})
+		})
+
+		Convey("When the SVID key is of an unsupported curve", func() {
+			key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+			So(err, ShouldBeNil)
+			So(server.SetX509SVIDs([]*spiffe.X509SVID{domain.issue("spiffe://example.org/web", key)}, nil), ShouldBeNil)
+
+			_, err = NewSPIFFESecrets(socket)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
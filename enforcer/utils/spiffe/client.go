@@ -0,0 +1,104 @@
+package spiffe
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Client fetches the X.509 SVIDs of the workload from the SPIFFE workload API
+type Client struct {
+	socketPath string
+	client     *workloadapi.Client
+}
+
+// NewClient creates a client of the workload API listening on the given
+// Unix socket
+func NewClient(socketPath string) (*Client, error) {
+
+	socketPath = strings.TrimPrefix(socketPath, "unix://")
+	if socketPath == "" {
+		return nil, fmt.Errorf("Workload API socket can not be empty")
+	}
+
+	client, err := workloadapi.New(context.Background(), workloadapi.WithAddr("unix://"+socketPath))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to the workload API at %s: %s", socketPath, err)
+	}
+
+	return &Client{
+		socketPath: socketPath,
+		client:     client,
+	}, nil
+}
+
+// SocketPath returns the path of the socket of the workload API
+func (c *Client) SocketPath() string {
+	return c.socketPath
+}
+
+// Close closes the connection to the workload API
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// FetchX509Context returns the first X.509 context sent by the workload API
+func (c *Client) FetchX509Context(ctx context.Context) (*X509Context, error) {
+
+	x, err := c.client.FetchX509Context(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newX509Context(x)
+}
+
+// WatchX509Context calls the handler with every X.509 context sent by the
+// workload API until the context is done. The workload API client opens the
+// stream again with a backoff after errors.
+func (c *Client) WatchX509Context(ctx context.Context, handler func(*X509Context)) {
+
+	err := c.client.WatchX509Context(ctx, &watcher{socketPath: c.socketPath, handler: handler})
+	if ctx.Err() == nil {
+		zap.L().Error("Stopped watching the X.509 SVIDs of the workload API",
+			zap.String("socket", c.socketPath),
+			zap.Error(err),
+		)
+	}
+}
+
+// watcher receives the X.509 contexts of the workload API client
+type watcher struct {
+	socketPath string
+	handler    func(*X509Context)
+}
+
+// OnX509ContextUpdate implements the interface workloadapi.X509ContextWatcher
+func (w *watcher) OnX509ContextUpdate(x *workloadapi.X509Context) {
+
+	x509Context, err := newX509Context(x)
+	if err != nil {
+		zap.L().Error("Ignoring invalid X.509 SVID update", zap.Error(err))
+		return
+	}
+
+	w.handler(x509Context)
+}
+
+// OnX509ContextWatchError implements the interface workloadapi.X509ContextWatcher
+func (w *watcher) OnX509ContextWatchError(err error) {
+
+	if status.Code(err) == codes.Canceled {
+		return
+	}
+
+	zap.L().Warn("Lost the X.509 SVID stream of the workload API",
+		zap.String("socket", w.socketPath),
+		zap.Error(err),
+	)
+}
@@ -0,0 +1,138 @@
+package spiffe
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// securityHeader must be sent with every request to the workload API
+const securityHeader = "workload.spiffe.io"
+
+// Server is a minimal workload API serving the X.509 SVIDs it is given on a
+// Unix socket. It stands in for a SPIFFE agent in tests and development setups
+// and does not attest the workloads.
+type Server struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+
+	listener net.Listener
+	server   *grpc.Server
+	current  *workload.X509SVIDResponse
+	changed  chan struct{}
+
+	sync.Mutex
+}
+
+// NewServer starts a workload API on the given Unix socket
+func NewServer(socketPath string) (*Server, error) {
+
+	os.Remove(socketPath) // nolint
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on %s: %s", socketPath, err)
+	}
+
+	s := &Server{
+		listener: listener,
+		server:   grpc.NewServer(),
+		changed:  make(chan struct{}),
+	}
+
+	workload.RegisterSpiffeWorkloadAPIServer(s.server, s)
+
+	go s.server.Serve(listener) // nolint
+
+	return s, nil
+}
+
+// SetX509SVIDs replaces the SVIDs served to the workloads and sends them to
+// the connected workloads. The federated bundles are indexed by the SPIFFE ID
+// of their trust domain.
+func (s *Server) SetX509SVIDs(svids []*X509SVID, federatedBundles map[string][]*x509.Certificate) error {
+
+	resp := &workload.X509SVIDResponse{
+		FederatedBundles: map[string][]byte{},
+	}
+
+	for _, svid := range svids {
+
+		key, err := x509.MarshalPKCS8PrivateKey(svid.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("Invalid SVID key of %s: %s", svid.ID, err)
+		}
+
+		resp.Svids = append(resp.Svids, &workload.X509SVID{
+			SpiffeId:    svid.ID,
+			X509Svid:    concatenate(svid.Certificates),
+			X509SvidKey: key,
+			Bundle:      concatenate(svid.Bundle),
+		})
+	}
+
+	for trustDomain, bundle := range federatedBundles {
+		resp.FederatedBundles[trustDomain] = concatenate(bundle)
+	}
+
+	s.Lock()
+	s.current = resp
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.Unlock()
+
+	return nil
+}
+
+// Stop stops the workload API
+func (s *Server) Stop() {
+	s.server.Stop()
+}
+
+// FetchX509SVID streams the SVIDs to a workload
+func (s *Server) FetchX509SVID(req *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+
+	md, ok := metadata.FromIncomingContext(stream.Context())
+	if !ok || len(md.Get(securityHeader)) != 1 || md.Get(securityHeader)[0] != "true" {
+		return status.Error(codes.InvalidArgument, "Missing security header")
+	}
+
+	var sent *workload.X509SVIDResponse
+
+	for {
+		s.Lock()
+		current, changed := s.current, s.changed
+		s.Unlock()
+
+		if current != nil && current != sent {
+			if err := stream.Send(current); err != nil {
+				return err
+			}
+			sent = current
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// concatenate returns the DER encoding of the certificates one after the other
+func concatenate(certificates []*x509.Certificate) []byte {
+
+	data := []byte{}
+	for _, cert := range certificates {
+		data = append(data, cert.Raw...)
+	}
+
+	return data
+}
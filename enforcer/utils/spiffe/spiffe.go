@@ -0,0 +1,107 @@
+package spiffe
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// X509SVID is an X.509 SPIFFE verifiable identity document
+type X509SVID struct {
+	// ID is the SPIFFE ID of the workload
+	ID string
+	// Certificates is the certificate of the SVID followed by its intermediates
+	Certificates []*x509.Certificate
+	// PrivateKey is the key of the SVID certificate
+	PrivateKey crypto.Signer
+	// Bundle is the trust bundle of the trust domain of the SVID
+	Bundle []*x509.Certificate
+}
+
+// X509Context is an update of the workload API with the SVIDs of the workload
+// and the bundles of its trust domain and of the federated trust domains
+type X509Context struct {
+	SVIDs   []*X509SVID
+	Bundles *x509bundle.Set
+}
+
+// Default returns the default SVID of the workload, which is the first one
+func (x *X509Context) Default() *X509SVID {
+
+	if len(x.SVIDs) == 0 {
+		return nil
+	}
+
+	return x.SVIDs[0]
+}
+
+// Verify verifies an SVID certificate followed by its intermediates with the
+// bundle of the trust domain of its SPIFFE ID, and returns the SPIFFE ID. The
+// authorities of a trust domain can not issue the SVIDs of another one.
+func Verify(certificates []*x509.Certificate, bundles x509bundle.Source) (string, error) {
+
+	id, _, err := x509svid.Verify(certificates, bundles)
+	if err != nil {
+		return "", err
+	}
+
+	return id.String(), nil
+}
+
+// IDFromCertificate returns the SPIFFE ID of an SVID certificate
+func IDFromCertificate(cert *x509.Certificate) (string, error) {
+
+	if cert == nil {
+		return "", fmt.Errorf("No certificate")
+	}
+
+	id := ""
+	for _, uri := range cert.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		if id != "" {
+			return "", fmt.Errorf("Certificate has more than one SPIFFE ID")
+		}
+		id = uri.String()
+	}
+
+	if id == "" {
+		return "", fmt.Errorf("Certificate has no SPIFFE ID")
+	}
+
+	return id, nil
+}
+
+// newX509Context converts an X.509 context of the workload API client
+func newX509Context(x *workloadapi.X509Context) (*X509Context, error) {
+
+	if len(x.SVIDs) == 0 {
+		return nil, fmt.Errorf("No SVID received")
+	}
+
+	x509Context := &X509Context{
+		Bundles: x.Bundles,
+	}
+
+	for _, svid := range x.SVIDs {
+
+		bundle, err := x.Bundles.GetX509BundleForTrustDomain(svid.ID.TrustDomain())
+		if err != nil {
+			return nil, fmt.Errorf("No bundle for %s: %s", svid.ID, err)
+		}
+
+		x509Context.SVIDs = append(x509Context.SVIDs, &X509SVID{
+			ID:           svid.ID.String(),
+			Certificates: svid.Certificates,
+			PrivateKey:   svid.PrivateKey,
+			Bundle:       bundle.X509Authorities(),
+		})
+	}
+
+	return x509Context, nil
+}
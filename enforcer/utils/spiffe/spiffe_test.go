@@ -0,0 +1,222 @@
+package spiffe
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// newAuthority creates a self signed authority
+func newAuthority() (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	So(err, ShouldBeNil)
+	ca, err := x509.ParseCertificate(caDER)
+	So(err, ShouldBeNil)
+
+	return ca, caKey
+}
+
+// issueSVID creates an SVID with the given SPIFFE IDs signed by the authority
+func issueSVID(ca *x509.Certificate, caKey *ecdsa.PrivateKey, ids ...string) *X509SVID {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	for _, id := range ids {
+		uri, err := url.Parse(id)
+		So(err, ShouldBeNil)
+		template.URIs = append(template.URIs, uri)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+
+	svid := &X509SVID{
+		Certificates: []*x509.Certificate{cert},
+		PrivateKey:   key,
+		Bundle:       []*x509.Certificate{ca},
+	}
+	if len(ids) > 0 {
+		svid.ID = ids[0]
+	}
+
+	return svid
+}
+
+// newSVID creates a self signed bundle and an SVID with the given SPIFFE IDs
+func newSVID(ids ...string) *X509SVID {
+
+	ca, caKey := newAuthority()
+
+	return issueSVID(ca, caKey, ids...)
+}
+
+func TestIDFromCertificate(t *testing.T) {
+
+	Convey("Given SVID certificates", t, func() {
+
+		Convey("The SPIFFE ID of a certificate should be returned", func() {
+			id, err := IDFromCertificate(newSVID("spiffe://example.org/web").Certificates[0])
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "spiffe://example.org/web")
+		})
+
+		Convey("A certificate without SPIFFE ID should be rejected", func() {
+			_, err := IDFromCertificate(newSVID("https://example.org/web").Certificates[0])
+			So(err, ShouldNotBeNil)
+
+			_, err = IDFromCertificate(nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A certificate with two SPIFFE IDs should be rejected", func() {
+			_, err := IDFromCertificate(newSVID("spiffe://example.org/web", "spiffe://example.org/db").Certificates[0])
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestVerify(t *testing.T) {
+
+	Convey("Given the bundles of two trust domains", t, func() {
+		ca, caKey := newAuthority()
+		otherCA, otherKey := newAuthority()
+
+		bundles := x509bundle.NewSet(
+			x509bundle.FromX509Authorities(spiffeid.RequireTrustDomainFromString("example.org"), []*x509.Certificate{ca}),
+			x509bundle.FromX509Authorities(spiffeid.RequireTrustDomainFromString("other.org"), []*x509.Certificate{otherCA}),
+		)
+
+		Convey("An SVID signed by the bundle of its trust domain should be verified", func() {
+			id, err := Verify(issueSVID(ca, caKey, "spiffe://example.org/web").Certificates, bundles)
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "spiffe://example.org/web")
+		})
+
+		Convey("An SVID signed by the bundle of another trust domain should be rejected", func() {
+			_, err := Verify(issueSVID(otherCA, otherKey, "spiffe://example.org/web").Certificates, bundles)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestWorkloadAPI(t *testing.T) {
+
+	Convey("Given a workload API", t, func() {
+		dir, err := ioutil.TempDir("", "spiffe")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		socket := filepath.Join(dir, "agent.sock")
+		server, err := NewServer(socket)
+		So(err, ShouldBeNil)
+		defer server.Stop()
+
+		svid := newSVID("spiffe://example.org/web")
+		federated := newSVID().Bundle
+		So(server.SetX509SVIDs([]*X509SVID{svid}, map[string][]*x509.Certificate{"spiffe://other.org": federated}), ShouldBeNil)
+
+		client, err := NewClient("unix://" + socket)
+		So(err, ShouldBeNil)
+		defer client.Close() // nolint
+		So(client.SocketPath(), ShouldEqual, socket)
+
+		Convey("When I fetch the X.509 context", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			x, err := client.FetchX509Context(ctx)
+
+			Convey("I should get the SVID and the bundles", func() {
+				So(err, ShouldBeNil)
+				So(x.Default().ID, ShouldEqual, "spiffe://example.org/web")
+				So(x.Default().Certificates[0].Equal(svid.Certificates[0]), ShouldBeTrue)
+				So(x.Default().Bundle[0].Equal(svid.Bundle[0]), ShouldBeTrue)
+				So(x.Default().PrivateKey.Public(), ShouldResemble, svid.PrivateKey.Public())
+				bundle, ok := x.Bundles.Get(spiffeid.RequireTrustDomainFromString("other.org"))
+				So(ok, ShouldBeTrue)
+				So(bundle.X509Authorities()[0].Equal(federated[0]), ShouldBeTrue)
+			})
+		})
+
+		Convey("When I watch the X.509 contexts and the SVID is rotated", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			updates := make(chan *X509Context, 10)
+			go client.WatchX509Context(ctx, func(x *X509Context) {
+				updates <- x
+			})
+
+			first := <-updates
+			rotated := newSVID("spiffe://example.org/web")
+			So(server.SetX509SVIDs([]*X509SVID{rotated}, nil), ShouldBeNil)
+
+			Convey("I should get the new SVID", func() {
+				So(first.Default().Certificates[0].Equal(svid.Certificates[0]), ShouldBeTrue)
+
+				select {
+				case x := <-updates:
+					So(x.Default().Certificates[0].Equal(rotated.Certificates[0]), ShouldBeTrue)
+				case <-time.After(5 * time.Second):
+					So("no update", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When the workload API is stopped", func() {
+			server.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			_, err := client.FetchX509Context(ctx)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("When I create a client without socket", t, func() {
+		_, err := NewClient("")
+
+		Convey("I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
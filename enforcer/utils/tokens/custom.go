@@ -2,142 +2,543 @@ package tokens
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/hmac"
-	"crypto/x509"
-	"strings"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
 	"time"
 
+	"github.com/aporeto-inc/trireme/cache"
 	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
 	"github.com/aporeto-inc/trireme/policy"
-)
-
-// CustomTokenSignMethod describes the sign methods for the custome tokens
-type CustomTokenSignMethod int
+	"go.uber.org/zap"
 
-const (
-	// PreSharedKey defines a pre-shared key implementation
-	PreSharedKey CustomTokenSignMethod = iota
-	// PKI defines a public/private key implementation
-	PKI
+	"github.com/dgrijalva/jwt-go"
 )
 
+// The custom tokens are a binary encoding of the claims with a detached
+// signature. They are much smaller than the JWTs and faster to parse:
+//
+//	version (1) | method (1) | nonce (16) | length (2) | claims | signature length (1) | signature | key
+//
+// The nonce and the key are only in the Syn and SynAck tokens. The PEM
+// certificates of the PKI secrets are sent in DER to keep the key small. The
+// signature covers the version, the method and the claims. Like the JWT nonce,
+// the nonce is only signed if it is the local nonce of the claims, so that the
+// other tokens can be randomized and sent again. The claims are the
+// expiration and the issue times in seconds (4 each), the issuer, the tags,
+// the remote nonce, the local nonce and the ephemeral key. The issuer, the
+// nonces and the key are byte strings preceded by their length as a varint,
+// and the tags are a varint count of such strings.
 const (
-	lclIndex         = 64
-	rmtIndex         = 96
-	minBufferLength  = 128
-	sizeOfRandom     = 32
-	sizeOfMessageMac = 32
+	// customTokenVersion is the version of the binary encoding
+	customTokenVersion = 1
+
+	customVersionPosition = 0
+	customMethodPosition  = 1
+	customNoncePosition   = 2
+	customHeaderLength    = 2
+	customLengthSize      = 2
 )
 
+// customSigningMethods are the signing methods of the custom tokens, by their
+// identifier on the wire. They are the ones of the JWTs.
+var customSigningMethods = []jwt.SigningMethod{
+	jwt.SigningMethodNone,
+	jwt.SigningMethodHS256,
+	jwt.SigningMethodES256,
+	jwt.SigningMethodES384,
+	crypto.SigningMethodEdDSA,
+}
+
+// customSignatureSizes are the sizes of the signatures of the signing methods
+var customSignatureSizes = map[string]int{
+	jwt.SigningMethodNone.Alg():     0,
+	jwt.SigningMethodHS256.Alg():    32,
+	jwt.SigningMethodES256.Alg():    64,
+	jwt.SigningMethodES384.Alg():    96,
+	crypto.SigningMethodEdDSA.Alg(): 64,
+}
+
 // CustomTokenConfig configures the custom token generator with the standard parameters
 type CustomTokenConfig struct {
-
 	// ValidityPeriod for the signed token
 	ValidityPeriod time.Duration
-
 	// Issuer is the server that signs the request
 	Issuer string
+	// secrets is the secrets used for signing and verifying the tokens
+	secrets secrets.Secrets
+	// tokenCache caches the claims of the verified tokens
+	tokenCache cache.DataStore
+}
+
+// NewCustomToken creates a new token processor of binary tokens. They are
+// signed with the PKI or the pre-shared key secrets like the JWTs.
+func NewCustomToken(validity time.Duration, issuer string, s secrets.Secrets) (*CustomTokenConfig, error) {
+
+	if len(issuer) > MaxServerName {
+		return nil, fmt.Errorf("Server ID should be max %d chars. Got %s", MaxServerName, issuer)
+	}
+
+	if s == nil {
+		return nil, fmt.Errorf("Secrets can not be nil")
+	}
+
+	if _, err := crypto.SigningMethod(s.EncodingKey()); err != nil {
+		return nil, fmt.Errorf("Invalid signing key: %s", err)
+	}
 
-	// SignMethod is the method to use for signing the labels
-	SignMethod CustomTokenSignMethod
-
-	// Key is an interface for either the Private Key or the Preshared Key
-	Key interface{}
-	// CA is the certificate of the CA that has signed the server keys
-	CA *x509.Certificate
-	// Cert is the certificate of the server
-	Cert *x509.Certificate
-	// CertPEM is a buffer of the PEM file that is send to other servers - Cached for efficiency
-	CertPEM []byte
-	// IncludeCert instructs the engine to transmit the certificate with each token
-	IncludeCert bool
-	// CertPool is pool of certificates that are already distributed out of band
-	PublicKeyCache map[string]*ecdsa.PublicKey
-}
-
-// NewPSKCustomToken creates a new token generator for custom tokens
-func NewPSKCustomToken(validity time.Duration, issuer string, psk []byte) *CustomTokenConfig {
 	return &CustomTokenConfig{
 		ValidityPeriod: validity,
 		Issuer:         issuer,
-		SignMethod:     PreSharedKey,
-		Key:            psk,
+		secrets:        s,
+		tokenCache:     cache.NewCacheWithExpiration(time.Millisecond * 500),
+	}, nil
+}
+
+// CreateAndSign creates a buffer for a new custom token and signs the token.
+// It also randomizes the nonce of the Syn and SynAck tokens and returns it.
+func (c *CustomTokenConfig) CreateAndSign(isAck bool, claims *ConnectionClaims) (token []byte, nonce []byte, err error) {
+
+	key := c.secrets.EncodingKey()
+
+	method, err := crypto.SigningMethod(key)
+	if err != nil {
+		return []byte{}, []byte{}, err
 	}
+
+	methodID, err := customMethodID(method)
+	if err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	body := c.encodeClaims(claims)
+	if len(body) > 0xFFFF {
+		return []byte{}, []byte{}, fmt.Errorf("Claims are too large: %d bytes", len(body))
+	}
+
+	header := []byte{customTokenVersion, methodID}
+
+	signature, err := customSign(method, header, body, key)
+	if err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	var txKey []byte
+	if !isAck {
+		nonce, err = tokenNonce(claims)
+		if err != nil {
+			return []byte{}, []byte{}, err
+		}
+		txKey = c.transmittedKey()
+	}
+
+	token = make([]byte, 0, customHeaderLength+len(nonce)+customLengthSize+len(body)+1+len(signature)+len(txKey))
+	token = append(token, header...)
+	token = append(token, nonce...)
+	token = append(token, byte(len(body)>>8), byte(len(body)))
+	token = append(token, body...)
+	token = append(token, byte(len(signature)))
+	token = append(token, signature...)
+	token = append(token, txKey...)
+
+	if isAck {
+		return token, []byte{}, nil
+	}
+
+	return token, nonce, nil
 }
 
-// CreateAndSign  creates a buffer for a new custom token and signs the token. Format
-// is Signature, Random Local, Random Remote, Tags separated by the spaces
-func (c *CustomTokenConfig) CreateAndSign(isAck bool, claims *ConnectionClaims) []byte {
+// Decode decodes a custom token and verifies its signature. For Syn and SynAck
+// tokens, it first verifies the key of the issuer with the secrets. Ack tokens
+// are verified with the key of the previous token of the connection.
+func (c *CustomTokenConfig) Decode(isAck bool, data []byte, previousCert interface{}) (claims *ConnectionClaims, nonce []byte, publicKey interface{}, err error) {
+
+	var ackCert interface{}
+
+	nonce = make([]byte, NonceLength)
+
+	if len(data) < customHeaderLength {
+		return nil, nil, nil, fmt.Errorf("bad token length")
+	}
+
+	if data[customVersionPosition] != customTokenVersion {
+		return nil, nil, nil, fmt.Errorf("Unsupported token version %d", data[customVersionPosition])
+	}
+
+	method, err := customMethod(data[customMethodPosition])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	position := customHeaderLength
+	if !isAck {
+		if len(data) < position+NonceLength {
+			return nil, nil, nil, fmt.Errorf("bad token length")
+		}
+		copy(nonce, data[position:position+NonceLength])
+		position += NonceLength
+	}
 
-	buffer := make([]byte, minBufferLength)
+	claimsPosition := position
+	if len(data) < position+customLengthSize {
+		return nil, nil, nil, fmt.Errorf("bad token length")
+	}
+	bodyLength := int(binary.BigEndian.Uint16(data[position:]))
+	position += customLengthSize
+
+	if len(data) < position+bodyLength+1 {
+		return nil, nil, nil, fmt.Errorf("bad token length")
+	}
+	body := data[position : position+bodyLength]
+	position += bodyLength
 
-	// Copy the random part
-	//  copy(buffer[lclIndex:lclIndex+sizeOfRandom], claims.LCL)
-	copy(buffer[rmtIndex:rmtIndex+sizeOfRandom], claims.RMT)
+	signatureLength := int(data[position])
+	position++
+	if len(data) < position+signatureLength {
+		return nil, nil, nil, fmt.Errorf("bad token length")
+	}
+	signature := data[position : position+signatureLength]
+	position += signatureLength
+
+	// The signed part of the token and its signature identify it in the
+	// cache. The nonce is left out since it changes whenever a token is sent.
+	signed := string(data[:customHeaderLength]) + string(data[claimsPosition:position])
 
-	// If not an ACK packet copy the tags
 	if !isAck {
-		for _, kv := range claims.T.GetSlice() {
-			tag := []byte(kv + " ")
-			buffer = append(buffer, tag...)
+		ackCert, err = c.secrets.VerifyPublicKey(c.receivedKey(data[position:]))
+		if err == revocation.ErrRevoked {
+			return nil, nil, nil, err
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("bad public key")
+		}
+
+		if cachedClaims, cerr := c.tokenCache.Get(signed); cerr == nil {
+			if err := checkSignedNonce(cachedClaims.(*ConnectionClaims), nonce); err != nil {
+				return nil, nil, nil, err
+			}
+			return cachedClaims.(*ConnectionClaims), nonce, ackCert, nil
 		}
 	}
 
-	// Sign the buffer
-	signature, err := crypto.ComputeHmac256(buffer[lclIndex:], c.Key.([]byte))
+	claims, expiresAt, err := decodeClaims(body)
 	if err != nil {
-		return []byte{}
+		return nil, nil, nil, err
 	}
 
-	// Add the signature as the first part of the buffer
-	copy(buffer[0:], signature)
+	key, err := c.secrets.DecodingKey(claims.ISS, ackCert, previousCert)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	// Return the buffer
-	return buffer
+	// The peer picks the signing method of its key, which must be the method
+	// of the key that we verify it with
+	if err := crypto.CheckSigningMethod(method, key); err != nil {
+		return nil, nil, nil, err
+	}
+
+	header := data[:customHeaderLength]
+
+	if err := customVerify(method, header, body, signature, key); err != nil {
+		// During the overlap window of rotated secrets, the token may be
+		// signed with the previous key
+		if !c.verifyWithPrevious(method, header, body, signature, claims.ISS, ackCert, previousCert) {
+			zap.L().Error("Custom token verification failed", zap.Error(err))
+			return nil, nil, nil, fmt.Errorf("Invalid token")
+		}
+	}
 
+	if time.Now().Unix() > expiresAt {
+		return nil, nil, nil, fmt.Errorf("Token expired")
+	}
+
+	// The nonce in front of the token must be the one that was signed, if any
+	if !isAck {
+		if err := checkSignedNonce(claims, nonce); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	claims.SID = spiffeID(c.secrets, ackCert)
+
+	c.tokenCache.AddOrUpdate(signed, claims)
+
+	return claims, nonce, ackCert, nil
 }
 
-// Decode decodes a string into the data structures for a custom token
-func (c *CustomTokenConfig) Decode(isAck bool, data []byte, previousCert interface{}) (*ConnectionClaims, interface{}) {
-	claims := &ConnectionClaims{}
+// verifyWithPrevious verifies the signature of a token with the decoding key of
+// the previous secrets, if the secrets still accept it
+func (c *CustomTokenConfig) verifyWithPrevious(method jwt.SigningMethod, header, body, signature []byte, server string, ackCert, previousCert interface{}) bool {
 
-	if len(data) < minBufferLength {
-		return nil, nil
+	overlapping, ok := c.secrets.(secrets.OverlappingSecrets)
+	if !ok {
+		return false
 	}
 
-	messageMac := data[:sizeOfMessageMac]
-	expectedMac, err := crypto.ComputeHmac256(data[lclIndex:], c.Key.([]byte))
+	key, err := overlapping.PreviousDecodingKey(server, ackCert, previousCert)
 	if err != nil {
-		return nil, nil
+		return false
 	}
 
-	if !hmac.Equal(messageMac, expectedMac) {
-		return nil, nil
+	if err := crypto.CheckSigningMethod(method, key); err != nil {
+		return false
 	}
 
-	// claims.LCL = data[lclIndex : lclIndex+sizeOfRandom]
-	claims.RMT = data[rmtIndex : rmtIndex+sizeOfRandom]
+	return customVerify(method, header, body, signature, key) == nil
+}
 
-	if !isAck {
-		claims.T = policy.NewTagStore()
-		buffer := bytes.NewBuffer(data[minBufferLength:])
-		for {
-			tag, err := buffer.ReadBytes([]byte(" ")[0])
-
-			if err == nil {
-				values := strings.Split(string(tag[:len(tag)-1]), "=")
-				if len(values) != 2 {
-					continue
-				}
-
-				claims.T.AppendKeyValue(values[0], values[1])
-				continue
-			}
+// transmittedKey returns the key sent in the Syn and SynAck tokens. The PEM
+// certificates of the PKI secrets are sent in DER.
+func (c *CustomTokenConfig) transmittedKey() []byte {
+
+	key := c.secrets.TransmittedKey()
 
-			break
+	if !sendsCertificates(c.secrets) {
+		return key
+	}
+
+	der := []byte{}
+	for block, rest := pem.Decode(key); block != nil; block, rest = pem.Decode(rest) {
+		der = append(der, block.Bytes...)
+	}
+
+	return der
+}
+
+// receivedKey returns the key received in a Syn or SynAck token in the form
+// that the secrets verify. The DER certificates are encoded in PEM again.
+func (c *CustomTokenConfig) receivedKey(key []byte) []byte {
+
+	if !sendsCertificates(c.secrets) {
+		return key
+	}
+
+	var buffer bytes.Buffer
+	for len(key) > 0 {
+		var cert asn1.RawValue
+		rest, err := asn1.Unmarshal(key, &cert)
+		if err != nil {
+			return nil
 		}
+
+		if err := pem.Encode(&buffer, &pem.Block{Type: "CERTIFICATE", Bytes: cert.FullBytes}); err != nil {
+			return nil
+		}
+
+		key = rest
+	}
+
+	return buffer.Bytes()
+}
+
+// sendsCertificates returns true if the secrets send their certificates in PEM
+func sendsCertificates(s secrets.Secrets) bool {
+
+	switch s.Type() {
+	case secrets.PKIType, secrets.PKISPIFFEType:
+		return true
+	default:
+		return false
+	}
+}
+
+// Randomize adds a nonce to an existing token. Returns the nonce
+func (c *CustomTokenConfig) Randomize(token []byte) (nonce []byte, err error) {
+
+	if len(token) < customNoncePosition+NonceLength {
+		return []byte{}, fmt.Errorf("Token is too small")
+	}
+
+	nonce, err = crypto.GenerateRandomBytes(NonceLength)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	copy(token[customNoncePosition:], nonce)
+
+	return nonce, nil
+}
+
+// RetrieveNonce returns the nonce of a token. It copies the value
+func (c *CustomTokenConfig) RetrieveNonce(token []byte) ([]byte, error) {
+
+	if len(token) < customNoncePosition+NonceLength {
+		return []byte{}, fmt.Errorf("Invalid token")
+	}
+
+	nonce := make([]byte, NonceLength)
+	copy(nonce, token[customNoncePosition:customNoncePosition+NonceLength])
+	return nonce, nil
+}
+
+// AckSize returns the size of the Ack tokens. They carry the two nonces of the
+// connection and the signature of the current key.
+func (c *CustomTokenConfig) AckSize() uint32 {
+
+	method, err := crypto.SigningMethod(c.secrets.EncodingKey())
+	if err != nil {
+		return 0
+	}
+
+	body := c.encodeClaims(&ConnectionClaims{
+		LCL: make([]byte, NonceLength),
+		RMT: make([]byte, NonceLength),
+	})
+
+	return uint32(customHeaderLength + customLengthSize + len(body) + 1 + customSignatureSizes[method.Alg()])
+}
+
+// encodeClaims encodes the claims with the issuer, the expiration and the
+// issue times
+func (c *CustomTokenConfig) encodeClaims(claims *ConnectionClaims) []byte {
+
+	now := time.Now()
+
+	buffer := make([]byte, 8, 128)
+	binary.BigEndian.PutUint32(buffer, uint32(now.Add(c.ValidityPeriod).Unix()))
+	binary.BigEndian.PutUint32(buffer[4:], uint32(now.Unix()))
+
+	buffer = appendBytes(buffer, []byte(c.Issuer))
+
+	var tags []string
+	if claims.T != nil {
+		tags = claims.T.GetSlice()
+	}
+	buffer = appendUvarint(buffer, uint64(len(tags)))
+	for _, tag := range tags {
+		buffer = appendBytes(buffer, []byte(tag))
+	}
+
+	buffer = appendBytes(buffer, claims.RMT)
+	buffer = appendBytes(buffer, claims.LCL)
+	buffer = appendBytes(buffer, claims.EK)
+
+	return buffer
+}
+
+// decodeClaims decodes the claims of a token, with their issuer and issue
+// time, and returns them with the expiration time
+func decodeClaims(body []byte) (claims *ConnectionClaims, expiresAt int64, err error) {
+
+	if len(body) < 8 {
+		return nil, 0, fmt.Errorf("Invalid claims")
+	}
+
+	expiresAt = int64(binary.BigEndian.Uint32(body))
+
+	r := bytes.NewReader(body[8:])
+
+	issuerBytes, err := readBytes(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(r.Len()) {
+		return nil, 0, fmt.Errorf("Invalid tags in claims")
+	}
+
+	claims = &ConnectionClaims{
+		T:   policy.NewTagStore(),
+		IAT: int64(binary.BigEndian.Uint32(body[4:])),
+		ISS: string(issuerBytes),
+	}
+
+	for i := uint64(0); i < count; i++ {
+		tag, err := readBytes(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		claims.T.Tags = append(claims.T.Tags, string(tag))
+	}
+
+	if claims.RMT, err = readBytes(r); err != nil {
+		return nil, 0, err
+	}
+
+	if claims.LCL, err = readBytes(r); err != nil {
+		return nil, 0, err
+	}
+
+	if claims.EK, err = readBytes(r); err != nil {
+		return nil, 0, err
+	}
+
+	if r.Len() != 0 {
+		return nil, 0, fmt.Errorf("Invalid claims: %d extra bytes", r.Len())
+	}
+
+	return claims, expiresAt, nil
+}
+
+// customMethodID returns the identifier of a signing method on the wire
+func customMethodID(method jwt.SigningMethod) (byte, error) {
+
+	for id, m := range customSigningMethods {
+		if m.Alg() == method.Alg() {
+			return byte(id), nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unsupported signing method %s", method.Alg())
+}
+
+// customMethod returns the signing method of an identifier on the wire
+func customMethod(id byte) (jwt.SigningMethod, error) {
+
+	if int(id) >= len(customSigningMethods) {
+		return nil, fmt.Errorf("Unknown signing method %d", id)
+	}
+
+	return customSigningMethods[id], nil
+}
+
+// customSign signs the header and the claims with the signing method of the
+// JWTs and returns the raw signature
+func customSign(method jwt.SigningMethod, header, body []byte, key interface{}) ([]byte, error) {
+
+	signature, err := method.Sign(string(header)+string(body), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.DecodeSegment(signature)
+}
+
+// customVerify verifies the raw signature of the header and the claims
+func customVerify(method jwt.SigningMethod, header, body, signature []byte, key interface{}) error {
+	return method.Verify(string(header)+string(body), jwt.EncodeSegment(signature), key)
+}
+
+// appendUvarint appends a varint to a buffer
+func appendUvarint(buffer []byte, v uint64) []byte {
+
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(encoded[:], v)
+
+	return append(buffer, encoded[:n]...)
+}
+
+// appendBytes appends a byte string preceded by its length to a buffer
+func appendBytes(buffer []byte, data []byte) []byte {
+	return append(appendUvarint(buffer, uint64(len(data))), data...)
+}
+
+// readBytes reads a byte string preceded by its length
+func readBytes(r *bytes.Reader) ([]byte, error) {
+
+	length, err := binary.ReadUvarint(r)
+	if err != nil || length > uint64(r.Len()) {
+		return nil, fmt.Errorf("Invalid claims")
+	}
+
+	data := make([]byte, length)
+	if _, err := r.Read(data); err != nil && length > 0 {
+		return nil, fmt.Errorf("Invalid claims")
 	}
 
-	return claims, nil
+	return data, nil
 }
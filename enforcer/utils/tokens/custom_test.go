@@ -0,0 +1,330 @@
+package tokens
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNewCustomToken(t *testing.T) {
+
+	Convey("When I create a custom token engine without secrets, I should get an error", t, func() {
+		_, err := NewCustomToken(validity, "TEST", nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When I create a custom token engine with a long issuer, I should get an error", t, func() {
+		_, err := NewCustomToken(validity, "0123456789012345678901234567890123456789", secrets.NewPSKSecrets(psk))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("When I create a token engine of each type, I should get the right engine", t, func() {
+		engine, err := NewTokenEngine(JWTType, validity, "TEST", secrets.NewPSKSecrets(psk))
+		So(err, ShouldBeNil)
+		So(engine, ShouldHaveSameTypeAs, &JWTConfig{})
+
+		engine, err = NewTokenEngine(BinaryType, validity, "TEST", secrets.NewPSKSecrets(psk))
+		So(err, ShouldBeNil)
+		So(engine, ShouldHaveSameTypeAs, &CustomTokenConfig{})
+
+		_, err = NewTokenEngine(TokenType(10), validity, "TEST", secrets.NewPSKSecrets(psk))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCreateAndVerifyCustomPSK(t *testing.T) {
+
+	Convey("Given a custom token engine with a pre-shared key", t, func() {
+		c, err := NewCustomToken(validity, "TRIREME", secrets.NewPSKSecrets(psk))
+		So(err, ShouldBeNil)
+
+		claims := &ConnectionClaims{
+			T:   tags,
+			RMT: []byte(rmt),
+			EK:  []byte("ephemeral"),
+		}
+
+		Convey("When I create and decode a Syn token", func() {
+			token, nonce, err := c.CreateAndSign(false, claims)
+			So(err, ShouldBeNil)
+
+			decoded, decodedNonce, _, err := c.Decode(false, token, nil)
+
+			Convey("I should get the claims and the nonce", func() {
+				So(err, ShouldBeNil)
+				So(decoded.T.GetSlice(), ShouldResemble, tags.GetSlice())
+				So(decoded.RMT, ShouldResemble, []byte(rmt))
+				So(decoded.EK, ShouldResemble, []byte("ephemeral"))
+				So(decodedNonce, ShouldResemble, nonce)
+				So(decoded.ISS, ShouldEqual, "TRIREME")
+				So(decoded.IAT, ShouldAlmostEqual, time.Now().Unix(), 1)
+			})
+
+			Convey("When I randomize the token, it should still be valid with the new nonce", func() {
+				randomized, err := c.Randomize(token)
+				So(err, ShouldBeNil)
+
+				retrieved, err := c.RetrieveNonce(token)
+				So(err, ShouldBeNil)
+				So(retrieved, ShouldResemble, randomized)
+
+				_, decodedNonce, _, err := c.Decode(false, token, nil)
+				So(err, ShouldBeNil)
+				So(decodedNonce, ShouldResemble, randomized)
+			})
+		})
+
+		Convey("When I create a Syn token with a signed nonce", func() {
+			signedNonce := []byte("0123456789abcdef")
+			signed := *claims
+			signed.LCL = signedNonce
+			token, nonce, err := c.CreateAndSign(false, &signed)
+			So(err, ShouldBeNil)
+			So(nonce, ShouldResemble, signedNonce)
+
+			Convey("It should be valid with its nonce", func() {
+				decoded, decodedNonce, _, err := c.Decode(false, token, nil)
+				So(err, ShouldBeNil)
+				So(decoded.LCL, ShouldResemble, signedNonce)
+				So(decodedNonce, ShouldResemble, signedNonce)
+			})
+
+			Convey("When I change one byte of the nonce, the token should be rejected", func() {
+				token[customNoncePosition] ^= 0x01
+
+				_, _, _, err := c.Decode(false, token, nil)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I create and decode an Ack token", func() {
+			token, _, err := c.CreateAndSign(true, &ackClaims)
+			So(err, ShouldBeNil)
+
+			decoded, _, _, err := c.Decode(true, token, nil)
+
+			Convey("I should get the nonces of the connection", func() {
+				So(err, ShouldBeNil)
+				So(decoded.RMT, ShouldResemble, []byte(rmt))
+				So(decoded.LCL, ShouldResemble, []byte(lcl))
+			})
+		})
+
+		Convey("When the claims of a token are modified, it should be rejected", func() {
+			token, _, err := c.CreateAndSign(true, &ackClaims)
+			So(err, ShouldBeNil)
+			token[len(token)-40] ^= 0xFF
+
+			_, _, _, err = c.Decode(true, token, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When a token is signed with another key, it should be rejected", func() {
+			other, err := NewCustomToken(validity, "TRIREME", secrets.NewPSKSecrets([]byte("ANOTHER KEY")))
+			So(err, ShouldBeNil)
+			token, _, err := other.CreateAndSign(true, &ackClaims)
+			So(err, ShouldBeNil)
+
+			_, _, _, err = c.Decode(true, token, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When a token has expired, it should be rejected", func() {
+			expired, err := NewCustomToken(-time.Hour, "TRIREME", secrets.NewPSKSecrets(psk))
+			So(err, ShouldBeNil)
+			token, _, err := expired.CreateAndSign(true, &ackClaims)
+			So(err, ShouldBeNil)
+
+			_, _, _, err = c.Decode(true, token, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When a token is truncated or of another version, it should be rejected", func() {
+			token, _, err := c.CreateAndSign(false, claims)
+			So(err, ShouldBeNil)
+
+			for _, length := range []int{0, 1, 10, 30} {
+				_, _, _, err = c.Decode(false, token[:length], nil)
+				So(err, ShouldNotBeNil)
+			}
+
+			token[customVersionPosition] = customTokenVersion + 1
+			_, _, _, err = c.Decode(false, token, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When I decode a JWT, it should be rejected", func() {
+			j, err := NewJWT(validity, "TRIREME", secrets.NewPSKSecrets(psk))
+			So(err, ShouldBeNil)
+			token, _, err := j.CreateAndSign(false, claims)
+			So(err, ShouldBeNil)
+
+			_, _, _, err = c.Decode(false, token, nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// newTestAuthority creates an authority and returns a function that creates
+// PKI secrets with a certificate of the authority for a key
+func newTestAuthority() func(key gocrypto.Signer) secrets.Secrets {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	So(err, ShouldBeNil)
+	ca, err := x509.ParseCertificate(caDER)
+	So(err, ShouldBeNil)
+
+	serial := int64(1)
+
+	return func(key gocrypto.Signer) secrets.Secrets {
+		serial++
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+		So(err, ShouldBeNil)
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		So(err, ShouldBeNil)
+
+		s, err := secrets.NewPKISecrets(
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+			nil,
+		)
+		So(err, ShouldBeNil)
+
+		return s
+	}
+}
+
+func TestVerifyCustomRotatedPSK(t *testing.T) {
+
+	Convey("Given a custom token engine whose pre-shared key was rotated with an overlap window", t, func() {
+		rotating := secrets.NewRotatingSecrets(secrets.NewPSKSecrets(psk))
+		So(rotating.Rotate(secrets.NewPSKSecrets([]byte("New Test Password")), time.Minute), ShouldBeNil)
+		c, err := NewCustomToken(validity, "TRIREME", rotating)
+		So(err, ShouldBeNil)
+
+		Convey("A token signed with the previous key should be accepted", func() {
+			peer, _ := NewCustomToken(validity, "TRIREME", secrets.NewPSKSecrets(psk))
+			token, _, err := peer.CreateAndSign(false, &ConnectionClaims{T: tags, RMT: []byte(rmt)})
+			So(err, ShouldBeNil)
+
+			decoded, _, _, err := c.Decode(false, token, nil)
+			So(err, ShouldBeNil)
+			So(decoded.RMT, ShouldResemble, []byte(rmt))
+		})
+
+		Convey("A token signed with an unknown key should be rejected", func() {
+			peer, _ := NewCustomToken(validity, "TRIREME", secrets.NewPSKSecrets([]byte("Unknown Password")))
+			token, _, err := peer.CreateAndSign(false, &ConnectionClaims{T: tags, RMT: []byte(rmt)})
+			So(err, ShouldBeNil)
+
+			_, _, _, err = c.Decode(false, token, nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCreateAndVerifyCustomPKI(t *testing.T) {
+
+	Convey("Given a P-256 node and an Ed25519 node with custom tokens", t, func() {
+		issue := newTestAuthority()
+
+		p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		_, ed, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+
+		clientSecrets := issue(p256)
+		client, err := NewCustomToken(validity, "client", clientSecrets)
+		So(err, ShouldBeNil)
+		server, err := NewCustomToken(validity, "server", issue(ed))
+		So(err, ShouldBeNil)
+
+		claims := &ConnectionClaims{
+			T:  tags,
+			EK: []byte{},
+		}
+
+		Convey("When they exchange a SYN, a SYN/ACK and an ACK", func() {
+			syn, clientNonce, err := client.CreateAndSign(false, claims)
+			So(err, ShouldBeNil)
+			_, serverRemote, clientCert, err := server.Decode(false, syn, nil)
+			So(err, ShouldBeNil)
+
+			synAck, serverNonce, err := server.CreateAndSign(false, &ConnectionClaims{T: tags, RMT: serverRemote})
+			So(err, ShouldBeNil)
+			synAckClaims, clientRemote, serverCert, err := client.Decode(false, synAck, nil)
+			So(err, ShouldBeNil)
+			So(serverCert, ShouldNotBeNil)
+
+			ack, _, err := client.CreateAndSign(true, &ConnectionClaims{LCL: clientNonce, RMT: clientRemote})
+			So(err, ShouldBeNil)
+			ackDecoded, _, _, err := server.Decode(true, ack, clientCert)
+
+			Convey("Each side should get the nonce of the other one", func() {
+				So(synAckClaims.RMT, ShouldResemble, clientNonce)
+				So(clientRemote, ShouldResemble, serverNonce)
+				So(err, ShouldBeNil)
+				So(ackDecoded.RMT, ShouldResemble, serverNonce)
+				So(ackDecoded.LCL, ShouldResemble, clientNonce)
+			})
+
+			Convey("The ACK should have the size of the engine", func() {
+				So(len(ack), ShouldEqual, client.AckSize())
+
+				serverAck, _, err := server.CreateAndSign(true, &ConnectionClaims{LCL: serverNonce, RMT: clientNonce})
+				So(err, ShouldBeNil)
+				So(len(serverAck), ShouldEqual, server.AckSize())
+			})
+
+			Convey("The SYN should be smaller than a JWT", func() {
+				j, err := NewJWT(validity, "client", clientSecrets)
+				So(err, ShouldBeNil)
+				jwtSyn, _, err := j.CreateAndSign(false, claims)
+				So(err, ShouldBeNil)
+
+				So(len(syn), ShouldBeLessThan, len(jwtSyn))
+			})
+
+			Convey("The SYN should carry the certificate in DER", func() {
+				So(string(syn), ShouldNotContainSubstring, "-----BEGIN")
+			})
+		})
+
+		Convey("When an ACK is verified with the key of another type", func() {
+			ack, _, err := client.CreateAndSign(true, &ackClaims)
+			So(err, ShouldBeNil)
+			_, _, _, err = server.Decode(true, ack, ed.Public())
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
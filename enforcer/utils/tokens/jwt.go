@@ -1,6 +1,7 @@
 package tokens
 
 import (
+	"crypto/x509"
 	"encoding/binary"
 	"fmt"
 	"strings"
@@ -8,7 +9,9 @@ import (
 
 	"github.com/aporeto-inc/trireme/cache"
 	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/revocation"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/enforcer/utils/spiffe"
 	"go.uber.org/zap"
 
 	"github.com/dgrijalva/jwt-go"
@@ -32,8 +35,6 @@ type JWTConfig struct {
 	ValidityPeriod time.Duration
 	// Issuer is the server that issues the JWT
 	Issuer string
-	// signMethod is the method used to sign the JWT
-	signMethod jwt.SigningMethod
 	// secrets is the secrets used for signing and verifying the JWT
 	secrets secrets.Secrets
 	// cache test
@@ -51,25 +52,17 @@ func NewJWT(validity time.Duration, issuer string, s secrets.Secrets) (*JWTConfi
 		issuer = issuer + " "
 	}
 
-	var signMethod jwt.SigningMethod
-
 	if s == nil {
 		return nil, fmt.Errorf("Secrets can not be nil")
 	}
 
-	switch s.Type() {
-	case secrets.PKIType, secrets.PKICompactType:
-		signMethod = jwt.SigningMethodES256
-	case secrets.PSKType:
-		signMethod = jwt.SigningMethodHS256
-	default:
-		signMethod = jwt.SigningMethodNone
+	if _, err := crypto.SigningMethod(s.EncodingKey()); err != nil {
+		return nil, fmt.Errorf("Invalid signing key: %s", err)
 	}
 
 	return &JWTConfig{
 		ValidityPeriod: validity,
 		Issuer:         issuer,
-		signMethod:     signMethod,
 		secrets:        s,
 		tokenCache:     cache.NewCacheWithExpiration(time.Millisecond * 500),
 	}, nil
@@ -88,8 +81,31 @@ func (c *JWTConfig) CreateAndSign(isAck bool, claims *ConnectionClaims) (token [
 		},
 	}
 
-	// Create the token and sign with our key
-	strtoken, err := jwt.NewWithClaims(c.signMethod, allclaims).SignedString(c.secrets.EncodingKey())
+	// The Syn and SynAck tokens carry their issue time, and their nonce if it
+	// is signed, so that the receiver can remember their nonces until they
+	// are too old to be accepted. Ack tokens are bound to the nonces of the
+	// connection and keep their size.
+	if !isAck {
+		nonce, err = tokenNonce(claims)
+		if err != nil {
+			return []byte{}, []byte{}, err
+		}
+
+		stamped := *claims
+		stamped.IAT = time.Now().Unix()
+		allclaims.ConnectionClaims = &stamped
+	}
+
+	// Create the token and sign with our key. The signing method follows the
+	// type of the key, since the secrets can be rotated to another type.
+	key := c.secrets.EncodingKey()
+
+	signMethod, err := crypto.SigningMethod(key)
+	if err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	strtoken, err := jwt.NewWithClaims(signMethod, allclaims).SignedString(key)
 	if err != nil {
 		return []byte{}, []byte{}, err
 	}
@@ -98,11 +114,6 @@ func (c *JWTConfig) CreateAndSign(isAck bool, claims *ConnectionClaims) (token [
 	// again for Ack packets to reduce overhead
 	if !isAck {
 
-		nonce, err := crypto.GenerateRandomBytes(NonceLength)
-		if err != nil {
-			return []byte{}, []byte{}, err
-		}
-
 		txKey := c.secrets.TransmittedKey()
 
 		totalLength := len(strtoken) + len(txKey) + noncePosition + NonceLength + 1
@@ -168,21 +179,30 @@ func (c *JWTConfig) Decode(isAck bool, data []byte, previousCert interface{}) (c
 		certBytes := data[tokenPosition+tokenLength+1:]
 
 		ackCert, err = c.secrets.VerifyPublicKey(certBytes)
+		if err == revocation.ErrRevoked {
+			return nil, nil, nil, err
+		}
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("bad public key")
 		}
 
 		if cachedClaims, cerr := c.tokenCache.Get(string(token)); cerr == nil {
+			if err := checkSignedNonce(cachedClaims.(*ConnectionClaims), nonce); err != nil {
+				return nil, nil, nil, err
+			}
 			return cachedClaims.(*ConnectionClaims), nonce, ackCert, nil
 		}
 	}
 
 	// Parse the JWT token with the public key recovered
-	jwttoken, err := jwt.ParseWithClaims(string(token), jwtClaims, func(token *jwt.Token) (interface{}, error) {
-		server := token.Claims.(*JWTClaims).Issuer
-		server = strings.Trim(server, " ")
-		return c.secrets.DecodingKey(server, ackCert, previousCert)
-	})
+	jwttoken, err := jwt.ParseWithClaims(string(token), jwtClaims, keyFunc(c.secrets.DecodingKey, ackCert, previousCert))
+
+	// During the overlap window of rotated secrets, the token may be signed
+	// with the previous key
+	if overlapping, ok := c.secrets.(secrets.OverlappingSecrets); ok && (err != nil || !jwttoken.Valid) {
+		jwtClaims = &JWTClaims{}
+		jwttoken, err = jwt.ParseWithClaims(string(token), jwtClaims, keyFunc(overlapping.PreviousDecodingKey, ackCert, previousCert))
+	}
 
 	// If error is returned or the token is not valid, reject it
 	if err != nil || !jwttoken.Valid {
@@ -190,11 +210,66 @@ func (c *JWTConfig) Decode(isAck bool, data []byte, previousCert interface{}) (c
 		return nil, nil, nil, fmt.Errorf("Invalid token")
 	}
 
+	// The nonce in front of the token must be the one that was signed, if any
+	if !isAck {
+		if err := checkSignedNonce(jwtClaims.ConnectionClaims, nonce); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if jwtClaims.ConnectionClaims != nil {
+		jwtClaims.ConnectionClaims.SID = spiffeID(c.secrets, ackCert)
+		jwtClaims.ConnectionClaims.ISS = strings.Trim(jwtClaims.Issuer, " ")
+	}
+
 	c.tokenCache.AddOrUpdate(string(token), jwtClaims.ConnectionClaims)
 
 	return jwtClaims.ConnectionClaims, nonce, ackCert, nil
 }
 
+// keyFunc returns the function that finds the key a JWT token is verified
+// with, using a decoding key function of the secrets
+func keyFunc(decodingKey func(string, interface{}, interface{}) (interface{}, error), ackCert, previousCert interface{}) jwt.Keyfunc {
+
+	return func(token *jwt.Token) (interface{}, error) {
+		server := token.Claims.(*JWTClaims).Issuer
+		server = strings.Trim(server, " ")
+		key, err := decodingKey(server, ackCert, previousCert)
+		if err != nil {
+			return nil, err
+		}
+		// The peer picks the signing method of its key, which must be the
+		// method of the key that we verify it with
+		if err := crypto.CheckSigningMethod(token.Method, key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+}
+
+// spiffeID returns the SPIFFE ID of a verified certificate of the transmitter,
+// or an empty string if it has none. The SPIFFE IDs are only trusted with the
+// SPIFFE secrets, which verify a certificate with the bundle of the trust
+// domain of its SPIFFE ID.
+func spiffeID(s secrets.Secrets, cert interface{}) string {
+
+	if s.Type() != secrets.PKISPIFFEType {
+		return ""
+	}
+
+	x509Cert, ok := cert.(*x509.Certificate)
+	if !ok {
+		return ""
+	}
+
+	id, err := spiffe.IDFromCertificate(x509Cert)
+	if err != nil {
+		return ""
+	}
+
+	return id
+}
+
 // Randomize adds a nonce to an existing token. Returns the nonce
 func (c *JWTConfig) Randomize(token []byte) (nonce []byte, err error) {
 
@@ -212,6 +287,11 @@ func (c *JWTConfig) Randomize(token []byte) (nonce []byte, err error) {
 	return nonce, nil
 }
 
+// AckSize returns the size of the tokens of the Ack packets, given by the secrets
+func (c *JWTConfig) AckSize() uint32 {
+	return c.secrets.AckSize()
+}
+
 // RetrieveNonce returns the nonce of a token. It copies the value
 func (c *JWTConfig) RetrieveNonce(token []byte) ([]byte, error) {
 	if len(token) < tokenPosition {
@@ -1,12 +1,25 @@
 package tokens
 
 import (
+	gocrypto "crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/aporeto-inc/trireme/crypto"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/enforcer/utils/spiffe"
 	"github.com/aporeto-inc/trireme/policy"
 	jwt "github.com/dgrijalva/jwt-go"
 	. "github.com/smartystreets/goconvey/convey"
@@ -100,7 +113,9 @@ func TestConstructorNewJWT(t *testing.T) {
 		So(jwtConfig, ShouldHaveSameTypeAs, j)
 		So(jwtConfig.Issuer, ShouldResemble, "TRIREME                             ")
 		So(jwtConfig.ValidityPeriod.Seconds(), ShouldEqual, validity.Seconds())
-		So(jwtConfig.signMethod, ShouldEqual, jwt.SigningMethodHS256)
+		method, err := crypto.SigningMethod(jwtConfig.secrets.EncodingKey())
+		So(err, ShouldBeNil)
+		So(method, ShouldEqual, jwt.SigningMethodHS256)
 	})
 
 	Convey("Given that I instantiate a new JWT Engine with PKI secrets, it should succeed", t, func() {
@@ -113,7 +128,9 @@ func TestConstructorNewJWT(t *testing.T) {
 		So(jwtConfig, ShouldHaveSameTypeAs, j)
 		So(jwtConfig.Issuer, ShouldResemble, "TRIREME                             ")
 		So(jwtConfig.ValidityPeriod.Seconds(), ShouldEqual, validity.Seconds())
-		So(jwtConfig.signMethod, ShouldEqual, jwt.SigningMethodES256)
+		method, err := crypto.SigningMethod(jwtConfig.secrets.EncodingKey())
+		So(err, ShouldBeNil)
+		So(method, ShouldEqual, jwt.SigningMethodES256)
 	})
 
 	Convey("Given that I instantiate a new JWT null encryption, it should succeed", t, func() {
@@ -126,7 +143,9 @@ func TestConstructorNewJWT(t *testing.T) {
 		So(jwtConfig, ShouldHaveSameTypeAs, j)
 		So(jwtConfig.Issuer, ShouldResemble, "TRIREME                             ")
 		So(jwtConfig.ValidityPeriod.Seconds(), ShouldEqual, validity.Seconds())
-		So(jwtConfig.signMethod, ShouldEqual, jwt.SigningMethodNone)
+		method, err := crypto.SigningMethod(jwtConfig.secrets.EncodingKey())
+		So(err, ShouldBeNil)
+		So(method, ShouldEqual, jwt.SigningMethodNone)
 	})
 
 }
@@ -150,6 +169,9 @@ func TestCreateAndVerifyPSK(t *testing.T) {
 			So(lclaims, ShouldResemble, dclaims)
 			So(string(recoveredClaims.RMT), ShouldEqual, rmt)
 			So(recoveredNonce, ShouldResemble, nonce)
+			So(recoveredClaims.ISS, ShouldEqual, "TRIREME")
+			So(recoveredClaims.IAT, ShouldAlmostEqual, time.Now().Unix(), 1)
+			So(defaultClaims.IAT, ShouldEqual, 0)
 		})
 
 		Convey("Given a signature request for an ACK packet", func() {
@@ -161,6 +183,7 @@ func TestCreateAndVerifyPSK(t *testing.T) {
 			So(recoveredClaims.RMT, ShouldResemble, []byte(rmt))
 			So(recoveredClaims.LCL, ShouldResemble, []byte(lcl))
 			So(recoveredClaims.T, ShouldBeNil)
+			So(recoveredClaims.IAT, ShouldEqual, 0)
 		})
 
 		Convey("Given a signature request with a bad packet ", func() {
@@ -172,6 +195,33 @@ func TestCreateAndVerifyPSK(t *testing.T) {
 	})
 }
 
+func TestVerifyRotatedPSK(t *testing.T) {
+	Convey("Given a JWT engine whose pre-shared key was rotated with an overlap window", t, func() {
+		rotating := secrets.NewRotatingSecrets(secrets.NewPSKSecrets(psk))
+		So(rotating.Rotate(secrets.NewPSKSecrets([]byte("New Test Password")), time.Minute), ShouldBeNil)
+		jwtConfig, _ := NewJWT(validity, "TRIREME", rotating)
+
+		Convey("A token signed with the previous key should be accepted", func() {
+			peer, _ := NewJWT(validity, "TRIREME", secrets.NewPSKSecrets(psk))
+			token, _, err := peer.CreateAndSign(false, &defaultClaims)
+			So(err, ShouldBeNil)
+
+			claims, _, _, err := jwtConfig.Decode(false, token, nil)
+			So(err, ShouldBeNil)
+			So(string(claims.RMT), ShouldEqual, rmt)
+		})
+
+		Convey("A token signed with an unknown key should be rejected", func() {
+			peer, _ := NewJWT(validity, "TRIREME", secrets.NewPSKSecrets([]byte("Unknown Password")))
+			token, _, err := peer.CreateAndSign(false, &defaultClaims)
+			So(err, ShouldBeNil)
+
+			_, _, _, err = jwtConfig.Decode(false, token, nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
 func TestCreateAndVerifyPKI(t *testing.T) {
 	Convey("Given a JWT valid engine with a PKI  key ", t, func() {
 		secrets, serr := secrets.NewPKISecrets([]byte(keyPEM), []byte(certPEM), []byte(caPool), nil)
@@ -302,6 +352,44 @@ func TestRamdomize(t *testing.T) {
 	})
 }
 
+func TestSignedNonce(t *testing.T) {
+	Convey("Given a token engine with PKI key and a token with a signed nonce", t, func() {
+		secrets, serr := secrets.NewPKISecrets([]byte(keyPEM), []byte(certPEM), []byte(caPool), nil)
+		So(serr, ShouldBeNil)
+		jwtConfig, _ := NewJWT(validity, "TRIREME", secrets)
+
+		signedNonce := []byte("0123456789abcdef")
+		claims := defaultClaims
+		claims.LCL = signedNonce
+		token, nonce, err := jwtConfig.CreateAndSign(false, &claims)
+		So(err, ShouldBeNil)
+		So(nonce, ShouldResemble, signedNonce)
+
+		Convey("When I decode the token, it should be valid", func() {
+			decoded, decodedNonce, _, err := jwtConfig.Decode(false, token, nil)
+			So(err, ShouldBeNil)
+			So(decoded.LCL, ShouldResemble, signedNonce)
+			So(decodedNonce, ShouldResemble, signedNonce)
+		})
+
+		Convey("When I randomize the token, it should be rejected", func() {
+			_, err := jwtConfig.Randomize(token)
+			So(err, ShouldBeNil)
+			_, _, _, err = jwtConfig.Decode(false, token, nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When I change one byte of the nonce of a cached token, the token should be rejected", func() {
+			_, _, _, err := jwtConfig.Decode(false, token, nil)
+			So(err, ShouldBeNil)
+
+			token[noncePosition] ^= 0x01
+			_, _, _, err = jwtConfig.Decode(false, token, nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
 func TestRetrieveNonce(t *testing.T) {
 	Convey("Given a token engine and a good token", t, func() {
 		secrets, serr := secrets.NewPKISecrets([]byte(keyPEM), []byte(certPEM), []byte(caPool), nil)
@@ -321,3 +409,197 @@ func TestRetrieveNonce(t *testing.T) {
 		})
 	})
 }
+
+func TestCreateAndVerifySPIFFE(t *testing.T) {
+
+	Convey("Given two workloads with SVIDs of the same trust domain", t, func() {
+		dir, err := ioutil.TempDir("", "tokens")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint
+
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		caTemplate := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+		So(err, ShouldBeNil)
+		ca, err := x509.ParseCertificate(caDER)
+		So(err, ShouldBeNil)
+
+		workload := func(id string, serial int64) secrets.Secrets {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			So(err, ShouldBeNil)
+			uri, err := url.Parse(id)
+			So(err, ShouldBeNil)
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(serial),
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				URIs:         []*url.URL{uri},
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+			So(err, ShouldBeNil)
+			cert, err := x509.ParseCertificate(der)
+			So(err, ShouldBeNil)
+
+			socket := filepath.Join(dir, fmt.Sprintf("agent%d.sock", serial))
+			server, err := spiffe.NewServer(socket)
+			So(err, ShouldBeNil)
+			Reset(server.Stop)
+
+			So(server.SetX509SVIDs([]*spiffe.X509SVID{{
+				ID:           id,
+				Certificates: []*x509.Certificate{cert},
+				PrivateKey:   key,
+				Bundle:       []*x509.Certificate{ca},
+			}}, nil), ShouldBeNil)
+
+			s, err := secrets.NewSPIFFESecrets(socket)
+			So(err, ShouldBeNil)
+			Reset(s.Stop)
+
+			return s
+		}
+
+		sender, err := NewJWT(validity, "sender", workload("spiffe://example.org/db", 2))
+		So(err, ShouldBeNil)
+		receiver, err := NewJWT(validity, "receiver", workload("spiffe://example.org/web", 3))
+		So(err, ShouldBeNil)
+
+		Convey("When the receiver decodes a token of the sender", func() {
+			claims := &ConnectionClaims{
+				T:   policy.NewTagStoreFromMap(map[string]string{"label1": "value1"}),
+				RMT: []byte(rmt),
+				EK:  []byte{},
+				SID: "spiffe://example.org/admin",
+			}
+			token, _, err := sender.CreateAndSign(false, claims)
+			So(err, ShouldBeNil)
+
+			decoded, _, cert, err := receiver.Decode(false, token, nil)
+
+			Convey("The SPIFFE ID of the certificate of the sender should be in the claims", func() {
+				So(err, ShouldBeNil)
+				So(cert, ShouldNotBeNil)
+				So(decoded.SID, ShouldEqual, "spiffe://example.org/db")
+			})
+		})
+	})
+}
+
+func TestCreateAndVerifyKeyTypes(t *testing.T) {
+
+	Convey("Given a P-384 node and an Ed25519 node of the same authority", t, func() {
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		caTemplate := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+		So(err, ShouldBeNil)
+		ca, err := x509.ParseCertificate(caDER)
+		So(err, ShouldBeNil)
+
+		node := func(name string, key gocrypto.Signer, serial int64) *JWTConfig {
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(serial),
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+			So(err, ShouldBeNil)
+			keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+			So(err, ShouldBeNil)
+
+			s, err := secrets.NewPKISecrets(
+				pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+				nil,
+			)
+			So(err, ShouldBeNil)
+
+			c, err := NewJWT(validity, name, s)
+			So(err, ShouldBeNil)
+			return c
+		}
+
+		p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		So(err, ShouldBeNil)
+		_, ed, err := ed25519.GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+
+		client := node("client", p384, 2)
+		server := node("server", ed, 3)
+
+		claims := &ConnectionClaims{
+			T:   tags,
+			RMT: []byte(rmt),
+			EK:  []byte{},
+		}
+
+		Convey("When they exchange a SYN, a SYN/ACK and an ACK", func() {
+			syn, _, err := client.CreateAndSign(false, claims)
+			So(err, ShouldBeNil)
+			_, _, clientCert, err := server.Decode(false, syn, nil)
+			So(err, ShouldBeNil)
+
+			synAck, _, err := server.CreateAndSign(false, claims)
+			So(err, ShouldBeNil)
+			_, _, serverCert, err := client.Decode(false, synAck, nil)
+			So(err, ShouldBeNil)
+
+			// The ACK claims are the nonces of the connection, as in the datapath
+			ackClaims := &ConnectionClaims{
+				LCL: make([]byte, NonceLength),
+				RMT: make([]byte, NonceLength),
+			}
+			ack, _, err := client.CreateAndSign(true, ackClaims)
+			So(err, ShouldBeNil)
+			decoded, _, _, err := server.Decode(true, ack, clientCert)
+
+			Convey("Each token should be verified with the signing method of its sender", func() {
+				So(serverCert, ShouldNotBeNil)
+				So(err, ShouldBeNil)
+				So(decoded.RMT, ShouldResemble, ackClaims.RMT)
+			})
+
+			Convey("The ACK should grow with the signature of the key of its sender", func() {
+				p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				So(err, ShouldBeNil)
+				reference := node("reference", p256, 4)
+				referenceAck, _, err := reference.CreateAndSign(true, ackClaims)
+				So(err, ShouldBeNil)
+
+				serverAck, _, err := server.CreateAndSign(true, ackClaims)
+				So(err, ShouldBeNil)
+
+				So(len(ack)-len(referenceAck), ShouldEqual, client.secrets.AckSize()-reference.secrets.AckSize())
+				So(len(serverAck)-len(referenceAck), ShouldEqual, server.secrets.AckSize()-reference.secrets.AckSize())
+			})
+		})
+
+		Convey("When an ACK is verified with the key of another type", func() {
+			ack, _, err := client.CreateAndSign(true, claims)
+			So(err, ShouldBeNil)
+			_, _, _, err = server.Decode(true, ack, ed.Public())
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -1,32 +1,81 @@
 package tokens
 
-import "github.com/aporeto-inc/trireme/policy"
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/policy"
+)
 
 // ConnectionClaims captures all the claim information
 type ConnectionClaims struct {
 	T *policy.TagStore
 	// RMT is the nonce of the remote that has to be signed in the JWT
 	RMT []byte
-	// LCL is the nonce of the local node that has to be signed
+	// LCL is the nonce of the local node that has to be signed. In the Syn
+	// and SynAck tokens, it is the signed nonce of the token, if any
 	LCL []byte
 	// EK is the ephemeral EC key for encryption
 	EK []byte
+	// SID is the SPIFFE ID of the certificate of the transmitter. It is never
+	// transmitted and only set by the receiver once the certificate is verified
+	SID string `json:",omitempty"`
+	// IAT is the time at which the token was issued, in seconds since the
+	// epoch. The receiver checks it against its replay window
+	IAT int64 `json:",omitempty"`
+	// ISS is the issuer of the token. It is never transmitted and only set by
+	// the receiver once the token is verified
+	ISS string `json:"-"`
 }
 
 // TokenEngine is the interface to the different implementations of tokens
 type TokenEngine interface {
-	// CreteAndSign creates a token, signs it and produces the final byte string
+	// CreteAndSign creates a token, signs it and produces the final byte string.
+	// The nonce of the Syn and SynAck tokens is the LCL of the claims if it has
+	// the length of a nonce. It is then signed so that the receivers can detect
+	// the replayed tokens. Otherwise, the tokens get a new random nonce that is
+	// not signed.
 	CreateAndSign(isAck bool, claims *ConnectionClaims) (token []byte, nonce []byte, err error)
 	// Decode decodes an incoming buffer and returns the claims and the sender certificate
 	Decode(isAck bool, data []byte, previousCert interface{}) (claims *ConnectionClaims, nonce []byte, publicKey interface{}, err error)
 	// Randomize inserts a source nonce in an existing token - New nonce will be
 	// create every time the token is transmitted as a challenge to the other side
 	// even when the token is cached. There should be space in the token already.
-	// Returns an error if there is no space
+	// Returns an error if there is no space. The tokens with a signed nonce are
+	// not valid anymore once randomized.
 	Randomize([]byte) (nonce []byte, err error)
 	// RetrieveNonce retrieves the nonce from the token only. Returns the nonce
 	// or an error if the nonce cannot be decoded
 	RetrieveNonce([]byte) ([]byte, error)
+	// AckSize returns the size of the tokens of the Ack packets
+	AckSize() uint32
+}
+
+// TokenType is the encoding of the tokens on the wire
+type TokenType int
+
+const (
+	// JWTType encodes the tokens as JWTs
+	JWTType TokenType = iota
+	// BinaryType encodes the tokens in the compact binary format of the
+	// custom tokens. It keeps the Syn packets small.
+	BinaryType
+)
+
+// NewTokenEngine creates the token engine of the given type
+func NewTokenEngine(tokenType TokenType, validity time.Duration, issuer string, s secrets.Secrets) (TokenEngine, error) {
+
+	switch tokenType {
+	case JWTType:
+		return NewJWT(validity, issuer, s)
+	case BinaryType:
+		return NewCustomToken(validity, issuer, s)
+	default:
+		return nil, fmt.Errorf("Unknown token type %d", tokenType)
+	}
 }
 
 const (
@@ -35,3 +84,33 @@ const (
 	// NonceLength is the length of the Nonce to be used in the secrets
 	NonceLength = 16
 )
+
+// tokenNonce returns the nonce of a Syn or SynAck token. It is the LCL of the
+// claims if it has the length of a nonce, which is then signed, or a new
+// random nonce.
+func tokenNonce(claims *ConnectionClaims) ([]byte, error) {
+
+	if signedNonce(claims) {
+		return claims.LCL, nil
+	}
+
+	return crypto.GenerateRandomBytes(NonceLength)
+}
+
+// signedNonce returns true if the nonce of a Syn or SynAck token is signed in
+// its claims
+func signedNonce(claims *ConnectionClaims) bool {
+	return claims != nil && len(claims.LCL) == NonceLength
+}
+
+// checkSignedNonce checks that the nonce of a Syn or SynAck token is the one
+// signed in its claims, if any. The receivers remember the nonces to reject
+// the replayed tokens, so they must not be changed by anyone but the issuer.
+func checkSignedNonce(claims *ConnectionClaims, nonce []byte) error {
+
+	if signedNonce(claims) && !bytes.Equal(claims.LCL, nonce) {
+		return fmt.Errorf("Invalid token: nonce does not match the signed nonce")
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package enforcer
+
+import (
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/crypto"
+	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAuditedFlows(t *testing.T) {
+
+	Convey("Given an enforcer with a monitored PU", t, func() {
+
+		records := &channelCollector{flows: make(chan *collector.FlowRecord, 10)}
+		secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+		enforcer := NewWithDefaults("SomeServerId", records, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+
+		ips := policy.ExtendedMap{policy.DefaultNamespace: "10.1.1.1"}
+		puInfo := policy.NewPUInfo("audit-pu", constants.ContainerPU)
+		puInfo.Policy = policy.NewPUPolicy("audit-pu", policy.Monitor, nil, nil, nil, nil, nil, nil, ips, nil, nil)
+		puInfo.Runtime.SetIPAddresses(ips)
+		So(enforcer.Enforce("audit-pu", puInfo), ShouldBeNil)
+
+		item, err := enforcer.contextTracker.Get("audit-pu")
+		So(err, ShouldBeNil)
+		context := item.(*PUContext)
+
+		Convey("The context should be monitored", func() {
+			So(context.isMonitored(), ShouldBeTrue)
+		})
+
+		Convey("When a flow of the PU is rejected, it should be reported as audited", func() {
+			enforcer.reportRejectedFlow(tcpTestPacket("10.1.1.2", "10.1.1.1", 2000, 80), nil, "remote", "audit-pu", context, collector.PolicyDrop, nil, nil)
+
+			record := <-records.flows
+			So(record.Action, ShouldEqual, policy.Reject|policy.Audit)
+			So(record.DropReason, ShouldEqual, collector.PolicyDrop)
+		})
+
+		Convey("When the PU is not monitored anymore, its rejected flows should be reported as rejected", func() {
+			puInfo.Policy = policy.NewPUPolicy("audit-pu", policy.Police, nil, nil, nil, nil, nil, nil, ips, nil, nil)
+			So(enforcer.Enforce("audit-pu", puInfo), ShouldBeNil)
+			So(context.isMonitored(), ShouldBeFalse)
+
+			enforcer.reportRejectedFlow(tcpTestPacket("10.1.1.2", "10.1.1.1", 2000, 80), nil, "remote", "audit-pu", context, collector.PolicyDrop, nil, nil)
+
+			record := <-records.flows
+			So(record.Action, ShouldEqual, policy.Reject)
+		})
+	})
+
+	Convey("Given a monitored PU with an encrypted connection", t, func() {
+
+		records := &channelCollector{flows: make(chan *collector.FlowRecord, 10)}
+		secret := secrets.NewPSKSecrets([]byte("Dummy Test Password"))
+		enforcer := NewWithDefaults("SomeServerId", records, nil, secret, constants.LocalContainer, "/proc").(*Datapath)
+
+		ips := policy.ExtendedMap{policy.DefaultNamespace: "10.1.1.1"}
+		puInfo := policy.NewPUInfo("audit-pu", constants.ContainerPU)
+		puInfo.Policy = policy.NewPUPolicy("audit-pu", policy.Monitor, nil, nil, nil, nil, nil, nil, ips, nil, nil)
+		puInfo.Runtime.SetIPAddresses(ips)
+		So(enforcer.Enforce("audit-pu", puInfo), ShouldBeNil)
+
+		item, err := enforcer.contextTracker.Get("audit-pu")
+		So(err, ShouldBeNil)
+
+		initiatorKey, initiatorEK := crypto.CreateEphemeralKey(elliptic.P256)
+		responderKey, responderEK := crypto.CreateEphemeralKey(elliptic.P256)
+		initiator, err := newFlowCipher(initiatorKey, responderEK, []byte("0123456789abcdef"), []byte("fedcba9876543210"), true)
+		So(err, ShouldBeNil)
+		responder, err := newFlowCipher(responderKey, initiatorEK, []byte("0123456789abcdef"), []byte("fedcba9876543210"), false)
+		So(err, ShouldBeNil)
+
+		conn := NewTCPConnection()
+		conn.Context = item.(*PUContext)
+		conn.encryption = responder
+		conn.SetState(TCPData)
+
+		sent := tcpTestDataPacket("10.1.1.2", "10.1.1.1", 2000, 80, []byte("GET / HTTP/1.1\r\n\r\n"))
+		So(enforcer.encryptPayload(sent, &TCPConnection{encryption: initiator}), ShouldBeNil)
+		sent.UpdateTCPChecksum()
+		segment := sent.GetBytes()
+
+		Convey("When a tampered encrypted segment is received, it should be dropped", func() {
+			segment[len(segment)-1] ^= 0x01
+			p, err := packet.New(packet.PacketTypeNetwork, segment, "0")
+			So(err, ShouldBeNil)
+			enforcer.netOrigConnectionTracker.AddOrUpdate(p.L4FlowHash(), conn)
+
+			So(enforcer.processNetworkTCPPackets(p), ShouldNotBeNil)
+			So(conn.GetState(), ShouldEqual, TCPData)
+			So(conn.encryption, ShouldEqual, responder)
+		})
+
+		Convey("When a valid encrypted segment is received, it should be accepted", func() {
+			p, err := packet.New(packet.PacketTypeNetwork, segment, "0")
+			So(err, ShouldBeNil)
+			enforcer.netOrigConnectionTracker.AddOrUpdate(p.L4FlowHash(), conn)
+
+			So(enforcer.processNetworkTCPPackets(p), ShouldBeNil)
+		})
+	})
+
+	Convey("When I audit an accepted policy, it should be rejected and audited without changing the original", t, func() {
+		plc := &policy.FlowPolicy{Action: policy.Accept | policy.Log, PolicyID: "p1"}
+		audited := auditedPolicy(plc)
+
+		So(audited.Action, ShouldEqual, policy.Reject|policy.Log|policy.Audit)
+		So(audited.PolicyID, ShouldEqual, "p1")
+		So(plc.Action, ShouldEqual, policy.Accept|policy.Log)
+	})
+}
@@ -0,0 +1,384 @@
+package enforcer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/collector"
+)
+
+// queueStopper stops a queue, so that the kernel does not send it packets
+// anymore. The packets are then accepted if the trap rules bypass the queue.
+type queueStopper interface {
+	StopQueue() error
+}
+
+// nfqueueProcFile lists the queues bound in the network namespace of the
+// enforcer with the number of packets that wait for a verdict in each of them
+const nfqueueProcFile = "/proc/net/netfilter/nfnetlink_queue"
+
+// queueBacklog returns the number of packets that wait in each queue
+type queueBacklog func() (map[uint16]uint32, error)
+
+// queueStarter binds a queue again once its stalled packet is processed, and
+// returns the handle that stops it
+type queueStarter func(queue uint16) (queueStopper, error)
+
+// queueWatch tracks the packets processed by the queues of one direction, so
+// that the watchdog notices the queues that are stalled
+type queueWatch struct {
+	// stalls is the number of stalls detected. It is accessed atomically and
+	// must stay at the beginning of the structure to be 64-bit aligned.
+	stalls uint64
+
+	first uint16
+	// busy is the time, in nanoseconds since the epoch, at which each queue
+	// started to process its current packet, or 0 when it is idle
+	busy []int64
+	// last is the time, in nanoseconds since the epoch, at which each queue
+	// last made progress with a packet
+	last []int64
+	// waiting is the time at which the watchdog found packets waiting in the
+	// kernel for each queue, or zero when there are none. It is only accessed
+	// by the watchdog.
+	waiting []time.Time
+	// stalled and stopped are set for each queue that is stalled and that
+	// was stopped by the watchdog
+	stalled []int32
+	stopped []int32
+	handles []queueStopper
+	starter queueStarter
+
+	sync.Mutex
+}
+
+// newQueueWatch creates the watch of a range of queues
+func newQueueWatch(first uint16, count uint16) *queueWatch {
+
+	return &queueWatch{
+		first:   first,
+		busy:    make([]int64, count),
+		last:    make([]int64, count),
+		waiting: make([]time.Time, count),
+		stalled: make([]int32, count),
+		stopped: make([]int32, count),
+		handles: make([]queueStopper, count),
+	}
+}
+
+// index returns the index of a queue in the watch, or -1 if it is not watched
+func (w *queueWatch) index(queue uint16) int {
+
+	index := int(queue) - int(w.first)
+	if index < 0 || index >= len(w.busy) {
+		return -1
+	}
+
+	return index
+}
+
+// setHandle sets the handle that stops a queue
+func (w *queueWatch) setHandle(queue uint16, handle queueStopper) {
+
+	if index := w.index(queue); index >= 0 {
+		w.Lock()
+		w.handles[index] = handle
+		w.Unlock()
+	}
+}
+
+// setStarter sets the function that binds the stopped queues again
+func (w *queueWatch) setStarter(starter queueStarter) {
+
+	w.Lock()
+	w.starter = starter
+	w.Unlock()
+}
+
+// begin records that a queue started to process a packet
+func (w *queueWatch) begin(queue uint16) {
+
+	if index := w.index(queue); index >= 0 {
+		now := time.Now().UnixNano()
+		atomic.StoreInt64(&w.busy[index], now)
+		atomic.StoreInt64(&w.last[index], now)
+	}
+}
+
+// end records that a queue is done with its packet
+func (w *queueWatch) end(queue uint16) {
+
+	if index := w.index(queue); index >= 0 {
+		atomic.StoreInt64(&w.busy[index], 0)
+		atomic.StoreInt64(&w.last[index], time.Now().UnixNano())
+	}
+}
+
+// check finds the queues that are processing a packet for longer than the
+// timeout, and the queues whose reader made no progress for longer than the
+// timeout although packets wait for them in the kernel. The reader of such a
+// queue died or is blocked outside of the callback. If failOpen is set, the
+// stalled queues are stopped so that their packets are accepted by the kernel.
+// Otherwise their packets are dropped until they recover. The stopped queues
+// are bound again once they recover. It returns the number of queues that
+// stalled since the last check and the number of queues that it stopped.
+func (w *queueWatch) check(direction string, now time.Time, timeout time.Duration, failOpen bool, backlog map[uint16]uint32) (stalls int, stopped int) {
+
+	for index := range w.busy {
+
+		queue := w.first + uint16(index)
+		busy := atomic.LoadInt64(&w.busy[index])
+		stalled := busy != 0 && now.Sub(time.Unix(0, busy)) > timeout
+
+		if backlog[queue] == 0 {
+			w.waiting[index] = time.Time{}
+		} else if !stalled {
+			if w.waiting[index].IsZero() {
+				w.waiting[index] = now
+			}
+			progress := time.Unix(0, atomic.LoadInt64(&w.last[index]))
+			if progress.Before(w.waiting[index]) {
+				progress = w.waiting[index]
+			}
+			stalled = now.Sub(progress) > timeout
+		}
+
+		if !stalled {
+			if atomic.CompareAndSwapInt32(&w.stalled[index], 1, 0) {
+				zap.L().Info("Queue recovered", zap.String("direction", direction), zap.Uint16("queue", queue))
+			}
+			if atomic.LoadInt32(&w.stopped[index]) == 1 {
+				w.restart(direction, index)
+			}
+			continue
+		}
+
+		if !atomic.CompareAndSwapInt32(&w.stalled[index], 0, 1) {
+			continue
+		}
+
+		atomic.AddUint64(&w.stalls, 1)
+		stalls++
+
+		if !failOpen {
+			zap.L().Error("Queue is stalled, its packets are dropped",
+				zap.String("direction", direction),
+				zap.Uint16("queue", queue),
+				zap.Uint32("backlog", backlog[queue]),
+				zap.Duration("timeout", timeout),
+			)
+			continue
+		}
+
+		zap.L().Error("Queue is stalled, stopping it to accept its packets",
+			zap.String("direction", direction),
+			zap.Uint16("queue", queue),
+			zap.Uint32("backlog", backlog[queue]),
+			zap.Duration("timeout", timeout),
+		)
+
+		w.Lock()
+		handle := w.handles[index]
+		w.Unlock()
+
+		if handle == nil || atomic.LoadInt32(&w.stopped[index]) == 1 {
+			continue
+		}
+
+		if err := handle.StopQueue(); err != nil {
+			zap.L().Error("Failed to stop stalled queue", zap.Uint16("queue", queue), zap.Error(err))
+			continue
+		}
+
+		atomic.StoreInt32(&w.stopped[index], 1)
+		stopped++
+	}
+
+	return stalls, stopped
+}
+
+// restart binds a stopped queue again. It is retried at the next check if it
+// fails.
+func (w *queueWatch) restart(direction string, index int) {
+
+	queue := w.first + uint16(index)
+
+	w.Lock()
+	starter := w.starter
+	w.Unlock()
+
+	if starter == nil {
+		return
+	}
+
+	handle, err := starter(queue)
+	if err != nil {
+		zap.L().Error("Failed to bind recovered queue", zap.String("direction", direction), zap.Uint16("queue", queue), zap.Error(err))
+		return
+	}
+
+	w.setHandle(queue, handle)
+	atomic.StoreInt32(&w.stopped[index], 0)
+
+	zap.L().Info("Queue bound again", zap.String("direction", direction), zap.Uint16("queue", queue))
+}
+
+// counts returns the number of queues that are stalled and stopped
+func (w *queueWatch) counts() (stalled uint16, stopped uint16) {
+
+	for index := range w.busy {
+		if atomic.LoadInt32(&w.stalled[index]) == 1 {
+			stalled++
+		}
+		if atomic.LoadInt32(&w.stopped[index]) == 1 {
+			stopped++
+		}
+	}
+
+	return stalled, stopped
+}
+
+// readQueueBacklog reads the number of packets that wait in each queue of the
+// network namespace of the enforcer
+func readQueueBacklog() (map[uint16]uint32, error) {
+
+	file, err := os.Open(nfqueueProcFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint
+
+	return parseQueueBacklog(file)
+}
+
+// parseQueueBacklog parses the queues listed by the kernel. The first field of
+// each line is the number of the queue and the third one is the number of
+// packets that wait for a verdict.
+func parseQueueBacklog(r io.Reader) (map[uint16]uint32, error) {
+
+	backlog := map[uint16]uint32{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+
+		queue, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid queue number %s: %s", fields[0], err)
+		}
+
+		total, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid backlog of queue %d: %s", queue, err)
+		}
+
+		backlog[uint16(queue)] = uint32(total)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return backlog, nil
+}
+
+// startWatchdog checks the queues periodically until the stop channel is
+// closed. The stalled queues are stopped if the packets of any PU must be
+// accepted when they can not be processed. The trap rules of each PU bypass
+// the stopped queues or not, as its failure policy says. Every stall is
+// reported to the collector for each PU.
+func (d *Datapath) startWatchdog(timeout time.Duration, stop chan struct{}) {
+
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			failOpen := d.filterQueue.FailOpen || len(d.failOpenPUs()) > 0
+
+			backlog, err := d.queueBacklog()
+			if err != nil {
+				zap.L().Debug("Unable to read the backlog of the queues", zap.Error(err))
+			}
+
+			netStalls, netStopped := d.netWatch.check("network", now, timeout, failOpen, backlog)
+			appStalls, appStopped := d.appWatch.check("application", now, timeout, failOpen, backlog)
+
+			if netStalls+appStalls > 0 {
+				d.reportStall(netStopped+appStopped > 0)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// failOpenPUs returns the PUs whose packets are accepted without being
+// processed when the queues are stopped
+func (d *Datapath) failOpenPUs() []*PUContext {
+
+	pus := []*PUContext{}
+
+	for _, contextID := range d.contextTracker.KeyList() {
+		item, err := d.contextTracker.Get(contextID)
+		if err != nil {
+			continue
+		}
+
+		pu := item.(*PUContext)
+		pu.Lock()
+		failOpen := pu.failurePolicy.FailsOpen(d.filterQueue.FailOpen)
+		pu.Unlock()
+
+		if failOpen {
+			pus = append(pus, pu)
+		}
+	}
+
+	return pus
+}
+
+// reportStall reports a stalled queue for every PU. The packets of the PUs
+// that fail open are accepted without being processed if a queue was stopped.
+// The packets of the other PUs are dropped.
+func (d *Datapath) reportStall(stopped bool) {
+
+	if d.collector == nil {
+		return
+	}
+
+	for _, contextID := range d.contextTracker.KeyList() {
+		item, err := d.contextTracker.Get(contextID)
+		if err != nil {
+			continue
+		}
+
+		pu := item.(*PUContext)
+		pu.Lock()
+		record := &collector.ContainerRecord{
+			ContextID: pu.ID,
+			IPAddress: pu.IP,
+			Tags:      pu.Annotations,
+			Event:     collector.ContainerFailClosed,
+		}
+		if stopped && pu.failurePolicy.FailsOpen(d.filterQueue.FailOpen) {
+			record.Event = collector.ContainerFailOpen
+		}
+		pu.Unlock()
+
+		d.collector.CollectContainerEvent(record)
+	}
+}
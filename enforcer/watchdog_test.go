@@ -0,0 +1,295 @@
+package enforcer
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeQueue counts the calls to stop a queue
+type fakeQueue struct {
+	stops int
+}
+
+func (q *fakeQueue) StopQueue() error {
+	q.stops++
+	return nil
+}
+
+// containerCollector keeps the container records
+type containerCollector struct {
+	records []*collector.ContainerRecord
+}
+
+func (c *containerCollector) CollectFlowEvent(record *collector.FlowRecord) {}
+
+func (c *containerCollector) CollectContainerEvent(record *collector.ContainerRecord) {
+	c.records = append(c.records, record)
+}
+
+// stallsAndStops returns the results of a check
+func stallsAndStops(stalls int, stopped int) []int {
+	return []int{stalls, stopped}
+}
+
+func TestQueueWatch(t *testing.T) {
+
+	Convey("Given a watch of queues 4 to 7", t, func() {
+		w := newQueueWatch(4, 4)
+		q := &fakeQueue{}
+		w.setHandle(5, q)
+
+		now := time.Now()
+		timeout := 10 * time.Second
+
+		Convey("The queues out of the range should be ignored", func() {
+			So(w.index(3), ShouldEqual, -1)
+			So(w.index(8), ShouldEqual, -1)
+			So(w.index(7), ShouldEqual, 3)
+			w.begin(8)
+			w.end(3)
+		})
+
+		Convey("When a queue processes a packet within the timeout, it should not be stalled", func() {
+			w.begin(5)
+			w.check("network", now, timeout, true, nil)
+
+			stalled, stopped := w.counts()
+			So(stalled, ShouldEqual, 0)
+			So(stopped, ShouldEqual, 0)
+			So(q.stops, ShouldEqual, 0)
+		})
+
+		Convey("When a queue is stuck on a packet and the queues fail closed", func() {
+			atomic.StoreInt64(&w.busy[1], now.Add(-time.Minute).UnixNano())
+			w.check("network", now, timeout, false, nil)
+			w.check("network", now, timeout, false, nil)
+
+			Convey("It should be stalled once and not stopped", func() {
+				stalled, stopped := w.counts()
+				So(stalled, ShouldEqual, 1)
+				So(stopped, ShouldEqual, 0)
+				So(atomic.LoadUint64(&w.stalls), ShouldEqual, 1)
+				So(q.stops, ShouldEqual, 0)
+			})
+
+			Convey("When it is done with the packet, it should recover", func() {
+				w.end(5)
+				w.check("network", now, timeout, false, nil)
+
+				stalled, _ := w.counts()
+				So(stalled, ShouldEqual, 0)
+				So(atomic.LoadUint64(&w.stalls), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When packets wait for an idle queue", func() {
+			atomic.StoreInt64(&w.last[1], now.Add(-time.Hour).UnixNano())
+			backlog := map[uint16]uint32{5: 3}
+
+			Convey("It should not be stalled before the timeout", func() {
+				So(stallsAndStops(w.check("network", now, timeout, false, backlog)), ShouldResemble, []int{0, 0})
+				So(stallsAndStops(w.check("network", now.Add(timeout/2), timeout, false, backlog)), ShouldResemble, []int{0, 0})
+
+				stalled, _ := w.counts()
+				So(stalled, ShouldEqual, 0)
+			})
+
+			Convey("It should not be stalled if it makes progress", func() {
+				w.check("network", now, timeout, false, backlog)
+				atomic.StoreInt64(&w.last[1], now.Add(timeout).UnixNano())
+				So(stallsAndStops(w.check("network", now.Add(2*timeout), timeout, false, backlog)), ShouldResemble, []int{0, 0})
+			})
+
+			Convey("When its reader makes no progress for longer than the timeout", func() {
+				w.check("network", now, timeout, true, backlog)
+				later := now.Add(2 * timeout)
+
+				Convey("It should be stalled and stopped", func() {
+					So(stallsAndStops(w.check("network", later, timeout, true, backlog)), ShouldResemble, []int{1, 1})
+					So(q.stops, ShouldEqual, 1)
+				})
+
+				Convey("It should be bound again with a new reader once its packets are gone", func() {
+					started := &fakeQueue{}
+					w.setStarter(func(queue uint16) (queueStopper, error) {
+						return started, nil
+					})
+					w.check("network", later, timeout, true, backlog)
+					w.check("network", later, timeout, true, map[uint16]uint32{})
+
+					stalled, stopped := w.counts()
+					So(stalled, ShouldEqual, 0)
+					So(stopped, ShouldEqual, 0)
+				})
+			})
+		})
+
+		Convey("When a queue is stuck on a packet and the queues fail open", func() {
+			atomic.StoreInt64(&w.busy[1], now.Add(-time.Minute).UnixNano())
+			So(stallsAndStops(w.check("network", now, timeout, true, nil)), ShouldResemble, []int{1, 1})
+			So(stallsAndStops(w.check("network", now, timeout, true, nil)), ShouldResemble, []int{0, 0})
+
+			Convey("It should be stopped once", func() {
+				stalled, stopped := w.counts()
+				So(stalled, ShouldEqual, 1)
+				So(stopped, ShouldEqual, 1)
+				So(q.stops, ShouldEqual, 1)
+			})
+
+			Convey("When it is done with the packet, it should be bound again", func() {
+				started := &fakeQueue{}
+				w.setStarter(func(queue uint16) (queueStopper, error) {
+					So(queue, ShouldEqual, 5)
+					return started, nil
+				})
+				w.end(5)
+				w.check("network", now, timeout, true, nil)
+
+				stalled, stopped := w.counts()
+				So(stalled, ShouldEqual, 0)
+				So(stopped, ShouldEqual, 0)
+
+				Convey("And it should be stopped again with its new handle if it stalls again", func() {
+					atomic.StoreInt64(&w.busy[1], now.Add(-time.Minute).UnixNano())
+					So(stallsAndStops(w.check("network", now, timeout, true, nil)), ShouldResemble, []int{1, 1})
+					So(started.stops, ShouldEqual, 1)
+					So(q.stops, ShouldEqual, 1)
+				})
+			})
+
+			Convey("When it is done with the packet and it can not be bound again", func() {
+				attempts := 0
+				w.setStarter(func(queue uint16) (queueStopper, error) {
+					attempts++
+					return nil, fmt.Errorf("busy")
+				})
+				w.end(5)
+				w.check("network", now, timeout, true, nil)
+				w.check("network", now, timeout, true, nil)
+
+				Convey("It should stay stopped and be retried at each check", func() {
+					_, stopped := w.counts()
+					So(stopped, ShouldEqual, 1)
+					So(attempts, ShouldEqual, 2)
+				})
+			})
+
+			Convey("The status of its direction should be unhealthy", func() {
+				v := &verdictCounters{}
+				v.accept()
+				status := v.status(4, w)
+				So(status.Stalls, ShouldEqual, 1)
+				So(status.Stopped, ShouldEqual, 1)
+				So(status.healthy(), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestFailOpenPUs(t *testing.T) {
+
+	Convey("Given an enforcer that fails closed with a PU that fails open and a PU with the default policy", t, func() {
+		c := &containerCollector{}
+		enforcer := NewWithDefaults("SomeServerId", c, nil, secrets.NewPSKSecrets([]byte("Dummy Test Password")), constants.LocalContainer, "/proc").(*Datapath)
+		enforcer.filterQueue.FailOpen = false
+
+		open := policy.NewPUInfo("open", constants.ContainerPU)
+		open.Runtime.SetIPAddresses(policy.ExtendedMap{"bridge": "10.1.1.1"})
+		open.Policy.SetFailurePolicy(policy.FailOpen)
+		So(enforcer.Enforce("open", open), ShouldBeNil)
+
+		closed := policy.NewPUInfo("closed", constants.ContainerPU)
+		closed.Runtime.SetIPAddresses(policy.ExtendedMap{"bridge": "10.1.1.2"})
+		So(enforcer.Enforce("closed", closed), ShouldBeNil)
+
+		Convey("Only the PU that fails open should be returned", func() {
+			pus := enforcer.failOpenPUs()
+			So(len(pus), ShouldEqual, 1)
+			So(pus[0].ID, ShouldEqual, "open")
+		})
+
+		Convey("When a queue is stopped, the PU that fails open should be reported as accepted and the other one as dropped", func() {
+			enforcer.reportStall(true)
+
+			So(len(c.records), ShouldEqual, 2)
+			events := map[string]string{}
+			for _, record := range c.records {
+				events[record.ContextID] = record.Event
+			}
+			So(events["open"], ShouldEqual, collector.ContainerFailOpen)
+			So(events["closed"], ShouldEqual, collector.ContainerFailClosed)
+		})
+
+		Convey("When a queue stalls and is not stopped, every PU should be reported as dropped", func() {
+			enforcer.reportStall(false)
+
+			So(len(c.records), ShouldEqual, 2)
+			for _, record := range c.records {
+				So(record.Event, ShouldEqual, collector.ContainerFailClosed)
+			}
+		})
+	})
+}
+
+func TestParseQueueBacklog(t *testing.T) {
+
+	Convey("Given the queues listed by the kernel", t, func() {
+		queues := "    0  28371     0 2 65531     0     0       12  1\n" +
+			"    1  28372    17 2 65531     0     4      340  1\n"
+
+		Convey("The backlog of each queue should be parsed", func() {
+			backlog, err := parseQueueBacklog(strings.NewReader(queues))
+			So(err, ShouldBeNil)
+			So(backlog, ShouldResemble, map[uint16]uint32{0: 0, 1: 17})
+		})
+
+		Convey("An invalid queue number should be an error", func() {
+			_, err := parseQueueBacklog(strings.NewReader("x 1 2 3\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestWatchdogReportsStalls(t *testing.T) {
+
+	Convey("Given an enforcer that fails closed with a watchdog", t, func() {
+		c := &containerCollector{}
+		enforcer := NewWithDefaults("SomeServerId", c, nil, secrets.NewPSKSecrets([]byte("Dummy Test Password")), constants.LocalContainer, "/proc").(*Datapath)
+		enforcer.filterQueue.FailOpen = false
+
+		pu := policy.NewPUInfo("pu", constants.ContainerPU)
+		pu.Runtime.SetIPAddresses(policy.ExtendedMap{"bridge": "10.1.1.1"})
+		So(enforcer.Enforce("pu", pu), ShouldBeNil)
+
+		Convey("When packets wait for a network queue whose reader is dead, the stall should be reported", func() {
+			queue := enforcer.filterQueue.GetNetworkQueueStart()
+			enforcer.queueBacklog = func() (map[uint16]uint32, error) {
+				return map[uint16]uint32{queue: 10}, nil
+			}
+
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				enforcer.startWatchdog(20*time.Millisecond, stop)
+				close(done)
+			}()
+			time.Sleep(200 * time.Millisecond)
+			close(stop)
+			<-done
+
+			So(atomic.LoadUint64(&enforcer.netWatch.stalls), ShouldEqual, 1)
+			So(len(c.records), ShouldEqual, 1)
+			So(c.records[0].ContextID, ShouldEqual, "pu")
+			So(c.records[0].Event, ShouldEqual, collector.ContainerFailClosed)
+		})
+	})
+}
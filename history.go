@@ -0,0 +1,104 @@
+package trireme
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+var (
+	// maxPolicyHistory is the number of policies kept in the history of a PU
+	maxPolicyHistory = 10
+)
+
+// PolicyVersion is a policy that was applied to a PU
+type PolicyVersion struct {
+	// Version is the number of the policy. It increases with every policy
+	// applied to the PU, including the rollbacks.
+	Version int
+	// Hash is the hash of the content of the policy
+	Hash string
+	// Applied is the time at which the policy was applied
+	Applied time.Time
+	// Policy is a copy of the policy
+	Policy *policy.PUPolicy
+}
+
+// policyHistory holds the last policies applied to a PU
+type policyHistory struct {
+	versions []*PolicyVersion
+	last     int
+	sync.Mutex
+}
+
+// newPolicyHistory creates an empty history
+func newPolicyHistory() *policyHistory {
+
+	return &policyHistory{
+		versions: []*PolicyVersion{},
+	}
+}
+
+// add records a policy that was applied and forgets the oldest policies
+// beyond the size of the history. The policy must not be changed afterwards.
+func (h *policyHistory) add(p *policy.PUPolicy) *PolicyVersion {
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.last++
+
+	version := &PolicyVersion{
+		Version: h.last,
+		Hash:    p.Hash(),
+		Applied: time.Now(),
+		Policy:  p,
+	}
+
+	h.versions = append(h.versions, version)
+	if len(h.versions) > maxPolicyHistory {
+		h.versions = h.versions[len(h.versions)-maxPolicyHistory:]
+	}
+
+	return version
+}
+
+// get returns a copy of a version of the policy
+func (h *policyHistory) get(version int) (*PolicyVersion, error) {
+
+	h.Lock()
+	defer h.Unlock()
+
+	for _, v := range h.versions {
+		if v.Version == version {
+			return v.copy(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Policy version %d not found in history", version)
+}
+
+// list returns a copy of the versions, from the oldest to the latest
+func (h *policyHistory) list() []*PolicyVersion {
+
+	h.Lock()
+	defer h.Unlock()
+
+	versions := make([]*PolicyVersion, len(h.versions))
+	for i, v := range h.versions {
+		versions[i] = v.copy()
+	}
+
+	return versions
+}
+
+// copy returns a copy of the version, so that its policy can be changed
+func (v *PolicyVersion) copy() *PolicyVersion {
+
+	c := *v
+	c.Policy = v.Policy.Clone()
+
+	return &c
+}
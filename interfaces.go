@@ -1,7 +1,11 @@
 package trireme
 
 import (
+	"time"
+
 	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
 	"github.com/aporeto-inc/trireme/monitor"
 	"github.com/aporeto-inc/trireme/policy"
 	"github.com/aporeto-inc/trireme/supervisor"
@@ -22,6 +26,26 @@ type Trireme interface {
 	// Supervisor returns the supervisor for a given PU type
 	Supervisor(kind constants.PUType) supervisor.Supervisor
 
+	// SimulateFlow evaluates the policy of a flow between a source and a destination
+	// on the given port without processing any packets. The source and destination are
+	// either contextIDs of PUs or IP addresses of external services. The flow is
+	// evaluated with the last policies applied to the PUs, so that PUs of different
+	// enforcers can be simulated together.
+	SimulateFlow(source, destination string, port uint16) (*enforcer.FlowSimulation, error)
+
+	// UpdateSecrets replaces the secrets of all the enforcers. The previous secrets
+	// are still accepted for the overlap duration, so that the connections of the
+	// peers that did not rotate yet are not dropped.
+	UpdateSecrets(s secrets.Secrets, overlap time.Duration) error
+
+	// PolicyHistory returns the last policies applied to a PU, from the oldest
+	// to the latest.
+	PolicyHistory(contextID string) ([]*PolicyVersion, error)
+
+	// RollbackPolicy applies again a version of the policy of a PU from its history.
+	// It is recorded as a new version once it is applied.
+	RollbackPolicy(contextID string, version int) error
+
 	monitor.ProcessingUnitsHandler
 
 	PolicyUpdater
@@ -32,6 +56,10 @@ type PolicyUpdater interface {
 
 	// UpdatePolicy updates the policy of the isolator for a container.
 	UpdatePolicy(contextID string, newPolicy *policy.PUPolicy) error
+
+	// UpdatePolicies updates the policies of several PUs, by contextID. It
+	// returns the error of each PU, which is nil if its policy was updated.
+	UpdatePolicies(policies map[string]*policy.PUPolicy) map[string]error
 }
 
 // A PolicyResolver is responsible of creating the Policies for a specific Processing Unit.
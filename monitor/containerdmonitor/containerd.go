@@ -0,0 +1,861 @@
+package containerdmonitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/monitor/linuxmonitor/cgnetcls"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/typeurl/v2"
+	"github.com/dchest/siphash"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ContainerdEvent is the topic of the containerd events.
+type ContainerdEvent string
+
+const (
+	// ContainerdEventCreate represents the containerd container create event.
+	ContainerdEventCreate ContainerdEvent = "/containers/create"
+
+	// ContainerdEventStart represents the containerd task start event.
+	ContainerdEventStart ContainerdEvent = "/tasks/start"
+
+	// ContainerdEventExit represents the containerd task exit event.
+	ContainerdEventExit ContainerdEvent = "/tasks/exit"
+
+	// ContainerdEventDelete represents the containerd container delete event.
+	ContainerdEventDelete ContainerdEvent = "/containers/delete"
+
+	// ContainerdEventPaused represents the containerd task paused event.
+	ContainerdEventPaused ContainerdEvent = "/tasks/paused"
+
+	// ContainerdEventResumed represents the containerd task resumed event.
+	ContainerdEventResumed ContainerdEvent = "/tasks/resumed"
+)
+
+const (
+	// subscribeBackoff is the delay before subscribing again to the containerd events
+	// after the first failure. It doubles after each failure up to subscribeMaxBackoff.
+	subscribeBackoff = time.Second
+
+	// subscribeMaxBackoff is the maximum delay between two subscriptions
+	subscribeMaxBackoff = 30 * time.Second
+)
+
+// ContainerInfo is the information of a containerd container used to create its processing unit.
+type ContainerInfo struct {
+	// ID is the containerd ID of the container
+	ID string
+
+	// Image is the image reference of the container
+	Image string
+
+	// Labels are the labels of the container
+	Labels map[string]string
+
+	// Pid is the PID of the task of the container, or 0 if it has no task
+	Pid int
+
+	// NSPath is the path of the network namespace given in the spec of the container. It
+	// is empty if the container creates its own network namespace.
+	NSPath string
+
+	// HostNetwork is true if the container runs in the network namespace of the host
+	HostNetwork bool
+
+	// IPAddress is the IPv4 address of the container in its network namespace. It
+	// is empty if the address could not be resolved.
+	IPAddress string
+
+	// IPv6Address is the IPv6 address of the container in its network namespace
+	IPv6Address string
+
+	// Status is the status of the task of the container
+	Status containerd.ProcessStatus
+}
+
+// A ContainerdMetadataExtractor is a function used to extract a *policy.PURuntime from a given
+// containerd container.
+type ContainerdMetadataExtractor func(*ContainerInfo) (*policy.PURuntime, error)
+
+// A namespaceResolver returns the IPv4 and IPv6 addresses of the network namespace
+// of a container.
+type namespaceResolver func(*ContainerInfo) (string, string, error)
+
+// A containerdEventHandler is type of containerd event handler functions.
+type containerdEventHandler func(event *containerEvent) error
+
+// containerEvent is a containerd event decoded from its envelope
+type containerEvent struct {
+	topic       ContainerdEvent
+	containerID string
+}
+
+// containerdClient is the part of the containerd client used by the monitor
+type containerdClient interface {
+	Containers(ctx context.Context, filters ...string) ([]containerd.Container, error)
+	LoadContainer(ctx context.Context, id string) (containerd.Container, error)
+	Subscribe(ctx context.Context, filters ...string) (<-chan *events.Envelope, <-chan error)
+}
+
+func contextIDFromContainerID(containerID string) (string, error) {
+
+	if containerID == "" {
+		return "", fmt.Errorf("Empty container ID")
+	}
+
+	if len(containerID) < 12 {
+		return "", fmt.Errorf("Container ID smaller than 12 characters")
+	}
+
+	return containerID[:12], nil
+}
+
+// decodeEvent decodes a containerd event. It returns nil for the events that are not
+// handled, such as the exit of the processes executed in a container.
+func decodeEvent(envelope *events.Envelope) (*containerEvent, error) {
+
+	if envelope.Event == nil {
+		return nil, fmt.Errorf("Empty event for topic %s", envelope.Topic)
+	}
+
+	v, err := typeurl.UnmarshalAny(envelope.Event)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode event for topic %s: %s", envelope.Topic, err)
+	}
+
+	event := &containerEvent{topic: ContainerdEvent(envelope.Topic)}
+
+	switch e := v.(type) {
+	case *apievents.ContainerCreate:
+		event.containerID = e.ID
+	case *apievents.ContainerDelete:
+		event.containerID = e.ID
+	case *apievents.TaskStart:
+		event.containerID = e.ContainerID
+	case *apievents.TaskExit:
+		if e.ID != e.ContainerID {
+			return nil, nil
+		}
+		event.containerID = e.ContainerID
+	case *apievents.TaskPaused:
+		event.containerID = e.ContainerID
+	case *apievents.TaskResumed:
+		event.containerID = e.ContainerID
+	default:
+		return nil, nil
+	}
+
+	return event, nil
+}
+
+// defaultContainerdMetadataExtractor is the default metadata extractor for containerd
+func defaultContainerdMetadataExtractor(info *ContainerInfo) (*policy.PURuntime, error) {
+
+	tags := policy.NewTagStore()
+	tags.AppendKeyValue("@sys:image", info.Image)
+	tags.AppendKeyValue("@sys:name", info.ID)
+
+	for k, v := range info.Labels {
+		tags.AppendKeyValue("@usr:"+k, v)
+	}
+
+	if info.HostNetwork {
+		ipa := policy.ExtendedMap{
+			policy.DefaultNamespace: "0.0.0.0/0",
+		}
+
+		return policy.NewPURuntime(info.ID, info.Pid, "", tags, ipa, constants.LinuxProcessPU, hostModeOptions(info)), nil
+	}
+
+	ipa := policy.ExtendedMap{}
+
+	if info.IPAddress != "" {
+		ipa[policy.DefaultNamespace] = info.IPAddress
+	}
+
+	if info.IPv6Address != "" {
+		ipa[policy.DefaultNamespaceIPv6] = info.IPv6Address
+	}
+
+	return policy.NewPURuntime(info.ID, info.Pid, info.NSPath, tags, ipa, constants.ContainerPU, nil), nil
+}
+
+// hostModeOptions creates the default options for a host-mode container. Containerd does
+// not know the ports of the container so all the ports are selected.
+func hostModeOptions(info *ContainerInfo) policy.ExtendedMap {
+
+	return policy.ExtendedMap{
+		cgnetcls.PortTag:       "0",
+		cgnetcls.CgroupNameTag: strconv.Itoa(info.Pid),
+		cgnetcls.CgroupMarkTag: strconv.FormatUint(cgnetcls.MarkVal(), 10),
+	}
+}
+
+// namespaceAddresses reads the addresses of the interfaces of the network namespace of
+// a container. The namespace is the one given in the spec of the container, or the one
+// of its task. The addresses are configured by the CNI plugins before the task starts.
+func namespaceAddresses(info *ContainerInfo) (string, string, error) {
+
+	var ns netns.NsHandle
+	var err error
+
+	if info.NSPath != "" {
+		ns, err = netns.GetFromPath(info.NSPath)
+	} else {
+		ns, err = netns.GetFromPid(info.Pid)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to open the network namespace of container %s: %s", info.ID, err)
+	}
+	defer ns.Close() // nolint
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to open the network namespace of container %s: %s", info.ID, err)
+	}
+	defer handle.Delete()
+
+	addresses, err := handle.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to read the addresses of container %s: %s", info.ID, err)
+	}
+
+	var ipv4, ipv6 string
+	for _, address := range addresses {
+		if !address.IP.IsGlobalUnicast() {
+			continue
+		}
+
+		if address.IP.To4() != nil {
+			if ipv4 == "" {
+				ipv4 = address.IP.String()
+			}
+			continue
+		}
+
+		if ipv6 == "" {
+			ipv6 = address.IP.String()
+		}
+	}
+
+	return ipv4, ipv6, nil
+}
+
+// containerdMonitor implements the connection to containerd and monitoring based on events
+type containerdMonitor struct {
+	client             containerdClient
+	namespace          string
+	metadataExtractor  ContainerdMetadataExtractor
+	handlers           map[ContainerdEvent]containerdEventHandler
+	eventnotifications []chan *containerEvent
+	stopprocessor      []chan bool
+	numberOfQueues     int
+	stoplistener       chan bool
+	syncHandler        monitor.SynchronizationHandler
+	resolver           namespaceResolver
+
+	collector collector.EventCollector
+	puHandler monitor.ProcessingUnitsHandler
+
+	netcls cgnetcls.Cgroupnetcls
+	// killContainerOnPolicyError if enabled kills the container if a policy setting resulted in an error.
+	killContainerOnPolicyError bool
+	syncAtStart                bool
+}
+
+// NewContainerdMonitor returns a monitor for the containers of the given containerd
+// namespace. The address is the path of the containerd socket, which is also the CRI
+// socket of containerd. The CRI containers are in the constants.DefaultContainerdNamespace
+// namespace.
+func NewContainerdMonitor(
+	address string,
+	namespace string,
+	p monitor.ProcessingUnitsHandler,
+	m ContainerdMetadataExtractor,
+	l collector.EventCollector,
+	syncAtStart bool,
+	s monitor.SynchronizationHandler,
+	killContainerOnPolicyError bool,
+) monitor.Monitor {
+
+	// Sanity check that this path exists
+	if _, err := os.Stat(address); err != nil {
+		zap.L().Debug("Unable to find containerd socket", zap.Error(err))
+		return nil
+	}
+
+	cli, err := containerd.New(address, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		zap.L().Debug("Unable to initialize containerd client", zap.Error(err))
+		return nil
+	}
+
+	return newContainerdMonitor(cli, namespace, p, m, l, syncAtStart, s, killContainerOnPolicyError)
+}
+
+func newContainerdMonitor(
+	cli containerdClient,
+	namespace string,
+	p monitor.ProcessingUnitsHandler,
+	m ContainerdMetadataExtractor,
+	l collector.EventCollector,
+	syncAtStart bool,
+	s monitor.SynchronizationHandler,
+	killContainerOnPolicyError bool,
+) *containerdMonitor {
+
+	c := &containerdMonitor{
+		client:                     cli,
+		namespace:                  namespace,
+		puHandler:                  p,
+		collector:                  l,
+		handlers:                   make(map[ContainerdEvent]containerdEventHandler),
+		stoplistener:               make(chan bool),
+		metadataExtractor:          m,
+		syncAtStart:                syncAtStart,
+		syncHandler:                s,
+		killContainerOnPolicyError: killContainerOnPolicyError,
+		netcls:                     cgnetcls.NewDockerCgroupNetController(),
+		resolver:                   namespaceAddresses,
+	}
+
+	c.numberOfQueues = runtime.NumCPU() * 8
+	c.eventnotifications = make([]chan *containerEvent, c.numberOfQueues)
+	c.stopprocessor = make([]chan bool, c.numberOfQueues)
+
+	for i := 0; i < c.numberOfQueues; i++ {
+		c.eventnotifications[i] = make(chan *containerEvent, 1000)
+		c.stopprocessor[i] = make(chan bool)
+	}
+
+	// Add handlers for the events that we know how to process
+	c.handlers[ContainerdEventCreate] = c.handleCreateEvent
+	c.handlers[ContainerdEventStart] = c.handleStartEvent
+	c.handlers[ContainerdEventExit] = c.handleExitEvent
+	c.handlers[ContainerdEventDelete] = c.handleDeleteEvent
+	c.handlers[ContainerdEventPaused] = c.handlePausedEvent
+	c.handlers[ContainerdEventResumed] = c.handleResumedEvent
+
+	return c
+}
+
+// context returns a context for the namespace of the monitor
+func (c *containerdMonitor) context() context.Context {
+
+	return namespaces.WithNamespace(context.Background(), c.namespace)
+}
+
+// sendRequestToQueue sends a request to a channel based on a hash function
+func (c *containerdMonitor) sendRequestToQueue(r *containerEvent) {
+
+	key0 := uint64(256203161)
+	key1 := uint64(982451653)
+
+	h := siphash.Hash(key0, key1, []byte(r.containerID))
+
+	c.eventnotifications[int(h%uint64(c.numberOfQueues))] <- r
+}
+
+// Start will start the enforcement of the containerd containers.
+// It applies a policy to each container already running and
+// listens to the container and task events.
+func (c *containerdMonitor) Start() error {
+
+	zap.L().Debug("Starting the containerd monitor")
+
+	// Starting the eventListener first so that no event is missed during the sync.
+	listenerReady := make(chan struct{})
+	go c.eventListener(listenerReady)
+	<-listenerReady
+
+	if c.syncAtStart {
+		if err := c.syncContainers(); err != nil {
+			zap.L().Error("Error Syncing existingContainers", zap.Error(err))
+		}
+	}
+
+	// Processing the events received during the time of Sync.
+	go c.eventProcessors()
+
+	return nil
+}
+
+// Stop monitoring containerd events.
+func (c *containerdMonitor) Stop() error {
+
+	zap.L().Debug("Stopping the containerd monitor")
+
+	c.stoplistener <- true
+	for i := 0; i < c.numberOfQueues; i++ {
+		c.stopprocessor[i] <- true
+	}
+
+	return nil
+}
+
+// eventProcessors processes containerd events
+func (c *containerdMonitor) eventProcessors() {
+
+	for i := 0; i < c.numberOfQueues; i++ {
+		go func(i int) {
+			for {
+				select {
+				case event := <-c.eventnotifications[i]:
+					f, ok := c.handlers[event.topic]
+					if !ok {
+						zap.L().Debug("Containerd event not handled.", zap.String("topic", string(event.topic)))
+						continue
+					}
+					if err := f(event); err != nil {
+						zap.L().Error("Error while handling event",
+							zap.String("topic", string(event.topic)),
+							zap.Error(err),
+						)
+					}
+				case <-c.stopprocessor[i]:
+					return
+				}
+			}
+		}(i)
+	}
+}
+
+// subscribe subscribes to the container and task events of the namespace of the monitor.
+// The subscription ends when the returned cancel function is called.
+func (c *containerdMonitor) subscribe() (<-chan *events.Envelope, <-chan error, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(c.context())
+
+	messages, errs := c.client.Subscribe(ctx,
+		fmt.Sprintf(`namespace==%s,topic~="^/tasks/"`, c.namespace),
+		fmt.Sprintf(`namespace==%s,topic~="^/containers/"`, c.namespace),
+	)
+
+	return messages, errs, cancel
+}
+
+// eventListener listens to the container and task events of containerd and passes
+// them to the processors through buffered channels. Containerd ends the subscription
+// after an error, for example when it restarts. The listener then subscribes again
+// with a backoff until it is stopped.
+func (c *containerdMonitor) eventListener(listenerReady chan struct{}) {
+
+	messages, errs, cancel := c.subscribe()
+
+	listenerReady <- struct{}{}
+
+	delay := subscribeBackoff
+
+	for {
+		var err error
+
+		select {
+		case envelope, ok := <-messages:
+			if !ok {
+				err = errors.New("Event stream closed")
+				break
+			}
+			if envelope == nil {
+				continue
+			}
+			delay = subscribeBackoff
+			zap.L().Debug("Got message from containerd", zap.String("topic", envelope.Topic))
+			event, derr := decodeEvent(envelope)
+			if derr != nil {
+				zap.L().Warn("Received invalid containerd event", zap.Error(derr))
+				continue
+			}
+			if event != nil {
+				c.sendRequestToQueue(event)
+			}
+			continue
+
+		case e, ok := <-errs:
+			if ok && e == nil {
+				continue
+			}
+			if err = e; !ok {
+				err = errors.New("Event stream closed")
+			}
+
+		case stop := <-c.stoplistener:
+			if stop {
+				cancel()
+				return
+			}
+			continue
+		}
+
+		cancel()
+
+		zap.L().Warn("Lost the containerd event subscription. Subscribing again",
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+
+		select {
+		case <-time.After(delay):
+		case <-c.stoplistener:
+			return
+		}
+
+		if delay = delay * 2; delay > subscribeMaxBackoff {
+			delay = subscribeMaxBackoff
+		}
+
+		messages, errs, cancel = c.subscribe()
+	}
+}
+
+// containerInfo reads the information of a container. A container without task
+// is reported as stopped.
+func (c *containerdMonitor) containerInfo(ctx context.Context, container containerd.Container) (*ContainerInfo, error) {
+
+	record, err := container.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read container %s: %s", container.ID(), err)
+	}
+
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the spec of container %s: %s", container.ID(), err)
+	}
+
+	info := &ContainerInfo{
+		ID:          record.ID,
+		Image:       record.Image,
+		Labels:      record.Labels,
+		HostNetwork: true,
+		Status:      containerd.Stopped,
+	}
+
+	if spec.Linux != nil {
+		for _, ns := range spec.Linux.Namespaces {
+			if ns.Type == specs.NetworkNamespace {
+				info.HostNetwork = false
+				info.NSPath = ns.Path
+			}
+		}
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return info, nil
+		}
+		return nil, fmt.Errorf("Unable to read the task of container %s: %s", container.ID(), err)
+	}
+
+	status, err := task.Status(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the status of container %s: %s", container.ID(), err)
+	}
+
+	info.Pid = int(task.Pid())
+	info.Status = status.Status
+
+	if !info.HostNetwork && info.Status == containerd.Running && c.resolver != nil {
+		if info.IPAddress, info.IPv6Address, err = c.resolver(info); err != nil {
+			zap.L().Warn("Unable to resolve the addresses of the container", zap.Error(err))
+		}
+	}
+
+	return info, nil
+}
+
+// syncContainers resyncs all the existing containers of the namespace, using the
+// same process as when a container is initially spawn up
+func (c *containerdMonitor) syncContainers() error {
+
+	zap.L().Debug("Syncing all existing containers")
+
+	ctx := c.context()
+
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return fmt.Errorf("Error Getting ContainerList: %s", err)
+	}
+
+	infos := []*ContainerInfo{}
+	for _, container := range containers {
+		info, err := c.containerInfo(ctx, container)
+		if err != nil {
+			zap.L().Error("Error Syncing existing Container", zap.Error(err))
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	if c.syncHandler != nil {
+		for _, info := range infos {
+			contextID, err := contextIDFromContainerID(info.ID)
+			if err != nil {
+				zap.L().Error("Error Syncing existing Container", zap.Error(err))
+				continue
+			}
+
+			runtimeInfo, err := c.extractMetadata(info)
+			if err != nil {
+				zap.L().Error("Error Syncing existing Container", zap.Error(err))
+				continue
+			}
+
+			var state monitor.State
+			switch info.Status {
+			case containerd.Running:
+				state = monitor.StateStarted
+			case containerd.Paused, containerd.Pausing:
+				state = monitor.StatePaused
+			default:
+				state = monitor.StateStopped
+			}
+
+			if err := c.syncHandler.HandleSynchronization(contextID, state, runtimeInfo, monitor.SynchronizationTypeInitial); err != nil {
+				zap.L().Error("Error Syncing existing Container", zap.Error(err))
+			}
+		}
+
+		c.syncHandler.HandleSynchronizationComplete(monitor.SynchronizationTypeInitial)
+	}
+
+	for _, info := range infos {
+		if err := c.startContainer(info); err != nil {
+			zap.L().Error("Error Syncing existing Container during start handling", zap.Error(err))
+			continue
+		}
+
+		zap.L().Info("Successfully synced container: ", zap.String("ID", info.ID))
+	}
+
+	return nil
+}
+
+// setupHostMode sets up the net_cls cgroup for the host mode
+func (c *containerdMonitor) setupHostMode(contextID string, runtimeInfo *policy.PURuntime, info *ContainerInfo) error {
+
+	if err := c.netcls.Creategroup(contextID); err != nil {
+		return err
+	}
+
+	markval, ok := runtimeInfo.Options().Get(cgnetcls.CgroupMarkTag)
+	if !ok {
+		if derr := c.netcls.DeleteCgroup(contextID); derr != nil {
+			zap.L().Warn("Failed to clean cgroup", zap.Error(derr))
+		}
+		return errors.New("Mark value not found")
+	}
+
+	mark, _ := strconv.ParseUint(markval, 10, 32)
+	if err := c.netcls.AssignMark(contextID, mark); err != nil {
+		if derr := c.netcls.DeleteCgroup(contextID); derr != nil {
+			zap.L().Warn("Failed to clean cgroup", zap.Error(derr))
+		}
+		return err
+	}
+
+	if err := c.netcls.AddProcess(contextID, info.Pid); err != nil {
+		if derr := c.netcls.DeleteCgroup(contextID); derr != nil {
+			zap.L().Warn("Failed to clean cgroup", zap.Error(derr))
+		}
+		return err
+	}
+
+	return nil
+}
+
+// killContainer kills the task of a container
+func (c *containerdMonitor) killContainer(containerID string) error {
+
+	ctx := c.context()
+
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return err
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	return task.Kill(ctx, syscall.SIGKILL)
+}
+
+func (c *containerdMonitor) startContainer(info *ContainerInfo) error {
+
+	if info.Status != containerd.Running {
+		return nil
+	}
+
+	contextID, err := contextIDFromContainerID(info.ID)
+	if err != nil {
+		return fmt.Errorf("Couldn't generate ContextID: %s", err)
+	}
+
+	runtimeInfo, err := c.extractMetadata(info)
+	if err != nil {
+		return fmt.Errorf("Error getting some of the containerd primitives: %s", err)
+	}
+
+	if err := c.puHandler.SetPURuntime(contextID, runtimeInfo); err != nil {
+		return err
+	}
+
+	if err := c.puHandler.HandlePUEvent(contextID, monitor.EventStart); err != nil {
+		if c.killContainerOnPolicyError {
+			if derr := c.killContainer(info.ID); derr != nil {
+				zap.L().Warn("Failed to stop bad container", zap.Error(derr))
+			}
+			return fmt.Errorf("Policy cound't be set - container was killed %s %s", contextID, err)
+		}
+		return fmt.Errorf("Policy cound't be set - container was kept alive per policy %s %s", contextID, err)
+	}
+
+	if info.HostNetwork {
+		if err := c.setupHostMode(contextID, runtimeInfo, info); err != nil {
+			return fmt.Errorf("Failed to setup host mode ")
+		}
+	}
+
+	return nil
+}
+
+// extractMetadata generates the RuntimeInfo based on the containerd container
+func (c *containerdMonitor) extractMetadata(info *ContainerInfo) (*policy.PURuntime, error) {
+
+	if info == nil {
+		return nil, fmt.Errorf("ContainerInfo is empty")
+	}
+
+	if c.metadataExtractor != nil {
+		return c.metadataExtractor(info)
+	}
+
+	return defaultContainerdMetadataExtractor(info)
+}
+
+// handleCreateEvent generates a create event type.
+func (c *containerdMonitor) handleCreateEvent(event *containerEvent) error {
+
+	contextID, err := contextIDFromContainerID(event.containerID)
+	if err != nil {
+		return fmt.Errorf("Error Generating ContextID: %s", err)
+	}
+
+	return c.puHandler.HandlePUEvent(contextID, monitor.EventCreate)
+}
+
+// handleStartEvent reads the container of a task that was started and activates it.
+func (c *containerdMonitor) handleStartEvent(event *containerEvent) error {
+
+	contextID, err := contextIDFromContainerID(event.containerID)
+	if err != nil {
+		return fmt.Errorf("Error Generating ContextID: %s", err)
+	}
+
+	ctx := c.context()
+
+	container, err := c.client.LoadContainer(ctx, event.containerID)
+	if err == nil {
+		var info *ContainerInfo
+		if info, err = c.containerInfo(ctx, container); err == nil {
+			return c.startContainer(info)
+		}
+	}
+
+	// If we see errors, we will kill the container for security reasons if the monitor was configured to do so.
+	if c.killContainerOnPolicyError {
+		if kerr := c.killContainer(event.containerID); kerr != nil {
+			zap.L().Warn("Failed to stop illegal container", zap.Error(kerr))
+		}
+
+		if c.collector != nil {
+			c.collector.CollectContainerEvent(&collector.ContainerRecord{
+				ContextID: contextID,
+				IPAddress: "N/A",
+				Tags:      nil,
+				Event:     collector.ContainerFailed,
+			})
+		}
+		return fmt.Errorf("Cannot read container information. Killing container: %s", err)
+	}
+
+	return fmt.Errorf("Cannot read container information. Container still alive per policy: %s", err)
+}
+
+// handleExitEvent is called when the task of a container exits. It generates a "Stop" event.
+func (c *containerdMonitor) handleExitEvent(event *containerEvent) error {
+
+	contextID, err := contextIDFromContainerID(event.containerID)
+	if err != nil {
+		return fmt.Errorf("Error Generating ContextID: %s", err)
+	}
+
+	return c.puHandler.HandlePUEvent(contextID, monitor.EventStop)
+}
+
+// handleDeleteEvent handles the delete events of containers. It generates a "Destroy" event.
+func (c *containerdMonitor) handleDeleteEvent(event *containerEvent) error {
+
+	contextID, err := contextIDFromContainerID(event.containerID)
+	if err != nil {
+		return fmt.Errorf("Error Generating ContextID: %s", err)
+	}
+
+	if err := c.puHandler.HandlePUEvent(contextID, monitor.EventDestroy); err != nil {
+		zap.L().Error("Failed to handle delete event",
+			zap.Error(err),
+		)
+	}
+
+	if err := c.netcls.DeleteCgroup(contextID); err != nil {
+		zap.L().Warn("Failed to clean netcls group",
+			zap.String("contextID", contextID),
+			zap.Error(err),
+		)
+	}
+
+	return nil
+}
+
+// handlePausedEvent generates a pause event type.
+func (c *containerdMonitor) handlePausedEvent(event *containerEvent) error {
+
+	contextID, err := contextIDFromContainerID(event.containerID)
+	if err != nil {
+		return fmt.Errorf("Error Generating ContextID: %s", err)
+	}
+
+	return c.puHandler.HandlePUEvent(contextID, monitor.EventPause)
+}
+
+// handleResumedEvent generates an unpause event type.
+func (c *containerdMonitor) handleResumedEvent(event *containerEvent) error {
+
+	contextID, err := contextIDFromContainerID(event.containerID)
+	if err != nil {
+		return fmt.Errorf("Error Generating ContextID: %s", err)
+	}
+
+	return c.puHandler.HandlePUEvent(contextID, monitor.EventUnpause)
+}
@@ -0,0 +1,451 @@
+package containerdmonitor
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/monitor/linuxmonitor/cgnetcls"
+	"github.com/aporeto-inc/trireme/monitor/linuxmonitor/cgnetcls/mock"
+	"github.com/aporeto-inc/trireme/monitor/mock"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/typeurl/v2"
+	gomock "github.com/golang/mock/gomock"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	runningID = "74cc486f9ec3256d7bee789853ce05510167c7daf893f90a7577cdcba259d063"
+	stoppedID = "598a35a60f79af0001b52ef5a5d1c2b3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9"
+)
+
+type fakeTask struct {
+	containerd.Task
+	pid    uint32
+	status containerd.ProcessStatus
+	killed syscall.Signal
+}
+
+func (t *fakeTask) Pid() uint32 { return t.pid }
+
+func (t *fakeTask) Status(ctx context.Context) (containerd.Status, error) {
+	return containerd.Status{Status: t.status}, nil
+}
+
+func (t *fakeTask) Kill(ctx context.Context, signal syscall.Signal, opts ...containerd.KillOpts) error {
+	t.killed = signal
+	return nil
+}
+
+type fakeContainer struct {
+	containerd.Container
+	record containers.Container
+	spec   *oci.Spec
+	task   *fakeTask
+}
+
+func (c *fakeContainer) ID() string { return c.record.ID }
+
+func (c *fakeContainer) Info(ctx context.Context, opts ...containerd.InfoOpts) (containers.Container, error) {
+	return c.record, nil
+}
+
+func (c *fakeContainer) Spec(ctx context.Context) (*oci.Spec, error) { return c.spec, nil }
+
+func (c *fakeContainer) Task(ctx context.Context, attach cio.Attach) (containerd.Task, error) {
+	if c.task == nil {
+		return nil, fmt.Errorf("no running task found: %w", errdefs.ErrNotFound)
+	}
+	return c.task, nil
+}
+
+type fakeClient struct {
+	containers    map[string]*fakeContainer
+	events        chan *events.Envelope
+	errs          chan error
+	subscriptions int32
+}
+
+func (f *fakeClient) Containers(ctx context.Context, filters ...string) ([]containerd.Container, error) {
+	list := []containerd.Container{}
+	for _, id := range []string{runningID, stoppedID} {
+		if c, ok := f.containers[id]; ok {
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+func (f *fakeClient) LoadContainer(ctx context.Context, id string) (containerd.Container, error) {
+	c, ok := f.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("container %s: %w", id, errdefs.ErrNotFound)
+	}
+	return c, nil
+}
+
+func (f *fakeClient) Subscribe(ctx context.Context, filters ...string) (<-chan *events.Envelope, <-chan error) {
+	atomic.AddInt32(&f.subscriptions, 1)
+	return f.events, f.errs
+}
+
+func fakeResolver(info *ContainerInfo) (string, string, error) {
+	return "10.1.1.2", "", nil
+}
+
+func testSpec(nsPath string, network bool) *oci.Spec {
+
+	spec := &oci.Spec{Linux: &specs.Linux{Namespaces: []specs.LinuxNamespace{{Type: specs.PIDNamespace}}}}
+	if network {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: nsPath})
+	}
+
+	return spec
+}
+
+func testClient() *fakeClient {
+
+	return &fakeClient{
+		containers: map[string]*fakeContainer{
+			runningID: {
+				record: containers.Container{ID: runningID, Image: "docker.io/library/nginx:latest", Labels: map[string]string{"app": "web"}},
+				spec:   testSpec("/var/run/netns/cni-1234", true),
+				task:   &fakeTask{pid: 4912, status: containerd.Running},
+			},
+			stoppedID: {
+				record: containers.Container{ID: stoppedID, Image: "docker.io/library/redis:latest"},
+				spec:   testSpec("", true),
+			},
+		},
+		events: make(chan *events.Envelope, 10),
+		errs:   make(chan error),
+	}
+}
+
+func testEnvelope(topic ContainerdEvent, event interface{}) *events.Envelope {
+
+	payload, err := typeurl.MarshalAny(event)
+	So(err, ShouldBeNil)
+
+	return &events.Envelope{Namespace: constants.DefaultContainerdNamespace, Topic: string(topic), Event: payload}
+}
+
+func TestNewContainerdMonitor(t *testing.T) {
+	Convey("When I try to initialize a containerd monitor on a missing socket", t, func() {
+		cm := NewContainerdMonitor("/var/random.sock", constants.DefaultContainerdNamespace, nil, nil, &collector.DefaultCollector{}, false, nil, false)
+
+		Convey("Then the monitor should be nil", func() {
+			So(cm, ShouldBeNil)
+		})
+	})
+}
+
+func TestContextIDFromContainerID(t *testing.T) {
+	Convey("When I try to retrieve the contextID of a container", t, func() {
+		cID, err := contextIDFromContainerID(runningID)
+
+		Convey("Then contextID should match and I should not get any error", func() {
+			So(cID, ShouldEqual, "74cc486f9ec3")
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("When I try to retrieve the contextID of a container with a short ID", t, func() {
+		_, err := contextIDFromContainerID("6f47830f64")
+
+		Convey("Then I should get error", func() {
+			So(err, ShouldResemble, fmt.Errorf("Container ID smaller than 12 characters"))
+		})
+	})
+
+	Convey("When I try to retrieve the contextID of a container without ID", t, func() {
+		_, err := contextIDFromContainerID("")
+
+		Convey("Then I should get error", func() {
+			So(err, ShouldResemble, fmt.Errorf("Empty container ID"))
+		})
+	})
+}
+
+func TestDecodeEvent(t *testing.T) {
+	Convey("When I decode the start event of a task", t, func() {
+		event, err := decodeEvent(testEnvelope(ContainerdEventStart, &apievents.TaskStart{ContainerID: runningID, Pid: 4912}))
+
+		Convey("Then I should get the ID of the container", func() {
+			So(err, ShouldBeNil)
+			So(event, ShouldResemble, &containerEvent{topic: ContainerdEventStart, containerID: runningID})
+		})
+	})
+
+	Convey("When I decode the exit event of the init process of a container", t, func() {
+		event, err := decodeEvent(testEnvelope(ContainerdEventExit, &apievents.TaskExit{ContainerID: runningID, ID: runningID}))
+
+		Convey("Then I should get the ID of the container", func() {
+			So(err, ShouldBeNil)
+			So(event, ShouldResemble, &containerEvent{topic: ContainerdEventExit, containerID: runningID})
+		})
+	})
+
+	Convey("When I decode the exit event of a process executed in a container", t, func() {
+		event, err := decodeEvent(testEnvelope(ContainerdEventExit, &apievents.TaskExit{ContainerID: runningID, ID: "exec1"}))
+
+		Convey("Then the event should be ignored", func() {
+			So(err, ShouldBeNil)
+			So(event, ShouldBeNil)
+		})
+	})
+
+	Convey("When I decode an envelope without event", t, func() {
+		_, err := decodeEvent(&events.Envelope{Topic: string(ContainerdEventStart)})
+
+		Convey("Then I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDefaultContainerdMetadataExtractor(t *testing.T) {
+	Convey("When I extract the metadata of a container with its own network namespace", t, func() {
+		puR, err := defaultContainerdMetadataExtractor(&ContainerInfo{
+			ID:     runningID,
+			Image:  "nginx",
+			Labels: map[string]string{"app": "web"},
+			Pid:    4912,
+			NSPath: "/var/run/netns/cni-1234",
+		})
+
+		Convey("Then I should get a container PU with the tags and the namespace", func() {
+			So(err, ShouldBeNil)
+			So(puR.PUType(), ShouldEqual, constants.ContainerPU)
+			So(puR.Pid(), ShouldEqual, 4912)
+			So(puR.NSPath(), ShouldEqual, "/var/run/netns/cni-1234")
+			So(puR.Tags().GetSlice(), ShouldContain, "@sys:image=nginx")
+			So(puR.Tags().GetSlice(), ShouldContain, "@usr:app=web")
+		})
+
+		Convey("Then the PU should have no IP address", func() {
+			_, ok := puR.DefaultIPAddress()
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("When I extract the metadata of a container with resolved addresses", t, func() {
+		puR, err := defaultContainerdMetadataExtractor(&ContainerInfo{
+			ID:          runningID,
+			Pid:         4912,
+			IPAddress:   "10.1.1.2",
+			IPv6Address: "fd00::2",
+		})
+
+		Convey("Then the PU should have the addresses of the container", func() {
+			So(err, ShouldBeNil)
+			ip, ok := puR.DefaultIPAddress()
+			So(ok, ShouldBeTrue)
+			So(ip, ShouldEqual, "10.1.1.2")
+			So(puR.IPAddresses()[policy.DefaultNamespaceIPv6], ShouldEqual, "fd00::2")
+		})
+	})
+
+	Convey("When I extract the metadata of a container in the host network", t, func() {
+		puR, err := defaultContainerdMetadataExtractor(&ContainerInfo{ID: runningID, Pid: 4912, HostNetwork: true})
+
+		Convey("Then I should get a Linux process PU with the cgroup options", func() {
+			So(err, ShouldBeNil)
+			So(puR.PUType(), ShouldEqual, constants.LinuxProcessPU)
+			name, _ := puR.Options().Get(cgnetcls.CgroupNameTag)
+			So(name, ShouldEqual, "4912")
+		})
+	})
+}
+
+func TestContainerInfo(t *testing.T) {
+	Convey("Given a containerd monitor", t, func() {
+		client := testClient()
+		cm := newContainerdMonitor(client, constants.DefaultContainerdNamespace, nil, nil, &collector.DefaultCollector{}, false, nil, false)
+		cm.resolver = fakeResolver
+
+		Convey("When I read a running container", func() {
+			info, err := cm.containerInfo(context.Background(), client.containers[runningID])
+
+			Convey("Then I should get its task, network namespace and address", func() {
+				So(err, ShouldBeNil)
+				So(info, ShouldResemble, &ContainerInfo{
+					ID:        runningID,
+					Image:     "docker.io/library/nginx:latest",
+					Labels:    map[string]string{"app": "web"},
+					Pid:       4912,
+					NSPath:    "/var/run/netns/cni-1234",
+					IPAddress: "10.1.1.2",
+					Status:    containerd.Running,
+				})
+			})
+		})
+
+		Convey("When I read a container without task or network namespace", func() {
+			client.containers[stoppedID].spec = testSpec("", false)
+			info, err := cm.containerInfo(context.Background(), client.containers[stoppedID])
+
+			Convey("Then it should be stopped in the host network", func() {
+				So(err, ShouldBeNil)
+				So(info.Status, ShouldEqual, containerd.Stopped)
+				So(info.HostNetwork, ShouldBeTrue)
+				So(info.Pid, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestSyncContainers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a containerd monitor with a running and a stopped container", t, func() {
+		mockPU := mockmonitor.NewMockProcessingUnitsHandler(ctrl)
+		mockSync := mockmonitor.NewMockSynchronizationHandler(ctrl)
+		cm := newContainerdMonitor(testClient(), constants.DefaultContainerdNamespace, mockPU, nil, &collector.DefaultCollector{}, true, mockSync, false)
+
+		Convey("When I sync the containers", func() {
+			gomock.InOrder(
+				mockSync.EXPECT().HandleSynchronization("74cc486f9ec3", monitor.StateStarted, gomock.Any(), monitor.SynchronizationTypeInitial).Times(1).Return(nil),
+				mockSync.EXPECT().HandleSynchronization("598a35a60f79", monitor.StateStopped, gomock.Any(), monitor.SynchronizationTypeInitial).Times(1).Return(nil),
+				mockSync.EXPECT().HandleSynchronizationComplete(monitor.SynchronizationTypeInitial).Times(1),
+				mockPU.EXPECT().SetPURuntime("74cc486f9ec3", gomock.Any()).Times(1).Return(nil),
+				mockPU.EXPECT().HandlePUEvent("74cc486f9ec3", monitor.EventStart).Times(1).Return(nil),
+			)
+
+			err := cm.syncContainers()
+
+			Convey("Then both containers should be synced and the running one started", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestStartEventWithPolicyError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a containerd monitor that kills containers on policy errors", t, func() {
+		client := testClient()
+		mockPU := mockmonitor.NewMockProcessingUnitsHandler(ctrl)
+		cm := newContainerdMonitor(client, constants.DefaultContainerdNamespace, mockPU, nil, &collector.DefaultCollector{}, false, nil, true)
+
+		Convey("When the policy of a started container fails", func() {
+			mockPU.EXPECT().SetPURuntime("74cc486f9ec3", gomock.Any()).Times(1).Return(nil)
+			mockPU.EXPECT().HandlePUEvent("74cc486f9ec3", monitor.EventStart).Times(1).Return(fmt.Errorf("policy error"))
+
+			err := cm.handleStartEvent(&containerEvent{topic: ContainerdEventStart, containerID: runningID})
+
+			Convey("Then the container should be killed", func() {
+				So(err, ShouldNotBeNil)
+				So(client.containers[runningID].task.killed, ShouldEqual, syscall.SIGKILL)
+			})
+		})
+
+		Convey("When a started container cannot be read", func() {
+			err := cm.handleStartEvent(&containerEvent{topic: ContainerdEventStart, containerID: "0123456789abcdef"})
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestContainerdEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a started containerd monitor", t, func() {
+		client := testClient()
+		mockPU := mockmonitor.NewMockProcessingUnitsHandler(ctrl)
+		mockCG := mock_cgnetcls.NewMockCgroupnetcls(ctrl)
+		cm := newContainerdMonitor(client, constants.DefaultContainerdNamespace, mockPU, nil, &collector.DefaultCollector{}, false, nil, false)
+		cm.netcls = mockCG
+
+		So(cm.Start(), ShouldBeNil)
+		defer cm.Stop() // nolint
+
+		Convey("When a container is started, stopped and deleted", func() {
+			done := make(chan struct{})
+
+			gomock.InOrder(
+				mockPU.EXPECT().SetPURuntime("74cc486f9ec3", gomock.Any()).Times(1).Return(nil),
+				mockPU.EXPECT().HandlePUEvent("74cc486f9ec3", monitor.EventStart).Times(1).Return(nil),
+				mockPU.EXPECT().HandlePUEvent("74cc486f9ec3", monitor.EventStop).Times(1).Return(nil),
+				mockPU.EXPECT().HandlePUEvent("74cc486f9ec3", monitor.EventDestroy).Times(1).Return(nil),
+				mockCG.EXPECT().DeleteCgroup("74cc486f9ec3").Times(1).Return(nil).Do(func(string) {
+					close(done)
+				}),
+			)
+
+			client.events <- testEnvelope(ContainerdEventStart, &apievents.TaskStart{ContainerID: runningID, Pid: 4912})
+			client.events <- testEnvelope(ContainerdEventExit, &apievents.TaskExit{ContainerID: runningID, ID: "exec1"})
+			client.events <- testEnvelope(ContainerdEventExit, &apievents.TaskExit{ContainerID: runningID, ID: runningID})
+			client.events <- testEnvelope(ContainerdEventDelete, &apievents.ContainerDelete{ID: runningID})
+
+			Convey("Then the PU should be started, stopped and destroyed in order", func() {
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					So("timeout waiting for the events", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
+
+func TestEventListenerResubscribe(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a started containerd monitor", t, func() {
+		client := testClient()
+		mockPU := mockmonitor.NewMockProcessingUnitsHandler(ctrl)
+		cm := newContainerdMonitor(client, constants.DefaultContainerdNamespace, mockPU, nil, nil, false, nil, false)
+		cm.resolver = fakeResolver
+
+		So(cm.Start(), ShouldBeNil)
+		defer cm.Stop() // nolint
+
+		Convey("When the event subscription fails", func() {
+			client.errs <- fmt.Errorf("connection reset")
+
+			Convey("Then the monitor should subscribe again and keep processing events", func() {
+				deadline := time.Now().Add(5 * time.Second)
+				for atomic.LoadInt32(&client.subscriptions) < 2 && time.Now().Before(deadline) {
+					time.Sleep(50 * time.Millisecond)
+				}
+				So(atomic.LoadInt32(&client.subscriptions), ShouldEqual, 2)
+
+				done := make(chan struct{})
+				mockPU.EXPECT().HandlePUEvent("74cc486f9ec3", monitor.EventCreate).Times(1).Return(nil).Do(func(string, monitor.Event) {
+					close(done)
+				})
+
+				client.events <- testEnvelope(ContainerdEventCreate, &apievents.ContainerCreate{ID: runningID})
+
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					So("timeout waiting for the event", ShouldBeEmpty)
+				}
+			})
+		})
+	})
+}
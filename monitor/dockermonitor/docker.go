@@ -122,6 +122,10 @@ func defaultDockerMetadataExtractor(info *types.ContainerJSON) (*policy.PURuntim
 		"bridge": info.NetworkSettings.IPAddress,
 	}
 
+	if info.NetworkSettings.GlobalIPv6Address != "" {
+		ipa[policy.DefaultNamespaceIPv6] = info.NetworkSettings.GlobalIPv6Address
+	}
+
 	if info.HostConfig.NetworkMode == DockerHostMode {
 		return policy.NewPURuntime(info.Name, info.State.Pid, "", tags, ipa, constants.LinuxProcessPU, hostModeOptions(info)), nil
 	}
@@ -0,0 +1,516 @@
+// Package kubernetesmonitor watches the pods of a node through the Kubernetes
+// API. It is built against k8s.io/api, k8s.io/apimachinery and k8s.io/client-go
+// v0.34, and needs the context aware clients of client-go v0.18 or later.
+package kubernetesmonitor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+
+	api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// KubernetesResyncPeriod is the period at which the pods of the node are resynced from the cache
+	KubernetesResyncPeriod = 10 * time.Minute
+
+	// nodeNameField is the field used to select the pods scheduled on a node
+	nodeNameField = "spec.nodeName"
+
+	// defaultProcMountPoint is the mount point of proc used to find the processes of the pods
+	defaultProcMountPoint = "/proc"
+
+	// infraCommand is the command of the infra container of the pods
+	infraCommand = "pause"
+)
+
+// A KubernetesMetadataExtractor is a function used to extract a *policy.PURuntime from a given
+// Kubernetes pod.
+type KubernetesMetadataExtractor func(*api.Pod) (*policy.PURuntime, error)
+
+// A KubernetesPIDResolver is a function used to find the pid of the infra container of a
+// given Kubernetes pod. The containers of a pod share the network namespace of this process.
+type KubernetesPIDResolver func(*api.Pod) (int, error)
+
+// contextIDFromPod returns the context ID of a pod. It is derived from the UID of the pod
+// since the name of a pod can be reused after it is deleted.
+func contextIDFromPod(pod *api.Pod) (string, error) {
+
+	uid := strings.Replace(string(pod.UID), "-", "", -1)
+
+	if uid == "" {
+		return "", fmt.Errorf("Empty pod UID")
+	}
+
+	if len(uid) < 12 {
+		return "", fmt.Errorf("Pod UID smaller than 12 characters")
+	}
+
+	return uid[:12], nil
+}
+
+// DefaultKubernetesMetadataExtractor is the default metadata extractor for Kubernetes. The labels
+// of the pod are user tags and its namespace, name, service account and owners are system tags.
+// The pid of the runtime is set by the monitor.
+func DefaultKubernetesMetadataExtractor(pod *api.Pod) (*policy.PURuntime, error) {
+
+	if pod == nil {
+		return nil, fmt.Errorf("Pod is empty")
+	}
+
+	tags := policy.NewTagStore()
+	tags.AppendKeyValue("@sys:name", pod.Name)
+	tags.AppendKeyValue("@sys:namespace", pod.Namespace)
+
+	if pod.Spec.ServiceAccountName != "" {
+		tags.AppendKeyValue("@sys:serviceaccount", pod.Spec.ServiceAccountName)
+	}
+
+	for _, owner := range pod.OwnerReferences {
+		tags.AppendKeyValue("@sys:owner", owner.Kind+"/"+owner.Name)
+	}
+
+	for k, v := range pod.Labels {
+		tags.AppendKeyValue("@usr:"+k, v)
+	}
+
+	ipa := policy.ExtendedMap{}
+
+	if ip := net.ParseIP(pod.Status.PodIP); ip != nil {
+		if ip.To4() != nil {
+			ipa["bridge"] = pod.Status.PodIP
+		} else {
+			ipa[policy.DefaultNamespaceIPv6] = pod.Status.PodIP
+		}
+	}
+
+	return policy.NewPURuntime(pod.Namespace+"/"+pod.Name, 0, "", tags, ipa, constants.ContainerPU, nil), nil
+}
+
+// NewCgroupPIDResolver returns a resolver that looks for the processes of a pod in the cgroups
+// of the processes of the given proc mount point. It returns the pid of the infra container of
+// the pod, or else the lowest pid of the pod.
+func NewCgroupPIDResolver(procMountPoint string) KubernetesPIDResolver {
+
+	return func(pod *api.Pod) (int, error) {
+
+		uid := string(pod.UID)
+		if uid == "" {
+			return 0, fmt.Errorf("Empty pod UID")
+		}
+
+		// The cgroupfs driver keeps the dashes of the UID and the systemd driver replaces them
+		cgroups := []string{"pod" + uid, "pod" + strings.Replace(uid, "-", "_", -1)}
+
+		processes, err := ioutil.ReadDir(procMountPoint)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to list the processes: %s", err)
+		}
+
+		lowest := 0
+		for _, process := range processes {
+			pid, err := strconv.Atoi(process.Name())
+			if err != nil {
+				continue
+			}
+
+			cgroup, err := ioutil.ReadFile(filepath.Join(procMountPoint, process.Name(), "cgroup"))
+			if err != nil || !containsAny(string(cgroup), cgroups) {
+				continue
+			}
+
+			comm, err := ioutil.ReadFile(filepath.Join(procMountPoint, process.Name(), "comm"))
+			if err == nil && strings.TrimSpace(string(comm)) == infraCommand {
+				return pid, nil
+			}
+
+			if lowest == 0 || pid < lowest {
+				lowest = pid
+			}
+		}
+
+		if lowest == 0 {
+			return 0, fmt.Errorf("No process found for pod %s", pod.Name)
+		}
+
+		return lowest, nil
+	}
+}
+
+// containsAny returns true if s contains one of the substrings
+func containsAny(s string, substrings []string) bool {
+
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// podState returns the state of the processing unit of a pod
+func podState(pod *api.Pod) monitor.State {
+
+	switch pod.Status.Phase {
+	case api.PodRunning:
+		if pod.Status.PodIP == "" {
+			return monitor.StateStopped
+		}
+		return monitor.StateStarted
+	case api.PodPending, api.PodSucceeded, api.PodFailed:
+		return monitor.StateStopped
+	default:
+		return monitor.StateUnknwown
+	}
+}
+
+// kubernetesMonitor watches the pods of a node through the Kubernetes API
+type kubernetesMonitor struct {
+	client            kubernetes.Interface
+	nodeName          string
+	metadataExtractor KubernetesMetadataExtractor
+	pidResolver       KubernetesPIDResolver
+	syncHandler       monitor.SynchronizationHandler
+	syncAtStart       bool
+
+	collector collector.EventCollector
+	puHandler monitor.ProcessingUnitsHandler
+
+	// pods holds the processing units that were created for the pods. It is
+	// only accessed by the event handlers which are called sequentially by
+	// the controller.
+	pods map[string]*podUnit
+
+	controller cache.Controller
+	stop       chan struct{}
+}
+
+// podUnit is the processing unit of a pod
+type podUnit struct {
+	runtime *policy.PURuntime
+	started bool
+}
+
+// NewKubernetesMonitor returns a monitor that watches the pods scheduled on the given node
+// through the Kubernetes API. Pods that use the host network are ignored. The pids of the
+// pods are found in their cgroups if no resolver is given.
+func NewKubernetesMonitor(
+	client kubernetes.Interface,
+	nodeName string,
+	p monitor.ProcessingUnitsHandler,
+	m KubernetesMetadataExtractor,
+	r KubernetesPIDResolver,
+	l collector.EventCollector,
+	syncAtStart bool,
+	s monitor.SynchronizationHandler,
+) monitor.Monitor {
+
+	if m == nil {
+		m = DefaultKubernetesMetadataExtractor
+	}
+
+	if r == nil {
+		r = NewCgroupPIDResolver(defaultProcMountPoint)
+	}
+
+	if l == nil {
+		zap.L().Warn("Using a default collector for events")
+		l = &collector.DefaultCollector{}
+	}
+
+	k := &kubernetesMonitor{
+		client:            client,
+		nodeName:          nodeName,
+		metadataExtractor: m,
+		pidResolver:       r,
+		syncHandler:       s,
+		syncAtStart:       syncAtStart,
+		collector:         l,
+		puHandler:         p,
+		pods:              map[string]*podUnit{},
+		stop:              make(chan struct{}),
+	}
+
+	selector := fields.OneTermEqualSelector(nodeNameField, nodeName).String()
+
+	watchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return client.CoreV1().Pods(metav1.NamespaceAll).List(context.Background(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return client.CoreV1().Pods(metav1.NamespaceAll).Watch(context.Background(), options)
+		},
+	}
+
+	_, k.controller = cache.NewInformer(watchlist, &api.Pod{}, KubernetesResyncPeriod, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			k.handlePod(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			k.handlePod(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			k.handleDeletedPod(obj)
+		},
+	})
+
+	return k
+}
+
+// Start synchronizes the existing pods of the node and starts watching the pods.
+func (k *kubernetesMonitor) Start() error {
+
+	zap.L().Debug("Starting the kubernetes monitor", zap.String("node", k.nodeName))
+
+	if k.syncAtStart && k.syncHandler != nil {
+		if err := k.syncPods(); err != nil {
+			zap.L().Error("Error syncing existing pods", zap.Error(err))
+		}
+	}
+
+	go k.controller.Run(k.stop)
+
+	if !cache.WaitForCacheSync(k.stop, k.controller.HasSynced) {
+		return fmt.Errorf("Unable to sync the pods of node %s", k.nodeName)
+	}
+
+	return nil
+}
+
+// Stop stops watching the pods.
+func (k *kubernetesMonitor) Stop() error {
+
+	zap.L().Debug("Stopping the kubernetes monitor")
+
+	close(k.stop)
+
+	return nil
+}
+
+// syncPods reconciles the processing units of the pods that exist on the node.
+// The running pods are started when the controller lists them.
+func (k *kubernetesMonitor) syncPods() error {
+
+	zap.L().Debug("Syncing all existing pods")
+
+	pods, err := k.client.CoreV1().Pods(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector(nodeNameField, k.nodeName).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("Error getting the pods of node %s: %s", k.nodeName, err)
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+
+		if !k.isManaged(pod) {
+			continue
+		}
+
+		contextID, err := contextIDFromPod(pod)
+		if err != nil {
+			zap.L().Error("Error syncing existing pod", zap.String("pod", pod.Name), zap.Error(err))
+			continue
+		}
+
+		runtimeInfo, err := k.metadataExtractor(pod)
+		if err != nil {
+			zap.L().Error("Error syncing existing pod", zap.String("pod", pod.Name), zap.Error(err))
+			continue
+		}
+
+		state := podState(pod)
+		if state == monitor.StateStarted {
+			pid, err := k.pidResolver(pod)
+			if err != nil {
+				zap.L().Error("Error getting the pid of existing pod", zap.String("pod", pod.Name), zap.Error(err))
+			}
+			runtimeInfo.SetPid(pid)
+		}
+
+		if err := k.syncHandler.HandleSynchronization(contextID, state, runtimeInfo, monitor.SynchronizationTypeInitial); err != nil {
+			zap.L().Error("Error syncing existing pod", zap.String("pod", pod.Name), zap.Error(err))
+		}
+	}
+
+	k.syncHandler.HandleSynchronizationComplete(monitor.SynchronizationTypeInitial)
+
+	return nil
+}
+
+// isManaged returns true if the pod is scheduled on the node and does not use the host network.
+func (k *kubernetesMonitor) isManaged(pod *api.Pod) bool {
+
+	return pod.Spec.NodeName == k.nodeName && !pod.Spec.HostNetwork
+}
+
+// handlePod starts or stops the processing unit of a pod that was added or updated,
+// and updates the processing unit of a started pod whose metadata changed.
+func (k *kubernetesMonitor) handlePod(obj interface{}) {
+
+	pod, ok := obj.(*api.Pod)
+	if !ok || !k.isManaged(pod) {
+		return
+	}
+
+	contextID, err := contextIDFromPod(pod)
+	if err != nil {
+		zap.L().Error("Error generating ContextID", zap.String("pod", pod.Name), zap.Error(err))
+		return
+	}
+
+	unit, known := k.pods[contextID]
+
+	switch podState(pod) {
+	case monitor.StateStarted:
+		if known && unit.started {
+			if err := k.updatePod(contextID, unit, pod); err != nil {
+				zap.L().Error("Error updating pod", zap.String("pod", pod.Name), zap.Error(err))
+			}
+			return
+		}
+		if err := k.startPod(contextID, pod); err != nil {
+			zap.L().Error("Error starting pod", zap.String("pod", pod.Name), zap.Error(err))
+		}
+
+	case monitor.StateStopped:
+		if !known || !unit.started {
+			return
+		}
+		unit.started = false
+		if err := k.puHandler.HandlePUEvent(contextID, monitor.EventStop); err != nil {
+			zap.L().Error("Error stopping pod", zap.String("pod", pod.Name), zap.Error(err))
+		}
+	}
+}
+
+// startPod creates the processing unit of a pod and starts it. A pod that can
+// not be started is retried on its next event.
+func (k *kubernetesMonitor) startPod(contextID string, pod *api.Pod) error {
+
+	runtimeInfo, err := k.metadataExtractor(pod)
+	if err != nil {
+		k.collector.CollectContainerEvent(&collector.ContainerRecord{
+			ContextID: contextID,
+			IPAddress: pod.Status.PodIP,
+			Tags:      nil,
+			Event:     collector.ContainerFailed,
+		})
+		return fmt.Errorf("Error getting the metadata of the pod: %s", err)
+	}
+
+	pid, err := k.pidResolver(pod)
+	if err != nil {
+		return fmt.Errorf("Error getting the pid of the pod: %s", err)
+	}
+	runtimeInfo.SetPid(pid)
+
+	if err := k.puHandler.SetPURuntime(contextID, runtimeInfo); err != nil {
+		return err
+	}
+
+	k.pods[contextID] = &podUnit{runtime: runtimeInfo, started: true}
+
+	if err := k.puHandler.HandlePUEvent(contextID, monitor.EventStart); err != nil {
+		return fmt.Errorf("Policy couldn't be set for pod %s: %s", contextID, err)
+	}
+
+	return nil
+}
+
+// updatePod replaces the runtime of a started pod when its tags or IP addresses
+// changed, and sends an update event so that its policy is resolved and updated
+// for the new runtime. The pod keeps its policy if the update fails.
+func (k *kubernetesMonitor) updatePod(contextID string, unit *podUnit, pod *api.Pod) error {
+
+	runtimeInfo, err := k.metadataExtractor(pod)
+	if err != nil {
+		return fmt.Errorf("Error getting the metadata of the pod: %s", err)
+	}
+
+	if sameMetadata(unit.runtime, runtimeInfo) {
+		return nil
+	}
+
+	runtimeInfo.SetPid(unit.runtime.Pid())
+
+	if err := k.puHandler.SetPURuntime(contextID, runtimeInfo); err != nil {
+		return err
+	}
+
+	unit.runtime = runtimeInfo
+
+	if err := k.puHandler.HandlePUEvent(contextID, monitor.EventUpdate); err != nil {
+		return fmt.Errorf("Policy couldn't be updated for pod %s: %s", contextID, err)
+	}
+
+	return nil
+}
+
+// sameMetadata returns true if two runtimes have the same tags and IP addresses
+func sameMetadata(a, b *policy.PURuntime) bool {
+
+	aTags := a.Tags().GetSlice()
+	bTags := b.Tags().GetSlice()
+	sort.Strings(aTags)
+	sort.Strings(bTags)
+
+	return reflect.DeepEqual(aTags, bTags) && reflect.DeepEqual(a.IPAddresses(), b.IPAddresses())
+}
+
+// handleDeletedPod stops the processing unit of a deleted pod and destroys it.
+func (k *kubernetesMonitor) handleDeletedPod(obj interface{}) {
+
+	pod, ok := obj.(*api.Pod)
+	if !ok {
+		return
+	}
+
+	contextID, err := contextIDFromPod(pod)
+	if err != nil {
+		return
+	}
+
+	unit, known := k.pods[contextID]
+	if !known {
+		return
+	}
+	delete(k.pods, contextID)
+
+	if unit.started {
+		if err := k.puHandler.HandlePUEvent(contextID, monitor.EventStop); err != nil {
+			zap.L().Error("Error stopping deleted pod", zap.String("pod", pod.Name), zap.Error(err))
+		}
+	}
+
+	if err := k.puHandler.HandlePUEvent(contextID, monitor.EventDestroy); err != nil {
+		zap.L().Error("Error destroying deleted pod", zap.String("pod", pod.Name), zap.Error(err))
+	}
+}
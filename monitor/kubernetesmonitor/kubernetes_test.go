@@ -0,0 +1,345 @@
+package kubernetesmonitor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/monitor/mock"
+	"github.com/aporeto-inc/trireme/policy"
+	gomock "github.com/golang/mock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+
+	api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testNode = "node1"
+	testPid  = 1234
+)
+
+func testPIDResolver(pod *api.Pod) (int, error) {
+	return testPid, nil
+}
+
+func testPod(name string, uid string, phase api.PodPhase, ip string) *api.Pod {
+
+	return &api.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID(uid),
+			Labels:    map[string]string{"app": "web"},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "web-1234"},
+			},
+		},
+		Spec: api.PodSpec{
+			NodeName:           testNode,
+			ServiceAccountName: "web-sa",
+		},
+		Status: api.PodStatus{
+			Phase: phase,
+			PodIP: ip,
+		},
+	}
+}
+
+func TestContextIDFromPod(t *testing.T) {
+
+	Convey("When I retrieve the context ID of a pod", t, func() {
+		cID, err := contextIDFromPod(testPod("web", "7c0bd5bb-0b2d-11e8-8a6f-42010a800002", api.PodRunning, ""))
+
+		Convey("Then I should get the first 12 characters of the UID without dashes", func() {
+			So(err, ShouldBeNil)
+			So(cID, ShouldEqual, "7c0bd5bb0b2d")
+		})
+	})
+
+	Convey("When I retrieve the context ID of a pod without UID", t, func() {
+		_, err := contextIDFromPod(testPod("web", "", api.PodRunning, ""))
+
+		Convey("Then I should get an error", func() {
+			So(err, ShouldResemble, fmt.Errorf("Empty pod UID"))
+		})
+	})
+
+	Convey("When I retrieve the context ID of a pod with a short UID", t, func() {
+		_, err := contextIDFromPod(testPod("web", "7c0bd5bb", api.PodRunning, ""))
+
+		Convey("Then I should get an error", func() {
+			So(err, ShouldResemble, fmt.Errorf("Pod UID smaller than 12 characters"))
+		})
+	})
+}
+
+func TestDefaultKubernetesMetadataExtractor(t *testing.T) {
+
+	Convey("When I extract the metadata of a pod with an IPv4 address", t, func() {
+		runtime, err := DefaultKubernetesMetadataExtractor(testPod("web", "", api.PodRunning, "10.0.0.5"))
+
+		Convey("Then the runtime should have the tags and the IP of the pod", func() {
+			So(err, ShouldBeNil)
+			So(runtime.Name(), ShouldEqual, "default/web")
+			So(runtime.PUType(), ShouldEqual, constants.ContainerPU)
+			So(runtime.Tags().GetSlice(), ShouldContain, "@usr:app=web")
+			So(runtime.Tags().GetSlice(), ShouldContain, "@sys:name=web")
+			So(runtime.Tags().GetSlice(), ShouldContain, "@sys:namespace=default")
+			So(runtime.Tags().GetSlice(), ShouldContain, "@sys:serviceaccount=web-sa")
+			So(runtime.Tags().GetSlice(), ShouldContain, "@sys:owner=ReplicaSet/web-1234")
+			So(runtime.IPAddresses(), ShouldResemble, policy.ExtendedMap{"bridge": "10.0.0.5"})
+		})
+	})
+
+	Convey("When I extract the metadata of a pod with an IPv6 address", t, func() {
+		runtime, err := DefaultKubernetesMetadataExtractor(testPod("web", "", api.PodRunning, "fd00::5"))
+
+		Convey("Then the IP should be in the IPv6 namespace", func() {
+			So(err, ShouldBeNil)
+			So(runtime.IPAddresses(), ShouldResemble, policy.ExtendedMap{policy.DefaultNamespaceIPv6: "fd00::5"})
+		})
+	})
+
+	Convey("When I extract the metadata of a nil pod", t, func() {
+		_, err := DefaultKubernetesMetadataExtractor(nil)
+
+		Convey("Then I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCgroupPIDResolver(t *testing.T) {
+
+	Convey("Given the processes of two pods", t, func() {
+		proc, err := ioutil.TempDir("", "proc")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(proc) // nolint
+
+		process := func(pid string, cgroup string, comm string) {
+			So(os.MkdirAll(filepath.Join(proc, pid), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(proc, pid, "cgroup"), []byte(cgroup), 0644), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(proc, pid, "comm"), []byte(comm+"\n"), 0644), ShouldBeNil)
+		}
+
+		process("1", "0::/init.scope\n", "systemd")
+		process("210", "0::/kubepods/burstable/pod7c0bd5bb-0b2d-11e8-8a6f-42010a800002/c1\n", "nginx")
+		process("200", "0::/kubepods/burstable/pod7c0bd5bb-0b2d-11e8-8a6f-42010a800002/c2\n", "nginx")
+		process("220", "0::/kubepods/burstable/pod7c0bd5bb-0b2d-11e8-8a6f-42010a800002/c3\n", "pause")
+		process("310", "0::/kubepods.slice/kubepods-pod8d1ce6cc_0b2d_11e8_8a6f_42010a800002.slice/c4\n", "postgres")
+		process("300", "0::/kubepods.slice/kubepods-pod8d1ce6cc_0b2d_11e8_8a6f_42010a800002.slice/c5\n", "postgres")
+
+		resolve := NewCgroupPIDResolver(proc)
+
+		Convey("When I resolve the pid of a pod with an infra container", func() {
+			pid, err := resolve(testPod("web", "7c0bd5bb-0b2d-11e8-8a6f-42010a800002", api.PodRunning, ""))
+
+			Convey("Then I should get the pid of the infra container", func() {
+				So(err, ShouldBeNil)
+				So(pid, ShouldEqual, 220)
+			})
+		})
+
+		Convey("When I resolve the pid of a pod in a systemd cgroup without infra container", func() {
+			pid, err := resolve(testPod("db", "8d1ce6cc-0b2d-11e8-8a6f-42010a800002", api.PodRunning, ""))
+
+			Convey("Then I should get the lowest pid of the pod", func() {
+				So(err, ShouldBeNil)
+				So(pid, ShouldEqual, 300)
+			})
+		})
+
+		Convey("When I resolve the pid of a pod without processes", func() {
+			_, err := resolve(testPod("cache", "9e2df7dd-0b2d-11e8-8a6f-42010a800002", api.PodRunning, ""))
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestPodEvents(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a kubernetes monitor", t, func() {
+
+		mockPU := mockmonitor.NewMockProcessingUnitsHandler(ctrl)
+		k := NewKubernetesMonitor(fake.NewSimpleClientset(), testNode, mockPU, nil, testPIDResolver, nil, false, nil).(*kubernetesMonitor)
+
+		pod := testPod("web", "7c0bd5bb-0b2d-11e8-8a6f-42010a800002", api.PodPending, "")
+
+		Convey("When a pending pod is added, nothing should happen", func() {
+			k.handlePod(pod)
+			So(k.pods, ShouldBeEmpty)
+		})
+
+		Convey("When a pod becomes running", func() {
+			var runtimeInfo *policy.PURuntime
+			mockPU.EXPECT().SetPURuntime("7c0bd5bb0b2d", gomock.Any()).Times(1).Return(nil).Do(func(contextID string, r *policy.PURuntime) {
+				runtimeInfo = r
+			})
+			mockPU.EXPECT().HandlePUEvent("7c0bd5bb0b2d", monitor.EventStart).Times(1).Return(nil)
+
+			pod.Status.Phase = api.PodRunning
+			pod.Status.PodIP = "10.0.0.5"
+			k.handlePod(pod)
+			k.handlePod(pod)
+
+			Convey("Then it should be started once with the pid of its infra container", func() {
+				So(k.pods, ShouldContainKey, "7c0bd5bb0b2d")
+				So(k.pods["7c0bd5bb0b2d"].started, ShouldBeTrue)
+				So(runtimeInfo.Pid(), ShouldEqual, testPid)
+			})
+
+			Convey("When the labels of the pod change", func() {
+				var updated *policy.PURuntime
+				mockPU.EXPECT().SetPURuntime("7c0bd5bb0b2d", gomock.Any()).Times(1).Return(nil).Do(func(contextID string, r *policy.PURuntime) {
+					updated = r
+				})
+				mockPU.EXPECT().HandlePUEvent("7c0bd5bb0b2d", monitor.EventUpdate).Times(1).Return(nil)
+
+				pod.Labels = map[string]string{"app": "web", "version": "2"}
+				k.handlePod(pod)
+				k.handlePod(pod)
+
+				Convey("Then its runtime should be updated once and its policy updated", func() {
+					So(updated.Tags().GetSlice(), ShouldContain, "@usr:version=2")
+					So(updated.Pid(), ShouldEqual, testPid)
+				})
+			})
+
+			Convey("When the pod completes and is deleted", func() {
+				mockPU.EXPECT().HandlePUEvent("7c0bd5bb0b2d", monitor.EventStop).Times(1).Return(nil)
+				mockPU.EXPECT().HandlePUEvent("7c0bd5bb0b2d", monitor.EventDestroy).Times(1).Return(nil)
+
+				pod.Status.Phase = api.PodSucceeded
+				k.handlePod(pod)
+				k.handleDeletedPod(pod)
+
+				Convey("Then it should be stopped and destroyed", func() {
+					So(k.pods, ShouldBeEmpty)
+				})
+			})
+
+			Convey("When the pod is deleted while running", func() {
+				mockPU.EXPECT().HandlePUEvent("7c0bd5bb0b2d", monitor.EventStop).Times(1).Return(nil)
+				mockPU.EXPECT().HandlePUEvent("7c0bd5bb0b2d", monitor.EventDestroy).Times(1).Return(nil)
+
+				k.handleDeletedPod(pod)
+
+				Convey("Then it should be stopped and destroyed", func() {
+					So(k.pods, ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey("When the pid of a running pod can not be resolved", func() {
+			k.pidResolver = func(*api.Pod) (int, error) {
+				return 0, fmt.Errorf("No process found")
+			}
+
+			pod.Status.Phase = api.PodRunning
+			pod.Status.PodIP = "10.0.0.5"
+			k.handlePod(pod)
+
+			Convey("Then it should not be started", func() {
+				So(k.pods, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a running pod uses the host network, nothing should happen", func() {
+			pod.Status.Phase = api.PodRunning
+			pod.Status.PodIP = "10.0.0.5"
+			pod.Spec.HostNetwork = true
+			k.handlePod(pod)
+			So(k.pods, ShouldBeEmpty)
+		})
+
+		Convey("When a running pod is on another node, nothing should happen", func() {
+			pod.Status.Phase = api.PodRunning
+			pod.Status.PodIP = "10.0.0.5"
+			pod.Spec.NodeName = "node2"
+			k.handlePod(pod)
+			So(k.pods, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestStartAndSync(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a fake cluster with a running and a pending pod on the node", t, func() {
+
+		running := testPod("web", "7c0bd5bb-0b2d-11e8-8a6f-42010a800002", api.PodRunning, "10.0.0.5")
+		pending := testPod("db", "8d1ce6cc-0b2d-11e8-8a6f-42010a800002", api.PodPending, "")
+		client := fake.NewSimpleClientset(running, pending)
+
+		mockPU := mockmonitor.NewMockProcessingUnitsHandler(ctrl)
+		mockSync := mockmonitor.NewMockSynchronizationHandler(ctrl)
+
+		k := NewKubernetesMonitor(client, testNode, mockPU, nil, testPIDResolver, &collector.DefaultCollector{}, true, mockSync)
+
+		Convey("When I start the monitor", func() {
+			started := make(chan struct{}, 1)
+
+			syncRunning := mockSync.EXPECT().HandleSynchronization("7c0bd5bb0b2d", monitor.StateStarted, gomock.Any(), monitor.SynchronizationTypeInitial).Times(1).Return(nil)
+			syncPending := mockSync.EXPECT().HandleSynchronization("8d1ce6cc0b2d", monitor.StateStopped, gomock.Any(), monitor.SynchronizationTypeInitial).Times(1).Return(nil)
+
+			gomock.InOrder(
+				mockSync.EXPECT().HandleSynchronizationComplete(monitor.SynchronizationTypeInitial).Times(1).After(syncRunning).After(syncPending),
+				mockPU.EXPECT().SetPURuntime("7c0bd5bb0b2d", gomock.Any()).Times(1).Return(nil),
+				mockPU.EXPECT().HandlePUEvent("7c0bd5bb0b2d", monitor.EventStart).Times(1).Return(nil).Do(func(string, monitor.Event) {
+					started <- struct{}{}
+				}),
+			)
+
+			So(k.Start(), ShouldBeNil)
+			defer k.Stop() // nolint
+
+			Convey("Then the existing pods should be synchronized and the running pod started", func() {
+				select {
+				case <-started:
+				case <-time.After(5 * time.Second):
+					So("timeout waiting for the pod to start", ShouldBeEmpty)
+				}
+			})
+
+			Convey("When the running pod is deleted", func() {
+				<-started
+
+				destroyed := make(chan struct{}, 1)
+				gomock.InOrder(
+					mockPU.EXPECT().HandlePUEvent("7c0bd5bb0b2d", monitor.EventStop).Times(1).Return(nil),
+					mockPU.EXPECT().HandlePUEvent("7c0bd5bb0b2d", monitor.EventDestroy).Times(1).Return(nil).Do(func(string, monitor.Event) {
+						destroyed <- struct{}{}
+					}),
+				)
+
+				So(client.CoreV1().Pods("default").Delete(context.Background(), "web", metav1.DeleteOptions{}), ShouldBeNil)
+
+				Convey("Then it should be stopped and destroyed", func() {
+					select {
+					case <-destroyed:
+					case <-time.After(5 * time.Second):
+						So("timeout waiting for the pod to be destroyed", ShouldBeEmpty)
+					}
+				})
+			})
+		})
+	})
+}
@@ -21,6 +21,10 @@ const (
 
 	// EventUnpause is the event generated when a PU is unpaused.
 	EventUnpause Event = "unpause"
+
+	// EventUpdate is the event generated when the runtime of a started PU
+	// changes, for example its tags.
+	EventUpdate Event = "update"
 )
 
 // A State describes the state of the PU.
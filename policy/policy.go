@@ -1,6 +1,11 @@
 package policy
 
-import "sync"
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/cnf/structhash"
+)
 
 // PUPolicy captures all policy information related ot the container
 type PUPolicy struct {
@@ -30,6 +35,9 @@ type PUPolicy struct {
 	triremeNetworks []string
 	// excludedNetworks a list of networks that must be excluded
 	excludedNetworks []string
+	// failurePolicy defines what happens to the packets when the enforcer can
+	// not process them
+	failurePolicy FailurePolicy
 
 	sync.Mutex
 }
@@ -42,8 +50,38 @@ const (
 	AllowAll = 0x1
 	// Police filters on the PU based on the PolicyRules.
 	Police = 0x2
+	// Monitor evaluates the PolicyRules of the PU and reports the flows that
+	// they would reject, but accepts every flow.
+	Monitor = 0x3
 )
 
+// FailurePolicy defines what happens to the packets of a PU when the enforcer
+// is not able to process them, because it stopped or its queues are stalled.
+type FailurePolicy int
+
+const (
+	// DefaultFailure applies the failure policy of the enforcer.
+	DefaultFailure FailurePolicy = iota
+	// FailClosed drops the packets and reports the failure.
+	FailClosed
+	// FailOpen accepts the packets without processing them and reports the failure.
+	FailOpen
+)
+
+// FailsOpen returns true if the packets must be accepted when they can not be
+// processed. failOpen is the failure policy of the enforcer.
+func (f FailurePolicy) FailsOpen(failOpen bool) bool {
+
+	switch f {
+	case FailOpen:
+		return true
+	case FailClosed:
+		return false
+	default:
+		return failOpen
+	}
+}
+
 // NewPUPolicy generates a new ContainerPolicyInfo
 // appACLs are the ACLs for packet coming from the Application/PU to the Network.
 // netACLs are the ACLs for packet coming from the Network to the Application/PU.
@@ -122,10 +160,47 @@ func (p *PUPolicy) Clone() *PUPolicy {
 		p.triremeNetworks,
 		p.excludedNetworks,
 	)
+	np.failurePolicy = p.failurePolicy
 
 	return np
 }
 
+// Hash returns a hash of the content of the policy. The policies that enforce
+// the same rules have the same hash, even when they were copied or sent to a
+// remote enforcer.
+func (p *PUPolicy) Hash() string {
+	p.Lock()
+	defer p.Unlock()
+
+	return hex.EncodeToString(structhash.Md5(struct {
+		ManagementID     string
+		TriremeAction    PUAction
+		ApplicationACLs  IPRuleList
+		NetworkACLs      IPRuleList
+		Identity         *TagStore
+		Annotations      *TagStore
+		TransmitterRules TagSelectorList
+		ReceiverRules    TagSelectorList
+		IPs              ExtendedMap
+		TriremeNetworks  []string
+		ExcludedNetworks []string
+		FailurePolicy    FailurePolicy
+	}{
+		p.managementID,
+		p.triremeAction,
+		p.applicationACLs,
+		p.networkACLs,
+		p.identity,
+		p.annotations,
+		p.transmitterRules,
+		p.receiverRules,
+		p.ips,
+		p.triremeNetworks,
+		p.excludedNetworks,
+		p.failurePolicy,
+	}, 1))
+}
+
 // ManagementID returns the management ID
 func (p *PUPolicy) ManagementID() string {
 	p.Lock()
@@ -268,6 +343,22 @@ func (p *PUPolicy) UpdateTriremeNetworks(networks []string) {
 
 }
 
+// FailurePolicy returns the failure policy of the PU
+func (p *PUPolicy) FailurePolicy() FailurePolicy {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.failurePolicy
+}
+
+// SetFailurePolicy sets the failure policy of the PU
+func (p *PUPolicy) SetFailurePolicy(f FailurePolicy) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.failurePolicy = f
+}
+
 // ExcludedNetworks returns the list of excluded networks.
 func (p *PUPolicy) ExcludedNetworks() []string {
 	p.Lock()
@@ -404,3 +404,58 @@ func TestPUInfo(t *testing.T) {
 		})
 	})
 }
+
+func TestHash(t *testing.T) {
+	Convey("Given a policy", t, func() {
+		identity := NewTagStore()
+		identity.AppendKeyValue("app", "web")
+
+		p := NewPUPolicy("id1", Police, nil, nil, nil, nil, identity, nil, ExtendedMap{DefaultNamespace: "172.0.0.1"}, nil, []string{})
+
+		Convey("Its clone should have the same hash", func() {
+			So(p.Hash(), ShouldNotBeEmpty)
+			So(p.Clone().Hash(), ShouldEqual, p.Hash())
+		})
+
+		Convey("When the policy changes, its hash should change", func() {
+			hash := p.Hash()
+			p.AddIdentityTag("image", "nginx")
+			So(p.Hash(), ShouldNotEqual, hash)
+		})
+
+		Convey("When the failure policy changes, its hash should change and be cloned", func() {
+			hash := p.Hash()
+			p.SetFailurePolicy(FailOpen)
+			So(p.Hash(), ShouldNotEqual, hash)
+			So(p.Clone().FailurePolicy(), ShouldEqual, FailOpen)
+		})
+	})
+}
+
+func TestFailsOpen(t *testing.T) {
+	Convey("The default failure policy should follow the global policy", t, func() {
+		So(DefaultFailure.FailsOpen(true), ShouldBeTrue)
+		So(DefaultFailure.FailsOpen(false), ShouldBeFalse)
+	})
+
+	Convey("The failure policy of a PU should override the global policy", t, func() {
+		So(FailOpen.FailsOpen(false), ShouldBeTrue)
+		So(FailClosed.FailsOpen(true), ShouldBeFalse)
+	})
+}
+
+func TestAuditedAction(t *testing.T) {
+	Convey("An audited reject should be reported as an audit", t, func() {
+		action := Reject | Audit
+		So(action.Audited(), ShouldBeTrue)
+		So(action.ShortActionString(), ShouldEqual, "u")
+		So(action.ActionString(), ShouldEqual, "audit")
+		So(action.String(), ShouldEqual, "audit")
+	})
+
+	Convey("An action that is not audited should be reported as before", t, func() {
+		So(Reject.Audited(), ShouldBeFalse)
+		So(Reject.ShortActionString(), ShouldEqual, "r")
+		So((Accept | Audit).ShortActionString(), ShouldEqual, "a")
+	})
+}
@@ -3,6 +3,9 @@ package policy
 const (
 	// DefaultNamespace is the default namespace for applying policy
 	DefaultNamespace = "bridge"
+
+	// DefaultNamespaceIPv6 is the namespace of the IPv6 address for applying policy
+	DefaultNamespaceIPv6 = "bridge6"
 )
 
 // Operator defines the operation between your key and value.
@@ -42,8 +45,17 @@ func (f ActionType) Logged() bool {
 	return f&Log > 0
 }
 
+// Audited returns if the action mask contains the Audit mask.
+func (f ActionType) Audited() bool {
+	return f&Audit > 0
+}
+
 // ShortActionString returns if the action if accepted of rejected as a short string.
 func (f ActionType) ShortActionString() string {
+	if f.Audited() && f.Rejected() {
+		return "u"
+	}
+
 	if f.Accepted() && !f.Rejected() {
 		return "a"
 	}
@@ -57,6 +69,10 @@ func (f ActionType) ShortActionString() string {
 
 // ActionString returns if the action if accepted of rejected as a long string.
 func (f ActionType) ActionString() string {
+	if f.Audited() && f.Rejected() {
+		return "audit"
+	}
+
 	if f.Accepted() && !f.Rejected() {
 		return "accept"
 	}
@@ -80,6 +96,10 @@ func (f ActionType) String() string {
 		return "log"
 	}
 
+	if f.Audited() && f.Rejected() {
+		return "audit"
+	}
+
 	return "unknown"
 }
 
@@ -92,6 +112,9 @@ const (
 	Encrypt ActionType = 0x4
 	// Log instructs the datapath to log the IP addresses
 	Log ActionType = 0x8
+	// Audit marks the flows that are only accepted because their PU is
+	// monitored. With Reject, it reports a flow that the policy would reject.
+	Audit ActionType = 0x10
 )
 
 // FlowPolicy captures the policy for a particular flow
@@ -128,10 +151,13 @@ type KeyValueOperator struct {
 	Operator Operator
 }
 
-// TagSelector info describes a tag selector key Operator value
+// TagSelector info describes a tag selector key Operator value. When more
+// than one selector matches, the one with the highest Priority is selected
+// and selectors of equal Priority are selected in the order they were added.
 type TagSelector struct {
-	Clause []KeyValueOperator
-	Policy *FlowPolicy
+	Clause   []KeyValueOperator
+	Policy   *FlowPolicy
+	Priority int
 }
 
 // TagSelectorList defines a list of TagSelectors
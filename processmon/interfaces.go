@@ -9,4 +9,5 @@ type ProcessManager interface {
 	KillProcess(contextID string)
 	LaunchProcess(contextID string, refPid int, refNsPath string, rpchdl rpcwrapper.RPCClient, arg string, statssecret string, procMountPoint string) error
 	SetnsNetPath(netpath string)
+	SetExitHandler(handler ExitHandler)
 }
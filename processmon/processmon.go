@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -30,8 +31,15 @@ var (
 //ProcessMon exported
 type ProcessMon struct {
 	activeProcesses *cache.Cache
+	exitHandler     ExitHandler
+
+	sync.Mutex
 }
 
+// ExitHandler is called with the exit status of a remote enforcer that exited
+// while it was active. It is not called for the enforcers that are killed.
+type ExitHandler func(contextID string, status error)
+
 var launcher *ProcessMon
 
 //ProcessInfo exported
@@ -85,9 +93,58 @@ func collectChildExitStatus() {
 			zap.Int("pid", exitStatus.process),
 			zap.Error(exitStatus.exitStatus),
 		)
+
+		if launcher != nil {
+			launcher.processExited(exitStatus)
+		}
+	}
+}
+
+// processExited forgets a remote enforcer that exited while it was still
+// active and calls the exit handler. The enforcers that are killed are not
+// active anymore when they exit.
+func (p *ProcessMon) processExited(exitStatus ExitStatus) {
+
+	s, err := p.activeProcesses.Get(exitStatus.contextID)
+	if err != nil {
+		return
+	}
+
+	// The enforcer of the context may have been launched again already
+	info := s.(*processInfo)
+	if info.process.Pid != exitStatus.process || info.deleted {
+		return
+	}
+
+	zap.L().Error("Remote enforcer exited unexpectedly",
+		zap.String("contextID", exitStatus.contextID),
+		zap.Int("pid", exitStatus.process),
+		zap.Error(exitStatus.exitStatus),
+	)
+
+	info.RPCHdl.DestroyRPCClient(exitStatus.contextID)
+	if err := p.activeProcesses.Remove(exitStatus.contextID); err != nil {
+		zap.L().Warn("Failed to remove process from cache", zap.Error(err))
+	}
+
+	p.Lock()
+	handler := p.exitHandler
+	p.Unlock()
+
+	if handler != nil {
+		go handler(exitStatus.contextID, exitStatus.exitStatus)
 	}
 }
 
+// SetExitHandler sets the handler of the remote enforcers that exit while
+// they are active. They are only forgotten if it is nil.
+func (p *ProcessMon) SetExitHandler(handler ExitHandler) {
+
+	p.Lock()
+	p.exitHandler = handler
+	p.Unlock()
+}
+
 // processIOReader will read from a reader and print it on the calling process
 func processIOReader(fd io.Reader, contextID string, exited chan int) {
 	reader := bufio.NewReader(fd)
@@ -141,6 +198,12 @@ func (p *ProcessMon) KillProcess(contextID string) {
 		zap.L().Debug("Process already killed or never launched")
 		return
 	}
+
+	// The process is not active anymore, so that its exit is expected
+	if err := p.activeProcesses.Remove(contextID); err != nil {
+		zap.L().Warn("Failed to remote process from cache", zap.Error(err))
+	}
+
 	req := &rpcwrapper.Request{}
 	resp := &rpcwrapper.Response{}
 	req.Payload = s.(*processInfo).process.Pid
@@ -172,10 +235,6 @@ func (p *ProcessMon) KillProcess(contextID string) {
 	if err := os.Remove(netnspath + contextID); err != nil {
 		zap.L().Warn("Failed to remote process from netns path", zap.Error(err))
 	}
-
-	if err := p.activeProcesses.Remove(contextID); err != nil {
-		zap.L().Warn("Failed to remote process from cache", zap.Error(err))
-	}
 }
 
 //LaunchProcess prepares the environment for the new process and launches the process
@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aporeto-inc/trireme/cache"
 	"github.com/aporeto-inc/trireme/enforcer/utils/rpcwrapper"
@@ -215,3 +216,53 @@ func TestGetProcessManagerHdl(t *testing.T) {
 		t.Errorf("ProcessManagerhandle don't match with cache")
 	}
 }
+
+func TestProcessExited(t *testing.T) {
+	contextID := "12345"
+	p := &ProcessMon{activeProcesses: cache.NewCache()}
+	rpchdl := rpcwrapper.NewTestRPCClient()
+
+	exited := make(chan string, 1)
+	p.SetExitHandler(func(contextID string, status error) {
+		exited <- contextID
+	})
+
+	//The exit of a process that was launched again is ignored
+	p.activeProcesses.AddOrUpdate(contextID, &processInfo{contextID: contextID, process: &os.Process{Pid: 2}, RPCHdl: rpchdl})
+	p.processExited(ExitStatus{process: 1, contextID: contextID})
+	if _, err := p.activeProcesses.Get(contextID); err != nil {
+		t.Errorf("TEST:Process removed on the exit of another process")
+	}
+
+	//The exit of an active process is reported
+	p.processExited(ExitStatus{process: 2, contextID: contextID, exitStatus: errors.New("Crashed")})
+	if _, err := p.activeProcesses.Get(contextID); err == nil {
+		t.Errorf("TEST:Process still active after it exited")
+	}
+	select {
+	case id := <-exited:
+		if id != contextID {
+			t.Errorf("TEST:Exit handler called for %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TEST:Exit handler not called")
+	}
+
+	//The exit of a process that is killed is not reported
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("TEST:Failed to start process %s", err)
+	}
+	defer cmd.Wait() // nolint
+	p.activeProcesses.AddOrUpdate(contextID, &processInfo{contextID: contextID, process: cmd.Process, RPCHdl: rpchdl})
+	rpchdl.MockRemoteCall(t, func(passed_contextID string, methodName string, req *rpcwrapper.Request, resp *rpcwrapper.Response) error {
+		p.processExited(ExitStatus{process: cmd.Process.Pid, contextID: contextID})
+		return nil
+	})
+	p.KillProcess(contextID)
+	select {
+	case id := <-exited:
+		t.Errorf("TEST:Exit handler called for killed process %s", id)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
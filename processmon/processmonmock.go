@@ -8,11 +8,12 @@ import (
 )
 
 type mockedMethods struct {
-	GetExitStatusMock func(string) bool
-	KillProcessMock   func(string)
-	LaunchProcessMock func(string, int, string, rpcwrapper.RPCClient, string, string, string) error
-	SetExitStatusMock func(string, bool) error
-	SetnsNetPathMock  func(string)
+	GetExitStatusMock  func(string) bool
+	KillProcessMock    func(string)
+	LaunchProcessMock  func(string, int, string, rpcwrapper.RPCClient, string, string, string) error
+	SetExitStatusMock  func(string, bool) error
+	SetnsNetPathMock   func(string)
+	SetExitHandlerMock func(ExitHandler)
 }
 
 // TestProcessManager is a mock process manager
@@ -23,6 +24,7 @@ type TestProcessManager interface {
 	MockLaunchProcess(t *testing.T, impl func(string, int, string, rpcwrapper.RPCClient, string, string, string) error)
 	MockSetExitStatus(t *testing.T, impl func(string, bool) error)
 	MockSetnsNetPath(t *testing.T, impl func(string))
+	MockSetExitHandler(t *testing.T, impl func(ExitHandler))
 }
 
 type testProcessMon struct {
@@ -57,6 +59,9 @@ func (m *testProcessMon) currentMocks(t *testing.T) *mockedMethods {
 func (m *testProcessMon) MockSetnsNetPath(t *testing.T, impl func(string)) {
 	m.currentMocks(t).SetnsNetPathMock = impl
 }
+func (m *testProcessMon) MockSetExitHandler(t *testing.T, impl func(ExitHandler)) {
+	m.currentMocks(t).SetExitHandlerMock = impl
+}
 func (m *testProcessMon) MockGetExitStatus(t *testing.T, impl func(string) bool) {
 	m.currentMocks(t).GetExitStatusMock = impl
 }
@@ -104,3 +109,9 @@ func (m *testProcessMon) LaunchProcess(contextID string, refPid int, refNSPath s
 	}
 	return nil
 }
+func (m *testProcessMon) SetExitHandler(handler ExitHandler) {
+	if mock := m.currentMocks(m.currentTest); mock != nil && mock.SetExitHandlerMock != nil {
+		mock.SetExitHandlerMock(handler)
+		return
+	}
+}
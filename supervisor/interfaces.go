@@ -42,3 +42,17 @@ type Implementor interface {
 	// Stop cleans up state
 	Stop() error
 }
+
+// A RuleVerifier is an implementation that can read back the installed rules
+// of a processing unit. The supervisor uses it to detect and repair drift.
+type RuleVerifier interface {
+
+	// VerifyRules returns a description of the rules of the processing unit
+	// that are not installed as expected
+	VerifyRules(version int, contextID string, containerInfo *policy.PUInfo) ([]string, error)
+
+	// RepairGlobalRules reinstalls the rules shared by all the processing
+	// units if they are not installed as expected. It returns the drift that
+	// was repaired.
+	RepairGlobalRules() ([]string, error)
+}
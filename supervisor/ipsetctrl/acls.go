@@ -2,9 +2,11 @@ package ipsetctrl
 
 import (
 	"fmt"
+	"strconv"
 
 	"go.uber.org/zap"
 
+	"github.com/aporeto-inc/trireme/constants"
 	"github.com/aporeto-inc/trireme/policy"
 	"github.com/bvandewalle/go-ipset/ipset"
 )
@@ -16,25 +18,34 @@ const (
 	rejectPrefix   = "R-"
 )
 
-// createACLSets creates the sets for a given PU
-func (i *Instance) createACLSets(version string, set string, rules policy.IPRuleList) error {
+// createACLSets creates the sets for a given PU. If audit is set, the rejected
+// addresses are left out of the sets, so that their flows reach the datapath
+// which reports them.
+func (i *Instance) createACLSets(version string, set string, rules policy.IPRuleList, audit bool) error {
 
-	allowSet, err := i.ips.NewIpset(set+allowPrefix+version, "hash:net,port", &ipset.Params{})
+	allowSet, err := i.ips.NewIpset(set+allowPrefix+version, "hash:net,port", &ipset.Params{HashFamily: i.ipsetFamily()})
 	if err != nil {
 		return fmt.Errorf("Couldn't create IPSet for Trireme: %s", err.Error())
 	}
 
-	rejectSet, err := i.ips.NewIpset(set+rejectPrefix+version, "hash:net,port", &ipset.Params{})
+	rejectSet, err := i.ips.NewIpset(set+rejectPrefix+version, "hash:net,port", &ipset.Params{HashFamily: i.ipsetFamily()})
 	if err != nil {
 		return fmt.Errorf("Couldn't create IPSet for Trireme: %s", err.Error())
 	}
 
 	for _, rule := range rules {
+		if !i.matchesFamily(rule.Address) {
+			continue
+		}
+
 		var err error
 		switch rule.Policy.Action {
 		case policy.Accept:
 			err = allowSet.Add(rule.Address+","+rule.Port, 0)
 		case policy.Reject:
+			if audit {
+				continue
+			}
 			err = rejectSet.Add(rule.Address+","+rule.Port, 0)
 		default:
 			continue
@@ -185,7 +196,7 @@ func (i *Instance) deleteNetSetRules(version, setPrefix, ip string) error {
 //deleteSet deletes the ipset
 func (i *Instance) deleteSet(set string) error {
 
-	ipSet, err := i.ips.NewIpset(set, "hash:net,port", &ipset.Params{})
+	ipSet, err := i.ips.NewIpset(set, "hash:net,port", &ipset.Params{HashFamily: i.ipsetFamily()})
 	if err != nil {
 		return fmt.Errorf("Couldn't create IPSet for Trireme: %s", err)
 	}
@@ -196,14 +207,14 @@ func (i *Instance) deleteSet(set string) error {
 // setupIpset sets up an ipset
 func (i *Instance) setupIpset(target, container string) error {
 
-	ips, err := i.ips.NewIpset(target, "hash:net", &ipset.Params{})
+	ips, err := i.ips.NewIpset(target, "hash:net", &ipset.Params{HashFamily: i.ipsetFamily()})
 	if err != nil {
 		return fmt.Errorf("Couldn't create IPSet for %s: %s", target, err)
 	}
 
 	i.targetSet = ips
 
-	cSet, err := i.ips.NewIpset(container, "hash:ip", &ipset.Params{})
+	cSet, err := i.ips.NewIpset(container, "hash:ip", &ipset.Params{HashFamily: i.ipsetFamily()})
 	if err != nil {
 		return fmt.Errorf("Failed to create container set: %s", err)
 	}
@@ -221,6 +232,10 @@ func (i *Instance) addTargetNets(networks []string) error {
 	}
 
 	for _, net := range networks {
+		if !i.matchesFamily(net) {
+			continue
+		}
+
 		if err := i.targetSet.Add(net, 0); err != nil {
 			return fmt.Errorf("Error adding ip %s to target networks IPSet: %s", net, err)
 		}
@@ -279,7 +294,7 @@ func (i *Instance) setupTrapRules(set string) error {
 		{
 			i.appPacketIPTableContext, i.appPacketIPTableSection,
 			"-m", "set", "--match-set", set, "dst",
-			"-m", "set", "--match-set", containerSet, "src",
+			"-m", "set", "--match-set", i.containerSetName, "src",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueSynStr(),
 		},
@@ -287,23 +302,40 @@ func (i *Instance) setupTrapRules(set string) error {
 		{
 			i.appAckPacketIPTableContext, i.appPacketIPTableSection,
 			"-m", "set", "--match-set", set, "dst",
-			"-m", "set", "--match-set", containerSet, "src",
+			"-m", "set", "--match-set", i.containerSetName, "src",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN",
 			"-j", "ACCEPT",
 		},
 		// Application Matching Trireme SRC and DST. everything but SYN, first 4 packets
 		{
 			i.appAckPacketIPTableContext, i.appPacketIPTableSection,
-			"-m", "set", "--match-set", containerSet, "src",
+			"-m", "set", "--match-set", i.containerSetName, "src",
 			"-m", "set", "--match-set", set, "dst",
 			"-p", "tcp",
 			"-m", "connbytes", "--connbytes", ":3", "--connbytes-dir", "original", "--connbytes-mode", "packets",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueAckStr(),
 		},
+		// Application data packets of encrypted connections
+		{
+			i.appAckPacketIPTableContext, i.appPacketIPTableSection,
+			"-m", "set", "--match-set", i.containerSetName, "src",
+			"-p", "tcp",
+			"-m", "connmark", "--mark", strconv.Itoa(int(constants.EncryptedConnMark)),
+			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueAckStr(),
+		},
+		// Application UDP packets until the flow is authorized
+		{
+			i.appAckPacketIPTableContext, i.appPacketIPTableSection,
+			"-m", "set", "--match-set", i.containerSetName, "src",
+			"-m", "set", "--match-set", set, "dst",
+			"-p", "udp",
+			"-m", "connmark", "!", "--mark", strconv.Itoa(int(constants.DefaultConnMark)),
+			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueAckStr(),
+		},
 		// Default Drop from Trireme to Network
 		{
 			i.appAckPacketIPTableContext, i.appPacketIPTableSection,
-			"-m", "set", "--match-set", containerSet, "src",
+			"-m", "set", "--match-set", i.containerSetName, "src",
 			"-p", "tcp", "-m", "state", "--state", "NEW",
 			"-j", "DROP",
 		},
@@ -312,7 +344,7 @@ func (i *Instance) setupTrapRules(set string) error {
 		{
 			i.netPacketIPTableContext, i.netPacketIPTableSection,
 			"-m", "set", "--match-set", set, "src",
-			"-m", "set", "--match-set", containerSet, "dst",
+			"-m", "set", "--match-set", i.containerSetName, "dst",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueSynStr(),
 		},
@@ -320,21 +352,43 @@ func (i *Instance) setupTrapRules(set string) error {
 		{
 			i.netPacketIPTableContext, i.netPacketIPTableSection,
 			"-m", "set", "--match-set", set, "src",
-			"-m", "set", "--match-set", containerSet, "dst",
+			"-m", "set", "--match-set", i.containerSetName, "dst",
 			"-p", "tcp",
 			"-m", "connbytes", "--connbytes", ":3", "--connbytes-dir", "original", "--connbytes-mode", "packets",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueAckStr(),
 		},
+		// Network data packets of encrypted connections
+		{
+			i.netPacketIPTableContext, i.netPacketIPTableSection,
+			"-m", "set", "--match-set", i.containerSetName, "dst",
+			"-p", "tcp",
+			"-m", "connmark", "--mark", strconv.Itoa(int(constants.EncryptedConnMark)),
+			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueAckStr(),
+		},
+		// Network UDP packets until the flow is authorized
+		{
+			i.netPacketIPTableContext, i.netPacketIPTableSection,
+			"-m", "set", "--match-set", set, "src",
+			"-m", "set", "--match-set", i.containerSetName, "dst",
+			"-p", "udp",
+			"-m", "connmark", "!", "--mark", strconv.Itoa(int(constants.DefaultConnMark)),
+			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueAckStr(),
+		},
 		// Default Drop from Network to Trireme.
 		{
 			i.netPacketIPTableContext, i.netPacketIPTableSection,
-			"-m", "set", "--match-set", containerSet, "dst",
+			"-m", "set", "--match-set", i.containerSetName, "dst",
 			"-p", "tcp", "-m", "state", "--state", "NEW",
 			"-j", "DROP",
 		},
 	}
 
+	// The trap rules are shared by all the PUs, so only the failure policy of
+	// the enforcer applies
 	for _, tr := range rules {
+		if i.fqc.FailOpen {
+			tr = bypassQueue(tr)
+		}
 		if err := i.ipt.Append(tr[0], tr[1], tr[2:]...); err != nil {
 			return fmt.Errorf("Failed to add initial rules for TriremeNet IPSet: %s", err)
 		}
@@ -343,6 +397,21 @@ func (i *Instance) setupTrapRules(set string) error {
 	return nil
 }
 
+// bypassQueue adds the bypass option to the NFQUEUE target of a rule, so that
+// the kernel accepts the packets when no enforcer is bound to the queues
+func bypassQueue(rule []string) []string {
+
+	bypassed := make([]string, 0, len(rule)+1)
+	for _, arg := range rule {
+		if arg == "--queue-balance" {
+			bypassed = append(bypassed, "--queue-bypass")
+		}
+		bypassed = append(bypassed, arg)
+	}
+
+	return bypassed
+}
+
 // cleanIPSets cleans all the ipsets
 func (i *Instance) cleanIPSets() error {
 
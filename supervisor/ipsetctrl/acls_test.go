@@ -59,7 +59,7 @@ func TestCreateACLSets(t *testing.T) {
 				},
 			}
 
-			err := i.createACLSets("0", "APP1-", rules)
+			err := i.createACLSets("0", "APP1-", rules, false)
 
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
@@ -72,7 +72,7 @@ func TestCreateACLSets(t *testing.T) {
 				return nil, fmt.Errorf("Error")
 			})
 
-			err := i.createACLSets("0", "APP1-", policy.IPRuleList{})
+			err := i.createACLSets("0", "APP1-", policy.IPRuleList{}, false)
 			Convey("I should get an error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -107,11 +107,46 @@ func TestCreateACLSets(t *testing.T) {
 				},
 			}
 
-			err := i.createACLSets("0", "APP1-", rules)
+			err := i.createACLSets("0", "APP1-", rules, false)
 			Convey("I should get an error", func() {
 				So(err, ShouldNotBeNil)
 			})
 		})
+
+		Convey("When I create the ACL sets of a monitored PU", func() {
+			added := map[string][]string{}
+			ipsets.MockNewIpset(t, func(name string, hasht string, p *ipset.Params) (provider.Ipset, error) {
+				testset := provider.NewTestIpset()
+				testset.MockAdd(t, func(entry string, timeout int) error {
+					added[name] = append(added[name], entry)
+					return nil
+				})
+				return testset, nil
+			})
+
+			rules := policy.IPRuleList{
+				policy.IPRule{
+					Address:  "192.30.253.0/24",
+					Port:     "80",
+					Protocol: "TCP",
+					Policy:   &policy.FlowPolicy{Action: policy.Reject},
+				},
+
+				policy.IPRule{
+					Address:  "192.30.253.0/24",
+					Port:     "443",
+					Protocol: "TCP",
+					Policy:   &policy.FlowPolicy{Action: policy.Accept},
+				},
+			}
+
+			err := i.createACLSets("0", "APP1-", rules, true)
+			Convey("The rejected addresses should be left to the datapath", func() {
+				So(err, ShouldBeNil)
+				So(added["APP1-A-0"], ShouldResemble, []string{"192.30.253.0/24,443"})
+				So(added["APP1-R-0"], ShouldBeEmpty)
+			})
+		})
 	})
 }
 
@@ -670,5 +705,26 @@ func TestSetupTrapRules(t *testing.T) {
 
 		})
 
+		Convey("When I add the trap rules of an enforcer that fails open", func() {
+			i.fqc.FailOpen = true
+			queued, bypassed := 0, 0
+			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+				if matchSpec("NFQUEUE", rulespec) {
+					queued++
+				}
+				if matchSpec("--queue-bypass", rulespec) {
+					bypassed++
+				}
+				return nil
+			})
+
+			err := i.setupTrapRules("set")
+			Convey("All the queues should be bypassed", func() {
+				So(err, ShouldBeNil)
+				So(queued, ShouldBeGreaterThan, 0)
+				So(bypassed, ShouldEqual, queued)
+			})
+		})
+
 	})
 }
@@ -3,6 +3,7 @@ package ipsetctrl
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"go.uber.org/zap"
 
@@ -13,8 +14,11 @@ import (
 )
 
 const (
-	triremeSet   = "TriremeSet"
-	containerSet = "ContainerSet"
+	triremeSet    = "TriremeSet"
+	containerSet  = "ContainerSet"
+	triremeSet6   = "TriremeSet6"
+	containerSet6 = "ContainerSet6"
+	ipv6SetPrefix = "6-"
 )
 
 // Instance  is the structure holding all information about a implementation
@@ -30,6 +34,12 @@ type Instance struct {
 	netPacketIPTableContext    string
 	netPacketIPTableSection    string
 	mode                       constants.ModeType
+	ipv6                       bool
+	ip6t                       provider.IptablesProvider
+	ipv6Instance               *Instance
+	triremeSetName             string
+	containerSetName           string
+	ipNamespace                string
 }
 
 // NewInstance creates a new iptables controller instance
@@ -43,13 +53,23 @@ func NewInstance(fqc *fqconfig.FilterQueue, remote bool, mode constants.ModeType
 	ips := provider.NewGoIPsetProvider()
 
 	i := &Instance{
-		fqc: fqc,
-		ipt: ipt,
-		ips: ips,
+		fqc:                        fqc,
+		ipt:                        ipt,
+		ips:                        ips,
 		appPacketIPTableContext:    "raw",
 		appAckPacketIPTableContext: "mangle",
 		netPacketIPTableContext:    "mangle",
-		mode: mode,
+		mode:                       mode,
+		triremeSetName:             triremeSet,
+		containerSetName:           containerSet,
+		ipNamespace:                policy.DefaultNamespace,
+	}
+
+	// The IPv6 rules are installed with the first PU that has an IPv6 address
+	if ip6t, err := provider.NewGoIP6TablesProvider(); err == nil {
+		i.ip6t = ip6t
+	} else {
+		zap.L().Info("IPv6 is not supported on this host", zap.Error(err))
 	}
 
 	if remote {
@@ -63,13 +83,74 @@ func NewInstance(fqc *fqconfig.FilterQueue, remote bool, mode constants.ModeType
 	return i, nil
 }
 
+// ipv6Controller returns the controller of the IPv6 rules. The controller
+// shares the configuration of the IPv4 controller but drives ip6tables and
+// inet6 sets. It is started the first time it is needed.
+func (i *Instance) ipv6Controller() (*Instance, error) {
+
+	if i.ipv6Instance != nil {
+		return i.ipv6Instance, nil
+	}
+
+	if i.ip6t == nil {
+		return nil, fmt.Errorf("IPv6 addresses require ip6tables")
+	}
+
+	v6 := *i
+
+	v6.ipt = i.ip6t
+	v6.ip6t = nil
+	v6.ipv6 = true
+	v6.targetSet = nil
+	v6.containerSet = nil
+	v6.triremeSetName = triremeSet6
+	v6.containerSetName = containerSet6
+	v6.ipNamespace = policy.DefaultNamespaceIPv6
+
+	if err := v6.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to start the IPv6 controller: %s", err)
+	}
+
+	i.ipv6Instance = &v6
+
+	return i.ipv6Instance, nil
+}
+
+// hasIPv6Address returns true if the address list has an IPv6 address
+func hasIPv6Address(addresslist map[string]string) bool {
+
+	ip, ok := addresslist[policy.DefaultNamespaceIPv6]
+
+	return ok && len(ip) > 0
+}
+
+// ipsetFamily returns the ipset family of the addresses of this controller
+func (i *Instance) ipsetFamily() string {
+
+	if i.ipv6 {
+		return "inet6"
+	}
+
+	return "inet"
+}
+
+// matchesFamily returns true if the address or network belongs to the
+// IP family of this controller
+func (i *Instance) matchesFamily(address string) bool {
+	return strings.Contains(address, ":") == i.ipv6
+}
+
 // DefaultIPAddress returns the default IP address for the processing unit
 func (i *Instance) defaultIP(addresslist map[string]string) (string, bool) {
 
-	if ip, ok := addresslist[policy.DefaultNamespace]; ok {
+	if ip, ok := addresslist[i.ipNamespace]; ok {
 		return ip, true
 	}
 
+	if i.ipv6 {
+		return "::/0", false
+	}
+
 	return "0.0.0.0/0", false
 }
 
@@ -77,6 +158,11 @@ func (i *Instance) defaultIP(addresslist map[string]string) (string, bool) {
 func (i *Instance) setPrefix(contextID string) (app, net string) {
 	app = appChainPrefix + contextID + "-"
 	net = netChainPrefix + contextID + "-"
+
+	if i.ipv6 {
+		return app + ipv6SetPrefix, net + ipv6SetPrefix
+	}
+
 	return app, net
 }
 
@@ -100,7 +186,7 @@ func (i *Instance) ConfigureRules(version int, contextID string, containerInfo *
 		return fmt.Errorf("No ip address found")
 	}
 
-	if err := i.addAllRules(version, appSetPrefix, netSetPrefix, policyrules.ApplicationACLs(), policyrules.NetworkACLs(), ipAddress); err != nil {
+	if err := i.addAllRules(version, appSetPrefix, netSetPrefix, policyrules.ApplicationACLs(), policyrules.NetworkACLs(), ipAddress, policyrules.TriremeAction() == policy.Monitor); err != nil {
 		return err
 	}
 
@@ -108,6 +194,15 @@ func (i *Instance) ConfigureRules(version int, contextID string, containerInfo *
 		return err
 	}
 
+	if !i.ipv6 && hasIPv6Address(policyrules.IPAddresses()) {
+		v6, err := i.ipv6Controller()
+		if err != nil {
+			return err
+		}
+
+		return v6.ConfigureRules(version, contextID, containerInfo)
+	}
+
 	return nil
 }
 
@@ -139,6 +234,11 @@ func (i *Instance) DeleteRules(version int, contextID string, ipAddresses policy
 			zap.L().Warn("Error while deleting rules", zap.Error(errvector[i]))
 		}
 	}
+
+	if i.ipv6Instance != nil && hasIPv6Address(ipAddresses) {
+		return i.ipv6Instance.DeleteRules(version, contextID, ipAddresses, port, mark, uid)
+	}
+
 	return nil
 
 }
@@ -154,7 +254,7 @@ func (i *Instance) UpdateRules(version int, contextID string, containerInfo *pol
 		return fmt.Errorf("No ip address found")
 	}
 
-	if err := i.addAllRules(version, appSetPrefix, netSetPrefix, policyrules.ApplicationACLs(), policyrules.NetworkACLs(), ipAddress); err != nil {
+	if err := i.addAllRules(version, appSetPrefix, netSetPrefix, policyrules.ApplicationACLs(), policyrules.NetworkACLs(), ipAddress, policyrules.TriremeAction() == policy.Monitor); err != nil {
 		return fmt.Errorf("Unable to add all rules: %s", err)
 	}
 
@@ -176,11 +276,20 @@ func (i *Instance) UpdateRules(version int, contextID string, containerInfo *pol
 		}
 	}
 
+	if !i.ipv6 && hasIPv6Address(policyrules.IPAddresses()) {
+		v6, err := i.ipv6Controller()
+		if err != nil {
+			return err
+		}
+
+		return v6.UpdateRules(version, contextID, containerInfo)
+	}
+
 	return nil
 
 }
 
-func (i *Instance) addAllRules(version int, appSetPrefix, netSetPrefix string, appACLs policy.IPRuleList, netACLs policy.IPRuleList, ip string) error {
+func (i *Instance) addAllRules(version int, appSetPrefix, netSetPrefix string, appACLs policy.IPRuleList, netACLs policy.IPRuleList, ip string, audit bool) error {
 
 	versionstring := strconv.Itoa(version)
 
@@ -188,11 +297,11 @@ func (i *Instance) addAllRules(version int, appSetPrefix, netSetPrefix string, a
 		return err
 	}
 
-	if err := i.createACLSets(versionstring, appSetPrefix, appACLs); err != nil {
+	if err := i.createACLSets(versionstring, appSetPrefix, appACLs, audit); err != nil {
 		return err
 	}
 
-	if err := i.createACLSets(versionstring, netSetPrefix, netACLs); err != nil {
+	if err := i.createACLSets(versionstring, netSetPrefix, netACLs, audit); err != nil {
 		return err
 	}
 
@@ -209,11 +318,11 @@ func (i *Instance) addAllRules(version int, appSetPrefix, netSetPrefix string, a
 // Start implements the start of the interface
 func (i *Instance) Start() error {
 
-	if err := i.setupIpset(triremeSet, containerSet); err != nil {
+	if err := i.setupIpset(i.triremeSetName, i.containerSetName); err != nil {
 		return err
 	}
 
-	if err := i.setupTrapRules(triremeSet); err != nil {
+	if err := i.setupTrapRules(i.triremeSetName); err != nil {
 		return err
 	}
 	return nil
@@ -222,6 +331,12 @@ func (i *Instance) Start() error {
 // Stop implements the stop interface
 func (i *Instance) Stop() error {
 
+	if i.ipv6Instance != nil {
+		if err := i.ipv6Instance.Stop(); err != nil {
+			zap.L().Warn("Error while cleaning IPv6 ACL rules", zap.Error(err))
+		}
+	}
+
 	return i.cleanACLs()
 }
 
@@ -127,8 +127,9 @@ func (i *Instance) chainRules(appChain string, netChain string, ip string) [][]s
 
 }
 
-//trapRules provides the packet trap rules to add/delete
-func (i *Instance) trapRules(appChain string, netChain string) [][]string {
+//trapRules provides the packet trap rules to add/delete. If failOpen is set, the
+//packets are accepted while no enforcer is bound to the queues.
+func (i *Instance) trapRules(appChain string, netChain string, failOpen bool) [][]string {
 
 	rules := [][]string{}
 
@@ -136,14 +137,14 @@ func (i *Instance) trapRules(appChain string, netChain string) [][]string {
 		// Application Packets - SYN
 		rules = append(rules, []string{
 			i.appPacketIPTableContext, appChain,
-			"-m", "set", "--match-set", targetNetworkSet, "dst",
+			"-m", "set", "--match-set", i.targetNetworkSet, "dst",
 			"-p", "tcp", "--tcp-flags", "FIN,SYN,RST,PSH,URG", "SYN",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueSynStr(),
 		})
 		// Application Packets - Evertyhing but SYN (first 4 packets)
 		rules = append(rules, []string{
 			i.appAckPacketIPTableContext, appChain,
-			"-m", "set", "--match-set", targetNetworkSet, "dst",
+			"-m", "set", "--match-set", i.targetNetworkSet, "dst",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK", "ACK",
 			"-m", "connbytes", "--connbytes", ":3", "--connbytes-dir", "original", "--connbytes-mode", "packets",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueAckStr(),
@@ -152,14 +153,14 @@ func (i *Instance) trapRules(appChain string, netChain string) [][]string {
 		// Network Packets - SYN
 		rules = append(rules, []string{
 			i.netPacketIPTableContext, netChain,
-			"-m", "set", "--match-set", targetNetworkSet, "src",
+			"-m", "set", "--match-set", i.targetNetworkSet, "src",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueSynStr(),
 		})
 		// // Network Packets - Evertyhing but SYN (first 4 packets)
 		rules = append(rules, []string{
 			i.netPacketIPTableContext, netChain,
-			"-m", "set", "--match-set", targetNetworkSet, "src",
+			"-m", "set", "--match-set", i.targetNetworkSet, "src",
 			"-p", "tcp",
 			"-m", "connbytes", "--connbytes", ":3", "--connbytes-dir", "original", "--connbytes-mode", "packets",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueAckStr(),
@@ -169,41 +170,91 @@ func (i *Instance) trapRules(appChain string, netChain string) [][]string {
 		// Application Packets - SYN
 		rules = append(rules, []string{
 			i.appAckPacketIPTableContext, appChain,
-			"-m", "set", "--match-set", targetNetworkSet, "dst",
+			"-m", "set", "--match-set", i.targetNetworkSet, "dst",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueSynStr(),
 		})
 		rules = append(rules, []string{
 			i.appAckPacketIPTableContext, appChain,
-			"-m", "set", "--match-set", targetNetworkSet, "dst",
+			"-m", "set", "--match-set", i.targetNetworkSet, "dst",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN,ACK",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueSynStr(),
 		})
 		// Application Packets - Evertyhing but SYN and SYN,ACK (first 4 packets). SYN,ACK is captured by global rule
 		rules = append(rules, []string{
 			i.appAckPacketIPTableContext, appChain,
-			"-m", "set", "--match-set", targetNetworkSet, "dst",
+			"-m", "set", "--match-set", i.targetNetworkSet, "dst",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK", "ACK",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueAckStr(),
 		})
 		// Network Packets - SYN
 		rules = append(rules, []string{
 			i.netPacketIPTableContext, netChain,
-			"-m", "set", "--match-set", targetNetworkSet, "src",
+			"-m", "set", "--match-set", i.targetNetworkSet, "src",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueSynStr(),
 		})
 		// Network Packets - Evertyhing but SYN and SYN,ACK (first 4 packets). SYN,ACK is captured by global rule
 		rules = append(rules, []string{
 			i.netPacketIPTableContext, netChain,
-			"-m", "set", "--match-set", targetNetworkSet, "src",
+			"-m", "set", "--match-set", i.targetNetworkSet, "src",
 			"-p", "tcp", "--tcp-flags", "SYN,ACK,PSH", "ACK",
 			"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueAckStr(),
 		})
 	}
+
+	// UDP packets are processed until the flow is authorized and the connection is marked
+	rules = append(rules, []string{
+		i.appAckPacketIPTableContext, appChain,
+		"-m", "set", "--match-set", i.targetNetworkSet, "dst",
+		"-p", "udp",
+		"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueAckStr(),
+	})
+	rules = append(rules, []string{
+		i.netPacketIPTableContext, netChain,
+		"-m", "set", "--match-set", i.targetNetworkSet, "src",
+		"-p", "udp",
+		"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueAckStr(),
+	})
+
+	// Data packets of encrypted connections must always be processed
+	rules = append(rules, []string{
+		i.appAckPacketIPTableContext, appChain,
+		"-p", "tcp",
+		"-m", "connmark", "--mark", strconv.Itoa(int(constants.EncryptedConnMark)),
+		"-j", "NFQUEUE", "--queue-balance", i.fqc.GetApplicationQueueAckStr(),
+	})
+	rules = append(rules, []string{
+		i.netPacketIPTableContext, netChain,
+		"-p", "tcp",
+		"-m", "connmark", "--mark", strconv.Itoa(int(constants.EncryptedConnMark)),
+		"-j", "NFQUEUE", "--queue-balance", i.fqc.GetNetworkQueueAckStr(),
+	})
+
+	if failOpen {
+		for r := range rules {
+			rules[r] = bypassQueue(rules[r])
+		}
+	}
+
 	return rules
 }
 
+// bypassQueue adds the bypass option to the NFQUEUE target of a rule, so that
+// the kernel accepts the packets when no enforcer is bound to the queues
+func bypassQueue(rule []string) []string {
+
+	bypassed := make([]string, 0, len(rule)+1)
+	for _, arg := range rule {
+		if arg == "--queue-balance" {
+			bypassed = append(bypassed, "--queue-bypass")
+		}
+		bypassed = append(bypassed, arg)
+	}
+
+	return bypassed
+}
+
 // addContainerChain adds a chain for the specific container and redirects traffic there
 // This simplifies significantly the management and makes the iptable rules more readable
 // All rules related to a container are contained within the dedicated chain
@@ -264,18 +315,23 @@ func (i *Instance) addChainRules(appChain string, netChain string, ip string, po
 }
 
 // addPacketTrap adds the necessary iptables rules to capture control packets to user space
-func (i *Instance) addPacketTrap(appChain string, netChain string, ip string, networks []string) error {
+func (i *Instance) addPacketTrap(appChain string, netChain string, ip string, networks []string, failOpen bool) error {
 
-	return i.processRulesFromList(i.trapRules(appChain, netChain), "Append")
+	return i.processRulesFromList(i.trapRules(appChain, netChain, failOpen), "Append")
 
 }
 
 // addAppACLs adds a set of rules to the external services that are initiated
-// by an application. The allow rules are inserted with highest priority.
-func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleList) error {
+// by an application. The allow rules are inserted with highest priority. If
+// audit is set, the packets are logged and returned instead of dropped.
+func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleList, audit bool) error {
 
 	for _, rule := range rules {
 
+		if !i.matchesFamily(rule.Address) {
+			continue
+		}
+
 		proto := strings.ToLower(rule.Protocol)
 
 		if proto == "udp" || proto == "tcp" {
@@ -314,12 +370,12 @@ func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleLi
 					"-p", rule.Protocol, "-m", "state", "--state", "NEW",
 					"-d", rule.Address,
 					"--dport", rule.Port,
-					"-j", "DROP",
+					"-j", rejectTarget(audit),
 				); err != nil {
 					return fmt.Errorf("Failed to add acl rule for table %s, chain %s, with %s", i.appAckPacketIPTableContext, chain, err.Error())
 				}
 
-				if rule.Policy.Action&policy.Log > 0 {
+				if rule.Policy.Action&policy.Log > 0 || audit {
 					if err := i.ipt.Insert(
 						i.appAckPacketIPTableContext,
 						chain,
@@ -329,7 +385,7 @@ func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleLi
 						"--dport", rule.Port,
 						"-m", "state", "--state", "NEW",
 						"-j", "NFLOG", "--nflog-group", "10",
-						"--nflog-prefix", contextID+":"+rule.Policy.PolicyID+":"+rule.Policy.ServiceID+rule.Policy.Action.ShortActionString(),
+						"--nflog-prefix", contextID+":"+rule.Policy.PolicyID+":"+rule.Policy.ServiceID+rejectAction(rule.Policy.Action, audit).ShortActionString(),
 					); err != nil {
 						return fmt.Errorf("Failed to add acl log rule for table %s, chain %s, with %s", i.appAckPacketIPTableContext, chain, err.Error())
 					}
@@ -372,12 +428,12 @@ func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleLi
 					i.appAckPacketIPTableContext, chain, 1,
 					"-p", rule.Protocol,
 					"-d", rule.Address,
-					"-j", "DROP",
+					"-j", rejectTarget(audit),
 				); err != nil {
 					return fmt.Errorf("Failed to add acl rule for table %s, chain %s, with error: %s", i.appAckPacketIPTableContext, chain, err.Error())
 				}
 
-				if rule.Policy.Action&policy.Log > 0 {
+				if rule.Policy.Action&policy.Log > 0 || audit {
 					if err := i.ipt.Insert(
 						i.appAckPacketIPTableContext,
 						chain,
@@ -386,7 +442,7 @@ func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleLi
 						"-d", rule.Address,
 						"-m", "state", "--state", "NEW",
 						"-j", "NFLOG", "--nflog-group", "10",
-						"--nflog-prefix", contextID+":"+rule.Policy.PolicyID+":"+rule.Policy.ServiceID+rule.Policy.Action.ShortActionString(),
+						"--nflog-prefix", contextID+":"+rule.Policy.PolicyID+":"+rule.Policy.ServiceID+rejectAction(rule.Policy.Action, audit).ShortActionString(),
 					); err != nil {
 						return fmt.Errorf("Failed to add acl log rule for table %s, chain %s, with %s", i.appAckPacketIPTableContext, chain, err.Error())
 					}
@@ -401,7 +457,7 @@ func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleLi
 	// Accept established connections
 	if err := i.ipt.Append(
 		i.appAckPacketIPTableContext, chain,
-		"-d", "0.0.0.0/0",
+		"-d", i.anyNetwork,
 		"-p", "udp", "-m", "state", "--state", "ESTABLISHED",
 		"-j", "ACCEPT"); err != nil {
 
@@ -410,21 +466,32 @@ func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleLi
 
 	if err := i.ipt.Append(
 		i.appAckPacketIPTableContext, chain,
-		"-d", "0.0.0.0/0",
+		"-d", i.anyNetwork,
 		"-p", "tcp", "-m", "state", "--state", "ESTABLISHED",
 		"-j", "ACCEPT"); err != nil {
 
 		return fmt.Errorf("Failed to add default tcp acl rule for table %s, chain %s, with error: %s", i.appAckPacketIPTableContext, chain, err.Error())
 	}
 
+	// IPv6 depends on ICMPv6 for neighbor discovery
+	if i.ipv6 {
+		if err := i.ipt.Append(
+			i.appAckPacketIPTableContext, chain,
+			"-p", "icmpv6",
+			"-j", "ACCEPT"); err != nil {
+
+			return fmt.Errorf("Failed to add default icmpv6 acl rule for table %s, chain %s, with error: %s", i.appAckPacketIPTableContext, chain, err.Error())
+		}
+	}
+
 	// Log everything else
 	if err := i.ipt.Append(
 		i.appAckPacketIPTableContext,
 		chain,
-		"-d", "0.0.0.0/0",
+		"-d", i.anyNetwork,
 		"-m", "state", "--state", "NEW",
 		"-j", "NFLOG", "--nflog-group", "10",
-		"--nflog-prefix", contextID+":default:defaultr",
+		"--nflog-prefix", contextID+":default:default"+rejectAction(policy.Reject, audit).ShortActionString(),
 	); err != nil {
 		return fmt.Errorf("Failed to add acl log rule for table %s, chain %s, with %s", i.appAckPacketIPTableContext, chain, err.Error())
 	}
@@ -432,8 +499,8 @@ func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleLi
 	// Drop everything else
 	if err := i.ipt.Append(
 		i.appAckPacketIPTableContext, chain,
-		"-d", "0.0.0.0/0",
-		"-j", "DROP"); err != nil {
+		"-d", i.anyNetwork,
+		"-j", rejectTarget(audit)); err != nil {
 
 		return fmt.Errorf("Failed to add default drop acl rule for table %s, chain %s, with error: %s", i.appAckPacketIPTableContext, chain, err.Error())
 	}
@@ -443,10 +510,15 @@ func (i *Instance) addAppACLs(contextID, chain, ip string, rules policy.IPRuleLi
 
 // addNetACLs adds iptables rules that manage traffic from external services. The
 // explicit rules are added with the highest priority since they are direct allows.
-func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleList) error {
+// If audit is set, the packets are logged and returned instead of dropped.
+func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleList, audit bool) error {
 
 	for _, rule := range rules {
 
+		if !i.matchesFamily(rule.Address) {
+			continue
+		}
+
 		proto := strings.ToLower(rule.Protocol)
 
 		if proto == "udp" || proto == "tcp" {
@@ -485,13 +557,13 @@ func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleLi
 					"-p", rule.Protocol,
 					"-s", rule.Address,
 					"--dport", rule.Port,
-					"-j", "DROP",
+					"-j", rejectTarget(audit),
 				); err != nil {
 
 					return fmt.Errorf("Failed to add net acl rule for table %s, chain %s, with error: %s", i.netPacketIPTableContext, chain, err.Error())
 				}
 
-				if rule.Policy.Action&policy.Log > 0 {
+				if rule.Policy.Action&policy.Log > 0 || audit {
 					if err := i.ipt.Insert(
 						i.netPacketIPTableContext,
 						chain,
@@ -501,7 +573,7 @@ func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleLi
 						"--dport", rule.Port,
 						"-m", "state", "--state", "NEW",
 						"-j", "NFLOG", "--nflog-group", "11",
-						"--nflog-prefix", contextID+":"+rule.Policy.PolicyID+":"+rule.Policy.ServiceID+rule.Policy.Action.ShortActionString(),
+						"--nflog-prefix", contextID+":"+rule.Policy.PolicyID+":"+rule.Policy.ServiceID+rejectAction(rule.Policy.Action, audit).ShortActionString(),
 					); err != nil {
 						return fmt.Errorf("Failed to add net log rule for table %s, chain %s, with %s", i.netPacketIPTableContext, chain, err.Error())
 					}
@@ -543,13 +615,13 @@ func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleLi
 					i.netPacketIPTableContext, chain, 1,
 					"-p", rule.Protocol,
 					"-s", rule.Address,
-					"-j", "DROP",
+					"-j", rejectTarget(audit),
 				); err != nil {
 
 					return fmt.Errorf("Failed to add net acl rule for table %s, chain %s, with error: %s", i.netPacketIPTableContext, chain, err.Error())
 				}
 
-				if rule.Policy.Action&policy.Log > 0 {
+				if rule.Policy.Action&policy.Log > 0 || audit {
 					if err := i.ipt.Insert(
 						i.netPacketIPTableContext,
 						chain,
@@ -558,7 +630,7 @@ func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleLi
 						"-s", rule.Address,
 						"-m", "state", "--state", "NEW",
 						"-j", "NFLOG", "--nflog-group", "11",
-						"--nflog-prefix", contextID+":"+rule.Policy.PolicyID+":"+rule.Policy.ServiceID+rule.Policy.Action.ShortActionString(),
+						"--nflog-prefix", contextID+":"+rule.Policy.PolicyID+":"+rule.Policy.ServiceID+rejectAction(rule.Policy.Action, audit).ShortActionString(),
 					); err != nil {
 						return fmt.Errorf("Failed to add net log rule for table %s, chain %s, with %s", i.netPacketIPTableContext, chain, err.Error())
 					}
@@ -572,7 +644,7 @@ func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleLi
 	// Accept established connections
 	if err := i.ipt.Append(
 		i.netPacketIPTableContext, chain,
-		"-s", "0.0.0.0/0",
+		"-s", i.anyNetwork,
 		"-p", "tcp", "-m", "state", "--state", "ESTABLISHED",
 		"-j", "ACCEPT",
 	); err != nil {
@@ -582,7 +654,7 @@ func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleLi
 
 	if err := i.ipt.Append(
 		i.netPacketIPTableContext, chain,
-		"-s", "0.0.0.0/0",
+		"-s", i.anyNetwork,
 		"-p", "udp", "-m", "state", "--state", "ESTABLISHED",
 		"-j", "ACCEPT",
 	); err != nil {
@@ -590,14 +662,26 @@ func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleLi
 		return fmt.Errorf("Failed to add net acl rule for table %s, chain %s, with error: %s", i.netPacketIPTableContext, chain, err.Error())
 	}
 
+	// IPv6 depends on ICMPv6 for neighbor discovery
+	if i.ipv6 {
+		if err := i.ipt.Append(
+			i.netPacketIPTableContext, chain,
+			"-p", "icmpv6",
+			"-j", "ACCEPT",
+		); err != nil {
+
+			return fmt.Errorf("Failed to add net acl rule for table %s, chain %s, with error: %s", i.netPacketIPTableContext, chain, err.Error())
+		}
+	}
+
 	// Log everything
 	if err := i.ipt.Append(
 		i.netPacketIPTableContext,
 		chain,
-		"-s", "0.0.0.0/0",
+		"-s", i.anyNetwork,
 		"-m", "state", "--state", "NEW",
 		"-j", "NFLOG", "--nflog-group", "11",
-		"--nflog-prefix", contextID+":default:defaultr",
+		"--nflog-prefix", contextID+":default:default"+rejectAction(policy.Reject, audit).ShortActionString(),
 	); err != nil {
 		return fmt.Errorf("Failed to add net log rule for table %s, chain %s, with %s", i.netPacketIPTableContext, chain, err.Error())
 	}
@@ -605,8 +689,8 @@ func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleLi
 	// Drop everything else
 	if err := i.ipt.Append(
 		i.netPacketIPTableContext, chain,
-		"-s", "0.0.0.0/0",
-		"-j", "DROP",
+		"-s", i.anyNetwork,
+		"-j", rejectTarget(audit),
 	); err != nil {
 
 		return fmt.Errorf("Failed to add net acl rule for table %s, chain %s, with error: %s", i.netPacketIPTableContext, chain, err.Error())
@@ -615,6 +699,28 @@ func (i *Instance) addNetACLs(contextID, chain, ip string, rules policy.IPRuleLi
 	return nil
 }
 
+// rejectTarget returns the target of the rules that drop packets. The monitored
+// PUs log the packets and return them to the calling chain instead, so that
+// they go through the rest of the rules as if there was no ACL.
+func rejectTarget(audit bool) string {
+
+	if audit {
+		return "RETURN"
+	}
+
+	return "DROP"
+}
+
+// rejectAction returns the action logged by the rules that drop packets
+func rejectAction(action policy.ActionType, audit bool) policy.ActionType {
+
+	if audit {
+		return action | policy.Audit
+	}
+
+	return action
+}
+
 // deleteChainRules deletes the rules that send traffic to our chain
 func (i *Instance) deleteChainRules(appChain, netChain, ip string, port string, mark string, uid string) error {
 
@@ -632,20 +738,23 @@ func (i *Instance) deleteChainRules(appChain, netChain, ip string, port string,
 // deleteAllContainerChains removes all the container specific chains and basic rules
 func (i *Instance) deleteAllContainerChains(appChain, netChain string) error {
 
-	if err := i.ipt.ClearChain(i.appPacketIPTableContext, appChain); err != nil {
-		zap.L().Warn("Failed to clear the container specific chain",
-			zap.String("appChain", appChain),
-			zap.String("context", i.appPacketIPTableContext),
-			zap.Error(err),
-		)
-	}
+	// The app packet chain only exists for local containers
+	if i.mode == constants.LocalContainer {
+		if err := i.ipt.ClearChain(i.appPacketIPTableContext, appChain); err != nil {
+			zap.L().Warn("Failed to clear the container specific chain",
+				zap.String("appChain", appChain),
+				zap.String("context", i.appPacketIPTableContext),
+				zap.Error(err),
+			)
+		}
 
-	if err := i.ipt.DeleteChain(i.appPacketIPTableContext, appChain); err != nil {
-		zap.L().Warn("Failed to delete the container app packet chain",
-			zap.String("appChain", appChain),
-			zap.String("context", i.appPacketIPTableContext),
-			zap.Error(err),
-		)
+		if err := i.ipt.DeleteChain(i.appPacketIPTableContext, appChain); err != nil {
+			zap.L().Warn("Failed to delete the container app packet chain",
+				zap.String("appChain", appChain),
+				zap.String("context", i.appPacketIPTableContext),
+				zap.Error(err),
+			)
+		}
 	}
 
 	if err := i.ipt.ClearChain(i.appAckPacketIPTableContext, appChain); err != nil {
@@ -689,7 +798,7 @@ func (i *Instance) setGlobalRules(appChain, netChain string) error {
 	err := i.ipt.Insert(
 		i.appAckPacketIPTableContext,
 		appChain, 1,
-		"-m", "set", "--match-set", targetNetworkSet, "dst",
+		"-m", "set", "--match-set", i.targetNetworkSet, "dst",
 		"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN,ACK",
 		"-j", "NFQUEUE", "--queue-bypass", "--queue-balance", i.fqc.GetApplicationQueueSynAckStr())
 
@@ -700,7 +809,7 @@ func (i *Instance) setGlobalRules(appChain, netChain string) error {
 	err = i.ipt.Insert(
 		i.appAckPacketIPTableContext,
 		appChain, 1,
-		"-m", "set", "--match-set", targetNetworkSet, "dst",
+		"-m", "set", "--match-set", i.targetNetworkSet, "dst",
 		"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN,ACK",
 		"-j", "MARK", "--set-mark", strconv.Itoa(cgnetcls.Initialmarkval-1))
 	if err != nil {
@@ -710,7 +819,7 @@ func (i *Instance) setGlobalRules(appChain, netChain string) error {
 	err = i.ipt.Insert(
 		i.netPacketIPTableContext,
 		netChain, 1,
-		"-m", "set", "--match-set", targetNetworkSet, "src",
+		"-m", "set", "--match-set", i.targetNetworkSet, "src",
 		"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN,ACK",
 		"-j", "NFQUEUE", "--queue-bypass", "--queue-balance", i.fqc.GetNetworkQueueSynAckStr())
 
@@ -748,7 +857,7 @@ func (i *Instance) CleanGlobalRules() error {
 	if err := i.ipt.Delete(
 		i.appAckPacketIPTableContext,
 		i.appPacketIPTableSection,
-		"-m", "set", "--match-set", targetNetworkSet, "dst",
+		"-m", "set", "--match-set", i.targetNetworkSet, "dst",
 		"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN,ACK",
 		"-j", "NFQUEUE", "--queue-bypass", "--queue-balance", i.fqc.GetApplicationQueueAckStr()); err != nil {
 
@@ -758,7 +867,7 @@ func (i *Instance) CleanGlobalRules() error {
 	if err := i.ipt.Delete(
 		i.netPacketIPTableContext,
 		i.netPacketIPTableSection,
-		"-m", "set", "--match-set", targetNetworkSet, "src",
+		"-m", "set", "--match-set", i.targetNetworkSet, "src",
 		"-p", "tcp", "--tcp-flags", "SYN,ACK", "SYN,ACK",
 		"-j", "NFQUEUE", "--queue-bypass", "--queue-balance", i.fqc.GetNetworkQueueAckStr()); err != nil {
 
@@ -921,6 +1030,10 @@ func (i *Instance) addExclusionACLs(appChain, netChain string, ip string, exclus
 
 	for _, e := range exclusions {
 
+		if !i.matchesFamily(e) {
+			continue
+		}
+
 		if err := i.ipt.Insert(
 			i.appAckPacketIPTableContext, appChain, 1,
 			"-s", ip,
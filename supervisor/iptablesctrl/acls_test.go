@@ -216,7 +216,7 @@ func TestAddPacketTrap(t *testing.T) {
 			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
 				return nil
 			})
-			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"})
+			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"}, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -229,7 +229,7 @@ func TestAddPacketTrap(t *testing.T) {
 				}
 				return nil
 			})
-			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"})
+			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"}, false)
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -242,7 +242,7 @@ func TestAddPacketTrap(t *testing.T) {
 				}
 				return nil
 			})
-			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"})
+			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"}, false)
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -255,7 +255,7 @@ func TestAddPacketTrap(t *testing.T) {
 				}
 				return nil
 			})
-			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"})
+			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"}, false)
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -263,6 +263,30 @@ func TestAddPacketTrap(t *testing.T) {
 
 	})
 
+	Convey("Given an iptables controller, when I add the packet trap rules of a PU that fails open", t, func() {
+		i, _ := NewInstance(fqconfig.NewFilterQueueWithDefaults(), constants.LocalServer)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+
+		bypassed := 0
+		iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+			if err := matchSpec("--queue-bypass", rulespec); err == nil {
+				bypassed++
+			}
+			return nil
+		})
+
+		Convey("All the queues should be bypassed", func() {
+			So(i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"}, true), ShouldBeNil)
+			So(bypassed, ShouldEqual, len(i.trapRules("appchain", "netchain", false)))
+		})
+
+		Convey("No queue should be bypassed if it fails closed", func() {
+			So(i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"}, false), ShouldBeNil)
+			So(bypassed, ShouldEqual, 0)
+		})
+	})
+
 	Convey("Given an iptables controller, when I test addPacketTrap for Local Server", t, func() {
 		i, _ := NewInstance(fqconfig.NewFilterQueueWithDefaults(), constants.LocalServer)
 		iptables := provider.NewTestIptablesProvider()
@@ -272,7 +296,7 @@ func TestAddPacketTrap(t *testing.T) {
 			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
 				return nil
 			})
-			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"})
+			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"}, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -285,7 +309,7 @@ func TestAddPacketTrap(t *testing.T) {
 				}
 				return nil
 			})
-			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"})
+			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"}, false)
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -298,7 +322,7 @@ func TestAddPacketTrap(t *testing.T) {
 				}
 				return nil
 			})
-			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"})
+			err := i.addPacketTrap("appchain", "netchain", "172.17.0.1", []string{"172.17.0.0/24"}, false)
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -330,7 +354,7 @@ func TestAddAppACLs(t *testing.T) {
 				return fmt.Errorf("Error")
 			})
 
-			err := i.addAppACLs("", "chain", "", policy.IPRuleList{})
+			err := i.addAppACLs("", "chain", "", policy.IPRuleList{}, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -344,7 +368,7 @@ func TestAddAppACLs(t *testing.T) {
 				return nil
 			})
 
-			err := i.addAppACLs("", "chain", "", policy.IPRuleList{})
+			err := i.addAppACLs("", "chain", "", policy.IPRuleList{}, false)
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -380,7 +404,7 @@ func TestAddAppACLs(t *testing.T) {
 				}
 				return fmt.Errorf("error %s ", rulespec)
 			})
-			err := i.addAppACLs("chain", "", "", rules)
+			err := i.addAppACLs("chain", "", "", rules, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -413,7 +437,7 @@ func TestAddAppACLs(t *testing.T) {
 				}
 				return fmt.Errorf("error %s ", rulespec)
 			})
-			err := i.addAppACLs("chain", "", "", rules)
+			err := i.addAppACLs("chain", "", "", rules, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -446,12 +470,56 @@ func TestAddAppACLs(t *testing.T) {
 				}
 				return fmt.Errorf("error %s ", rulespec)
 			})
-			err := i.addAppACLs("chain", "", "", rules)
+			err := i.addAppACLs("chain", "", "", rules, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
 		})
 
+		Convey("When I add app ACLs of a monitored PU", func() {
+
+			rules := policy.IPRuleList{
+				policy.IPRule{
+					Address:  "192.30.253.0/24",
+					Port:     "80",
+					Protocol: "TCP",
+					Policy:   &policy.FlowPolicy{Action: policy.Reject, PolicyID: "p1"},
+				},
+			}
+
+			added := [][]string{}
+			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+				added = append(added, rulespec)
+				return nil
+			})
+			iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
+				added = append(added, rulespec)
+				return nil
+			})
+			err := i.addAppACLs("pu", "chain", "", rules, true)
+
+			Convey("The rejected packets should be logged and returned", func() {
+				So(err, ShouldBeNil)
+				for _, rule := range added {
+					So(matchSpec("DROP", rule), ShouldNotBeNil)
+				}
+				So(added, ShouldContain, []string{
+					"-p", "TCP", "-m", "state", "--state", "NEW",
+					"-d", "192.30.253.0/24", "--dport", "80",
+					"-j", "RETURN",
+				})
+				So(added, ShouldContain, []string{"-d", "0.0.0.0/0", "-j", "RETURN"})
+				So(added, ShouldContain, []string{
+					"-p", "TCP", "-d", "192.30.253.0/24", "--dport", "80",
+					"-m", "state", "--state", "NEW",
+					"-j", "NFLOG", "--nflog-group", "10", "--nflog-prefix", "pu:p1:u",
+				})
+				So(added, ShouldContain, []string{
+					"-d", "0.0.0.0/0", "-m", "state", "--state", "NEW",
+					"-j", "NFLOG", "--nflog-group", "10", "--nflog-prefix", "pu:default:defaultu",
+				})
+			})
+		})
 	})
 }
 
@@ -478,7 +546,7 @@ func TestAddNetAcls(t *testing.T) {
 				return fmt.Errorf("Error")
 			})
 
-			err := i.addNetACLs("", "chain", "", policy.IPRuleList{})
+			err := i.addNetACLs("", "chain", "", policy.IPRuleList{}, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -492,7 +560,7 @@ func TestAddNetAcls(t *testing.T) {
 				return nil
 			})
 
-			err := i.addNetACLs("", "chain", "", policy.IPRuleList{})
+			err := i.addNetACLs("", "chain", "", policy.IPRuleList{}, false)
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -531,7 +599,7 @@ func TestAddNetAcls(t *testing.T) {
 				}
 				return fmt.Errorf("error %s ", rulespec)
 			})
-			err := i.addNetACLs("chain", "", "", rules)
+			err := i.addNetACLs("chain", "", "", rules, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -567,7 +635,7 @@ func TestAddNetAcls(t *testing.T) {
 				}
 				return fmt.Errorf("error %s ", rulespec)
 			})
-			err := i.addNetACLs("chain", "", "", rules)
+			err := i.addNetACLs("chain", "", "", rules, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -603,7 +671,7 @@ func TestAddNetAcls(t *testing.T) {
 				}
 				return fmt.Errorf("error %s ", rulespec)
 			})
-			err := i.addNetACLs("chain", "", "", rules)
+			err := i.addNetACLs("chain", "", "", rules, false)
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
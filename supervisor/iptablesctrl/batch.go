@@ -0,0 +1,459 @@
+package iptablesctrl
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/supervisor/provider"
+)
+
+const (
+	newChainCommand    = "-N"
+	appendCommand      = "-A"
+	insertCommand      = "-I"
+	deleteCommand      = "-D"
+	clearChainCommand  = "-F"
+	deleteChainCommand = "-X"
+)
+
+// batchOperation is a change to the rules recorded by a batch
+type batchOperation struct {
+	table    string
+	command  string
+	chain    string
+	position int
+	rulespec []string
+}
+
+// String returns the operation in the iptables-save format
+func (o *batchOperation) String() string {
+
+	args := []string{o.command, quote(o.chain)}
+
+	if o.command == insertCommand {
+		args = append(args, strconv.Itoa(o.position))
+	}
+
+	for _, arg := range o.rulespec {
+		args = append(args, quote(arg))
+	}
+
+	return strings.Join(args, " ")
+}
+
+// apply applies the operation with the given provider
+func (o *batchOperation) apply(ipt provider.IptablesProvider) error {
+
+	switch o.command {
+	case newChainCommand:
+		return ipt.NewChain(o.table, o.chain)
+	case appendCommand:
+		return ipt.Append(o.table, o.chain, o.rulespec...)
+	case insertCommand:
+		return ipt.Insert(o.table, o.chain, o.position, o.rulespec...)
+	case deleteCommand:
+		return ipt.Delete(o.table, o.chain, o.rulespec...)
+	case clearChainCommand:
+		return ipt.ClearChain(o.table, o.chain)
+	case deleteChainCommand:
+		return ipt.DeleteChain(o.table, o.chain)
+	default:
+		return fmt.Errorf("Invalid command %s", o.command)
+	}
+}
+
+// quote quotes an argument for iptables-restore if needed
+func quote(arg string) string {
+
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\") {
+		return arg
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// splitRule splits a rule listed by iptables into its arguments. It reverts
+// the quoting of quote.
+func splitRule(rule string) []string {
+
+	args := []string{}
+
+	var arg strings.Builder
+	quoted, escaped, started := false, false, false
+
+	for _, c := range rule {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			started = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if started {
+				args = append(args, arg.String())
+				arg.Reset()
+				started = false
+			}
+		default:
+			arg.WriteRune(c)
+			started = true
+		}
+	}
+
+	if started {
+		args = append(args, arg.String())
+	}
+
+	return args
+}
+
+// chainSnapshot holds the rules of an existing chain before a batch is applied
+type chainSnapshot struct {
+	table string
+	chain string
+	rules [][]string
+}
+
+// batch is an IptablesProvider that records the changes to the rules instead
+// of applying them, so that they can be applied together. Chains and rules are
+// read with the underlying provider.
+type batch struct {
+	ipt        provider.IptablesProvider
+	operations []*batchOperation
+
+	// existing holds the chains that exist before the batch is applied
+	existing map[string]bool
+
+	// snapshots hold the rules of the existing chains that the batch removes
+	// rules from, so that they can be restored
+	snapshots []*chainSnapshot
+}
+
+// newBatch returns an empty batch on top of the given provider
+func newBatch(ipt provider.IptablesProvider) *batch {
+	return &batch{
+		ipt:        ipt,
+		operations: []*batchOperation{},
+	}
+}
+
+func (b *batch) record(o *batchOperation) error {
+	b.operations = append(b.operations, o)
+	return nil
+}
+
+// Append records the append of a rule
+func (b *batch) Append(table, chain string, rulespec ...string) error {
+	return b.record(&batchOperation{table: table, command: appendCommand, chain: chain, rulespec: rulespec})
+}
+
+// Insert records the insertion of a rule
+func (b *batch) Insert(table, chain string, pos int, rulespec ...string) error {
+	return b.record(&batchOperation{table: table, command: insertCommand, chain: chain, position: pos, rulespec: rulespec})
+}
+
+// Delete records the removal of a rule
+func (b *batch) Delete(table, chain string, rulespec ...string) error {
+	return b.record(&batchOperation{table: table, command: deleteCommand, chain: chain, rulespec: rulespec})
+}
+
+// Exists checks the rule with the underlying provider
+func (b *batch) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return b.ipt.Exists(table, chain, rulespec...)
+}
+
+// List lists the rules of the chain with the underlying provider
+func (b *batch) List(table, chain string) ([]string, error) {
+	return b.ipt.List(table, chain)
+}
+
+// ListChains lists the chains of the table with the underlying provider
+func (b *batch) ListChains(table string) ([]string, error) {
+	return b.ipt.ListChains(table)
+}
+
+// ClearChain records the flush of a chain
+func (b *batch) ClearChain(table, chain string) error {
+	return b.record(&batchOperation{table: table, command: clearChainCommand, chain: chain})
+}
+
+// DeleteChain records the removal of a chain
+func (b *batch) DeleteChain(table, chain string) error {
+	return b.record(&batchOperation{table: table, command: deleteChainCommand, chain: chain})
+}
+
+// NewChain records the creation of a chain
+func (b *batch) NewChain(table, chain string) error {
+	return b.record(&batchOperation{table: table, command: newChainCommand, chain: chain})
+}
+
+// tables returns the tables changed by the operations in the order they are
+// first changed
+func tables(operations []*batchOperation) []string {
+
+	seen := map[string]bool{}
+	list := []string{}
+
+	for _, o := range operations {
+		if !seen[o.table] {
+			seen[o.table] = true
+			list = append(list, o.table)
+		}
+	}
+
+	return list
+}
+
+// render returns the operations on a table in the iptables-save format. The
+// chains are declared before the rules that can refer to them. Only the chains
+// that do not exist are declared, since the declaration of an existing chain
+// flushes it.
+func render(table string, operations []*batchOperation, existing map[string]bool) []byte {
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "*%s\n", table)
+
+	for _, o := range operations {
+		if o.table == table && o.command == newChainCommand && !existing[o.table+"/"+o.chain] {
+			fmt.Fprintf(&buf, ":%s - [0:0]\n", o.chain)
+		}
+	}
+
+	for _, o := range operations {
+		if o.table == table && o.command != newChainCommand {
+			fmt.Fprintf(&buf, "%s\n", o)
+		}
+	}
+
+	buf.WriteString("COMMIT\n")
+
+	return buf.Bytes()
+}
+
+// listChains returns the chains of the given tables that exist
+func listChains(ipt provider.IptablesProvider, tables []string) (map[string]bool, error) {
+
+	existing := map[string]bool{}
+
+	for _, table := range tables {
+
+		chains, err := ipt.ListChains(table)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list the chains of table %s: %s", table, err)
+		}
+
+		for _, chain := range chains {
+			existing[table+"/"+chain] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// prepare records the chains that exist and the rules of the existing chains
+// that the batch removes rules from. If they cannot be read, the batch must not
+// be applied since it could not be reverted.
+func (b *batch) prepare() error {
+
+	existing, err := listChains(b.ipt, tables(b.operations))
+	if err != nil {
+		return err
+	}
+
+	b.existing = existing
+	b.snapshots = []*chainSnapshot{}
+
+	created := map[string]bool{}
+	seen := map[string]bool{}
+
+	for _, o := range b.operations {
+
+		key := o.table + "/" + o.chain
+
+		switch o.command {
+		case newChainCommand:
+			if !existing[key] {
+				created[key] = true
+			}
+			continue
+		case deleteCommand, clearChainCommand, deleteChainCommand:
+		default:
+			continue
+		}
+
+		if created[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		rules, err := b.ipt.List(o.table, o.chain)
+		if err != nil {
+			return fmt.Errorf("Failed to list the rules of chain %s in table %s: %s", o.chain, o.table, err)
+		}
+
+		snapshot := &chainSnapshot{table: o.table, chain: o.chain, rules: [][]string{}}
+		for _, rule := range rules {
+			if args := splitRule(rule); len(args) > 2 && args[0] == appendCommand {
+				snapshot.rules = append(snapshot.rules, args[2:])
+			}
+		}
+
+		b.snapshots = append(b.snapshots, snapshot)
+	}
+
+	return nil
+}
+
+// undo returns the operations that revert the given ones, which are the first
+// operations of the batch. The chains from which rules were removed are
+// restored from their snapshots. The rules added to the chains created by the
+// operations go away with the chains.
+func (b *batch) undo(operations []*batchOperation) []*batchOperation {
+
+	touched := map[string]bool{}
+	deleted := map[string]bool{}
+	created := map[string]bool{}
+	for _, o := range operations {
+		key := o.table + "/" + o.chain
+		touched[key] = true
+		switch o.command {
+		case deleteChainCommand:
+			deleted[key] = true
+		case newChainCommand:
+			deleted[key] = false
+			created[key] = !b.existing[key]
+		}
+	}
+
+	restored := map[string]bool{}
+	reverted := []*batchOperation{}
+
+	// The removed chains are created again first, so that the restored rules
+	// can jump to them
+	for _, c := range b.snapshots {
+		key := c.table + "/" + c.chain
+		if !touched[key] {
+			continue
+		}
+		restored[key] = true
+		if deleted[key] {
+			reverted = append(reverted, &batchOperation{table: c.table, command: newChainCommand, chain: c.chain})
+		}
+	}
+
+	for _, c := range b.snapshots {
+		if !restored[c.table+"/"+c.chain] {
+			continue
+		}
+		reverted = append(reverted, &batchOperation{table: c.table, command: clearChainCommand, chain: c.chain})
+		for _, rule := range c.rules {
+			reverted = append(reverted, &batchOperation{table: c.table, command: appendCommand, chain: c.chain, rulespec: rule})
+		}
+	}
+
+	for k := len(operations) - 1; k >= 0; k-- {
+		o := operations[k]
+		key := o.table + "/" + o.chain
+
+		if restored[key] {
+			continue
+		}
+
+		switch o.command {
+		case newChainCommand:
+			if created[key] {
+				reverted = append(reverted,
+					&batchOperation{table: o.table, command: clearChainCommand, chain: o.chain},
+					&batchOperation{table: o.table, command: deleteChainCommand, chain: o.chain},
+				)
+			}
+		case appendCommand, insertCommand:
+			if !created[key] {
+				reverted = append(reverted, &batchOperation{table: o.table, command: deleteCommand, chain: o.chain, rulespec: o.rulespec})
+			}
+		}
+	}
+
+	return reverted
+}
+
+// restore applies the batch with one restore per table. Tables are restored
+// atomically, so if a table fails only the tables restored before it have to
+// be reverted.
+func (b *batch) restore(r provider.IptablesRestoreProvider) error {
+
+	if err := b.prepare(); err != nil {
+		return err
+	}
+
+	applied := []*batchOperation{}
+
+	for _, table := range tables(b.operations) {
+
+		if err := r.Restore(render(table, b.operations, b.existing)); err != nil {
+
+			reverted := b.undo(applied)
+			existing, lerr := listChains(b.ipt, tables(reverted))
+			if lerr != nil {
+				zap.L().Warn("Failed to list the chains to revert", zap.Error(lerr))
+				return fmt.Errorf("Failed to restore the rules of table %s: %s", table, err)
+			}
+
+			for _, t := range tables(reverted) {
+				if uerr := r.Restore(render(t, reverted, existing)); uerr != nil {
+					zap.L().Warn("Failed to revert partially restored rules",
+						zap.String("table", t),
+						zap.Error(uerr),
+					)
+				}
+			}
+
+			return fmt.Errorf("Failed to restore the rules of table %s: %s", table, err)
+		}
+
+		for _, o := range b.operations {
+			if o.table == table {
+				applied = append(applied, o)
+			}
+		}
+	}
+
+	return nil
+}
+
+// execute applies the batch one operation at a time with the given provider.
+// If an operation fails, the operations already applied are reverted.
+func (b *batch) execute(ipt provider.IptablesProvider) error {
+
+	if err := b.prepare(); err != nil {
+		return err
+	}
+
+	for k, o := range b.operations {
+
+		if err := o.apply(ipt); err != nil {
+
+			for _, u := range b.undo(b.operations[:k]) {
+				if uerr := u.apply(ipt); uerr != nil {
+					zap.L().Warn("Failed to revert partially applied rules",
+						zap.String("table", u.table),
+						zap.String("operation", u.String()),
+						zap.Error(uerr),
+					)
+				}
+			}
+
+			return fmt.Errorf("Failed to apply %s in table %s: %s", o, o.table, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,316 @@
+package iptablesctrl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/supervisor/provider"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBatchRender(t *testing.T) {
+
+	Convey("Given a batch with changes to two tables", t, func() {
+		b := newBatch(provider.NewTestIptablesProvider())
+
+		b.NewChain("raw", "App")                                                        // nolint
+		b.Append("raw", "PREROUTING", "-s", "10.1.1.1", "-j", "App")                    // nolint
+		b.NewChain("mangle", "App")                                                     // nolint
+		b.Insert("mangle", "App", 1, "-m", "comment", "--comment", "Container chain 1") // nolint
+		b.Append("mangle", "App", "--nflog-prefix", `a"b`)                              // nolint
+		b.NewChain("raw", "Net")                                                        // nolint
+
+		Convey("When I list the tables", func() {
+			list := tables(b.operations)
+
+			Convey("They should be in the order they are first changed", func() {
+				So(list, ShouldResemble, []string{"raw", "mangle"})
+			})
+		})
+
+		Convey("When I render a table", func() {
+			raw := string(render("raw", b.operations, nil))
+			mangle := string(render("mangle", b.operations, nil))
+
+			Convey("The chains should be declared first and the arguments quoted", func() {
+				So(raw, ShouldEqual, "*raw\n"+
+					":App - [0:0]\n"+
+					":Net - [0:0]\n"+
+					"-A PREROUTING -s 10.1.1.1 -j App\n"+
+					"COMMIT\n")
+				So(mangle, ShouldEqual, "*mangle\n"+
+					":App - [0:0]\n"+
+					"-I App 1 -m comment --comment \"Container chain 1\"\n"+
+					"-A App --nflog-prefix \"a\\\"b\"\n"+
+					"COMMIT\n")
+			})
+		})
+
+		Convey("When I undo the changes", func() {
+			reverted := b.undo(b.operations)
+
+			Convey("Only the rules outside of the new chains and the new chains should be removed", func() {
+				lines := []string{}
+				for _, o := range reverted {
+					lines = append(lines, o.table+" "+o.String())
+				}
+				So(lines, ShouldResemble, []string{
+					"raw -F Net",
+					"raw -X Net",
+					"mangle -F App",
+					"mangle -X App",
+					"raw -D PREROUTING -s 10.1.1.1 -j App",
+					"raw -F App",
+					"raw -X App",
+				})
+			})
+		})
+
+		Convey("When I render a table with an existing chain", func() {
+			raw := string(render("raw", b.operations, map[string]bool{"raw/App": true}))
+
+			Convey("Only the chains that do not exist should be declared", func() {
+				So(raw, ShouldEqual, "*raw\n"+
+					":Net - [0:0]\n"+
+					"-A PREROUTING -s 10.1.1.1 -j App\n"+
+					"COMMIT\n")
+			})
+		})
+	})
+}
+
+func TestSplitRule(t *testing.T) {
+
+	Convey("When I split a rule listed by iptables", t, func() {
+		args := splitRule(`-A App -m comment --comment "Container chain 1" --nflog-prefix "a\"b" ! -s 10.1.1.1/32  -j ACCEPT`)
+
+		Convey("I should get the arguments without the quotes", func() {
+			So(args, ShouldResemble, []string{"-A", "App", "-m", "comment", "--comment", "Container chain 1", "--nflog-prefix", `a"b`, "!", "-s", "10.1.1.1/32", "-j", "ACCEPT"})
+		})
+	})
+
+	Convey("When I split a rule with an empty argument", t, func() {
+		args := splitRule(`-A App --comment "" -j ACCEPT`)
+
+		Convey("I should keep the empty argument", func() {
+			So(args, ShouldResemble, []string{"-A", "App", "--comment", "", "-j", "ACCEPT"})
+		})
+	})
+}
+
+func TestBatchUndoRemovals(t *testing.T) {
+
+	Convey("Given a batch that removes rules and chains that exist", t, func() {
+		iptables := provider.NewTestIptablesProvider()
+		iptables.MockListChains(t, func(table string) ([]string, error) {
+			return []string{"OUTPUT", "Old", "Other"}, nil
+		})
+		iptables.MockList(t, func(table string, chain string) ([]string, error) {
+			switch chain {
+			case "Old":
+				return []string{"-N Old", `-A Old -m comment --comment "Old chain" -j ACCEPT`}, nil
+			case "OUTPUT":
+				return []string{"-P OUTPUT ACCEPT", "-A OUTPUT -j Old", "-A OUTPUT -j Other"}, nil
+			}
+			return nil, fmt.Errorf("No chain")
+		})
+
+		b := newBatch(iptables)
+		b.NewChain("mangle", "New")                 // nolint
+		b.Append("mangle", "OUTPUT", "-j", "New")   // nolint
+		b.Delete("mangle", "OUTPUT", "-j", "Old")   // nolint
+		b.ClearChain("mangle", "Old")               // nolint
+		b.DeleteChain("mangle", "Old")              // nolint
+		b.NewChain("mangle", "Other")               // nolint
+		b.Append("mangle", "Other", "-j", "ACCEPT") // nolint
+
+		So(b.prepare(), ShouldBeNil)
+
+		Convey("The existing chain should not be declared", func() {
+			So(string(render("mangle", b.operations, b.existing)), ShouldNotContainSubstring, ":Other")
+			So(string(render("mangle", b.operations, b.existing)), ShouldContainSubstring, ":New")
+		})
+
+		Convey("When I undo the changes", func() {
+			lines := []string{}
+			for _, o := range b.undo(b.operations) {
+				lines = append(lines, o.String())
+			}
+
+			Convey("The chains should be restored from their snapshots and the new chains removed", func() {
+				So(lines, ShouldResemble, []string{
+					"-N Old",
+					"-F OUTPUT",
+					"-A OUTPUT -j Old",
+					"-A OUTPUT -j Other",
+					"-F Old",
+					"-A Old -m comment --comment \"Old chain\" -j ACCEPT",
+					"-D Other -j ACCEPT",
+					"-F New",
+					"-X New",
+				})
+			})
+		})
+
+		Convey("When I undo the changes before the chain removal", func() {
+			lines := []string{}
+			for _, o := range b.undo(b.operations[:3]) {
+				lines = append(lines, o.String())
+			}
+
+			Convey("Only the chain with a removed rule should be restored", func() {
+				So(lines, ShouldResemble, []string{
+					"-F OUTPUT",
+					"-A OUTPUT -j Old",
+					"-A OUTPUT -j Other",
+					"-F New",
+					"-X New",
+				})
+			})
+		})
+	})
+
+	Convey("Given a batch that removes a rule from a chain that cannot be listed", t, func() {
+		iptables := provider.NewTestIptablesProvider()
+		iptables.MockList(t, func(table string, chain string) ([]string, error) {
+			return nil, fmt.Errorf("No chain")
+		})
+
+		b := newBatch(iptables)
+		b.Delete("mangle", "OUTPUT", "-j", "Old") // nolint
+
+		restore := provider.NewTestIptablesRestoreProvider()
+		restored := 0
+		restore.MockRestore(t, func(data []byte) error {
+			restored++
+			return nil
+		})
+
+		Convey("When I restore the batch, I should get an error and nothing should be applied", func() {
+			So(b.restore(restore), ShouldNotBeNil)
+			So(restored, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestBatchRestore(t *testing.T) {
+
+	Convey("Given a batch with changes to two tables", t, func() {
+		b := newBatch(provider.NewTestIptablesProvider())
+		b.NewChain("raw", "App")                                     // nolint
+		b.Append("raw", "PREROUTING", "-s", "10.1.1.1", "-j", "App") // nolint
+		b.NewChain("mangle", "Net")                                  // nolint
+
+		restore := provider.NewTestIptablesRestoreProvider()
+
+		Convey("When every table is restored", func() {
+			restored := []string{}
+			restore.MockRestore(t, func(data []byte) error {
+				restored = append(restored, string(data))
+				return nil
+			})
+
+			err := b.restore(restore)
+
+			Convey("I should get one restore per table", func() {
+				So(err, ShouldBeNil)
+				So(len(restored), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When the first table fails", func() {
+			restored := []string{}
+			restore.MockRestore(t, func(data []byte) error {
+				restored = append(restored, string(data))
+				return fmt.Errorf("Error")
+			})
+
+			err := b.restore(restore)
+
+			Convey("I should get an error and nothing should be reverted", func() {
+				So(err, ShouldNotBeNil)
+				So(len(restored), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the second table fails", func() {
+			restored := []string{}
+			restore.MockRestore(t, func(data []byte) error {
+				restored = append(restored, string(data))
+				if len(restored) == 2 {
+					return fmt.Errorf("Error")
+				}
+				return nil
+			})
+
+			err := b.restore(restore)
+
+			Convey("I should get an error and the first table should be reverted", func() {
+				So(err, ShouldNotBeNil)
+				So(len(restored), ShouldEqual, 3)
+				So(restored[2], ShouldEqual, "*raw\n"+
+					"-D PREROUTING -s 10.1.1.1 -j App\n"+
+					"-F App\n"+
+					"-X App\n"+
+					"COMMIT\n")
+			})
+		})
+	})
+}
+
+func TestBatchExecute(t *testing.T) {
+
+	Convey("Given a batch and an iptables provider", t, func() {
+		iptables := provider.NewTestIptablesProvider()
+
+		b := newBatch(iptables)
+		b.NewChain("mangle", "App")                                    // nolint
+		b.Append("mangle", "App", "-j", "ACCEPT")                      // nolint
+		b.Append("mangle", "OUTPUT", "-s", "10.1.1.1", "-j", "App")    // nolint
+		b.Insert("mangle", "OUTPUT", 1, "-d", "10.1.1.2", "-j", "App") // nolint
+
+		applied := []string{}
+		iptables.MockNewChain(t, func(table string, chain string) error {
+			applied = append(applied, "-N "+chain)
+			return nil
+		})
+		iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+			applied = append(applied, "-A "+chain)
+			return nil
+		})
+		iptables.MockDelete(t, func(table string, chain string, rulespec ...string) error {
+			applied = append(applied, "-D "+chain)
+			return nil
+		})
+		iptables.MockClearChain(t, func(table string, chain string) error {
+			applied = append(applied, "-F "+chain)
+			return nil
+		})
+		iptables.MockDeleteChain(t, func(table string, chain string) error {
+			applied = append(applied, "-X "+chain)
+			return nil
+		})
+
+		Convey("When every operation succeeds", func() {
+			err := b.execute(iptables)
+
+			Convey("The operations should be applied in order", func() {
+				So(err, ShouldBeNil)
+				So(applied, ShouldResemble, []string{"-N App", "-A App", "-A OUTPUT"})
+			})
+		})
+
+		Convey("When the last operation fails", func() {
+			iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
+				return fmt.Errorf("Error")
+			})
+
+			err := b.execute(iptables)
+
+			Convey("I should get an error and the operations should be reverted", func() {
+				So(err, ShouldNotBeNil)
+				So(applied, ShouldResemble, []string{"-N App", "-A App", "-A OUTPUT", "-D OUTPUT", "-F App", "-X App"})
+			})
+		})
+	})
+}
@@ -40,9 +40,9 @@ func (i *Instance) updateTargetNetworks(old, new []string) error {
 // createTargetSet creates a new target set
 func (i *Instance) createTargetSet(networks []string) error {
 
-	ips, err := i.ipset.NewIpset(targetNetworkSet, "hash:net", &ipset.Params{})
+	ips, err := i.ipset.NewIpset(i.targetNetworkSet, "hash:net", &ipset.Params{HashFamily: i.ipsetFamily()})
 	if err != nil {
-		return fmt.Errorf("Couldn't create IPSet for %s: %s", targetNetworkSet, err)
+		return fmt.Errorf("Couldn't create IPSet for %s: %s", i.targetNetworkSet, err)
 	}
 
 	i.targetSet = ips
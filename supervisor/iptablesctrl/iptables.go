@@ -3,6 +3,7 @@ package iptablesctrl
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"go.uber.org/zap"
 
@@ -20,6 +21,7 @@ const (
 	appChainPrefix            = chainPrefix + "App-"
 	netChainPrefix            = chainPrefix + "Net-"
 	targetNetworkSet          = "TargetNetSet"
+	targetNetworkSet6         = "TargetNetSet6"
 	ipTableSectionOutput      = "OUTPUT"
 	ipTableSectionInput       = "INPUT"
 	ipTableSectionPreRouting  = "PREROUTING"
@@ -30,6 +32,7 @@ const (
 type Instance struct {
 	fqc                        *fqconfig.FilterQueue
 	ipt                        provider.IptablesProvider
+	restore                    provider.IptablesRestoreProvider
 	ipset                      provider.IpsetProvider
 	targetSet                  provider.Ipset
 	appPacketIPTableContext    string
@@ -40,6 +43,13 @@ type Instance struct {
 	appCgroupIPTableSection    string
 	appSynAckIPTableSection    string
 	mode                       constants.ModeType
+	ipv6                       bool
+	ip6t                       provider.IptablesProvider
+	restore6                   provider.IptablesRestoreProvider
+	ipv6Instance               *Instance
+	targetNetworkSet           string
+	anyNetwork                 string
+	ipNamespace                string
 }
 
 // NewInstance creates a new iptables controller instance
@@ -56,13 +66,34 @@ func NewInstance(fqc *fqconfig.FilterQueue, mode constants.ModeType) (*Instance,
 	}
 
 	i := &Instance{
-		fqc:   fqc,
-		ipt:   ipt,
-		ipset: ips,
+		fqc:                        fqc,
+		ipt:                        ipt,
+		ipset:                      ips,
 		appPacketIPTableContext:    "raw",
 		appAckPacketIPTableContext: "mangle",
 		netPacketIPTableContext:    "mangle",
-		mode: mode,
+		mode:                       mode,
+		targetNetworkSet:           targetNetworkSet,
+		anyNetwork:                 "0.0.0.0/0",
+		ipNamespace:                policy.DefaultNamespace,
+	}
+
+	// Without iptables-restore the rules of a PU are applied one at a time
+	if restore, err := provider.NewIPTablesRestoreProvider(); err == nil {
+		i.restore = restore
+	} else {
+		zap.L().Info("Rules will not be applied in batches", zap.Error(err))
+	}
+
+	// IPv6 rules are only installed when IPv6 target networks are configured
+	if ip6t, err := provider.NewGoIP6TablesProvider(); err == nil {
+		i.ip6t = ip6t
+	} else {
+		zap.L().Info("IPv6 is not supported on this host", zap.Error(err))
+	}
+
+	if restore6, err := provider.NewIP6TablesRestoreProvider(); err == nil {
+		i.restore6 = restore6
 	}
 
 	if mode == constants.LocalServer || mode == constants.RemoteContainer {
@@ -81,6 +112,72 @@ func NewInstance(fqc *fqconfig.FilterQueue, mode constants.ModeType) (*Instance,
 
 }
 
+// newIPv6Instance creates the controller of the IPv6 rules. It shares the
+// configuration of the IPv4 controller but drives ip6tables and an inet6 set.
+func (i *Instance) newIPv6Instance() *Instance {
+
+	v6 := *i
+
+	v6.ipt = i.ip6t
+	v6.ip6t = nil
+	v6.restore = i.restore6
+	v6.restore6 = nil
+	v6.ipv6 = true
+	v6.ipv6Instance = nil
+	v6.targetSet = nil
+	v6.targetNetworkSet = targetNetworkSet6
+	v6.anyNetwork = "::/0"
+	v6.ipNamespace = policy.DefaultNamespaceIPv6
+
+	return &v6
+}
+
+// ipsetFamily returns the ipset family of the addresses of this controller
+func (i *Instance) ipsetFamily() string {
+
+	if i.ipv6 {
+		return "inet6"
+	}
+
+	return "inet"
+}
+
+// matchesFamily returns true if the address or network belongs to the
+// IP family of this controller
+func (i *Instance) matchesFamily(address string) bool {
+	return strings.Contains(address, ":") == i.ipv6
+}
+
+// ipv6Enabled returns true if the IPv6 controller must manage the rules of
+// a PU with the given addresses
+func (i *Instance) ipv6Enabled(addresslist map[string]string) bool {
+
+	if i.ipv6Instance == nil {
+		return false
+	}
+
+	_, ok := i.ipv6Instance.defaultIP(addresslist)
+
+	return ok
+}
+
+// splitNetworks splits a list of networks to IPv4 and IPv6 networks
+func splitNetworks(networks []string) (ipv4 []string, ipv6 []string) {
+
+	ipv4 = []string{}
+	ipv6 = []string{}
+
+	for _, network := range networks {
+		if strings.Contains(network, ":") {
+			ipv6 = append(ipv6, network)
+		} else {
+			ipv4 = append(ipv4, network)
+		}
+	}
+
+	return ipv4, ipv6
+}
+
 // chainPrefix returns the chain name for the specific PU
 func (i *Instance) chainName(contextID string, version int) (app, net string) {
 	app = appChainPrefix + contextID + "-" + strconv.Itoa(version)
@@ -91,69 +188,97 @@ func (i *Instance) chainName(contextID string, version int) (app, net string) {
 // DefaultIPAddress returns the default IP address for the processing unit
 func (i *Instance) defaultIP(addresslist map[string]string) (string, bool) {
 
-	if ip, ok := addresslist[policy.DefaultNamespace]; ok && len(ip) > 0 {
+	if ip, ok := addresslist[i.ipNamespace]; ok && len(ip) > 0 {
 		return ip, true
 	}
 
 	if i.mode == constants.LocalContainer {
-		return "0.0.0.0/0", false
+		return i.anyNetwork, false
 	}
 
-	return "0.0.0.0/0", true
+	return i.anyNetwork, true
 }
 
-// ConfigureRules implmenets the ConfigureRules interface
-func (i *Instance) ConfigureRules(version int, contextID string, containerInfo *policy.PUInfo) error {
-	policyrules := containerInfo.Policy
+// withProvider returns a copy of the controller that drives the given provider
+func (i *Instance) withProvider(ipt provider.IptablesProvider) *Instance {
 
-	appChain, netChain := i.chainName(contextID, version)
-	// policyrules.DefaultIPAddress()
+	t := *i
+	t.ipt = ipt
+
+	return &t
+}
+
+// transaction records the changes made by apply and applies them together.
+// With iptables-restore every table is changed at once, otherwise the changes
+// are applied one at a time. Either way, if the changes cannot be applied,
+// the ones already made are reverted.
+func (i *Instance) transaction(apply func(t *Instance) error) error {
+
+	b := newBatch(i.ipt)
+
+	if err := apply(i.withProvider(b)); err != nil {
+		return err
+	}
+
+	if i.restore == nil {
+		return b.execute(i.ipt)
+	}
+
+	return b.restore(i.restore)
+}
+
+// puParameters returns the IP address of the processing unit for the IP family
+// of the controller and, for Linux processes, the port, mark and uid that
+// identify its traffic
+func (i *Instance) puParameters(containerInfo *policy.PUInfo) (ipAddress, port, mark, uid string, err error) {
 
 	// Supporting only one ip
-	ipAddress, ok := i.defaultIP(policyrules.IPAddresses())
+	ipAddress, ok := i.defaultIP(containerInfo.Policy.IPAddresses())
 	if !ok {
-		return fmt.Errorf("No ip address found ")
+		return "", "", "", "", fmt.Errorf("No ip address found ")
 	}
 
-	// Configure all the ACLs
-	if err := i.addContainerChain(appChain, netChain); err != nil {
-		return err
+	if i.mode != constants.LocalServer {
+		return ipAddress, "", "", "", nil
 	}
 
-	if i.mode != constants.LocalServer {
+	mark, ok = containerInfo.Runtime.Options().Get(cgnetcls.CgroupMarkTag)
+	if !ok {
+		return "", "", "", "", fmt.Errorf("No Mark value found")
+	}
 
-		if err := i.addChainRules(appChain, netChain, ipAddress, "", "", ""); err != nil {
-			return err
-		}
+	port, ok = containerInfo.Runtime.Options().Get(cgnetcls.PortTag)
+	if !ok {
+		port = "0"
+	}
 
-	} else {
-		mark, ok := containerInfo.Runtime.Options().Get(cgnetcls.CgroupMarkTag)
-		if !ok {
-			return fmt.Errorf("No Mark value found")
-		}
+	uid, ok = containerInfo.Runtime.Options().Get("USER")
+	if !ok {
+		uid = ""
+	}
 
-		port, ok := containerInfo.Runtime.Options().Get(cgnetcls.PortTag)
-		if !ok {
-			port = "0"
-		}
-		uid, ok := containerInfo.Runtime.Options().Get("USER")
-		if !ok {
-			uid = ""
-		}
-		if err := i.addChainRules(appChain, netChain, ipAddress, port, mark, uid); err != nil {
-			return err
-		}
+	return ipAddress, port, mark, uid, nil
+}
+
+// addPURules adds the chains of the processing unit with all the ACLs and
+// then the rules that send traffic to them
+func (i *Instance) addPURules(contextID, appChain, netChain, ipAddress, port, mark, uid string, policyrules *policy.PUPolicy) error {
+
+	if err := i.addContainerChain(appChain, netChain); err != nil {
+		return err
 	}
 
-	if err := i.addPacketTrap(appChain, netChain, ipAddress, containerInfo.Policy.TriremeNetworks()); err != nil {
+	failOpen := policyrules.FailurePolicy().FailsOpen(i.fqc.FailOpen)
+	if err := i.addPacketTrap(appChain, netChain, ipAddress, policyrules.TriremeNetworks(), failOpen); err != nil {
 		return err
 	}
 
-	if err := i.addAppACLs(contextID, appChain, ipAddress, policyrules.ApplicationACLs()); err != nil {
+	audit := policyrules.TriremeAction() == policy.Monitor
+	if err := i.addAppACLs(contextID, appChain, ipAddress, policyrules.ApplicationACLs(), audit); err != nil {
 		return err
 	}
 
-	if err := i.addNetACLs(contextID, netChain, ipAddress, policyrules.NetworkACLs()); err != nil {
+	if err := i.addNetACLs(contextID, netChain, ipAddress, policyrules.NetworkACLs(), audit); err != nil {
 		return err
 	}
 
@@ -161,6 +286,97 @@ func (i *Instance) ConfigureRules(version int, contextID string, containerInfo *
 		return err
 	}
 
+	return i.addChainRules(appChain, netChain, ipAddress, port, mark, uid)
+}
+
+// removePURules removes the rules that send traffic to the chains of the
+// processing unit and then the chains
+func (i *Instance) removePURules(appChain, netChain, ipAddress, port, mark, uid string) {
+
+	if err := i.deleteChainRules(appChain, netChain, ipAddress, port, mark, uid); err != nil {
+		zap.L().Warn("Failed to clean rules", zap.Error(err))
+	}
+
+	if err := i.deleteAllContainerChains(appChain, netChain); err != nil {
+		zap.L().Warn("Failed to clean container chains while deleting the rules", zap.Error(err))
+	}
+}
+
+// applyRules adds a version of the rules of a processing unit in one
+// transaction
+func (i *Instance) applyRules(version int, contextID string, containerInfo *policy.PUInfo) error {
+
+	ipAddress, port, mark, uid, err := i.puParameters(containerInfo)
+	if err != nil {
+		return err
+	}
+
+	appChain, netChain := i.chainName(contextID, version)
+
+	return i.transaction(func(t *Instance) error {
+		return t.addPURules(contextID, appChain, netChain, ipAddress, port, mark, uid, containerInfo.Policy)
+	})
+}
+
+// removeRules removes a version of the rules of a processing unit. The
+// removal is first tried in one transaction, and if it fails, for instance
+// because some of the rules are already gone, one rule at a time.
+func (i *Instance) removeRules(version int, contextID, ipAddress, port, mark, uid string) {
+
+	appChain, netChain := i.chainName(contextID, version)
+
+	remove := func(t *Instance) error {
+		t.removePURules(appChain, netChain, ipAddress, port, mark, uid)
+		return nil
+	}
+
+	if i.restore != nil {
+		err := i.transaction(remove)
+		if err == nil {
+			return
+		}
+		zap.L().Debug("Failed to remove the rules in one batch", zap.String("contextID", contextID), zap.Error(err))
+	}
+
+	remove(i) // nolint
+}
+
+// removeVersion removes a version of the rules of a processing unit described
+// by its current runtime
+func (i *Instance) removeVersion(version int, contextID string, containerInfo *policy.PUInfo) {
+
+	ipAddress, port, mark, uid, err := i.puParameters(containerInfo)
+	if err != nil {
+		zap.L().Warn("Failed to clean rules", zap.String("contextID", contextID), zap.Error(err))
+		return
+	}
+
+	i.removeRules(version, contextID, ipAddress, port, mark, uid)
+}
+
+// ConfigureRules implmenets the ConfigureRules interface
+func (i *Instance) ConfigureRules(version int, contextID string, containerInfo *policy.PUInfo) error {
+
+	if containerInfo == nil {
+		return fmt.Errorf("Container info cannot be nil")
+	}
+
+	policyrules := containerInfo.Policy
+	if policyrules == nil {
+		return fmt.Errorf("Policy rules cannot be nil")
+	}
+
+	if err := i.applyRules(version, contextID, containerInfo); err != nil {
+		return err
+	}
+
+	if i.ipv6Enabled(policyrules.IPAddresses()) {
+		if err := i.ipv6Instance.applyRules(version, contextID, containerInfo); err != nil {
+			i.removeVersion(version, contextID, containerInfo)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -181,20 +397,18 @@ func (i *Instance) DeleteRules(version int, contextID string, ipAddresses policy
 		}
 	}
 
-	appChain, netChain := i.chainName(contextID, version)
+	i.removeRules(version, contextID, ipAddress, port, mark, uid)
 
-	if derr := i.deleteChainRules(appChain, netChain, ipAddress, port, mark, uid); derr != nil {
-		zap.L().Warn("Failed to clean rules", zap.Error(derr))
-	}
-
-	if err := i.deleteAllContainerChains(appChain, netChain); err != nil {
-		zap.L().Warn("Failed to clean container chains while deleting the rules", zap.Error(err))
+	if i.ipv6Enabled(ipAddresses) {
+		return i.ipv6Instance.DeleteRules(version, contextID, ipAddresses, port, mark, uid)
 	}
 
 	return nil
 }
 
-// UpdateRules implements the update part of the interface
+// UpdateRules implements the update part of the interface. The new version of
+// the rules is added in one transaction before the previous version is
+// removed. If the new version cannot be added, the previous one is kept.
 func (i *Instance) UpdateRules(version int, contextID string, containerInfo *policy.PUInfo) error {
 
 	if containerInfo == nil {
@@ -206,88 +420,250 @@ func (i *Instance) UpdateRules(version int, contextID string, containerInfo *pol
 		return fmt.Errorf("Policy rules cannot be nil")
 	}
 
-	// Supporting only one ip
-	ipAddress, ok := i.defaultIP(policyrules.IPAddresses())
-	if !ok {
-		return fmt.Errorf("No ip address found ")
+	ipv6 := i.ipv6Enabled(policyrules.IPAddresses())
+
+	if err := i.applyRules(version, contextID, containerInfo); err != nil {
+		return err
 	}
 
-	appChain, netChain := i.chainName(contextID, version)
+	if ipv6 {
+		if err := i.ipv6Instance.applyRules(version, contextID, containerInfo); err != nil {
+			i.removeVersion(version, contextID, containerInfo)
+			return err
+		}
+	}
 
-	oldAppChain, oldNetChain := i.chainName(contextID, version^1)
+	// Remove the previous version now that the traffic goes to the new chains
+	i.removeVersion(version^1, contextID, containerInfo)
 
-	//Add a new chain for this update and map all rules there
-	if err := i.addContainerChain(appChain, netChain); err != nil {
-		return err
+	if ipv6 {
+		i.ipv6Instance.removeVersion(version^1, contextID, containerInfo)
 	}
 
-	if err := i.addPacketTrap(appChain, netChain, ipAddress, containerInfo.Policy.TriremeNetworks()); err != nil {
-		return err
+	return nil
+}
+
+// VerifyRules returns a description of the rules of a version of a processing
+// unit that are not installed as expected, for instance because the chains
+// were flushed by another agent. An empty list means that there is no drift.
+func (i *Instance) VerifyRules(version int, contextID string, containerInfo *policy.PUInfo) ([]string, error) {
+
+	if containerInfo == nil || containerInfo.Policy == nil {
+		return nil, fmt.Errorf("Container info and policy cannot be nil")
 	}
 
-	if err := i.addAppACLs(contextID, appChain, ipAddress, policyrules.ApplicationACLs()); err != nil {
-		return err
+	drift, err := i.verifyRules(version, contextID, containerInfo)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := i.addNetACLs(contextID, netChain, ipAddress, policyrules.NetworkACLs()); err != nil {
-		return err
+	if i.ipv6Enabled(containerInfo.Policy.IPAddresses()) {
+		drift6, err := i.ipv6Instance.verifyRules(version, contextID, containerInfo)
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, drift6...)
 	}
 
-	if err := i.addExclusionACLs(appChain, netChain, ipAddress, policyrules.ExcludedNetworks()); err != nil {
-		return err
+	return drift, nil
+}
+
+// verifyRules compares the installed rules of a processing unit with the rules
+// that ConfigureRules would install. The chains of the processing unit must
+// hold as many rules as expected, and every expected rule must be installed
+// with the same content.
+func (i *Instance) verifyRules(version int, contextID string, containerInfo *policy.PUInfo) ([]string, error) {
+
+	ipAddress, port, mark, uid, err := i.puParameters(containerInfo)
+	if err != nil {
+		return nil, err
 	}
 
-	// Add mapping to new chain
-	if i.mode != constants.LocalServer {
+	appChain, netChain := i.chainName(contextID, version)
 
-		if err := i.addChainRules(appChain, netChain, ipAddress, "", "", ""); err != nil {
-			return err
+	b := newBatch(i.ipt)
+	if err := i.withProvider(b).addPURules(contextID, appChain, netChain, ipAddress, port, mark, uid, containerInfo.Policy); err != nil {
+		return nil, err
+	}
+
+	chains := []*batchOperation{}
+	expected := map[string]int{}
+	for _, o := range b.operations {
+		if o.command == newChainCommand {
+			chains = append(chains, o)
+			expected[o.table+"/"+o.chain] = 0
 		}
-	} else {
-		mark, ok := containerInfo.Runtime.Options().Get(cgnetcls.CgroupMarkTag)
-		if !ok {
-			return fmt.Errorf("No Mark value found")
+	}
+
+	for _, o := range b.operations {
+		if _, ok := expected[o.table+"/"+o.chain]; ok && o.command != newChainCommand {
+			expected[o.table+"/"+o.chain]++
 		}
-		portlist, ok := containerInfo.Runtime.Options().Get(cgnetcls.PortTag)
-		if !ok {
-			portlist = "0"
+	}
+
+	// The chains of the processing unit are only checked rule by rule if
+	// they hold the expected number of rules
+	chainDrift := []string{}
+	verified := map[string]bool{}
+	for _, c := range chains {
+
+		rules, err := i.ipt.List(c.table, c.chain)
+		if err != nil {
+			chainDrift = append(chainDrift, fmt.Sprintf("-t %s %s: missing chain", c.table, c))
+			continue
 		}
-		uid, ok := containerInfo.Runtime.Options().Get("USER")
-		if !ok {
-			uid = ""
+
+		count := 0
+		for _, rule := range rules {
+			if strings.HasPrefix(rule, appendCommand+" ") {
+				count++
+			}
 		}
-		if err := i.addChainRules(appChain, netChain, ipAddress, portlist, mark, uid); err != nil {
-			return err
+
+		if count != expected[c.table+"/"+c.chain] {
+			chainDrift = append(chainDrift, fmt.Sprintf("-t %s %s: %d rules instead of %d", c.table, c, count, expected[c.table+"/"+c.chain]))
+			continue
 		}
+
+		verified[c.table+"/"+c.chain] = true
 	}
 
-	//Remove mapping from old chain
-	if i.mode != constants.LocalServer {
-		if err := i.deleteChainRules(oldAppChain, oldNetChain, ipAddress, "", "", ""); err != nil {
-			return err
+	drift := []string{}
+	for _, o := range b.operations {
+
+		if o.command != appendCommand && o.command != insertCommand {
+			continue
 		}
-	} else {
-		mark, _ := containerInfo.Runtime.Options().Get(cgnetcls.CgroupMarkTag)
-		port, ok := containerInfo.Runtime.Options().Get(cgnetcls.PortTag)
 
-		if !ok {
-			port = "0"
+		if _, ok := expected[o.table+"/"+o.chain]; ok && !verified[o.table+"/"+o.chain] {
+			continue
 		}
-		uid, ok := containerInfo.Runtime.Options().Get("USER")
-		if !ok {
-			uid = ""
+
+		missing, err := i.missingRule(o)
+		if err != nil {
+			return nil, err
 		}
-		if err := i.deleteChainRules(oldAppChain, oldNetChain, ipAddress, port, mark, uid); err != nil {
-			return err
+
+		if missing != "" {
+			drift = append(drift, missing)
 		}
 	}
 
-	// Delete the old chain to clean up
-	if err := i.deleteAllContainerChains(oldAppChain, oldNetChain); err != nil {
-		return err
+	return append(drift, chainDrift...), nil
+}
+
+// missingRule returns the description of a rule if it is not installed
+func (i *Instance) missingRule(o *batchOperation) (string, error) {
+
+	exists, err := i.ipt.Exists(o.table, o.chain, o.rulespec...)
+	if err != nil {
+		return "", fmt.Errorf("Failed to verify rule %s in table %s: %s", o, o.table, err)
 	}
 
-	return nil
+	if exists {
+		return "", nil
+	}
+
+	return fmt.Sprintf("-t %s %s: missing rule", o.table, o), nil
+}
+
+// globalRules returns the operations that install the rules shared by all the
+// processing units, as Start and SetTargetNetworks install them
+func (i *Instance) globalRules() []*batchOperation {
+
+	b := newBatch(i.ipt)
+	t := i.withProvider(b)
+
+	if err := t.acceptMarkedPackets(); err != nil {
+		zap.L().Debug("Failed to record the filter of marked packets", zap.Error(err))
+	}
+
+	if i.targetSet != nil {
+		if err := t.setGlobalRules(i.appPacketIPTableSection, i.netPacketIPTableSection); err != nil {
+			zap.L().Debug("Failed to record the SynAck rules", zap.Error(err))
+		}
+		b.NewChain(i.appAckPacketIPTableContext, uidchain)                                   // nolint
+		b.Insert(i.appAckPacketIPTableContext, i.appPacketIPTableSection, 1, "-j", uidchain) // nolint
+	}
+
+	return b.operations
+}
+
+// RepairGlobalRules reinstalls the rules shared by all the processing units,
+// such as the capture of the SynAck packets and the acceptance of the marked
+// packets, if they are not installed as expected. It returns the drift that
+// was repaired.
+func (i *Instance) RepairGlobalRules() ([]string, error) {
+
+	drift, err := i.repairGlobalRules()
+	if err != nil {
+		return drift, err
+	}
+
+	if i.ipv6Instance != nil {
+		drift6, err := i.ipv6Instance.repairGlobalRules()
+		drift = append(drift, drift6...)
+		if err != nil {
+			return drift, err
+		}
+	}
+
+	return drift, nil
+}
+
+// repairGlobalRules repairs the global rules of the IP family of the controller.
+// The rules are all inserted at the top of their chains in a given order, so
+// they are removed and inserted again together to keep that order.
+func (i *Instance) repairGlobalRules() ([]string, error) {
+
+	operations := i.globalRules()
+
+	drift := []string{}
+	for _, o := range operations {
+
+		if o.command == newChainCommand {
+			if _, err := i.ipt.List(o.table, o.chain); err != nil {
+				drift = append(drift, fmt.Sprintf("-t %s %s: missing chain", o.table, o))
+			}
+			continue
+		}
+
+		missing, err := i.missingRule(o)
+		if err != nil {
+			return nil, err
+		}
+
+		if missing != "" {
+			drift = append(drift, missing)
+		}
+	}
+
+	if len(drift) == 0 {
+		return drift, nil
+	}
+
+	for _, o := range operations {
+		if o.command == insertCommand {
+			if err := i.ipt.Delete(o.table, o.chain, o.rulespec...); err != nil {
+				zap.L().Debug("Global rule was not installed", zap.String("rule", o.String()), zap.Error(err))
+			}
+		}
+	}
+
+	for _, o := range operations {
+
+		if o.command == newChainCommand {
+			if _, err := i.ipt.List(o.table, o.chain); err == nil {
+				continue
+			}
+		}
+
+		if err := o.apply(i.ipt); err != nil {
+			return drift, fmt.Errorf("Failed to repair %s in table %s: %s", o, o.table, err)
+		}
+	}
+
+	return drift, nil
 }
 
 // Start starts the iptables controller
@@ -309,15 +685,49 @@ func (i *Instance) Start() error {
 	return nil
 }
 
+// defaultTargetNetworks returns the target networks that capture all the
+// traffic, which are used when no target networks are given. The IPv6 networks
+// are only added if ip6tables is available. The ipsets cannot hold a network
+// with a prefix of 0, so every address space is split in two halves.
+func (i *Instance) defaultTargetNetworks() []string {
+
+	networks := []string{"0.0.0.0/1", "128.0.0.0/1"}
+
+	if i.ip6t != nil {
+		networks = append(networks, "::/1", "8000::/1")
+	}
+
+	return networks
+}
+
 // SetTargetNetworks updates ths target networks for SynAck packets
 func (i *Instance) SetTargetNetworks(current, networks []string) error {
 
+	if len(current) == 0 {
+		current = i.defaultTargetNetworks()
+	}
+
 	if len(networks) == 0 {
-		networks = []string{"0.0.0.0/1", "128.0.0.0/1"}
+		networks = i.defaultTargetNetworks()
+	}
+
+	current, current6 := splitNetworks(current)
+	networks, networks6 := splitNetworks(networks)
+
+	if len(networks6) > 0 || i.ipv6Instance != nil {
+		if err := i.setIPv6TargetNetworks(current6, networks6); err != nil {
+			return err
+		}
 	}
 
+	return i.setTargetNetworks(current, networks)
+}
+
+// setTargetNetworks updates the target networks of the IP family of the controller
+func (i *Instance) setTargetNetworks(current, networks []string) error {
+
 	// Cleanup old ACLs
-	if len(current) > 0 {
+	if i.targetSet != nil {
 		return i.updateTargetNetworks(current, networks)
 	}
 
@@ -337,6 +747,26 @@ func (i *Instance) SetTargetNetworks(current, networks []string) error {
 	return nil
 }
 
+// setIPv6TargetNetworks updates the IPv6 target networks. The IPv6 controller
+// is started with the first IPv6 target network.
+func (i *Instance) setIPv6TargetNetworks(current, networks []string) error {
+
+	if i.ipv6Instance == nil {
+		if i.ip6t == nil {
+			return fmt.Errorf("IPv6 target networks require ip6tables")
+		}
+
+		v6 := i.newIPv6Instance()
+		if err := v6.Start(); err != nil {
+			return fmt.Errorf("Failed to start the IPv6 controller: %s", err)
+		}
+
+		i.ipv6Instance = v6
+	}
+
+	return i.ipv6Instance.setTargetNetworks(current, networks)
+}
+
 // Stop stops the supervisor
 func (i *Instance) Stop() error {
 
@@ -347,6 +777,12 @@ func (i *Instance) Stop() error {
 		zap.L().Error("Failed to clean acls while stopping the supervisor", zap.Error(err))
 	}
 
+	if i.ipv6Instance != nil {
+		if err := i.ipv6Instance.cleanACLs(); err != nil {
+			zap.L().Error("Failed to clean IPv6 acls while stopping the supervisor", zap.Error(err))
+		}
+	}
+
 	if err := i.ipset.DestroyAll(); err != nil {
 		zap.L().Error("Failed to clean up ipsets", zap.Error(err))
 	}
@@ -2,12 +2,14 @@ package iptablesctrl
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/aporeto-inc/trireme/constants"
 	"github.com/aporeto-inc/trireme/enforcer/utils/fqconfig"
 	"github.com/aporeto-inc/trireme/policy"
 	"github.com/aporeto-inc/trireme/supervisor/provider"
+	"github.com/bvandewalle/go-ipset/ipset"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -108,6 +110,7 @@ func TestConfigureRules(t *testing.T) {
 		i, _ := NewInstance(fqconfig.NewFilterQueueWithDefaults(), constants.LocalContainer)
 		iptables := provider.NewTestIptablesProvider()
 		i.ipt = iptables
+		i.restore = nil
 
 		rules := policy.IPRuleList{
 			policy.IPRule{
@@ -236,6 +239,111 @@ func TestConfigureRules(t *testing.T) {
 			})
 		})
 
+		Convey("With a set of policy rules and valid IP, where add ACLs fails after the chains are created", func() {
+
+			ipl := policy.ExtendedMap{}
+			ipl[policy.DefaultNamespace] = "172.17.0.1"
+			policyrules := policy.NewPUPolicy("Context",
+				policy.Police,
+				rules,
+				rules,
+				nil,
+				nil,
+				nil,
+				nil, ipl, []string{"172.17.0.0/24"}, []string{})
+
+			containerinfo := policy.NewPUInfo("Context", constants.ContainerPU)
+			containerinfo.Policy = policyrules
+			containerinfo.Runtime = policy.NewPURuntimeWithDefaults()
+
+			deleted := []string{}
+			iptables.MockNewChain(t, func(table string, chain string) error {
+				return nil
+			})
+			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+				return fmt.Errorf("Failed to add rule")
+			})
+			iptables.MockDeleteChain(t, func(table string, chain string) error {
+				deleted = append(deleted, table+"/"+chain)
+				return nil
+			})
+
+			err := i.ConfigureRules(1, "Context", containerinfo)
+			Convey("I should get an error and the chains should be removed", func() {
+				So(err, ShouldNotBeNil)
+				So(deleted, ShouldResemble, []string{
+					"mangle/TRIREME-Net-Context-1",
+					"mangle/TRIREME-App-Context-1",
+					"raw/TRIREME-App-Context-1",
+				})
+			})
+		})
+
+		Convey("With a set of policy rules and valid IP, and iptables-restore", func() {
+
+			restore := provider.NewTestIptablesRestoreProvider()
+			i.restore = restore
+
+			ipl := policy.ExtendedMap{}
+			ipl[policy.DefaultNamespace] = "172.17.0.1"
+			policyrules := policy.NewPUPolicy("Context",
+				policy.Police,
+				rules,
+				rules,
+				nil,
+				nil,
+				nil,
+				nil, ipl, []string{"172.17.0.0/24"}, []string{})
+
+			containerinfo := policy.NewPUInfo("Context", constants.ContainerPU)
+			containerinfo.Policy = policyrules
+			containerinfo.Runtime = policy.NewPURuntimeWithDefaults()
+
+			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+				return fmt.Errorf("Rules should not be appended one at a time")
+			})
+
+			Convey("When the restore succeeds", func() {
+				batches := []string{}
+				restore.MockRestore(t, func(data []byte) error {
+					batches = append(batches, string(data))
+					return nil
+				})
+
+				err := i.ConfigureRules(1, "Context", containerinfo)
+				Convey("Every table should be restored in one batch", func() {
+					So(err, ShouldBeNil)
+					So(len(batches), ShouldEqual, 2)
+					So(batches[0], ShouldStartWith, "*raw\n:TRIREME-App-Context-1 - [0:0]\n")
+					So(batches[1], ShouldStartWith, "*mangle\n:TRIREME-App-Context-1 - [0:0]\n:TRIREME-Net-Context-1 - [0:0]\n")
+					So(batches[1], ShouldContainSubstring, "-A PREROUTING -s 172.17.0.1 -m comment --comment Container-specific-chain -j TRIREME-App-Context-1\n")
+					So(batches[1], ShouldEndWith, "COMMIT\n")
+				})
+			})
+
+			Convey("When the restore of the second table fails", func() {
+				batches := []string{}
+				restore.MockRestore(t, func(data []byte) error {
+					batches = append(batches, string(data))
+					if strings.HasPrefix(string(data), "*mangle") {
+						return fmt.Errorf("Error")
+					}
+					return nil
+				})
+
+				err := i.ConfigureRules(1, "Context", containerinfo)
+				Convey("I should get an error and the first table should be reverted", func() {
+					So(err, ShouldNotBeNil)
+					So(len(batches), ShouldEqual, 3)
+					So(batches[2], ShouldEqual, "*raw\n"+
+						"-D PREROUTING -s 172.17.0.1 -m comment --comment Container-specific-chain -j TRIREME-App-Context-1\n"+
+						"-F TRIREME-App-Context-1\n"+
+						"-X TRIREME-App-Context-1\n"+
+						"COMMIT\n")
+				})
+			})
+		})
+
 	})
 }
 
@@ -244,6 +352,7 @@ func TestDeleteRules(t *testing.T) {
 		i, _ := NewInstance(fqconfig.NewFilterQueueWithDefaults(), constants.LocalContainer)
 		iptables := provider.NewTestIptablesProvider()
 		i.ipt = iptables
+		i.restore = nil
 
 		Convey("If I try to delete with nil IP addreses", func() {
 			err := i.DeleteRules(1, "context", nil, "0", "0", "")
@@ -283,6 +392,7 @@ func TestUpdateRules(t *testing.T) {
 		i, _ := NewInstance(fqconfig.NewFilterQueueWithDefaults(), constants.LocalContainer)
 		iptables := provider.NewTestIptablesProvider()
 		i.ipt = iptables
+		i.restore = nil
 
 		rules := policy.IPRuleList{
 			policy.IPRule{
@@ -391,6 +501,278 @@ func TestUpdateRules(t *testing.T) {
 			})
 		})
 
+		Convey("I try to update with iptables-restore", func() {
+
+			restore := provider.NewTestIptablesRestoreProvider()
+			i.restore = restore
+
+			ipl := policy.ExtendedMap{}
+			ipl[policy.DefaultNamespace] = "172.17.0.1"
+			policyrules := policy.NewPUPolicy("Context",
+				policy.Police,
+				rules,
+				rules,
+				nil,
+				nil,
+				nil,
+				nil, ipl, []string{"172.17.0.0/24"}, []string{})
+
+			containerinfo := policy.NewPUInfo("Context", constants.ContainerPU)
+			containerinfo.Policy = policyrules
+			containerinfo.Runtime = policy.NewPURuntimeWithDefaults()
+
+			Convey("When the new rules are restored", func() {
+				batches := []string{}
+				restore.MockRestore(t, func(data []byte) error {
+					batches = append(batches, string(data))
+					return nil
+				})
+
+				err := i.UpdateRules(1, "Context", containerinfo)
+				Convey("The previous version should be removed after the new one is added", func() {
+					So(err, ShouldBeNil)
+					So(len(batches), ShouldEqual, 4)
+					So(batches[1], ShouldContainSubstring, "-j TRIREME-App-Context-1\n")
+					So(batches[3], ShouldContainSubstring, "-D PREROUTING -s 172.17.0.1 -m comment --comment Container-specific-chain -j TRIREME-App-Context-0\n")
+					So(batches[3], ShouldContainSubstring, "-X TRIREME-Net-Context-0\n")
+				})
+			})
+
+			Convey("When the new rules cannot be restored", func() {
+				batches := []string{}
+				restore.MockRestore(t, func(data []byte) error {
+					batches = append(batches, string(data))
+					if strings.Contains(string(data), ":TRIREME-Net-Context-1") {
+						return fmt.Errorf("Error")
+					}
+					return nil
+				})
+
+				err := i.UpdateRules(1, "Context", containerinfo)
+				Convey("I should get an error and the previous version should be kept", func() {
+					So(err, ShouldNotBeNil)
+					for _, b := range batches {
+						So(b, ShouldNotContainSubstring, "Context-0")
+					}
+				})
+			})
+		})
+
+	})
+}
+
+func TestVerifyRules(t *testing.T) {
+	Convey("Given an iptables controller with the rules of a PU installed", t, func() {
+		i, _ := NewInstance(fqconfig.NewFilterQueueWithDefaults(), constants.LocalContainer)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+		i.restore = nil
+
+		installed := map[string][]string{}
+		iptables.MockNewChain(t, func(table string, chain string) error {
+			installed[table+"/"+chain] = []string{}
+			return nil
+		})
+		iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+			installed[table+"/"+chain] = append(installed[table+"/"+chain], strings.Join(rulespec, " "))
+			return nil
+		})
+		iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
+			installed[table+"/"+chain] = append([]string{strings.Join(rulespec, " ")}, installed[table+"/"+chain]...)
+			return nil
+		})
+		iptables.MockList(t, func(table string, chain string) ([]string, error) {
+			rules, ok := installed[table+"/"+chain]
+			if !ok {
+				return nil, fmt.Errorf("No chain/target/match by that name")
+			}
+			list := []string{"-N " + chain}
+			for _, rule := range rules {
+				list = append(list, "-A "+chain+" "+rule)
+			}
+			return list, nil
+		})
+		iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+			for _, rule := range installed[table+"/"+chain] {
+				if rule == strings.Join(rulespec, " ") {
+					return true, nil
+				}
+			}
+			return false, nil
+		})
+
+		rules := policy.IPRuleList{
+			policy.IPRule{
+				Address:  "192.30.253.0/24",
+				Port:     "80",
+				Protocol: "TCP",
+				Policy:   &policy.FlowPolicy{Action: policy.Reject},
+			},
+		}
+
+		ipl := policy.ExtendedMap{}
+		ipl[policy.DefaultNamespace] = "172.17.0.1"
+		policyrules := policy.NewPUPolicy("Context", policy.Police, rules, rules, nil, nil, nil, nil, ipl, []string{}, []string{"10.0.0.0/8"})
+
+		containerinfo := policy.NewPUInfo("Context", constants.ContainerPU)
+		containerinfo.Policy = policyrules
+		containerinfo.Runtime = policy.NewPURuntimeWithDefaults()
+
+		So(i.ConfigureRules(1, "Context", containerinfo), ShouldBeNil)
+
+		Convey("When nothing changed", func() {
+			drift, err := i.VerifyRules(1, "Context", containerinfo)
+
+			Convey("I should get no drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a chain of the PU is flushed", func() {
+			installed["mangle/TRIREME-Net-Context-1"] = []string{}
+			drift, err := i.VerifyRules(1, "Context", containerinfo)
+
+			Convey("I should get the chain in the drift", func() {
+				So(err, ShouldBeNil)
+				So(len(drift), ShouldEqual, 1)
+				So(drift[0], ShouldStartWith, "-t mangle -N TRIREME-Net-Context-1: 0 rules instead of")
+			})
+		})
+
+		Convey("When the chains of a table are deleted", func() {
+			delete(installed, "raw/TRIREME-App-Context-1")
+			installed["raw/PREROUTING"] = []string{}
+			drift, err := i.VerifyRules(1, "Context", containerinfo)
+
+			Convey("I should get the chain and the rules that send traffic to it in the drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldResemble, []string{
+					"-t raw -A PREROUTING -s 172.17.0.1 -m comment --comment Container-specific-chain -j TRIREME-App-Context-1: missing rule",
+					"-t raw -N TRIREME-App-Context-1: missing chain",
+				})
+			})
+		})
+
+		Convey("When I verify another version", func() {
+			drift, err := i.VerifyRules(0, "Context", containerinfo)
+
+			Convey("I should get all its chains in the drift", func() {
+				So(err, ShouldBeNil)
+				So(len(drift), ShouldBeGreaterThan, 3)
+			})
+		})
+
+		Convey("When a rule of a chain of the PU is replaced by another one", func() {
+			rules := installed["mangle/TRIREME-Net-Context-1"]
+			rules[len(rules)-1] = "-j ACCEPT"
+			drift, err := i.VerifyRules(1, "Context", containerinfo)
+
+			Convey("I should get the replaced rule in the drift", func() {
+				So(err, ShouldBeNil)
+				So(len(drift), ShouldEqual, 1)
+				So(drift[0], ShouldStartWith, "-t mangle -A TRIREME-Net-Context-1")
+				So(drift[0], ShouldEndWith, ": missing rule")
+			})
+		})
+	})
+}
+
+func TestRepairGlobalRules(t *testing.T) {
+	Convey("Given an iptables controller with its global rules installed", t, func() {
+		i, _ := NewInstance(fqconfig.NewFilterQueueWithDefaults(), constants.LocalContainer)
+		iptables := provider.NewTestIptablesProvider()
+		ipsets := provider.NewTestIpsetProvider()
+		i.ipt = iptables
+		i.ipset = ipsets
+		i.restore = nil
+
+		ipsets.MockNewIpset(t, func(name string, hasht string, p *ipset.Params) (provider.Ipset, error) {
+			testset := provider.NewTestIpset()
+			testset.MockAdd(t, func(entry string, timeout int) error {
+				return nil
+			})
+			return testset, nil
+		})
+
+		installed := map[string][]string{}
+		iptables.MockNewChain(t, func(table string, chain string) error {
+			installed[table+"/"+chain] = []string{}
+			return nil
+		})
+		iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
+			installed[table+"/"+chain] = append([]string{strings.Join(rulespec, " ")}, installed[table+"/"+chain]...)
+			return nil
+		})
+		iptables.MockDelete(t, func(table string, chain string, rulespec ...string) error {
+			rules := []string{}
+			for _, rule := range installed[table+"/"+chain] {
+				if rule != strings.Join(rulespec, " ") {
+					rules = append(rules, rule)
+				}
+			}
+			installed[table+"/"+chain] = rules
+			return nil
+		})
+		iptables.MockClearChain(t, func(table string, chain string) error {
+			installed[table+"/"+chain] = []string{}
+			return nil
+		})
+		iptables.MockList(t, func(table string, chain string) ([]string, error) {
+			if _, ok := installed[table+"/"+chain]; !ok {
+				return nil, fmt.Errorf("No chain/target/match by that name")
+			}
+			return []string{"-N " + chain}, nil
+		})
+		iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+			for _, rule := range installed[table+"/"+chain] {
+				if rule == strings.Join(rulespec, " ") {
+					return true, nil
+				}
+			}
+			return false, nil
+		})
+
+		So(i.Start(), ShouldBeNil)
+		So(i.SetTargetNetworks([]string{}, []string{"10.0.0.0/8"}), ShouldBeNil)
+
+		original := map[string][]string{}
+		for k, v := range installed {
+			original[k] = append([]string{}, v...)
+		}
+
+		Convey("When nothing changed", func() {
+			drift, err := i.RepairGlobalRules()
+
+			Convey("I should get no drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeEmpty)
+				So(installed, ShouldResemble, original)
+			})
+		})
+
+		Convey("When the SynAck capture and the connmark rules are removed", func() {
+			installed["mangle/PREROUTING"] = installed["mangle/PREROUTING"][2:]
+			drift, err := i.RepairGlobalRules()
+
+			Convey("They should be installed again in the same order", func() {
+				So(err, ShouldBeNil)
+				So(len(drift), ShouldEqual, 2)
+				So(installed, ShouldResemble, original)
+			})
+		})
+
+		Convey("When the mangle chains are flushed", func() {
+			installed["mangle/PREROUTING"] = []string{}
+			installed["mangle/POSTROUTING"] = []string{}
+			drift, err := i.RepairGlobalRules()
+
+			Convey("All the global rules should be installed again", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldNotBeEmpty)
+				So(installed, ShouldResemble, original)
+			})
+		})
 	})
 }
 
@@ -452,3 +834,126 @@ func TestStop(t *testing.T) {
 		})
 	})
 }
+
+func TestIPv6Rules(t *testing.T) {
+	Convey("Given an iptables controller on a host with ip6tables", t, func() {
+		i, _ := NewInstance(fqconfig.NewFilterQueueWithDefaults(), constants.LocalContainer)
+		iptables := provider.NewTestIptablesProvider()
+		ip6tables := provider.NewTestIptablesProvider()
+		ipsets := provider.NewTestIpsetProvider()
+		i.ipt = iptables
+		i.ip6t = ip6tables
+		i.restore = nil
+		i.restore6 = nil
+		i.ipset = ipsets
+
+		families := map[string]string{}
+		entries := map[string][]string{}
+		ipsets.MockNewIpset(t, func(name string, hasht string, p *ipset.Params) (provider.Ipset, error) {
+			families[name] = p.HashFamily
+			testset := provider.NewTestIpset()
+			testset.MockAdd(t, func(entry string, timeout int) error {
+				entries[name] = append(entries[name], entry)
+				return nil
+			})
+			return testset, nil
+		})
+
+		rules4 := [][]string{}
+		iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+			rules4 = append(rules4, rulespec)
+			return nil
+		})
+
+		rules6 := [][]string{}
+		ip6tables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+			rules6 = append(rules6, rulespec)
+			return nil
+		})
+		ip6tables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
+			rules6 = append(rules6, rulespec)
+			return nil
+		})
+
+		Convey("When I set IPv4 and IPv6 target networks", func() {
+			err := i.SetTargetNetworks([]string{}, []string{"10.0.0.0/8", "fd00::/8"})
+
+			Convey("I should get a set for every family", func() {
+				So(err, ShouldBeNil)
+				So(i.ipv6Instance, ShouldNotBeNil)
+				So(families[targetNetworkSet], ShouldEqual, "inet")
+				So(families[targetNetworkSet6], ShouldEqual, "inet6")
+				So(entries[targetNetworkSet], ShouldResemble, []string{"10.0.0.0/8"})
+				So(entries[targetNetworkSet6], ShouldResemble, []string{"fd00::/8"})
+			})
+
+			Convey("When I configure a PU with an IPv4 and an IPv6 address", func() {
+				acls := policy.IPRuleList{
+					policy.IPRule{
+						Address:  "192.30.253.0/24",
+						Port:     "443",
+						Protocol: "TCP",
+						Policy:   &policy.FlowPolicy{Action: policy.Accept},
+					},
+					policy.IPRule{
+						Address:  "2001:db8::/32",
+						Port:     "443",
+						Protocol: "TCP",
+						Policy:   &policy.FlowPolicy{Action: policy.Accept},
+					},
+				}
+
+				ipl := policy.ExtendedMap{
+					policy.DefaultNamespace:     "172.17.0.1",
+					policy.DefaultNamespaceIPv6: "fd00::1",
+				}
+				policyrules := policy.NewPUPolicy("Context", policy.Police, acls, acls, nil, nil, nil, nil, ipl, []string{}, []string{})
+
+				containerinfo := policy.NewPUInfo("Context", constants.ContainerPU)
+				containerinfo.Policy = policyrules
+				containerinfo.Runtime = policy.NewPURuntimeWithDefaults()
+
+				rules4 = [][]string{}
+				rules6 = [][]string{}
+				err := i.ConfigureRules(1, "Context", containerinfo)
+
+				Convey("Every family should only get the rules of its addresses", func() {
+					So(err, ShouldBeNil)
+					So(len(rules6), ShouldBeGreaterThan, 0)
+
+					for _, rule := range rules4 {
+						So(matchSpec("2001:db8::/32", rule), ShouldNotBeNil)
+						So(matchSpec("fd00::1", rule), ShouldNotBeNil)
+					}
+
+					for _, rule := range rules6 {
+						So(matchSpec("192.30.253.0/24", rule), ShouldNotBeNil)
+						So(matchSpec("172.17.0.1", rule), ShouldNotBeNil)
+						So(matchSpec(targetNetworkSet, rule), ShouldNotBeNil)
+					}
+				})
+			})
+		})
+
+		Convey("When I set no target networks", func() {
+			err := i.SetTargetNetworks([]string{}, []string{})
+
+			Convey("The whole IPv4 and IPv6 address spaces should be targets", func() {
+				So(err, ShouldBeNil)
+				So(i.ipv6Instance, ShouldNotBeNil)
+				So(entries[targetNetworkSet], ShouldResemble, []string{"0.0.0.0/1", "128.0.0.0/1"})
+				So(entries[targetNetworkSet6], ShouldResemble, []string{"::/1", "8000::/1"})
+			})
+		})
+
+		Convey("When I only set IPv4 target networks", func() {
+			err := i.SetTargetNetworks([]string{}, []string{"10.0.0.0/8"})
+
+			Convey("The IPv6 controller should not be started", func() {
+				So(err, ShouldBeNil)
+				So(i.ipv6Instance, ShouldBeNil)
+				So(len(rules6), ShouldEqual, 0)
+			})
+		})
+	})
+}
@@ -0,0 +1,578 @@
+package nftablesctrl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"go.uber.org/zap"
+
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/utils/fqconfig"
+	"github.com/aporeto-inc/trireme/monitor/linuxmonitor/cgnetcls"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor/provider"
+)
+
+const (
+	tableName         = "trireme"
+	uidchain          = "UIDCHAIN"
+	appRawChainPrefix = "AppRaw-"
+	appChainPrefix    = "App-"
+	netChainPrefix    = "Net-"
+	appRawHookChain   = "app-raw"
+	appHookChain      = "app"
+	netHookChain      = "net"
+	targetNetworkSet  = "TargetNetSet"
+	targetNetworkSet6 = "TargetNetSet6"
+)
+
+// Instance is the structure holding all information about an nftables
+// implementation. All the rules live in a dedicated inet table, so that
+// IPv4 and IPv6 are handled by the same chains and the rules of other
+// tables are never touched.
+type Instance struct {
+	fqc        *fqconfig.FilterQueue
+	queues     *queues
+	nft        provider.NftablesProvider
+	mode       constants.ModeType
+	table      *nftables.Table
+	appRawHook *nftables.Chain
+	appHook    *nftables.Chain
+	netHook    *nftables.Chain
+	uidChain   *nftables.Chain
+	targetSet  *nftables.Set
+	targetSet6 *nftables.Set
+	sync.Mutex
+}
+
+// NewInstance creates a new nftables controller instance
+func NewInstance(fqc *fqconfig.FilterQueue, mode constants.ModeType) (*Instance, error) {
+
+	nft, err := provider.NewGoNftablesProvider()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot initialize nftables provider: %s", err)
+	}
+
+	return newInstance(fqc, mode, nft)
+}
+
+// newInstance creates the controller with the given provider
+func newInstance(fqc *fqconfig.FilterQueue, mode constants.ModeType, nft provider.NftablesProvider) (*Instance, error) {
+
+	q, err := parseQueues(
+		fqc.GetApplicationQueueSynStr(),
+		fqc.GetApplicationQueueAckStr(),
+		fqc.GetApplicationQueueSynAckStr(),
+		fqc.GetNetworkQueueSynStr(),
+		fqc.GetNetworkQueueAckStr(),
+		fqc.GetNetworkQueueSynAckStr(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &nftables.Table{
+		Name:   tableName,
+		Family: nftables.TableFamilyINet,
+	}
+
+	i := &Instance{
+		fqc:    fqc,
+		queues: q,
+		nft:    nft,
+		mode:   mode,
+		table:  table,
+		targetSet: &nftables.Set{
+			Table:    table,
+			Name:     targetNetworkSet,
+			KeyType:  nftables.TypeIPAddr,
+			Interval: true,
+		},
+		targetSet6: &nftables.Set{
+			Table:    table,
+			Name:     targetNetworkSet6,
+			KeyType:  nftables.TypeIP6Addr,
+			Interval: true,
+		},
+	}
+
+	if mode == constants.LocalServer || mode == constants.RemoteContainer {
+		i.appHook = baseChain(table, appHookChain, nftables.ChainHookOutput, nftables.ChainPriorityMangle)
+		i.netHook = baseChain(table, netHookChain, nftables.ChainHookInput, nftables.ChainPriorityMangle)
+	} else {
+		i.appRawHook = baseChain(table, appRawHookChain, nftables.ChainHookPrerouting, nftables.ChainPriorityRaw)
+		i.appHook = baseChain(table, appHookChain, nftables.ChainHookPrerouting, nftables.ChainPriorityMangle)
+		i.netHook = baseChain(table, netHookChain, nftables.ChainHookPostrouting, nftables.ChainPriorityMangle)
+	}
+
+	if mode == constants.LocalServer {
+		i.uidChain = &nftables.Chain{Table: table, Name: uidchain}
+	}
+
+	return i, nil
+}
+
+// baseChain returns a filter chain attached to the given hook
+func baseChain(table *nftables.Table, name string, hook *nftables.ChainHook, priority *nftables.ChainPriority) *nftables.Chain {
+	return &nftables.Chain{
+		Table:    table,
+		Name:     name,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  hook,
+		Priority: priority,
+	}
+}
+
+// puChains holds the chains of a specific version of a PU
+type puChains struct {
+	appRaw *nftables.Chain
+	app    *nftables.Chain
+	net    *nftables.Chain
+}
+
+// list returns the chains that exist in the current mode
+func (c *puChains) list() []*nftables.Chain {
+
+	if c.appRaw == nil {
+		return []*nftables.Chain{c.app, c.net}
+	}
+
+	return []*nftables.Chain{c.appRaw, c.app, c.net}
+}
+
+// chainName returns the chain names for the specific PU
+func (i *Instance) chainName(contextID string, version int) (app, net string) {
+	app = appChainPrefix + contextID + "-" + strconv.Itoa(version)
+	net = netChainPrefix + contextID + "-" + strconv.Itoa(version)
+	return app, net
+}
+
+// puChains returns the chains of the specific PU
+func (i *Instance) puChains(contextID string, version int) *puChains {
+
+	app, net := i.chainName(contextID, version)
+
+	c := &puChains{
+		app: &nftables.Chain{Table: i.table, Name: app},
+		net: &nftables.Chain{Table: i.table, Name: net},
+	}
+
+	if i.mode == constants.LocalContainer {
+		c.appRaw = &nftables.Chain{Table: i.table, Name: appRawChainPrefix + contextID + "-" + strconv.Itoa(version)}
+	}
+
+	return c
+}
+
+// defaultIPs returns the IPv4 and IPv6 addresses of the processing unit. An
+// empty list means that the chains apply to any address.
+func (i *Instance) defaultIPs(addresslist map[string]string) ([]string, error) {
+
+	ips := []string{}
+	for _, namespace := range []string{policy.DefaultNamespace, policy.DefaultNamespaceIPv6} {
+		if ip, ok := addresslist[namespace]; ok && len(ip) > 0 {
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 && i.mode == constants.LocalContainer {
+		return nil, fmt.Errorf("No ip address found")
+	}
+
+	return ips, nil
+}
+
+// puRules returns the PU chains and all the rules of a processing unit,
+// including the rules that dispatch traffic to its chains
+func (i *Instance) puRules(version int, contextID string, containerInfo *policy.PUInfo) (*puChains, []*nftables.Rule, error) {
+
+	if containerInfo == nil {
+		return nil, nil, fmt.Errorf("Container info cannot be nil")
+	}
+
+	policyrules := containerInfo.Policy
+	if policyrules == nil {
+		return nil, nil, fmt.Errorf("Policy rules cannot be nil")
+	}
+
+	ips, err := i.defaultIPs(policyrules.IPAddresses())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chains := i.puChains(contextID, version)
+
+	rules := i.trapRules(chains, policyrules.FailurePolicy().FailsOpen(i.fqc.FailOpen))
+
+	audit := policyrules.TriremeAction() == policy.Monitor
+
+	appACLs, err := i.aclRules(contextID, chains.app, true, policyrules.ApplicationACLs(), audit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	netACLs, err := i.aclRules(contextID, chains.net, false, policyrules.NetworkACLs(), audit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exclusions, err := i.exclusionRules(chains, ips, policyrules.ExcludedNetworks())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Exclusions and rejects are evaluated before the packets are trapped
+	rules = append(appACLs.rejects, rules...)
+	rules = append(netACLs.rejects, rules...)
+	rules = append(exclusions, rules...)
+	rules = append(rules, appACLs.accepts...)
+	rules = append(rules, netACLs.accepts...)
+
+	if i.mode != constants.LocalServer {
+		dispatch, err := i.chainRules(chains, ips)
+		if err != nil {
+			return nil, nil, err
+		}
+		return chains, append(rules, dispatch...), nil
+	}
+
+	mark, ok := containerInfo.Runtime.Options().Get(cgnetcls.CgroupMarkTag)
+	if !ok {
+		return nil, nil, fmt.Errorf("No Mark value found")
+	}
+
+	port, ok := containerInfo.Runtime.Options().Get(cgnetcls.PortTag)
+	if !ok {
+		port = "0"
+	}
+
+	uid, ok := containerInfo.Runtime.Options().Get("USER")
+	if !ok {
+		uid = ""
+	}
+
+	var dispatch []*nftables.Rule
+	if port != "0" || uid == "" {
+		dispatch, err = i.cgroupChainRules(chains, mark, port)
+	} else {
+		dispatch, err = i.uidChainRules(chains, mark, uid)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return chains, append(rules, dispatch...), nil
+}
+
+// addPU queues the creation of the PU chains and rules
+func (i *Instance) addPU(chains *puChains, rules []*nftables.Rule) {
+
+	for _, c := range chains.list() {
+		i.nft.AddChain(c)
+	}
+
+	for _, r := range rules {
+		i.nft.AddRule(r)
+	}
+}
+
+// staleRules returns the existing chains among the given PU chains and the
+// rules that jump to them. It only reads the kernel state, so it must be
+// called before anything is queued.
+func (i *Instance) staleRules(chains *puChains) ([]*nftables.Chain, []*nftables.Rule, error) {
+
+	existing, err := i.nft.ListChains()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to list chains: %s", err)
+	}
+
+	names := map[string]bool{}
+	for _, c := range existing {
+		if c.Table != nil && c.Table.Name == i.table.Name {
+			names[c.Name] = true
+		}
+	}
+
+	targets := map[string]bool{}
+	stale := []*nftables.Chain{}
+	for _, c := range chains.list() {
+		if names[c.Name] {
+			targets[c.Name] = true
+			stale = append(stale, c)
+		}
+	}
+
+	if len(stale) == 0 {
+		return nil, nil, nil
+	}
+
+	dispatch := []*nftables.Rule{}
+	for _, hook := range i.dispatchChains() {
+		if !names[hook.Name] {
+			continue
+		}
+
+		rules, err := i.nft.GetRules(i.table, hook)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to list rules of chain %s: %s", hook.Name, err)
+		}
+
+		for _, r := range rules {
+			if targets[jumpTarget(r)] {
+				r.Table = i.table
+				r.Chain = hook
+				dispatch = append(dispatch, r)
+			}
+		}
+	}
+
+	return stale, dispatch, nil
+}
+
+// deletePU queues the removal of the dispatch rules and then of the chains
+func (i *Instance) deletePU(chains []*nftables.Chain, dispatch []*nftables.Rule) error {
+
+	for _, r := range dispatch {
+		if err := i.nft.DelRule(r); err != nil {
+			return fmt.Errorf("Failed to delete rule of chain %s: %s", r.Chain.Name, err)
+		}
+	}
+
+	for _, c := range chains {
+		i.nft.FlushChain(c)
+		i.nft.DelChain(c)
+	}
+
+	return nil
+}
+
+// dispatchChains returns the chains that hold the rules sending traffic
+// to the PU chains
+func (i *Instance) dispatchChains() []*nftables.Chain {
+
+	chains := []*nftables.Chain{}
+	for _, c := range []*nftables.Chain{i.appRawHook, i.appHook, i.netHook, i.uidChain} {
+		if c != nil {
+			chains = append(chains, c)
+		}
+	}
+
+	return chains
+}
+
+// jumpTarget returns the chain a rule jumps to, if any
+func jumpTarget(r *nftables.Rule) string {
+
+	if len(r.Exprs) == 0 {
+		return ""
+	}
+
+	if v, ok := r.Exprs[len(r.Exprs)-1].(*expr.Verdict); ok && v.Kind == expr.VerdictJump {
+		return v.Chain
+	}
+
+	return ""
+}
+
+// ConfigureRules implements the ConfigureRules interface. The chains and the
+// rules of the PU are created in one transaction.
+func (i *Instance) ConfigureRules(version int, contextID string, containerInfo *policy.PUInfo) error {
+
+	chains, rules, err := i.puRules(version, contextID, containerInfo)
+	if err != nil {
+		return err
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	i.addPU(chains, rules)
+
+	if err := i.nft.Flush(); err != nil {
+		return fmt.Errorf("Failed to configure the rules of %s: %s", contextID, err)
+	}
+
+	return nil
+}
+
+// UpdateRules implements the update part of the interface. The new chains
+// are created and the old ones removed in one transaction, so that there is
+// no window in which the PU has no or partial rules.
+func (i *Instance) UpdateRules(version int, contextID string, containerInfo *policy.PUInfo) error {
+
+	chains, rules, err := i.puRules(version, contextID, containerInfo)
+	if err != nil {
+		return err
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	oldChains, oldRules, err := i.staleRules(i.puChains(contextID, version^1))
+	if err != nil {
+		return err
+	}
+
+	i.addPU(chains, rules)
+
+	if err := i.deletePU(oldChains, oldRules); err != nil {
+		i.nft.Abort()
+		return err
+	}
+
+	if err := i.nft.Flush(); err != nil {
+		return fmt.Errorf("Failed to update the rules of %s: %s", contextID, err)
+	}
+
+	return nil
+}
+
+// DeleteRules implements the DeleteRules interface. The rules that send
+// traffic to the PU are found from the chains they jump to, so the addresses,
+// port, mark and uid are not needed.
+func (i *Instance) DeleteRules(version int, contextID string, ipAddresses policy.ExtendedMap, port string, mark string, uid string) error {
+
+	if i.mode != constants.LocalServer && ipAddresses == nil {
+		return fmt.Errorf("Provided map of IP addresses is nil")
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	chains, rules, err := i.staleRules(i.puChains(contextID, version))
+	if err != nil {
+		zap.L().Warn("Failed to clean rules", zap.Error(err))
+		return nil
+	}
+
+	if err := i.deletePU(chains, rules); err != nil {
+		i.nft.Abort()
+		zap.L().Warn("Failed to clean rules", zap.Error(err))
+		return nil
+	}
+
+	if err := i.nft.Flush(); err != nil {
+		zap.L().Warn("Failed to clean container chains while deleting the rules", zap.Error(err))
+	}
+
+	return nil
+}
+
+// Start starts the nftables controller. It replaces any previous trireme
+// table with the base chains, the target network sets and the global rules.
+func (i *Instance) Start() error {
+
+	i.Lock()
+	defer i.Unlock()
+
+	if err := i.queueTableCleanup(); err != nil {
+		zap.L().Warn("Failed to clean previous table while starting the supervisor", zap.Error(err))
+	}
+
+	i.nft.AddTable(i.table)
+
+	for _, c := range i.dispatchChains() {
+		i.nft.AddChain(c)
+	}
+
+	for _, s := range []*nftables.Set{i.targetSet, i.targetSet6} {
+		if err := i.nft.AddSet(s, nil); err != nil {
+			i.nft.Abort()
+			return fmt.Errorf("Failed to add set %s: %s", s.Name, err)
+		}
+	}
+
+	for _, r := range i.globalRules() {
+		i.nft.AddRule(r)
+	}
+
+	if err := i.nft.Flush(); err != nil {
+		return fmt.Errorf("Failed to start the nftables controller: %s", err)
+	}
+
+	zap.L().Debug("Started the nftables controller")
+
+	return nil
+}
+
+// queueTableCleanup queues the removal of the trireme table if it exists
+func (i *Instance) queueTableCleanup() error {
+
+	tables, err := i.nft.ListTables()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tables {
+		if t.Name == i.table.Name && t.Family == i.table.Family {
+			i.nft.DelTable(i.table)
+		}
+	}
+
+	return nil
+}
+
+// SetTargetNetworks updates the target networks. Both sets are rewritten in
+// one transaction, so the current networks are not needed.
+func (i *Instance) SetTargetNetworks(current, networks []string) error {
+
+	if len(networks) == 0 {
+		networks = []string{"0.0.0.0/1", "128.0.0.0/1", "::/0"}
+	}
+
+	elements, elements6, err := targetElements(networks)
+	if err != nil {
+		return err
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	i.nft.FlushSet(i.targetSet)
+	i.nft.FlushSet(i.targetSet6)
+
+	if err := i.nft.SetAddElements(i.targetSet, elements); err != nil {
+		i.nft.Abort()
+		return fmt.Errorf("Failed to add target networks: %s", err)
+	}
+
+	if err := i.nft.SetAddElements(i.targetSet6, elements6); err != nil {
+		i.nft.Abort()
+		return fmt.Errorf("Failed to add IPv6 target networks: %s", err)
+	}
+
+	if err := i.nft.Flush(); err != nil {
+		return fmt.Errorf("Failed to update target networks: %s", err)
+	}
+
+	return nil
+}
+
+// Stop stops the supervisor and removes the trireme table
+func (i *Instance) Stop() error {
+
+	zap.L().Debug("Stop the supervisor")
+
+	i.Lock()
+	defer i.Unlock()
+
+	if err := i.queueTableCleanup(); err != nil {
+		zap.L().Error("Failed to list tables while stopping the supervisor", zap.Error(err))
+		return nil
+	}
+
+	if err := i.nft.Flush(); err != nil {
+		zap.L().Error("Failed to clean the table while stopping the supervisor", zap.Error(err))
+	}
+
+	return nil
+}
+
+// isIPv6 returns true if the address or network is an IPv6 one
+func isIPv6(address string) bool {
+	return strings.Contains(address, ":")
+}
@@ -0,0 +1,720 @@
+package nftablesctrl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/utils/fqconfig"
+	"github.com/aporeto-inc/trireme/monitor/linuxmonitor/cgnetcls"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// fakeState is the kernel state of the fake provider
+type fakeState struct {
+	table  bool
+	chains map[string][]*nftables.Rule
+	sets   map[string][]nftables.SetElement
+}
+
+func (s *fakeState) copy() *fakeState {
+
+	c := &fakeState{
+		table:  s.table,
+		chains: map[string][]*nftables.Rule{},
+		sets:   map[string][]nftables.SetElement{},
+	}
+
+	for name, rules := range s.chains {
+		c.chains[name] = append([]*nftables.Rule{}, rules...)
+	}
+
+	for name, elements := range s.sets {
+		c.sets[name] = append([]nftables.SetElement{}, elements...)
+	}
+
+	return c
+}
+
+// referenced returns true if a rule jumps to the chain
+func (s *fakeState) referenced(chain string) bool {
+
+	for _, rules := range s.chains {
+		for _, r := range rules {
+			if jumpTarget(r) == chain {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// fakeNftables is an in memory provider applying the batches atomically
+type fakeNftables struct {
+	state     *fakeState
+	pending   []func(*fakeState) error
+	handle    uint64
+	flushes   int
+	flushErr  error
+	listError error
+}
+
+func newFakeNftables() *fakeNftables {
+	return &fakeNftables{
+		state: &fakeState{
+			chains: map[string][]*nftables.Rule{},
+			sets:   map[string][]nftables.SetElement{},
+		},
+	}
+}
+
+func (f *fakeNftables) queue(op func(*fakeState) error) {
+	f.pending = append(f.pending, op)
+}
+
+func (f *fakeNftables) ListTables() ([]*nftables.Table, error) {
+
+	if !f.state.table {
+		return []*nftables.Table{}, f.listError
+	}
+
+	return []*nftables.Table{{Name: tableName, Family: nftables.TableFamilyINet}}, f.listError
+}
+
+func (f *fakeNftables) AddTable(t *nftables.Table) *nftables.Table {
+	f.queue(func(s *fakeState) error {
+		s.table = true
+		return nil
+	})
+	return t
+}
+
+func (f *fakeNftables) DelTable(t *nftables.Table) {
+	f.queue(func(s *fakeState) error {
+		if !s.table {
+			return fmt.Errorf("no such table")
+		}
+		s.table = false
+		s.chains = map[string][]*nftables.Rule{}
+		s.sets = map[string][]nftables.SetElement{}
+		return nil
+	})
+}
+
+func (f *fakeNftables) ListChains() ([]*nftables.Chain, error) {
+
+	chains := []*nftables.Chain{}
+	table := &nftables.Table{Name: tableName, Family: nftables.TableFamilyINet}
+	for name := range f.state.chains {
+		chains = append(chains, &nftables.Chain{Name: name, Table: table})
+	}
+
+	return chains, f.listError
+}
+
+func (f *fakeNftables) AddChain(c *nftables.Chain) *nftables.Chain {
+	f.queue(func(s *fakeState) error {
+		if !s.table {
+			return fmt.Errorf("no such table")
+		}
+		if _, ok := s.chains[c.Name]; !ok {
+			s.chains[c.Name] = []*nftables.Rule{}
+		}
+		return nil
+	})
+	return c
+}
+
+func (f *fakeNftables) FlushChain(c *nftables.Chain) {
+	f.queue(func(s *fakeState) error {
+		if _, ok := s.chains[c.Name]; !ok {
+			return fmt.Errorf("no such chain %s", c.Name)
+		}
+		s.chains[c.Name] = []*nftables.Rule{}
+		return nil
+	})
+}
+
+func (f *fakeNftables) DelChain(c *nftables.Chain) {
+	f.queue(func(s *fakeState) error {
+		if rules, ok := s.chains[c.Name]; !ok || len(rules) > 0 {
+			return fmt.Errorf("cannot delete chain %s", c.Name)
+		}
+		if s.referenced(c.Name) {
+			return fmt.Errorf("chain %s is busy", c.Name)
+		}
+		delete(s.chains, c.Name)
+		return nil
+	})
+}
+
+func (f *fakeNftables) GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+
+	rules := []*nftables.Rule{}
+	for _, r := range f.state.chains[c.Name] {
+		copied := *r
+		rules = append(rules, &copied)
+	}
+
+	return rules, f.listError
+}
+
+func (f *fakeNftables) AddRule(r *nftables.Rule) *nftables.Rule {
+	f.queue(func(s *fakeState) error {
+		if _, ok := s.chains[r.Chain.Name]; !ok {
+			return fmt.Errorf("no such chain %s", r.Chain.Name)
+		}
+		if target := jumpTarget(r); target != "" {
+			if _, ok := s.chains[target]; !ok {
+				return fmt.Errorf("no such chain %s", target)
+			}
+		}
+		f.handle++
+		added := *r
+		added.Handle = f.handle
+		s.chains[r.Chain.Name] = append(s.chains[r.Chain.Name], &added)
+		return nil
+	})
+	return r
+}
+
+func (f *fakeNftables) DelRule(r *nftables.Rule) error {
+	f.queue(func(s *fakeState) error {
+		rules := s.chains[r.Chain.Name]
+		for idx, existing := range rules {
+			if existing.Handle == r.Handle {
+				s.chains[r.Chain.Name] = append(rules[:idx:idx], rules[idx+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("no such rule %d", r.Handle)
+	})
+	return nil
+}
+
+func (f *fakeNftables) AddSet(set *nftables.Set, vals []nftables.SetElement) error {
+	f.queue(func(s *fakeState) error {
+		s.sets[set.Name] = append([]nftables.SetElement{}, vals...)
+		return nil
+	})
+	return nil
+}
+
+func (f *fakeNftables) FlushSet(set *nftables.Set) {
+	f.queue(func(s *fakeState) error {
+		s.sets[set.Name] = []nftables.SetElement{}
+		return nil
+	})
+}
+
+func (f *fakeNftables) SetAddElements(set *nftables.Set, vals []nftables.SetElement) error {
+	f.queue(func(s *fakeState) error {
+		if _, ok := s.sets[set.Name]; !ok {
+			return fmt.Errorf("no such set %s", set.Name)
+		}
+		s.sets[set.Name] = append(s.sets[set.Name], vals...)
+		return nil
+	})
+	return nil
+}
+
+func (f *fakeNftables) Flush() error {
+
+	pending := f.pending
+	f.pending = nil
+	f.flushes++
+
+	if f.flushErr != nil {
+		return f.flushErr
+	}
+
+	next := f.state.copy()
+	for _, op := range pending {
+		if err := op(next); err != nil {
+			return err
+		}
+	}
+
+	f.state = next
+
+	return nil
+}
+
+func (f *fakeNftables) Abort() {
+	f.pending = nil
+}
+
+// jumps returns the chains the rules of a chain jump to
+func (f *fakeNftables) jumps(chain string) []string {
+
+	targets := []string{}
+	for _, r := range f.state.chains[chain] {
+		if target := jumpTarget(r); target != "" {
+			targets = append(targets, target)
+		}
+	}
+
+	return targets
+}
+
+// findExpr returns the index of the first rule of the chain holding the expression
+func (f *fakeNftables) findExpr(chain string, e expr.Any) int {
+
+	for idx, r := range f.state.chains[chain] {
+		for _, re := range r.Exprs {
+			if fmt.Sprintf("%#v", re) == fmt.Sprintf("%#v", e) {
+				return idx
+			}
+		}
+	}
+
+	return -1
+}
+
+func newTestInstance(mode constants.ModeType) (*Instance, *fakeNftables) {
+
+	f := newFakeNftables()
+	i, err := newInstance(fqconfig.NewFilterQueueWithDefaults(), mode, f)
+	So(err, ShouldBeNil)
+
+	return i, f
+}
+
+func testPUInfo(contextID string, ips policy.ExtendedMap) *policy.PUInfo {
+
+	puInfo := policy.NewPUInfo(contextID, constants.ContainerPU)
+	puInfo.Policy.SetIPAddresses(ips)
+
+	return puInfo
+}
+
+func TestNewInstance(t *testing.T) {
+
+	Convey("When I create a local container nftables instance", t, func() {
+		i, _ := newTestInstance(constants.LocalContainer)
+
+		Convey("Then the app chains should hook prerouting and the net chain postrouting", func() {
+			So(i.appRawHook.Hooknum, ShouldEqual, nftables.ChainHookPrerouting)
+			So(i.appRawHook.Priority, ShouldEqual, nftables.ChainPriorityRaw)
+			So(i.appHook.Hooknum, ShouldEqual, nftables.ChainHookPrerouting)
+			So(i.netHook.Hooknum, ShouldEqual, nftables.ChainHookPostrouting)
+			So(i.uidChain, ShouldBeNil)
+		})
+	})
+
+	Convey("When I create a remote container nftables instance", t, func() {
+		i, _ := newTestInstance(constants.RemoteContainer)
+
+		Convey("Then the app chain should hook output and the net chain input", func() {
+			So(i.appRawHook, ShouldBeNil)
+			So(i.appHook.Hooknum, ShouldEqual, nftables.ChainHookOutput)
+			So(i.netHook.Hooknum, ShouldEqual, nftables.ChainHookInput)
+		})
+	})
+
+	Convey("When I create an instance with an invalid queue configuration", t, func() {
+		fqc := fqconfig.NewFilterQueueWithDefaults()
+		fqc.ApplicationQueuesSynStr = "4:2"
+		_, err := newInstance(fqc, constants.LocalContainer, newFakeNftables())
+
+		Convey("Then I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestChainName(t *testing.T) {
+
+	Convey("When I test the creation of the name of the chain", t, func() {
+		i, _ := newTestInstance(constants.LocalContainer)
+		app, net := i.chainName("Context", 1)
+
+		Convey("I should get the right names", func() {
+			So(app, ShouldEqual, "App-Context-1")
+			So(net, ShouldEqual, "Net-Context-1")
+		})
+	})
+}
+
+func TestStart(t *testing.T) {
+
+	Convey("Given a local container nftables instance", t, func() {
+		i, f := newTestInstance(constants.LocalContainer)
+
+		Convey("When I start it", func() {
+			So(i.Start(), ShouldBeNil)
+
+			Convey("Then the table, base chains and sets should be created in one transaction", func() {
+				So(f.flushes, ShouldEqual, 1)
+				So(f.state.table, ShouldBeTrue)
+				So(f.state.chains, ShouldContainKey, appRawHookChain)
+				So(f.state.chains, ShouldContainKey, appHookChain)
+				So(f.state.chains, ShouldContainKey, netHookChain)
+				So(f.state.sets, ShouldContainKey, targetNetworkSet)
+				So(f.state.sets, ShouldContainKey, targetNetworkSet6)
+			})
+
+			Convey("Then the SynAck packets should be queued with bypass", func() {
+				So(f.findExpr(appHookChain, &expr.Queue{Num: 8, Total: 4, Flag: expr.QueueFlagBypass}), ShouldBeGreaterThanOrEqualTo, 0)
+				So(f.findExpr(netHookChain, &expr.Queue{Num: 24, Total: 4, Flag: expr.QueueFlagBypass}), ShouldBeGreaterThanOrEqualTo, 0)
+			})
+
+			Convey("When I start it again, the previous table should be replaced", func() {
+				f.state.chains["App-stale-0"] = []*nftables.Rule{}
+				So(i.Start(), ShouldBeNil)
+				So(f.state.chains, ShouldNotContainKey, "App-stale-0")
+				So(f.state.chains, ShouldContainKey, appHookChain)
+			})
+
+			Convey("When I stop it, the table should be removed", func() {
+				So(i.Stop(), ShouldBeNil)
+				So(f.state.table, ShouldBeFalse)
+				So(f.state.chains, ShouldBeEmpty)
+			})
+		})
+	})
+
+	Convey("Given a linux process nftables instance", t, func() {
+		i, f := newTestInstance(constants.LocalServer)
+
+		Convey("When I start it, the app chain should first jump to the uid chain", func() {
+			So(i.Start(), ShouldBeNil)
+			So(f.state.chains, ShouldContainKey, uidchain)
+			So(f.jumps(appHookChain), ShouldResemble, []string{uidchain})
+		})
+	})
+}
+
+func TestSetTargetNetworks(t *testing.T) {
+
+	Convey("Given a started nftables instance", t, func() {
+		i, f := newTestInstance(constants.LocalContainer)
+		So(i.Start(), ShouldBeNil)
+
+		Convey("When I set no target networks", func() {
+			So(i.SetTargetNetworks(nil, nil), ShouldBeNil)
+
+			Convey("Then the whole IPv4 and IPv6 address spaces should be a target", func() {
+				So(f.state.sets[targetNetworkSet], ShouldResemble, []nftables.SetElement{
+					{Key: net.IP{0, 0, 0, 0}},
+					{Key: net.IP{128, 0, 0, 0}, IntervalEnd: true},
+					{Key: net.IP{128, 0, 0, 0}},
+				})
+				So(f.state.sets[targetNetworkSet6], ShouldResemble, []nftables.SetElement{
+					{Key: net.IPv6zero},
+				})
+			})
+		})
+
+		Convey("When I update the target networks", func() {
+			So(i.SetTargetNetworks(nil, []string{"10.0.0.0/8"}), ShouldBeNil)
+			So(i.SetTargetNetworks([]string{"10.0.0.0/8"}, []string{"172.17.0.0/16", "fd00::/8"}), ShouldBeNil)
+
+			Convey("Then the sets should only hold the new networks", func() {
+				So(f.state.sets[targetNetworkSet], ShouldResemble, []nftables.SetElement{
+					{Key: net.IP{172, 17, 0, 0}},
+					{Key: net.IP{172, 18, 0, 0}, IntervalEnd: true},
+				})
+				So(len(f.state.sets[targetNetworkSet6]), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When I set an invalid network", func() {
+			flushes := f.flushes
+			err := i.SetTargetNetworks(nil, []string{"10.0.0.0/33"})
+
+			Convey("Then I should get an error and nothing should be sent", func() {
+				So(err, ShouldNotBeNil)
+				So(f.flushes, ShouldEqual, flushes)
+			})
+		})
+	})
+}
+
+func TestConfigureRules(t *testing.T) {
+
+	Convey("Given a started local container nftables instance", t, func() {
+		i, f := newTestInstance(constants.LocalContainer)
+		So(i.Start(), ShouldBeNil)
+
+		puInfo := testPUInfo("pu", policy.ExtendedMap{policy.DefaultNamespace: "172.17.0.2"})
+
+		Convey("When I configure the rules of a PU", func() {
+			flushes := f.flushes
+			So(i.ConfigureRules(0, "pu", puInfo), ShouldBeNil)
+
+			Convey("Then the chains and the dispatch rules should be created in one transaction", func() {
+				So(f.flushes, ShouldEqual, flushes+1)
+				So(f.state.chains, ShouldContainKey, "AppRaw-pu-0")
+				So(f.state.chains, ShouldContainKey, "App-pu-0")
+				So(f.state.chains, ShouldContainKey, "Net-pu-0")
+				So(f.jumps(appRawHookChain), ShouldResemble, []string{"AppRaw-pu-0"})
+				So(f.jumps(appHookChain), ShouldResemble, []string{"App-pu-0"})
+				So(f.jumps(netHookChain), ShouldResemble, []string{"Net-pu-0"})
+			})
+
+			Convey("Then the SYN packets should be trapped to the SYN queues", func() {
+				So(f.findExpr("AppRaw-pu-0", &expr.Queue{Num: 0, Total: 4}), ShouldEqual, 0)
+				So(f.findExpr("Net-pu-0", &expr.Queue{Num: 16, Total: 4}), ShouldBeGreaterThanOrEqualTo, 0)
+			})
+
+			Convey("Then the packet counter should be compared in big endian", func() {
+				first := matchFirstPackets()
+				So(first, ShouldResemble, []expr.Any{
+					&expr.Ct{Key: expr.CtKeyPKTS, Register: 1},
+					&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 8, Size: 8},
+					&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: []byte{0, 0, 0, 0, 0, 0, 0, 6}},
+				})
+				So(f.findExpr("App-pu-0", first[1]), ShouldBeGreaterThanOrEqualTo, 0)
+				So(f.findExpr("Net-pu-0", first[2]), ShouldBeGreaterThanOrEqualTo, 0)
+			})
+
+			Convey("Then the chains should end with the default log and drop", func() {
+				rules := f.state.chains["App-pu-0"]
+				So(rules[len(rules)-2].Exprs[len(rules[len(rules)-2].Exprs)-1], ShouldResemble, nflog(appNFLogGroup, "pu:default:defaultr")[0])
+				So(rules[len(rules)-1].Exprs, ShouldResemble, drop())
+			})
+
+			Convey("When I delete the rules", func() {
+				So(i.DeleteRules(0, "pu", puInfo.Policy.IPAddresses(), "", "", ""), ShouldBeNil)
+
+				Convey("Then the chains and the dispatch rules should be removed", func() {
+					So(f.state.chains, ShouldNotContainKey, "App-pu-0")
+					So(f.state.chains, ShouldNotContainKey, "Net-pu-0")
+					So(f.jumps(appHookChain), ShouldBeEmpty)
+					So(f.jumps(netHookChain), ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey("When I configure the rules of a PU that fails open", func() {
+			puInfo.Policy.SetFailurePolicy(policy.FailOpen)
+			So(i.ConfigureRules(0, "pu", puInfo), ShouldBeNil)
+
+			Convey("Then the SYN packets should be trapped with bypass", func() {
+				So(f.findExpr("AppRaw-pu-0", &expr.Queue{Num: 0, Total: 4, Flag: expr.QueueFlagBypass}), ShouldEqual, 0)
+				So(f.findExpr("Net-pu-0", &expr.Queue{Num: 16, Total: 4, Flag: expr.QueueFlagBypass}), ShouldBeGreaterThanOrEqualTo, 0)
+				So(f.findExpr("Net-pu-0", &expr.Queue{Num: 16, Total: 4}), ShouldBeLessThan, 0)
+			})
+		})
+
+		Convey("When I configure the rules of a PU without IP address", func() {
+			err := i.ConfigureRules(0, "pu", testPUInfo("pu", policy.ExtendedMap{}))
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+				So(f.state.chains, ShouldNotContainKey, "App-pu-0")
+			})
+		})
+	})
+}
+
+func TestACLRules(t *testing.T) {
+
+	Convey("Given a remote container nftables instance", t, func() {
+		i, _ := newTestInstance(constants.RemoteContainer)
+		chains := i.puChains("pu", 0)
+
+		rules := policy.IPRuleList{
+			{
+				Address:  "192.30.253.0/24",
+				Port:     "80",
+				Protocol: "TCP",
+				Policy:   &policy.FlowPolicy{Action: policy.Reject | policy.Log, PolicyID: "p1"},
+			},
+			{
+				Address:  "192.30.254.0/24",
+				Port:     "443",
+				Protocol: "TCP",
+				Policy:   &policy.FlowPolicy{Action: policy.Reject, PolicyID: "p2"},
+			},
+			{
+				Address:  "10.0.0.0/8",
+				Port:     "1000:2000",
+				Protocol: "udp",
+				Policy:   &policy.FlowPolicy{Action: policy.Accept | policy.Log, PolicyID: "p3"},
+			},
+		}
+
+		Convey("When I create the application ACL rules", func() {
+			acls, err := i.aclRules("pu", chains.app, true, rules, false)
+			So(err, ShouldBeNil)
+
+			Convey("Then the later rejects should come first, each log before its drop", func() {
+				So(len(acls.rejects), ShouldEqual, 3)
+				So(acls.rejects[0].Exprs[len(acls.rejects[0].Exprs)-1], ShouldResemble, &expr.Verdict{Kind: expr.VerdictDrop})
+				So(acls.rejects[1].Exprs[len(acls.rejects[1].Exprs)-1], ShouldResemble, nflog(appNFLogGroup, "pu:p1:"+rules[0].Policy.Action.ShortActionString())[0])
+				So(acls.rejects[2].Exprs[len(acls.rejects[2].Exprs)-1], ShouldResemble, &expr.Verdict{Kind: expr.VerdictDrop})
+			})
+
+			Convey("Then the accepts should be followed by the default rules", func() {
+				So(len(acls.accepts), ShouldEqual, 7)
+				So(acls.accepts[0].Exprs[len(acls.accepts[0].Exprs)-1], ShouldResemble, nflog(appNFLogGroup, "pu:p3:"+rules[2].Policy.Action.ShortActionString())[0])
+				So(acls.accepts[1].Exprs[len(acls.accepts[1].Exprs)-1], ShouldResemble, &expr.Verdict{Kind: expr.VerdictAccept})
+				So(acls.accepts[6].Exprs, ShouldResemble, drop())
+			})
+		})
+
+		Convey("When I create the application ACL rules of a monitored PU", func() {
+			acls, err := i.aclRules("pu", chains.app, true, rules, true)
+			So(err, ShouldBeNil)
+
+			Convey("Then every reject should be logged as audited and returned", func() {
+				So(len(acls.rejects), ShouldEqual, 4)
+				So(acls.rejects[0].Exprs[len(acls.rejects[0].Exprs)-1], ShouldResemble, nflog(appNFLogGroup, "pu:p2:u")[0])
+				So(acls.rejects[1].Exprs[len(acls.rejects[1].Exprs)-1], ShouldResemble, &expr.Verdict{Kind: expr.VerdictReturn})
+				So(acls.rejects[2].Exprs[len(acls.rejects[2].Exprs)-1], ShouldResemble, nflog(appNFLogGroup, "pu:p1:u")[0])
+				So(acls.rejects[3].Exprs[len(acls.rejects[3].Exprs)-1], ShouldResemble, &expr.Verdict{Kind: expr.VerdictReturn})
+			})
+
+			Convey("Then the default rules should log as audited and return", func() {
+				So(acls.accepts[5].Exprs[len(acls.accepts[5].Exprs)-1], ShouldResemble, nflog(appNFLogGroup, "pu:default:defaultu")[0])
+				So(acls.accepts[6].Exprs, ShouldResemble, exprs(&expr.Verdict{Kind: expr.VerdictReturn}))
+			})
+		})
+
+		Convey("When I create ACL rules with an unknown protocol", func() {
+			_, err := i.aclRules("pu", chains.net, false, policy.IPRuleList{
+				{Address: "10.0.0.0/8", Protocol: "foo", Policy: &policy.FlowPolicy{Action: policy.Accept}},
+			}, false)
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestUpdateRules(t *testing.T) {
+
+	Convey("Given a PU configured with version 0", t, func() {
+		i, f := newTestInstance(constants.RemoteContainer)
+		So(i.Start(), ShouldBeNil)
+
+		puInfo := testPUInfo("pu", policy.ExtendedMap{policy.DefaultNamespace: "10.1.1.1", policy.DefaultNamespaceIPv6: "fd00::1"})
+		So(i.ConfigureRules(0, "pu", puInfo), ShouldBeNil)
+
+		Convey("Then both addresses should be dispatched to the PU chains", func() {
+			So(f.jumps(appHookChain), ShouldResemble, []string{"App-pu-0", "App-pu-0"})
+		})
+
+		Convey("When I update the rules to version 1", func() {
+			flushes := f.flushes
+			So(i.UpdateRules(1, "pu", puInfo), ShouldBeNil)
+
+			Convey("Then the chains should be swapped in one transaction", func() {
+				So(f.flushes, ShouldEqual, flushes+1)
+				So(f.state.chains, ShouldContainKey, "App-pu-1")
+				So(f.state.chains, ShouldNotContainKey, "App-pu-0")
+				So(f.state.chains, ShouldNotContainKey, "Net-pu-0")
+				So(f.jumps(appHookChain), ShouldResemble, []string{"App-pu-1", "App-pu-1"})
+				So(f.jumps(netHookChain), ShouldResemble, []string{"Net-pu-1", "Net-pu-1"})
+			})
+		})
+
+		Convey("When the update transaction fails", func() {
+			f.flushErr = fmt.Errorf("transaction aborted")
+			err := i.UpdateRules(1, "pu", puInfo)
+
+			Convey("Then the previous rules should be left in place", func() {
+				So(err, ShouldNotBeNil)
+				So(f.state.chains, ShouldContainKey, "App-pu-0")
+				So(f.state.chains, ShouldNotContainKey, "App-pu-1")
+				So(f.jumps(appHookChain), ShouldResemble, []string{"App-pu-0", "App-pu-0"})
+			})
+		})
+
+		Convey("When the old rules cannot be listed", func() {
+			f.listError = fmt.Errorf("netlink error")
+			err := i.UpdateRules(1, "pu", puInfo)
+
+			Convey("Then nothing should be queued", func() {
+				So(err, ShouldNotBeNil)
+				So(f.pending, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestLinuxProcessRules(t *testing.T) {
+
+	Convey("Given a started linux process nftables instance", t, func() {
+		i, f := newTestInstance(constants.LocalServer)
+		So(i.Start(), ShouldBeNil)
+
+		Convey("When I configure a PU with a mark and ports", func() {
+			puInfo := testPUInfo("pu", policy.ExtendedMap{})
+			puInfo.Runtime.SetOptions(policy.ExtendedMap{
+				cgnetcls.CgroupMarkTag: "100",
+				cgnetcls.PortTag:       "80,8000:8080",
+			})
+			So(i.ConfigureRules(0, "pu", puInfo), ShouldBeNil)
+
+			Convey("Then the cgroup and the ports should be dispatched to the PU chains", func() {
+				So(f.jumps(appHookChain), ShouldResemble, []string{uidchain, "App-pu-0"})
+				So(f.jumps(netHookChain), ShouldResemble, []string{"Net-pu-0", "Net-pu-0"})
+			})
+
+			Convey("When I delete the rules, the dispatch rules should be removed", func() {
+				So(i.DeleteRules(0, "pu", nil, "80,8000:8080", "100", ""), ShouldBeNil)
+				So(f.jumps(appHookChain), ShouldResemble, []string{uidchain})
+				So(f.jumps(netHookChain), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When I configure a PU of a user", func() {
+			puInfo := testPUInfo("pu", policy.ExtendedMap{})
+			puInfo.Runtime.SetOptions(policy.ExtendedMap{
+				cgnetcls.CgroupMarkTag: "100",
+				"USER":                 "1000",
+			})
+			So(i.ConfigureRules(0, "pu", puInfo), ShouldBeNil)
+
+			Convey("Then the uid chain should send the user traffic to the PU chain", func() {
+				So(f.jumps(uidchain), ShouldResemble, []string{"App-pu-0", "App-pu-0", "App-pu-0"})
+			})
+		})
+
+		Convey("When I configure a PU without mark", func() {
+			err := i.ConfigureRules(0, "pu", testPUInfo("pu", policy.ExtendedMap{}))
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestTargetElements(t *testing.T) {
+
+	Convey("When I convert networks to set elements", t, func() {
+		ipv4, ipv6, err := targetElements([]string{"10.0.0.0/8", "192.168.1.1", "::/0"})
+
+		Convey("Then each network should be an interval", func() {
+			So(err, ShouldBeNil)
+			So(ipv4, ShouldResemble, []nftables.SetElement{
+				{Key: net.IP{10, 0, 0, 0}},
+				{Key: net.IP{11, 0, 0, 0}, IntervalEnd: true},
+				{Key: net.IP{192, 168, 1, 1}},
+				{Key: net.IP{192, 168, 1, 2}, IntervalEnd: true},
+			})
+			So(ipv6, ShouldResemble, []nftables.SetElement{{Key: net.ParseIP("::")}})
+		})
+	})
+
+	Convey("When I convert an invalid network", t, func() {
+		_, _, err := targetElements([]string{"10.0.0.0/8", "foo"})
+
+		Convey("Then I should get an error", func() {
+			So(err, ShouldNotBeNil)
+			So(strings.Contains(err.Error(), "foo"), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,849 @@
+package nftablesctrl
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	"github.com/aporeto-inc/trireme/constants"
+	"github.com/aporeto-inc/trireme/enforcer/utils/packet"
+	"github.com/aporeto-inc/trireme/monitor/linuxmonitor/cgnetcls"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+const (
+	// trapPackets is the number of packets of a connection that are trapped
+	// after the SYN. iptables counts the packets of the original direction with
+	// connbytes, but the netlink API does not expose the conntrack direction,
+	// so the limit applies to the packets of both directions.
+	trapPackets = uint64(6)
+
+	appNFLogGroup = uint16(10)
+	netNFLogGroup = uint16(11)
+
+	tcpFlagFIN = byte(0x01)
+	tcpFlagSYN = byte(0x02)
+	tcpFlagRST = byte(0x04)
+	tcpFlagPSH = byte(0x08)
+	tcpFlagACK = byte(0x10)
+	tcpFlagURG = byte(0x20)
+)
+
+// protocols maps the protocol names used in the policies to their numbers
+var protocols = map[string]byte{
+	"icmp":      unix.IPPROTO_ICMP,
+	"tcp":       unix.IPPROTO_TCP,
+	"udp":       unix.IPPROTO_UDP,
+	"gre":       unix.IPPROTO_GRE,
+	"esp":       unix.IPPROTO_ESP,
+	"ah":        unix.IPPROTO_AH,
+	"icmpv6":    unix.IPPROTO_ICMPV6,
+	"ipv6-icmp": unix.IPPROTO_ICMPV6,
+	"sctp":      unix.IPPROTO_SCTP,
+}
+
+// queue holds the NFQUEUE range of a --queue-balance option
+type queue struct {
+	num   uint16
+	total uint16
+}
+
+// parseQueue parses a queue range in the "first:last" format of fqconfig
+func parseQueue(spec string) (*queue, error) {
+
+	parts := strings.SplitN(spec, ":", 2)
+
+	first, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid queue %s: %s", spec, err)
+	}
+
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.ParseUint(parts[1], 10, 16); err != nil {
+			return nil, fmt.Errorf("Invalid queue %s: %s", spec, err)
+		}
+	}
+
+	if last < first {
+		return nil, fmt.Errorf("Invalid queue %s", spec)
+	}
+
+	return &queue{num: uint16(first), total: uint16(last - first + 1)}, nil
+}
+
+// expr returns the queue expression balancing the packets over the range
+func (q *queue) expr(flag expr.QueueFlag) *expr.Queue {
+	return &expr.Queue{Num: q.num, Total: q.total, Flag: flag}
+}
+
+// queues holds the queues of all the packet types
+type queues struct {
+	appSyn    *queue
+	appAck    *queue
+	appSynAck *queue
+	netSyn    *queue
+	netAck    *queue
+	netSynAck *queue
+}
+
+// parseQueues parses the queues of the filter queue configuration
+func parseQueues(specs ...string) (*queues, error) {
+
+	parsed := make([]*queue, len(specs))
+	for i, spec := range specs {
+		q, err := parseQueue(spec)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = q
+	}
+
+	return &queues{
+		appSyn:    parsed[0],
+		appAck:    parsed[1],
+		appSynAck: parsed[2],
+		netSyn:    parsed[3],
+		netAck:    parsed[4],
+		netSynAck: parsed[5],
+	}, nil
+}
+
+// newRule returns a rule of the given chain
+func newRule(chain *nftables.Chain, exprs ...[]expr.Any) *nftables.Rule {
+
+	r := &nftables.Rule{
+		Table: chain.Table,
+		Chain: chain,
+	}
+
+	for _, e := range exprs {
+		r.Exprs = append(r.Exprs, e...)
+	}
+
+	return r
+}
+
+// exprs is a shorthand to build a list of expressions
+func exprs(e ...expr.Any) []expr.Any {
+	return e
+}
+
+// accept returns the accept verdict
+func accept() []expr.Any {
+	return exprs(&expr.Verdict{Kind: expr.VerdictAccept})
+}
+
+// drop returns the drop verdict
+func drop() []expr.Any {
+	return exprs(&expr.Verdict{Kind: expr.VerdictDrop})
+}
+
+// jump returns the verdict jumping to the given chain
+func jump(chain *nftables.Chain) []expr.Any {
+	return exprs(&expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name})
+}
+
+// nflog returns the statement logging the packet to the given NFLOG group
+func nflog(group uint16, prefix string) []expr.Any {
+	return exprs(&expr.Log{
+		Key:   1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_PREFIX,
+		Group: group,
+		Data:  []byte(prefix),
+	})
+}
+
+// logPrefix returns the NFLOG prefix of an ACL rule logging the given action
+func logPrefix(contextID string, rule policy.IPRule, action policy.ActionType) string {
+	return contextID + ":" + rule.Policy.PolicyID + ":" + rule.Policy.ServiceID + action.ShortActionString()
+}
+
+// rejectVerdict returns the verdict of the rules that drop packets. The
+// monitored PUs log the packets and return them to the calling chain instead,
+// so that they go through the rest of the rules as if there was no ACL.
+func rejectVerdict(audit bool) []expr.Any {
+
+	if audit {
+		return exprs(&expr.Verdict{Kind: expr.VerdictReturn})
+	}
+
+	return drop()
+}
+
+// rejectAction returns the action logged by the rules that drop packets
+func rejectAction(action policy.ActionType, audit bool) policy.ActionType {
+
+	if audit {
+		return action | policy.Audit
+	}
+
+	return action
+}
+
+// setMark returns the statement setting the packet mark
+func setMark(mark uint32) []expr.Any {
+	return exprs(
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	)
+}
+
+// matchMeta matches a 32 bits meta key
+func matchMeta(key expr.MetaKey, value uint32) []expr.Any {
+	return exprs(
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(value)},
+	)
+}
+
+// matchFamily matches the IP family of the packet
+func matchFamily(ipv6 bool) []expr.Any {
+
+	family := byte(unix.NFPROTO_IPV4)
+	if ipv6 {
+		family = unix.NFPROTO_IPV6
+	}
+
+	return exprs(
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+	)
+}
+
+// matchProtocol matches the layer 4 protocol
+func matchProtocol(proto byte) []expr.Any {
+	return exprs(
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	)
+}
+
+// matchProtocolName matches the layer 4 protocol by name or number. The
+// "all" protocol matches every packet.
+func matchProtocolName(name string) ([]expr.Any, error) {
+
+	name = strings.ToLower(name)
+	if name == "all" {
+		return nil, nil
+	}
+
+	if proto, ok := protocols[name]; ok {
+		return matchProtocol(proto), nil
+	}
+
+	proto, err := strconv.ParseUint(name, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown protocol %s", name)
+	}
+
+	return matchProtocol(byte(proto)), nil
+}
+
+// matchTCPFlags matches the TCP flags selected by the mask
+func matchTCPFlags(mask, flags byte) []expr.Any {
+	return exprs(
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{mask}, Xor: []byte{0}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{flags}},
+	)
+}
+
+// matchNoTCPOption matches the TCP packets without the given option
+func matchNoTCPOption(option uint8) []expr.Any {
+	return exprs(
+		&expr.Exthdr{DestRegister: 1, Type: option, Offset: 0, Len: 1, Flags: unix.NFT_EXTHDR_F_PRESENT, Op: expr.ExthdrOpTcpopt},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0}},
+	)
+}
+
+// matchPort matches a destination port or a "first:last" port range
+func matchPort(port string) ([]expr.Any, error) {
+
+	parts := strings.SplitN(port, ":", 2)
+
+	first, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %s", port)
+	}
+
+	load := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}
+
+	if len(parts) == 1 {
+		return exprs(
+			load,
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(first))},
+		), nil
+	}
+
+	last, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %s", port)
+	}
+
+	return exprs(
+		load,
+		&expr.Range{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			FromData: binaryutil.BigEndian.PutUint16(uint16(first)),
+			ToData:   binaryutil.BigEndian.PutUint16(uint16(last)),
+		},
+	), nil
+}
+
+// matchCtState matches the conntrack states given as a bitmask
+func matchCtState(states uint32) []expr.Any {
+	return exprs(
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(states),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	)
+}
+
+// matchCtMark matches the connection mark
+func matchCtMark(mark uint32) []expr.Any {
+	return exprs(
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+	)
+}
+
+// matchFirstPackets matches the first packets of a connection. The kernel
+// compares the registers as bytes, so the counter is converted to big endian
+// before the comparison, as the nft command does.
+func matchFirstPackets() []expr.Any {
+	return exprs(
+		&expr.Ct{Key: expr.CtKeyPKTS, Register: 1},
+		&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 8, Size: 8},
+		&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: binaryutil.BigEndian.PutUint64(trapPackets)},
+	)
+}
+
+// addressOffset returns the offset of the source or destination address in
+// the network header
+func addressOffset(ipv6, src bool) uint32 {
+
+	switch {
+	case ipv6 && src:
+		return 8
+	case ipv6:
+		return 24
+	case src:
+		return 12
+	default:
+		return 16
+	}
+}
+
+// parseNetwork parses an address or a network
+func parseNetwork(address string) (*net.IPNet, bool, error) {
+
+	ipv6 := isIPv6(address)
+
+	if !strings.Contains(address, "/") {
+		if ipv6 {
+			address = address + "/128"
+		} else {
+			address = address + "/32"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid address %s: %s", address, err)
+	}
+
+	if !ipv6 {
+		network.IP = network.IP.To4()
+	}
+
+	return network, ipv6, nil
+}
+
+// matchAddress matches the source or destination address against an address
+// or a network
+func matchAddress(address string, src bool) ([]expr.Any, error) {
+
+	network, ipv6, err := parseNetwork(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Any network only needs the IP family to match
+	ones, bits := network.Mask.Size()
+	if ones == 0 {
+		return matchFamily(ipv6), nil
+	}
+
+	length := uint32(len(network.IP))
+
+	e := matchFamily(ipv6)
+	e = append(e, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: addressOffset(ipv6, src), Len: length})
+
+	if ones < bits {
+		e = append(e, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: length, Mask: network.Mask, Xor: make([]byte, length)})
+	}
+
+	return append(e, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: network.IP}), nil
+}
+
+// matchSet matches the source or destination address against a set
+func matchSet(set *nftables.Set, ipv6, src bool) []expr.Any {
+
+	length := uint32(net.IPv4len)
+	if ipv6 {
+		length = net.IPv6len
+	}
+
+	e := matchFamily(ipv6)
+
+	return append(e,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: addressOffset(ipv6, src), Len: length},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	)
+}
+
+// targetSets returns the target network set of each IP family
+func (i *Instance) targetSets() map[bool]*nftables.Set {
+	return map[bool]*nftables.Set{false: i.targetSet, true: i.targetSet6}
+}
+
+// trapRules provides the packet trap rules of the PU chains. If failOpen is
+// set, the packets are accepted while no enforcer is bound to the queues.
+func (i *Instance) trapRules(chains *puChains, failOpen bool) []*nftables.Rule {
+
+	var flag expr.QueueFlag
+	if failOpen {
+		flag = expr.QueueFlagBypass
+	}
+
+	tcp := matchProtocol(unix.IPPROTO_TCP)
+	udp := matchProtocol(unix.IPPROTO_UDP)
+
+	rules := []*nftables.Rule{}
+
+	for _, ipv6 := range []bool{false, true} {
+		set := i.targetSets()[ipv6]
+		dst := matchSet(set, ipv6, false)
+		src := matchSet(set, ipv6, true)
+
+		if i.mode == constants.LocalContainer {
+			rules = append(rules,
+				// Application Packets - SYN
+				newRule(chains.appRaw, dst, tcp, matchTCPFlags(tcpFlagFIN|tcpFlagSYN|tcpFlagRST|tcpFlagPSH|tcpFlagURG, tcpFlagSYN), exprs(i.queues.appSyn.expr(flag))),
+				// Application Packets - Everything but SYN (first packets)
+				newRule(chains.app, dst, tcp, matchTCPFlags(tcpFlagSYN|tcpFlagACK, tcpFlagACK), matchFirstPackets(), exprs(i.queues.appAck.expr(flag))),
+				// Network Packets - SYN
+				newRule(chains.net, src, tcp, matchTCPFlags(tcpFlagSYN|tcpFlagACK, tcpFlagSYN), exprs(i.queues.netSyn.expr(flag))),
+				// Network Packets - Everything but SYN (first packets)
+				newRule(chains.net, src, tcp, matchFirstPackets(), exprs(i.queues.netAck.expr(flag))),
+			)
+		} else {
+			rules = append(rules,
+				// Application Packets - SYN and SYN,ACK
+				newRule(chains.app, dst, tcp, matchTCPFlags(tcpFlagSYN|tcpFlagACK, tcpFlagSYN), exprs(i.queues.appSyn.expr(flag))),
+				newRule(chains.app, dst, tcp, matchTCPFlags(tcpFlagSYN|tcpFlagACK, tcpFlagSYN|tcpFlagACK), exprs(i.queues.appSyn.expr(flag))),
+				// Application Packets - ACK
+				newRule(chains.app, dst, tcp, matchTCPFlags(tcpFlagSYN|tcpFlagACK, tcpFlagACK), exprs(i.queues.appAck.expr(flag))),
+				// Network Packets - SYN
+				newRule(chains.net, src, tcp, matchTCPFlags(tcpFlagSYN|tcpFlagACK, tcpFlagSYN), exprs(i.queues.netSyn.expr(flag))),
+				// Network Packets - ACK without data. SYN,ACK is captured by global rule
+				newRule(chains.net, src, tcp, matchTCPFlags(tcpFlagSYN|tcpFlagACK|tcpFlagPSH, tcpFlagACK), exprs(i.queues.netAck.expr(flag))),
+			)
+		}
+
+		// UDP packets are processed until the flow is authorized and the connection is marked
+		rules = append(rules,
+			newRule(chains.app, dst, udp, exprs(i.queues.appAck.expr(flag))),
+			newRule(chains.net, src, udp, exprs(i.queues.netAck.expr(flag))),
+		)
+	}
+
+	// Data packets of encrypted connections must always be processed
+	rules = append(rules,
+		newRule(chains.app, tcp, matchCtMark(constants.EncryptedConnMark), exprs(i.queues.appAck.expr(flag))),
+		newRule(chains.net, tcp, matchCtMark(constants.EncryptedConnMark), exprs(i.queues.netAck.expr(flag))),
+	)
+
+	return rules
+}
+
+// aclRules holds the ACL rules of a chain. The rejects are evaluated before
+// the packets are trapped and the accepts after.
+type aclRules struct {
+	rejects []*nftables.Rule
+	accepts []*nftables.Rule
+}
+
+// aclRules returns the rules implementing the application ACLs, matching the
+// destination address, or the network ACLs, matching the source address. If
+// audit is set, the rejected packets are logged and returned.
+func (i *Instance) aclRules(contextID string, chain *nftables.Chain, app bool, rules policy.IPRuleList, audit bool) (*aclRules, error) {
+
+	group := netNFLogGroup
+	if app {
+		group = appNFLogGroup
+	}
+
+	acls := &aclRules{
+		rejects: []*nftables.Rule{},
+		accepts: []*nftables.Rule{},
+	}
+
+	newConnection := matchCtState(expr.CtStateBitNEW)
+
+	for _, rule := range rules {
+
+		action := rule.Policy.Action & (policy.Accept | policy.Reject)
+		if action != policy.Accept && action != policy.Reject {
+			continue
+		}
+
+		proto, err := matchProtocolName(rule.Protocol)
+		if err != nil {
+			return nil, err
+		}
+
+		address, err := matchAddress(rule.Address, !app)
+		if err != nil {
+			return nil, err
+		}
+
+		var port []expr.Any
+		if p := strings.ToLower(rule.Protocol); p == "tcp" || p == "udp" {
+			if port, err = matchPort(rule.Port); err != nil {
+				return nil, err
+			}
+		}
+
+		// Only the application accepts and rejects of TCP and UDP are
+		// limited to new connections, as with the iptables implementation
+		var state []expr.Any
+		if app && port != nil {
+			state = newConnection
+		}
+
+		var log *nftables.Rule
+		if rule.Policy.Action&policy.Log > 0 {
+			log = newRule(chain, proto, address, port, newConnection, nflog(group, logPrefix(contextID, rule, rule.Policy.Action)))
+		}
+
+		if action == policy.Accept {
+			if log != nil {
+				acls.accepts = append(acls.accepts, log)
+			}
+			acls.accepts = append(acls.accepts, newRule(chain, proto, state, address, port, accept()))
+			continue
+		}
+
+		if audit {
+			log = newRule(chain, proto, address, port, newConnection, nflog(group, logPrefix(contextID, rule, rejectAction(rule.Policy.Action, audit))))
+		}
+
+		// Every reject goes on top of the previous ones
+		reject := []*nftables.Rule{newRule(chain, proto, state, address, port, rejectVerdict(audit))}
+		if log != nil {
+			reject = append([]*nftables.Rule{log}, reject...)
+		}
+		acls.rejects = append(reject, acls.rejects...)
+	}
+
+	established := matchCtState(expr.CtStateBitESTABLISHED)
+
+	// Accept established connections, ICMPv6 for neighbor discovery and
+	// log and drop everything else
+	acls.accepts = append(acls.accepts,
+		newRule(chain, matchProtocol(unix.IPPROTO_UDP), established, accept()),
+		newRule(chain, matchProtocol(unix.IPPROTO_TCP), established, accept()),
+		newRule(chain, matchProtocol(unix.IPPROTO_ICMPV6), accept()),
+		newRule(chain, newConnection, nflog(group, contextID+":default:default"+rejectAction(policy.Reject, audit).ShortActionString())),
+		newRule(chain, rejectVerdict(audit)),
+	)
+
+	return acls, nil
+}
+
+// familyIPs returns the addresses of the PU in the same family as the network.
+// A PU without addresses matches any address.
+func familyIPs(ips []string, network string) []string {
+
+	if len(ips) == 0 {
+		return []string{""}
+	}
+
+	matching := []string{}
+	for _, ip := range ips {
+		if isIPv6(ip) == isIPv6(network) {
+			matching = append(matching, ip)
+		}
+	}
+
+	return matching
+}
+
+// matchOptionalAddress matches an address unless it is empty
+func matchOptionalAddress(address string, src bool) ([]expr.Any, error) {
+
+	if address == "" {
+		return nil, nil
+	}
+
+	return matchAddress(address, src)
+}
+
+// exclusionRules returns the rules accepting the traffic of the excluded networks
+func (i *Instance) exclusionRules(chains *puChains, ips []string, exclusions []string) ([]*nftables.Rule, error) {
+
+	rules := []*nftables.Rule{}
+
+	for _, e := range exclusions {
+
+		dst, err := matchAddress(e, false)
+		if err != nil {
+			return nil, err
+		}
+
+		src, err := matchAddress(e, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range familyIPs(ips, e) {
+
+			puSrc, err := matchOptionalAddress(ip, true)
+			if err != nil {
+				return nil, err
+			}
+
+			puDst, err := matchOptionalAddress(ip, false)
+			if err != nil {
+				return nil, err
+			}
+
+			rules = append(rules,
+				newRule(chains.app, puSrc, dst, accept()),
+				newRule(chains.net, src, puDst, matchProtocol(unix.IPPROTO_TCP), matchNoTCPOption(packet.TCPAuthenticationOption), accept()),
+			)
+		}
+	}
+
+	return rules, nil
+}
+
+// chainRules provides the list of rules that are used to send traffic to
+// the chains of a PU
+func (i *Instance) chainRules(chains *puChains, ips []string) ([]*nftables.Rule, error) {
+
+	rules := []*nftables.Rule{}
+
+	if len(ips) == 0 {
+		ips = []string{""}
+	}
+
+	for _, ip := range ips {
+
+		src, err := matchOptionalAddress(ip, true)
+		if err != nil {
+			return nil, err
+		}
+
+		dst, err := matchOptionalAddress(ip, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if i.mode == constants.LocalContainer {
+			rules = append(rules, newRule(i.appRawHook, src, jump(chains.appRaw)))
+		}
+
+		rules = append(rules,
+			newRule(i.appHook, src, jump(chains.app)),
+			newRule(i.netHook, dst, jump(chains.net)),
+		)
+	}
+
+	return rules, nil
+}
+
+// parseMark parses the mark of a Linux process PU
+func parseMark(mark string) (uint32, error) {
+
+	value, err := strconv.ParseUint(mark, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid mark %s", mark)
+	}
+
+	return uint32(value), nil
+}
+
+// cgroupChainRules provides the rules sending the traffic of a cgroup and of
+// its ports to the chains of a PU
+func (i *Instance) cgroupChainRules(chains *puChains, mark string, ports string) ([]*nftables.Rule, error) {
+
+	value, err := parseMark(mark)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []*nftables.Rule{
+		newRule(i.appHook, matchMeta(expr.MetaKeyCGROUP, value), setMark(value), jump(chains.app)),
+	}
+
+	for _, port := range strings.Split(ports, ",") {
+		dport, err := matchPort(port)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, newRule(i.netHook, matchProtocol(unix.IPPROTO_TCP), dport, jump(chains.net)))
+	}
+
+	return rules, nil
+}
+
+// lookupUID returns the numeric uid of a user name or uid
+func lookupUID(uid string) (uint32, error) {
+
+	if value, err := strconv.ParseUint(uid, 10, 32); err == nil {
+		return uint32(value), nil
+	}
+
+	u, err := user.Lookup(uid)
+	if err != nil {
+		return 0, fmt.Errorf("Unknown user %s: %s", uid, err)
+	}
+
+	value, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid uid %s", u.Uid)
+	}
+
+	return uint32(value), nil
+}
+
+// uidChainRules provides the rules sending the traffic of a user to the
+// chains of a PU
+func (i *Instance) uidChainRules(chains *puChains, mark string, uid string) ([]*nftables.Rule, error) {
+
+	value, err := parseMark(mark)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := lookupUID(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*nftables.Rule{
+		newRule(i.uidChain, matchMeta(expr.MetaKeySKUID, owner), setMark(value), jump(chains.app)),
+		newRule(i.uidChain, matchMeta(expr.MetaKeyCGROUP, value), setMark(value), jump(chains.app)),
+		newRule(i.uidChain, matchMeta(expr.MetaKeyMARK, value), jump(chains.app)),
+		newRule(i.netHook, matchProtocol(unix.IPPROTO_TCP), jump(chains.net)),
+	}, nil
+}
+
+// globalRules provides the rules of the base chains that apply to all the
+// PUs: the capture of SynAck packets and the accept of marked connections
+func (i *Instance) globalRules() []*nftables.Rule {
+
+	tcp := matchProtocol(unix.IPPROTO_TCP)
+	synAck := matchTCPFlags(tcpFlagSYN|tcpFlagACK, tcpFlagSYN|tcpFlagACK)
+
+	appRules := []*nftables.Rule{}
+	netRules := []*nftables.Rule{}
+
+	if i.mode == constants.LocalServer {
+		appRules = append(appRules, newRule(i.appHook, jump(i.uidChain)))
+	}
+
+	appRules = append(appRules, newRule(i.appHook, matchCtMark(constants.DefaultConnMark), accept()))
+	netRules = append(netRules, newRule(i.netHook, matchCtMark(constants.DefaultConnMark), accept()))
+
+	for _, ipv6 := range []bool{false, true} {
+		set := i.targetSets()[ipv6]
+
+		appRules = append(appRules, newRule(i.appHook,
+			matchSet(set, ipv6, false), tcp, synAck,
+			setMark(uint32(cgnetcls.Initialmarkval-1)),
+			exprs(i.queues.appSynAck.expr(expr.QueueFlagBypass)),
+		))
+
+		netRules = append(netRules, newRule(i.netHook,
+			matchSet(set, ipv6, true), tcp, synAck,
+			exprs(i.queues.netSynAck.expr(expr.QueueFlagBypass)),
+		))
+	}
+
+	if i.mode == constants.LocalContainer {
+		appRules = append(appRules, newRule(i.appHook, matchMeta(expr.MetaKeyMARK, uint32(i.fqc.GetMarkValue())), accept()))
+	}
+
+	return append(appRules, netRules...)
+}
+
+// targetElements returns the interval set elements of the IPv4 and IPv6
+// target networks
+func targetElements(networks []string) (ipv4 []nftables.SetElement, ipv6 []nftables.SetElement, err error) {
+
+	ipv4 = []nftables.SetElement{}
+	ipv6 = []nftables.SetElement{}
+
+	for _, n := range networks {
+
+		network, v6, err := parseNetwork(n)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		elements := []nftables.SetElement{{Key: network.IP}}
+
+		// The interval ends at the first address after the network, which
+		// does not exist for the networks at the end of the address space
+		if end, ok := nextNetwork(network); ok {
+			elements = append(elements, nftables.SetElement{Key: end, IntervalEnd: true})
+		}
+
+		if v6 {
+			ipv6 = append(ipv6, elements...)
+		} else {
+			ipv4 = append(ipv4, elements...)
+		}
+	}
+
+	return ipv4, ipv6, nil
+}
+
+// nextNetwork returns the first address after the network
+func nextNetwork(network *net.IPNet) (net.IP, bool) {
+
+	ones, bits := network.Mask.Size()
+
+	start := new(big.Int).SetBytes(network.IP)
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	end := new(big.Int).Add(start, size)
+
+	if end.BitLen() > bits {
+		return nil, false
+	}
+
+	ip := make(net.IP, len(network.IP))
+	endBytes := end.Bytes()
+	copy(ip[len(ip)-len(endBytes):], endBytes)
+
+	return ip, true
+}
@@ -8,6 +8,8 @@ type IptablesProvider interface {
 	Append(table, chain string, rulespec ...string) error
 	Insert(table, chain string, pos int, rulespec ...string) error
 	Delete(table, chain string, rulespec ...string) error
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	List(table, chain string) ([]string, error)
 	ListChains(table string) ([]string, error)
 	ClearChain(table, chain string) error
 	DeleteChain(table, chain string) error
@@ -19,3 +21,9 @@ type IptablesProvider interface {
 func NewGoIPTablesProvider() (IptablesProvider, error) {
 	return iptables.New()
 }
+
+// NewGoIP6TablesProvider returns an IptablesProvider interface for ip6tables
+// based on the go-iptables external package.
+func NewGoIP6TablesProvider() (IptablesProvider, error) {
+	return iptables.NewWithProtocol(iptables.ProtocolIPv6)
+}
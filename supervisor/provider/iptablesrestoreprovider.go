@@ -0,0 +1,55 @@
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// IptablesRestoreProvider is an abstraction of a userspace implementation that
+// applies a batch of rules in the iptables-save format. The rules of every
+// table of the batch are applied at once, and the existing rules are kept.
+type IptablesRestoreProvider interface {
+	Restore(data []byte) error
+}
+
+// execRestoreProvider runs an iptables-restore binary
+type execRestoreProvider struct {
+	path string
+}
+
+// NewIPTablesRestoreProvider returns an IptablesRestoreProvider interface based
+// on the iptables-restore binary.
+func NewIPTablesRestoreProvider() (IptablesRestoreProvider, error) {
+	return newExecRestoreProvider("iptables-restore")
+}
+
+// NewIP6TablesRestoreProvider returns an IptablesRestoreProvider interface based
+// on the ip6tables-restore binary.
+func NewIP6TablesRestoreProvider() (IptablesRestoreProvider, error) {
+	return newExecRestoreProvider("ip6tables-restore")
+}
+
+func newExecRestoreProvider(binary string) (IptablesRestoreProvider, error) {
+
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	return &execRestoreProvider{path: path}, nil
+}
+
+// Restore applies the batch without flushing the tables it references
+func (r *execRestoreProvider) Restore(data []byte) error {
+
+	cmd := exec.Command(r.path, "--noflush")
+	cmd.Stdin = bytes.NewReader(data)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
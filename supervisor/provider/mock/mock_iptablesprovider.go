@@ -74,6 +74,33 @@ func (_mr *_MockIptablesProviderRecorder) Delete(arg0, arg1 interface{}, arg2 ..
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Delete", _s...)
 }
 
+func (_m *MockIptablesProvider) Exists(table string, chain string, rulespec ...string) (bool, error) {
+	_s := []interface{}{table, chain}
+	for _, _x := range rulespec {
+		_s = append(_s, _x)
+	}
+	ret := _m.ctrl.Call(_m, "Exists", _s...)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockIptablesProviderRecorder) Exists(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1}, arg2...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Exists", _s...)
+}
+
+func (_m *MockIptablesProvider) List(table string, chain string) ([]string, error) {
+	ret := _m.ctrl.Call(_m, "List", table, chain)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockIptablesProviderRecorder) List(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "List", arg0, arg1)
+}
+
 func (_m *MockIptablesProvider) ListChains(table string) ([]string, error) {
 	ret := _m.ctrl.Call(_m, "ListChains", table)
 	ret0, _ := ret[0].([]string)
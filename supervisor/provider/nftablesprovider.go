@@ -0,0 +1,180 @@
+package provider
+
+import "github.com/google/nftables"
+
+// NftablesProvider is an abstraction of all the methods an implementation of
+// nftables over netlink needs to provide. Modifications are buffered and only
+// applied by Flush, as one atomic transaction, or discarded by Abort.
+type NftablesProvider interface {
+	ListTables() ([]*nftables.Table, error)
+	AddTable(t *nftables.Table) *nftables.Table
+	DelTable(t *nftables.Table)
+	ListChains() ([]*nftables.Chain, error)
+	AddChain(c *nftables.Chain) *nftables.Chain
+	FlushChain(c *nftables.Chain)
+	DelChain(c *nftables.Chain)
+	GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error)
+	AddRule(r *nftables.Rule) *nftables.Rule
+	DelRule(r *nftables.Rule) error
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	FlushSet(s *nftables.Set)
+	SetAddElements(s *nftables.Set, vals []nftables.SetElement) error
+	Flush() error
+	Abort()
+}
+
+// goNftablesProvider wraps a google/nftables v0.3.0 connection. The connection
+// can not discard the modifications it buffers, so they are queued by the
+// provider and only given to the connection by Flush. Abort drops the queue
+// and keeps the connection with its network namespace.
+type goNftablesProvider struct {
+	conn    *nftables.Conn
+	pending []func(*nftables.Conn) error
+}
+
+// NewGoNftablesProvider returns an NftablesProvider interface based on the
+// google/nftables external package.
+func NewGoNftablesProvider() (NftablesProvider, error) {
+	return newGoNftablesProvider()
+}
+
+// newGoNftablesProvider returns a provider for a connection with the options
+func newGoNftablesProvider(opts ...nftables.ConnOption) (*goNftablesProvider, error) {
+
+	conn, err := nftables.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &goNftablesProvider{conn: conn}, nil
+}
+
+// add adds a modification to the pending ones
+func (p *goNftablesProvider) add(op func(*nftables.Conn)) {
+	p.pending = append(p.pending, func(c *nftables.Conn) error {
+		op(c)
+		return nil
+	})
+}
+
+// queue adds a modification that can fail to the pending ones. It is validated
+// on a connection that is never flushed, so that it can not fail when it is
+// given to the real connection.
+func (p *goNftablesProvider) queue(op func(*nftables.Conn) error) error {
+
+	if err := op(&nftables.Conn{}); err != nil {
+		return err
+	}
+
+	p.pending = append(p.pending, op)
+
+	return nil
+}
+
+// ListTables lists the tables
+func (p *goNftablesProvider) ListTables() ([]*nftables.Table, error) {
+	return p.conn.ListTables()
+}
+
+// AddTable queues the creation of a table
+func (p *goNftablesProvider) AddTable(t *nftables.Table) *nftables.Table {
+	p.add(func(c *nftables.Conn) {
+		c.AddTable(t)
+	})
+	return t
+}
+
+// DelTable queues the deletion of a table
+func (p *goNftablesProvider) DelTable(t *nftables.Table) {
+	p.add(func(c *nftables.Conn) {
+		c.DelTable(t)
+	})
+}
+
+// ListChains lists the chains
+func (p *goNftablesProvider) ListChains() ([]*nftables.Chain, error) {
+	return p.conn.ListChains()
+}
+
+// AddChain queues the creation of a chain
+func (p *goNftablesProvider) AddChain(ch *nftables.Chain) *nftables.Chain {
+	p.add(func(c *nftables.Conn) {
+		c.AddChain(ch)
+	})
+	return ch
+}
+
+// FlushChain queues the removal of the rules of a chain
+func (p *goNftablesProvider) FlushChain(ch *nftables.Chain) {
+	p.add(func(c *nftables.Conn) {
+		c.FlushChain(ch)
+	})
+}
+
+// DelChain queues the deletion of a chain
+func (p *goNftablesProvider) DelChain(ch *nftables.Chain) {
+	p.add(func(c *nftables.Conn) {
+		c.DelChain(ch)
+	})
+}
+
+// GetRules lists the rules of a chain
+func (p *goNftablesProvider) GetRules(t *nftables.Table, ch *nftables.Chain) ([]*nftables.Rule, error) {
+	return p.conn.GetRules(t, ch)
+}
+
+// AddRule queues the creation of a rule
+func (p *goNftablesProvider) AddRule(r *nftables.Rule) *nftables.Rule {
+	p.add(func(c *nftables.Conn) {
+		c.AddRule(r)
+	})
+	return r
+}
+
+// DelRule queues the deletion of a rule
+func (p *goNftablesProvider) DelRule(r *nftables.Rule) error {
+	return p.queue(func(c *nftables.Conn) error {
+		return c.DelRule(r)
+	})
+}
+
+// AddSet queues the creation of a set with its elements
+func (p *goNftablesProvider) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	return p.queue(func(c *nftables.Conn) error {
+		return c.AddSet(s, vals)
+	})
+}
+
+// FlushSet queues the removal of the elements of a set
+func (p *goNftablesProvider) FlushSet(s *nftables.Set) {
+	p.add(func(c *nftables.Conn) {
+		c.FlushSet(s)
+	})
+}
+
+// SetAddElements queues the addition of elements to a set
+func (p *goNftablesProvider) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	return p.queue(func(c *nftables.Conn) error {
+		return c.SetAddElements(s, vals)
+	})
+}
+
+// Flush applies the pending modifications as one transaction
+func (p *goNftablesProvider) Flush() error {
+
+	pending := p.pending
+	p.pending = nil
+
+	for _, op := range pending {
+		if err := op(p.conn); err != nil {
+			return err
+		}
+	}
+
+	return p.conn.Flush()
+}
+
+// Abort discards the pending modifications
+func (p *goNftablesProvider) Abort() {
+	p.pending = nil
+}
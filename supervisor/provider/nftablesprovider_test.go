@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/sys/unix"
+)
+
+func TestGoNftablesProviderTransactions(t *testing.T) {
+
+	Convey("Given a provider on a test connection", t, func() {
+		var sent []netlink.HeaderType
+		p, err := newGoNftablesProvider(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+			for _, msg := range req {
+				sent = append(sent, msg.Header.Type)
+			}
+			return req, nil
+		}))
+		So(err, ShouldBeNil)
+
+		table := &nftables.Table{Name: "trireme", Family: nftables.TableFamilyINet}
+		newTable := netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_NEWTABLE)
+
+		Convey("When I add a table and flush", func() {
+			p.AddTable(table)
+			So(sent, ShouldBeEmpty)
+			So(p.Flush(), ShouldBeNil)
+
+			Convey("Then the table should be sent", func() {
+				So(sent, ShouldContain, newTable)
+			})
+		})
+
+		Convey("When I add a table, abort and flush", func() {
+			p.AddTable(table)
+			p.Abort()
+			So(p.Flush(), ShouldBeNil)
+
+			Convey("Then nothing should be sent", func() {
+				So(sent, ShouldBeEmpty)
+			})
+
+			Convey("Then the connection should still be usable", func() {
+				p.AddTable(table)
+				So(p.Flush(), ShouldBeNil)
+				So(sent, ShouldContain, newTable)
+			})
+		})
+
+		Convey("When I delete a rule without handle", func() {
+			err := p.DelRule(&nftables.Rule{Table: table, Chain: &nftables.Chain{Name: "c", Table: table}})
+
+			Convey("Then I should get an error and nothing should be queued", func() {
+				So(err, ShouldNotBeNil)
+				So(p.Flush(), ShouldBeNil)
+				So(sent, ShouldBeEmpty)
+			})
+		})
+	})
+}
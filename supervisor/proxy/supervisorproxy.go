@@ -45,20 +45,7 @@ func (s *ProxyInfo) Supervise(contextID string, puInfo *policy.PUInfo) error {
 	}
 
 	req := &rpcwrapper.Request{
-		Payload: &rpcwrapper.SuperviseRequestPayload{
-			ContextID:        contextID,
-			ManagementID:     puInfo.Policy.ManagementID(),
-			TriremeAction:    puInfo.Policy.TriremeAction(),
-			ApplicationACLs:  puInfo.Policy.ApplicationACLs(),
-			NetworkACLs:      puInfo.Policy.NetworkACLs(),
-			PolicyIPs:        puInfo.Policy.IPAddresses(),
-			Annotations:      puInfo.Policy.Annotations(),
-			Identity:         puInfo.Policy.Identity(),
-			ReceiverRules:    puInfo.Policy.ReceiverRules(),
-			TransmitterRules: puInfo.Policy.TransmitterRules(),
-			ExcludedNetworks: puInfo.Policy.ExcludedNetworks(),
-			TriremeNetworks:  puInfo.Policy.TriremeNetworks(),
-		},
+		Payload: rpcwrapper.NewSupervisePayload(contextID, puInfo),
 	}
 
 	if err := s.rpchdl.RemoteCall(contextID, "Server.Supervise", req, &rpcwrapper.Response{}); err != nil {
@@ -3,6 +3,7 @@ package supervisor
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -15,14 +16,20 @@ import (
 	"github.com/aporeto-inc/trireme/policy"
 	"github.com/aporeto-inc/trireme/supervisor/ipsetctrl"
 	"github.com/aporeto-inc/trireme/supervisor/iptablesctrl"
+	"github.com/aporeto-inc/trireme/supervisor/nftablesctrl"
 )
 
+// reconcileInterval is the interval between two verifications of the rules
+// of all the processing units
+const reconcileInterval = 30 * time.Second
+
 type cacheData struct {
-	version int
-	ips     policy.ExtendedMap
-	mark    string
-	port    string
-	uid     string
+	version       int
+	ips           policy.ExtendedMap
+	mark          string
+	port          string
+	uid           string
+	containerInfo *policy.PUInfo
 }
 
 // Config is the structure holding all information about the supervisor
@@ -38,6 +45,12 @@ type Config struct {
 
 	triremeNetworks []string
 
+	// rulesLock is held for reading while the rules of a processing unit
+	// are changed, and for writing while they are reconciled
+	rulesLock         sync.RWMutex
+	reconcileInterval time.Duration
+	stop              chan struct{}
+
 	sync.Mutex
 }
 
@@ -62,19 +75,22 @@ func NewSupervisor(collector collector.EventCollector, enforcerInstance enforcer
 	}
 
 	s := &Config{
-		mode:            mode,
-		impl:            nil,
-		versionTracker:  cache.NewCache(),
-		collector:       collector,
-		filterQueue:     filterQueue,
-		excludedIPs:     []string{},
-		triremeNetworks: networks,
+		mode:              mode,
+		impl:              nil,
+		versionTracker:    cache.NewCache(),
+		collector:         collector,
+		filterQueue:       filterQueue,
+		excludedIPs:       []string{},
+		triremeNetworks:   networks,
+		reconcileInterval: reconcileInterval,
 	}
 
 	var err error
 	switch implementation {
 	case constants.IPSets:
 		s.impl, err = ipsetctrl.NewInstance(s.filterQueue, false, mode)
+	case constants.NFTables:
+		s.impl, err = nftablesctrl.NewInstance(s.filterQueue, mode)
 	default:
 		s.impl, err = iptablesctrl.NewInstance(s.filterQueue, mode)
 	}
@@ -94,6 +110,9 @@ func (s *Config) Supervise(contextID string, containerInfo *policy.PUInfo) error
 		return fmt.Errorf("Runtime, Policy and ContainerInfo should not be nil")
 	}
 
+	s.rulesLock.RLock()
+	defer s.rulesLock.RUnlock()
+
 	_, err := s.versionTracker.Get(contextID)
 
 	if err != nil {
@@ -110,6 +129,14 @@ func (s *Config) Supervise(contextID string, containerInfo *policy.PUInfo) error
 // as much cleanup as possible to avoid stale state
 func (s *Config) Unsupervise(contextID string) error {
 
+	s.rulesLock.RLock()
+	defer s.rulesLock.RUnlock()
+
+	return s.unsupervise(contextID)
+}
+
+func (s *Config) unsupervise(contextID string) error {
+
 	version, err := s.versionTracker.Get(contextID)
 
 	if err != nil {
@@ -142,6 +169,12 @@ func (s *Config) Start() error {
 	}
 	s.Unlock()
 
+	// Reconcile the rules if the implementation can read them back
+	if verifier, ok := s.impl.(RuleVerifier); ok && s.reconcileInterval > 0 {
+		s.stop = make(chan struct{})
+		go s.reconcile(verifier, s.reconcileInterval, s.stop)
+	}
+
 	zap.L().Debug("Started the supervisor")
 
 	return nil
@@ -150,6 +183,11 @@ func (s *Config) Start() error {
 // Stop stops the supervisor
 func (s *Config) Stop() error {
 
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+
 	if err := s.impl.Stop(); err != nil {
 		return fmt.Errorf("Failed to stop the implementer: %s", err)
 	}
@@ -163,11 +201,8 @@ func (s *Config) SetTargetNetworks(networks []string) error {
 	s.Lock()
 	defer s.Unlock()
 
-	// If there are no target networks, capture all traffic
-	if len(networks) == 0 {
-		networks = []string{"0.0.0.0/1", "128.0.0.0/1"}
-	}
-
+	// If there are no target networks, the implementation captures all the
+	// traffic of the IP families it supports
 	if err := s.impl.SetTargetNetworks(s.triremeNetworks, networks); err != nil {
 		return err
 	}
@@ -192,18 +227,19 @@ func (s *Config) doCreatePU(contextID string, containerInfo *policy.PUInfo) erro
 		uid = ""
 	}
 	cacheEntry := &cacheData{
-		version: version,
-		ips:     containerInfo.Policy.IPAddresses(),
-		mark:    mark,
-		port:    port,
-		uid:     uid,
+		version:       version,
+		ips:           containerInfo.Policy.IPAddresses(),
+		mark:          mark,
+		port:          port,
+		uid:           uid,
+		containerInfo: containerInfo,
 	}
 
 	// Version the policy so that we can do hitless policy changes
 	s.versionTracker.AddOrUpdate(contextID, cacheEntry)
 
 	if err := s.impl.ConfigureRules(version, contextID, containerInfo); err != nil {
-		if uerr := s.Unsupervise(contextID); uerr != nil {
+		if uerr := s.unsupervise(contextID); uerr != nil {
 			zap.L().Warn("Failed to clean up state while creating the PU",
 				zap.String("contextID", contextID),
 				zap.Error(uerr),
@@ -219,7 +255,7 @@ func (s *Config) doCreatePU(contextID string, containerInfo *policy.PUInfo) erro
 //and the invokes the various handlers that process all policies.
 func (s *Config) doUpdatePU(contextID string, containerInfo *policy.PUInfo) error {
 
-	cacheEntry, err := s.versionTracker.LockedModify(contextID, add, 1)
+	cacheEntry, err := s.versionTracker.LockedModify(contextID, add, containerInfo)
 
 	if err != nil {
 		return fmt.Errorf("Error finding PU in cache %s", err)
@@ -228,7 +264,7 @@ func (s *Config) doUpdatePU(contextID string, containerInfo *policy.PUInfo) erro
 	cachedEntry := cacheEntry.(*cacheData)
 
 	if err := s.impl.UpdateRules(cachedEntry.version, contextID, containerInfo); err != nil {
-		if uerr := s.Unsupervise(contextID); uerr != nil {
+		if uerr := s.unsupervise(contextID); uerr != nil {
 			zap.L().Warn("Failed to clean up state while updating the PU",
 				zap.String("contextID", contextID),
 				zap.Error(uerr),
@@ -243,5 +279,106 @@ func (s *Config) doUpdatePU(contextID string, containerInfo *policy.PUInfo) erro
 func add(a, b interface{}) interface{} {
 	entry := a.(*cacheData)
 	entry.version = entry.version ^ 1
+	if containerInfo, ok := b.(*policy.PUInfo); ok {
+		entry.containerInfo = containerInfo
+	}
 	return entry
 }
+
+// reconcile periodically verifies the rules of all the processing units until
+// the stop channel is closed
+func (s *Config) reconcile(verifier RuleVerifier, interval time.Duration, stop chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.reconcileGlobal(verifier)
+			for _, contextID := range s.versionTracker.KeyList() {
+				s.reconcilePU(verifier, contextID.(string))
+			}
+		}
+	}
+}
+
+// reconcileGlobal reinstalls the rules shared by all the processing units if
+// they are not installed as expected
+func (s *Config) reconcileGlobal(verifier RuleVerifier) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	drift, err := verifier.RepairGlobalRules()
+
+	if len(drift) > 0 {
+		zap.L().Warn("Global rules were modified outside of the supervisor, reinstalling them",
+			zap.Strings("drift", drift),
+		)
+	}
+
+	if err != nil {
+		zap.L().Error("Failed to reinstall the global rules", zap.Error(err))
+	}
+}
+
+// reconcilePU reinstalls the rules of a processing unit if they are not
+// installed as expected. The rules are reinstalled as a new version, so
+// that the traffic is enforced while they are repaired. If they can not be
+// reinstalled, the processing unit keeps its current version and the repair
+// is retried at the next interval.
+func (s *Config) reconcilePU(verifier RuleVerifier, contextID string) {
+
+	s.rulesLock.Lock()
+	defer s.rulesLock.Unlock()
+
+	data, err := s.versionTracker.Get(contextID)
+	if err != nil {
+		// The PU was unsupervised in the meantime
+		return
+	}
+
+	cacheEntry := data.(*cacheData)
+	containerInfo := cacheEntry.containerInfo
+
+	drift, err := verifier.VerifyRules(cacheEntry.version, contextID, containerInfo)
+	if err != nil {
+		zap.L().Warn("Failed to verify the rules",
+			zap.String("contextID", contextID),
+			zap.Error(err),
+		)
+		return
+	}
+
+	if len(drift) == 0 {
+		return
+	}
+
+	zap.L().Warn("Rules were modified outside of the supervisor, reinstalling them",
+		zap.String("contextID", contextID),
+		zap.Strings("drift", drift),
+	)
+
+	ip, _ := containerInfo.Policy.DefaultIPAddress()
+
+	event := collector.ContainerRepaired
+	if err := s.impl.UpdateRules(cacheEntry.version^1, contextID, containerInfo); err != nil {
+		zap.L().Error("Failed to reinstall the rules, retrying at the next interval",
+			zap.String("contextID", contextID),
+			zap.Error(err),
+		)
+		event = collector.ContainerRepairFailed
+	} else if _, err := s.versionTracker.LockedModify(contextID, add, containerInfo); err != nil {
+		zap.L().Warn("Failed to update the rule version cache", zap.String("contextID", contextID), zap.Error(err))
+	}
+
+	s.collector.CollectContainerEvent(&collector.ContainerRecord{
+		ContextID: contextID,
+		IPAddress: ip,
+		Tags:      containerInfo.Policy.Annotations(),
+		Event:     event,
+	})
+}
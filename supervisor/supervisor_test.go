@@ -3,12 +3,14 @@ package supervisor
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/aporeto-inc/mock/gomock"
 	"github.com/aporeto-inc/trireme/collector"
 	"github.com/aporeto-inc/trireme/constants"
 	"github.com/aporeto-inc/trireme/enforcer"
 	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
+	"github.com/aporeto-inc/trireme/mock"
 	"github.com/aporeto-inc/trireme/policy"
 	mock_supervisor "github.com/aporeto-inc/trireme/supervisor/mock"
 
@@ -254,3 +256,154 @@ func TestStop(t *testing.T) {
 		})
 	})
 }
+
+// verifyingImplementor is an implementor that reports the given drift
+type verifyingImplementor struct {
+	*mock_supervisor.MockImplementor
+	drift   []string
+	err     error
+	repairs int
+}
+
+func (v *verifyingImplementor) VerifyRules(version int, contextID string, containerInfo *policy.PUInfo) ([]string, error) {
+	return v.drift, v.err
+}
+
+func (v *verifyingImplementor) RepairGlobalRules() ([]string, error) {
+	v.repairs++
+	return nil, nil
+}
+
+func TestReconcile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a supervisor with a PU and an implementor that can verify the rules", t, func() {
+		c := mock_trireme.NewMockEventCollector(ctrl)
+		secrets := secrets.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewWithDefaults("serverID", c, nil, secrets, constants.LocalContainer, "/proc")
+
+		s, _ := NewSupervisor(c, e, constants.LocalContainer, constants.IPTables, []string{"172.17.0.0/16"})
+		So(s, ShouldNotBeNil)
+
+		impl := &verifyingImplementor{MockImplementor: mock_supervisor.NewMockImplementor(ctrl)}
+		s.impl = impl
+
+		puInfo := createPUInfo()
+		impl.EXPECT().ConfigureRules(0, "contextID", puInfo).Return(nil)
+		So(s.Supervise("contextID", puInfo), ShouldBeNil)
+
+		Convey("When the rules did not drift", func() {
+			s.reconcilePU(impl, "contextID")
+
+			Convey("Nothing should be reinstalled", func() {
+				data, err := s.versionTracker.Get("contextID")
+				So(err, ShouldBeNil)
+				So(data.(*cacheData).version, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the rules cannot be verified", func() {
+			impl.err = fmt.Errorf("Error")
+			s.reconcilePU(impl, "contextID")
+
+			Convey("Nothing should be reinstalled", func() {
+				data, err := s.versionTracker.Get("contextID")
+				So(err, ShouldBeNil)
+				So(data.(*cacheData).version, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the global rules are reconciled", func() {
+			s.reconcileGlobal(impl)
+
+			Convey("The implementor should repair them", func() {
+				So(impl.repairs, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the rules drifted", func() {
+			impl.drift = []string{"-t mangle -N TRIREME-App-contextID-0: missing chain"}
+
+			var record *collector.ContainerRecord
+			impl.EXPECT().UpdateRules(1, "contextID", puInfo).Return(nil)
+			c.EXPECT().CollectContainerEvent(gomock.Any()).Do(func(r *collector.ContainerRecord) {
+				record = r
+			})
+
+			s.reconcilePU(impl, "contextID")
+
+			Convey("The rules should be reinstalled as a new version and the repair reported", func() {
+				data, err := s.versionTracker.Get("contextID")
+				So(err, ShouldBeNil)
+				So(data.(*cacheData).version, ShouldEqual, 1)
+				So(record, ShouldNotBeNil)
+				So(record.ContextID, ShouldEqual, "contextID")
+				So(record.IPAddress, ShouldEqual, "172.17.0.1")
+				So(record.Event, ShouldEqual, collector.ContainerRepaired)
+			})
+		})
+
+		Convey("When the rules drifted and cannot be reinstalled", func() {
+			impl.drift = []string{"-t mangle -N TRIREME-App-contextID-0: missing chain"}
+
+			records := []*collector.ContainerRecord{}
+			impl.EXPECT().UpdateRules(1, "contextID", puInfo).Return(fmt.Errorf("Error"))
+			c.EXPECT().CollectContainerEvent(gomock.Any()).Do(func(r *collector.ContainerRecord) {
+				records = append(records, r)
+			}).AnyTimes()
+
+			s.reconcilePU(impl, "contextID")
+
+			Convey("The PU should keep its version and the failure reported", func() {
+				data, err := s.versionTracker.Get("contextID")
+				So(err, ShouldBeNil)
+				So(data.(*cacheData).version, ShouldEqual, 0)
+				So(len(records), ShouldEqual, 1)
+				So(records[0].Event, ShouldEqual, collector.ContainerRepairFailed)
+			})
+
+			Convey("The repair should be retried at the next interval", func() {
+				impl.EXPECT().UpdateRules(1, "contextID", puInfo).Return(nil)
+
+				s.reconcilePU(impl, "contextID")
+
+				data, err := s.versionTracker.Get("contextID")
+				So(err, ShouldBeNil)
+				So(data.(*cacheData).version, ShouldEqual, 1)
+				So(len(records), ShouldEqual, 2)
+				So(records[1].Event, ShouldEqual, collector.ContainerRepaired)
+			})
+		})
+
+		Convey("When the supervisor is started", func() {
+			s.reconcileInterval = 10 * time.Millisecond
+			impl.drift = []string{"-t mangle -N TRIREME-App-contextID-0: missing chain"}
+
+			repaired := make(chan struct{})
+			impl.EXPECT().Start().Return(nil)
+			impl.EXPECT().SetTargetNetworks([]string{}, []string{"172.17.0.0/16"}).Return(nil)
+			impl.EXPECT().UpdateRules(1, "contextID", puInfo).Do(func(version int, contextID string, containerInfo *policy.PUInfo) {
+				impl.drift = nil
+			}).Return(nil)
+			c.EXPECT().CollectContainerEvent(gomock.Any()).Do(func(r *collector.ContainerRecord) {
+				close(repaired)
+			})
+
+			So(s.Start(), ShouldBeNil)
+
+			Convey("The drift should be repaired in the background", func() {
+				select {
+				case <-repaired:
+				case <-time.After(5 * time.Second):
+				}
+				impl.EXPECT().Stop().Return(nil)
+				So(s.Stop(), ShouldBeNil)
+
+				data, err := s.versionTracker.Get("contextID")
+				So(err, ShouldBeNil)
+				So(data.(*cacheData).version, ShouldEqual, 1)
+			})
+		})
+	})
+}
@@ -2,6 +2,11 @@ package trireme
 
 import (
 	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -10,15 +15,32 @@ import (
 	"github.com/aporeto-inc/trireme/constants"
 	"github.com/aporeto-inc/trireme/enforcer"
 	"github.com/aporeto-inc/trireme/enforcer/proxy"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
 	"github.com/aporeto-inc/trireme/monitor"
 	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/processmon"
 	"github.com/aporeto-inc/trireme/supervisor"
+	"github.com/aporeto-inc/trireme/supervisor/proxy"
+)
+
+var (
+	// updateWorkers is the number of policies that UpdatePolicies updates at
+	// a time
+	updateWorkers = 16
+	// respawnAttempts is the number of attempts to launch a remote enforcer
+	// that exited again
+	respawnAttempts = 6
+	// respawnBackoff is the delay after the first failed attempt. It doubles
+	// after each failure
+	respawnBackoff = time.Second
 )
 
 // trireme contains references to all the different components involved.
 type trireme struct {
 	serverID    string
 	cache       cache.DataStore
+	puInfos     cache.DataStore
+	histories   cache.DataStore
 	supervisors map[constants.PUType]supervisor.Supervisor
 	enforcers   map[constants.PUType]enforcer.PolicyEnforcer
 	resolver    PolicyResolver
@@ -31,6 +53,8 @@ func NewTrireme(serverID string, resolver PolicyResolver, supervisors map[consta
 	t := &trireme{
 		serverID:    serverID,
 		cache:       cache.NewCache(),
+		puInfos:     cache.NewCache(),
+		histories:   cache.NewCache(),
 		supervisors: supervisors,
 		enforcers:   enforcers,
 		resolver:    resolver,
@@ -58,6 +82,11 @@ func (t *trireme) Start() error {
 		}
 	}
 
+	// The remote enforcers that exit are launched again
+	if t.hasRemoteEnforcers() {
+		processmon.GetProcessManagerHdl().SetExitHandler(t.respawnEnforcer)
+	}
+
 	return nil
 }
 
@@ -65,6 +94,10 @@ func (t *trireme) Start() error {
 // for PU Creation/Update and Policy Updates
 func (t *trireme) Stop() error {
 
+	if t.hasRemoteEnforcers() {
+		processmon.GetProcessManagerHdl().SetExitHandler(nil)
+	}
+
 	for _, s := range t.supervisors {
 		if err := s.Stop(); err != nil {
 			zap.L().Error("Error when stopping the supervisor", zap.Error(err))
@@ -92,6 +125,8 @@ func (t *trireme) HandlePUEvent(contextID string, event monitor.Event) error {
 		return t.doHandleCreate(contextID)
 	case monitor.EventStop:
 		return t.doHandleDelete(contextID)
+	case monitor.EventUpdate:
+		return t.doHandleUpdate(contextID)
 	default:
 		return nil
 	}
@@ -100,7 +135,87 @@ func (t *trireme) HandlePUEvent(contextID string, event monitor.Event) error {
 // UpdatePolicy updates a policy for an already activated PU. The PU is identified by the contextID
 func (t *trireme) UpdatePolicy(contextID string, newPolicy *policy.PUPolicy) error {
 
-	return t.doUpdatePolicy(contextID, newPolicy)
+	return t.doUpdatePolicy(contextID, newPolicy, false)
+}
+
+// UpdatePolicies updates the policies of several PUs, with at most
+// updateWorkers updates at a time. The remote enforcers get the policy of their
+// PU in a single call.
+func (t *trireme) UpdatePolicies(policies map[string]*policy.PUPolicy) map[string]error {
+
+	report := make(map[string]error, len(policies))
+	contextIDs := make(chan string)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	workers := updateWorkers
+	if len(policies) < workers {
+		workers = len(policies)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for contextID := range contextIDs {
+				var err error
+				if newPolicy := policies[contextID]; newPolicy == nil {
+					err = fmt.Errorf("Policy cannot be nil: context=%s", contextID)
+				} else {
+					err = t.doUpdatePolicy(contextID, newPolicy, true)
+				}
+
+				lock.Lock()
+				report[contextID] = err
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for contextID := range policies {
+		contextIDs <- contextID
+	}
+	close(contextIDs)
+
+	wg.Wait()
+
+	return report
+}
+
+// PolicyHistory returns the last policies applied to a PU, from the oldest to
+// the latest
+func (t *trireme) PolicyHistory(contextID string) ([]*PolicyVersion, error) {
+
+	history, err := t.histories.Get(contextID)
+	if err != nil {
+		return nil, fmt.Errorf("No policy history for contextID %s", contextID)
+	}
+
+	return history.(*policyHistory).list(), nil
+}
+
+// RollbackPolicy applies again a version of the policy of a PU from its
+// history. It is recorded as a new version of the policy once it is applied.
+func (t *trireme) RollbackPolicy(contextID string, version int) error {
+
+	history, err := t.histories.Get(contextID)
+	if err != nil {
+		return fmt.Errorf("No policy history for contextID %s", contextID)
+	}
+
+	v, err := history.(*policyHistory).get(version)
+	if err != nil {
+		return err
+	}
+
+	// A policy that allows all the traffic is not enforced by an update
+	if v.Policy.TriremeAction() == policy.AllowAll {
+		return fmt.Errorf("Policy version %d allows all traffic and can not be applied to contextID %s", version, contextID)
+	}
+
+	return t.doUpdatePolicy(contextID, v.Policy, false)
 }
 
 // PURuntime returns the RuntimeInfo based on the contextID.
@@ -170,6 +285,56 @@ func (t *trireme) doHandleCreate(contextID string) error {
 	runtimeInfo.GlobalLock.Lock()
 	defer runtimeInfo.GlobalLock.Unlock()
 
+	applied, err := t.createPU(contextID, runtimeInfo)
+	if err != nil || applied == nil {
+		return err
+	}
+
+	t.recordPolicy(contextID, applied)
+
+	return nil
+}
+
+// doHandleUpdate resolves the policy of a started PU again for its updated
+// runtime, and applies it as a policy update. If the update fails, the PU keeps
+// its previous policy. A PU that is not enforced yet is created instead.
+func (t *trireme) doHandleUpdate(contextID string) error {
+
+	cachedElement, err := t.cache.Get(contextID)
+	if err != nil {
+		return fmt.Errorf("Couldn't get the runtimeInfo from the cache %s", err)
+	}
+
+	runtimeInfo := cachedElement.(*policy.PURuntime)
+	runtimeInfo.GlobalLock.Lock()
+	defer runtimeInfo.GlobalLock.Unlock()
+
+	var applied *policy.PUPolicy
+
+	if _, perr := t.puInfos.Get(contextID); perr != nil {
+		applied, err = t.createPU(contextID, runtimeInfo)
+	} else {
+		policyInfo, rerr := t.resolver.ResolvePolicy(contextID, runtimeInfo)
+		if rerr != nil || policyInfo == nil {
+			return fmt.Errorf("Policy Error for this context: %s. Previous policy kept. %s", contextID, rerr)
+		}
+		applied, err = t.updatePolicy(contextID, runtimeInfo, policyInfo, false)
+	}
+
+	if err != nil || applied == nil {
+		return err
+	}
+
+	t.recordPolicy(contextID, applied)
+
+	return nil
+}
+
+// createPU resolves the policy of a PU and enforces and supervises it. It
+// returns the policy as resolved, or nil if the PU is not policed. The global
+// lock of the runtime must be held.
+func (t *trireme) createPU(contextID string, runtimeInfo *policy.PURuntime) (*policy.PUPolicy, error) {
+
 	policyInfo, err := t.resolver.ResolvePolicy(contextID, runtimeInfo)
 
 	if err != nil || policyInfo == nil {
@@ -180,11 +345,15 @@ func (t *trireme) doHandleCreate(contextID string) error {
 			Event:     collector.ContainerFailed,
 		})
 
-		return fmt.Errorf("Policy Error for this context: %s. Container killed. %s", contextID, err)
+		return nil, fmt.Errorf("Policy Error for this context: %s. Container killed. %s", contextID, err)
 	}
 
 	ip, _ := policyInfo.DefaultIPAddress()
 
+	// The history records the policy as resolved, before the transmitter
+	// label is added, so that it can be applied again
+	resolved := policyInfo.Clone()
+
 	containerInfo := policy.PUInfoFromPolicyAndRuntime(contextID, policyInfo, runtimeInfo)
 
 	addTransmitterLabel(contextID, containerInfo)
@@ -196,7 +365,7 @@ func (t *trireme) doHandleCreate(contextID string) error {
 			Tags:      policyInfo.Annotations(),
 			Event:     collector.ContainerIgnored,
 		})
-		return nil
+		return nil, nil
 	}
 
 	if err := t.enforcers[containerInfo.Runtime.PUType()].Enforce(contextID, containerInfo); err != nil {
@@ -206,7 +375,7 @@ func (t *trireme) doHandleCreate(contextID string) error {
 			Tags:      policyInfo.Annotations(),
 			Event:     collector.ContainerFailed,
 		})
-		return fmt.Errorf("Not able to setup enforcer: %s", err)
+		return nil, fmt.Errorf("Not able to setup enforcer: %s", err)
 	}
 
 	if err := t.supervisors[containerInfo.Runtime.PUType()].Supervise(contextID, containerInfo); err != nil {
@@ -224,9 +393,11 @@ func (t *trireme) doHandleCreate(contextID string) error {
 			Event:     collector.ContainerFailed,
 		})
 
-		return fmt.Errorf("Not able to setup supervisor: %s", err)
+		return nil, fmt.Errorf("Not able to setup supervisor: %s", err)
 	}
 
+	t.puInfos.AddOrUpdate(contextID, containerInfo)
+
 	t.collector.CollectContainerEvent(&collector.ContainerRecord{
 		ContextID: contextID,
 		IPAddress: ip,
@@ -234,7 +405,21 @@ func (t *trireme) doHandleCreate(contextID string) error {
 		Event:     collector.ContainerStart,
 	})
 
-	return nil
+	return resolved, nil
+}
+
+// recordPolicy adds a policy to the history of a PU once it is applied. The
+// history survives the re-initialization of the PU after its remote enforcer
+// was lost.
+func (t *trireme) recordPolicy(contextID string, applied *policy.PUPolicy) {
+
+	history, err := t.histories.Get(contextID)
+	if err != nil {
+		history = newPolicyHistory()
+		t.histories.AddOrUpdate(contextID, history)
+	}
+
+	history.(*policyHistory).add(applied)
 }
 
 func (t *trireme) doHandleDelete(contextID string) error {
@@ -268,6 +453,9 @@ func (t *trireme) doHandleDelete(contextID string) error {
 		)
 	}
 
+	t.puInfos.Remove(contextID)   // nolint
+	t.histories.Remove(contextID) // nolint
+
 	if errS != nil || errE != nil {
 		t.collector.CollectContainerEvent(&collector.ContainerRecord{
 			ContextID: contextID,
@@ -289,7 +477,9 @@ func (t *trireme) doHandleDelete(contextID string) error {
 	return nil
 }
 
-func (t *trireme) doUpdatePolicy(contextID string, newPolicy *policy.PUPolicy) error {
+// doUpdatePolicy applies a new policy to a PU. If batch is set, the remote
+// enforcers get it in a single call, and in two phases if that call fails.
+func (t *trireme) doUpdatePolicy(contextID string, newPolicy *policy.PUPolicy, batch bool) error {
 
 	runtimeReader, err := t.PURuntime(contextID)
 	if err != nil {
@@ -301,58 +491,263 @@ func (t *trireme) doUpdatePolicy(contextID string, newPolicy *policy.PUPolicy) e
 	runtime.GlobalLock.Lock()
 	defer runtime.GlobalLock.Unlock()
 
+	applied, err := t.updatePolicy(contextID, runtime, newPolicy, batch)
+	if err != nil || applied == nil {
+		return err
+	}
+
+	t.recordPolicy(contextID, applied)
+
+	return nil
+}
+
+// updatePolicy applies a new policy to a PU and returns the policy that was
+// applied, or nil if the PU is not policed. The global lock of the runtime
+// must be held.
+func (t *trireme) updatePolicy(contextID string, runtime *policy.PURuntime, newPolicy *policy.PUPolicy, batch bool) (*policy.PUPolicy, error) {
+
+	requested := newPolicy.Clone()
+
 	containerInfo := policy.PUInfoFromPolicyAndRuntime(contextID, newPolicy, runtime)
 
 	addTransmitterLabel(contextID, containerInfo)
 
 	if !mustEnforce(contextID, containerInfo) {
-		return nil
+		return nil, nil
 	}
 
-	if err = t.enforcers[containerInfo.Runtime.PUType()].Enforce(contextID, containerInfo); err != nil {
+	puType := containerInfo.Runtime.PUType()
+
+	// The policy is applied in two phases, first by the enforcer and then by
+	// the supervisor. If a phase fails, both get the previous policy again.
+	var previous *policy.PUInfo
+	if cachedElement, perr := t.puInfos.Get(contextID); perr == nil {
+		previous = cachedElement.(*policy.PUInfo)
+	}
+
+	if batch && t.enforceAndSupervise(contextID, puType, containerInfo) {
+		t.policyUpdated(contextID, containerInfo)
+		return requested, nil
+	}
+
+	if err := t.enforcers[puType].Enforce(contextID, containerInfo); err != nil {
 		//We lost communication with the remote and killed it lets restart it here by feeding a create event in the request channel
-		zap.L().Warn("Re-initializing enforcers - connection lost")
-		if containerInfo.Runtime.PUType() == constants.ContainerPU {
+		if _, ok := t.enforcers[puType].(*enforcerproxy.ProxyInfo); ok && puType == constants.ContainerPU {
+			zap.L().Warn("Re-initializing enforcers - connection lost")
 			//The unsupervise and unenforce functions just make changes to the proxy structures
 			//and do not depend on the remote instance running and can be called here
-			switch t.enforcers[containerInfo.Runtime.PUType()].(type) {
-			case *enforcerproxy.ProxyInfo:
-				if lerr := t.enforcers[containerInfo.Runtime.PUType()].Unenforce(contextID); lerr != nil {
-					return err
-				}
+			if lerr := t.enforcers[puType].Unenforce(contextID); lerr != nil {
+				return nil, err
+			}
 
-				if lerr := t.supervisors[containerInfo.Runtime.PUType()].Unsupervise(contextID); lerr != nil {
-					return err
-				}
+			if lerr := t.supervisors[puType].Unsupervise(contextID); lerr != nil {
+				return nil, err
+			}
 
-				if lerr := t.doHandleCreate(contextID); lerr != nil {
-					return err
-				}
-			default:
-				return err
+			// The PU is created again with the policy of the resolver
+			applied, lerr := t.createPU(contextID, runtime)
+			if lerr != nil {
+				return nil, err
 			}
-			return nil
+
+			return applied, nil
 		}
 
-		return fmt.Errorf("Enforcer failed to update PU policy: context=%s error=%s", contextID, err)
+		t.revertPolicy(contextID, puType, previous, false)
+
+		return nil, fmt.Errorf("Enforcer failed to update PU policy: context=%s error=%s", contextID, err)
 	}
 
-	if err = t.supervisors[containerInfo.Runtime.PUType()].Supervise(contextID, containerInfo); err != nil {
-		if werr := t.enforcers[containerInfo.Runtime.PUType()].Unenforce(contextID); werr != nil {
+	if err := t.supervisors[puType].Supervise(contextID, containerInfo); err != nil {
+		t.revertPolicy(contextID, puType, previous, true)
+
+		return nil, fmt.Errorf("Supervisor failed to update PU policy: context=%s error=%s", contextID, err)
+	}
+
+	t.policyUpdated(contextID, containerInfo)
+
+	return requested, nil
+}
+
+// enforceAndSupervise applies a policy with a single call to the remote
+// enforcer of a PU. It returns false if the PU has no remote enforcer or if the
+// call failed, so that the policy is applied in two phases instead.
+func (t *trireme) enforceAndSupervise(contextID string, puType constants.PUType, containerInfo *policy.PUInfo) bool {
+
+	proxy, ok := t.enforcers[puType].(*enforcerproxy.ProxyInfo)
+	if !ok {
+		return false
+	}
+
+	if _, ok := t.supervisors[puType].(*supervisorproxy.ProxyInfo); !ok {
+		return false
+	}
+
+	if err := proxy.EnforceAndSupervise(contextID, containerInfo); err != nil {
+		zap.L().Debug("Failed to update policy in a single call, updating it in two phases",
+			zap.String("contextID", contextID),
+			zap.Error(err),
+		)
+		return false
+	}
+
+	return true
+}
+
+// policyUpdated keeps the policy that was applied to a PU and reports the update
+func (t *trireme) policyUpdated(contextID string, containerInfo *policy.PUInfo) {
+
+	t.puInfos.AddOrUpdate(contextID, containerInfo)
+
+	ip, _ := containerInfo.Policy.DefaultIPAddress()
+	t.collector.CollectContainerEvent(&collector.ContainerRecord{
+		ContextID: contextID,
+		IPAddress: ip,
+		Tags:      containerInfo.Runtime.Tags(),
+		Event:     collector.ContainerUpdate,
+	})
+}
+
+// revertPolicy applies the previous policy of a PU again after an update
+// failed, on the enforcer and, if supervised is set, on the supervisor. A PU
+// without a previous policy is not enforced anymore once supervised.
+func (t *trireme) revertPolicy(contextID string, puType constants.PUType, previous *policy.PUInfo, supervised bool) {
+
+	if previous == nil {
+		if !supervised {
+			return
+		}
+		if err := t.enforcers[puType].Unenforce(contextID); err != nil {
 			zap.L().Warn("Failed to clean up after enforcerments failures",
 				zap.String("contextID", contextID),
-				zap.Error(werr),
+				zap.Error(err),
 			)
 		}
-		return fmt.Errorf("Supervisor failed to update PU policy: context=%s error=%s", contextID, err)
+		return
+	}
+
+	if err := t.enforcers[puType].Enforce(contextID, previous); err != nil {
+		zap.L().Error("Failed to revert enforcer to the previous policy",
+			zap.String("contextID", contextID),
+			zap.Error(err),
+		)
+	}
+
+	if !supervised {
+		return
+	}
+
+	if err := t.supervisors[puType].Supervise(contextID, previous); err != nil {
+		zap.L().Error("Failed to revert supervisor to the previous policy",
+			zap.String("contextID", contextID),
+			zap.Error(err),
+		)
+	}
+}
+
+// hasRemoteEnforcers returns true if the PUs of a type are enforced by
+// remote enforcers
+func (t *trireme) hasRemoteEnforcers() bool {
+
+	for _, e := range t.enforcers {
+		if _, ok := e.(*enforcerproxy.ProxyInfo); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// respawnEnforcer launches the remote enforcer of a PU again after it exited.
+// The new enforcer is initialized and gets the last policy of the PU, so that
+// the traffic of the PU is processed again. The attempts are spaced out
+// exponentially and the PU is reported as failed if they all fail.
+func (t *trireme) respawnEnforcer(contextID string, status error) {
+
+	zap.L().Warn("Remote enforcer exited, launching it again",
+		zap.String("contextID", contextID),
+		zap.Error(status),
+	)
+
+	delay := respawnBackoff
+
+	for attempt := 1; attempt <= respawnAttempts; attempt++ {
+
+		err := t.doRespawnEnforcer(contextID)
+		if err == nil {
+			return
+		}
+
+		zap.L().Warn("Failed to launch remote enforcer again",
+			zap.String("contextID", contextID),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+
+		if attempt < respawnAttempts {
+			time.Sleep(delay)
+			delay = delay * 2
+		}
+	}
+
+	zap.L().Error("Giving up launching remote enforcer", zap.String("contextID", contextID))
+
+	t.collector.CollectContainerEvent(&collector.ContainerRecord{
+		ContextID: contextID,
+		IPAddress: "N/A",
+		Tags:      nil,
+		Event:     collector.ContainerFailed,
+	})
+}
+
+// doRespawnEnforcer replays the last policy of a PU on a new remote enforcer.
+// Nothing is done if the PU was deleted in the meantime.
+func (t *trireme) doRespawnEnforcer(contextID string) error {
+
+	runtimeReader, err := t.PURuntime(contextID)
+	if err != nil {
+		return nil
+	}
+
+	runtime := runtimeReader.(*policy.PURuntime)
+
+	// Serialize operations
+	runtime.GlobalLock.Lock()
+	defer runtime.GlobalLock.Unlock()
+
+	cachedElement, err := t.puInfos.Get(contextID)
+	if err != nil {
+		return nil
+	}
+
+	containerInfo := cachedElement.(*policy.PUInfo)
+	puType := containerInfo.Runtime.PUType()
+
+	// The proxies forget the state of the enforcer that exited, so that the
+	// new one is initialized before the policy is sent again
+	if err := t.enforcers[puType].Unenforce(contextID); err != nil {
+		return err
+	}
+
+	if err := t.supervisors[puType].Unsupervise(contextID); err != nil {
+		return err
+	}
+
+	if err := t.enforcers[puType].Enforce(contextID, containerInfo); err != nil {
+		return fmt.Errorf("Not able to setup enforcer: %s", err)
+	}
+
+	if err := t.supervisors[puType].Supervise(contextID, containerInfo); err != nil {
+		return fmt.Errorf("Not able to setup supervisor: %s", err)
 	}
 
-	ip, _ := newPolicy.DefaultIPAddress()
+	ip, _ := containerInfo.Policy.DefaultIPAddress()
+
 	t.collector.CollectContainerEvent(&collector.ContainerRecord{
 		ContextID: contextID,
 		IPAddress: ip,
-		Tags:      containerInfo.Runtime.Tags(),
-		Event:     collector.ContainerUpdate,
+		Tags:      containerInfo.Policy.Annotations(),
+		Event:     collector.ContainerEnforcerRestarted,
 	})
 
 	return nil
@@ -366,3 +761,99 @@ func (t *trireme) Supervisor(kind constants.PUType) supervisor.Supervisor {
 	}
 	return nil
 }
+
+// SimulateFlow evaluates the policy of a flow with the last policies applied to
+// the PUs involved. The PUs do not have to be enforced by the same enforcer.
+func (t *trireme) SimulateFlow(source, destination string, port uint16) (*enforcer.FlowSimulation, error) {
+
+	src, err := t.simulationEndpoint(source)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := t.simulationEndpoint(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	// The transmitter validates the receiver as its enforcer is configured to
+	mutualAuthorization := false
+	if src.PU != nil {
+		if authorizer, ok := t.enforcers[src.PU.Runtime.PUType()].(enforcer.MutualAuthorizer); ok {
+			mutualAuthorization = authorizer.MutualAuthorization()
+		}
+	}
+
+	return enforcer.SimulatePolicyFlow(src, dst, port, mutualAuthorization)
+}
+
+// UpdateSecrets replaces the secrets of every enforcer. An enforcer shared by
+// several PU types is only updated once. The secrets are given to all the
+// enforcers even if one of them fails, and the enforcers whose secrets changed
+// are then rolled back to their previous secrets, so that they keep signing
+// with the same key.
+func (t *trireme) UpdateSecrets(s secrets.Secrets, overlap time.Duration) error {
+
+	updaters := map[enforcer.SecretsUpdater]constants.PUType{}
+
+	for puType, e := range t.enforcers {
+
+		updater, ok := e.(enforcer.SecretsUpdater)
+		if !ok {
+			return fmt.Errorf("Enforcer for PU type %d does not support secrets updates", puType)
+		}
+
+		updaters[updater] = puType
+	}
+
+	previous := map[enforcer.SecretsUpdater]secrets.Secrets{}
+	for updater := range updaters {
+		previous[updater] = updater.CurrentSecrets()
+	}
+
+	failures := []string{}
+	for updater, puType := range updaters {
+		if err := updater.UpdateSecrets(s, overlap); err != nil {
+			failures = append(failures, fmt.Sprintf("PU type %d: %s", puType, err))
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	// The tokens signed with the new secrets in the meantime are still
+	// accepted for the overlap duration
+	for updater, puType := range updaters {
+
+		if updater.CurrentSecrets() == previous[updater] {
+			continue
+		}
+
+		if err := updater.UpdateSecrets(previous[updater], overlap); err != nil {
+			zap.L().Error("Failed to roll back secrets of enforcer",
+				zap.Int("puType", int(puType)),
+				zap.Error(err),
+			)
+		}
+	}
+
+	sort.Strings(failures)
+
+	return fmt.Errorf("Failed to update secrets of enforcers: %s", strings.Join(failures, ", "))
+}
+
+// simulationEndpoint returns the policy of a PU or the IP address of an
+// external service
+func (t *trireme) simulationEndpoint(endpoint string) (*enforcer.SimulationEndpoint, error) {
+
+	if cachedElement, err := t.puInfos.Get(endpoint); err == nil {
+		return &enforcer.SimulationEndpoint{PU: cachedElement.(*policy.PUInfo)}, nil
+	}
+
+	if ip := net.ParseIP(endpoint); ip != nil {
+		return &enforcer.SimulationEndpoint{IP: ip}, nil
+	}
+
+	return nil, fmt.Errorf("Endpoint %s is neither an enforced PU nor an IP address", endpoint)
+}
@@ -1,12 +1,16 @@
 package trireme
 
 import (
+	"errors"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aporeto-inc/trireme/collector"
 	"github.com/aporeto-inc/trireme/constants"
 	"github.com/aporeto-inc/trireme/enforcer"
+	"github.com/aporeto-inc/trireme/enforcer/utils/secrets"
 	"github.com/aporeto-inc/trireme/monitor"
 	"github.com/aporeto-inc/trireme/policy"
 	"github.com/aporeto-inc/trireme/supervisor"
@@ -360,3 +364,473 @@ func TestTransmitterLabel(t *testing.T) {
 	}
 
 }
+
+func TestSimulateFlow(t *testing.T) {
+
+	tresolver, tsupervisor, tenforcer, _, tcollector := createMocks()
+	tr := NewTrireme("serverID", tresolver, tsupervisor, tenforcer, tcollector)
+
+	if _, err := tr.SimulateFlow("unknown", "10.0.0.1", 80); err == nil {
+		t.Errorf("Expecting an error when simulating a flow of an unknown PU")
+	}
+
+	// Each PU is enforced by its own remote enforcer, the controller knows both policies
+	simulationPU := func(contextID string, ip string, rxRules policy.TagSelectorList) {
+		identity := policy.NewTagStore()
+		identity.AppendKeyValue(enforcer.TransmitterLabel, contextID)
+
+		runtime := policy.NewPURuntimeWithDefaults()
+		runtime.SetIPAddresses(policy.ExtendedMap{policy.DefaultNamespace: ip})
+
+		puPolicy := policy.NewPUPolicy(contextID, policy.Police, nil, nil, nil, rxRules, identity, nil, nil, []string{}, []string{})
+		tr.(*trireme).puInfos.AddOrUpdate(contextID, policy.PUInfoFromPolicyAndRuntime(contextID, puPolicy, runtime))
+	}
+
+	simulationPU("client", "10.1.1.1", nil)
+	simulationPU("server", "10.1.1.2", policy.TagSelectorList{
+		{
+			Clause: []policy.KeyValueOperator{
+				{
+					Key:      enforcer.TransmitterLabel,
+					Value:    []string{"client"},
+					Operator: policy.Equal,
+				},
+			},
+			Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "rx-client"},
+		},
+	})
+
+	result, err := tr.SimulateFlow("client", "server", 80)
+	if err != nil {
+		t.Errorf("Failed to simulate the flow: %s", err)
+	}
+	if result == nil || result.Action != collector.FlowAccept || result.Policy.PolicyID != "rx-client" {
+		t.Errorf("Expecting the flow between the PUs to be accepted but got %+v", result)
+	}
+
+	result, err = tr.SimulateFlow("server", "client", 80)
+	if err != nil {
+		t.Errorf("Failed to simulate the flow: %s", err)
+	}
+	if result == nil || result.Action != collector.FlowReject || result.DropReason != collector.PolicyDrop {
+		t.Errorf("Expecting the flow in the other direction to be rejected by policy but got %+v", result)
+	}
+
+	result, err = tr.SimulateFlow("client", "10.0.0.1", 80)
+	if err != nil {
+		t.Errorf("Failed to simulate the flow: %s", err)
+	}
+	if result == nil || result.Action != collector.FlowReject || result.DropReason != collector.PolicyDrop {
+		t.Errorf("Expecting the flow to an external service to be rejected by policy but got %+v", result)
+	}
+}
+
+func TestUpdateSecrets(t *testing.T) {
+
+	tresolver, tsupervisor, tenforcer, _, tcollector := createMocks()
+	tr := NewTrireme("serverID", tresolver, tsupervisor, tenforcer, tcollector)
+
+	if err := tr.UpdateSecrets(secrets.NewPSKSecrets([]byte("New Test Password")), time.Minute); err == nil {
+		t.Errorf("Expecting an error when the enforcer does not support secrets updates")
+	}
+
+	datapath := enforcer.NewWithDefaults("serverID", tcollector, nil, secrets.NewPSKSecrets([]byte("Dummy Test Password")), constants.LocalContainer, "/proc")
+	tenforcer[constants.ContainerPU] = datapath
+	tenforcer[constants.LinuxProcessPU] = datapath
+
+	if err := tr.UpdateSecrets(secrets.NewPSKSecrets([]byte("New Test Password")), time.Minute); err != nil {
+		t.Errorf("Failed to update the secrets: %s", err)
+	}
+
+	null, _ := secrets.NewNullPKI(nil, nil, nil)
+	if err := tr.UpdateSecrets(null, time.Minute); err == nil {
+		t.Errorf("Expecting an error when the type of the secrets changes")
+	}
+
+	updater := datapath.(enforcer.SecretsUpdater)
+	current := updater.CurrentSecrets()
+	tenforcer[constants.LinuxProcessPU] = &failingSecretsUpdater{PolicyEnforcer: datapath, current: current}
+
+	if err := tr.UpdateSecrets(secrets.NewPSKSecrets([]byte("Newer Test Password")), time.Minute); err == nil {
+		t.Errorf("Expecting an error when an enforcer fails to update the secrets")
+	}
+
+	if updater.CurrentSecrets() != current {
+		t.Errorf("Secrets of the enforcer were not rolled back")
+	}
+}
+
+// failingSecretsUpdater is an enforcer that fails to update its secrets
+type failingSecretsUpdater struct {
+	enforcer.PolicyEnforcer
+	current secrets.Secrets
+}
+
+func (f *failingSecretsUpdater) UpdateSecrets(s secrets.Secrets, overlap time.Duration) error {
+	return errors.New("Failed to update secrets")
+}
+
+func (f *failingSecretsUpdater) CurrentSecrets() secrets.Secrets {
+	return f.current
+}
+
+func TestRespawnEnforcer(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor, tcollector := createMocks()
+	tr := NewTrireme("serverID", tresolver, tsupervisor, tenforcer, tcollector)
+	if err := tr.Start(); err != nil {
+		t.Errorf("Failed to start trireme")
+	}
+	contextID := "123123"
+	runtime := policy.NewPURuntimeWithDefaults()
+
+	testSupervisor := tsupervisor[constants.ContainerPU].(supervisor.TestSupervisor)
+	testEnforcer := tenforcer[constants.ContainerPU].(enforcer.TestPolicyEnforcer)
+
+	doTestCreate(t, tr, tresolver, testSupervisor, testEnforcer, tmonitor, contextID, runtime)
+
+	calls := []string{}
+	failures := 2
+
+	testEnforcer.MockUnenforce(t, func(id string) error {
+		calls = append(calls, "unenforce")
+		return nil
+	})
+	testSupervisor.MockUnsupervise(t, func(id string) error {
+		calls = append(calls, "unsupervise")
+		return nil
+	})
+	testEnforcer.MockEnforce(t, func(id string, puInfo *policy.PUInfo) error {
+		calls = append(calls, "enforce")
+		if !reflect.DeepEqual(runtime, puInfo.Runtime) {
+			t.Errorf("Runtime given to Enforcer is not the same. Received %v, expected %v", puInfo.Runtime, runtime)
+		}
+		if failures > 0 {
+			failures--
+			return errors.New("Failed to launch")
+		}
+		return nil
+	})
+	testSupervisor.MockSupervise(t, func(id string, puInfo *policy.PUInfo) error {
+		calls = append(calls, "supervise")
+		return nil
+	})
+
+	backoff := respawnBackoff
+	respawnBackoff = time.Millisecond
+	defer func() { respawnBackoff = backoff }()
+
+	tr.(*trireme).respawnEnforcer(contextID, nil)
+
+	expected := []string{
+		"unenforce", "unsupervise", "enforce",
+		"unenforce", "unsupervise", "enforce",
+		"unenforce", "unsupervise", "enforce", "supervise",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Respawn expected to replay the policy after two failures, got %v", calls)
+	}
+
+	// A PU that is deleted is not enforced again
+	doTestDelete(t, tr, tresolver, testSupervisor, testEnforcer, tmonitor, contextID, runtime)
+
+	calls = []string{}
+	tr.(*trireme).respawnEnforcer(contextID, nil)
+	if len(calls) != 0 {
+		t.Errorf("Respawn of a deleted PU expected to do nothing, got %v", calls)
+	}
+}
+
+func TestPolicyHistory(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor, tcollector := createMocks()
+	tr := NewTrireme("serverID", tresolver, tsupervisor, tenforcer, tcollector)
+	if err := tr.Start(); err != nil {
+		t.Errorf("Failed to start trireme")
+	}
+	contextID := "123123"
+	runtime := policy.NewPURuntimeWithDefaults()
+
+	testSupervisor := tsupervisor[constants.ContainerPU].(supervisor.TestSupervisor)
+	testEnforcer := tenforcer[constants.ContainerPU].(enforcer.TestPolicyEnforcer)
+
+	if _, err := tr.PolicyHistory(contextID); err == nil {
+		t.Errorf("Expecting an error for the history of an unknown PU")
+	}
+
+	doTestCreate(t, tr, tresolver, testSupervisor, testEnforcer, tmonitor, contextID, runtime)
+
+	history := maxPolicyHistory
+	maxPolicyHistory = 3
+	defer func() { maxPolicyHistory = history }()
+
+	applied := []string{}
+	testEnforcer.MockEnforce(t, func(id string, puInfo *policy.PUInfo) error {
+		applied = append(applied, puInfo.Policy.ManagementID())
+		return nil
+	})
+
+	ipl := policy.ExtendedMap{policy.DefaultNamespace: "127.0.0.1"}
+	for _, id := range []string{"v2", "v3", "v4"} {
+		if err := tr.UpdatePolicy(contextID, policy.NewPUPolicy(id, policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil, nil)); err != nil {
+			t.Errorf("Update was supposed to be nil, was %s", err)
+		}
+	}
+
+	versions, err := tr.PolicyHistory(contextID)
+	if err != nil {
+		t.Errorf("Failed to get the history: %s", err)
+	}
+	if len(versions) != 3 || versions[0].Version != 2 || versions[2].Version != 4 {
+		t.Errorf("History expected to keep versions 2 to 4, got %v", versions)
+	}
+	if versions[0].Hash == versions[1].Hash || versions[0].Hash != versions[0].Policy.Hash() {
+		t.Errorf("History expected to have the hashes of the policies, got %v", versions)
+	}
+
+	// Changing a version does not change the history
+	versions[0].Policy.SetTriremeAction(policy.AllowAll)
+	hash := versions[0].Hash
+
+	if err := tr.RollbackPolicy(contextID, 1); err == nil {
+		t.Errorf("Expecting an error when rolling back to a version out of the history")
+	}
+
+	if err := tr.RollbackPolicy(contextID, 2); err != nil {
+		t.Errorf("Rollback was supposed to be nil, was %s", err)
+	}
+	if applied[len(applied)-1] != "v2" {
+		t.Errorf("Rollback expected to enforce the policy of version 2, got %v", applied)
+	}
+
+	versions, _ = tr.PolicyHistory(contextID) // nolint
+	latest := versions[len(versions)-1]
+	if latest.Version != 5 || latest.Hash != hash {
+		t.Errorf("Rollback expected to be recorded as version 5 of the policy, got %v", versions)
+	}
+
+	// A policy that allows all the traffic is not applied by an update
+	if err := tr.UpdatePolicy(contextID, policy.NewPUPolicy("v6", policy.AllowAll, nil, nil, nil, nil, nil, nil, ipl, nil, nil)); err != nil {
+		t.Errorf("Update was supposed to be nil, was %s", err)
+	}
+
+	versions, _ = tr.PolicyHistory(contextID) // nolint
+	if versions[len(versions)-1].Version != 5 {
+		t.Errorf("Policy that is not applied expected not to be recorded, got %v", versions)
+	}
+
+	doTestDelete(t, tr, tresolver, testSupervisor, testEnforcer, tmonitor, contextID, runtime)
+
+	if _, err := tr.PolicyHistory(contextID); err == nil {
+		t.Errorf("Expecting the history to be removed with the PU")
+	}
+}
+
+func TestUpdatePolicyRevert(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor, tcollector := createMocks()
+	tr := NewTrireme("serverID", tresolver, tsupervisor, tenforcer, tcollector)
+	if err := tr.Start(); err != nil {
+		t.Errorf("Failed to start trireme")
+	}
+	contextID := "123123"
+	runtime := policy.NewPURuntimeWithDefaults()
+
+	testSupervisor := tsupervisor[constants.ContainerPU].(supervisor.TestSupervisor)
+	testEnforcer := tenforcer[constants.ContainerPU].(enforcer.TestPolicyEnforcer)
+
+	doTestCreate(t, tr, tresolver, testSupervisor, testEnforcer, tmonitor, contextID, runtime)
+
+	calls := []string{}
+	testEnforcer.MockEnforce(t, func(id string, puInfo *policy.PUInfo) error {
+		calls = append(calls, "enforce "+puInfo.Policy.ManagementID())
+		return nil
+	})
+	testEnforcer.MockUnenforce(t, func(id string) error {
+		calls = append(calls, "unenforce")
+		return nil
+	})
+	testSupervisor.MockSupervise(t, func(id string, puInfo *policy.PUInfo) error {
+		calls = append(calls, "supervise "+puInfo.Policy.ManagementID())
+		if puInfo.Policy.ManagementID() == "new" {
+			return errors.New("Failed to supervise")
+		}
+		return nil
+	})
+
+	ipl := policy.ExtendedMap{policy.DefaultNamespace: "127.0.0.1"}
+	if err := tr.UpdatePolicy(contextID, policy.NewPUPolicy("new", policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil, nil)); err == nil {
+		t.Errorf("Expecting an error when the supervisor fails")
+	}
+
+	expected := []string{"enforce new", "supervise new", "enforce SomeId", "supervise SomeId"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Update expected to revert the enforcer and the supervisor, got %v", calls)
+	}
+
+	versions, _ := tr.PolicyHistory(contextID) // nolint
+	if len(versions) != 1 || versions[0].Policy.ManagementID() != "SomeId" {
+		t.Errorf("Failed update expected not to be recorded, got %v", versions)
+	}
+
+	calls = []string{}
+	testEnforcer.MockEnforce(t, func(id string, puInfo *policy.PUInfo) error {
+		calls = append(calls, "enforce "+puInfo.Policy.ManagementID())
+		if puInfo.Policy.ManagementID() == "new" {
+			return errors.New("Failed to enforce")
+		}
+		return nil
+	})
+
+	if err := tr.UpdatePolicy(contextID, policy.NewPUPolicy("new", policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil, nil)); err == nil {
+		t.Errorf("Expecting an error when the enforcer fails")
+	}
+
+	expected = []string{"enforce new", "enforce SomeId"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Update expected to revert the enforcer only, got %v", calls)
+	}
+}
+
+func TestRuntimeUpdate(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor, tcollector := createMocks()
+	tr := NewTrireme("serverID", tresolver, tsupervisor, tenforcer, tcollector)
+	if err := tr.Start(); err != nil {
+		t.Errorf("Failed to start trireme")
+	}
+	contextID := "123123"
+	runtime := policy.NewPURuntimeWithDefaults()
+
+	testSupervisor := tsupervisor[constants.ContainerPU].(supervisor.TestSupervisor)
+	testEnforcer := tenforcer[constants.ContainerPU].(enforcer.TestPolicyEnforcer)
+
+	doTestCreate(t, tr, tresolver, testSupervisor, testEnforcer, tmonitor, contextID, runtime)
+
+	ipl := policy.ExtendedMap{policy.DefaultNamespace: "127.0.0.1"}
+	tresolver.MockResolvePolicy(t, func(id string, runtimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		return policy.NewPUPolicy("updated", policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil, nil), nil
+	})
+
+	calls := []string{}
+	testEnforcer.MockEnforce(t, func(id string, puInfo *policy.PUInfo) error {
+		calls = append(calls, "enforce "+puInfo.Policy.ManagementID())
+		return nil
+	})
+	testEnforcer.MockUnenforce(t, func(id string) error {
+		calls = append(calls, "unenforce")
+		return nil
+	})
+	testSupervisor.MockSupervise(t, func(id string, puInfo *policy.PUInfo) error {
+		calls = append(calls, "supervise "+puInfo.Policy.ManagementID())
+		if puInfo.Policy.ManagementID() == "updated" {
+			return errors.New("Failed to supervise")
+		}
+		return nil
+	})
+
+	if err := tr.HandlePUEvent(contextID, monitor.EventUpdate); err == nil {
+		t.Errorf("Expecting an error when the supervisor fails")
+	}
+
+	expected := []string{"enforce updated", "supervise updated", "enforce SomeId", "supervise SomeId"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Failed runtime update expected to keep the previous policy enforced, got %v", calls)
+	}
+
+	calls = []string{}
+	testSupervisor.MockSupervise(t, func(id string, puInfo *policy.PUInfo) error {
+		calls = append(calls, "supervise "+puInfo.Policy.ManagementID())
+		return nil
+	})
+
+	if err := tr.HandlePUEvent(contextID, monitor.EventUpdate); err != nil {
+		t.Errorf("Runtime update was supposed to be nil, was %s", err)
+	}
+
+	expected = []string{"enforce updated", "supervise updated"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Runtime update expected to update the policy, got %v", calls)
+	}
+
+	versions, _ := tr.PolicyHistory(contextID) // nolint
+	if len(versions) != 2 || versions[1].Policy.ManagementID() != "updated" {
+		t.Errorf("Runtime update expected to be recorded, got %v", versions)
+	}
+}
+
+func TestUpdatePolicies(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor, tcollector := createMocks()
+	tr := NewTrireme("serverID", tresolver, tsupervisor, tenforcer, tcollector)
+	if err := tr.Start(); err != nil {
+		t.Errorf("Failed to start trireme")
+	}
+
+	testSupervisor := tsupervisor[constants.ContainerPU].(supervisor.TestSupervisor)
+	testEnforcer := tenforcer[constants.ContainerPU].(enforcer.TestPolicyEnforcer)
+
+	contextIDs := []string{"pu1", "pu2", "pu3", "pu4"}
+	for _, contextID := range contextIDs {
+		doTestCreate(t, tr, tresolver, testSupervisor, testEnforcer, tmonitor, contextID, policy.NewPURuntimeWithDefaults())
+	}
+
+	workers := updateWorkers
+	updateWorkers = 2
+	defer func() { updateWorkers = workers }()
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+
+	testEnforcer.MockEnforce(t, func(id string, puInfo *policy.PUInfo) error {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+
+		if puInfo.Policy.ManagementID() == "bad" {
+			return errors.New("Failed to enforce")
+		}
+		return nil
+	})
+	testSupervisor.MockSupervise(t, func(id string, puInfo *policy.PUInfo) error {
+		return nil
+	})
+
+	ipl := policy.ExtendedMap{policy.DefaultNamespace: "127.0.0.1"}
+	policies := map[string]*policy.PUPolicy{
+		"pu1":     policy.NewPUPolicy("good", policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil, nil),
+		"pu2":     policy.NewPUPolicy("good", policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil, nil),
+		"pu3":     policy.NewPUPolicy("good", policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil, nil),
+		"pu4":     policy.NewPUPolicy("bad", policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil, nil),
+		"unknown": policy.NewPUPolicy("good", policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil, nil),
+		"nil":     nil,
+	}
+
+	report := tr.UpdatePolicies(policies)
+
+	if len(report) != len(policies) {
+		t.Errorf("Report expected to have an entry per PU, got %v", report)
+	}
+	for _, contextID := range []string{"pu1", "pu2", "pu3"} {
+		if err, ok := report[contextID]; !ok || err != nil {
+			t.Errorf("Update of %s expected to succeed, got %v", contextID, err)
+		}
+	}
+	for _, contextID := range []string{"pu4", "unknown", "nil"} {
+		if report[contextID] == nil {
+			t.Errorf("Update of %s expected to fail", contextID)
+		}
+	}
+	if maxRunning > 2 {
+		t.Errorf("Expected at most 2 updates at a time, got %d", maxRunning)
+	}
+
+	versions, _ := tr.PolicyHistory("pu1") // nolint
+	if len(versions) != 2 || versions[1].Policy.ManagementID() != "good" {
+		t.Errorf("Update of pu1 expected to be recorded, got %v", versions)
+	}
+}